@@ -0,0 +1,156 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cloudflare/pat-app/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Prefix under which every admin endpoint is served
+	adminURIPrefix = "/admin/"
+
+	adminMetricsURI = adminURIPrefix + "metrics"
+
+	// Served without authentication with --metrics-addr
+	metricsURI = "/metrics"
+)
+
+type adminRoute struct {
+	method   string
+	path     string
+	summary  string
+	request  interface{} // value of the JSON request body type, nil for none
+	response interface{} // value of the JSON response body type, nil for none
+	handler  http.HandlerFunc
+}
+
+// adminServer is the administrative surface of a role. Every request must be
+// accepted by one of the authenticators, by default the configured bearer
+// token. Routes are described in an OpenAPI document served at
+// /admin/openapi.json.
+type adminServer struct {
+	name           string
+	authenticators []adminAuthenticator
+	audit          *adminAudit // nil unless an audit log is configured
+	routes         []adminRoute
+	mux            *http.ServeMux
+}
+
+// newAdminServer creates the admin surface of a role, accepting the bearer
+// token unless it is empty.
+func newAdminServer(name, token string) *adminServer {
+	s := &adminServer{
+		name:           name,
+		authenticators: make([]adminAuthenticator, 0),
+		routes:         make([]adminRoute, 0),
+		mux:            http.NewServeMux(),
+	}
+	if token != "" {
+		s.authenticate(bearerAuthenticator(token))
+	}
+	s.handle(http.MethodGet, adminOpenAPIURI, "OpenAPI description of the admin API", nil, map[string]interface{}{}, s.handleOpenAPI)
+	s.handle(http.MethodGet, adminMetricsURI, "Metrics and runtime statistics in the Prometheus text format", nil, nil, handleMetrics)
+	s.handle(http.MethodGet, adminGoroutinesURI, "Stacks of all goroutines, aggregated, in the pprof text format", nil, nil, handleGoroutineProfile)
+	s.handle(http.MethodGet, adminHeapURI, "Heap profile in the pprof format", nil, nil, handleHeapProfile)
+	return s
+}
+
+// authenticate adds a way for requests to authenticate.
+func (s *adminServer) authenticate(authenticator adminAuthenticator) {
+	s.authenticators = append(s.authenticators, authenticator)
+}
+
+// handle registers an admin endpoint for a single method. The request and
+// response values document the JSON body types of the endpoint.
+func (s *adminServer) handle(method, path, summary string, request, response interface{}, handler http.HandlerFunc) {
+	route := adminRoute{
+		method:   method,
+		path:     path,
+		summary:  summary,
+		request:  request,
+		response: response,
+		handler:  handler,
+	}
+	s.routes = append(s.routes, route)
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != route.method {
+			w.Header().Set("Allow", route.method)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		route.handler(w, req)
+	})
+}
+
+// principal returns who sent the request, and false if no authenticator
+// accepts it.
+func (s *adminServer) principal(req *http.Request) (string, bool) {
+	for _, authenticator := range s.authenticators {
+		if principal, ok := authenticator.verify(req); ok {
+			return principal, true
+		}
+	}
+	return "", false
+}
+
+func (s *adminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Bodies are read before authentication, for the audit log and HMAC
+	// signatures, so any peer can send them
+	if req.Body != nil {
+		req.Body = http.MaxBytesReader(w, req.Body, adminMaxBody)
+	}
+	body, err := peekAdminBody(req)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		log.Debugln("Admin request for", req.URL.Path, "from", req.RemoteAddr, "larger than", adminMaxBody, "bytes")
+		s.audit.record(s.name, "", req, nil, http.StatusRequestEntityTooLarge, time.Now())
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	principal, ok := s.principal(req)
+	if !ok {
+		log.Debugln("Unauthorized admin request for", req.URL.Path, "from", req.RemoteAddr)
+		s.audit.record(s.name, "", req, body, http.StatusUnauthorized, time.Now())
+		for _, authenticator := range s.authenticators {
+			if authenticator.scheme != "" {
+				w.Header().Add("WWW-Authenticate", authenticator.scheme)
+			}
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	log.Infoln("Admin request:", req.Method, req.URL.Path, "from", req.RemoteAddr, "by", principal)
+	recorder := newStatusRecorder(w)
+	s.mux.ServeHTTP(recorder, req)
+	s.audit.record(s.name, principal, req, body, recorder.status, time.Now())
+}
+
+func handleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := metrics.Default.WriteText(w); err != nil {
+		log.Debugln("Failed writing metrics:", err)
+		return
+	}
+	metrics.WriteRuntimeText(w)
+}
+
+func writeAdminJSON(w http.ResponseWriter, value interface{}) {
+	valueEnc, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(valueEnc)
+}
+
+func readAdminJSON(req *http.Request, value interface{}) error {
+	defer req.Body.Close()
+	return json.NewDecoder(req.Body).Decode(value)
+}
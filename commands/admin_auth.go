@@ -0,0 +1,288 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Authorization scheme of HMAC-signed admin requests
+	adminHMACScheme = "PAT-HMAC-SHA256"
+
+	// Largest difference between the signature timestamp and the local clock
+	// unless configured otherwise
+	defaultAdminHMACSkew = 5 * time.Minute
+
+	// Largest request body kept in the audit log
+	adminAuditMaxBody = 4096
+
+	// Largest request body the admin API reads, before authentication
+	adminMaxBody = 1 << 20
+)
+
+// adminAuthenticator identifies the principal sending an admin request.
+type adminAuthenticator struct {
+	scheme string // advertised in WWW-Authenticate, empty for none
+	verify func(req *http.Request) (string, bool)
+}
+
+func bearerAuthenticator(token string) adminAuthenticator {
+	return adminAuthenticator{
+		scheme: "Bearer",
+		verify: func(req *http.Request) (string, bool) {
+			authValue := req.Header.Get("Authorization")
+			if !strings.HasPrefix(authValue, "Bearer ") {
+				return "", false
+			}
+			value := strings.TrimPrefix(authValue, "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(value), []byte(token)) != 1 {
+				return "", false
+			}
+			return "bearer", true
+		},
+	}
+}
+
+// clientCertAuthenticator accepts requests over TLS connections whose client
+// certificate chains to one of the roots, identified by the subject's common
+// name.
+func clientCertAuthenticator(roots *x509.CertPool) adminAuthenticator {
+	return adminAuthenticator{
+		verify: func(req *http.Request) (string, bool) {
+			leaf, err := verifyClientCertificate(req, roots)
+			if err != nil {
+				log.Debugln("Admin client certificate rejected:", err)
+				return "", false
+			}
+			return "cert:" + leaf.Subject.CommonName, true
+		},
+	}
+}
+
+func loadClientCAs(fileNames ...string) (*x509.CertPool, error) {
+	roots := x509.NewCertPool()
+	for _, fileName := range fileNames {
+		pemEnc, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		if !roots.AppendCertsFromPEM(pemEnc) {
+			return nil, fmt.Errorf("No certificates in %s", fileName)
+		}
+	}
+	return roots, nil
+}
+
+// parseAdminHMACKeys parses <key-id>:<hex key> pairs.
+func parseAdminHMACKeys(specs []string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid admin HMAC key %q, expected <key-id>:<hex key>", spec)
+		}
+		key, err := hex.DecodeString(parts[1])
+		if err != nil || len(key) < sha256.Size {
+			return nil, fmt.Errorf("Invalid admin HMAC key %s, expected at least %d hex-encoded bytes", parts[0], sha256.Size)
+		}
+		if _, ok := keys[parts[0]]; ok {
+			return nil, fmt.Errorf("Duplicate admin HMAC key %s", parts[0])
+		}
+		keys[parts[0]] = key
+	}
+	return keys, nil
+}
+
+// adminHMACMessage is the signed representation of a request: the method,
+// request URI, Unix timestamp, and hex-encoded SHA-256 digest of the body,
+// separated by newlines.
+func adminHMACMessage(method, requestURI string, timestamp int64, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	return []byte(method + "\n" + requestURI + "\n" + strconv.FormatInt(timestamp, 10) + "\n" + hex.EncodeToString(digest[:]))
+}
+
+func adminHMACSignature(key, message []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signAdminRequest adds a PAT-HMAC-SHA256 Authorization header to the request.
+func signAdminRequest(req *http.Request, keyID string, key []byte, now time.Time) error {
+	body, err := peekAdminBody(req)
+	if err != nil {
+		return err
+	}
+	timestamp := now.Unix()
+	signature := adminHMACSignature(key, adminHMACMessage(req.Method, req.URL.RequestURI(), timestamp, body))
+	req.Header.Set("Authorization", fmt.Sprintf(`%s key-id="%s", timestamp="%d", signature="%s"`, adminHMACScheme, keyID, timestamp, signature))
+	return nil
+}
+
+// parseAuthParams parses the comma-separated name="value" parameters of an
+// Authorization header value following the scheme.
+func parseAuthParams(value string) map[string]string {
+	params := make(map[string]string)
+	for _, param := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		params[strings.ToLower(parts[0])] = strings.Trim(parts[1], `"`)
+	}
+	return params
+}
+
+// hmacVerifier checks HMAC-signed admin requests. Signatures are accepted
+// once, within skew of their timestamp.
+type hmacVerifier struct {
+	keys map[string][]byte
+	skew time.Duration
+	now  func() time.Time
+
+	lock sync.Mutex
+	seen map[string]time.Time // signature to expiry
+}
+
+func hmacAuthenticator(keys map[string][]byte, skew time.Duration) adminAuthenticator {
+	verifier := &hmacVerifier{
+		keys: keys,
+		skew: skew,
+		now:  time.Now,
+		seen: make(map[string]time.Time),
+	}
+	return adminAuthenticator{
+		scheme: adminHMACScheme,
+		verify: verifier.verify,
+	}
+}
+
+func (v *hmacVerifier) verify(req *http.Request) (string, bool) {
+	authValue := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authValue, adminHMACScheme+" ") {
+		return "", false
+	}
+	params := parseAuthParams(strings.TrimPrefix(authValue, adminHMACScheme+" "))
+	keyID := params["key-id"]
+	key, ok := v.keys[keyID]
+	if !ok {
+		log.Debugln("Unknown admin HMAC key", keyID)
+		return "", false
+	}
+	timestamp, err := strconv.ParseInt(params["timestamp"], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	now := v.now()
+	signedAt := time.Unix(timestamp, 0)
+	if signedAt.Before(now.Add(-v.skew)) || signedAt.After(now.Add(v.skew)) {
+		log.Debugln("Admin HMAC signature outside of the allowed clock skew, signed at", signedAt)
+		clockSkewChecks.Inc(0, skewCheckAdminHMAC, skewResultRefused)
+		return "", false
+	}
+	clockSkewChecks.Inc(0, skewCheckAdminHMAC, skewResultOK)
+	body, err := peekAdminBody(req)
+	if err != nil {
+		return "", false
+	}
+	signature := adminHMACSignature(key, adminHMACMessage(req.Method, req.URL.RequestURI(), timestamp, body))
+	if !hmac.Equal([]byte(signature), []byte(strings.ToLower(params["signature"]))) {
+		return "", false
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for seen, expiry := range v.seen {
+		if now.After(expiry) {
+			delete(v.seen, seen)
+		}
+	}
+	if _, ok := v.seen[signature]; ok {
+		log.Debugln("Replayed admin HMAC signature from key", keyID)
+		return "", false
+	}
+	v.seen[signature] = signedAt.Add(v.skew)
+	return "hmac:" + keyID, true
+}
+
+// peekAdminBody reads the request body and leaves it intact for the handler.
+func peekAdminBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// adminAuditEntry records one admin request, including refused ones.
+type adminAuditEntry struct {
+	Time       time.Time       `json:"time"`
+	Role       string          `json:"role"`
+	Principal  string          `json:"principal,omitempty"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	RemoteAddr string          `json:"remote_addr"`
+	Status     int             `json:"status"`
+	Request    json.RawMessage `json:"request,omitempty"`
+}
+
+// adminAudit appends admin requests as JSON lines.
+type adminAudit struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func newAdminAudit(w io.Writer) *adminAudit {
+	if w == nil {
+		return nil
+	}
+	return &adminAudit{w: w}
+}
+
+// record logs the request. Bodies are kept if they are small JSON documents.
+func (a *adminAudit) record(role, principal string, req *http.Request, body []byte, status int, now time.Time) {
+	if a == nil {
+		return
+	}
+	entry := adminAuditEntry{
+		Time:       now.UTC(),
+		Role:       role,
+		Principal:  principal,
+		Method:     req.Method,
+		Path:       req.URL.RequestURI(),
+		RemoteAddr: req.RemoteAddr,
+		Status:     status,
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && len(body) <= adminAuditMaxBody && json.Valid(body) {
+		entry.Request = json.RawMessage(body)
+	}
+	entryEnc, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorln("Failed encoding admin audit entry:", err)
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err := a.w.Write(append(entryEnc, '\n')); err != nil {
+		log.Errorln("Failed writing admin audit entry:", err)
+	}
+}
@@ -0,0 +1,99 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	attestationVerifyEntryPoint = "pat_verify"
+)
+
+var (
+	// Headers carrying client attestation evidence
+	headerAttestationFormat   = "Sec-Attestation-Format"
+	headerAttestationEvidence = "Sec-Attestation-Evidence"
+
+	ErrMissingAttestation     = errors.New("Missing attestation evidence")
+	ErrUnsupportedAttestation = errors.New("Unsupported attestation format")
+)
+
+// attestationEvidence is what a client presents to prove it is eligible for
+// issuance, in some verifier-specific format.
+type attestationEvidence struct {
+	Format    string `json:"format"`
+	Evidence  []byte `json:"evidence"`
+	ClientID  string `json:"client_id"`
+	TokenType uint16 `json:"token_type"`
+}
+
+// attestationVerdict is a verifier's decision. Attributes of valid evidence,
+// e.g., the client platform, are made available to the policy expression.
+type attestationVerdict struct {
+	Valid      bool              `json:"valid"`
+	Reason     string            `json:"reason"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+type attestationVerifier interface {
+	verify(ctx context.Context, evidence attestationEvidence) (attestationVerdict, error)
+}
+
+// wasmAttestationVerifier delegates verification to a WASM plugin exporting
+// pat_verify, which receives the JSON evidence and returns a JSON verdict.
+type wasmAttestationVerifier struct {
+	plugin *wasmPlugin
+}
+
+func loadWasmAttestationVerifier(path string) (*wasmAttestationVerifier, error) {
+	plugin, err := loadWasmPlugin(context.Background(), path, attestationVerifyEntryPoint)
+	if err != nil {
+		return nil, err
+	}
+	return &wasmAttestationVerifier{
+		plugin: plugin,
+	}, nil
+}
+
+func (v *wasmAttestationVerifier) verify(ctx context.Context, evidence attestationEvidence) (attestationVerdict, error) {
+	verdict := attestationVerdict{}
+	err := v.plugin.call(ctx, attestationVerifyEntryPoint, evidence, &verdict)
+	return verdict, err
+}
+
+// loadAttestationVerifiers parses format=path.wasm plugin specifications.
+func loadAttestationVerifiers(specs []string) (map[string]attestationVerifier, error) {
+	verifiers := make(map[string]attestationVerifier)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid attestation plugin %q, expected format=path.wasm", spec)
+		}
+		verifier, err := loadWasmAttestationVerifier(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		verifiers[parts[0]] = verifier
+	}
+	return verifiers, nil
+}
+
+func readAttestationEvidence(req *http.Request, clientID string, tokenType uint16) (attestationEvidence, error) {
+	format := req.Header.Get(headerAttestationFormat)
+	if format == "" || req.Header.Get(headerAttestationEvidence) == "" {
+		return attestationEvidence{}, ErrMissingAttestation
+	}
+	evidence, err := parseStructuredBinaryHeader(req, headerAttestationEvidence)
+	if err != nil {
+		return attestationEvidence{}, err
+	}
+	return attestationEvidence{
+		Format:    format,
+		Evidence:  evidence,
+		ClientID:  clientID,
+		TokenType: tokenType,
+	}, nil
+}
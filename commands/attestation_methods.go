@@ -0,0 +1,386 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Built-in attestation formats, from weakest to strongest
+	attestationFormatAPIKey          = "api-key"
+	attestationFormatTOTP            = "totp"
+	attestationFormatDeviceStatement = "device-statement"
+
+	// TOTP parameters of RFC 6238, as used by common authenticator apps
+	totpStep        = 30 * time.Second
+	totpDigits      = 6
+	totpWindowSteps = 1 // steps accepted before and after the current one
+
+	// Largest difference between the issuance time of device statements and
+	// the local clock
+	deviceStatementSkew = 5 * time.Minute
+)
+
+// readCredentialLines reads <name>:<value> lines, skipping blank lines and
+// comments starting with #.
+func readCredentialLines(fileName string) ([][2]string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := make([][2]string, 0)
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("Invalid line in %s, expected <name>:<value>", fileName)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("Duplicate name %s in %s", name, fileName)
+		}
+		names[name] = true
+		lines = append(lines, [2]string{name, value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("No credentials in %s", fileName)
+	}
+	return lines, nil
+}
+
+// addAttestationMethods adds the built-in verifiers of the format=file
+// specifications to the verifiers, refusing formats already verified, e.g.,
+// by a plugin.
+func addAttestationMethods(verifiers map[string]attestationVerifier, specs []string) error {
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("Invalid attestation method %q, expected format=file", spec)
+		}
+		if _, ok := verifiers[parts[0]]; ok {
+			return fmt.Errorf("Duplicate attestation format %s", parts[0])
+		}
+		var verifier attestationVerifier
+		var err error
+		switch parts[0] {
+		case attestationFormatAPIKey:
+			verifier, err = loadAPIKeyVerifier(parts[1])
+		case attestationFormatTOTP:
+			verifier, err = loadTOTPVerifier(parts[1])
+		case attestationFormatDeviceStatement:
+			verifier, err = loadDeviceStatementVerifier(parts[1])
+		default:
+			return fmt.Errorf("%w: %s", ErrUnsupportedAttestation, parts[0])
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid %s attestation: %w", parts[0], err)
+		}
+		verifiers[parts[0]] = verifier
+	}
+	return nil
+}
+
+// apiKeyVerifier accepts evidence equal to one of the static API keys, e.g.,
+// handed out to partners. Keys are bearer secrets, so this is the weakest
+// attestation.
+type apiKeyVerifier struct {
+	keys map[string][]byte // by key name
+}
+
+func loadAPIKeyVerifier(fileName string) (*apiKeyVerifier, error) {
+	lines, err := readCredentialLines(fileName)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte)
+	for _, line := range lines {
+		keys[line[0]] = []byte(line[1])
+	}
+	return &apiKeyVerifier{keys: keys}, nil
+}
+
+func (v *apiKeyVerifier) verify(ctx context.Context, evidence attestationEvidence) (attestationVerdict, error) {
+	for name, key := range v.keys {
+		if subtle.ConstantTimeCompare(evidence.Evidence, key) == 1 {
+			return attestationVerdict{Valid: true, Attributes: map[string]string{"api_key": name}}, nil
+		}
+	}
+	return attestationVerdict{Reason: "Unknown API key"}, nil
+}
+
+// totpVerifier accepts <name>:<code> evidence with a time-based one-time
+// password (RFC 6238) of the named secret. Codes are accepted once, so that
+// evidence seen on the wire cannot be replayed.
+type totpVerifier struct {
+	secrets map[string][]byte // by name
+	now     func() time.Time
+
+	lock     sync.Mutex
+	lastStep map[string]uint64 // of the last code accepted, by name
+}
+
+func decodeTOTPSecret(secretEnc string) ([]byte, error) {
+	secretEnc = strings.TrimRight(strings.ToUpper(strings.ReplaceAll(secretEnc, " ", "")), "=")
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secretEnc)
+	if err != nil || len(secret) == 0 {
+		return nil, fmt.Errorf("Invalid TOTP secret, expected base32")
+	}
+	return secret, nil
+}
+
+func loadTOTPVerifier(fileName string) (*totpVerifier, error) {
+	lines, err := readCredentialLines(fileName)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string][]byte)
+	for _, line := range lines {
+		if secrets[line[0]], err = decodeTOTPSecret(line[1]); err != nil {
+			return nil, fmt.Errorf("%s: %w", line[0], err)
+		}
+	}
+	return &totpVerifier{
+		secrets:  secrets,
+		now:      time.Now,
+		lastStep: make(map[string]uint64),
+	}, nil
+}
+
+// totpCode computes the HOTP value (RFC 4226) of the secret at the step.
+func totpCode(secret []byte, step uint64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], step)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code := strconv.FormatUint(uint64(value%1000000), 10)
+	return strings.Repeat("0", totpDigits-len(code)) + code
+}
+
+func (v *totpVerifier) verify(ctx context.Context, evidence attestationEvidence) (attestationVerdict, error) {
+	name, code, ok := strings.Cut(string(evidence.Evidence), ":")
+	secret, known := v.secrets[name]
+	if !ok || !known {
+		return attestationVerdict{Reason: "Unknown TOTP secret"}, nil
+	}
+	current := uint64(v.now().Unix() / int64(totpStep/time.Second))
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for step := current - totpWindowSteps; step <= current+totpWindowSteps; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) != 1 {
+			continue
+		}
+		if last, ok := v.lastStep[name]; ok && step <= last {
+			return attestationVerdict{Reason: "TOTP code used before"}, nil
+		}
+		v.lastStep[name] = step
+		return attestationVerdict{Valid: true, Attributes: map[string]string{"totp": name}}, nil
+	}
+	return attestationVerdict{Reason: "Invalid TOTP code"}, nil
+}
+
+// deviceStatement is what a trusted device signer, e.g., a platform device
+// check service, states about the client.
+type deviceStatement struct {
+	KeyID    string `json:"key_id"`
+	ClientID string `json:"client_id,omitempty"` // Sec-Client-Id the statement is bound to
+	Platform string `json:"platform"`
+	IssuedAt int64  `json:"issued_at"` // Unix seconds
+}
+
+// signedDeviceStatement is the evidence of the device-statement format: the
+// JSON statement and its Ed25519 signature.
+type signedDeviceStatement struct {
+	Statement []byte `json:"statement"`
+	Signature []byte `json:"signature"`
+}
+
+// deviceStatementVerifier accepts fresh device statements signed by one of
+// the device signer keys and bound to the client ID of the request. The
+// platform stated becomes an attestation attribute.
+type deviceStatementVerifier struct {
+	keys map[string]ed25519.PublicKey
+	now  func() time.Time
+}
+
+func loadDeviceStatementVerifier(fileName string) (*deviceStatementVerifier, error) {
+	lines, err := readCredentialLines(fileName)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]ed25519.PublicKey)
+	for _, line := range lines {
+		if keys[line[0]], err = parseEd25519PublicKey(line[1]); err != nil {
+			return nil, fmt.Errorf("%s: %w", line[0], err)
+		}
+	}
+	return &deviceStatementVerifier{keys: keys, now: time.Now}, nil
+}
+
+func (v *deviceStatementVerifier) verify(ctx context.Context, evidence attestationEvidence) (attestationVerdict, error) {
+	var signed signedDeviceStatement
+	var statement deviceStatement
+	if err := json.Unmarshal(evidence.Evidence, &signed); err != nil {
+		return attestationVerdict{Reason: "Invalid device statement"}, nil
+	}
+	if err := json.Unmarshal(signed.Statement, &statement); err != nil {
+		return attestationVerdict{Reason: "Invalid device statement"}, nil
+	}
+	key, ok := v.keys[statement.KeyID]
+	if !ok {
+		return attestationVerdict{Reason: "Unknown device signer " + statement.KeyID}, nil
+	}
+	if !ed25519.Verify(key, signed.Statement, signed.Signature) {
+		return attestationVerdict{Reason: "Invalid device statement signature"}, nil
+	}
+	if statement.ClientID != evidence.ClientID {
+		return attestationVerdict{Reason: "Device statement bound to another client"}, nil
+	}
+	now, issuedAt := v.now(), time.Unix(statement.IssuedAt, 0)
+	if issuedAt.Before(now.Add(-deviceStatementSkew)) || issuedAt.After(now.Add(deviceStatementSkew)) {
+		return attestationVerdict{Reason: "Stale device statement"}, nil
+	}
+	return attestationVerdict{Valid: true, Attributes: map[string]string{
+		"platform":      statement.Platform,
+		"device_signer": statement.KeyID,
+	}}, nil
+}
+
+// attestationCredential produces the evidence a client presents to the
+// attester in one of the built-in formats.
+type attestationCredential struct {
+	format   string
+	evidence func(clientID string, now time.Time) ([]byte, error)
+}
+
+// loadAttestationCredential reads the credential of a format=file
+// specification: the API key, the <name>:<base32 secret> of a TOTP secret, or
+// the <key-id>:<hex Ed25519 seed> of a device signer.
+func loadAttestationCredential(spec string) (*attestationCredential, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid attestation %q, expected format=file", spec)
+	}
+	credential := &attestationCredential{format: parts[0]}
+	switch parts[0] {
+	case attestationFormatAPIKey:
+		key, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		key = bytes.TrimSpace(key)
+		credential.evidence = func(string, time.Time) ([]byte, error) {
+			return key, nil
+		}
+	case attestationFormatTOTP:
+		lines, err := readCredentialLines(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		name := lines[0][0]
+		secret, err := decodeTOTPSecret(lines[0][1])
+		if err != nil {
+			return nil, err
+		}
+		credential.evidence = func(_ string, now time.Time) ([]byte, error) {
+			return []byte(name + ":" + totpCode(secret, uint64(now.Unix()/int64(totpStep/time.Second)))), nil
+		}
+	case attestationFormatDeviceStatement:
+		lines, err := readCredentialLines(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		keyID := lines[0][0]
+		seed, err := hex.DecodeString(lines[0][1])
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("Invalid Ed25519 signing key, expected %d hex-encoded bytes", ed25519.SeedSize)
+		}
+		key := ed25519.NewKeyFromSeed(seed)
+		credential.evidence = func(clientID string, now time.Time) ([]byte, error) {
+			statement, err := json.Marshal(deviceStatement{
+				KeyID:    keyID,
+				ClientID: clientID,
+				Platform: runtime.GOOS,
+				IssuedAt: now.Unix(),
+			})
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(signedDeviceStatement{Statement: statement, Signature: ed25519.Sign(key, statement)})
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAttestation, parts[0])
+	}
+	return credential, nil
+}
+
+// attestationTransport presents the credential's evidence with the token
+// requests a client sends to the attester, directly or through the Oblivious
+// HTTP relay, but not with requests to origins or issuers.
+type attestationTransport struct {
+	base       http.RoundTripper
+	credential *attestationCredential
+}
+
+func (t *attestationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Header.Get("Content-Type") {
+	case tokenRequestMediaType, batchedTokenRequestMediaType, ohttpRequestMediaType:
+	default:
+		return t.base.RoundTrip(req)
+	}
+	evidence, err := t.credential.evidence(req.Header.Get(headerClientID), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// Round trippers must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set(headerAttestationFormat, t.credential.format)
+	req.Header.Set(headerAttestationEvidence, marshalStructuredBinary(evidence))
+	return t.base.RoundTrip(req)
+}
+
+// withAttestation returns a client presenting the credential with its token
+// requests, or the client itself without one.
+func withAttestation(client *http.Client, credential *attestationCredential) *http.Client {
+	if credential == nil {
+		return client
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	withCredential := *client
+	withCredential.Transport = &attestationTransport{base: base, credential: credential}
+	return &withCredential
+}
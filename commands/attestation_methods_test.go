@@ -0,0 +1,148 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, req)
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func writeTestCredentials(t *testing.T, name, content string) string {
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// attestedRequest returns the token request the client sends with the
+// credential's evidence.
+func attestedRequest(t *testing.T, credential *attestationCredential, clientID string) *http.Request {
+	transport := &recordingTransport{}
+	client := withAttestation(&http.Client{Transport: transport}, credential)
+	req, _ := http.NewRequest(http.MethodPost, "https://attester.example/token-request", nil)
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+	if clientID != "" {
+		req.Header.Set(headerClientID, clientID)
+	}
+	if _, err := client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	return transport.requests[0]
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 4226, Appendix D
+	secret := []byte("12345678901234567890")
+	for step, code := range []string{"755224", "287082", "359152"} {
+		if got := totpCode(secret, uint64(step)); got != code {
+			t.Fatalf("expected %s at step %d, got %s", code, step, got)
+		}
+	}
+}
+
+func TestAttestationMethods(t *testing.T) {
+	_, deviceKey, _ := ed25519.GenerateKey(nil)
+	deviceKeyID := hex.EncodeToString(deviceKey.Public().(ed25519.PublicKey))
+	totpSecret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	attester := newTestAttester(&AttesterPolicy{})
+	attester.verifiers = make(map[string]attestationVerifier)
+	err := addAttestationMethods(attester.verifiers, []string{
+		"api-key=" + writeTestCredentials(t, "api-keys", "# partners\npartner:s3cret\n"),
+		"totp=" + writeTestCredentials(t, "totp", "alice:"+totpSecret+"\n"),
+		"device-statement=" + writeTestCredentials(t, "devices", "vendor:"+deviceKeyID+"\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	attester.verifiers[attestationFormatTOTP].(*totpVerifier).now = func() time.Time { return now }
+	attester.verifiers[attestationFormatDeviceStatement].(*deviceStatementVerifier).now = func() time.Time { return now }
+
+	apiKey, err := loadAttestationCredential("api-key=" + writeTestCredentials(t, "api-key", "s3cret\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes, err := attester.attest(attestedRequest(t, apiKey, ""), pat.BasicPublicTokenType)
+	if err != nil || attributes["api_key"] != "partner" {
+		t.Fatalf("unexpected attributes %v, %v", attributes, err)
+	}
+
+	totp, err := loadAttestationCredential("totp=" + writeTestCredentials(t, "totp", "alice:"+totpSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	evidence, _ := totp.evidence("", now)
+	req := attestedRequest(t, &attestationCredential{format: totp.format, evidence: func(string, time.Time) ([]byte, error) { return evidence, nil }}, "")
+	if attributes, err := attester.attest(req, pat.BasicPublicTokenType); err != nil || attributes["totp"] != "alice" {
+		t.Fatalf("unexpected attributes %v, %v", attributes, err)
+	}
+	if _, err := attester.attest(req, pat.BasicPublicTokenType); err == nil || !strings.Contains(err.Error(), "used before") {
+		t.Fatalf("expected a replayed TOTP code to be rejected, got %v", err)
+	}
+
+	seedFile := writeTestCredentials(t, "device-key", "vendor:"+hex.EncodeToString(deviceKey.Seed()))
+	device, err := loadAttestationCredential("device-statement=" + seedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evidence, _ = device.evidence("client-1", now)
+	fixed := &attestationCredential{format: device.format, evidence: func(string, time.Time) ([]byte, error) { return evidence, nil }}
+	if attributes, err := attester.attest(attestedRequest(t, fixed, "client-1"), pat.BasicPublicTokenType); err != nil || attributes["device_signer"] != "vendor" || attributes["platform"] == "" {
+		t.Fatalf("unexpected attributes %v, %v", attributes, err)
+	}
+	if _, err := attester.attest(attestedRequest(t, fixed, "client-2"), pat.BasicPublicTokenType); err == nil {
+		t.Fatal("expected a statement bound to another client to be rejected")
+	}
+	stale, _ := device.evidence("client-1", now.Add(-time.Hour))
+	fixed.evidence = func(string, time.Time) ([]byte, error) { return stale, nil }
+	if _, err := attester.attest(attestedRequest(t, fixed, "client-1"), pat.BasicPublicTokenType); err == nil {
+		t.Fatal("expected a stale statement to be rejected")
+	}
+
+	// Requests without evidence, or in formats without a verifier, are refused
+	wrong, _ := loadAttestationCredential("api-key=" + writeTestCredentials(t, "wrong", "guess"))
+	if _, err := attester.attest(attestedRequest(t, wrong, ""), pat.BasicPublicTokenType); err == nil {
+		t.Fatal("expected an unknown API key to be rejected")
+	}
+	if _, err := attester.attest(attestedRequest(t, nil, ""), pat.BasicPublicTokenType); !errors.Is(err, ErrMissingAttestation) {
+		t.Fatalf("expected missing evidence to be refused, got %v", err)
+	}
+	if err := addAttestationMethods(attester.verifiers, []string{"api-key=" + seedFile}); err == nil {
+		t.Fatal("expected a duplicate format to be refused")
+	}
+	if err := addAttestationMethods(attester.verifiers, []string{"smoke-signal=" + seedFile}); !errors.Is(err, ErrUnsupportedAttestation) {
+		t.Fatalf("expected an unknown format to be refused, got %v", err)
+	}
+}
+
+func TestAttestationTransport(t *testing.T) {
+	credential, err := loadAttestationCredential("api-key=" + writeTestCredentials(t, "api-key", "s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &recordingTransport{}
+	client := withAttestation(&http.Client{Transport: transport}, credential)
+	client.Get("https://origin.example/")
+	if len(transport.requests) != 1 || transport.requests[0].Header.Get(headerAttestationFormat) != "" {
+		t.Fatal("expected requests other than token requests to carry no evidence")
+	}
+}
@@ -1,19 +1,23 @@
 package commands
 
 import (
-	"bytes"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/sha512"
-	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"net/http"
 	"net/http/httputil"
-	"strconv"
+	"os"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/cloudflare/pat-app/structuredfield"
 	pat "github.com/cloudflare/pat-go"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -33,30 +37,392 @@ var (
 
 	// Rate-limited issuance protocol type
 	rateLimitedTokenType = uint16(0x0003)
+
+	ErrIndexMismatch        = errors.New("Index mismatch")
+	ErrIssuerLimitExceeded  = errors.New("Issuer token limit exceeded")
+	ErrBucketLimitExceeded  = errors.New("Token bucket empty")
+	ErrIssuanceDenied       = errors.New("Issuance denied by policy")
+	ErrBlindReuse           = errors.New("Blinded request key reused")
+	ErrDuplicateRequest     = errors.New("Duplicate token request")
+	ErrInvalidTokenResponse = errors.New("Invalid issuer token response")
+)
+
+const (
+	// What the attester does about reused blinded request keys
+	blindReuseActionLog    = "log"
+	blindReuseActionReject = "reject"
+
+	// Where a reused blinded request key was seen before
+	blindReuseSameOrigin  = "same-origin"
+	blindReuseCrossOrigin = "cross-origin"
+	blindReuseCrossClient = "cross-client"
 )
 
 type ClientState struct {
-	// XXX(caw): this needs to include a timestamp to allow for rotation
-	originIndices map[string]string // map from anonymous origin ID to stable index
-	originCounts  map[string]int    // map from anonymous origin ID to per-origin count
+	originIndices map[string]string                        // map from anonymous origin ID to stable index
+	originCounts  map[string]int                           // map from anonymous origin ID to per-origin count in its epoch
+	originEpochs  map[string]uint64                        // map from anonymous origin ID to policy epoch of its last issuance
+	indexOrigins  map[string]string                        // map from stable index to anonymous origin ID
+	windowCounts  map[string]map[time.Duration]windowCount // map from anonymous origin ID to counts by issuer token window
+	blindedKeys   map[string]blindedKeyClaim               // map from blinded request key to the anonymous origin it was returned for
+
+	clientBucket  *tokenBucket            // bucket shared across all origins
+	originBuckets map[string]*tokenBucket // map from anonymous origin ID to per-origin bucket
+
+	created  time.Time // time of the first issuance
+	updated  time.Time // time of the last change
+	revision uint64    // bumped on every change, which is persisted when it moves
 }
 
 type TestAttester struct {
-	client      *http.Client
-	clientState map[string]ClientState
+	client            *http.Client
+	issuers           *issuerPool
+	clients           *clientStateStore
+	issuerLimits      *issuerLimitCache
+	blindedKeys       *blindedKeyIndex
+	blindReuseAction  string             // blindReuseActionLog or blindReuseActionReject
+	policyWindow      time.Duration      // per-origin counts reset every window, never if zero
+	receiptKey        ed25519.PrivateKey // signs issuance receipts if set
+	policy            *AttesterPolicy
+	verifiers         map[string]attestationVerifier
+	ledger            *privacyLedger
+	clientKeys        *clientKeyRegistry
+	requireClientKeys bool             // refuse rate-limited requests of unregistered clients
+	clientKeyFormats  clientKeyFormats // the default formats if nil
+	fraud             *fraudSignals
+	clock             clock // system clock if nil
+	maintenance       *maintenanceMode
+	dedup             *requestDedup // nil unless deduplication is enabled
+	streaming         responseStreaming
+	issuerPolicies    *issuerPolicyCache // nil unless issuer policies are enforced
+	faults            attesterFaults     // simulated misbehavior, none if nil
+}
+
+func (a TestAttester) now() time.Time {
+	if a.clock != nil {
+		return a.clock.Now()
+	}
+	return time.Now()
+}
+
+// attest verifies the client's attestation evidence when verifiers are
+// configured and returns the verified attributes. Without verifiers, the
+// client-supplied Sec-Attestation-* headers are used as is.
+func (a TestAttester) attest(req *http.Request, tokenType uint16) (map[string]string, error) {
+	if len(a.verifiers) == 0 {
+		return readAttestationAttributes(req), nil
+	}
+
+	evidence, err := readAttestationEvidence(req, req.Header.Get(headerClientID), tokenType)
+	if err != nil {
+		return nil, err
+	}
+	verifier, ok := a.verifiers[evidence.Format]
+	if !ok {
+		attesterAttestations.Inc(tokenType, "", "unsupported")
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAttestation, evidence.Format)
+	}
+	verdict, err := verifier.verify(req.Context(), evidence)
+	if err != nil {
+		attesterAttestations.Inc(tokenType, evidence.Format, "error")
+		return nil, err
+	}
+	if !verdict.Valid {
+		attesterAttestations.Inc(tokenType, evidence.Format, "rejected")
+		return nil, fmt.Errorf("Attestation rejected: %s", verdict.Reason)
+	}
+	attesterAttestations.Inc(tokenType, evidence.Format, "valid")
+	return verdict.Attributes, nil
+}
+
+// policyEpoch returns the policy window now falls in, always zero if windows
+// are disabled.
+func (a TestAttester) policyEpoch(now time.Time) uint64 {
+	if a.policyWindow <= 0 {
+		return 0
+	}
+	return uint64(now.UnixNano() / int64(a.policyWindow))
+}
+
+// originCount returns the tokens issued to the client for the anonymous
+// origin in the epoch, and whether the origin is known at all.
+func (state *ClientState) originCount(anonOriginEnc string, epoch uint64) (int, bool) {
+	if _, ok := state.originIndices[anonOriginEnc]; !ok {
+		return 0, false
+	}
+	if state.originEpochs[anonOriginEnc] != epoch {
+		return 0, true
+	}
+	return state.originCounts[anonOriginEnc], true
+}
+
+// forgetOrigin drops all state of the anonymous origin.
+func (state *ClientState) forgetOrigin(anonOriginEnc string) {
+	delete(state.indexOrigins, state.originIndices[anonOriginEnc])
+	delete(state.originIndices, anonOriginEnc)
+	delete(state.originCounts, anonOriginEnc)
+	delete(state.originEpochs, anonOriginEnc)
+	delete(state.originBuckets, anonOriginEnc)
+	delete(state.windowCounts, anonOriginEnc)
+}
+
+// expireOrigins drops the anonymous origins the client did not use in the
+// current or the previous epoch. The previous epoch is kept so that an ID the
+// client rotated at the epoch boundary is still found by its index. Origins
+// with tokens still counting against an issuer token window are kept too.
+func (state *ClientState) expireOrigins(epoch uint64, now time.Time) {
+	for anonOriginEnc, last := range state.originEpochs {
+		if last+1 < epoch && !state.windowsCurrent(anonOriginEnc, now) {
+			state.forgetOrigin(anonOriginEnc)
+		}
+	}
+}
+
+// rotateOrigin moves the state of the anonymous origin previously recorded
+// with the same index to the new anonymous origin ID, as clients periodically
+// rotate the ID of an origin while the index the issuer computes for it stays
+// the same. Counts carry over within an epoch, so that rotating the ID does
+// not reset the limit. It reports whether the state was moved.
+func (a TestAttester) rotateOrigin(state *ClientState, clientID, anonOriginEnc, indexEnc string, now time.Time) bool {
+	if !state.known() {
+		return false
+	}
+	if _, ok := state.originIndices[anonOriginEnc]; ok {
+		return false
+	}
+	oldOriginEnc, ok := state.indexOrigins[indexEnc]
+	if !ok {
+		return false
+	}
+
+	log.Println("Anonymous origin ID rotated for client", clientID)
+	count, epoch := state.originCounts[oldOriginEnc], state.originEpochs[oldOriginEnc]
+	bucket, hasBucket := state.originBuckets[oldOriginEnc]
+	windowCounts, hasWindowCounts := state.windowCounts[oldOriginEnc]
+	state.forgetOrigin(oldOriginEnc)
+	state.originIndices[anonOriginEnc] = indexEnc
+	state.indexOrigins[indexEnc] = anonOriginEnc
+	state.originCounts[anonOriginEnc] = count
+	state.originEpochs[anonOriginEnc] = epoch
+	if hasBucket {
+		state.originBuckets[anonOriginEnc] = bucket
+	}
+	if hasWindowCounts {
+		state.windowCounts[anonOriginEnc] = windowCounts
+	}
+	state.touch(now)
+	a.ledger.rename(clientID, oldOriginEnc, anonOriginEnc, now)
+	attesterOriginRotations.Inc(pat.RateLimitedTokenType)
+	return true
+}
+
+// takeFromBuckets consumes one issuance from the client and per-origin token
+// buckets configured in the policy. Nothing is consumed unless both buckets
+// have capacity.
+func (a TestAttester) takeFromBuckets(clientID, anonOriginEnc string, state *ClientState, now time.Time) bool {
+	policy := a.policy.forClient(clientID)
+
+	originBucket, ok := state.originBuckets[anonOriginEnc]
+	if !ok {
+		originBucket = newTokenBucket(policy.Origin, now)
+		state.originBuckets[anonOriginEnc] = originBucket
+	}
+
+	if policy.Client.enabled() && !state.clientBucket.available(policy.Client, now) {
+		return false
+	}
+	if policy.Origin.enabled() && !originBucket.available(policy.Origin, now) {
+		return false
+	}
+
+	if policy.Client.enabled() {
+		state.clientBucket.take()
+	}
+	if policy.Origin.enabled() {
+		originBucket.take()
+	}
+	return true
+}
+
+// bucketsAvailable reports whether the client and per-origin token buckets
+// configured in the policy have capacity, without consuming it.
+func (a TestAttester) bucketsAvailable(clientID, anonOriginEnc string, state *ClientState, now time.Time) bool {
+	policy := a.policy.forClient(clientID)
+	if policy.Client.enabled() && !state.clientBucket.available(policy.Client, now) {
+		return false
+	}
+	if originBucket, ok := state.originBuckets[anonOriginEnc]; ok && policy.Origin.enabled() {
+		return originBucket.available(policy.Origin, now)
+	}
+	return true
+}
+
+// checkIssuance checks whether the client may obtain one more token for the
+// anonymous origin, without changing any state. A zero tokenLimit is unknown
+// and not enforced, and the policy expression is only evaluated if
+// evaluatePolicy is set, as it may depend on the limit.
+func (a TestAttester) checkIssuance(state *ClientState, clientID, anonOriginEnc, issuer string, tokenType uint16, tokenLimit int, attestation map[string]string, evaluatePolicy bool, now time.Time) error {
+	originCount, origins := 1, 1
+	known := state.known()
+	if known {
+		origins = len(state.originIndices)
+		if count, ok := state.originCount(anonOriginEnc, a.policyEpoch(now)); ok {
+			originCount = count + 1
+			if tokenLimit > 0 && originCount >= tokenLimit {
+				return ErrIssuerLimitExceeded
+			}
+		} else {
+			origins++
+		}
+		if err := a.checkWindows(state, anonOriginEnc, issuer, now); err != nil {
+			return err
+		}
+	}
+
+	if evaluatePolicy {
+		allowed, err := a.policy.allow(policyInput{
+			tokenType:   tokenType,
+			clientID:    clientID,
+			issuer:      issuer,
+			originCount: originCount,
+			origins:     origins,
+			limit:       tokenLimit,
+			attestation: attestation,
+		})
+		if !allowed {
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrIssuanceDenied, err)
+			}
+			return ErrIssuanceDenied
+		}
+	}
+
+	if known && !a.bucketsAvailable(clientID, anonOriginEnc, state, now) {
+		return ErrBucketLimitExceeded
+	}
+	return nil
 }
 
+// checkIndex checks that the index of the client for the anonymous origin is
+// the one recorded before, if any.
+func checkIndex(state *ClientState, anonOriginEnc, indexEnc string) error {
+	if oldIndexEnc, ok := state.originIndices[anonOriginEnc]; ok && oldIndexEnc != indexEnc {
+		return ErrIndexMismatch
+	}
+	return nil
+}
+
+// recordIssuance updates the client state for an issued token, which was
+// checked under the same client lock.
+func (a TestAttester) recordIssuance(state *ClientState, clientID, anonOriginEnc, indexEnc, issuer string, now time.Time) {
+	if !state.known() {
+		log.Println("Initializing new state for client", clientID)
+		*state = ClientState{
+			originIndices: make(map[string]string),
+			originCounts:  make(map[string]int),
+			originEpochs:  make(map[string]uint64),
+			indexOrigins:  make(map[string]string),
+			clientBucket:  newTokenBucket(a.policy.forClient(clientID).Client, now),
+			originBuckets: make(map[string]*tokenBucket),
+			created:       now,
+		}
+	}
+
+	epoch := a.policyEpoch(now)
+	state.expireOrigins(epoch, now)
+	if _, ok := state.originIndices[anonOriginEnc]; !ok {
+		log.Println("Recording new origin for client", clientID)
+		state.originIndices[anonOriginEnc] = indexEnc
+		state.indexOrigins[indexEnc] = anonOriginEnc
+		a.fraud.newOrigin(clientID, anonOriginEnc, issuer, now)
+	} else {
+		log.Println("Incrementing index count for client", clientID)
+	}
+	if state.originEpochs[anonOriginEnc] != epoch {
+		state.originCounts[anonOriginEnc] = 0
+		state.originEpochs[anonOriginEnc] = epoch
+	}
+	state.originCounts[anonOriginEnc]++
+	state.countInWindows(anonOriginEnc, a.issuerPolicies.windows(issuer), now)
+	a.takeFromBuckets(clientID, anonOriginEnc, state, now)
+	state.touch(now)
+	a.ledger.record(clientID, anonOriginEnc, now)
+}
+
+// completeIssuance checks the issuance of a rate-limited token the issuer
+// responded to against the client state, and records it. The blinded request
+// key is only claimed once every other check passed, so that a refused
+// issuance does not leave it claimed for the client's retry. The caller
+// holds the client lock.
+func (a TestAttester) completeIssuance(state *ClientState, clientID, anonOriginEnc, indexEnc, blindedKeyEnc, issuer string, tokenType uint16, tokenLimit int, attestation map[string]string, now time.Time) error {
+	if err := checkIndex(state, anonOriginEnc, indexEnc); err != nil {
+		return err
+	}
+	if err := a.checkIssuance(state, clientID, anonOriginEnc, issuer, tokenType, tokenLimit, attestation, true, now); err != nil {
+		return err
+	}
+	if scope := a.blindedKeys.claim(blindedKeyEnc, clientID, anonOriginEnc, now); scope != "" {
+		a.fraud.blindReuse(clientID, anonOriginEnc, issuer, scope, now)
+		if a.blindReuseAction == blindReuseActionReject {
+			return ErrBlindReuse
+		}
+	}
+	a.recordIssuance(state, clientID, anonOriginEnc, indexEnc, issuer, now)
+	state.claimBlindedKey(blindedKeyEnc, anonOriginEnc, a.blindedKeys.lifetime, now)
+	return nil
+}
+
+// refuseIssuance reports the refusal as a fraud signal and to the client.
+func (a TestAttester) refuseIssuance(w http.ResponseWriter, clientID, anonOriginEnc, issuer string, err error) {
+	switch {
+	case errors.Is(err, ErrIndexMismatch):
+		log.Println("Index mismatch for client", clientID)
+		a.fraud.indexMismatch(clientID, anonOriginEnc, issuer, a.now())
+		http.Error(w, "Invalid mapping, aborting", 400)
+	case errors.Is(err, ErrIssuerLimitExceeded):
+		log.Println("Issuer limit exceeded for client", clientID)
+		a.fraud.limitExceeded(clientID, anonOriginEnc, issuer, fraudLimitIssuer, a.now())
+		setRetryAfter(w, a.retryAfter(err, clientID, a.now()))
+		http.Error(w, "Limit exceeded", http.StatusTooManyRequests)
+	case errors.Is(err, ErrWindowLimitExceeded):
+		log.Println("Token window limit exceeded for client", clientID+":", err)
+		a.fraud.limitExceeded(clientID, anonOriginEnc, issuer, fraudLimitWindow, a.now())
+		setRetryAfter(w, a.retryAfter(err, clientID, a.now()))
+		http.Error(w, "Limit exceeded", http.StatusTooManyRequests)
+	case errors.Is(err, ErrBlindReuse):
+		log.Println("Blinded request key reused by client", clientID)
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrBucketLimitExceeded):
+		log.Println("Token bucket empty for client", clientID)
+		a.fraud.limitExceeded(clientID, anonOriginEnc, issuer, fraudLimitBucket, a.now())
+		setRetryAfter(w, a.retryAfter(err, clientID, a.now()))
+		http.Error(w, "Limit exceeded", http.StatusTooManyRequests)
+	case errors.Is(err, ErrStatePersistence):
+		// Failing closed, since the issuance would be forgotten on restart
+		http.Error(w, "Client state unavailable", http.StatusServiceUnavailable)
+	default:
+		log.Println("Issuance denied by policy for client", clientID, err)
+		http.Error(w, "Issuance denied by policy", http.StatusForbidden)
+	}
+}
+
+// parseStructuredBinaryHeader parses the sf-binary header of the request.
+// Field lines of the header are combined, so a repeated header is refused.
 func parseStructuredBinaryHeader(req *http.Request, header string) ([]byte, error) {
 	if req.Header.Get(header) == "" {
 		log.Println("Header", header, "missing")
 		return nil, fmt.Errorf("Header %s missing", header)
 	}
-	return unmarshalStructuredBinary(req.Header.Get(header))
+	value, err := unmarshalStructuredBinary(strings.Join(req.Header.Values(header), ", "))
+	if err != nil {
+		return nil, fmt.Errorf("Header %s: %w", header, err)
+	}
+	return value, nil
 }
 
 func (a TestAttester) handleAttestationRequest(w http.ResponseWriter, req *http.Request) {
 	reqEnc, _ := httputil.DumpRequest(req, false)
-	log.Println("Handling attestation token request:", string(reqEnc))
+	log.Println("Handling attestation token request from", req.RemoteAddr+":", string(reqEnc))
 
 	// Sanity check the request format
 	if req.Method != http.MethodPost {
@@ -64,7 +430,8 @@ func (a TestAttester) handleAttestationRequest(w http.ResponseWriter, req *http.
 		http.Error(w, "Invalid method", 400)
 		return
 	}
-	if req.Header.Get("Content-Type") != tokenRequestMediaType {
+	batched := req.Header.Get("Content-Type") == batchedTokenRequestMediaType
+	if req.Header.Get("Content-Type") != tokenRequestMediaType && !batched {
 		log.Println("Invalid content type")
 		http.Error(w, "Invalid Content-Type", 400)
 		return
@@ -86,25 +453,40 @@ func (a TestAttester) handleAttestationRequest(w http.ResponseWriter, req *http.
 		return
 	}
 
-	targetURI, err := composeURL(targetName, tokenRequestURI)
-	if err != nil {
+	// Reject malformed requests before doing any crypto or forwarding
+	validate, requestMediaType, responseMediaType := validateTokenRequest, tokenRequestMediaType, tokenResponseMediaType
+	if batched {
+		validate, requestMediaType, responseMediaType = validateBatchedTokenRequest, batchedTokenRequestMediaType, batchedTokenResponseMediaType
+	}
+	tokenType, err := validate(requestBody)
+	if errors.Is(err, ErrUnsupportedTokenRequest) {
+		writeUnsupportedTokenType(w, unsupportedTokenTypeError{role: "attester", tokenType: tokenType, supported: knownTokenTypes()})
+		return
+	} else if err != nil {
+		log.Println("Invalid client TokenRequest:", err)
 		http.Error(w, err.Error(), 400)
 		return
 	}
-	log.Println("Target:", targetURI)
 
-	// XXX(caw): get the policy information from the issuer's .well-known: /.well-known/token-issuer-directory
-	// https://tfpauly.github.io/privacy-proxy/draft-privacypass-rate-limit-tokens.html#name-configuration
-
-	tokenReq, err := http.NewRequest(http.MethodPost, targetURI, bytes.NewBuffer(requestBody))
+	attestation, err := a.attest(req, tokenType)
 	if err != nil {
-		log.Println("Failed creating forwarding request:", err)
-		http.Error(w, err.Error(), 400)
+		log.Println("Attestation failed:", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// Check the request against the policy in the issuer directory
+	// https://tfpauly.github.io/privacy-proxy/draft-privacypass-rate-limit-tokens.html#name-configuration
+	if err := a.issuerPolicies.check(targetName, tokenType, a.now()); err != nil {
+		log.Println("Issuer policy check failed:", err)
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrIssuerPolicyUnavailable) {
+			status = http.StatusBadGateway
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
-	tokenReq.Header.Set("Content-Type", tokenRequestMediaType)
 
-	tokenType := binary.BigEndian.Uint16(requestBody)
 	if tokenType == pat.RateLimitedTokenType {
 		var rateLimitedTokenRequest pat.RateLimitedTokenRequest
 		if !rateLimitedTokenRequest.Unmarshal(requestBody) {
@@ -126,6 +508,12 @@ func (a TestAttester) handleAttestationRequest(w http.ResponseWriter, req *http.
 			http.Error(w, err.Error(), 400)
 			return
 		}
+		if _, err := a.clientKeyFormats.parse(clientKey); err != nil {
+			log.Println("Client key refused:", err)
+			attesterClientKeyChecks.Inc(pat.RateLimitedTokenType, clientKeyCheckUnsupported)
+			http.Error(w, err.Error(), 400)
+			return
+		}
 		requestBlind, err := parseStructuredBinaryHeader(req, headerRequestBlind)
 		if err != nil {
 			log.Println("parseStructuredBinaryHeader failed:", err)
@@ -148,8 +536,15 @@ func (a TestAttester) handleAttestationRequest(w http.ResponseWriter, req *http.
 		// Deserialize the request key
 		curve := elliptic.P384()
 		x, y := elliptic.UnmarshalCompressed(curve, tokenRequest.RequestKey)
+		if x == nil {
+			log.Println("Invalid request key encoding")
+			http.Error(w, "Invalid request key encoding", 400)
+			return
+		}
 		requestKey := &ecdsa.PublicKey{
-			curve, x, y,
+			Curve: curve,
+			X:     x,
+			Y:     y,
 		}
 
 		scalarLen := (curve.Params().Params().BitSize + 7) / 8
@@ -177,37 +572,61 @@ func (a TestAttester) handleAttestationRequest(w http.ResponseWriter, req *http.
 			return
 		}
 
-		// Note: typically, the Attester would check that the request key is the equal
-		// to the output of BlindPublicKey(client public key, request blind), but since
-		// this test Attester does not keep any per-Client state, we skip this step.
+		// Clients that registered a key must use it, and their request key must be
+		// its blinding
+		if err := a.checkClientKey(clientID, clientKey, requestBlind, tokenRequest.RequestKey); err != nil {
+			log.Println("Client key check failed for client", clientID+":", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		// Refuse clients over their limits before the issuer does any work, using
+		// the token limit the issuer sent last
+		anonOriginEnc := hex.EncodeToString(anonOrigin)
+		cachedLimit := a.issuerLimits.get(targetName)
+		err = a.clients.update(clientID, func(state *ClientState) error {
+			return a.checkIssuance(state, clientID, anonOriginEnc, targetName, tokenType, cachedLimit, attestation, cachedLimit != 0, a.now())
+		})
+		if err != nil {
+			a.refuseIssuance(w, clientID, anonOriginEnc, targetName, err)
+			return
+		}
 
-		tokenReqEnc, _ := httputil.DumpRequest(tokenReq, false)
-		log.Println("Forwarding attestation token request:", string(tokenReqEnc))
+		log.Println("Forwarding attestation token request to issuer", targetName)
 
-		resp, err := a.client.Do(tokenReq)
+		resp, err := a.issuers.forward(req.Context(), a.client, tokenType, targetName, requestMediaType, a.faults.forwardedRequest(tokenRequest, requestBody))
 		if err != nil {
 			log.Println("Forwarded request failed:", err)
 			http.Error(w, err.Error(), 400)
 			return
 		}
 		defer resp.Body.Close()
+		if relayProblem(w, resp) {
+			return
+		}
+		if err := checkTokenResponse(resp, tokenResponseMediaType); err != nil {
+			log.Println("Refusing issuer response:", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
 
 		if resp.Header.Get(headerTokenLimit) == "" {
 			log.Println("Response missing " + headerTokenLimit + " header")
 			http.Error(w, "Response missing "+headerTokenLimit+" header", 400) // XXX(caw): fix this response code
 			return
 		}
-		tokenLimit, err := strconv.Atoi(resp.Header.Get(headerTokenLimit))
-		if err != nil {
-			log.Println("Invalid " + headerTokenLimit + " header")
+		limit, err := structuredfield.ParseInteger(resp.Header.Get(headerTokenLimit))
+		if err != nil || limit < 0 {
+			log.Println("Invalid "+headerTokenLimit+" header:", err)
 			http.Error(w, "Invalid "+headerTokenLimit+" header", 400) // XXX(caw): fix this response code
 			return
 		}
+		tokenLimit := int(limit)
 
 		tokenRespEnc, _ := httputil.DumpResponse(resp, false)
 		log.Println("Attestation token response:", string(tokenRespEnc))
 
-		blindSignature, err := ioutil.ReadAll(resp.Body)
+		blindSignature, err := a.streaming.buffer(resp.Body)
 		if err != nil {
 			http.Error(w, err.Error(), 400)
 			return
@@ -220,7 +639,7 @@ func (a TestAttester) handleAttestationRequest(w http.ResponseWriter, req *http.
 			return
 		}
 
-		index, err := pat.FinalizeIndex(clientKey, requestBlind, blindedRequestKey)
+		index, err := pat.FinalizeIndex(clientKey, a.faults.indexBlind(requestBlind), blindedRequestKey)
 		if err != nil {
 			log.Println("Index computation failed:", err)
 			http.Error(w, "Index computation failed", 400)
@@ -228,92 +647,161 @@ func (a TestAttester) handleAttestationRequest(w http.ResponseWriter, req *http.
 		}
 		indexEnc := hex.EncodeToString(index)
 
-		anonOriginEnc := hex.EncodeToString(anonOrigin)
-		state, ok := a.clientState[clientID]
-		if !ok {
-			log.Println("Initializing new state for client", clientID)
-
-			// No client state for this client, so initialize it
-			originIndices := make(map[string]string)
-			originIndices[anonOriginEnc] = indexEnc
-			originCounts := make(map[string]int)
-			originCounts[anonOriginEnc] = 1
-			a.clientState[clientID] = ClientState{
-				originIndices: originIndices,
-				originCounts:  originCounts,
-			}
-		} else {
-			log.Println("Updating state for client", clientID)
-			oldIndexEnc, ok := state.originIndices[anonOriginEnc]
-			if !ok {
-				log.Println("Recording new origin for client", clientID)
-
-				// This is a newly visited origin, so initialize it as such
-				state.originIndices[anonOriginEnc] = indexEnc
-				state.originCounts[anonOriginEnc] = 1
-			} else {
-				log.Println("Updating existing origin for client", clientID)
-
-				// Check for index stability
-				if oldIndexEnc != indexEnc {
-					if err != nil {
-						log.Println("Index mismatch for client", clientID)
-						http.Error(w, "Invalid mapping, aborting", 400)
-						return
-					}
-				} else {
-					log.Println("Incrementing index count for client", clientID)
-					state.originCounts[indexEnc] = state.originCounts[indexEnc] + 1
-
-					if state.originCounts[indexEnc] >= tokenLimit {
-						log.Println("Limit", tokenLimit, "exceeded")
-						http.Error(w, "Limit exceeded", http.StatusTooManyRequests)
-						return
-					}
-				}
+		a.issuerLimits.set(targetName, tokenLimit)
+
+		// Check again with the actual limit, since the state may have changed
+		// during the round trip, and record the issuance in the same update
+		var receipt []byte
+		blindedKeyEnc := hex.EncodeToString(blindedRequestKey)
+		err = a.clients.update(clientID, func(state *ClientState) error {
+			a.rotateOrigin(state, clientID, anonOriginEnc, indexEnc, a.now())
+			if err := a.completeIssuance(state, clientID, anonOriginEnc, indexEnc, blindedKeyEnc, targetName, tokenType, tokenLimit, attestation, a.now()); err != nil {
+				return err
 			}
+			receipt = a.issuanceReceipt(state, clientID, anonOriginEnc, tokenType, tokenLimit, a.now())
+			return nil
+		})
+		if err != nil {
+			a.refuseIssuance(w, clientID, anonOriginEnc, targetName, err)
+			return
 		}
 
+		if receipt != nil {
+			w.Header().Set(headerIssuanceReceipt, marshalStructuredBinary(receipt))
+		}
 		w.Header().Set("content-type", tokenResponseMediaType)
-		w.Write(blindSignature)
-	} else if tokenType == pat.BasicPublicTokenType {
-		tokenReqEnc, _ := httputil.DumpRequest(tokenReq, false)
-		log.Println("Forwarding attestation token request:", string(tokenReqEnc))
+		a.streaming.write(w, resp, blindSignature)
+	} else if tokenType == pat.BasicPublicTokenType || tokenType == pat.BasicPrivateTokenType || tokenType == ed25519TokenType {
+		allowed, err := a.policy.allow(policyInput{
+			tokenType:   tokenType,
+			clientID:    req.Header.Get(headerClientID),
+			issuer:      targetName,
+			attestation: attestation,
+		})
+		if !allowed {
+			log.Println("Issuance denied by policy", err)
+			http.Error(w, "Issuance denied by policy", http.StatusForbidden)
+			return
+		}
 
-		resp, err := a.client.Do(tokenReq)
+		log.Println("Forwarding attestation token request to issuer", targetName)
+
+		resp, err := a.issuers.forward(req.Context(), a.client, tokenType, targetName, requestMediaType, requestBody)
 		if err != nil {
 			log.Println("Forwarded request failed:", err)
 			http.Error(w, err.Error(), 400)
 			return
 		}
 		defer resp.Body.Close()
+		if relayProblem(w, resp) {
+			return
+		}
+		if err := checkTokenResponse(resp, responseMediaType); err != nil {
+			log.Println("Refusing issuer response:", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
 
 		tokenRespEnc, _ := httputil.DumpResponse(resp, false)
 		log.Println("Attestation token response:", string(tokenRespEnc))
 
-		blindSignature, err := ioutil.ReadAll(resp.Body)
+		blindSignature, err := a.streaming.buffer(resp.Body)
 		if err != nil {
 			http.Error(w, err.Error(), 400)
 			return
 		}
 
-		w.Header().Set("content-type", tokenResponseMediaType)
-		w.Write(blindSignature)
+		w.Header().Set("content-type", responseMediaType)
+		a.streaming.write(w, resp, blindSignature)
 	}
 }
 
+// checkTokenResponse refuses issuer responses that are not token responses,
+// so that issuer errors are not relayed to clients as tokens.
+func checkTokenResponse(resp *http.Response, mediaType string) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: status %d", ErrInvalidTokenResponse, resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != mediaType {
+		return fmt.Errorf("%w: content type %q", ErrInvalidTokenResponse, contentType)
+	}
+	return nil
+}
+
 func startAttester(c *cli.Context) error {
-	cert := c.String("cert")
-	key := c.String("key")
+	certs := c.StringSlice("cert")
+	keys := c.StringSlice("key")
+	certDir := c.String("cert-dir")
 	port := c.String("port")
 	logLevel := c.String("log")
-
-	if cert == "" {
+	policyFile := c.String("policy")
+	attestationPlugins := c.StringSlice("attestation-plugin")
+	attestationMethods := c.StringSlice("attestation")
+	issuerFailover := c.StringSlice("issuer-failover")
+	issuerTimeout := c.Duration("issuer-timeout")
+	adminToken := c.String("admin-token")
+	privacyEpoch := c.Duration("privacy-epoch")
+	originChurnWindow := c.Duration("origin-churn-window")
+	originChurnThreshold := c.Int("origin-churn-threshold")
+	fraudEventsFile := c.String("fraud-events")
+	auditLogFile := c.String("admin-audit-log")
+	blindReuseAction := c.String("blind-reuse-action")
+	policyWindow := c.Duration("policy-window")
+	dedupWindow := c.Duration("dedup-window")
+	dedupAction := c.String("dedup-action")
+	stateStore := c.String("state-store")
+	stateKeyFile := c.String("state-encryption-key")
+	streamFlushInterval := c.Duration("stream-flush-interval")
+
+	if len(certs) == 0 && certDir == "" {
 		log.Fatal("Invalid key material (missing certificate). See README for configuration.")
 	}
-	if key == "" {
+	if len(keys) != len(certs) {
 		log.Fatal("Invalid key material (missing private key). See README for configuration.")
 	}
+	if privacyEpoch <= 0 {
+		log.Fatal("Invalid privacy epoch. See README for configuration.")
+	}
+	if policyWindow < 0 {
+		log.Fatal("Invalid policy window. See README for configuration.")
+	}
+	issuerPolicy := c.String("issuer-policy")
+	if issuerPolicy != issuerPolicyIgnore && issuerPolicy != issuerPolicyEnforce {
+		log.Fatal("Invalid issuer policy. See README for configuration.")
+	}
+	issuerPolicyTTL := c.Duration("issuer-policy-ttl")
+	if issuerPolicyTTL <= 0 {
+		log.Fatal("Invalid issuer policy TTL. See README for configuration.")
+	}
+	if blindReuseAction != blindReuseActionLog && blindReuseAction != blindReuseActionReject {
+		log.Fatal("Invalid blind reuse action. See README for configuration.")
+	}
+	if dedupWindow < 0 {
+		log.Fatal("Invalid deduplication window. See README for configuration.")
+	}
+	if dedupAction != dedupActionReplay && dedupAction != dedupActionReject {
+		log.Fatal("Invalid deduplication action. See README for configuration.")
+	}
+	if streamFlushInterval < 0 {
+		log.Fatal("Invalid stream flush interval. See README for configuration.")
+	}
+	issuerHeaders, err := parseIssuerHeaders(c.String("user-agent"), c.StringSlice("issuer-header"))
+	if err != nil {
+		log.Fatal(err, ". See README for configuration.")
+	}
+	if kind, err := storeKind(stateStore); err != nil {
+		log.Fatal(err, ". See README for configuration.")
+	} else if kind != storeMemory && stateKeyFile == "" {
+		log.Fatal("Invalid state store, persisted client state requires --state-encryption-key. See README for configuration.")
+	}
+	faults, err := parseAttesterFaults(c.StringSlice("simulate-fault"))
+	if err != nil {
+		log.Fatal(err, ". See README for configuration.")
+	}
+	keyFormats, err := parseClientKeyFormats(c.StringSlice("client-key-format"))
+	if err != nil {
+		log.Fatal(err, ". See README for configuration.")
+	}
 
 	switch logLevel {
 	case "debug":
@@ -322,15 +810,189 @@ func startAttester(c *cli.Context) error {
 		log.SetLevel(log.InfoLevel)
 	}
 
+	options := serverOptionsFromFlags(c)
+	if err := options.validate(); err != nil {
+		log.Fatal(err, ". See README for configuration.")
+	}
+
+	config := effectiveConfigFromFlags(c, "attester")
+	if c.Bool("print-config") {
+		return printConfig(os.Stdout, config)
+	}
+	logStartupBanner(config, port)
+
+	tlsConfig, err := newServerTLSConfig(certs, keys, certDir)
+	if err != nil {
+		log.Fatal("Invalid key material: ", err)
+	}
+
+	proxies, err := parseTrustedProxies(c.StringSlice("trusted-proxies"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var policy *AttesterPolicy
+	if policyFile != "" {
+		policy, err = readAttesterPolicy(policyFile)
+		if err != nil {
+			log.Fatal("Failed reading policy from file ", policyFile, ": ", err)
+		}
+	}
+
+	verifiers, err := loadAttestationVerifiers(attestationPlugins)
+	if err != nil {
+		log.Fatal("Failed loading attestation plugins: ", err)
+	}
+	if err := addAttestationMethods(verifiers, attestationMethods); err != nil {
+		log.Fatal(err)
+	}
+	if len(verifiers) > 0 {
+		formats := make([]string, 0, len(verifiers))
+		for format := range verifiers {
+			formats = append(formats, format)
+		}
+		sort.Strings(formats)
+		log.Infoln("Requiring attestation evidence in one of the formats", strings.Join(formats, ", "))
+	}
+
+	failover, err := parseIssuerFailover(issuerFailover)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Receipts are audited offline, possibly long after issuance, so they are
+	// only signed with a key that outlives the process
+	var receiptKey ed25519.PrivateKey
+	if receiptKeyFile := c.String("receipt-signing-key"); receiptKeyFile != "" {
+		receiptKey, err = loadEd25519SigningKey(receiptKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infoln("Signing issuance receipts with key", hex.EncodeToString(receiptKey.Public().(ed25519.PublicKey)))
+	} else {
+		log.Infoln("Not issuing receipts without --receipt-signing-key")
+	}
+	requestSigner, err := newRequestSigner(c.String("request-signing-key"), c.String("request-signing-key-id"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if requestSigner != nil {
+		log.Infoln("Signing forwarded token requests as", requestSigner.keyID, "with key", hex.EncodeToString(requestSigner.key.Public().(ed25519.PublicKey)))
+	}
+
+	fraudEvents, err := openEventLog(fraudEventsFile)
+	if err != nil {
+		log.Fatal("Failed opening fraud events file ", fraudEventsFile, ": ", err)
+	}
+	auditLog, err := openEventLog(auditLogFile)
+	if err != nil {
+		log.Fatal("Invalid admin audit log: ", err)
+	}
+	if auditLog != nil && adminToken == "" {
+		log.Fatal("Invalid admin audit log: the admin API requires --admin-token")
+	}
+
+	issuerClient := newHTTPClient(false, c.Bool("issuer-h2c"))
+	clientCert, err := loadIssuerClientCertificate(c.String("issuer-client-cert"), c.String("issuer-client-key"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if clientCert != nil {
+		if issuerClient, err = withClientCertificate(issuerClient, *clientCert); err != nil {
+			log.Fatal(err)
+		}
+		log.Infoln("Presenting client certificate", clientCert.Leaf.Subject.CommonName, "to issuers")
+	}
+
 	attester := TestAttester{
-		client:      &http.Client{},
-		clientState: make(map[string]ClientState),
+		client:            withLocalRoles(withIssuerHeaders(issuerClient, issuerHeaders)),
+		issuers:           newIssuerPool(failover, issuerTimeout),
+		clients:           newClientStateStore(),
+		issuerLimits:      newIssuerLimitCache(),
+		blindedKeys:       newBlindedKeyIndex(blindedKeyLifetime(policyWindow, privacyEpoch)),
+		blindReuseAction:  blindReuseAction,
+		policyWindow:      policyWindow,
+		receiptKey:        receiptKey,
+		policy:            policy,
+		verifiers:         verifiers,
+		ledger:            newPrivacyLedger(privacyEpoch),
+		clientKeys:        newClientKeyRegistry(),
+		requireClientKeys: c.Bool("require-client-keys"),
+		clientKeyFormats:  keyFormats,
+		fraud:             newFraudSignals(originChurnWindow, originChurnThreshold, fraudEvents),
+		clock:             newRoleClock(c.Bool("demo")),
+		maintenance:       newMaintenanceMode(),
+		streaming: responseStreaming{
+			enabled:       c.Bool("stream-responses"),
+			flushInterval: streamFlushInterval,
+		},
+		faults: faults,
+	}
+	attester.issuers.signer = requestSigner
+	if issuerPolicy == issuerPolicyEnforce {
+		attester.issuerPolicies = newIssuerPolicyCache(attester.client, attester.issuers, issuerPolicyTTL, policyWindow)
+	}
+	if c.Bool("demo") {
+		log.Warnln("Attester runs on a demo clock the admin API can move")
+	}
+	log.Infoln("Accepting client keys of formats", keyFormats)
+	if faults != nil {
+		log.Warnln("Attester deliberately misbehaves for research, simulating", faults)
 	}
 
-	http.HandleFunc(attesterTokenRequestURI, attester.handleAttestationRequest)
-	err := http.ListenAndServeTLS(":"+port, cert, key, nil)
+	stores := newStateStores()
+	backend, err := stores.openClientStates(stateStore)
 	if err != nil {
-		log.Fatal("ListenAndServeTLS: ", err)
+		log.Fatal("Failed opening state store: ", err)
+	}
+	if backend != nil {
+		sealer, err := openStateSealer(stateKeyFile)
+		if err != nil {
+			log.Fatal("Failed reading state encryption key: ", err)
+		}
+		restored, err := attester.clients.restore(backend, sealer)
+		if err != nil {
+			log.Fatal("Failed reading state store: ", err)
+		}
+		log.Infoln("Restored the state of", restored, "clients from", redactRedisURL(stateStore))
+		log.Infoln("Restored", attester.blindedKeys.restore(attester.clients, attester.now()), "blinded request keys")
+	}
+
+	if c.Bool("self-test") {
+		if err := runSelfTest("attester", attester.selfTestChecks()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	attester.dedup = newRequestDedup(dedupWindow, dedupAction)
+	mux := http.NewServeMux()
+	mux.HandleFunc(attesterTokenRequestURI, instrumentTokenRequests("attester", attesterRequests, attesterRequestDuration, attester.maintenance.wrap(attester.dedup.wrap(attester.handleAttestationRequest))))
+	mux.HandleFunc(attesterHealthURI, attester.maintenance.handleHealth)
+	mux.HandleFunc(attesterRegisterURI, attester.handleClientKeyRegistration)
+	mux.HandleFunc(attesterClientKeyURI, attester.handleClientKeyRegistration)
+	if c.Bool("ohttp-relay") {
+		mux.HandleFunc(attesterOHTTPRelayURI, attester.maintenance.wrap(attester.handleOHTTPRelayRequest))
+	}
+	if adminToken != "" {
+		admin := attester.newAdminServer(adminToken)
+		admin.audit = newAdminAudit(auditLog)
+		admin.serveConfig(config)
+		mux.Handle(adminURIPrefix, admin)
+	}
+
+	life := newLifecycle("attester", options.shutdownTimeout)
+	if err := startComposedRoles(life.context(), c, "attester"); err != nil {
+		log.Fatal("Invalid composed roles: ", err, ". See README for configuration.")
+	}
+	life.onShutdown("state", stores.close)
+	life.onShutdown("admin audit log", func() error { return closeEventLog(auditLog) })
+	life.onShutdown("fraud events", func() error { return closeEventLog(fraudEvents) })
+	if options.metricsAddr != "" {
+		life.serveMetrics(options.metricsAddr)
+	}
+	if policyWindow > 0 {
+		life.goBackground(attester.runStateRotation)
 	}
-	return err
+	life.serveTLS(newServer(port, tlsConfig, withClientAddr(mux, proxies), options), options.http3)
+	return life.wait()
 }
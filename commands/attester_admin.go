@@ -0,0 +1,29 @@
+package commands
+
+import (
+	"net/http"
+)
+
+const (
+	adminPrivacyBudgetURI = adminURIPrefix + "privacy-budget"
+)
+
+func (a TestAttester) handlePrivacyBudget(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, a.ledger.report(req.URL.Query().Get("client")))
+}
+
+func (a TestAttester) newAdminServer(token string) *adminServer {
+	admin := newAdminServer("attester", token)
+	admin.handle(http.MethodGet, adminPrivacyBudgetURI, "Per-epoch linkable information accumulated per client, optionally filtered with ?client=<id>",
+		nil, privacyBudgetReport{}, a.handlePrivacyBudget)
+	admin.handle(http.MethodGet, adminMaintenanceURI, "Whether the attester is in maintenance mode, refusing new issuance",
+		nil, maintenanceState{}, a.maintenance.handleMaintenance)
+	admin.handle(http.MethodPost, adminMaintenanceSetURI, "Enter or leave maintenance mode, keeping all attester state",
+		maintenanceSetRequest{}, maintenanceState{}, a.maintenance.handleMaintenanceSet(a.now))
+	admin.handle(http.MethodPost, adminStateWipeURI, "Drop all client state, e.g., after an experiment; requires {\"confirm\": \"wipe-state\"}",
+		stateWipeRequest{}, stateWipeReport{}, a.handleStateWipe)
+	admin.handle(http.MethodGet, adminStateSummaryURI, "Counts of client state, without client IDs or anonymous origins",
+		nil, attesterStateSummary{}, a.handleStateSummary)
+	handleClockAdmin(admin, a.clock)
+	return admin
+}
@@ -0,0 +1,108 @@
+package commands
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sort"
+
+	"github.com/cloudflare/pat-go"
+)
+
+const (
+	// Misbehavior the attester simulates for research, as metric labels
+	attesterFaultDropBlind        = "drop-blind"
+	attesterFaultTamperRequestKey = "tamper-request-key"
+	attesterFaultMisreportCount   = "misreport-count"
+)
+
+var attesterFaultNames = []string{
+	attesterFaultDropBlind,
+	attesterFaultTamperRequestKey,
+	attesterFaultMisreportCount,
+}
+
+// attesterFaults are protocol violations the attester commits on purpose, so
+// that researchers can check that clients and issuers notice a misbehaving
+// attester as the drafts claim:
+//
+//   - drop-blind: the client's request blind is replaced with a random one
+//     when computing the client's index, as if the attester lost it. The
+//     index of an origin changes on every issuance.
+//   - tamper-request-key: the request key of rate-limited token requests is
+//     altered before forwarding, which the issuer's signature check catches.
+//   - misreport-count: issuance receipts claim the client's full budget for
+//     the origin, whatever it was issued before.
+//
+// A nil set commits none.
+type attesterFaults map[string]bool
+
+func parseAttesterFaults(names []string) (attesterFaults, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	faults := make(attesterFaults)
+	for _, name := range names {
+		known := false
+		for _, fault := range attesterFaultNames {
+			known = known || name == fault
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown attester fault %q", name)
+		}
+		faults[name] = true
+	}
+	return faults, nil
+}
+
+// String lists the faults for logs.
+func (f attesterFaults) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+// inject tells whether the fault is enabled, and counts it if so.
+func (f attesterFaults) inject(fault string, tokenType uint16) bool {
+	if !f[fault] {
+		return false
+	}
+	attesterFaultsInjected.Inc(tokenType, fault)
+	return true
+}
+
+// indexBlind returns the blind the client's index is computed with.
+func (f attesterFaults) indexBlind(requestBlind []byte) []byte {
+	if !f.inject(attesterFaultDropBlind, pat.RateLimitedTokenType) {
+		return requestBlind
+	}
+	blind := make([]byte, len(requestBlind))
+	rand.Reader.Read(blind)
+	return blind
+}
+
+// forwardedRequest returns the rate-limited token request forwarded to the
+// issuer.
+func (f attesterFaults) forwardedRequest(tokenRequest pat.RateLimitedTokenRequest, requestBody []byte) []byte {
+	if !f.inject(attesterFaultTamperRequestKey, pat.RateLimitedTokenType) {
+		return requestBody
+	}
+	tampered := pat.RateLimitedTokenRequest{
+		RequestKey:            append([]byte{}, tokenRequest.RequestKey...),
+		NameKeyID:             tokenRequest.NameKeyID,
+		EncryptedTokenRequest: tokenRequest.EncryptedTokenRequest,
+		Signature:             tokenRequest.Signature,
+	}
+	tampered.RequestKey[len(tampered.RequestKey)-1] ^= 0x01
+	return tampered.Marshal()
+}
+
+// remaining returns the budget reported in issuance receipts.
+func (f attesterFaults) remaining(remaining uint32, tokenLimit int) uint32 {
+	if !f.inject(attesterFaultMisreportCount, pat.RateLimitedTokenType) || tokenLimit < 1 {
+		return remaining
+	}
+	return uint32(tokenLimit - 1)
+}
@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestParseAttesterFaults(t *testing.T) {
+	faults, err := parseAttesterFaults(nil)
+	if err != nil || faults != nil {
+		t.Fatalf("expected no faults by default, got %v: %v", faults, err)
+	}
+	faults, err = parseAttesterFaults([]string{attesterFaultMisreportCount, attesterFaultDropBlind})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if faults.String() != "[drop-blind misreport-count]" {
+		t.Fatalf("unexpected faults %s", faults)
+	}
+	if _, err := parseAttesterFaults([]string{"forge-tokens"}); err == nil {
+		t.Fatal("expected unknown faults to be refused")
+	}
+}
+
+func TestAttesterFaults(t *testing.T) {
+	tokenKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := pat.NewRateLimitedIssuer(tokenKey)
+	issuer.AddOrigin("origin.example")
+	tokenKeyEnc, _ := marshalTokenKey(&tokenKey.PublicKey, false)
+	tokenKeyID := sha256.Sum256(tokenKeyEnc)
+	challenge := pat.TokenChallenge{
+		TokenType:  pat.RateLimitedTokenType,
+		IssuerName: "issuer.example",
+		OriginInfo: []string{"origin.example"},
+	}
+	nonce := make([]byte, 32)
+	blind := make([]byte, clientBlindLength)
+	rand.Read(blind)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	state, err := pat.CreateRateLimitedClientFromSecret(secret).CreateTokenRequest(challenge.Marshal(), nonce, blind, tokenKeyID[:], &tokenKey.PublicKey, "origin.example", issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenRequest := *state.Request()
+	requestBody := tokenRequest.Marshal()
+
+	// Without faults, requests and blinds are passed on as they are
+	var none attesterFaults
+	if !bytes.Equal(none.forwardedRequest(tokenRequest, requestBody), requestBody) ||
+		!bytes.Equal(none.indexBlind(blind), blind) || none.remaining(1, 10) != 1 {
+		t.Fatal("expected no fault to be injected")
+	}
+
+	faults, _ := parseAttesterFaults(attesterFaultNames)
+	injected := attesterFaultsInjected.Value(pat.RateLimitedTokenType, attesterFaultTamperRequestKey)
+	var tampered pat.RateLimitedTokenRequest
+	if !tampered.Unmarshal(faults.forwardedRequest(tokenRequest, requestBody)) {
+		t.Fatal("expected the tampered request to stay well-formed")
+	}
+	if _, _, err := issuer.Evaluate(&tampered); err == nil {
+		t.Fatal("expected the issuer to refuse a tampered request key")
+	}
+	if _, _, err := issuer.Evaluate(&tokenRequest); err != nil {
+		t.Fatal("expected the client's request to be left intact:", err)
+	}
+	if attesterFaultsInjected.Value(pat.RateLimitedTokenType, attesterFaultTamperRequestKey) != injected+1 {
+		t.Fatal("expected the fault to be counted")
+	}
+
+	_, blindedRequestKey, err := issuer.Evaluate(&tokenRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := pat.FinalizeIndex(state.ClientKey(), blind, blindedRequestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped, _ := pat.FinalizeIndex(state.ClientKey(), faults.indexBlind(blind), blindedRequestKey)
+	if bytes.Equal(index, dropped) {
+		t.Fatal("expected a dropped blind to change the index")
+	}
+
+	if faults.remaining(1, 10) != 9 {
+		t.Fatal("expected the full budget to be reported")
+	}
+}
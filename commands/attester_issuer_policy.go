@@ -0,0 +1,154 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// What the attester does with the policy in issuer directories
+	issuerPolicyIgnore  = "ignore"
+	issuerPolicyEnforce = "enforce"
+
+	defaultIssuerPolicyTTL = 5 * time.Minute
+
+	// Results of issuer policy checks, as metric labels
+	issuerPolicyCheckOK          = "ok"
+	issuerPolicyCheckTokenType   = "token-type"
+	issuerPolicyCheckUnavailable = "unavailable"
+)
+
+var (
+	ErrTokenTypeNotOffered     = errors.New("Token type not offered by issuer")
+	ErrIssuerPolicyUnavailable = errors.New("Issuer directory unavailable")
+)
+
+// issuerDirectoryPolicy is the policy an issuer publishes in its directory.
+// Origin allowlists are not published, and the attester could not check them
+// anyway, since it only sees anonymous origin IDs, so the issuer enforces
+// them alone.
+type issuerDirectoryPolicy struct {
+	tokenTypes   map[uint16]bool
+	tokenWindow  time.Duration // zero if the directory has none
+	tokenWindows []tokenWindow // limits per origin, shortest first
+	fetched      time.Time
+}
+
+func newIssuerDirectoryPolicy(issuerConfig IssuerConfig, now time.Time) *issuerDirectoryPolicy {
+	policy := &issuerDirectoryPolicy{
+		tokenTypes:   make(map[uint16]bool),
+		tokenWindow:  time.Duration(issuerConfig.TokenWindow) * time.Second,
+		tokenWindows: tokenWindowsOf(issuerConfig.TokenWindows),
+		fetched:      now,
+	}
+	for _, tokenKey := range issuerConfig.TokenKeys {
+		policy.tokenTypes[uint16(tokenKey.TokenType)] = true
+	}
+	return policy
+}
+
+// issuerPolicyCache fetches the directories of the issuers the attester
+// forwards to, so that requests the issuer would refuse are refused before
+// forwarding them. Directories are kept for the TTL, and after that for as
+// long as the issuer's directory cannot be fetched.
+type issuerPolicyCache struct {
+	client       *http.Client
+	issuers      *issuerPool
+	ttl          time.Duration
+	policyWindow time.Duration // the attester's, compared to the issuers'
+
+	lock     sync.Mutex
+	policies map[string]*issuerDirectoryPolicy
+}
+
+func newIssuerPolicyCache(client *http.Client, issuers *issuerPool, ttl, policyWindow time.Duration) *issuerPolicyCache {
+	return &issuerPolicyCache{
+		client:       client,
+		issuers:      issuers,
+		ttl:          ttl,
+		policyWindow: policyWindow,
+		policies:     make(map[string]*issuerDirectoryPolicy),
+	}
+}
+
+// fetch reads the directory of the issuer from its endpoints in failover
+// order.
+func (c *issuerPolicyCache) fetch(issuer string, now time.Time) (*issuerDirectoryPolicy, error) {
+	var lastErr error
+	for _, endpoint := range c.issuers.candidates(issuer, now) {
+		issuerConfig, err := fetchIssuerDirectory(c.client, endpoint.directoryURI())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		policy := newIssuerDirectoryPolicy(issuerConfig, now)
+		if policy.tokenWindow > 0 && policy.tokenWindow != c.policyWindow {
+			log.Warnf("Issuer %s counts tokens over %s, the attester over its policy window of %s", issuer, policy.tokenWindow, c.policyWindow)
+		}
+		return policy, nil
+	}
+	return nil, lastErr
+}
+
+// get returns the policy of the issuer, fetching its directory if the cached
+// one is older than the TTL.
+func (c *issuerPolicyCache) get(issuer string, now time.Time) (*issuerDirectoryPolicy, error) {
+	c.lock.Lock()
+	cached := c.policies[issuer]
+	c.lock.Unlock()
+	if cached != nil && now.Sub(cached.fetched) < c.ttl {
+		return cached, nil
+	}
+
+	policy, err := c.fetch(issuer, now)
+	if err != nil {
+		if cached != nil {
+			log.Warnln("Failed fetching issuer directory of", issuer+", using the cached one:", err)
+			return cached, nil
+		}
+		return nil, fmt.Errorf("%w: %v", ErrIssuerPolicyUnavailable, err)
+	}
+	c.lock.Lock()
+	c.policies[issuer] = policy
+	c.lock.Unlock()
+	return policy, nil
+}
+
+// check refuses token requests of a type the issuer does not offer. A nil
+// cache checks nothing.
+func (c *issuerPolicyCache) check(issuer string, tokenType uint16, now time.Time) error {
+	if c == nil {
+		return nil
+	}
+	policy, err := c.get(issuer, now)
+	if err != nil {
+		attesterIssuerPolicyChecks.Inc(tokenType, issuerPolicyCheckUnavailable)
+		return err
+	}
+	if !policy.tokenTypes[tokenType] {
+		attesterIssuerPolicyChecks.Inc(tokenType, issuerPolicyCheckTokenType)
+		return fmt.Errorf("%w: 0x%04x", ErrTokenTypeNotOffered, tokenType)
+	}
+	attesterIssuerPolicyChecks.Inc(tokenType, issuerPolicyCheckOK)
+	return nil
+}
+
+// windows returns the token windows of the issuer as of its cached directory,
+// without fetching it, so that it can be called under client locks. A nil
+// cache has none.
+func (c *issuerPolicyCache) windows(issuer string) []tokenWindow {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if policy := c.policies[issuer]; policy != nil {
+		return policy.tokenWindows
+	}
+	return nil
+}
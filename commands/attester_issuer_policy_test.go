@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestIssuerEndpointDirectoryURI(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"issuer.example":                 "https://issuer.example" + issuerConfigURI,
+		"http://localhost:8080/v1/issue": "http://localhost:8080" + issuerConfigURI,
+	} {
+		endpoint, err := newIssuerEndpoint(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uri := endpoint.directoryURI(); uri != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, spec, uri)
+		}
+	}
+}
+
+func TestIssuerPolicyCache(t *testing.T) {
+	var fetches int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != issuerConfigURI {
+			http.NotFound(w, req)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		json.NewEncoder(w).Encode(IssuerConfig{
+			TokenWindow: 3600,
+			TokenKeys:   []IssuerTokenKey{{TokenType: int(pat.RateLimitedTokenType), TokenKey: "key"}},
+		})
+	}))
+	defer server.Close()
+
+	issuers := newIssuerPool(map[string][]string{"issuer.example": {server.URL}}, 0)
+	cache := newIssuerPolicyCache(server.Client(), issuers, time.Minute, time.Hour)
+	now := time.Now()
+	if err := cache.check("issuer.example", pat.RateLimitedTokenType, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.check("issuer.example", pat.BasicPublicTokenType, now); !errors.Is(err, ErrTokenTypeNotOffered) {
+		t.Fatalf("expected a token type the issuer does not offer to be refused, got %v", err)
+	}
+	if atomic.LoadInt32(&fetches) != 1 {
+		t.Fatalf("expected the directory to be cached, got %d fetches", fetches)
+	}
+	if policy, _ := cache.get("issuer.example", now); policy.tokenWindow != time.Hour {
+		t.Fatalf("expected the issuer's token window, got %s", policy.tokenWindow)
+	}
+
+	// Expired directories are fetched again, and kept while the issuer is down
+	cache.check("issuer.example", pat.RateLimitedTokenType, now.Add(2*time.Minute))
+	if atomic.LoadInt32(&fetches) != 2 {
+		t.Fatalf("expected the expired directory to be fetched again, got %d fetches", fetches)
+	}
+	server.Close()
+	if err := cache.check("issuer.example", pat.RateLimitedTokenType, now.Add(4*time.Minute)); err != nil {
+		t.Fatalf("expected the cached directory to be used while the issuer is down, got %v", err)
+	}
+
+	unavailable := cache.check("other.example", pat.RateLimitedTokenType, now)
+	if !errors.Is(unavailable, ErrIssuerPolicyUnavailable) {
+		t.Fatalf("expected requests to issuers without directory to be refused, got %v", unavailable)
+	}
+
+	var disabled *issuerPolicyCache
+	if err := disabled.check("other.example", pat.BasicPublicTokenType, now); err != nil {
+		t.Fatal(err)
+	}
+}
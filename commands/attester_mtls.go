@@ -0,0 +1,107 @@
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrMissingAttesterCertificate = errors.New("Token requests require an attester client certificate")
+	ErrInvalidAttesterCertificate = errors.New("Invalid attester client certificate")
+)
+
+// loadIssuerClientCertificate loads the client certificate attesters present
+// to issuers, or returns nil if none is configured.
+func loadIssuerClientCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("Invalid issuer client certificate, both --issuer-client-cert and --issuer-client-key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid issuer client certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("Invalid issuer client certificate: %w", err)
+		}
+	}
+	return &cert, nil
+}
+
+// withClientCertificate returns a client presenting the certificate when
+// issuers ask for one during the TLS handshake. Clients that do not speak TLS,
+// such as h2c clients, cannot present certificates.
+func withClientCertificate(client *http.Client, cert tls.Certificate) (*http.Client, error) {
+	var transport *http.Transport
+	switch base := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = base.Clone()
+	default:
+		return nil, fmt.Errorf("Invalid issuer client certificate, the transport to issuers does not use TLS")
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	withCert := *client
+	withCert.Transport = transport
+	return &withCert, nil
+}
+
+// verifyClientCertificate verifies the certificate the client presented during
+// the TLS handshake for client authentication against the roots, and returns
+// its leaf.
+func verifyClientCertificate(req *http.Request, roots *x509.CertPool) (*x509.Certificate, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("No client certificate")
+	}
+	leaf := req.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range req.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// verifyAttesterCertificate refuses token requests without a client
+// certificate of a trusted attester if attester CAs are configured, and logs
+// which attester presented the others.
+func (i *Issuer) verifyAttesterCertificate(w http.ResponseWriter, req *http.Request) bool {
+	if i.attesterCAs == nil {
+		return true
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		log.Infoln("Refusing token request from", req.RemoteAddr+":", ErrMissingAttesterCertificate)
+		issuerAttesterCertificates.Inc(0, "", "missing")
+		http.Error(w, ErrMissingAttesterCertificate.Error(), http.StatusUnauthorized)
+		return false
+	}
+	leaf, err := verifyClientCertificate(req, i.attesterCAs)
+	if err != nil {
+		log.Infoln("Refusing token request from", req.RemoteAddr+":", ErrInvalidAttesterCertificate.Error()+":", err)
+		issuerAttesterCertificates.Inc(0, "", "invalid")
+		http.Error(w, ErrInvalidAttesterCertificate.Error(), http.StatusForbidden)
+		return false
+	}
+	log.Infoln("Token request from", req.RemoteAddr, "presented attester certificate", leaf.Subject.CommonName)
+	issuerAttesterCertificates.Inc(0, leaf.Subject.CommonName, "verified")
+	return true
+}
@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestAttesterClientCertificate(t *testing.T) {
+	attesterCA, attesterCAKey := createTestClientCert(t, "Attester CA", nil, nil)
+	attesterCert, attesterKey := createTestClientCert(t, "attester.example", attesterCA, attesterCAKey)
+	adminCA, adminCAKey := createTestClientCert(t, "Admin CA", nil, nil)
+	operatorCert, operatorKey := createTestClientCert(t, "operator", adminCA, adminCAKey)
+
+	issuer := newTestPrivateIssuer(t)
+	issuer.attesterCAs = x509.NewCertPool()
+	issuer.attesterCAs.AddCert(attesterCA)
+	mux := http.NewServeMux()
+	mux.HandleFunc(issuerConfigURI, issuer.handleConfigRequest)
+	mux.HandleFunc(tokenRequestURI, issuer.handleIssuanceRequest)
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: x509.NewCertPool()}
+	server.TLS.ClientCAs.AddCert(attesterCA)
+	server.TLS.ClientCAs.AddCert(adminCA)
+	server.StartTLS()
+	defer server.Close()
+	issuer.name = strings.TrimPrefix(server.URL, "https://")
+
+	challenge := pat.TokenChallenge{
+		TokenType:  pat.BasicPrivateTokenType,
+		IssuerName: issuer.name,
+		OriginInfo: []string{"origin.example"},
+	}
+	publicKeyEnc, _ := issuer.privateIssuer.TokenKey().MarshalBinary()
+	fetch := func(client *http.Client) error {
+		token, err := fetchPrivateToken(client, "", challenge.Marshal(), publicKeyEnc)
+		if err != nil {
+			return err
+		}
+		return verifyPrivateToken(issuer.privateTokenKey, token)
+	}
+
+	if err := fetch(server.Client()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected a token request without a client certificate to be refused, got %v", err)
+	}
+	// Certificates of admins pass the handshake but do not make attesters
+	operator, err := withClientCertificate(server.Client(), tls.Certificate{Certificate: [][]byte{operatorCert.Raw}, PrivateKey: operatorKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fetch(operator); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected a token request with an admin certificate to be refused, got %v", err)
+	}
+	attester, err := withClientCertificate(server.Client(), tls.Certificate{Certificate: [][]byte{attesterCert.Raw}, PrivateKey: attesterKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := issuerAttesterCertificates.Value(0, "attester.example", "verified")
+	if err := fetch(attester); err != nil {
+		t.Fatal(err)
+	}
+	if issuerAttesterCertificates.Value(0, "attester.example", "verified") != verified+1 {
+		t.Fatal("expected the attester certificate to be counted")
+	}
+
+	if _, err := withClientCertificate(newHTTPClient(false, true), tls.Certificate{}); err == nil {
+		t.Fatal("expected h2c clients to refuse client certificates")
+	}
+	if _, err := loadIssuerClientCertificate("attester.pem", ""); err == nil {
+		t.Fatal("expected a certificate without its key to be refused")
+	}
+}
@@ -0,0 +1,68 @@
+package commands
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rotateStates drops the anonymous origin mappings that clients did not use
+// in the current or the previous policy window, as issuances do for the
+// issuing client, and clients left without any, along with expired blinded
+// request keys. Otherwise the mappings of clients that stopped requesting
+// tokens would be kept, and persisted, forever. It returns the mappings and
+// clients dropped.
+func (a TestAttester) rotateStates(now time.Time) (int, int) {
+	epoch := a.policyEpoch(now)
+	origins, clients := 0, 0
+	for _, clientID := range a.clients.clientIDs() {
+		err := a.clients.update(clientID, func(state *ClientState) error {
+			if !state.known() {
+				return nil
+			}
+			before := len(state.originIndices)
+			state.expireOrigins(epoch, now)
+			expired := before - len(state.originIndices)
+			expiredKeys := state.expireBlindedKeys(a.blindedKeys.lifetime, now)
+			if expired == 0 {
+				if expiredKeys > 0 {
+					state.touch(now)
+				}
+				return nil
+			}
+			origins += expired
+			if len(state.originIndices) == 0 {
+				*state = ClientState{}
+				clients++
+			} else {
+				state.touch(now)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Errorln("Failed rotating state of client", clientID+":", err)
+		}
+	}
+	attesterStateExpired.Add(0, float64(origins), "origin")
+	attesterStateExpired.Add(0, float64(clients), "client")
+	return origins, clients
+}
+
+// runStateRotation rotates the client states once per policy window until ctx
+// is done.
+func (a TestAttester) runStateRotation(ctx context.Context) {
+	ticker := time.NewTicker(a.policyWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			origins, clients := a.rotateStates(a.now())
+			if origins > 0 {
+				log.Infof("Rotated client state: dropped %d anonymous origins and %d clients", origins, clients)
+			}
+		}
+	}
+}
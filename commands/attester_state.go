@@ -0,0 +1,317 @@
+package commands
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// clientEntry guards the state of a single client.
+type clientEntry struct {
+	lock    sync.Mutex
+	state   ClientState
+	removed bool // set once the entry was dropped from the store
+}
+
+// clientStateStore holds the attester's per-client state. Updates of one
+// client's state are atomic, while different clients are updated in parallel.
+type clientStateStore struct {
+	lock    sync.Mutex
+	clients map[string]*clientEntry
+	backend clientStateBackend // persists every change if set
+	sealer  *stateSealer       // encrypts the states of the backend
+
+	// Held for reading by updates and for writing by wipes, so that no
+	// update persists a state while the key is rotated and the backend wiped
+	wipeLock sync.RWMutex
+}
+
+func newClientStateStore() *clientStateStore {
+	return &clientStateStore{
+		clients: make(map[string]*clientEntry),
+	}
+}
+
+func (s *clientStateStore) entry(clientID string) *clientEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry, ok := s.clients[clientID]
+	if !ok {
+		entry = &clientEntry{}
+		s.clients[clientID] = entry
+	}
+	return entry
+}
+
+// update runs fn on the client's state while holding the client's lock, and
+// returns its error. Clients without state are passed the zero ClientState,
+// which is dropped again unless fn initializes it.
+func (s *clientStateStore) update(clientID string, fn func(state *ClientState) error) error {
+	s.wipeLock.RLock()
+	defer s.wipeLock.RUnlock()
+	for {
+		entry := s.entry(clientID)
+		entry.lock.Lock()
+		if entry.removed {
+			// Dropped while waiting for the lock, start over with a fresh entry
+			entry.lock.Unlock()
+			continue
+		}
+		wasKnown, revision := entry.state.known(), entry.state.revision
+		err := fn(&entry.state)
+		persistErr := s.persist(clientID, entry.state, wasKnown, revision)
+		if !entry.state.known() {
+			s.lock.Lock()
+			delete(s.clients, clientID)
+			s.lock.Unlock()
+			entry.removed = true
+		}
+		entry.lock.Unlock()
+		if err == nil {
+			return persistErr
+		}
+		return err
+	}
+}
+
+// persist writes the client's state through to the backend if it changed
+// since the update started, or removes it if it was dropped.
+func (s *clientStateStore) persist(clientID string, state ClientState, wasKnown bool, revision uint64) error {
+	var err error
+	switch {
+	case s.backend == nil:
+		return nil
+	case state.known() && state.revision != revision:
+		err = s.save(clientID, state)
+	case !state.known() && wasKnown:
+		err = s.backend.remove(clientID)
+	default:
+		return nil
+	}
+	if err != nil {
+		log.Errorln("Failed persisting state of client", clientID+":", err)
+		attesterStatePersistFailures.Inc(0)
+		return fmt.Errorf("%w: %v", ErrStatePersistence, err)
+	}
+	return nil
+}
+
+func (s *clientStateStore) save(clientID string, state ClientState) error {
+	data, err := marshalClientState(state)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.sealer.seal(clientID, data)
+	if err != nil {
+		return err
+	}
+	return s.backend.save(clientID, sealed)
+}
+
+// restore loads the states persisted in the backend, and writes every later
+// change through to it, sealed by the sealer. States the sealer cannot open,
+// e.g., left behind by a wipe under a key since rotated, are skipped. It
+// returns the number of clients loaded.
+func (s *clientStateStore) restore(backend clientStateBackend, sealer *stateSealer) (int, error) {
+	sealedStates, err := backend.load()
+	if err != nil {
+		return 0, err
+	}
+	states := make(map[string]ClientState, len(sealedStates))
+	unsealed := 0
+	for clientID, sealed := range sealedStates {
+		data, err := sealer.open(clientID, sealed)
+		if err != nil {
+			unsealed++
+			continue
+		}
+		state, err := unmarshalClientState(data)
+		if err != nil {
+			return 0, err
+		}
+		states[clientID] = state
+	}
+	if unsealed > 0 {
+		log.Warnln("Skipped the state of", unsealed, "clients not sealed under the state encryption key")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for clientID, state := range states {
+		s.clients[clientID] = &clientEntry{state: state}
+	}
+	s.backend = backend
+	s.sealer = sealer
+	return len(states), nil
+}
+
+// clientIDs returns the clients with state.
+func (s *clientStateStore) clientIDs() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	clientIDs := make([]string, 0, len(s.clients))
+	for clientID := range s.clients {
+		clientIDs = append(clientIDs, clientID)
+	}
+	return clientIDs
+}
+
+// touch records a change of the state.
+func (state *ClientState) touch(now time.Time) {
+	state.updated = now
+	state.revision++
+}
+
+// known reports whether the state was initialized by an issuance.
+func (state ClientState) known() bool {
+	return state.originIndices != nil
+}
+
+// issuerLimitCache remembers the token limit each issuer sent last.
+type issuerLimitCache struct {
+	lock   sync.RWMutex
+	limits map[string]int
+}
+
+func newIssuerLimitCache() *issuerLimitCache {
+	return &issuerLimitCache{
+		limits: make(map[string]int),
+	}
+}
+
+// get returns the last limit of the issuer, zero if unknown.
+func (c *issuerLimitCache) get(issuer string) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.limits[issuer]
+}
+
+func (c *issuerLimitCache) set(issuer string, limit int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.limits[issuer] = limit
+}
+
+// blindedKeyClaim is the anonymous origin a blinded request key was returned
+// for, and when.
+type blindedKeyClaim struct {
+	anonOriginEnc string
+	claimed       time.Time
+}
+
+// blindedKeyOwner is the client and anonymous origin a blinded request key
+// was first returned for.
+type blindedKeyOwner struct {
+	clientID string
+	blindedKeyClaim
+}
+
+// blindedKeyLifetime returns how long blinded request keys are tracked: the
+// policy window, over which anonymous origin mappings are kept, or the
+// privacy epoch if the mappings are kept forever.
+func blindedKeyLifetime(policyWindow, privacyEpoch time.Duration) time.Duration {
+	if policyWindow > 0 {
+		return policyWindow
+	}
+	return privacyEpoch
+}
+
+// blindedKeyIndex records the blinded request keys returned by issuers for
+// the keys' lifetime, across the states of all clients. Each client's state
+// keeps its own keys, which are persisted with it and rebuild the index when
+// the attester restarts.
+type blindedKeyIndex struct {
+	lock      sync.Mutex
+	lifetime  time.Duration
+	owners    map[string]blindedKeyOwner
+	nextSweep time.Time
+}
+
+func newBlindedKeyIndex(lifetime time.Duration) *blindedKeyIndex {
+	return &blindedKeyIndex{
+		lifetime: lifetime,
+		owners:   make(map[string]blindedKeyOwner),
+	}
+}
+
+// expired tells whether a key claimed then is no longer tracked.
+func (i *blindedKeyIndex) expired(claimed, now time.Time) bool {
+	return !now.Before(claimed.Add(i.lifetime))
+}
+
+// claim records the blinded request key for the client and anonymous origin.
+// Clients draw a fresh blind for every request, so a blinded request key seen
+// before means the client replayed a blind, e.g., to evade index stability,
+// and the returned scope tells where it was seen. Fresh keys return "". Keys
+// claimed longer than the lifetime ago count as fresh, and are swept once
+// per lifetime.
+func (i *blindedKeyIndex) claim(blindedKeyEnc, clientID, anonOriginEnc string, now time.Time) string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if !now.Before(i.nextSweep) {
+		for key, owner := range i.owners {
+			if i.expired(owner.claimed, now) {
+				delete(i.owners, key)
+			}
+		}
+		i.nextSweep = now.Add(i.lifetime)
+	}
+	owner, ok := i.owners[blindedKeyEnc]
+	switch {
+	case !ok || i.expired(owner.claimed, now):
+		i.owners[blindedKeyEnc] = blindedKeyOwner{clientID, blindedKeyClaim{anonOriginEnc, now}}
+		return ""
+	case owner.clientID != clientID:
+		return blindReuseCrossClient
+	case owner.anonOriginEnc != anonOriginEnc:
+		return blindReuseCrossOrigin
+	default:
+		return blindReuseSameOrigin
+	}
+}
+
+// restore adds the unexpired blinded request keys kept in the client
+// states, and returns how many.
+func (i *blindedKeyIndex) restore(clients *clientStateStore, now time.Time) int {
+	restored := 0
+	for _, clientID := range clients.clientIDs() {
+		clients.update(clientID, func(state *ClientState) error {
+			i.lock.Lock()
+			defer i.lock.Unlock()
+			for blindedKeyEnc, claim := range state.blindedKeys {
+				if !i.expired(claim.claimed, now) {
+					i.owners[blindedKeyEnc] = blindedKeyOwner{clientID, claim}
+					restored++
+				}
+			}
+			return nil
+		})
+	}
+	return restored
+}
+
+// claimBlindedKey keeps the blinded request key returned for the anonymous
+// origin in the client's state, dropping the keys claimed longer than the
+// lifetime ago.
+func (state *ClientState) claimBlindedKey(blindedKeyEnc, anonOriginEnc string, lifetime time.Duration, now time.Time) {
+	state.expireBlindedKeys(lifetime, now)
+	if state.blindedKeys == nil {
+		state.blindedKeys = make(map[string]blindedKeyClaim)
+	}
+	state.blindedKeys[blindedKeyEnc] = blindedKeyClaim{anonOriginEnc, now}
+}
+
+// expireBlindedKeys drops the blinded request keys claimed longer than the
+// lifetime ago, and returns how many.
+func (state *ClientState) expireBlindedKeys(lifetime time.Duration, now time.Time) int {
+	expired := 0
+	for blindedKeyEnc, claim := range state.blindedKeys {
+		if !now.Before(claim.claimed.Add(lifetime)) {
+			delete(state.blindedKeys, blindedKeyEnc)
+			expired++
+		}
+	}
+	return expired
+}
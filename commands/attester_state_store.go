@@ -0,0 +1,253 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrStatePersistence = errors.New("Failed persisting client state")
+)
+
+// clientStateBackend persists the attester's client state, so that a
+// restarted attester keeps per-origin counts and buckets, and clients cannot
+// reset their limits by waiting for a restart. States are written through on
+// every change and read back at startup. Backends keep states as sealed by
+// the stateSealer, by client ID.
+type clientStateBackend interface {
+	load() (map[string][]byte, error)
+	save(clientID string, sealed []byte) error
+	remove(clientID string) error
+	// wipe removes all states, and returns how many there were.
+	wipe() (int, error)
+}
+
+type persistedBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+type persistedBlindedKey struct {
+	Origin  string    `json:"origin"`
+	Claimed time.Time `json:"claimed"`
+}
+
+// persistedWindowCount is a windowCount, keyed by its window in seconds.
+type persistedWindowCount struct {
+	Epoch uint64 `json:"epoch"`
+	Count int    `json:"count"`
+}
+
+// persistedClientState is ClientState as stored. Indices by anonymous origin
+// are stored once, and the reverse mapping is rebuilt when loading.
+type persistedClientState struct {
+	OriginIndices map[string]string                         `json:"origin-indices"`
+	OriginCounts  map[string]int                            `json:"origin-counts"`
+	OriginEpochs  map[string]uint64                         `json:"origin-epochs"`
+	ClientBucket  *persistedBucket                          `json:"client-bucket,omitempty"`
+	OriginBuckets map[string]persistedBucket                `json:"origin-buckets"`
+	WindowCounts  map[string]map[int64]persistedWindowCount `json:"window-counts,omitempty"`
+	BlindedKeys   map[string]persistedBlindedKey            `json:"blinded-keys,omitempty"`
+	Created       time.Time                                 `json:"created"`
+	Updated       time.Time                                 `json:"updated"`
+}
+
+func marshalClientState(state ClientState) ([]byte, error) {
+	persisted := persistedClientState{
+		OriginIndices: state.originIndices,
+		OriginCounts:  state.originCounts,
+		OriginEpochs:  state.originEpochs,
+		OriginBuckets: make(map[string]persistedBucket, len(state.originBuckets)),
+		Created:       state.created,
+		Updated:       state.updated,
+	}
+	if state.clientBucket != nil {
+		persisted.ClientBucket = &persistedBucket{state.clientBucket.tokens, state.clientBucket.updated}
+	}
+	for anonOriginEnc, bucket := range state.originBuckets {
+		persisted.OriginBuckets[anonOriginEnc] = persistedBucket{bucket.tokens, bucket.updated}
+	}
+	if len(state.windowCounts) > 0 {
+		persisted.WindowCounts = make(map[string]map[int64]persistedWindowCount, len(state.windowCounts))
+		for anonOriginEnc, counts := range state.windowCounts {
+			persisted.WindowCounts[anonOriginEnc] = make(map[int64]persistedWindowCount, len(counts))
+			for length, counted := range counts {
+				persisted.WindowCounts[anonOriginEnc][int64(length/time.Second)] = persistedWindowCount{counted.epoch, counted.count}
+			}
+		}
+	}
+	if len(state.blindedKeys) > 0 {
+		persisted.BlindedKeys = make(map[string]persistedBlindedKey, len(state.blindedKeys))
+		for blindedKeyEnc, claim := range state.blindedKeys {
+			persisted.BlindedKeys[blindedKeyEnc] = persistedBlindedKey{claim.anonOriginEnc, claim.claimed}
+		}
+	}
+	return json.Marshal(persisted)
+}
+
+func unmarshalClientState(data []byte) (ClientState, error) {
+	var persisted persistedClientState
+	if err := json.Unmarshal(data, &persisted); err != nil {
+		return ClientState{}, err
+	}
+	state := ClientState{
+		originIndices: make(map[string]string),
+		originCounts:  make(map[string]int),
+		originEpochs:  make(map[string]uint64),
+		indexOrigins:  make(map[string]string),
+		originBuckets: make(map[string]*tokenBucket),
+		created:       persisted.Created,
+		updated:       persisted.Updated,
+	}
+	for anonOriginEnc, indexEnc := range persisted.OriginIndices {
+		state.originIndices[anonOriginEnc] = indexEnc
+		state.indexOrigins[indexEnc] = anonOriginEnc
+	}
+	for anonOriginEnc, count := range persisted.OriginCounts {
+		state.originCounts[anonOriginEnc] = count
+	}
+	for anonOriginEnc, epoch := range persisted.OriginEpochs {
+		state.originEpochs[anonOriginEnc] = epoch
+	}
+	if persisted.ClientBucket != nil {
+		state.clientBucket = &tokenBucket{tokens: persisted.ClientBucket.Tokens, updated: persisted.ClientBucket.Updated}
+	}
+	for anonOriginEnc, bucket := range persisted.OriginBuckets {
+		state.originBuckets[anonOriginEnc] = &tokenBucket{tokens: bucket.Tokens, updated: bucket.Updated}
+	}
+	for anonOriginEnc, counts := range persisted.WindowCounts {
+		for seconds, counted := range counts {
+			state.setWindowCount(anonOriginEnc, time.Duration(seconds)*time.Second, windowCount{counted.Epoch, counted.Count})
+		}
+	}
+	if len(persisted.BlindedKeys) > 0 {
+		state.blindedKeys = make(map[string]blindedKeyClaim, len(persisted.BlindedKeys))
+		for blindedKeyEnc, claim := range persisted.BlindedKeys {
+			state.blindedKeys[blindedKeyEnc] = blindedKeyClaim{claim.Origin, claim.Claimed}
+		}
+	}
+	return state, nil
+}
+
+// boltClientStateBackend keeps client states in a bucket of a Bolt database,
+// by client ID.
+type boltClientStateBackend struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func newBoltClientStateBackend(db *bolt.DB) (*boltClientStateBackend, error) {
+	b := &boltClientStateBackend{
+		db:     db,
+		bucket: []byte("attester-clients"),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(b.bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *boltClientStateBackend) load() (map[string][]byte, error) {
+	states := make(map[string][]byte)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).ForEach(func(key, value []byte) error {
+			// Values are only valid during the transaction
+			states[string(key)] = append([]byte(nil), value...)
+			return nil
+		})
+	})
+	return states, err
+}
+
+func (b *boltClientStateBackend) save(clientID string, sealed []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Put([]byte(clientID), sealed)
+	})
+}
+
+func (b *boltClientStateBackend) remove(clientID string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Delete([]byte(clientID))
+	})
+}
+
+func (b *boltClientStateBackend) wipe() (int, error) {
+	count := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		count = tx.Bucket(b.bucket).Stats().KeyN
+		if err := tx.DeleteBucket(b.bucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(b.bucket)
+		return err
+	})
+	return count, err
+}
+
+// redisClientStateBackend keeps client states in Redis, one key per client,
+// so that attester replicas sharing the server also share the state.
+type redisClientStateBackend struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func newRedisClientStateBackend(client redis.UniversalClient) *redisClientStateBackend {
+	return &redisClientStateBackend{
+		client: client,
+		prefix: "pat:attester-clients:",
+	}
+}
+
+func (b *redisClientStateBackend) load() (map[string][]byte, error) {
+	ctx := context.Background()
+	keys, err := scanRedisKeys(ctx, b.client, b.prefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		data, err := b.client.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		states[strings.TrimPrefix(key, b.prefix)] = data
+	}
+	return states, nil
+}
+
+func (b *redisClientStateBackend) save(clientID string, sealed []byte) error {
+	return b.client.Set(context.Background(), b.prefix+clientID, sealed, 0).Err()
+}
+
+func (b *redisClientStateBackend) remove(clientID string) error {
+	return b.client.Del(context.Background(), b.prefix+clientID).Err()
+}
+
+func (b *redisClientStateBackend) wipe() (int, error) {
+	ctx := context.Background()
+	keys, err := scanRedisKeys(ctx, b.client, b.prefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	// Keys of a cluster are deleted one by one, as they may lie in different
+	// slots
+	for _, key := range keys {
+		if err := b.client.Del(ctx, key).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,150 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// testClientStatePersistence checks that a restarted attester keeps the
+// per-origin counts of the state store.
+func testClientStatePersistence(t *testing.T, store string) {
+	stores := newStateStores()
+	defer stores.close()
+	backend, err := stores.openClientStates(store)
+	if err != nil || backend == nil {
+		t.Fatalf("expected a state store, got %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "state.key")
+	sealer, err := openStateSealer(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attester := newTestAttester(nil)
+	if restored, err := attester.clients.restore(backend, sealer); err != nil || restored != 0 {
+		t.Fatalf("expected an empty store, got %d clients: %v", restored, err)
+	}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := attester.issue("client", "origin", 3, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attester.issue("other", "origin", 3, now)
+
+	// States are stored encrypted
+	sealedStates, _ := backend.load()
+	for _, sealed := range sealedStates {
+		if bytes.Contains(sealed, []byte("origin")) {
+			t.Fatalf("expected the stored state to be encrypted, got %q", sealed)
+		}
+	}
+
+	// The key is read back from its file on restart
+	if sealer, err = openStateSealer(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	restarted := newTestAttester(nil)
+	if restored, err := restarted.clients.restore(backend, sealer); err != nil || restored != 2 {
+		t.Fatalf("expected both clients to be restored, got %d: %v", restored, err)
+	}
+	if count := restarted.originCount("client", "origin"); count != 2 {
+		t.Fatalf("expected the count to survive the restart, got %d", count)
+	}
+	if err := restarted.issue("client", "origin", 3, now); !errors.Is(err, ErrIssuerLimitExceeded) {
+		t.Fatalf("expected the restarted attester to enforce the limit, got %v", err)
+	}
+	restarted.clients.update("client", func(state *ClientState) error {
+		if !state.created.Equal(now) || state.indexOrigins["index"] != "origin" {
+			t.Fatalf("expected timestamps and indices to be restored, got %+v", state)
+		}
+		return nil
+	})
+
+	// Wiping drops the stored states too
+	if _, stored, err := restarted.clients.wipe(); err != nil || stored != 2 {
+		t.Fatalf("expected 2 stored clients to be wiped, got %d: %v", stored, err)
+	}
+	if states, _ := backend.load(); len(states) != 0 {
+		t.Fatalf("expected no stored state after a wipe, got %d", len(states))
+	}
+	// and rotates the key, so that states left behind cannot be read
+	if _, err := sealer.open("client", sealedStates["client"]); !errors.Is(err, ErrStateUnsealed) {
+		t.Fatalf("expected states sealed before the wipe to be unreadable, got %v", err)
+	}
+	backend.save("client", sealedStates["client"])
+	if restored, err := newTestAttester(nil).clients.restore(backend, sealer); err != nil || restored != 0 {
+		t.Fatalf("expected states sealed before the wipe to be skipped, got %d: %v", restored, err)
+	}
+}
+
+func TestBoltClientStates(t *testing.T) {
+	testClientStatePersistence(t, "bolt:"+filepath.Join(t.TempDir(), "attester.db"))
+}
+
+func TestRedisClientStates(t *testing.T) {
+	server := miniredis.RunT(t)
+	testClientStatePersistence(t, "redis://"+server.Addr()+"/0")
+}
+
+func TestMemoryClientStates(t *testing.T) {
+	if backend, err := newStateStores().openClientStates(storeMemory); err != nil || backend != nil {
+		t.Fatalf("expected no state store for memory, got %v: %v", backend, err)
+	}
+}
+
+type failingClientStateBackend struct{}
+
+func (failingClientStateBackend) load() (map[string][]byte, error) { return nil, nil }
+func (failingClientStateBackend) save(string, []byte) error        { return errors.New("disk full") }
+func (failingClientStateBackend) remove(string) error              { return errors.New("disk full") }
+func (failingClientStateBackend) wipe() (int, error)               { return 0, errors.New("disk full") }
+
+func TestClientStatePersistenceFailure(t *testing.T) {
+	sealer, err := openStateSealer(filepath.Join(t.TempDir(), "state.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attester := newTestAttester(nil)
+	attester.clients.restore(failingClientStateBackend{}, sealer)
+	failures := attesterStatePersistFailures.Value(0)
+	if err := attester.issue("client", "origin", 3, time.Now()); !errors.Is(err, ErrStatePersistence) {
+		t.Fatalf("expected the issuance to fail closed, got %v", err)
+	}
+	if attesterStatePersistFailures.Value(0) != failures+1 {
+		t.Fatal("expected the failure to be counted")
+	}
+	// Checks that change nothing are not written
+	err = attester.clients.update("client", func(state *ClientState) error { return nil })
+	if err != nil {
+		t.Fatalf("expected unchanged state not to be written, got %v", err)
+	}
+}
+
+func TestRotateStates(t *testing.T) {
+	attester := newTestAttester(nil)
+	attester.policyWindow = time.Hour
+	now := time.Unix(0, 0).Add(10 * time.Hour)
+	attester.issue("idle", "origin", 0, now)
+	attester.issue("active", "old-origin", 0, now)
+	attester.issue("active", "origin", 0, now.Add(time.Hour))
+
+	// Mappings are kept through the next window
+	if origins, clients := attester.rotateStates(now.Add(time.Hour)); origins != 0 || clients != 0 {
+		t.Fatalf("expected nothing to expire yet, got %d origins and %d clients", origins, clients)
+	}
+	origins, clients := attester.rotateStates(now.Add(2 * time.Hour))
+	if origins != 2 || clients != 1 {
+		t.Fatalf("expected 2 origins and 1 client to expire, got %d and %d", origins, clients)
+	}
+	if ids := attester.clients.clientIDs(); len(ids) != 1 || ids[0] != "active" {
+		t.Fatalf("expected only the active client to be kept, got %q", ids)
+	}
+	if attester.originCount("active", "origin") != 1 || attester.originCount("active", "old-origin") != 0 {
+		t.Fatal("expected only the unused origin of the active client to expire")
+	}
+}
@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Bytes of issuer responses copied to the client at a time when streaming
+	streamChunkSize = 32 * 1024
+)
+
+// responseStreaming controls how the attester relays the body of issuer
+// responses. Buffered, the body is read in full before the attester answers,
+// so a failed read is answered with an error. Streamed, the body is copied to
+// the client as it arrives once the attester is done with the issuer's
+// headers, which cuts the tail latency of large batched responses from slow
+// issuers, and a failed read aborts the response.
+type responseStreaming struct {
+	enabled       bool
+	flushInterval time.Duration // between flushes at most, after every chunk if zero
+}
+
+// buffer reads the body of the issuer's response, or returns nil if it is
+// streamed by write.
+func (s responseStreaming) buffer(body io.Reader) ([]byte, error) {
+	if s.enabled {
+		return nil, nil
+	}
+	return ioutil.ReadAll(body)
+}
+
+// write answers the client with the buffered body, or streams the body of
+// the issuer's response. Headers must be set before.
+func (s responseStreaming) write(w http.ResponseWriter, resp *http.Response, buffered []byte) {
+	if !s.enabled {
+		w.Write(buffered)
+		return
+	}
+	// The length lets clients tell an aborted stream from a complete one
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+	chunk := make([]byte, streamChunkSize)
+	flushed := time.Now()
+	for {
+		n, err := resp.Body.Read(chunk)
+		if n > 0 {
+			if _, writeErr := w.Write(chunk[:n]); writeErr != nil {
+				log.Println("Failed streaming issuer response:", writeErr)
+				return
+			}
+			if s.flushInterval == 0 || time.Since(flushed) >= s.flushInterval {
+				controller.Flush()
+				flushed = time.Now()
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Println("Failed reading streamed issuer response:", err)
+			attesterStreamAborts.Inc(0)
+			// The status is sent already, reset the connection instead
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
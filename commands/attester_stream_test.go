@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStreamServer relays the body read from issuer like the attester relays
+// issuer responses, behind the wrappers of the attester's token requests.
+func testStreamServer(t *testing.T, streaming responseStreaming, issuer io.Reader, length int64) *httptest.Server {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		resp := &http.Response{Body: ioutil.NopCloser(issuer), ContentLength: length}
+		body, err := streaming.buffer(resp.Body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		w.Header().Set("content-type", batchedTokenResponseMediaType)
+		streaming.write(w, resp, body)
+	}
+	dedup := newRequestDedup(time.Minute, dedupActionReplay)
+	server := httptest.NewServer(instrumentTokenRequests("attester", attesterRequests, attesterRequestDuration, dedup.wrap(handler)))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestResponseStreaming(t *testing.T) {
+	issuer, issuerWriter := io.Pipe()
+	server := testStreamServer(t, responseStreaming{enabled: true}, issuer, 6)
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Post(server.URL, batchedTokenRequestMediaType, strings.NewReader("request"))
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+
+	// The first bytes reach the client while the issuer is still responding
+	issuerWriter.Write([]byte("abc"))
+	resp := <-responses
+	if resp == nil {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	first := make([]byte, 3)
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "abc" {
+		t.Fatalf("expected the first bytes to be streamed, got %q: %v", first, err)
+	}
+	issuerWriter.Write([]byte("def"))
+	issuerWriter.Close()
+	rest, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(rest) != "def" {
+		t.Fatalf("expected the rest of the response, got %q: %v", rest, err)
+	}
+}
+
+func TestResponseStreamingAbort(t *testing.T) {
+	issuer, issuerWriter := io.Pipe()
+	server := testStreamServer(t, responseStreaming{enabled: true}, issuer, 6)
+	go func() {
+		issuerWriter.Write([]byte("abc"))
+		issuerWriter.CloseWithError(errors.New("issuer connection reset"))
+	}()
+	aborts := attesterStreamAborts.Value(0)
+	resp, err := http.Post(server.URL, batchedTokenRequestMediaType, strings.NewReader("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := ioutil.ReadAll(resp.Body); err == nil {
+		t.Fatalf("expected the aborted response to fail, got %q", body)
+	}
+	if attesterStreamAborts.Value(0) != aborts+1 {
+		t.Fatal("expected the abort to be counted")
+	}
+}
+
+func TestResponseBuffering(t *testing.T) {
+	server := testStreamServer(t, responseStreaming{}, bytes.NewReader([]byte("abcdef")), -1)
+	resp, err := http.Post(server.URL, batchedTokenRequestMediaType, strings.NewReader("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "abcdef" {
+		t.Fatalf("expected the buffered response, got %q: %v", body, err)
+	}
+}
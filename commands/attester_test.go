@@ -0,0 +1,313 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func newTestAttester(policy *AttesterPolicy) TestAttester {
+	return TestAttester{
+		clients:      newClientStateStore(),
+		issuerLimits: newIssuerLimitCache(),
+		blindedKeys:  newBlindedKeyIndex(time.Hour),
+		policy:       policy,
+		ledger:       newPrivacyLedger(time.Hour),
+		fraud:        newFraudSignals(time.Minute, 0, nil),
+		maintenance:  newMaintenanceMode(),
+	}
+}
+
+// issue checks and records one issuance like the attester does once the
+// issuer responded.
+func (a TestAttester) issue(clientID, anonOriginEnc string, tokenLimit int, now time.Time) error {
+	return a.clients.update(clientID, func(state *ClientState) error {
+		if err := checkIndex(state, anonOriginEnc, "index"); err != nil {
+			return err
+		}
+		if err := a.checkIssuance(state, clientID, anonOriginEnc, "issuer.example", pat.RateLimitedTokenType, tokenLimit, nil, true, now); err != nil {
+			return err
+		}
+		a.recordIssuance(state, clientID, anonOriginEnc, "index", "issuer.example", now)
+		return nil
+	})
+}
+
+func (a TestAttester) originCount(clientID, anonOriginEnc string) int {
+	count := 0
+	a.clients.update(clientID, func(state *ClientState) error {
+		count = state.originCounts[anonOriginEnc]
+		return nil
+	})
+	return count
+}
+
+func TestAttesterIssuanceCheck(t *testing.T) {
+	attester := newTestAttester(nil)
+	now := time.Now()
+	check := func(tokenLimit int) error {
+		return attester.clients.update("alice", func(state *ClientState) error {
+			return attester.checkIssuance(state, "alice", "origin-a", "issuer.example", pat.RateLimitedTokenType, tokenLimit, nil, true, now)
+		})
+	}
+
+	// Unknown clients and limits are not refused, and checks keep no state
+	if err := check(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(attester.clients.clients) != 0 {
+		t.Fatal("expected checks of unknown clients not to create state")
+	}
+	for i := 0; i < 2; i++ {
+		if err := attester.issue("alice", "origin-a", 3, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := check(3); !errors.Is(err, ErrIssuerLimitExceeded) {
+		t.Fatalf("expected the issuer limit to be enforced, got %v", err)
+	}
+	if err := check(0); err != nil {
+		t.Fatal("expected an unknown limit not to be enforced")
+	}
+	if attester.originCount("alice", "origin-a") != 2 {
+		t.Fatal("expected refused checks not to change the state")
+	}
+
+	err := attester.clients.update("alice", func(state *ClientState) error {
+		if err := checkIndex(state, "origin-b", "other"); err != nil {
+			return fmt.Errorf("expected new origins to accept any index")
+		}
+		return checkIndex(state, "origin-a", "other")
+	})
+	if !errors.Is(err, ErrIndexMismatch) {
+		t.Fatalf("expected the index mismatch to be detected, got %v", err)
+	}
+}
+
+func TestAttesterIssuanceCheckBuckets(t *testing.T) {
+	policy := &AttesterPolicy{
+		ClientPolicy: ClientPolicy{Client: BucketPolicy{Burst: 1}},
+	}
+	expression, err := compilePolicyExpression(`limit == 0 || state.origin_count < limit`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.expression = expression
+	attester := newTestAttester(policy)
+	now := time.Now()
+	check := func(clientID string, tokenLimit int, evaluatePolicy bool) error {
+		return attester.clients.update(clientID, func(state *ClientState) error {
+			return attester.checkIssuance(state, clientID, "origin-b", "issuer.example", pat.RateLimitedTokenType, tokenLimit, nil, evaluatePolicy, now)
+		})
+	}
+
+	if err := attester.issue("alice", "origin-a", 10, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := check("alice", 10, true); !errors.Is(err, ErrBucketLimitExceeded) {
+		t.Fatalf("expected the empty bucket to be reported, got %v", err)
+	}
+	if err := check("bob", 1, true); !errors.Is(err, ErrIssuanceDenied) {
+		t.Fatalf("expected the policy to deny, got %v", err)
+	}
+	if err := check("bob", 1, false); err != nil {
+		t.Fatal("expected the policy to be skipped")
+	}
+}
+
+func TestAttesterOriginRotation(t *testing.T) {
+	attester := newTestAttester(nil)
+	attester.policyWindow = time.Hour
+	start := time.Unix(0, 0).Add(1000 * time.Hour)
+	issue := func(anonOriginEnc, indexEnc string, now time.Time) error {
+		return attester.clients.update("alice", func(state *ClientState) error {
+			attester.rotateOrigin(state, "alice", anonOriginEnc, indexEnc, now)
+			if err := checkIndex(state, anonOriginEnc, indexEnc); err != nil {
+				return err
+			}
+			if err := attester.checkIssuance(state, "alice", anonOriginEnc, "issuer.example", pat.RateLimitedTokenType, 4, nil, true, now); err != nil {
+				return err
+			}
+			attester.recordIssuance(state, "alice", anonOriginEnc, indexEnc, "issuer.example", now)
+			return nil
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := issue("origin-a", "index-1", start); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A rotated ID with the same index takes over the count of the old ID
+	rotations := attesterOriginRotations.Value(pat.RateLimitedTokenType)
+	if err := issue("origin-b", "index-1", start.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if attesterOriginRotations.Value(pat.RateLimitedTokenType) != rotations+1 {
+		t.Fatal("expected the rotation to be counted")
+	}
+	if attester.originCount("alice", "origin-a") != 0 || attester.originCount("alice", "origin-b") != 3 {
+		t.Fatal("expected the count to move to the rotated ID")
+	}
+	if err := issue("origin-c", "index-1", start.Add(2*time.Minute)); !errors.Is(err, ErrIssuerLimitExceeded) {
+		t.Fatalf("expected rotating the ID not to reset the limit, got %v", err)
+	}
+	if budget := attester.ledger.report("alice").Epochs[0].Clients[0]; budget.DistinctOrigins != 1 || budget.Tokens != 3 {
+		t.Fatalf("expected the rotation not to count as another origin, got %+v", budget)
+	}
+
+	// Counts reset with the next policy window
+	if err := issue("origin-c", "index-1", start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if attester.originCount("alice", "origin-c") != 1 {
+		t.Fatal("expected the count to reset in the next window")
+	}
+
+	// Origins unused for a whole window expire
+	if err := issue("origin-d", "index-2", start.Add(3*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	attester.clients.update("alice", func(state *ClientState) error {
+		if _, ok := state.originIndices["origin-c"]; ok || len(state.indexOrigins) != 1 {
+			t.Fatal("expected the unused origin to expire")
+		}
+		return nil
+	})
+}
+
+// TestAttesterConcurrentIssuance is meant to be run with -race as well.
+func TestAttesterConcurrentIssuance(t *testing.T) {
+	attester := newTestAttester(nil)
+	const clients, requests, limit = 4, 50, 21
+
+	var wg sync.WaitGroup
+	refused := make([]int32, clients)
+	for c := 0; c < clients; c++ {
+		for r := 0; r < requests; r++ {
+			wg.Add(1)
+			go func(c int) {
+				defer wg.Done()
+				if err := attester.issue(fmt.Sprintf("client-%d", c), "origin-a", limit, time.Now()); err != nil {
+					atomic.AddInt32(&refused[c], 1)
+				}
+			}(c)
+		}
+	}
+	wg.Wait()
+
+	for c := 0; c < clients; c++ {
+		clientID := fmt.Sprintf("client-%d", c)
+		if count := attester.originCount(clientID, "origin-a"); count != limit-1 {
+			t.Fatalf("expected %d issuances for %s, got %d", limit-1, clientID, count)
+		}
+		if int(refused[c]) != requests-(limit-1) {
+			t.Fatalf("expected %d refusals for %s, got %d", requests-(limit-1), clientID, refused[c])
+		}
+	}
+}
+
+func TestAttesterBlindReuse(t *testing.T) {
+	var events bytes.Buffer
+	attester := newTestAttester(nil)
+	attester.fraud = newFraudSignals(time.Minute, 0, &events)
+	now := time.Now()
+
+	if scope := attester.blindedKeys.claim("blinded", "alice", "origin-a", now); scope != "" {
+		t.Fatal("expected a fresh blinded request key to pass")
+	}
+	for _, tc := range []struct {
+		clientID, anonOriginEnc, scope string
+	}{
+		{"alice", "origin-a", blindReuseSameOrigin},
+		{"alice", "origin-b", blindReuseCrossOrigin},
+		{"bob", "origin-a", blindReuseCrossClient},
+	} {
+		if scope := attester.blindedKeys.claim("blinded", tc.clientID, tc.anonOriginEnc, now); scope != tc.scope {
+			t.Fatalf("expected %s, got %q", tc.scope, scope)
+		}
+	}
+	// Keys expire after their lifetime, and are swept
+	if scope := attester.blindedKeys.claim("other", "alice", "origin-a", now.Add(time.Hour)); scope != "" || attester.blindedKeys.count() != 1 {
+		t.Fatalf("expected the expired key to be swept, got %q and %d keys", scope, attester.blindedKeys.count())
+	}
+	if scope := attester.blindedKeys.claim("blinded", "bob", "origin-a", now.Add(time.Hour)); scope != "" {
+		t.Fatalf("expected an expired key to count as fresh, got %q", scope)
+	}
+
+	reuse := attesterBlindReuse.Value(pat.RateLimitedTokenType, blindReuseCrossClient)
+	attester.fraud.blindReuse("bob", "origin-a", "issuer.example", blindReuseCrossClient, time.Now())
+	if attesterBlindReuse.Value(pat.RateLimitedTokenType, blindReuseCrossClient) != reuse+1 {
+		t.Fatal("expected blind reuse to be counted")
+	}
+	event := fraudEvent{}
+	if err := json.Unmarshal(events.Bytes(), &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Event != fraudEventBlindReuse || event.Scope != blindReuseCrossClient {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestAttesterBlindedKeyClaimedOnIssuance(t *testing.T) {
+	attester := newTestAttester(nil)
+	attester.blindReuseAction = blindReuseActionReject
+	now := time.Now()
+	complete := func(blindedKeyEnc string, tokenLimit int) error {
+		return attester.clients.update("client", func(state *ClientState) error {
+			return attester.completeIssuance(state, "client", "origin", "index", blindedKeyEnc, "issuer.example", pat.RateLimitedTokenType, tokenLimit, nil, now)
+		})
+	}
+	if err := complete("first", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refused issuances leave the key unclaimed for a retry
+	if err := complete("second", 2); !errors.Is(err, ErrIssuerLimitExceeded) {
+		t.Fatalf("expected the limit to be enforced, got %v", err)
+	}
+	if err := complete("second", 3); err != nil {
+		t.Fatalf("expected the retry not to be taken for blind reuse, got %v", err)
+	}
+	if err := complete("second", 4); !errors.Is(err, ErrBlindReuse) {
+		t.Fatalf("expected blind reuse to be refused, got %v", err)
+	}
+
+	// Keys are kept in the client state, and rebuild the index
+	attester.clients.update("client", func(state *ClientState) error {
+		data, err := marshalClientState(*state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := unmarshalClientState(data)
+		if err != nil || len(restored.blindedKeys) != 2 || restored.blindedKeys["second"].anonOriginEnc != "origin" {
+			t.Fatalf("expected the blinded keys to be persisted, got %+v: %v", restored.blindedKeys, err)
+		}
+		return nil
+	})
+	restarted := newBlindedKeyIndex(time.Hour)
+	if restored := restarted.restore(attester.clients, now); restored != 2 {
+		t.Fatalf("expected 2 blinded keys to be restored, got %d", restored)
+	}
+	if scope := restarted.claim("first", "other", "origin", now); scope != blindReuseCrossClient {
+		t.Fatalf("expected a restored key to be claimed, got %q", scope)
+	}
+
+	// and expire with the client's state rotation
+	attester.policyWindow = time.Hour
+	attester.rotateStates(now.Add(time.Hour))
+	attester.clients.update("client", func(state *ClientState) error {
+		if len(state.blindedKeys) != 0 {
+			t.Fatalf("expected the blinded keys to expire, got %d", len(state.blindedKeys))
+		}
+		return nil
+	})
+}
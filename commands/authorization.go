@@ -0,0 +1,258 @@
+package commands
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+const (
+	// Authorization parameters of PrivateToken credentials
+	authParamToken      = "token"
+	authParamExtensions = "extensions"
+	authParamChallenge  = "challenge" // echoed signed challenges, see signed_challenge.go
+
+	// What origins do about Authorization parameters they do not know
+	unknownAuthParamsIgnore = "ignore"
+	unknownAuthParamsReject = "reject"
+)
+
+var (
+	// Authorization parameters the origin understands
+	knownAuthParams = map[string]bool{
+		authParamToken:      true,
+		authParamExtensions: true,
+		authParamChallenge:  true,
+	}
+
+	ErrInvalidAuthorization = errors.New("Invalid PrivateToken authorization")
+	ErrUnknownAuthParam     = errors.New("Unknown PrivateToken authorization parameter")
+	ErrMissingCredentials   = errors.New("No PrivateToken credentials")
+)
+
+// privateTokenCredentials holds the parameters of a PrivateToken Authorization
+// header, keyed by lower-case name, with the token and extensions decoded.
+type privateTokenCredentials struct {
+	token      []byte
+	extensions []byte // nil unless sent
+	challenge  []byte // nil unless sent
+	params     map[string]string
+}
+
+// extraParams returns the parameters other than the token, which are passed
+// on to redemption hooks.
+func (c privateTokenCredentials) extraParams() map[string]string {
+	if len(c.params) <= 1 {
+		return nil
+	}
+	params := make(map[string]string)
+	for name, value := range c.params {
+		if name != authParamToken {
+			params[name] = value
+		}
+	}
+	return params
+}
+
+// parseAuthorizationParams parses comma-separated auth-params whose values are
+// tokens or quoted strings, as in RFC 9110. Names are lower-cased and may only
+// appear once.
+func parseAuthorizationParams(value string) (map[string]string, error) {
+	params := make(map[string]string)
+	rest := strings.TrimSpace(value)
+	for rest != "" {
+		separator := strings.IndexByte(rest, '=')
+		if separator <= 0 {
+			return nil, fmt.Errorf("%w: expected a parameter at %q", ErrInvalidAuthorization, rest)
+		}
+		name := strings.ToLower(strings.TrimSpace(rest[:separator]))
+		if name == "" || strings.ContainsAny(name, " \t,\"") {
+			return nil, fmt.Errorf("%w: invalid parameter name %q", ErrInvalidAuthorization, name)
+		}
+		rest = strings.TrimLeft(rest[separator+1:], " \t")
+
+		var paramValue string
+		if strings.HasPrefix(rest, `"`) {
+			var builder strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				builder.WriteByte(rest[i])
+			}
+			if i == len(rest) {
+				return nil, fmt.Errorf("%w: unterminated value of %s", ErrInvalidAuthorization, name)
+			}
+			paramValue, rest = builder.String(), rest[i+1:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			paramValue, rest = strings.TrimRight(rest[:end], " \t"), rest[end:]
+			if paramValue == "" || strings.ContainsAny(paramValue, " \t\"") {
+				return nil, fmt.Errorf("%w: invalid value of %s", ErrInvalidAuthorization, name)
+			}
+		}
+
+		if _, ok := params[name]; ok {
+			return nil, fmt.Errorf("%w: duplicate parameter %s", ErrInvalidAuthorization, name)
+		}
+		params[name] = paramValue
+
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			break
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("%w: expected a comma after %s", ErrInvalidAuthorization, name)
+		}
+		rest = strings.TrimLeft(rest[1:], " \t,")
+	}
+	return params, nil
+}
+
+// parsePrivateTokenAuthorization parses a PrivateToken Authorization header.
+// Unknown parameters are kept, or refused if unknownParams is
+// unknownAuthParamsReject.
+func parsePrivateTokenAuthorization(authValue, unknownParams string) (privateTokenCredentials, error) {
+	scheme, value := authValue, ""
+	if separator := strings.IndexAny(authValue, " \t"); separator >= 0 {
+		scheme, value = authValue[:separator], authValue[separator+1:]
+	}
+	if !strings.EqualFold(scheme, privateTokenType) {
+		return privateTokenCredentials{}, fmt.Errorf("%w: unexpected scheme %q", ErrInvalidAuthorization, scheme)
+	}
+	params, err := parseAuthorizationParams(value)
+	if err != nil {
+		return privateTokenCredentials{}, err
+	}
+	if unknownParams == unknownAuthParamsReject {
+		for name := range params {
+			if !knownAuthParams[name] {
+				return privateTokenCredentials{}, fmt.Errorf("%w: %s", ErrUnknownAuthParam, name)
+			}
+		}
+	}
+
+	credentials := privateTokenCredentials{params: params}
+	tokenEnc, ok := params[authParamToken]
+	if !ok {
+		return privateTokenCredentials{}, fmt.Errorf("%w: missing token", ErrInvalidAuthorization)
+	}
+	credentials.token, err = decodeAuthParam(tokenEnc)
+	if err != nil {
+		return privateTokenCredentials{}, fmt.Errorf("%w: invalid token encoding", ErrInvalidAuthorization)
+	}
+	if extensionsEnc, ok := params[authParamExtensions]; ok {
+		credentials.extensions, err = decodeAuthParam(extensionsEnc)
+		if err != nil {
+			return privateTokenCredentials{}, fmt.Errorf("%w: invalid extensions encoding", ErrInvalidAuthorization)
+		}
+	}
+	if challengeEnc, ok := params[authParamChallenge]; ok {
+		credentials.challenge, err = decodeAuthParam(challengeEnc)
+		if err != nil {
+			return privateTokenCredentials{}, fmt.Errorf("%w: invalid challenge encoding", ErrInvalidAuthorization)
+		}
+	}
+	return credentials, nil
+}
+
+// privateTokenAuthorization returns the Authorization value redeeming the
+// token for the challenge, which is sent back if the origin asked for it.
+func privateTokenAuthorization(token pat.Token, challenge clientChallenge) string {
+	authValue := privateTokenType + " " + authParamToken + "=" + base64.URLEncoding.EncodeToString(token.Marshal())
+	if challenge.echo {
+		authValue += ", " + authParamChallenge + "=" + base64.URLEncoding.EncodeToString(challenge.blob)
+	}
+	return authValue
+}
+
+// decodeAuthParam decodes a base64url parameter value, padded or not.
+func decodeAuthParam(value string) ([]byte, error) {
+	data, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		data, err = base64.RawURLEncoding.DecodeString(value)
+	}
+	return data, err
+}
+
+// splitCredentials splits an Authorization header value into the credentials
+// it holds, as proxies combine repeated headers with commas. A new credential
+// starts after a comma with a scheme followed by whitespace or nothing,
+// rather than by '=' as parameters are.
+func splitCredentials(value string) []string {
+	credentials := make([]string, 0, 1)
+	start, quoted := 0, false
+	for i := 0; i < len(value); i++ {
+		switch {
+		case quoted && value[i] == '\\':
+			i++
+		case value[i] == '"':
+			quoted = !quoted
+		case !quoted && value[i] == ',' && startsCredentials(value[i+1:]):
+			credentials = append(credentials, strings.TrimSpace(value[start:i]))
+			start = i + 1
+		}
+	}
+	credentials = append(credentials, strings.TrimSpace(value[start:]))
+
+	nonEmpty := credentials[:0]
+	for _, credential := range credentials {
+		if credential != "" {
+			nonEmpty = append(nonEmpty, credential)
+		}
+	}
+	return nonEmpty
+}
+
+// startsCredentials tells whether rest starts with an auth-scheme, past any
+// empty list elements.
+func startsCredentials(rest string) bool {
+	rest = strings.TrimLeft(rest, " \t,")
+	end := strings.IndexAny(rest, " \t=,")
+	if end == 0 {
+		return false
+	}
+	switch {
+	case end < 0 || rest[end] == ',':
+		return true
+	case rest[end] == '=':
+		return false
+	}
+	next := strings.TrimLeft(rest[end:], " \t")
+	return next == "" || next[0] != '='
+}
+
+// findPrivateTokenAuthorization parses the PrivateToken credentials among
+// those of the Authorization headers of a request, skipping other schemes.
+// ErrMissingCredentials is returned if there are none, so that the client is
+// challenged, and ErrInvalidAuthorization if there are several.
+func findPrivateTokenAuthorization(header http.Header, unknownParams string) (privateTokenCredentials, error) {
+	var found []string
+	for _, value := range header.Values("Authorization") {
+		for _, credential := range splitCredentials(value) {
+			scheme := credential
+			if separator := strings.IndexAny(credential, " \t"); separator >= 0 {
+				scheme = credential[:separator]
+			}
+			if strings.EqualFold(scheme, privateTokenType) {
+				found = append(found, credential)
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return privateTokenCredentials{}, ErrMissingCredentials
+	case 1:
+		return parsePrivateTokenAuthorization(found[0], unknownParams)
+	default:
+		return privateTokenCredentials{}, fmt.Errorf("%w: %d PrivateToken credentials", ErrInvalidAuthorization, len(found))
+	}
+}
@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePrivateTokenAuthorization(t *testing.T) {
+	credentials, err := parsePrivateTokenAuthorization(`privatetoken token=AAEC, Extensions="AwQ=",key-hint="a\"b"`, unknownAuthParamsIgnore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(credentials.token, []byte{0, 1, 2}) || !bytes.Equal(credentials.extensions, []byte{3, 4}) {
+		t.Fatalf("unexpected credentials %+v", credentials)
+	}
+	params := credentials.extraParams()
+	if len(params) != 2 || params["extensions"] != "AwQ=" || params["key-hint"] != `a"b` {
+		t.Fatalf("unexpected parameters %v", params)
+	}
+	if credentials, err := parsePrivateTokenAuthorization("PrivateToken token=AAEC", unknownAuthParamsReject); err != nil || credentials.extraParams() != nil {
+		t.Fatal("expected the token alone to be accepted")
+	}
+
+	if _, err := parsePrivateTokenAuthorization(`PrivateToken token=AAEC, key-hint=1`, unknownAuthParamsReject); !errors.Is(err, ErrUnknownAuthParam) {
+		t.Fatalf("expected the unknown parameter to be refused, got %v", err)
+	}
+	for _, authValue := range []string{
+		"Bearer token=AAEC",
+		"PrivateToken",
+		"PrivateToken extensions=AwQ=",
+		"PrivateToken token=AAEC, token=AAEC",
+		`PrivateToken token="AAEC`,
+		"PrivateToken token=AAEC extensions=AwQ=",
+		"PrivateToken token=!!",
+		"PrivateToken token=AAEC, extensions=!!",
+	} {
+		if _, err := parsePrivateTokenAuthorization(authValue, unknownAuthParamsIgnore); !errors.Is(err, ErrInvalidAuthorization) {
+			t.Fatalf("expected %q to be invalid, got %v", authValue, err)
+		}
+	}
+}
+
+func TestSplitCredentials(t *testing.T) {
+	for value, expected := range map[string][]string{
+		`PrivateToken token=AAEC, extensions="a,b"`:         {`PrivateToken token=AAEC, extensions="a,b"`},
+		`Basic Zm9vOmJhcg==, PrivateToken token=AAEC`:       {"Basic Zm9vOmJhcg==", "PrivateToken token=AAEC"},
+		`PrivateToken token=AAEC,key-hint=1 , Negotiate`:    {"PrivateToken token=AAEC,key-hint=1", "Negotiate"},
+		`Bearer , , PrivateToken   token = "AAEC", x="\","`: {"Bearer", `PrivateToken   token = "AAEC", x="\","`},
+	} {
+		credentials := splitCredentials(value)
+		if len(credentials) != len(expected) {
+			t.Fatalf("unexpected credentials %q of %q", credentials, value)
+		}
+		for i := range expected {
+			if credentials[i] != expected[i] {
+				t.Fatalf("unexpected credentials %q of %q", credentials, value)
+			}
+		}
+	}
+}
+
+func TestFindPrivateTokenAuthorization(t *testing.T) {
+	header := make(http.Header)
+	if _, err := findPrivateTokenAuthorization(header, unknownAuthParamsIgnore); !errors.Is(err, ErrMissingCredentials) {
+		t.Fatalf("expected missing credentials, got %v", err)
+	}
+	header.Add("Authorization", "Basic Zm9vOmJhcg==")
+	if _, err := findPrivateTokenAuthorization(header, unknownAuthParamsIgnore); !errors.Is(err, ErrMissingCredentials) {
+		t.Fatalf("expected credentials of other schemes to be skipped, got %v", err)
+	}
+
+	// Unpadded values and extra whitespace are accepted
+	header.Add("Authorization", "Bearer abc,  privatetoken  token = AAE , extensions=AwQ")
+	credentials, err := findPrivateTokenAuthorization(header, unknownAuthParamsIgnore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(credentials.token, []byte{0, 1}) || !bytes.Equal(credentials.extensions, []byte{3, 4}) {
+		t.Fatalf("unexpected credentials %+v", credentials)
+	}
+
+	header.Add("Authorization", "PrivateToken token=AAEC")
+	if _, err := findPrivateTokenAuthorization(header, unknownAuthParamsIgnore); !errors.Is(err, ErrInvalidAuthorization) {
+		t.Fatalf("expected several PrivateToken credentials to be refused, got %v", err)
+	}
+}
+
+func TestOriginAuthorizationStatus(t *testing.T) {
+	origin := newMultiIssuerOrigin(t, newTestIssuer(t, "issuer.example"))
+	for header, status := range map[string]int{
+		"Basic Zm9vOmJhcg==":                        http.StatusUnauthorized,
+		"PrivateToken token=!!":                     http.StatusBadRequest,
+		"PrivateToken token=AAEC, PrivateToken x=1": http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+		req.Header.Set("Authorization", header)
+		rec := httptest.NewRecorder()
+		origin.handleRequest(rec, req)
+		if rec.Code != status {
+			t.Fatalf("expected %d for %q, got %d", status, header, rec.Code)
+		}
+		if status == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("expected a challenge for %q", header)
+		}
+		if status == http.StatusBadRequest && !strings.HasPrefix(rec.Body.String(), ErrInvalidAuthorization.Error()) {
+			t.Fatalf("expected the error for %q, got %q", header, rec.Body.String())
+		}
+	}
+}
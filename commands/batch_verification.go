@@ -0,0 +1,144 @@
+package commands
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+)
+
+const (
+	adminVerifyTokensURI = adminURIPrefix + "tokens/verify"
+
+	// Most tokens verified in one batch
+	maxTokenVerificationBatch = 10000
+)
+
+var ErrUnknownTokenIssuer = errors.New("No issuer of the origin verifies the token")
+
+// tokenVerdict is the outcome of verifying one token of a batch. Verifying
+// neither consumes a challenge nor spends the token.
+type tokenVerdict struct {
+	Valid     bool   `json:"valid"`
+	TokenType string `json:"token_type,omitempty"`
+	Issuer    string `json:"issuer,omitempty"` // that verified the token
+	Error     string `json:"error,omitempty"`
+}
+
+// verifyTokenBatch verifies the encoded tokens with a pool of workers, with
+// the keys of the named issuer or else of every issuer of the origin, and
+// returns the verdicts in the order of the tokens. Tokens not verified before
+// the context is done are reported with its error.
+func (o *Origin) verifyTokenBatch(ctx context.Context, issuerName string, tokens [][]byte, workers int) []tokenVerdict {
+	issuers := o.challengeIssuers()
+	if issuerName != "" {
+		issuer, ok := o.issuerByName(issuerName)
+		if !ok {
+			issuer = originIssuer{name: issuerName}
+		}
+		issuers = []originIssuer{issuer}
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	verdicts := make([]tokenVerdict, len(tokens))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(tokens); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					verdicts[i] = tokenVerdict{Error: err.Error()}
+					continue
+				}
+				verdicts[i] = o.verifyBatchToken(ctx, issuers, tokens[i])
+			}
+		}()
+	}
+	for i := range tokens {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return verdicts
+}
+
+// verifyBatchToken verifies the token with the issuers in turn, remotely for
+// issuers the origin verifies tokens of remotely.
+func (o *Origin) verifyBatchToken(ctx context.Context, issuers []originIssuer, tokenEnc []byte) tokenVerdict {
+	token, err := unmarshalToken(tokenEnc)
+	if err != nil {
+		originBatchVerifications.Inc(0, "invalid")
+		return tokenVerdict{Error: "Failed decoding token"}
+	}
+	verdict := tokenVerdict{TokenType: formatTokenType(token.TokenType)}
+	err = ErrUnknownTokenIssuer
+	for _, issuer := range issuers {
+		if issuer.remoteVerifier != nil {
+			err = issuer.remoteVerifier.verify(ctx, token.TokenType, tokenEnc)
+		} else if issuer.keys != nil {
+			err = verifyToken(verificationKeys{issuer: issuer.keys.current(), privateTokenKey: o.privateTokenKey}, token.TokenType, token)
+		}
+		if err == nil {
+			originBatchVerifications.Inc(token.TokenType, "valid")
+			verdict.Valid, verdict.Issuer = true, issuer.name
+			return verdict
+		}
+	}
+	originBatchVerifications.Inc(token.TokenType, "invalid")
+	verdict.Error = err.Error()
+	return verdict
+}
+
+// verifyTokensRequest lists tokens encoded as in the Authorization header,
+// verified with the keys of the named issuer, or else of every issuer.
+type verifyTokensRequest struct {
+	Issuer string   `json:"issuer,omitempty"`
+	Tokens []string `json:"tokens"`
+}
+
+type verifyTokensResponse struct {
+	Valid    int            `json:"valid"`
+	Invalid  int            `json:"invalid"`
+	Verdicts []tokenVerdict `json:"verdicts"` // in the order of the tokens
+}
+
+func (o *Origin) handleVerifyTokens(w http.ResponseWriter, req *http.Request) {
+	var verifyReq verifyTokensRequest
+	if err := readAdminJSON(req, &verifyReq); err != nil {
+		http.Error(w, "Invalid verification request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(verifyReq.Tokens) > maxTokenVerificationBatch {
+		http.Error(w, fmt.Sprintf("At most %d tokens can be verified at once", maxTokenVerificationBatch), http.StatusBadRequest)
+		return
+	}
+	tokens := make([][]byte, len(verifyReq.Tokens))
+	for i, tokenEnc := range verifyReq.Tokens {
+		token, err := base64.URLEncoding.DecodeString(tokenEnc)
+		if err != nil {
+			token, err = base64.RawURLEncoding.DecodeString(tokenEnc)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid encoding of token %d", i), http.StatusBadRequest)
+			return
+		}
+		tokens[i] = token
+	}
+
+	response := verifyTokensResponse{Verdicts: o.verifyTokenBatch(req.Context(), verifyReq.Issuer, tokens, o.verificationWorkers)}
+	for _, verdict := range response.Verdicts {
+		if verdict.Valid {
+			response.Valid++
+		} else {
+			response.Invalid++
+		}
+	}
+	writeAdminJSON(w, response)
+}
@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestVerifyTokenBatch(t *testing.T) {
+	issuerA := newTestIssuer(t, "a.example")
+	issuerB := newTestIssuer(t, "b.example")
+	origin := newMultiIssuerOrigin(t, issuerA, issuerB)
+	admin := origin.newAdminServer("secret")
+
+	challenge := pat.TokenChallenge{TokenType: pat.BasicPublicTokenType, IssuerName: "b.example", OriginInfo: []string{"origin.example"}}
+	tokens := []string{
+		base64.URLEncoding.EncodeToString(createTestToken(t, issuerA, challenge.Marshal()).Marshal()),
+		base64.RawURLEncoding.EncodeToString(createTestToken(t, issuerB, challenge.Marshal()).Marshal()),
+		base64.URLEncoding.EncodeToString([]byte{0x00}),
+	}
+	forged := createTestToken(t, issuerB, challenge.Marshal())
+	forged.Authenticator[0] ^= 1
+	tokens = append(tokens, base64.URLEncoding.EncodeToString(forged.Marshal()))
+
+	var response verifyTokensResponse
+	if code := adminRequest(t, admin, http.MethodPost, adminVerifyTokensURI, verifyTokensRequest{Tokens: tokens}, &response); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if response.Valid != 2 || response.Invalid != 2 || len(response.Verdicts) != 4 {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	if response.Verdicts[0].Issuer != "a.example" || response.Verdicts[1].Issuer != "b.example" || response.Verdicts[1].TokenType != "0x0002" {
+		t.Fatalf("unexpected verdicts %+v", response.Verdicts)
+	}
+	if response.Verdicts[2].Valid || response.Verdicts[2].Error == "" || response.Verdicts[3].Valid || response.Verdicts[3].TokenType != "0x0002" {
+		t.Fatalf("expected the malformed and forged tokens to be invalid, got %+v", response.Verdicts[2:])
+	}
+
+	// Naming the issuer verifies with its keys only
+	if code := adminRequest(t, admin, http.MethodPost, adminVerifyTokensURI, verifyTokensRequest{Issuer: "b.example", Tokens: tokens[:2]}, &response); code != http.StatusOK || response.Valid != 1 || response.Verdicts[0].Valid {
+		t.Fatalf("unexpected response %d %+v", code, response)
+	}
+	if code := adminRequest(t, admin, http.MethodPost, adminVerifyTokensURI, verifyTokensRequest{Tokens: []string{"!"}}, nil); code != http.StatusBadRequest {
+		t.Fatalf("expected a malformed encoding to be refused, got %d", code)
+	}
+
+	// Tokens left when the context is done are not verified
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, verdict := range origin.verifyTokenBatch(ctx, "", [][]byte{nil, nil}, 1) {
+		if verdict.Valid || verdict.Error != context.Canceled.Error() {
+			t.Fatalf("unexpected verdict %+v", verdict)
+		}
+	}
+}
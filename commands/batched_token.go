@@ -0,0 +1,321 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/cloudflare/circl/group"
+	"github.com/cloudflare/circl/group/dleq"
+	"github.com/cloudflare/circl/oprf"
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	batchedTokenRequestMediaType  = "message/batched-token-request"
+	batchedTokenResponseMediaType = "message/batched-token-response"
+
+	// Tokens per batch the issuer evaluates at most
+	maxTokenBatchSize = 64
+)
+
+var (
+	ErrInvalidBatchedTokenRequest  = errors.New("Invalid batched TokenRequest")
+	ErrInvalidBatchedTokenResponse = errors.New("Invalid batched TokenResponse")
+)
+
+// batchedTokenRequest asks for several private tokens in one round trip. The
+// issuer evaluates all blinded elements with one key and proves it with a
+// single DLEQ proof.
+//
+//	struct {
+//	    uint16_t token_type = 0x0001;
+//	    uint8_t truncated_token_key_id;
+//	    BlindedElement blinded_elements<0..2^16-1>;
+//	} BatchedTokenRequest;
+type batchedTokenRequest struct {
+	tokenKeyID      uint8
+	blindedElements [][]byte
+}
+
+func (r batchedTokenRequest) Marshal() []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(pat.BasicPrivateTokenType)
+	b.AddUint8(r.tokenKeyID)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, element := range r.blindedElements {
+			b.AddBytes(element)
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+// validateBatchedTokenRequest checks the encoding of a batched TokenRequest,
+// like validateTokenRequest, and returns its token type.
+func validateBatchedTokenRequest(data []byte) (uint16, error) {
+	if _, err := unmarshalBatchedTokenRequest(data); err != nil {
+		return 0, err
+	}
+	return pat.BasicPrivateTokenType, nil
+}
+
+func unmarshalBatchedTokenRequest(data []byte) (*batchedTokenRequest, error) {
+	s := cryptobyte.String(data)
+	var tokenType uint16
+	var elements cryptobyte.String
+	request := &batchedTokenRequest{}
+	if !s.ReadUint16(&tokenType) || tokenType != pat.BasicPrivateTokenType ||
+		!s.ReadUint8(&request.tokenKeyID) ||
+		!s.ReadUint16LengthPrefixed(&elements) || !s.Empty() {
+		return nil, ErrInvalidBatchedTokenRequest
+	}
+	if len(elements) == 0 || len(elements)%privateTokenElementLength != 0 {
+		return nil, ErrInvalidBatchedTokenRequest
+	}
+	if count := len(elements) / privateTokenElementLength; count > maxTokenBatchSize {
+		return nil, fmt.Errorf("%w: %d tokens, at most %d", ErrInvalidBatchedTokenRequest, count, maxTokenBatchSize)
+	}
+	for !elements.Empty() {
+		var element []byte
+		elements.ReadBytes(&element, privateTokenElementLength)
+		request.blindedElements = append(request.blindedElements, element)
+	}
+	return request, nil
+}
+
+//	struct {
+//	    EvaluatedElement evaluated_elements<0..2^16-1>;
+//	    opaque evaluated_proof[Ns + Ns];
+//	} BatchedTokenResponse;
+func marshalBatchedTokenResponse(evaluation *oprf.Evaluation) ([]byte, error) {
+	b := cryptobyte.NewBuilder(nil)
+	var err error
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, element := range evaluation.Elements {
+			var elementEnc []byte
+			if elementEnc, err = element.MarshalBinaryCompress(); err != nil {
+				return
+			}
+			b.AddBytes(elementEnc)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	proofEnc, err := evaluation.Proof.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b.AddBytes(proofEnc)
+	return b.Bytes()
+}
+
+func unmarshalBatchedTokenResponse(data []byte, count int) (*oprf.Evaluation, error) {
+	s := cryptobyte.String(data)
+	var elements cryptobyte.String
+	var proofEnc []byte
+	if !s.ReadUint16LengthPrefixed(&elements) || len(elements) != count*privateTokenElementLength ||
+		!s.ReadBytes(&proofEnc, 2*privateTokenScalarLength) || !s.Empty() {
+		return nil, ErrInvalidBatchedTokenResponse
+	}
+	evaluation := &oprf.Evaluation{Proof: new(dleq.Proof)}
+	for !elements.Empty() {
+		var elementEnc []byte
+		elements.ReadBytes(&elementEnc, privateTokenElementLength)
+		element := group.P384.NewElement()
+		if err := element.UnmarshalBinary(elementEnc); err != nil {
+			return nil, ErrInvalidBatchedTokenResponse
+		}
+		evaluation.Elements = append(evaluation.Elements, element)
+	}
+	if err := evaluation.Proof.UnmarshalBinary(group.P384, proofEnc); err != nil {
+		return nil, ErrInvalidBatchedTokenResponse
+	}
+	return evaluation, nil
+}
+
+// evaluateBatchedTokenRequest evaluates every blinded element of the request
+// with the issuer key, checking it names that key.
+func evaluateBatchedTokenRequest(key *oprf.PrivateKey, request *batchedTokenRequest) ([]byte, error) {
+	issuer := pat.NewBasicPrivateIssuer(key)
+	if keyID := issuer.TokenKeyID(); request.tokenKeyID != keyID[0] {
+		return nil, fmt.Errorf("Unknown token key ID %d", request.tokenKeyID)
+	}
+	evalRequest := &oprf.EvaluationRequest{}
+	for _, elementEnc := range request.blindedElements {
+		element := group.P384.NewElement()
+		if err := element.UnmarshalBinary(elementEnc); err != nil {
+			return nil, ErrInvalidBatchedTokenRequest
+		}
+		evalRequest.Elements = append(evalRequest.Elements, element)
+	}
+	evaluation, err := oprf.NewVerifiableServer(oprf.SuiteP384, key).Evaluate(evalRequest)
+	if err != nil {
+		return nil, err
+	}
+	return marshalBatchedTokenResponse(evaluation)
+}
+
+// batchedTokenRequestState holds what the client needs to unbatch the
+// response into tokens.
+type batchedTokenRequestState struct {
+	client       oprf.VerifiableClient
+	finalizeData *oprf.FinalizeData
+	tokens       []pat.Token // without authenticator
+	request      batchedTokenRequest
+}
+
+// createBatchedTokenRequest blinds count private tokens for the challenge,
+// each with its own nonce.
+func createBatchedTokenRequest(challenge []byte, count int, publicKeyEnc []byte) (*batchedTokenRequestState, error) {
+	if count <= 0 || count > maxTokenBatchSize {
+		return nil, fmt.Errorf("Invalid batch size %d", count)
+	}
+	publicKey, err := unmarshalPrivateTokenKey(publicKeyEnc)
+	if err != nil {
+		return nil, err
+	}
+	keyID := privateTokenKeyID(publicKeyEnc)
+	context := sha256.Sum256(challenge)
+
+	state := &batchedTokenRequestState{
+		client:  oprf.NewVerifiableClient(oprf.SuiteP384, publicKey),
+		request: batchedTokenRequest{tokenKeyID: keyID[0]},
+	}
+	inputs := make([][]byte, count)
+	for i := range inputs {
+		nonce := make([]byte, 32)
+		rand.Reader.Read(nonce)
+		token := pat.Token{
+			TokenType: pat.BasicPrivateTokenType,
+			Nonce:     nonce,
+			Context:   context[:],
+			KeyID:     keyID,
+		}
+		state.tokens = append(state.tokens, token)
+		inputs[i] = token.AuthenticatorInput()
+	}
+
+	finalizeData, evalRequest, err := state.client.Blind(inputs)
+	if err != nil {
+		return nil, err
+	}
+	state.finalizeData = finalizeData
+	for _, element := range evalRequest.Elements {
+		elementEnc, err := element.MarshalBinaryCompress()
+		if err != nil {
+			return nil, err
+		}
+		state.request.blindedElements = append(state.request.blindedElements, elementEnc)
+	}
+	return state, nil
+}
+
+// finalize checks the batch proof and unbatches the response into tokens.
+func (s *batchedTokenRequestState) finalize(responseEnc []byte) ([]pat.Token, error) {
+	evaluation, err := unmarshalBatchedTokenResponse(responseEnc, len(s.tokens))
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := s.client.Finalize(s.finalizeData, evaluation)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]pat.Token, len(s.tokens))
+	for i, token := range s.tokens {
+		token.Authenticator = outputs[i]
+		tokens[i] = token
+	}
+	return tokens, nil
+}
+
+// fetchBatchedPrivateTokens runs one issuance for count private tokens
+// through the attester.
+func fetchBatchedPrivateTokens(httpClient *http.Client, attester string, challenge []byte, publicKeyEnc []byte, count int) ([]pat.Token, error) {
+	tokenChallenge, err := pat.UnmarshalTokenChallenge(challenge)
+	if err != nil {
+		return nil, err
+	}
+	issuerConfig, err := fetchIssuerConfig(httpClient, tokenChallenge.IssuerName)
+	if err != nil {
+		return nil, err
+	}
+	issuerRequestURI, err := composeURL(tokenChallenge.IssuerName, issuerConfig.RequestURI)
+	if err != nil {
+		return nil, err
+	}
+	issuerURL, err := url.Parse(issuerRequestURI)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := createBatchedTokenRequest(challenge, count, publicKeyEnc)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenRequestURI, err := composeURL(attester, attesterTokenRequestURI)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, tokenRequestURI, bytes.NewReader(state.request.Marshal()))
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("issuer", issuerURL.Host)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Content-Type", batchedTokenRequestMediaType)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, tokenRequestError(resp)
+	}
+	tokenResponse, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	protocolTranscript.record("client", messageTokenChallenge, pat.BasicPrivateTokenType, publicKeyEnc, challenge)
+	protocolTranscript.record("client", messageBatchedTokenRequest, pat.BasicPrivateTokenType, nil, state.request.Marshal())
+	protocolTranscript.record("client", messageBatchedTokenResponse, pat.BasicPrivateTokenType, nil, tokenResponse)
+	tokens, err := state.finalize(tokenResponse)
+	for _, token := range tokens {
+		protocolTranscript.recordToken(token, err)
+	}
+	return tokens, err
+}
+
+// issueBatch answers a batched token request. The caller holds the lock.
+func (i *Issuer) issueBatch(w http.ResponseWriter, body []byte) {
+	tokenRequest, err := unmarshalBatchedTokenRequest(body)
+	if err != nil || i.privateTokenKey == nil {
+		log.Debugln("Failed decoding batched token request:", err)
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Failed decoding token request", 400)
+		return
+	}
+
+	tokenResponse, err := evaluateBatchedTokenRequest(i.privateTokenKey, tokenRequest)
+	if err != nil {
+		log.Debugln("Token evaluation failed:", err)
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Token evaluation failed", 400)
+		return
+	}
+	issuerBatchedTokens.Add(pat.BasicPrivateTokenType, float64(len(tokenRequest.blindedElements)))
+
+	w.Header().Set("content-type", batchedTokenResponseMediaType)
+	w.Header().Set("Connection", "close")
+	w.Write(tokenResponse)
+}
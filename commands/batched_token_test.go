@@ -0,0 +1,102 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestBatchedTokenIssuance(t *testing.T) {
+	issuer := newTestPrivateIssuer(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(issuer.handleIssuanceRequest))
+	defer server.Close()
+
+	attester := newTestAttester(&AttesterPolicy{})
+	attester.client = server.Client()
+	attester.issuers = newIssuerPool(map[string][]string{"issuer.example": {server.URL + tokenRequestURI}}, time.Second)
+
+	challenge := pat.TokenChallenge{
+		TokenType:  pat.BasicPrivateTokenType,
+		IssuerName: "issuer.example",
+		OriginInfo: []string{"origin.example"},
+	}
+	publicKeyEnc, _ := issuer.privateIssuer.TokenKey().MarshalBinary()
+	state, err := createBatchedTokenRequest(challenge.Marshal(), 5, publicKeyEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batched := issuerBatchedTokens.Value(pat.BasicPrivateTokenType)
+	req := httptest.NewRequest(http.MethodPost, attesterTokenRequestURI+"?issuer=issuer.example", bytes.NewReader(state.request.Marshal()))
+	req.Header.Set("Content-Type", batchedTokenRequestMediaType)
+	w := httptest.NewRecorder()
+	attester.handleAttestationRequest(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != batchedTokenResponseMediaType {
+		t.Fatalf("unexpected batched response %d %q: %s", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+	if issuerBatchedTokens.Value(pat.BasicPrivateTokenType) != batched+5 {
+		t.Fatal("expected the batched tokens to be counted")
+	}
+
+	tokens, err := state.finalize(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 5 || bytes.Equal(tokens[0].Nonce, tokens[1].Nonce) {
+		t.Fatalf("expected 5 distinct tokens, got %d", len(tokens))
+	}
+	for _, token := range tokens {
+		decoded, err := unmarshalToken(token.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verifyPrivateToken(issuer.privateTokenKey, decoded); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The batch proof binds the response to the issuer key
+	otherKey, _ := loadPrivateTokenKey("")
+	request := state.request
+	otherKeyID := pat.NewBasicPrivateIssuer(otherKey).TokenKeyID()
+	request.tokenKeyID = otherKeyID[0]
+	forged, err := evaluateBatchedTokenRequest(otherKey, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := state.finalize(forged); err == nil {
+		t.Fatal("expected a response under another key to be refused")
+	}
+}
+
+func TestBatchedTokenRequestEncoding(t *testing.T) {
+	element := make([]byte, privateTokenElementLength)
+	request := batchedTokenRequest{tokenKeyID: 7, blindedElements: [][]byte{element, element}}
+	decoded, err := unmarshalBatchedTokenRequest(request.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.tokenKeyID != 7 || len(decoded.blindedElements) != 2 {
+		t.Fatalf("unexpected request %+v", decoded)
+	}
+
+	tooLarge := batchedTokenRequest{}
+	for i := 0; i <= maxTokenBatchSize; i++ {
+		tooLarge.blindedElements = append(tooLarge.blindedElements, element)
+	}
+	for _, data := range [][]byte{
+		batchedTokenRequest{}.Marshal(),
+		request.Marshal()[:len(request.Marshal())-1],
+		tooLarge.Marshal(),
+		append([]byte{0x00, 0x02}, request.Marshal()[2:]...),
+	} {
+		if _, err := validateBatchedTokenRequest(data); !errors.Is(err, ErrInvalidBatchedTokenRequest) {
+			t.Fatalf("expected ErrInvalidBatchedTokenRequest, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// challengeTiming is when a challenge reached the client, measured from the
+// start of the request.
+type challengeTiming struct {
+	hinted time.Duration // in 103 Early Hints, zero if none was sent
+	final  time.Duration // in the final 401
+}
+
+// timeChallenge requests the resource without a token and times the arrival
+// of its challenge.
+func timeChallenge(httpClient *http.Client, resourceURI string) (challengeTiming, error) {
+	timing := challengeTiming{}
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints && header.Get("WWW-Authenticate") != "" && timing.hinted == 0 {
+				timing.hinted = time.Since(start)
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, resourceURI, nil)
+	if err != nil {
+		return timing, err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return timing, err
+	}
+	timing.final = time.Since(start)
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		return timing, fmt.Errorf("Expected a challenge, got status %d", resp.StatusCode)
+	}
+	return timing, nil
+}
+
+// percentile returns the p-th percentile of sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// benchSummary describes the challenge latencies, and the win of Early Hints
+// over the final response if they were sent.
+func benchSummary(timings []challengeTiming) string {
+	var hinted, final, win []time.Duration
+	for _, timing := range timings {
+		final = append(final, timing.final)
+		if timing.hinted > 0 {
+			hinted = append(hinted, timing.hinted)
+			win = append(win, timing.final-timing.hinted)
+		}
+	}
+	for _, durations := range [][]time.Duration{hinted, final, win} {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	}
+	describe := func(durations []time.Duration) string {
+		return fmt.Sprintf("p50=%v p90=%v p99=%v", percentile(durations, 0.5), percentile(durations, 0.9), percentile(durations, 0.99))
+	}
+
+	summary := fmt.Sprintf("Challenge in final response: %s", describe(final))
+	if len(hinted) == 0 {
+		return summary + "\nNo challenge arrived in 103 Early Hints"
+	}
+	return summary + fmt.Sprintf("\nChallenge in 103 Early Hints (%d/%d): %s\nEarly Hints win: %s",
+		len(hinted), len(timings), describe(hinted), describe(win))
+}
+
+func runBench(c *cli.Context) error {
+	origin := c.String("origin")
+	resource := c.String("resource")
+	requests := c.Int("requests")
+	logLevel := c.String("log")
+
+	if origin == "" {
+		log.Fatal("Invalid origin. See README for running instructions.")
+	}
+	if requests <= 0 {
+		log.Fatal("Invalid number of requests. See README for running instructions.")
+	}
+
+	switch logLevel {
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	}
+
+	resourceURI, err := composeURL(origin, resource)
+	if err != nil {
+		return err
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	timings := make([]challengeTiming, 0, requests)
+	for i := 0; i < requests; i++ {
+		timing, err := timeChallenge(httpClient, resourceURI)
+		if err != nil {
+			return err
+		}
+		timings = append(timings, timing)
+	}
+	fmt.Println(benchSummary(timings))
+	return nil
+}
@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEarlyHints(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	origin := newTestOrigin()
+	origin.issuerKeys = &issuerKeySource{keys: &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey()}}
+	server := httptest.NewServer(http.HandlerFunc(origin.handleRequest))
+	defer server.Close()
+
+	timing, err := timeChallenge(server.Client(), server.URL)
+	if err != nil || timing.hinted != 0 {
+		t.Fatalf("expected no Early Hints by default, got %+v: %v", timing, err)
+	}
+
+	origin.earlyHints = true
+	hints := originEarlyHints.Value(0)
+	timing, err = timeChallenge(server.Client(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timing.hinted == 0 || timing.hinted > timing.final {
+		t.Fatalf("expected the challenge in Early Hints ahead of the 401, got %+v", timing)
+	}
+	if originEarlyHints.Value(0) != hints+1 {
+		t.Fatal("expected the Early Hints to be counted")
+	}
+	if outstanding := outstandingChallenges(origin); len(outstanding) != 2 {
+		t.Fatalf("expected one challenge per request, got %d contexts", len(outstanding))
+	}
+}
+
+func TestBenchSummary(t *testing.T) {
+	summary := benchSummary([]challengeTiming{
+		{hinted: time.Millisecond, final: 3 * time.Millisecond},
+		{final: 2 * time.Millisecond},
+	})
+	if !strings.Contains(summary, "(1/2)") || !strings.Contains(summary, "Early Hints win: p50=2ms") {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+	if summary := benchSummary([]challengeTiming{{final: time.Millisecond}}); !strings.Contains(summary, "No challenge arrived") {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+}
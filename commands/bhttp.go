@@ -0,0 +1,249 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Binary HTTP messages (RFC 9292) in their known-length form, which Oblivious
+// HTTP encapsulates.
+
+const (
+	bhttpKnownLengthRequest  = 0
+	bhttpKnownLengthResponse = 1
+)
+
+var ErrInvalidBinaryHTTPMessage = errors.New("Invalid binary HTTP message")
+
+// appendVarint appends v as a QUIC variable-length integer.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+func appendVarintBytes(b, data []byte) []byte {
+	return append(appendVarint(b, uint64(len(data))), data...)
+}
+
+// appendFieldSection appends the header as a known-length field section, with
+// lowercase names in a stable order.
+func appendFieldSection(b []byte, header http.Header) []byte {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]byte, 0)
+	for _, name := range names {
+		for _, value := range header[name] {
+			fields = appendVarintBytes(fields, []byte(strings.ToLower(name)))
+			fields = appendVarintBytes(fields, []byte(value))
+		}
+	}
+	return appendVarintBytes(b, fields)
+}
+
+// encodeBHTTPRequest encodes the request with the given content.
+func encodeBHTTPRequest(req *http.Request, content []byte) []byte {
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	authority := req.URL.Host
+	if authority == "" {
+		authority = req.Host
+	}
+
+	b := appendVarint(nil, bhttpKnownLengthRequest)
+	b = appendVarintBytes(b, []byte(req.Method))
+	b = appendVarintBytes(b, []byte(scheme))
+	b = appendVarintBytes(b, []byte(authority))
+	b = appendVarintBytes(b, []byte(req.URL.RequestURI()))
+	b = appendFieldSection(b, req.Header)
+	b = appendVarintBytes(b, content)
+	return appendFieldSection(b, http.Header{})
+}
+
+// encodeBHTTPResponse encodes a final response with the given content.
+func encodeBHTTPResponse(status int, header http.Header, content []byte) []byte {
+	b := appendVarint(nil, bhttpKnownLengthResponse)
+	b = appendVarint(b, uint64(status))
+	b = appendFieldSection(b, header)
+	b = appendVarintBytes(b, content)
+	return appendFieldSection(b, http.Header{})
+}
+
+// bhttpReader decodes a message, remembering the first error.
+type bhttpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *bhttpReader) varint() uint64 {
+	if r.err != nil || len(r.data) == 0 {
+		r.err = ErrInvalidBinaryHTTPMessage
+		return 0
+	}
+	length := 1 << (r.data[0] >> 6)
+	if len(r.data) < length {
+		r.err = ErrInvalidBinaryHTTPMessage
+		return 0
+	}
+	v := uint64(r.data[0] & 0x3f)
+	for _, b := range r.data[1:length] {
+		v = v<<8 | uint64(b)
+	}
+	r.data = r.data[length:]
+	return v
+}
+
+func (r *bhttpReader) bytes() []byte {
+	length := r.varint()
+	if r.err != nil || uint64(len(r.data)) < length {
+		r.err = ErrInvalidBinaryHTTPMessage
+		return nil
+	}
+	data := r.data[:length]
+	r.data = r.data[length:]
+	return data
+}
+
+// truncated reports whether the message ends here. Messages may be truncated
+// after the header section, and are padded with zeros.
+func (r *bhttpReader) truncated() bool {
+	return r.err == nil && len(bytes.Trim(r.data, "\x00")) == 0
+}
+
+func (r *bhttpReader) fieldSection() http.Header {
+	header := http.Header{}
+	if r.truncated() {
+		return header
+	}
+	fields := bhttpReader{data: r.bytes()}
+	for r.err == nil && fields.err == nil && len(fields.data) > 0 {
+		name := string(fields.bytes())
+		value := string(fields.bytes())
+		if name == "" || strings.ToLower(name) != name {
+			fields.err = ErrInvalidBinaryHTTPMessage
+		}
+		header.Add(name, value)
+	}
+	if r.err == nil {
+		r.err = fields.err
+	}
+	return header
+}
+
+func (r *bhttpReader) content() []byte {
+	if r.truncated() {
+		return []byte{}
+	}
+	return r.bytes()
+}
+
+// decodeBHTTPRequest decodes a known-length request.
+func decodeBHTTPRequest(data []byte) (*http.Request, error) {
+	r := bhttpReader{data: data}
+	if r.varint() != bhttpKnownLengthRequest {
+		return nil, ErrInvalidBinaryHTTPMessage
+	}
+	method := string(r.bytes())
+	scheme := string(r.bytes())
+	authority := string(r.bytes())
+	path := string(r.bytes())
+	header := r.fieldSection()
+	content := r.content()
+	r.fieldSection()
+	if r.err != nil || !r.truncated() {
+		return nil, ErrInvalidBinaryHTTPMessage
+	}
+
+	req, err := http.NewRequest(method, scheme+"://"+authority+path, bytes.NewReader(content))
+	if err != nil || !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("%w: invalid request target", ErrInvalidBinaryHTTPMessage)
+	}
+	req.Header = header
+	return req, nil
+}
+
+// decodeBHTTPResponse decodes a known-length response, skipping informational
+// responses.
+func decodeBHTTPResponse(data []byte) (*http.Response, error) {
+	r := bhttpReader{data: data}
+	if r.varint() != bhttpKnownLengthResponse {
+		return nil, ErrInvalidBinaryHTTPMessage
+	}
+	status := r.varint()
+	for r.err == nil && status >= 100 && status < 200 {
+		r.fieldSection()
+		status = r.varint()
+	}
+	if r.err != nil || status < 200 || status > 599 {
+		return nil, ErrInvalidBinaryHTTPMessage
+	}
+	header := r.fieldSection()
+	content := r.content()
+	r.fieldSection()
+	if r.err != nil || !r.truncated() {
+		return nil, ErrInvalidBinaryHTTPMessage
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(int(status))),
+		StatusCode:    int(status),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(content)),
+		ContentLength: int64(len(content)),
+	}, nil
+}
+
+// bhttpResponseWriter collects a response to encode it.
+type bhttpResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBHTTPResponseWriter() *bhttpResponseWriter {
+	return &bhttpResponseWriter{header: http.Header{}}
+}
+
+func (w *bhttpResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bhttpResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bhttpResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
+
+// encode returns the response, without connection-specific fields.
+func (w *bhttpResponseWriter) encode() []byte {
+	w.WriteHeader(http.StatusOK)
+	header := w.header.Clone()
+	header.Del("Connection")
+	return encodeBHTTPResponse(w.status, header, w.body.Bytes())
+}
@@ -0,0 +1,62 @@
+package commands
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestBinaryHTTPRequest(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "https://issuer.example/token-request?x=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+	content := bytes.Repeat([]byte{0xab}, 300)
+	encoded := encodeBHTTPRequest(req, content)
+
+	// Trailing zeros are padding
+	decoded, err := decodeBHTTPRequest(append(encoded, 0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(decoded.Body)
+	if decoded.Method != http.MethodPost || decoded.URL.String() != "https://issuer.example/token-request?x=1" ||
+		decoded.Header.Get("Content-Type") != tokenRequestMediaType || !bytes.Equal(body, content) {
+		t.Fatalf("unexpected request %s %s %v", decoded.Method, decoded.URL, decoded.Header)
+	}
+
+	for _, invalid := range [][]byte{nil, encoded[:10], append(encoded, 1), encodeBHTTPResponse(200, nil, nil)} {
+		if _, err := decodeBHTTPRequest(invalid); err == nil {
+			t.Fatalf("expected %x to be refused", invalid)
+		}
+	}
+}
+
+func TestBinaryHTTPResponse(t *testing.T) {
+	w := newBHTTPResponseWriter()
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Invalid Content-Type", 400)
+	resp, err := decodeBHTTPResponse(w.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 400 || string(body) != "Invalid Content-Type\n" || resp.Header.Get("Connection") != "" {
+		t.Fatalf("unexpected response %d %v %q", resp.StatusCode, resp.Header, body)
+	}
+
+	// Informational responses are skipped, and the trailers truncated
+	informational := appendFieldSection(appendVarint([]byte{bhttpKnownLengthResponse}, 103), http.Header{"Link": {"</style.css>"}})
+	final := appendFieldSection(appendVarint(informational, 200), http.Header{"Content-Type": {"text/plain"}})
+	final = appendVarintBytes(final, []byte("ok"))
+	resp, err = decodeBHTTPResponse(final)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || resp.Header.Get("Link") != "" || string(body) != "ok" {
+		t.Fatalf("unexpected response %d %v %q", resp.StatusCode, resp.Header, body)
+	}
+}
@@ -0,0 +1,209 @@
+package commands
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+const (
+	// Lifetime of outstanding challenges unless configured otherwise, matching
+	// the max-age sent with them
+	defaultChallengeTTL = 10 * time.Second
+)
+
+// outstandingChallenge collapses the challenges of one context, which are
+// identical since the context is their digest, into a single entry.
+type outstandingChallenge struct {
+	challenge pat.TokenChallenge
+	count     int
+}
+
+// contextChange is how a store operation changed the challenges outstanding
+// for a context, counting expired challenges until they are removed, so that
+// the origin can keep its gauges current.
+type contextChange struct {
+	tokenType uint16
+	before    int
+	after     int
+}
+
+// challengeStore keeps the outstanding challenges of an origin by context,
+// each expiring on its own. Operations on one context are atomic.
+type challengeStore interface {
+	// add records a challenge for the context expiring at expires, unless the
+	// context has limit unexpired challenges already, and reports whether it
+	// was recorded. Expired challenges of the context are removed.
+	add(contextEnc string, challenge pat.TokenChallenge, limit int, now, expires time.Time) (bool, contextChange, error)
+	// consume removes and returns the unexpired challenge of the context
+	// expiring first, or ErrUnknownChallenge.
+	consume(contextEnc string, now time.Time) (pat.TokenChallenge, contextChange, error)
+	// drop removes all challenges of the context.
+	drop(contextEnc string) (contextChange, error)
+	// expire removes all expired challenges.
+	expire(now time.Time) ([]contextChange, error)
+	// list returns the unexpired challenges by context.
+	list(now time.Time) (map[string]outstandingChallenge, error)
+}
+
+// storedChallenges are the challenges of one context with their expiry times
+// in Unix nanoseconds, earliest first.
+type storedChallenges struct {
+	Challenge []byte  `json:"challenge"`
+	Expires   []int64 `json:"expires"`
+}
+
+// prune drops the expired challenges.
+func (s *storedChallenges) prune(now time.Time) {
+	i := sort.Search(len(s.Expires), func(i int) bool {
+		return s.Expires[i] > now.UnixNano()
+	})
+	s.Expires = s.Expires[i:]
+}
+
+// insert records a challenge expiring at expires, keeping expiry times sorted.
+func (s *storedChallenges) insert(expires time.Time) {
+	i := sort.Search(len(s.Expires), func(i int) bool {
+		return s.Expires[i] > expires.UnixNano()
+	})
+	s.Expires = append(s.Expires, 0)
+	copy(s.Expires[i+1:], s.Expires[i:])
+	s.Expires[i] = expires.UnixNano()
+}
+
+func (s *storedChallenges) tokenType() uint16 {
+	if len(s.Challenge) < tokenTypeLength {
+		return 0
+	}
+	return binary.BigEndian.Uint16(s.Challenge)
+}
+
+// memoryChallengeStore keeps challenges in process memory.
+type memoryChallengeStore struct {
+	lock     sync.Mutex
+	contexts map[string]*storedChallenges
+}
+
+func newMemoryChallengeStore() *memoryChallengeStore {
+	return &memoryChallengeStore{
+		contexts: make(map[string]*storedChallenges),
+	}
+}
+
+func (s *memoryChallengeStore) add(contextEnc string, challenge pat.TokenChallenge, limit int, now, expires time.Time) (bool, contextChange, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored, ok := s.contexts[contextEnc]
+	if !ok {
+		stored = &storedChallenges{Challenge: challenge.Marshal()}
+	}
+	added, change := addStoredChallenge(stored, limit, now, expires)
+	s.update(contextEnc, stored)
+	return added, change, nil
+}
+
+func (s *memoryChallengeStore) consume(contextEnc string, now time.Time) (pat.TokenChallenge, contextChange, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored, ok := s.contexts[contextEnc]
+	if !ok {
+		return pat.TokenChallenge{}, contextChange{}, ErrUnknownChallenge
+	}
+	challenge, change, err := consumeStoredChallenge(stored, now)
+	s.update(contextEnc, stored)
+	return challenge, change, err
+}
+
+func (s *memoryChallengeStore) drop(contextEnc string) (contextChange, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored, ok := s.contexts[contextEnc]
+	if !ok {
+		return contextChange{}, nil
+	}
+	delete(s.contexts, contextEnc)
+	return contextChange{stored.tokenType(), len(stored.Expires), 0}, nil
+}
+
+func (s *memoryChallengeStore) expire(now time.Time) ([]contextChange, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var changes []contextChange
+	for contextEnc, stored := range s.contexts {
+		before := len(stored.Expires)
+		stored.prune(now)
+		if len(stored.Expires) != before {
+			changes = append(changes, contextChange{stored.tokenType(), before, len(stored.Expires)})
+			s.update(contextEnc, stored)
+		}
+	}
+	return changes, nil
+}
+
+func (s *memoryChallengeStore) list(now time.Time) (map[string]outstandingChallenge, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	outstanding := make(map[string]outstandingChallenge)
+	for contextEnc, stored := range s.contexts {
+		listStoredChallenges(outstanding, contextEnc, *stored, now)
+	}
+	return outstanding, nil
+}
+
+// update keeps the context unless it has no challenges left. The caller holds
+// the lock.
+func (s *memoryChallengeStore) update(contextEnc string, stored *storedChallenges) {
+	if len(stored.Expires) == 0 {
+		delete(s.contexts, contextEnc)
+	} else {
+		s.contexts[contextEnc] = stored
+	}
+}
+
+// unmarshalStoredChallenge decodes a stored challenge, restoring the empty
+// origin info of cross-origin challenges.
+func unmarshalStoredChallenge(challengeEnc []byte) (pat.TokenChallenge, error) {
+	challenge, err := pat.UnmarshalTokenChallenge(challengeEnc)
+	if err == nil && len(challenge.OriginInfo) == 1 && challenge.OriginInfo[0] == "" {
+		challenge.OriginInfo = nil
+	}
+	return challenge, err
+}
+
+func addStoredChallenge(stored *storedChallenges, limit int, now, expires time.Time) (bool, contextChange) {
+	change := contextChange{tokenType: stored.tokenType(), before: len(stored.Expires)}
+	stored.prune(now)
+	added := len(stored.Expires) < limit
+	if added {
+		stored.insert(expires)
+	}
+	change.after = len(stored.Expires)
+	return added, change
+}
+
+func consumeStoredChallenge(stored *storedChallenges, now time.Time) (pat.TokenChallenge, contextChange, error) {
+	change := contextChange{tokenType: stored.tokenType(), before: len(stored.Expires)}
+	stored.prune(now)
+	if len(stored.Expires) == 0 {
+		return pat.TokenChallenge{}, change, ErrUnknownChallenge
+	}
+	stored.Expires = stored.Expires[1:]
+	change.after = len(stored.Expires)
+	challenge, err := unmarshalStoredChallenge(stored.Challenge)
+	return challenge, change, err
+}
+
+func listStoredChallenges(outstanding map[string]outstandingChallenge, contextEnc string, stored storedChallenges, now time.Time) {
+	stored.prune(now)
+	if len(stored.Expires) == 0 {
+		return
+	}
+	challenge, err := unmarshalStoredChallenge(stored.Challenge)
+	if err != nil {
+		return
+	}
+	outstanding[contextEnc] = outstandingChallenge{challenge, len(stored.Expires)}
+}
@@ -0,0 +1,158 @@
+package commands
+
+import (
+	"encoding/json"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltChallengeStore keeps challenges in a bucket of a Bolt database named
+// after the origin, so that they survive restarts of the origin.
+type boltChallengeStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func newBoltChallengeStore(db *bolt.DB, originName string) (*boltChallengeStore, error) {
+	s := &boltChallengeStore{
+		db:     db,
+		bucket: []byte("challenges/" + originName),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// update runs fn on the stored challenges of the context, writing them back
+// afterwards or deleting the context if none are left, and returns the error
+// of fn. Changes are kept even if fn fails, e.g., expired challenges removed.
+func (s *boltChallengeStore) update(contextEnc string, fn func(stored *storedChallenges) error) error {
+	var fnErr error
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		stored := &storedChallenges{}
+		if data := bucket.Get([]byte(contextEnc)); data != nil {
+			if err := json.Unmarshal(data, stored); err != nil {
+				return err
+			}
+		}
+		fnErr = fn(stored)
+		if len(stored.Expires) == 0 {
+			return bucket.Delete([]byte(contextEnc))
+		}
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(contextEnc), data)
+	})
+	if err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func (s *boltChallengeStore) add(contextEnc string, challenge pat.TokenChallenge, limit int, now, expires time.Time) (bool, contextChange, error) {
+	var added bool
+	var change contextChange
+	err := s.update(contextEnc, func(stored *storedChallenges) error {
+		if stored.Challenge == nil {
+			stored.Challenge = challenge.Marshal()
+		}
+		added, change = addStoredChallenge(stored, limit, now, expires)
+		return nil
+	})
+	return added, change, err
+}
+
+func (s *boltChallengeStore) consume(contextEnc string, now time.Time) (pat.TokenChallenge, contextChange, error) {
+	var challenge pat.TokenChallenge
+	var change contextChange
+	err := s.update(contextEnc, func(stored *storedChallenges) error {
+		if stored.Challenge == nil {
+			return ErrUnknownChallenge
+		}
+		var err error
+		challenge, change, err = consumeStoredChallenge(stored, now)
+		return err
+	})
+	return challenge, change, err
+}
+
+func (s *boltChallengeStore) drop(contextEnc string) (contextChange, error) {
+	var change contextChange
+	err := s.update(contextEnc, func(stored *storedChallenges) error {
+		change = contextChange{stored.tokenType(), len(stored.Expires), 0}
+		stored.Expires = nil
+		return nil
+	})
+	return change, err
+}
+
+func (s *boltChallengeStore) expire(now time.Time) ([]contextChange, error) {
+	var changes []contextChange
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		changes = nil
+		bucket := tx.Bucket(s.bucket)
+		// Cursors are invalidated by writes, so collect the changes first
+		updates := make(map[string][]byte)
+		err := bucket.ForEach(func(key, data []byte) error {
+			var stored storedChallenges
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+			before := len(stored.Expires)
+			stored.prune(now)
+			if len(stored.Expires) == before {
+				return nil
+			}
+			changes = append(changes, contextChange{stored.tokenType(), before, len(stored.Expires)})
+			updates[string(key)] = nil
+			if len(stored.Expires) > 0 {
+				data, err := json.Marshal(stored)
+				if err != nil {
+					return err
+				}
+				updates[string(key)] = data
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, data := range updates {
+			if data == nil {
+				err = bucket.Delete([]byte(key))
+			} else {
+				err = bucket.Put([]byte(key), data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return changes, err
+}
+
+func (s *boltChallengeStore) list(now time.Time) (map[string]outstandingChallenge, error) {
+	outstanding := make(map[string]outstandingChallenge)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).ForEach(func(key, data []byte) error {
+			var stored storedChallenges
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return err
+			}
+			listStoredChallenges(outstanding, string(key), stored, now)
+			return nil
+		})
+	})
+	return outstanding, err
+}
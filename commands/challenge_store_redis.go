@@ -0,0 +1,201 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Time Redis keeps contexts after their last challenge expired, so that
+	// the origin sweeps them first and accounts for them
+	redisChallengeGrace = time.Minute
+
+	// Attempts of an optimistic transaction before giving up
+	redisChallengeAttempts = 8
+)
+
+// redisChallengeStore keeps challenges in Redis, one key per context prefixed
+// with the origin name, so that replicas share them and they survive restarts.
+// Keys expire on their own once the origin stopped sweeping them.
+type redisChallengeStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func newRedisChallengeStore(client redis.UniversalClient, originName string) *redisChallengeStore {
+	return &redisChallengeStore{
+		client: client,
+		prefix: "pat:challenges:" + originName + ":",
+	}
+}
+
+// update runs fn on the stored challenges of the key in an optimistic
+// transaction, retried if the key changed meanwhile, writing them back or
+// deleting the key if none are left. It returns the error of fn.
+func (s *redisChallengeStore) update(key string, fn func(stored *storedChallenges) error) error {
+	ctx := context.Background()
+	var fnErr error
+	txf := func(tx *redis.Tx) error {
+		stored := &storedChallenges{}
+		data, err := tx.Get(ctx, key).Bytes()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, stored); err != nil {
+				return err
+			}
+		}
+		fnErr = fn(stored)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(stored.Expires) == 0 {
+				pipe.Del(ctx, key)
+				return nil
+			}
+			data, err := json.Marshal(stored)
+			if err != nil {
+				return err
+			}
+			last := time.Unix(0, stored.Expires[len(stored.Expires)-1])
+			pipe.Set(ctx, key, data, time.Until(last)+redisChallengeGrace)
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < redisChallengeAttempts; i++ {
+		err := s.client.Watch(ctx, txf, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return fnErr
+	}
+	return redis.TxFailedErr
+}
+
+// keys returns the keys of the origin's contexts.
+func (s *redisChallengeStore) keys() ([]string, error) {
+	return scanRedisKeys(context.Background(), s.client, s.prefix+"*")
+}
+
+// scanRedisKeys returns the keys matching the pattern, on every master of a
+// cluster since each one scans only its own slots.
+func scanRedisKeys(ctx context.Context, client redis.UniversalClient, match string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanRedisNode(ctx, client, match)
+	}
+	var lock sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		nodeKeys, err := scanRedisNode(ctx, node, match)
+		lock.Lock()
+		keys = append(keys, nodeKeys...)
+		lock.Unlock()
+		return err
+	})
+	return keys, err
+}
+
+func scanRedisNode(ctx context.Context, node redis.Cmdable, match string) ([]string, error) {
+	var keys []string
+	iter := node.Scan(ctx, 0, match, 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+func (s *redisChallengeStore) add(contextEnc string, challenge pat.TokenChallenge, limit int, now, expires time.Time) (bool, contextChange, error) {
+	var added bool
+	var change contextChange
+	err := s.update(s.prefix+contextEnc, func(stored *storedChallenges) error {
+		if stored.Challenge == nil {
+			stored.Challenge = challenge.Marshal()
+		}
+		added, change = addStoredChallenge(stored, limit, now, expires)
+		return nil
+	})
+	return added, change, err
+}
+
+func (s *redisChallengeStore) consume(contextEnc string, now time.Time) (pat.TokenChallenge, contextChange, error) {
+	var challenge pat.TokenChallenge
+	var change contextChange
+	err := s.update(s.prefix+contextEnc, func(stored *storedChallenges) error {
+		if stored.Challenge == nil {
+			return ErrUnknownChallenge
+		}
+		var err error
+		challenge, change, err = consumeStoredChallenge(stored, now)
+		return err
+	})
+	return challenge, change, err
+}
+
+func (s *redisChallengeStore) drop(contextEnc string) (contextChange, error) {
+	var change contextChange
+	err := s.update(s.prefix+contextEnc, func(stored *storedChallenges) error {
+		change = contextChange{stored.tokenType(), len(stored.Expires), 0}
+		stored.Expires = nil
+		return nil
+	})
+	return change, err
+}
+
+func (s *redisChallengeStore) expire(now time.Time) ([]contextChange, error) {
+	keys, err := s.keys()
+	if err != nil {
+		return nil, err
+	}
+	var changes []contextChange
+	for _, key := range keys {
+		// Transactions may be retried, so only the last run counts
+		var change contextChange
+		err := s.update(key, func(stored *storedChallenges) error {
+			change = contextChange{stored.tokenType(), len(stored.Expires), 0}
+			stored.prune(now)
+			change.after = len(stored.Expires)
+			return nil
+		})
+		if err != nil {
+			return changes, err
+		}
+		if change.after != change.before {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func (s *redisChallengeStore) list(now time.Time) (map[string]outstandingChallenge, error) {
+	keys, err := s.keys()
+	if err != nil {
+		return nil, err
+	}
+	outstanding := make(map[string]outstandingChallenge)
+	for _, key := range keys {
+		data, err := s.client.Get(context.Background(), key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var stored storedChallenges
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return nil, err
+		}
+		listStoredChallenges(outstanding, strings.TrimPrefix(key, s.prefix), stored, now)
+	}
+	return outstanding, nil
+}
@@ -0,0 +1,169 @@
+package commands
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	pat "github.com/cloudflare/pat-go"
+)
+
+// testChallengeStore checks a store against the contract shared by all
+// stores: per-context caps, per-challenge expiry, and consumption order.
+func testChallengeStore(t *testing.T, store challengeStore) {
+	challenge := pat.TokenChallenge{
+		TokenType:       pat.RateLimitedTokenType,
+		IssuerName:      "issuer.example",
+		OriginInfo:      []string{"origin.example"},
+		RedemptionNonce: bytes.Repeat([]byte{1}, 32),
+	}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		added, change, err := store.add("context", challenge, 2, now, now.Add(time.Duration(i+1)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != (i < 2) || change.tokenType != pat.RateLimitedTokenType || change.after != min(i+1, 2) {
+			t.Fatalf("unexpected add %d: %v %+v", i, added, change)
+		}
+	}
+	outstanding, err := store.list(now)
+	if err != nil || len(outstanding) != 1 || outstanding["context"].count != 2 || outstanding["context"].challenge.IssuerName != "issuer.example" {
+		t.Fatalf("unexpected outstanding challenges %+v: %v", outstanding, err)
+	}
+
+	// The challenge expiring first is consumed first, and expired ones never
+	consumed, change, err := store.consume("context", now.Add(1500*time.Millisecond))
+	if err != nil || !bytes.Equal(consumed.Marshal(), challenge.Marshal()) {
+		t.Fatalf("unexpected challenge %+v: %v", consumed, err)
+	}
+	if change.before != 2 || change.after != 0 {
+		t.Fatalf("expected the expired challenge to be removed too, got %+v", change)
+	}
+	if _, _, err := store.consume("context", now); err != ErrUnknownChallenge {
+		t.Fatalf("expected no challenge left, got %v", err)
+	}
+
+	// Expiry sweeps contexts
+	store.add("expiring", challenge, 2, now, now.Add(time.Second))
+	store.add("other", challenge, 2, now, now.Add(time.Hour))
+	changes, err := store.expire(now.Add(time.Minute))
+	if err != nil || len(changes) != 1 || changes[0].before != 1 || changes[0].after != 0 {
+		t.Fatalf("unexpected expiry %+v: %v", changes, err)
+	}
+	change, err = store.drop("other")
+	if err != nil || change.before != 1 || change.after != 0 {
+		t.Fatalf("unexpected drop %+v: %v", change, err)
+	}
+	if outstanding, _ := store.list(now); len(outstanding) != 0 {
+		t.Fatalf("expected no outstanding challenges, got %+v", outstanding)
+	}
+
+	// Cross-origin challenges keep their empty origin info
+	challenge.OriginInfo = nil
+	store.add("cross-origin", challenge, 2, now, now.Add(time.Hour))
+	if consumed, _, _ := store.consume("cross-origin", now); consumed.OriginInfo != nil {
+		t.Fatalf("unexpected origin info %q", consumed.OriginInfo)
+	}
+}
+
+func TestMemoryChallengeStore(t *testing.T) {
+	testChallengeStore(t, newMemoryChallengeStore())
+}
+
+func TestBoltChallengeStore(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "challenges.db")
+	stores := newStateStores()
+	store, err := stores.openChallenges("bolt:"+fileName, "origin.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testChallengeStore(t, store)
+
+	// Origins sharing the database are kept apart, and challenges survive
+	// reopening it
+	now := time.Now()
+	store.add("context", pat.TokenChallenge{TokenType: pat.BasicPublicTokenType, IssuerName: "issuer.example"}, 1, now, now.Add(time.Hour))
+	other, err := stores.openChallenges("bolt:"+fileName, "other.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outstanding, _ := other.list(now); len(outstanding) != 0 {
+		t.Fatal("expected origins not to share challenges")
+	}
+	stores.boltDBs[fileName].Close()
+	reopened, err := newStateStores().openChallenges("bolt:"+fileName, "origin.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := reopened.consume("context", now); err != nil {
+		t.Fatal("expected the challenge to survive a restart:", err)
+	}
+}
+
+func TestRedisChallengeStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	stores := newStateStores()
+	store, err := stores.openChallenges("redis://"+server.Addr()+"/0", "origin.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testChallengeStore(t, store)
+
+	// Replicas sharing the server share challenges
+	now := time.Now()
+	store.add("context", pat.TokenChallenge{TokenType: pat.BasicPublicTokenType, IssuerName: "issuer.example"}, 1, now, now.Add(time.Second))
+	replica, _ := newStateStores().openChallenges("redis://"+server.Addr()+"/0", "origin.example")
+	if _, _, err := replica.consume("context", now); err != nil {
+		t.Fatal("expected replicas to share challenges:", err)
+	}
+
+	// Redis drops contexts the origin stopped sweeping
+	store.add("context", pat.TokenChallenge{TokenType: pat.BasicPublicTokenType, IssuerName: "issuer.example"}, 1, now, now.Add(time.Second))
+	server.FastForward(time.Second + redisChallengeGrace)
+	if server.Exists("pat:challenges:origin.example:context") {
+		t.Fatal("expected the context key to expire")
+	}
+
+	if _, err := newStateStores().openChallenges("ftp://challenges", "origin.example"); err == nil || !strings.Contains(err.Error(), "Invalid store") {
+		t.Fatalf("expected unknown stores to be refused, got %v", err)
+	}
+}
+
+func TestChallengeTTL(t *testing.T) {
+	origin := newTestOrigin()
+	origin.challengeTTL = 1500 * time.Millisecond
+	issuer := newTestIssuer(t, "issuer.example")
+	origin.issuerKeys = &issuerKeySource{keys: &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey()}}
+	tokenType := pat.RateLimitedTokenType
+	outstanding := originOutstandingChallenges.Value(tokenType)
+
+	w := httptest.NewRecorder()
+	origin.handleRequest(w, httptest.NewRequest(http.MethodGet, "https://origin.example/", nil))
+	if !strings.HasSuffix(w.Header().Get("WWW-Authenticate"), "max-age=2") {
+		t.Fatalf("expected max-age to advertise the TTL, got %q", w.Header().Get("WWW-Authenticate"))
+	}
+	var contextEnc string
+	for contextEnc = range outstandingChallenges(origin) {
+	}
+	if originOutstandingChallenges.Value(tokenType) != outstanding+1 {
+		t.Fatal("expected the challenge to be counted")
+	}
+
+	// Expired challenges are swept and refused
+	if err := origin.expireChallenges(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if originOutstandingChallenges.Value(tokenType) != outstanding {
+		t.Fatal("expected the expired challenge to be released")
+	}
+	if _, err := origin.consumeChallenge(contextEnc); err != ErrUnknownChallenge {
+		t.Fatalf("expected the expired challenge to be refused, got %v", err)
+	}
+}
@@ -2,12 +2,12 @@ package commands
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/base64"
-	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,7 +16,7 @@ import (
 	"net/url"
 	"os"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/cloudflare/pat-go"
 	log "github.com/sirupsen/logrus"
@@ -24,12 +24,20 @@ import (
 	"golang.org/x/crypto/hkdf"
 )
 
-func fetchIssuerConfig(issuer string) (IssuerConfig, error) {
-	resp, err := http.Get("https://" + issuer + issuerConfigURI)
+func fetchIssuerConfig(httpClient *http.Client, issuer string) (IssuerConfig, error) {
+	return fetchIssuerDirectory(httpClient, "https://"+issuer+issuerConfigURI)
+}
+
+// fetchIssuerDirectory reads the issuer directory at the given URI.
+func fetchIssuerDirectory(httpClient *http.Client, directoryURI string) (IssuerConfig, error) {
+	resp, err := httpClient.Get(directoryURI)
 	if err != nil {
 		return IssuerConfig{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return IssuerConfig{}, fmt.Errorf("Issuer directory request failed with error %d", resp.StatusCode)
+	}
 
 	issuerConfigEnc, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -45,12 +53,15 @@ func fetchIssuerConfig(issuer string) (IssuerConfig, error) {
 	return issuerConfig, nil
 }
 
-func fetchIssuerNameKey(nameKeyURI string) (pat.EncapKey, error) {
-	resp, err := http.Get(nameKeyURI)
+func fetchIssuerNameKey(httpClient *http.Client, nameKeyURI string) (pat.EncapKey, error) {
+	resp, err := httpClient.Get(nameKeyURI)
 	if err != nil {
 		return pat.EncapKey{}, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return pat.EncapKey{}, fmt.Errorf("Issuer encapsulation key request failed with error %d", resp.StatusCode)
+	}
 
 	nameKeyEnc, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -65,6 +76,24 @@ func fetchIssuerNameKey(nameKeyURI string) (pat.EncapKey, error) {
 	return nameKey, nil
 }
 
+// tokenRequestTarget returns the URI token requests for the issuer are sent
+// to: the attester's, naming the issuer, or the issuer's own if there is no
+// attester, as over Oblivious HTTP.
+func tokenRequestTarget(attester, issuerRequestURI string) (string, error) {
+	if attester == "" {
+		return issuerRequestURI, nil
+	}
+	issuerURL, err := url.Parse(issuerRequestURI)
+	if err != nil {
+		return "", err
+	}
+	tokenRequestURI, err := composeURL(attester, attesterTokenRequestURI)
+	if err != nil {
+		return "", err
+	}
+	return tokenRequestURI + "?" + url.Values{"issuer": {issuerURL.Host}}.Encode(), nil
+}
+
 func computeAnonymousOrigin(secret []byte, origin string) ([]byte, error) {
 	originID := make([]byte, 32)
 	hkdf := hkdf.New(sha256.New, secret, nil, []byte(origin))
@@ -72,7 +101,7 @@ func computeAnonymousOrigin(secret []byte, origin string) ([]byte, error) {
 	return originID, err
 }
 
-func fetchBasicToken(client pat.BasicPublicClient, attester string, challenge []byte, publicKeyEnc []byte) (pat.Token, error) {
+func fetchBasicToken(httpClient *http.Client, client pat.BasicPublicClient, attester string, challenge []byte, publicKeyEnc []byte) (pat.Token, error) {
 	nonce := make([]byte, 32)
 	rand.Reader.Read(nonce)
 
@@ -87,7 +116,7 @@ func fetchBasicToken(client pat.BasicPublicClient, attester string, challenge []
 		return pat.Token{}, err
 	}
 
-	issuerConfig, err := fetchIssuerConfig(tokenChallenge.IssuerName)
+	issuerConfig, err := fetchIssuerConfig(httpClient, tokenChallenge.IssuerName)
 	if err != nil {
 		return pat.Token{}, err
 	}
@@ -112,13 +141,12 @@ func fetchBasicToken(client pat.BasicPublicClient, attester string, challenge []
 	reqEnc, _ := httputil.DumpRequest(req, false)
 	log.Debugln("Token request:", string(reqEnc))
 
-	httpClient := &http.Client{}
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		return pat.Token{}, err
 	}
 	if resp.StatusCode != 200 {
-		return pat.Token{}, fmt.Errorf("Request failed with error %d", resp.StatusCode)
+		return pat.Token{}, tokenRequestError(resp)
 	}
 	defer resp.Body.Close()
 
@@ -129,13 +157,16 @@ func fetchBasicToken(client pat.BasicPublicClient, attester string, challenge []
 	if err != nil {
 		return pat.Token{}, err
 	}
+	protocolTranscript.recordIssuance(challenge, publicKeyEnc, tokenRequestEnc, tokenResponse)
 
-	return tokenRequestState.FinalizeToken(tokenResponse)
+	return protocolTranscript.recordToken(tokenRequestState.FinalizeToken(tokenResponse))
 }
 
-func fetchRateLimitedToken(client pat.RateLimitedClient, clientOriginSecret []byte, clientID string, attester string, origin string, challenge []byte, publicKeyEnc []byte) (pat.Token, error) {
-	blind := make([]byte, 32)
-	rand.Reader.Read(blind)
+func fetchRateLimitedToken(httpClient *http.Client, client pat.RateLimitedClient, blind []byte, clientOriginSecret []byte, clientID string, attester string, origin string, challenge []byte, publicKeyEnc []byte, receipts *receiptLog) (pat.Token, error) {
+	if blind == nil {
+		blind = make([]byte, clientBlindLength)
+		rand.Reader.Read(blind)
+	}
 
 	nonce := make([]byte, 32)
 	rand.Reader.Read(nonce)
@@ -151,7 +182,7 @@ func fetchRateLimitedToken(client pat.RateLimitedClient, clientOriginSecret []by
 		return pat.Token{}, err
 	}
 
-	issuerConfig, err := fetchIssuerConfig(tokenChallenge.IssuerName)
+	issuerConfig, err := fetchIssuerConfig(httpClient, tokenChallenge.IssuerName)
 	if err != nil {
 		return pat.Token{}, err
 	}
@@ -160,7 +191,7 @@ func fetchRateLimitedToken(client pat.RateLimitedClient, clientOriginSecret []by
 	if err != nil {
 		return pat.Token{}, err
 	}
-	originNameKey, err := fetchIssuerNameKey(issuerNameKeyURI)
+	originNameKey, err := fetchIssuerNameKey(httpClient, issuerNameKeyURI)
 	if err != nil {
 		return pat.Token{}, err
 	}
@@ -209,13 +240,17 @@ func fetchRateLimitedToken(client pat.RateLimitedClient, clientOriginSecret []by
 	reqEnc, _ := httputil.DumpRequest(req, false)
 	log.Debugln("Token request:", string(reqEnc))
 
-	httpClient := &http.Client{}
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		return pat.Token{}, err
 	}
 	if resp.StatusCode != 200 {
-		return pat.Token{}, fmt.Errorf("Request failed with error %d", resp.StatusCode)
+		err := tokenRequestError(resp)
+		if errors.Is(err, ErrOriginNotAllowed) {
+			// Only the client knows which origin it asked for
+			return pat.Token{}, fmt.Errorf("%w: %s", err, origin)
+		}
+		return pat.Token{}, err
 	}
 	defer resp.Body.Close()
 
@@ -226,8 +261,84 @@ func fetchRateLimitedToken(client pat.RateLimitedClient, clientOriginSecret []by
 	if err != nil {
 		return pat.Token{}, err
 	}
+	receipts.record(origin, resp.Header.Get(headerIssuanceReceipt), time.Now())
+	protocolTranscript.recordIssuance(challenge, publicKeyEnc, tokenRequestEnc, tokenResponse)
+
+	return protocolTranscript.recordToken(tokenRequestState.FinalizeToken(tokenResponse))
+}
+
+// deriveClientSecrets derives the secret of the rate-limited client and the
+// secret its anonymous origin IDs are computed with from the client secret.
+func deriveClientSecrets(clientSecret []byte) ([]byte, []byte) {
+	clientRequestSecret := make([]byte, 32)
+	clientOriginSecret := make([]byte, 32)
+	hkdf := hkdf.New(sha256.New, clientSecret, nil, []byte("PAT demo"))
+	if _, err := io.ReadFull(hkdf, clientRequestSecret); err != nil {
+		panic(err)
+	}
+	if _, err := io.ReadFull(hkdf, clientOriginSecret); err != nil {
+		panic(err)
+	}
+	return clientRequestSecret, clientOriginSecret
+}
+
+// tokenFetcher obtains tokens answering the challenges of an origin:
+// rate-limited, private, and Ed25519 tokens through the attester, and basic
+// tokens straight from the issuer.
+type tokenFetcher struct {
+	httpClient         *http.Client
+	attester           string
+	origin             string // origin name rate-limited tokens are bound to
+	id                 string
+	rateLimitedClient  pat.RateLimitedClient
+	basicClient        pat.BasicPublicClient
+	clientOriginSecret []byte
+	clientKey          *clientKeyFile // takes blinds from it if set
+	clientKeyFileName  string
+	receipts           *receiptLog
+	ohttp              *http.Client // tunnels token requests through the attester's relay, nil if not
+}
 
-	return tokenRequestState.FinalizeToken(tokenResponse)
+// tokenClient returns the client and attester to send token requests with.
+// Over Oblivious HTTP, token requests are addressed to the issuer and tunneled
+// through the attester.
+func (f *tokenFetcher) tokenClient() (*http.Client, string) {
+	if f.ohttp != nil {
+		return f.ohttp, ""
+	}
+	return f.httpClient, f.attester
+}
+
+func (f *tokenFetcher) fetch(challenge clientChallenge) (pat.Token, error) {
+	switch challenge.tokenType() {
+	case pat.RateLimitedTokenType:
+		log.Debugln("Fetching rate-limited token...")
+		var blind []byte
+		if f.clientKey != nil {
+			// Persist before use so that a blind is never sent twice
+			blind = f.clientKey.takeBlind()
+			if blind == nil {
+				log.Debugln("Client key blinds exhausted, using a fresh blind")
+			} else if err := f.clientKey.write(f.clientKeyFileName); err != nil {
+				return pat.Token{}, err
+			}
+		}
+		return fetchRateLimitedToken(f.httpClient, f.rateLimitedClient, blind, f.clientOriginSecret, f.id, f.attester, f.origin, challenge.blob, challenge.tokenKeyEnc, f.receipts)
+	case pat.BasicPrivateTokenType:
+		log.Debugln("Fetching private token...")
+		httpClient, attester := f.tokenClient()
+		return fetchPrivateToken(httpClient, attester, challenge.blob, challenge.tokenKeyEnc)
+	case ed25519TokenType:
+		log.Debugln("Fetching experimental Ed25519 token...")
+		httpClient, attester := f.tokenClient()
+		return fetchEd25519Token(httpClient, attester, challenge.blob, challenge.tokenKeyEnc)
+	case pat.BasicPublicTokenType:
+		log.Debugln("Fetching basic token...")
+		httpClient, attester := f.tokenClient()
+		return fetchBasicToken(httpClient, f.basicClient, attester, challenge.blob, challenge.tokenKeyEnc)
+	default:
+		return pat.Token{}, unsupportedTokenTypeError{role: "client", tokenType: challenge.tokenType(), supported: knownTokenTypes()}
+	}
 }
 
 func runClientFetch(c *cli.Context) error {
@@ -236,16 +347,27 @@ func runClientFetch(c *cli.Context) error {
 	secret := c.String("secret")        // 48 random bytes
 	attester := c.String("attester")    // attester.example:4569
 	store := c.String("store")          // token_store.json
-	tokenType := c.String("token-type") // "basic" or "rate-limited"
+	tokenType := c.String("token-type") // "basic", "rate-limited", "private", or "ed25519"
 	nonInteractive := c.Bool("non-interactive")
 	crossOrigin := c.Bool("cross-origin")
 	tokenCount := c.Int("count")
+	batchSize := c.Int("batch")
+	prefetch := c.Int("prefetch")
 	id := c.String("id")
 	logLevel := c.String("log")
+	emulate := c.String("emulate")
+	useHTTP3 := c.Bool("http3")
+	useH2C := c.Bool("h2c")
+	clientKeyFileName := c.String("client-key")
+	receiptLogFile := c.String("receipt-log")
+	receiptKeyHex := c.String("receipt-key")
 
 	if origin == "" {
 		log.Fatal("Invalid origin. See README for running instructions.")
 	}
+	if useHTTP3 && useH2C {
+		log.Fatal("Invalid transport, --http3 and --h2c exclude each other. See README for running instructions.")
+	}
 	if secret == "" {
 		log.Fatal("Invalid client secret. See README for running instructions.")
 	}
@@ -255,6 +377,16 @@ func runClientFetch(c *cli.Context) error {
 	if tokenCount <= 0 || tokenCount > 10 {
 		log.Fatal("Invalid token count. See README for running instructions.")
 	}
+	if batchSize < 0 || batchSize > maxTokenBatchSize {
+		log.Fatal("Invalid batch size. See README for running instructions.")
+	}
+	if prefetch < 0 {
+		log.Fatal("Invalid prefetch count. See README for running instructions.")
+	}
+	profile, err := lookupClientProfile(emulate)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	switch logLevel {
 	case "debug":
@@ -268,15 +400,7 @@ func runClientFetch(c *cli.Context) error {
 		return err
 	}
 
-	clientRequestSecret := make([]byte, 32)
-	clientOriginSecret := make([]byte, 32)
-	hkdf := hkdf.New(sha256.New, clientSecret, nil, []byte("PAT demo"))
-	if _, err := io.ReadFull(hkdf, clientRequestSecret); err != nil {
-		panic(err)
-	}
-	if _, err := io.ReadFull(hkdf, clientOriginSecret); err != nil {
-		panic(err)
-	}
+	clientRequestSecret, clientOriginSecret := deriveClientSecrets(clientSecret)
 
 	tokenStore := EmptyStore()
 	if store != "" {
@@ -290,31 +414,75 @@ func runClientFetch(c *cli.Context) error {
 	}
 
 	rateLimitedClient := pat.CreateRateLimitedClientFromSecret(clientRequestSecret)
-	basicClient := pat.NewBasicPublicClient()
+	var clientKey *clientKeyFile
+	if clientKeyFileName != "" {
+		clientKey, err = readClientKeyFile(clientKeyFileName)
+		if err != nil {
+			log.Fatal("Failed reading client key from file ", clientKeyFileName, ": ", err)
+		}
+		rateLimitedClient = clientKey.rateLimitedClient()
+		if !c.IsSet("id") && clientKey.ClientID != "" {
+			id = clientKey.ClientID
+		}
+	}
+
+	var receiptKey ed25519.PublicKey
+	if receiptKeyHex != "" {
+		receiptKey, err = parseEd25519PublicKey(receiptKeyHex)
+		if err != nil {
+			log.Fatal("Invalid receipt key: ", err)
+		}
+	}
+	receiptLogWriter, err := openEventLog(receiptLogFile)
+	if err != nil {
+		log.Fatal("Failed opening receipt log ", receiptLogFile, ": ", err)
+	}
+	receipts := newReceiptLog(receiptLogWriter, receiptKey)
 
 	resourceURI, err := composeURL(origin, resource)
 	if err != nil {
 		return err
 	}
 
-	httpClient := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, resourceURI, nil)
+	httpClient := newHTTPClient(useHTTP3, useH2C)
+	if spec := c.String("attestation"); spec != "" {
+		credential, err := loadAttestationCredential(spec)
+		if err != nil {
+			log.Fatal("Invalid attestation: ", err)
+		}
+		httpClient = withAttestation(httpClient, credential)
+	}
+	fetcher := &tokenFetcher{
+		httpClient:         httpClient,
+		attester:           attester,
+		origin:             origin,
+		id:                 id,
+		rateLimitedClient:  rateLimitedClient,
+		basicClient:        pat.NewBasicPublicClient(),
+		clientOriginSecret: clientOriginSecret,
+		clientKey:          clientKey,
+		clientKeyFileName:  clientKeyFileName,
+		receipts:           receipts,
+	}
+	if c.Bool("ohttp") {
+		fetcher.ohttp = newOHTTPClient(httpClient, attester)
+	}
+	req, err := profile.newRequest(resourceURI)
 	if err != nil {
 		return err
 	}
 	if nonInteractive {
-		req.Header.Add(headerTokenAttributeNoninteractive, "true")
+		profile.setHeader(req, headerTokenAttributeNoninteractive, "true")
 	}
 	if crossOrigin {
-		req.Header.Add(headerTokenAttributeCrossOrigin, "true")
+		profile.setHeader(req, headerTokenAttributeCrossOrigin, "true")
 	}
-	if tokenType == "basic" {
-		req.Header.Add(headerTokenType, strconv.Itoa(int(pat.BasicPublicTokenType)))
+	if tokenTypeValue, ok := tokenTypeNames[tokenType]; ok {
+		profile.setHeader(req, headerTokenType, strconv.Itoa(int(tokenTypeValue)))
 	}
-	if tokenType == "rate-limited" {
-		req.Header.Add(headerTokenType, strconv.Itoa(int(pat.RateLimitedTokenType)))
+	if profile.sendCountHint {
+		profile.setHeader(req, headerTokenAttributeChallengeCount, strconv.Itoa(tokenCount))
 	}
-	req.Header.Add(headerTokenAttributeChallengeCount, strconv.Itoa(tokenCount))
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		return err
@@ -327,117 +495,95 @@ func runClientFetch(c *cli.Context) error {
 	}
 	log.Debugln(string(respEnc))
 
-	if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "" {
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		log.Debugln("Missing WWW-Authenticate header")
+		return nil
+	}
+
+	for attempt := 0; ; attempt++ {
 		authValue := resp.Header.Get("WWW-Authenticate")
-		if !strings.HasPrefix(authValue, privateTokenType) {
-			return fmt.Errorf("Invalid WWW-Authenticate challenge header")
+		log.Debugln("Challenged:", authValue)
+		challenges, err := parseClientChallenges(authValue)
+		if err != nil {
+			return err
+		}
+		selected, err := profile.selectChallenges(challenges)
+		if err != nil {
+			return err
 		}
 
-		var err error
-		var challengeBlob []byte
-		var tokenKeyEnc []byte
-
-		log.Debugln("Challenged:", authValue)
-		challenges := strings.Split(authValue, privateTokenType)
-		tokenChallenges := make([]string, 0)
-		for _, challenge := range challenges {
-			if len(challenge) > 0 {
-				log.Debugln("Processing PrivateToken challenge:", challenge)
-				attributes := strings.Split(challenge, ",")
-				for _, attribute := range attributes {
-					kv := strings.SplitN(attribute, "=", 2)
-					key := strings.TrimSpace(kv[0])
-					value := kv[1]
-
-					if key == authorizationAttributeChallenge {
-						challengeBlob, err = base64.URLEncoding.DecodeString(value)
-						if err != nil {
-							challengeBlob, err = base64.RawURLEncoding.DecodeString(value)
-							if err != nil {
-								log.Error("Failed decoding ", authorizationAttributeChallenge, " attribute")
-								return err
-							}
-						}
-					} else if key == authorizationAttributeTokenKey {
-						tokenKeyEnc, err = base64.URLEncoding.DecodeString(value)
-						if err != nil {
-							tokenKeyEnc, err = base64.RawURLEncoding.DecodeString(value)
-							if err != nil {
-								log.Error("Failed decoding ", authorizationAttributeTokenKey, " attribute")
-								return err
-							}
-						}
-					} else if key == authorizationAttributeMaxAge {
-						// Ignore this attribute for now
-					} else {
-						log.Debugln("Unknown key:", key)
-					}
+		for _, challenge := range selected {
+			if profile.reuseTokens {
+				if _, err := tokenStore.Token(challenge.context); err == nil {
+					log.Debugf("Reusing stored token for challenge %s\n", challenge.context)
+					continue
 				}
+			}
 
-				challenge := sha256.Sum256(challengeBlob)
-				challengeEnc := hex.EncodeToString(challenge[:])
-				tokenChallenges = append(tokenChallenges, challengeEnc)
-
-				tokenType := binary.BigEndian.Uint16(challengeBlob)
-				if tokenType == pat.RateLimitedTokenType {
-					log.Debugln("Fetching rate-limited token...")
-					token, err := fetchRateLimitedToken(rateLimitedClient, clientOriginSecret, id, attester, origin, challengeBlob, tokenKeyEnc)
-					if err != nil {
-						return err
-					}
-
-					log.Debugf("Adding token for challenge %s to the store\n", challengeEnc)
-					tokenStore.AddToken(challengeEnc, token)
-					log.Debugln("TokenStore contents:", tokenStore.String())
-				} else {
-					log.Debugln("Fetching basic token...")
-					token, err := fetchBasicToken(basicClient, attester, challengeBlob, tokenKeyEnc)
-					if err != nil {
-						return err
-					}
-
-					log.Debugf("Adding token for challenge %s to the store\n", challengeEnc)
-					tokenStore.AddToken(challengeEnc, token)
-					log.Debugln("TokenStore contents:", tokenStore.String())
+			if batchSize > 1 && challenge.tokenType() == pat.BasicPrivateTokenType {
+				if _, err := tokenStore.Token(challenge.context); err == nil {
+					log.Debugf("Using batched token for challenge %s from the store\n", challenge.context)
+					continue
+				}
+				log.Debugf("Fetching a batch of %d private tokens...\n", batchSize)
+				tokens, err := fetchBatchedPrivateTokens(httpClient, attester, challenge.blob, challenge.tokenKeyEnc, batchSize)
+				if err != nil {
+					return err
 				}
+				for _, token := range tokens {
+					tokenStore.AddToken(challenge.context, token)
+				}
+				continue
+			}
+
+			token, err := cachedToken(tokenStore, fetcher, challenge, prefetch)
+			if err != nil {
+				return err
 			}
+
+			log.Debugf("Adding token for challenge %s to the store\n", challenge.context)
+			tokenStore.AddToken(challenge.context, token)
+			log.Debugln("TokenStore contents:", tokenStore.String())
 		}
 
 		// Retry the request with a fresh token using the first matching challenge
-		log.Debugf("Consuming token for challenge %s from the store\n", tokenChallenges[0])
-		token, err := tokenStore.ConsumeToken(tokenChallenges[0])
+		log.Debugf("Consuming token for challenge %s from the store\n", selected[0].context)
+		token, err := tokenStore.ConsumeToken(selected[0].context)
 		if err != nil {
 			return err
 		}
 
-		req, err := http.NewRequest(http.MethodGet, resourceURI, nil)
+		req, err := profile.newRequest(resourceURI)
 		if err != nil {
 			return err
 		}
-		req.Header.Add("Authorization", "PrivateToken token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+		profile.setHeader(req, "Authorization", privateTokenAuthorization(token, selected[0]))
 		resp, err = httpClient.Do(req)
 		if err != nil {
 			return err
 		}
-
 		defer resp.Body.Close()
 
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
+		if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "" && attempt < profile.retries {
+			log.Debugln("Redemption challenged again, retrying issuance")
+			continue
 		}
+		break
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
 
-		fmt.Println(string(body))
+	fmt.Println(string(body))
 
-		if store != "" {
-			log.Debugln("Writing TokenStore to", store)
-			err = tokenStore.WriteToFile(store)
-			if err != nil {
-				log.Fatal(err)
-			}
+	if store != "" {
+		log.Debugln("Writing TokenStore to", store)
+		err = tokenStore.WriteToFile(store)
+		if err != nil {
+			log.Fatal(err)
 		}
-	} else {
-		log.Debugln("Missing WWW-Authenticate header")
 	}
 
 	return nil
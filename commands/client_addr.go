@@ -0,0 +1,151 @@
+package commands
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	headerForwarded     = "Forwarded"
+	headerXForwardedFor = "X-Forwarded-For"
+)
+
+// trustedProxies lists the networks of proxies whose Forwarded and
+// X-Forwarded-For headers are honored when deriving the client address.
+type trustedProxies struct {
+	networks []*net.IPNet
+}
+
+// parseNetwork parses a CIDR, or a single address as the network of just it.
+func parseNetwork(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %s", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(entry)
+	return network, err
+}
+
+// parseTrustedProxies parses CIDRs or single addresses. Each entry may list
+// several separated by commas.
+func parseTrustedProxies(specs []string) (*trustedProxies, error) {
+	proxies := &trustedProxies{}
+	for _, spec := range specs {
+		for _, entry := range strings.Split(spec, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			network, err := parseNetwork(entry)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid trusted proxy %q: %w", entry, err)
+			}
+			proxies.networks = append(proxies.networks, network)
+		}
+	}
+	return proxies, nil
+}
+
+func (p *trustedProxies) trusted(ip net.IP) bool {
+	for _, network := range p.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedFor extracts the for= addresses of a Forwarded header, as in
+// RFC 7239, stripping quotes, brackets, and ports. Obfuscated and unknown
+// identifiers are kept as nil.
+func parseForwardedFor(values []string) []net.IP {
+	addrs := make([]net.IP, 0)
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+					continue
+				}
+				addrs = append(addrs, parseForwardedAddr(strings.Trim(pair[4:], `"`)))
+			}
+		}
+	}
+	return addrs
+}
+
+func parseForwardedAddr(node string) net.IP {
+	node = strings.TrimSpace(node)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(strings.Trim(node, "[]"))
+}
+
+// forwardedChain returns the client addresses claimed by proxies in order,
+// from the Forwarded header if present and X-Forwarded-For otherwise.
+func forwardedChain(req *http.Request) []net.IP {
+	if values := req.Header.Values(headerForwarded); len(values) > 0 {
+		return parseForwardedFor(values)
+	}
+	addrs := make([]net.IP, 0)
+	for _, value := range req.Header.Values(headerXForwardedFor) {
+		for _, node := range strings.Split(value, ",") {
+			addrs = append(addrs, parseForwardedAddr(node))
+		}
+	}
+	return addrs
+}
+
+// clientIP derives the client address of the request. Forwarding headers are
+// only honored when the peer is a trusted proxy, and then walked from the
+// nearest hop back while hops are trusted proxies themselves, so clients
+// cannot spoof their address by sending the headers.
+func (p *trustedProxies) clientIP(req *http.Request) string {
+	peer := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	ip := net.ParseIP(peer)
+	if ip == nil || !p.trusted(ip) {
+		return peer
+	}
+
+	chain := forwardedChain(req)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i] == nil {
+			// Unknown or obfuscated, the hop that reported it is the best guess
+			break
+		}
+		ip = chain[i]
+		if !p.trusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// withClientAddr replaces the remote address of forwarded requests with the
+// derived client address, with port 0 since the client port is unknown, before
+// handing them to next.
+func withClientAddr(next http.Handler, proxies *trustedProxies) http.Handler {
+	if len(proxies.networks) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		peer, _, err := net.SplitHostPort(req.RemoteAddr)
+		if client := proxies.clientIP(req); err == nil && client != peer {
+			req.RemoteAddr = net.JoinHostPort(client, "0")
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8, 192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies.networks) != 3 {
+		t.Fatalf("expected 3 networks, got %d", len(proxies.networks))
+	}
+	for _, spec := range []string{"10.0.0.0/33", "proxy.example"} {
+		if _, err := parseTrustedProxies([]string{spec}); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		remoteAddr string
+		header     string
+		value      string
+		expected   string
+	}{
+		// Headers from untrusted peers are ignored
+		{"198.51.100.7:1234", headerXForwardedFor, "203.0.113.1", "198.51.100.7"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"10.0.0.1:1234", headerXForwardedFor, "203.0.113.1", "203.0.113.1"},
+		// Spoofed entries in front of the first untrusted hop are ignored
+		{"10.0.0.1:1234", headerXForwardedFor, "192.0.2.9, 203.0.113.1, 10.0.0.2", "203.0.113.1"},
+		{"10.0.0.1:1234", headerForwarded, `for=192.0.2.9, for="[2001:db8::1]:4711";proto=https`, "2001:db8::1"},
+		{"10.0.0.1:1234", headerForwarded, "for=_hidden, for=10.0.0.2", "10.0.0.2"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		if ip := proxies.clientIP(req); ip != tc.expected {
+			t.Fatalf("expected %s for %s: %s, got %s", tc.expected, tc.header, tc.value, ip)
+		}
+	}
+}
+
+func TestWithClientAddr(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remoteAddr string
+	handler := withClientAddr(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		remoteAddr = req.RemoteAddr
+	}), proxies)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set(headerXForwardedFor, "203.0.113.1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if remoteAddr != "203.0.113.1:0" {
+		t.Fatalf("unexpected remote address %s", remoteAddr)
+	}
+}
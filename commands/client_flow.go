@@ -0,0 +1,309 @@
+package commands
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// clientFlow fetches a resource end to end: it requests the resource, answers
+// the origin's challenge with a fresh token, and redeems it.
+type clientFlow struct {
+	fetcher        *tokenFetcher
+	store          *TokenStore
+	prefetch       int // tokens fetched ahead for non-interactive challenges
+	profile        clientProfile
+	tokenType      string // requested token type, any offered if empty
+	nonInteractive bool
+	crossOrigin    bool
+}
+
+// newRequest returns a request for the resource asking for challenges with
+// the attributes of the flow.
+func (f clientFlow) newRequest(resourceURI string) (*http.Request, error) {
+	req, err := f.profile.newRequest(resourceURI)
+	if err != nil {
+		return nil, err
+	}
+	if f.nonInteractive {
+		f.profile.setHeader(req, headerTokenAttributeNoninteractive, "true")
+	}
+	if f.crossOrigin {
+		f.profile.setHeader(req, headerTokenAttributeCrossOrigin, "true")
+	}
+	if tokenTypeValue, ok := tokenTypeNames[f.tokenType]; ok {
+		f.profile.setHeader(req, headerTokenType, strconv.Itoa(int(tokenTypeValue)))
+	}
+	return req, nil
+}
+
+// selectChallenge returns the first challenge of the requested token type,
+// or the first challenge of a type pat-app implements if no type was
+// requested.
+func (f clientFlow) selectChallenge(challenges []clientChallenge) (clientChallenge, error) {
+	for _, challenge := range challenges {
+		if f.tokenType == "" && isKnownTokenType(challenge.tokenType()) || f.tokenType != "" && challenge.tokenType() == tokenTypeNames[f.tokenType] {
+			return challenge, nil
+		}
+	}
+	if f.tokenType == "" {
+		return clientChallenge{}, fmt.Errorf("%w: origin offered %s, client supports %s", ErrUnsupportedTokenType, describeTokenTypes(offeredTokenTypes(challenges)), describeTokenTypes(knownTokenTypes()))
+	}
+	return clientChallenge{}, fmt.Errorf("%w: origin sent no challenge for %s tokens, only %s", ErrUnsupportedTokenType, f.tokenType, describeTokenTypes(offeredTokenTypes(challenges)))
+}
+
+// challenge requests the resource without a token and returns the challenge
+// the flow answers. Resources the origin serves without a challenge are
+// returned as they are instead.
+func (f clientFlow) challenge(resourceURI string) (clientChallenge, *http.Response, error) {
+	req, err := f.newRequest(resourceURI)
+	if err != nil {
+		return clientChallenge{}, nil, err
+	}
+	resp, err := f.fetcher.httpClient.Do(req)
+	if err != nil {
+		return clientChallenge{}, nil, err
+	}
+	authValue := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode != http.StatusUnauthorized || authValue == "" {
+		return clientChallenge{}, resp, nil
+	}
+	resp.Body.Close()
+
+	log.Debugln("Challenged:", authValue)
+	challenges, err := parseClientChallenges(authValue)
+	if err != nil {
+		return clientChallenge{}, nil, err
+	}
+	challenge, err := f.selectChallenge(challenges)
+	return challenge, nil, err
+}
+
+// token returns a token answering the challenge, from the store if
+// prefetched.
+func (f clientFlow) token(challenge clientChallenge) (pat.Token, error) {
+	token, err := cachedToken(f.store, f.fetcher, challenge, f.prefetch)
+	if err != nil {
+		return pat.Token{}, fmt.Errorf("Failed fetching token: %w", err)
+	}
+	return token, nil
+}
+
+// redeem requests the resource with the token answering the challenge.
+func (f clientFlow) redeem(resourceURI string, token pat.Token, challenge clientChallenge) (*http.Response, error) {
+	req, err := f.profile.newRequest(resourceURI)
+	if err != nil {
+		return nil, err
+	}
+	f.profile.setHeader(req, "Authorization", privateTokenAuthorization(token, challenge))
+	return f.fetcher.httpClient.Do(req)
+}
+
+// run fetches the resource and returns the origin's final response. Resources
+// the origin serves without a challenge are returned as they are.
+func (f clientFlow) run(resourceURI string) (*http.Response, error) {
+	challenge, resp, err := f.challenge(resourceURI)
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil {
+		log.Infoln("Origin served the resource without a challenge")
+		return resp, nil
+	}
+	log.Infoln("Answering challenge:", describeChallenge(challenge.blob))
+
+	token, err := f.token(challenge)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Redeeming token for context %x", token.Context)
+	return f.redeem(resourceURI, token, challenge)
+}
+
+// clientOptions configure the token fetcher of a client, as the flags of the
+// client command do.
+type clientOptions struct {
+	secret            string // hex-encoded client secret
+	attester          string
+	originName        string // origin rate-limited tokens are bound to
+	id                string
+	idSet             bool   // keep id over the client ID of the client key
+	clientKeyFileName string // client key of rate-limited tokens, derived from secret if empty
+	attestation       string // format=file attestation credential, none if empty
+	useHTTP3          bool
+	useH2C            bool
+	ohttp             bool
+}
+
+// newTokenFetcher sets up the token fetcher of a client, the library other
+// commands drive issuance with.
+func newTokenFetcher(opts clientOptions) (*tokenFetcher, error) {
+	fetcher := &tokenFetcher{
+		httpClient:  newHTTPClient(opts.useHTTP3, opts.useH2C),
+		attester:    opts.attester,
+		origin:      opts.originName,
+		id:          opts.id,
+		basicClient: pat.NewBasicPublicClient(),
+	}
+	if opts.attestation != "" {
+		credential, err := loadAttestationCredential(opts.attestation)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid attestation: %w", err)
+		}
+		fetcher.httpClient = withAttestation(fetcher.httpClient, credential)
+	}
+	if opts.ohttp {
+		fetcher.ohttp = newOHTTPClient(fetcher.httpClient, opts.attester)
+	}
+	clientSecret, err := hex.DecodeString(opts.secret)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid client secret: %w", err)
+	}
+	var clientRequestSecret []byte
+	clientRequestSecret, fetcher.clientOriginSecret = deriveClientSecrets(clientSecret)
+	fetcher.rateLimitedClient = pat.CreateRateLimitedClientFromSecret(clientRequestSecret)
+	if opts.clientKeyFileName != "" {
+		clientKey, err := readClientKeyFile(opts.clientKeyFileName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading client key from file %s: %w", opts.clientKeyFileName, err)
+		}
+		fetcher.rateLimitedClient = clientKey.rateLimitedClient()
+		fetcher.clientKey = clientKey
+		fetcher.clientKeyFileName = opts.clientKeyFileName
+		if !opts.idSet && clientKey.ClientID != "" {
+			fetcher.id = clientKey.ClientID
+		}
+	}
+	return fetcher, nil
+}
+
+// writeResponseHead writes the status line and headers of the response, as
+// curl --include does.
+func writeResponseHead(w io.Writer, resp *http.Response) {
+	fmt.Fprintf(w, "%s %s\n", resp.Proto, resp.Status)
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range resp.Header[name] {
+			fmt.Fprintf(w, "%s: %s\n", name, value)
+		}
+	}
+	fmt.Fprintln(w)
+}
+
+func runClient(c *cli.Context) error {
+	resourceURI := c.Args().First()
+	secret := c.String("secret")
+	attester := c.String("attester")
+	tokenType := c.String("token-type")
+	id := c.String("id")
+	logLevel := c.String("log")
+	emulate := c.String("emulate")
+	useHTTP3 := c.Bool("http3")
+	useH2C := c.Bool("h2c")
+	include := c.Bool("include")
+	store := c.String("store")
+	prefetch := c.Int("prefetch")
+	clientKeyFileName := c.String("client-key")
+
+	u, err := url.Parse(resourceURI)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		log.Fatal("Invalid origin URL. See README for running instructions.")
+	}
+	if useHTTP3 && useH2C {
+		log.Fatal("Invalid transport, --http3 and --h2c exclude each other. See README for running instructions.")
+	}
+	if secret == "" {
+		log.Fatal("Invalid client secret. See README for running instructions.")
+	}
+	if attester == "" {
+		log.Fatal("Invalid attester. See README for running instructions.")
+	}
+	if _, ok := tokenTypeNames[tokenType]; tokenType != "" && !ok {
+		log.Fatal("Invalid token type. See README for running instructions.")
+	}
+	if prefetch < 0 {
+		log.Fatal("Invalid prefetch count. See README for running instructions.")
+	}
+	profile, err := lookupClientProfile(emulate)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch logLevel {
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	}
+
+	fetcher, err := newTokenFetcher(clientOptions{
+		secret:            secret,
+		attester:          attester,
+		originName:        u.Host,
+		id:                id,
+		idSet:             c.IsSet("id"),
+		clientKeyFileName: clientKeyFileName,
+		attestation:       c.String("attestation"),
+		useHTTP3:          useHTTP3,
+		useH2C:            useH2C,
+		ohttp:             c.Bool("ohttp"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tokenStore := EmptyStore()
+	if store != "" {
+		if _, err = os.Stat(store); err == nil {
+			log.Debugln("Reading TokenStore from", store)
+			tokenStore, err = ReadStoreFromFile(store)
+			if err != nil {
+				log.Fatal("Failed reading TokenStore from file ", store, ":", err)
+			}
+		}
+	}
+
+	flow := clientFlow{
+		fetcher:        fetcher,
+		store:          tokenStore,
+		prefetch:       prefetch,
+		profile:        profile,
+		tokenType:      tokenType,
+		nonInteractive: c.Bool("non-interactive"),
+		crossOrigin:    c.Bool("cross-origin"),
+	}
+	resp, err := flow.run(resourceURI)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if store != "" {
+		log.Debugln("Writing TokenStore to", store)
+		if err := tokenStore.WriteToFile(store); err != nil {
+			return err
+		}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		fmt.Fprint(os.Stderr, newRedemptionReport(resp))
+		return fmt.Errorf("Origin refused the token")
+	}
+	if include {
+		writeResponseHead(os.Stdout, resp)
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+// clientFlowServer serves an issuer and an origin of basic tokens from one
+// TLS server, named by its address.
+type clientFlowServer struct {
+	*httptest.Server
+	issuer     *Issuer
+	origin     *Origin
+	challenged []*http.Request // requests the origin challenged
+	issued     int
+}
+
+func newClientFlowServer(t *testing.T) *clientFlowServer {
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("resource"))
+	}))
+	t.Cleanup(resource.Close)
+	original := testResource
+	t.Cleanup(func() { testResource = original })
+	testResource = resource.URL
+
+	s := &clientFlowServer{origin: newTestOrigin()}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case issuerConfigURI:
+			s.issuer.handleConfigRequest(w, req)
+		case tokenRequestURI:
+			s.issued++
+			s.issuer.handleIssuanceRequest(w, req)
+		case "/unprotected":
+			w.Write([]byte("public"))
+		default:
+			if req.Header.Get("Authorization") == "" {
+				s.challenged = append(s.challenged, req)
+			}
+			s.origin.handleRequest(w, req)
+		}
+	}))
+	t.Cleanup(s.Close)
+	s.rotateKeys(t)
+	return s
+}
+
+// rotateKeys replaces the issuer with one under fresh keys.
+func (s *clientFlowServer) rotateKeys(t *testing.T) {
+	serverURL, _ := url.Parse(s.URL)
+	s.issuer = newTestIssuer(t, serverURL.Host)
+	keys := &issuerKeys{encapKey: s.issuer.rateLimitedIssuer.NameKey()}
+	basicKeyEnc, _ := marshalTokenKey(s.issuer.basicIssuer.TokenKey(), false)
+	keys.parseTokenKey(int(pat.BasicPublicTokenType), basicKeyEnc)
+	s.origin.issuerName = serverURL.Host
+	s.origin.issuerKeys = &issuerKeySource{keys: keys}
+}
+
+func TestClientFlow(t *testing.T) {
+	server := newClientFlowServer(t)
+	flow := clientFlow{
+		fetcher: &tokenFetcher{
+			httpClient:  server.Client(),
+			basicClient: pat.NewBasicPublicClient(),
+		},
+		tokenType:      "basic",
+		nonInteractive: true,
+	}
+	resp, err := flow.run(server.URL + "/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "resource" {
+		t.Fatalf("expected the resource after redemption, got %d %q", resp.StatusCode, body)
+	}
+	if len(server.challenged) != 1 || server.challenged[0].Header.Get(headerTokenAttributeNoninteractive) == "" ||
+		server.challenged[0].Header.Get(headerTokenType) != "2" {
+		t.Fatal("expected the challenge to be requested with the attributes of the flow")
+	}
+
+	resp, err = flow.run(server.URL + "/unprotected")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "public" {
+		t.Fatalf("expected resources without challenge to be returned as they are, got %q", body)
+	}
+
+	flow.tokenType = "ed25519"
+	if _, err := flow.run(server.URL + "/index.html"); err == nil || !strings.Contains(err.Error(), "no challenge") {
+		t.Fatalf("expected a missing challenge of the requested type to fail, got %v", err)
+	}
+}
+
+func TestWriteResponseHead(t *testing.T) {
+	resp := &http.Response{
+		Proto:  "HTTP/1.1",
+		Status: "200 OK",
+		Header: http.Header{"Content-Type": {"text/plain"}, "A": {"1", "2"}},
+	}
+	var out bytes.Buffer
+	writeResponseHead(&out, resp)
+	if out.String() != "HTTP/1.1 200 OK\nA: 1\nA: 2\nContent-Type: text/plain\n\n" {
+		t.Fatalf("unexpected response head %q", out.String())
+	}
+}
@@ -0,0 +1,446 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+
+	pat "github.com/cloudflare/pat-go"
+	blindecdsa "github.com/cloudflare/pat-go/ecdsa"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	clientKeyFileVersion   = 1
+	clientBlindLength      = 32
+	defaultClientKeyBlinds = 16
+
+	clientKeyRegistrationLabel = "pat-app client key registration"
+)
+
+const (
+	// Results of client key checks, as metric labels
+	clientKeyCheckOK           = "ok"
+	clientKeyCheckUnregistered = "unregistered"
+	clientKeyCheckKeyMismatch  = "key-mismatch"
+	clientKeyCheckBlindedKey   = "blinded-key-mismatch"
+	clientKeyCheckUnsupported  = "unsupported-format"
+)
+
+var (
+	// Attester URIs at which clients register their (rotated) keys. The
+	// second is kept for clients predating /register.
+	attesterRegisterURI  = "/register"
+	attesterClientKeyURI = "/client-key"
+
+	ErrClientKeyMismatch      = errors.New("Client key does not match the registered key")
+	ErrClientKeyUnregistered  = errors.New("Client key not registered")
+	ErrRequestKeyMismatch     = errors.New("Request key is not a blinding of the client key")
+	ErrRequestKeyUnchecked    = errors.New("Request keys can only be checked against P-384 client keys")
+	ErrClientKeyUnregistrable = errors.New("Only P-384 client keys can be registered, as request keys cannot be checked against others")
+)
+
+// clientKeyFile is the on-disk form of a client's rate-limited issuance key,
+// as written by `pat-app keygen client`. The secret is the P-384 private
+// scalar, the public key is its compressed encoding as sent in the
+// Sec-Token-Client header, and the blinds are unused Sec-Token-Request-Blind
+// values, consumed one per token request.
+type clientKeyFile struct {
+	Version    int      `json:"version"`
+	ClientID   string   `json:"client_id"`
+	Generation int      `json:"generation"`
+	Secret     []byte   `json:"secret"`
+	PublicKey  []byte   `json:"public_key"`
+	Blinds     [][]byte `json:"blinds"`
+}
+
+func generateBlinds(count int) ([][]byte, error) {
+	blinds := make([][]byte, count)
+	for i := range blinds {
+		blinds[i] = make([]byte, clientBlindLength)
+		if _, err := rand.Read(blinds[i]); err != nil {
+			return nil, err
+		}
+	}
+	return blinds, nil
+}
+
+func newClientKeyFile(clientID string, blinds int) (*clientKeyFile, error) {
+	curve := elliptic.P384()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, (curve.Params().BitSize+7)/8)
+	key.D.FillBytes(secret)
+
+	keyBlinds, err := generateBlinds(blinds)
+	if err != nil {
+		return nil, err
+	}
+	return &clientKeyFile{
+		Version:   clientKeyFileVersion,
+		ClientID:  clientID,
+		Secret:    secret,
+		PublicKey: elliptic.MarshalCompressed(curve, key.X, key.Y),
+		Blinds:    keyBlinds,
+	}, nil
+}
+
+func readClientKeyFile(fileName string) (*clientKeyFile, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	keyFile := &clientKeyFile{}
+	if err := json.Unmarshal(data, keyFile); err != nil {
+		return nil, err
+	}
+	if keyFile.Version != clientKeyFileVersion {
+		return nil, fmt.Errorf("Unsupported client key file version %d", keyFile.Version)
+	}
+	if _, err := keyFile.privateKey(); err != nil {
+		return nil, err
+	}
+	return keyFile, nil
+}
+
+func (f *clientKeyFile) write(fileName string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fileName, data, 0600)
+}
+
+func (f *clientKeyFile) privateKey() (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P384()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(f.Secret)}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(f.Secret)
+	if !bytes.Equal(elliptic.MarshalCompressed(curve, key.X, key.Y), f.PublicKey) {
+		return nil, fmt.Errorf("Client key file public key does not match its secret")
+	}
+	return key, nil
+}
+
+func (f *clientKeyFile) rateLimitedClient() pat.RateLimitedClient {
+	return pat.CreateRateLimitedClientFromSecret(f.Secret)
+}
+
+// takeBlind returns the next unused blind, or nil once they are exhausted.
+func (f *clientKeyFile) takeBlind() []byte {
+	if len(f.Blinds) == 0 {
+		return nil
+	}
+	blind := f.Blinds[0]
+	f.Blinds = f.Blinds[1:]
+	return blind
+}
+
+// rotate replaces the key and blinds, returning the registration for the new
+// key signed with the old one.
+func (f *clientKeyFile) rotate(blinds int) (clientKeyRegistration, error) {
+	oldKey, err := f.privateKey()
+	if err != nil {
+		return clientKeyRegistration{}, err
+	}
+	next, err := newClientKeyFile(f.ClientID, blinds)
+	if err != nil {
+		return clientKeyRegistration{}, err
+	}
+	next.Generation = f.Generation + 1
+
+	registration, err := signClientKeyRegistration(oldKey, f.ClientID, next.PublicKey)
+	if err != nil {
+		return clientKeyRegistration{}, err
+	}
+	*f = *next
+	return registration, nil
+}
+
+// clientKeyRegistration binds a client key to a client ID at the attester. It
+// is signed with the key currently registered for the client, or with the new
+// key itself on first registration.
+type clientKeyRegistration struct {
+	ClientID  string `json:"client_id"`
+	ClientKey []byte `json:"client_key"`
+	Signature []byte `json:"signature"`
+}
+
+func clientKeyRegistrationDigest(clientID string, clientKey []byte) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddBytes([]byte(clientKeyRegistrationLabel))
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes([]byte(clientID))
+	})
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(clientKey)
+	})
+	digest := sha512.Sum384(b.BytesOrPanic())
+	return digest[:]
+}
+
+func signClientKeyRegistration(signingKey *ecdsa.PrivateKey, clientID string, clientKey []byte) (clientKeyRegistration, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, signingKey, clientKeyRegistrationDigest(clientID, clientKey))
+	if err != nil {
+		return clientKeyRegistration{}, err
+	}
+	scalarLen := (signingKey.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*scalarLen)
+	r.FillBytes(signature[:scalarLen])
+	s.FillBytes(signature[scalarLen:])
+	return clientKeyRegistration{
+		ClientID:  clientID,
+		ClientKey: clientKey,
+		Signature: signature,
+	}, nil
+}
+
+// unmarshalClientKey decodes a client key of any known format, whether the
+// attester accepts it or not.
+func unmarshalClientKey(clientKeyEnc []byte) (*ecdsa.PublicKey, error) {
+	format, ok := detectClientKeyFormat(clientKeyEnc)
+	if !ok {
+		return nil, fmt.Errorf("Invalid client key encoding")
+	}
+	return format.unmarshal(clientKeyEnc)
+}
+
+func (r clientKeyRegistration) verify(signingKeyEnc []byte) error {
+	signingKey, err := unmarshalClientKey(signingKeyEnc)
+	if err != nil {
+		return err
+	}
+	scalarLen := (signingKey.Curve.Params().BitSize + 7) / 8
+	if len(r.Signature) != 2*scalarLen {
+		return fmt.Errorf("Invalid registration signature length")
+	}
+	rs := new(big.Int).SetBytes(r.Signature[:scalarLen])
+	ss := new(big.Int).SetBytes(r.Signature[scalarLen:])
+	if !ecdsa.Verify(signingKey, clientKeyRegistrationDigest(r.ClientID, r.ClientKey), rs, ss) {
+		return fmt.Errorf("Invalid registration signature")
+	}
+	return nil
+}
+
+// clientKeyRegistry holds the client keys registered at the attester. Clients
+// that registered a key must use it for rate-limited issuance, and their
+// request keys must be blindings of it.
+type clientKeyRegistry struct {
+	lock sync.Mutex
+	keys map[string][]byte // client ID -> compressed client key
+}
+
+func newClientKeyRegistry() *clientKeyRegistry {
+	return &clientKeyRegistry{
+		keys: make(map[string][]byte),
+	}
+}
+
+func (r *clientKeyRegistry) register(registration clientKeyRegistration) error {
+	if _, err := unmarshalClientKey(registration.ClientKey); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	signingKey, ok := r.keys[registration.ClientID]
+	if !ok {
+		signingKey = registration.ClientKey
+	}
+	if err := registration.verify(signingKey); err != nil {
+		return err
+	}
+	r.keys[registration.ClientID] = registration.ClientKey
+	return nil
+}
+
+func (r *clientKeyRegistry) lookup(clientID string) ([]byte, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	clientKey, ok := r.keys[clientID]
+	return clientKey, ok
+}
+
+// checkRequestKey verifies that the request key is the client key blinded
+// with the request blind. Request keys are P-384 keys, so only P-384 client
+// keys can be checked; the request keys of other clients are refused with
+// ErrRequestKeyUnchecked.
+func checkRequestKey(clientKeyEnc, requestBlind, requestKeyEnc []byte) error {
+	clientKey, err := unmarshalClientKey(clientKeyEnc)
+	if err != nil {
+		return err
+	}
+	curve := elliptic.P384()
+	if clientKey.Curve != curve {
+		return ErrRequestKeyUnchecked
+	}
+	blindKey, err := blindecdsa.CreateKey(curve, requestBlind)
+	if err != nil {
+		return err
+	}
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(pat.RateLimitedTokenType)
+	b.AddBytes([]byte("ClientBlind"))
+	blindedKey, err := blindecdsa.BlindPublicKeyWithContext(curve, &blindecdsa.PublicKey{Curve: curve, X: clientKey.X, Y: clientKey.Y}, blindKey, b.BytesOrPanic())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(elliptic.MarshalCompressed(curve, blindedKey.X, blindedKey.Y), requestKeyEnc) {
+		return ErrRequestKeyMismatch
+	}
+	return nil
+}
+
+// checkClientKey verifies that the client uses its registered key, and that
+// the request key is BlindPublicKey(client key, blind). Unregistered clients
+// are refused if the attester requires registration, and are not checked
+// otherwise.
+func (a TestAttester) checkClientKey(clientID string, clientKey, requestBlind, requestKey []byte) error {
+	registeredKey, ok := a.clientKeys.lookup(clientID)
+	if !ok {
+		if a.requireClientKeys {
+			attesterClientKeyChecks.Inc(pat.RateLimitedTokenType, clientKeyCheckUnregistered)
+			return ErrClientKeyUnregistered
+		}
+		return nil
+	}
+	if !bytes.Equal(registeredKey, clientKey) {
+		attesterClientKeyChecks.Inc(pat.RateLimitedTokenType, clientKeyCheckKeyMismatch)
+		return ErrClientKeyMismatch
+	}
+	if err := checkRequestKey(clientKey, requestBlind, requestKey); errors.Is(err, ErrRequestKeyUnchecked) {
+		attesterClientKeyChecks.Inc(pat.RateLimitedTokenType, clientKeyCheckUnsupported)
+		return err
+	} else if err != nil {
+		attesterClientKeyChecks.Inc(pat.RateLimitedTokenType, clientKeyCheckBlindedKey)
+		return err
+	}
+	attesterClientKeyChecks.Inc(pat.RateLimitedTokenType, clientKeyCheckOK)
+	return nil
+}
+
+func (a TestAttester) handleClientKeyRegistration(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	registration := clientKeyRegistration{}
+	if err := json.NewDecoder(req.Body).Decode(&registration); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if registration.ClientID == "" {
+		http.Error(w, "Missing client ID", http.StatusBadRequest)
+		return
+	}
+	clientKey, err := a.clientKeyFormats.parse(registration.ClientKey)
+	if err == nil && clientKey.Curve != elliptic.P384() {
+		// Registered clients would be refused every rate-limited token by
+		// checkClientKey, so their keys are refused here instead
+		err = ErrClientKeyUnregistrable
+	}
+	if err != nil {
+		log.Println("Client key registration refused for client", registration.ClientID, err)
+		attesterClientKeyChecks.Inc(pat.RateLimitedTokenType, clientKeyCheckUnsupported)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.clientKeys.register(registration); err != nil {
+		log.Println("Client key registration failed for client", registration.ClientID, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	log.Println("Registered client key for client", registration.ClientID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func registerClientKey(httpClient *http.Client, attester string, registration clientKeyRegistration) error {
+	registrationURI, err := composeURL(attester, attesterRegisterURI)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(registrationURI, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Client key registration failed with error %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+func runKeygenClient(c *cli.Context) error {
+	out := c.String("out")
+	clientID := c.String("id")
+	blinds := c.Int("blinds")
+	attester := c.String("attester")
+	rotate := c.Bool("rotate")
+
+	if out == "" {
+		log.Fatal("Invalid client key file. See README for running instructions.")
+	}
+	if blinds < 0 {
+		log.Fatal("Invalid blind count. See README for running instructions.")
+	}
+
+	var keyFile *clientKeyFile
+	var registration clientKeyRegistration
+	var err error
+	if rotate {
+		keyFile, err = readClientKeyFile(out)
+		if err != nil {
+			log.Fatal("Failed reading client key from file ", out, ": ", err)
+		}
+		registration, err = keyFile.rotate(blinds)
+	} else {
+		keyFile, err = newClientKeyFile(clientID, blinds)
+		if err != nil {
+			return err
+		}
+		var key *ecdsa.PrivateKey
+		key, err = keyFile.privateKey()
+		if err != nil {
+			return err
+		}
+		registration, err = signClientKeyRegistration(key, keyFile.ClientID, keyFile.PublicKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Register before writing so that a failed rotation keeps the old key usable
+	if attester != "" {
+		if err := registerClientKey(http.DefaultClient, attester, registration); err != nil {
+			return err
+		}
+	} else if rotate {
+		log.Warnln("Rotated client key without --attester, register it before use")
+	}
+
+	if err := keyFile.write(out); err != nil {
+		return err
+	}
+	fmt.Printf("Client key %x (generation %d, %d blinds) written to %s\n", keyFile.PublicKey, keyFile.Generation, len(keyFile.Blinds), out)
+	return nil
+}
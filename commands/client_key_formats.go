@@ -0,0 +1,146 @@
+package commands
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+const (
+	// Encodings of client keys the attester can accept, as metric labels
+	clientKeyFormatP256Compressed   = "p256-compressed"
+	clientKeyFormatP256Uncompressed = "p256-uncompressed"
+	clientKeyFormatP384Compressed   = "p384-compressed"
+	clientKeyFormatP384Uncompressed = "p384-uncompressed"
+)
+
+var (
+	clientKeyFormatNames = []string{
+		clientKeyFormatP256Compressed,
+		clientKeyFormatP256Uncompressed,
+		clientKeyFormatP384Compressed,
+		clientKeyFormatP384Uncompressed,
+	}
+
+	// Accepted unless --client-key-format is set: the compressed keys that
+	// pat-go and most other clients send
+	defaultClientKeyFormats = []string{
+		clientKeyFormatP384Compressed,
+		clientKeyFormatP256Compressed,
+	}
+
+	ErrUnsupportedClientKey = errors.New("Unsupported client key format")
+)
+
+// clientKeyFormat is a SEC 1 encoding of a point on one curve.
+type clientKeyFormat struct {
+	name       string
+	curve      elliptic.Curve
+	compressed bool
+}
+
+func (f clientKeyFormat) length() int {
+	fieldLen := (f.curve.Params().BitSize + 7) / 8
+	if f.compressed {
+		return 1 + fieldLen
+	}
+	return 1 + 2*fieldLen
+}
+
+var clientKeyFormatList = []clientKeyFormat{
+	{clientKeyFormatP256Compressed, elliptic.P256(), true},
+	{clientKeyFormatP256Uncompressed, elliptic.P256(), false},
+	{clientKeyFormatP384Compressed, elliptic.P384(), true},
+	{clientKeyFormatP384Uncompressed, elliptic.P384(), false},
+}
+
+// detectClientKeyFormat tells the format of an encoded client key from its
+// length and leading byte, without checking that the point is on the curve.
+func detectClientKeyFormat(clientKeyEnc []byte) (clientKeyFormat, bool) {
+	if len(clientKeyEnc) == 0 {
+		return clientKeyFormat{}, false
+	}
+	compressed := clientKeyEnc[0] == 2 || clientKeyEnc[0] == 3
+	if !compressed && clientKeyEnc[0] != 4 {
+		return clientKeyFormat{}, false
+	}
+	for _, format := range clientKeyFormatList {
+		if format.compressed == compressed && format.length() == len(clientKeyEnc) {
+			return format, true
+		}
+	}
+	return clientKeyFormat{}, false
+}
+
+// unmarshal decodes a client key of the format.
+func (f clientKeyFormat) unmarshal(clientKeyEnc []byte) (*ecdsa.PublicKey, error) {
+	var x, y *big.Int
+	if f.compressed {
+		x, y = elliptic.UnmarshalCompressed(f.curve, clientKeyEnc)
+	} else {
+		x, y = elliptic.Unmarshal(f.curve, clientKeyEnc)
+	}
+	if x == nil {
+		return nil, fmt.Errorf("Invalid %s client key encoding", f.name)
+	}
+	return &ecdsa.PublicKey{Curve: f.curve, X: x, Y: y}, nil
+}
+
+// clientKeyFormats are the client key formats the attester accepts in the
+// Sec-Token-Client header and at /register. Clients in the wild use P-256 or
+// P-384 for their stable key; whatever else they send is refused with
+// ErrUnsupportedClientKey rather than failing somewhere down the line. A nil
+// set accepts the default formats.
+type clientKeyFormats map[string]bool
+
+func parseClientKeyFormats(names []string) (clientKeyFormats, error) {
+	if len(names) == 0 {
+		names = defaultClientKeyFormats
+	}
+	formats := make(clientKeyFormats)
+	for _, name := range names {
+		known := false
+		for _, format := range clientKeyFormatNames {
+			known = known || name == format
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown client key format %q", name)
+		}
+		formats[name] = true
+	}
+	return formats, nil
+}
+
+// String lists the formats for logs.
+func (f clientKeyFormats) String() string {
+	if f == nil {
+		return fmt.Sprint(defaultClientKeyFormats)
+	}
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+// parse decodes a client key if its format is accepted.
+func (f clientKeyFormats) parse(clientKeyEnc []byte) (*ecdsa.PublicKey, error) {
+	format, ok := detectClientKeyFormat(clientKeyEnc)
+	if !ok {
+		return nil, fmt.Errorf("%w: %d bytes", ErrUnsupportedClientKey, len(clientKeyEnc))
+	}
+	accepted := f[format.name]
+	if f == nil {
+		for _, name := range defaultClientKeyFormats {
+			accepted = accepted || name == format.name
+		}
+	}
+	if !accepted {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedClientKey, format.name)
+	}
+	return format.unmarshal(clientKeyEnc)
+}
@@ -0,0 +1,163 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func testClientKeyEncodings(t *testing.T) map[string][]byte {
+	encodings := map[string][]byte{}
+	for _, format := range clientKeyFormatList {
+		key, err := ecdsa.GenerateKey(format.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format.compressed {
+			encodings[format.name] = elliptic.MarshalCompressed(format.curve, key.X, key.Y)
+		} else {
+			encodings[format.name] = elliptic.Marshal(format.curve, key.X, key.Y)
+		}
+	}
+	return encodings
+}
+
+func TestClientKeyFormatDetection(t *testing.T) {
+	for name, clientKeyEnc := range testClientKeyEncodings(t) {
+		format, ok := detectClientKeyFormat(clientKeyEnc)
+		if !ok || format.name != name {
+			t.Fatalf("expected %s to be detected, got %q", name, format.name)
+		}
+		if _, err := unmarshalClientKey(clientKeyEnc); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	edKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	for _, clientKeyEnc := range [][]byte{nil, edKey, make([]byte, 49), append([]byte{5}, edKey...)} {
+		if _, ok := detectClientKeyFormat(clientKeyEnc); ok {
+			t.Fatalf("expected %x not to be detected", clientKeyEnc)
+		}
+	}
+}
+
+func TestClientKeyFormatsAccept(t *testing.T) {
+	encodings := testClientKeyEncodings(t)
+
+	// Defaults accept compressed keys of both curves
+	var defaults clientKeyFormats
+	for name, clientKeyEnc := range encodings {
+		_, err := defaults.parse(clientKeyEnc)
+		if strings.HasSuffix(name, "-compressed") != (err == nil) {
+			t.Fatalf("%s: unexpected result %v", name, err)
+		}
+		if err != nil && !errors.Is(err, ErrUnsupportedClientKey) {
+			t.Fatalf("%s: expected ErrUnsupportedClientKey, got %v", name, err)
+		}
+	}
+
+	formats, err := parseClientKeyFormats([]string{clientKeyFormatP256Uncompressed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, clientKeyEnc := range encodings {
+		if _, err := formats.parse(clientKeyEnc); (name == clientKeyFormatP256Uncompressed) != (err == nil) {
+			t.Fatalf("%s: unexpected result %v", name, err)
+		}
+	}
+	if _, err := formats.parse([]byte("not a key")); !errors.Is(err, ErrUnsupportedClientKey) {
+		t.Fatalf("expected an unknown format to be refused, got %v", err)
+	}
+
+	if _, err := parseClientKeyFormats([]string{"ed25519"}); err == nil {
+		t.Fatal("expected an unknown format name to fail")
+	}
+	if formats, err := parseClientKeyFormats(nil); err != nil || formats.String() != "[p256-compressed p384-compressed]" {
+		t.Fatalf("expected the default formats, got %v %v", formats, err)
+	}
+}
+
+func TestClientKeyFormatsRegistration(t *testing.T) {
+	register := func(attester TestAttester, curve elliptic.Curve) int {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registration, err := signClientKeyRegistration(key, "alice", elliptic.MarshalCompressed(curve, key.X, key.Y))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(registration)
+		recorder := httptest.NewRecorder()
+		attester.handleClientKeyRegistration(recorder, httptest.NewRequest(http.MethodPost, attesterRegisterURI, bytes.NewReader(body)))
+		return recorder.Code
+	}
+
+	// P-256 keys are accepted in Sec-Token-Client, but their request keys
+	// cannot be checked, so they are refused at registration
+	attester := newTestAttester(nil)
+	attester.clientKeys = newClientKeyRegistry()
+	attester.requireClientKeys = true
+	unregistrable := attesterClientKeyChecks.Value(pat.RateLimitedTokenType, clientKeyCheckUnsupported)
+	if status := register(attester, elliptic.P256()); status != http.StatusBadRequest {
+		t.Fatalf("expected a P-256 key to be refused at registration, got %d", status)
+	}
+	if attesterClientKeyChecks.Value(pat.RateLimitedTokenType, clientKeyCheckUnsupported) != unregistrable+1 {
+		t.Fatal("expected the refusal to be counted")
+	}
+	if _, ok := attester.clientKeys.lookup("alice"); ok {
+		t.Fatal("expected no P-256 key to be registered")
+	}
+	if status := register(attester, elliptic.P384()); status != http.StatusNoContent {
+		t.Fatalf("expected a P-384 key to register, got %d", status)
+	}
+
+	// P-256 keys registered otherwise are refused whatever request key they send
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := newClientKeyFile("bob", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blind, mismatchedRequestKey := testRequestKey(t, keyFile)
+	registration, err := signClientKeyRegistration(key, "carol", elliptic.MarshalCompressed(elliptic.P256(), key.X, key.Y))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := attester.clientKeys.register(registration); err != nil {
+		t.Fatal(err)
+	}
+	unchecked := attesterClientKeyChecks.Value(pat.RateLimitedTokenType, clientKeyCheckUnsupported)
+	if err := attester.checkClientKey("carol", registration.ClientKey, blind, mismatchedRequestKey); !errors.Is(err, ErrRequestKeyUnchecked) {
+		t.Fatalf("expected a P-256 client to be refused, got %v", err)
+	}
+	if attesterClientKeyChecks.Value(pat.RateLimitedTokenType, clientKeyCheckUnsupported) != unchecked+1 {
+		t.Fatal("expected the refusal to be counted")
+	}
+
+	attester = newTestAttester(nil)
+	attester.clientKeys = newClientKeyRegistry()
+	attester.clientKeyFormats, _ = parseClientKeyFormats([]string{clientKeyFormatP384Compressed})
+	refused := attesterClientKeyChecks.Value(pat.RateLimitedTokenType, clientKeyCheckUnsupported)
+	if status := register(attester, elliptic.P256()); status != http.StatusBadRequest {
+		t.Fatalf("expected a P-256 key to be refused, got %d", status)
+	}
+	if attesterClientKeyChecks.Value(pat.RateLimitedTokenType, clientKeyCheckUnsupported) != refused+1 {
+		t.Fatal("expected the refusal to be counted")
+	}
+	if _, ok := attester.clientKeys.lookup("alice"); ok {
+		t.Fatal("expected no key to be registered")
+	}
+}
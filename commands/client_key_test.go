@@ -0,0 +1,217 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestClientKeyFile(t *testing.T) {
+	keyFile, err := newClientKeyFile("alice", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(t.TempDir(), "client.key")
+	if err := keyFile.write(fileName); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := readClientKeyFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.PublicKey, keyFile.PublicKey) || len(loaded.Blinds) != 2 {
+		t.Fatalf("unexpected key file %+v", loaded)
+	}
+
+	loaded.takeBlind()
+	loaded.takeBlind()
+	if loaded.takeBlind() != nil {
+		t.Fatal("expected blinds to be exhausted")
+	}
+
+	loaded.PublicKey[1] ^= 0xFF
+	if _, err := loaded.privateKey(); err == nil {
+		t.Fatal("expected mismatched public key to be rejected")
+	}
+}
+
+// testRequestKey creates a rate-limited TokenRequest with the next blind of
+// the key file, and returns the blind and the request key.
+func testRequestKey(t *testing.T, keyFile *clientKeyFile) ([]byte, []byte) {
+	tokenKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := pat.NewRateLimitedIssuer(tokenKey)
+	issuer.AddOrigin("origin.example")
+
+	tokenKeyEnc, err := marshalTokenKey(&tokenKey.PublicKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenKeyID := sha256.Sum256(tokenKeyEnc)
+	challenge := pat.TokenChallenge{
+		TokenType:  pat.RateLimitedTokenType,
+		IssuerName: "issuer.example",
+		OriginInfo: []string{"origin.example"},
+	}
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+
+	blind := keyFile.takeBlind()
+	state, err := keyFile.rateLimitedClient().CreateTokenRequest(challenge.Marshal(), nonce, blind, tokenKeyID[:], &tokenKey.PublicKey, "origin.example", issuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(state.ClientKey(), keyFile.PublicKey) {
+		t.Fatal("client key mismatch")
+	}
+	return blind, state.Request().RequestKey
+}
+
+func TestClientKeyRequestKey(t *testing.T) {
+	keyFile, err := newClientKeyFile("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blind, requestKey := testRequestKey(t, keyFile)
+	if err := checkRequestKey(keyFile.PublicKey, blind, requestKey); err != nil {
+		t.Fatal(err)
+	}
+
+	other := make([]byte, clientBlindLength)
+	rand.Read(other)
+	if err := checkRequestKey(keyFile.PublicKey, other, requestKey); !errors.Is(err, ErrRequestKeyMismatch) {
+		t.Fatalf("expected request key for another blind to be rejected, got %v", err)
+	}
+}
+
+func TestClientKeyCheck(t *testing.T) {
+	keyFile, err := newClientKeyFile("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blind, requestKey := testRequestKey(t, keyFile)
+	attester := newTestAttester(nil)
+	attester.clientKeys = newClientKeyRegistry()
+
+	// Unregistered clients are only refused in registration mode
+	if err := attester.checkClientKey("alice", keyFile.PublicKey, blind, requestKey); err != nil {
+		t.Fatal(err)
+	}
+	attester.requireClientKeys = true
+	if err := attester.checkClientKey("alice", keyFile.PublicKey, blind, requestKey); !errors.Is(err, ErrClientKeyUnregistered) {
+		t.Fatalf("expected an unregistered client to be refused, got %v", err)
+	}
+
+	key, _ := keyFile.privateKey()
+	registration, err := signClientKeyRegistration(key, "alice", keyFile.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := attester.clientKeys.register(registration); err != nil {
+		t.Fatal(err)
+	}
+	checks := attesterClientKeyChecks.Value(pat.RateLimitedTokenType, clientKeyCheckOK)
+	if err := attester.checkClientKey("alice", keyFile.PublicKey, blind, requestKey); err != nil {
+		t.Fatal(err)
+	}
+	if attesterClientKeyChecks.Value(pat.RateLimitedTokenType, clientKeyCheckOK) != checks+1 {
+		t.Fatal("expected the check to be counted")
+	}
+
+	other, err := newClientKeyFile("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBlind, otherRequestKey := testRequestKey(t, other)
+	if err := attester.checkClientKey("alice", other.PublicKey, otherBlind, otherRequestKey); !errors.Is(err, ErrClientKeyMismatch) {
+		t.Fatalf("expected another client key to be refused, got %v", err)
+	}
+	if err := attester.checkClientKey("alice", keyFile.PublicKey, blind, otherRequestKey); !errors.Is(err, ErrRequestKeyMismatch) {
+		t.Fatalf("expected a request key of another client key to be refused, got %v", err)
+	}
+}
+
+func TestClientKeyRegisterEndpoint(t *testing.T) {
+	keyFile, err := newClientKeyFile("alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := keyFile.privateKey()
+	registration, err := signClientKeyRegistration(key, "alice", keyFile.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attester := newTestAttester(nil)
+	attester.clientKeys = newClientKeyRegistry()
+	mux := http.NewServeMux()
+	mux.HandleFunc(attesterRegisterURI, attester.handleClientKeyRegistration)
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+
+	if err := registerClientKey(server.Client(), strings.TrimPrefix(server.URL, "https://"), registration); err != nil {
+		t.Fatal(err)
+	}
+	if registered, ok := attester.clientKeys.lookup("alice"); !ok || !bytes.Equal(registered, keyFile.PublicKey) {
+		t.Fatal("expected the client key to be registered")
+	}
+}
+
+func TestClientKeyRotation(t *testing.T) {
+	keyFile, err := newClientKeyFile("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keyFile.privateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registration, err := signClientKeyRegistration(key, "alice", keyFile.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := newClientKeyRegistry()
+	if err := registry.register(registration); err != nil {
+		t.Fatal(err)
+	}
+
+	// A key registered by someone else cannot replace the current one
+	intruder, err := newClientKeyFile("alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intruderKey, _ := intruder.privateKey()
+	forged, err := signClientKeyRegistration(intruderKey, "alice", intruder.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.register(forged); err == nil {
+		t.Fatal("expected self-signed key to be refused for a registered client")
+	}
+
+	rotation, err := keyFile.rotate(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyFile.Generation != 1 || len(keyFile.Blinds) != 4 {
+		t.Fatalf("unexpected rotated key file %+v", keyFile)
+	}
+	if err := registry.register(rotation); err != nil {
+		t.Fatal(err)
+	}
+	registered, _ := registry.lookup("alice")
+	if !bytes.Equal(registered, keyFile.PublicKey) {
+		t.Fatal("expected the rotated key to be registered")
+	}
+}
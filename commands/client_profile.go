@@ -0,0 +1,194 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cloudflare/pat-app/httpauth"
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// clientChallenge is a single PrivateToken challenge parsed from a
+// WWW-Authenticate header.
+type clientChallenge struct {
+	blob        []byte
+	tokenKeyEnc []byte
+	context     string // hex-encoded SHA-256 digest of the challenge, used to key the token store
+	echo        bool   // send the challenge back with the token, as signed challenges ask
+}
+
+func (c clientChallenge) tokenType() uint16 {
+	return binary.BigEndian.Uint16(c.blob)
+}
+
+// tokenKeyID returns the key ID of tokens issued under the challenge's token
+// key.
+func (c clientChallenge) tokenKeyID() []byte {
+	if c.tokenType() == pat.BasicPrivateTokenType {
+		return privateTokenKeyID(c.tokenKeyEnc)
+	}
+	keyID := sha256.Sum256(c.tokenKeyEnc)
+	return keyID[:]
+}
+
+// nonInteractive tells whether the challenge has an empty redemption nonce,
+// so that tokens for it can be fetched ahead of time.
+func (c clientChallenge) nonInteractive() bool {
+	challenge, err := pat.UnmarshalTokenChallenge(c.blob)
+	return err == nil && len(challenge.RedemptionNonce) == 0
+}
+
+func decodeChallengeAttribute(key, value string) ([]byte, error) {
+	data, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		data, err = base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			log.Error("Failed decoding ", key, " attribute")
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// parseClientChallenges returns the PrivateToken challenges of a
+// WWW-Authenticate header value, skipping challenges of other schemes.
+func parseClientChallenges(authValue string) ([]clientChallenge, error) {
+	parsed, err := httpauth.Parse(authValue)
+	if err != nil {
+		return nil, err
+	}
+
+	challenges := make([]clientChallenge, 0, len(parsed))
+	for _, authChallenge := range parsed {
+		if !authChallenge.IsPrivateToken() {
+			log.Debugln("Skipping challenge of scheme", authChallenge.Scheme)
+			continue
+		}
+		log.Debugln("Processing PrivateToken challenge:", authChallenge)
+		for _, param := range authChallenge.Params {
+			log.Debugln("Unknown key:", param.Name)
+		}
+		if len(authChallenge.TokenChallenge) < 2 {
+			return nil, fmt.Errorf("Invalid PrivateToken challenge: missing %s attribute", httpauth.ParamChallenge)
+		}
+
+		context := sha256.Sum256(authChallenge.TokenChallenge)
+		_, echo := authChallenge.Param(challengeParamEcho)
+		challenges = append(challenges, clientChallenge{
+			blob:        authChallenge.TokenChallenge,
+			tokenKeyEnc: authChallenge.TokenKey,
+			context:     hex.EncodeToString(context[:]),
+			echo:        echo,
+		})
+	}
+	if len(challenges) == 0 {
+		return nil, fmt.Errorf("Invalid WWW-Authenticate challenge header")
+	}
+
+	return challenges, nil
+}
+
+// clientProfile captures the observable behavior of a client implementation,
+// so that origins and attesters can be tested against realistic clients.
+type clientProfile struct {
+	name             string
+	userAgent        string   // User-Agent header, empty to use Go's default
+	lowercaseHeaders bool     // send header names in lowercase, as HTTP/2 stacks do
+	sendCountHint    bool     // ask the origin for multiple challenges
+	supportedTypes   []uint16 // token types the client can redeem, nil for all
+	fetchAll         bool     // fetch a token for every challenge rather than only the selected one
+	reuseTokens      bool     // redeem a stored token for a matching challenge before running issuance
+	retries          int      // times issuance is re-run if the redemption is challenged again
+}
+
+var clientProfiles = map[string]clientProfile{
+	"default": {
+		name:          "default",
+		sendCountHint: true,
+		fetchAll:      true,
+	},
+	// Observed behavior of Apple's client: lowercase HTTP/2 header names,
+	// basic publicly verifiable tokens only, one token for the first usable
+	// challenge, cached tokens reused, and a single retry.
+	"ios": {
+		name:             "ios",
+		userAgent:        "pat-app CFNetwork/1399 Darwin/22.1.0",
+		lowercaseHeaders: true,
+		supportedTypes:   []uint16{pat.BasicPublicTokenType},
+		reuseTokens:      true,
+		retries:          1,
+	},
+}
+
+func lookupClientProfile(name string) (clientProfile, error) {
+	if name == "" {
+		name = "default"
+	}
+	profile, ok := clientProfiles[name]
+	if !ok {
+		return clientProfile{}, fmt.Errorf("Unknown client profile %q", name)
+	}
+	return profile, nil
+}
+
+func (p clientProfile) setHeader(req *http.Request, name, value string) {
+	if p.lowercaseHeaders {
+		// Bypass canonicalization so the name goes out on the wire as is
+		req.Header[strings.ToLower(name)] = []string{value}
+	} else {
+		req.Header.Set(name, value)
+	}
+}
+
+func (p clientProfile) newRequest(uri string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.userAgent != "" {
+		p.setHeader(req, "User-Agent", p.userAgent)
+	}
+	return req, nil
+}
+
+// supports returns whether the profile fetches tokens of the type. Profiles
+// without supported types fetch every type pat-app implements.
+func (p clientProfile) supports(tokenType uint16) bool {
+	if p.supportedTypes == nil {
+		return isKnownTokenType(tokenType)
+	}
+	for _, supportedType := range p.supportedTypes {
+		if supportedType == tokenType {
+			return true
+		}
+	}
+	return false
+}
+
+// selectChallenges returns the challenges to fetch tokens for. The first
+// returned challenge is the one redeemed.
+func (p clientProfile) selectChallenges(challenges []clientChallenge) ([]clientChallenge, error) {
+	selected := make([]clientChallenge, 0)
+	for _, challenge := range challenges {
+		if p.supports(challenge.tokenType()) {
+			selected = append(selected, challenge)
+			if !p.fetchAll {
+				break
+			}
+		}
+	}
+	if len(selected) == 0 {
+		supported := p.supportedTypes
+		if supported == nil {
+			supported = knownTokenTypes()
+		}
+		return nil, fmt.Errorf("%w: origin offered %s, client profile %s supports %s", ErrUnsupportedTokenType, describeTokenTypes(offeredTokenTypes(challenges)), p.name, describeTokenTypes(supported))
+	}
+	return selected, nil
+}
@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/cloudflare/pat-app/httpauth"
+	pat "github.com/cloudflare/pat-go"
+)
+
+func createChallengeHeader(tokenTypes ...uint16) string {
+	challenges := make([]httpauth.Challenge, len(tokenTypes))
+	maxAge := 10
+	for i, tokenType := range tokenTypes {
+		challenge := pat.TokenChallenge{
+			TokenType:  tokenType,
+			IssuerName: "issuer.example",
+			OriginInfo: []string{"origin.example"},
+		}
+		challenges[i] = httpauth.Challenge{
+			TokenChallenge: challenge.Marshal(),
+			TokenKey:       []byte{0x01, 0x02},
+			MaxAge:         &maxAge,
+		}
+	}
+	return httpauth.Marshal(challenges...)
+}
+
+func TestParseClientChallenges(t *testing.T) {
+	challenges, err := parseClientChallenges(createChallengeHeader(pat.RateLimitedTokenType, pat.BasicPublicTokenType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(challenges) != 2 {
+		t.Fatalf("Expected 2 challenges, got %d", len(challenges))
+	}
+	if challenges[0].tokenType() != pat.RateLimitedTokenType || challenges[1].tokenType() != pat.BasicPublicTokenType {
+		t.Fatal("token type mismatch")
+	}
+
+	if _, err := parseClientChallenges("Basic realm=test"); err == nil {
+		t.Fatal("expected non-PrivateToken challenge to be rejected")
+	}
+}
+
+func TestClientProfileSelection(t *testing.T) {
+	challenges, err := parseClientChallenges(createChallengeHeader(pat.RateLimitedTokenType, pat.BasicPublicTokenType, pat.BasicPublicTokenType))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultProfile, err := lookupClientProfile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected, err := defaultProfile.selectChallenges(challenges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 3 {
+		t.Fatal("expected the default profile to fetch every challenge")
+	}
+
+	iosProfile, err := lookupClientProfile("ios")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected, err = iosProfile.selectChallenges(challenges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 1 || selected[0].tokenType() != pat.BasicPublicTokenType {
+		t.Fatal("expected the ios profile to select the first basic challenge")
+	}
+	if _, err := iosProfile.selectChallenges(challenges[:1]); err == nil {
+		t.Fatal("expected the ios profile to reject unsupported challenges")
+	}
+
+	if _, err := lookupClientProfile("unknown"); err == nil {
+		t.Fatal("expected unknown profile to be rejected")
+	}
+}
+
+func TestClientProfileHeaderCasing(t *testing.T) {
+	iosProfile, _ := lookupClientProfile("ios")
+	req, err := iosProfile.newRequest("https://origin.example/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iosProfile.setHeader(req, "Authorization", "PrivateToken token=abc")
+	if _, ok := req.Header["authorization"]; !ok {
+		t.Fatal("expected lowercase header name")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "https://origin.example/index.html", nil)
+	clientProfiles["default"].setHeader(req, "authorization", "PrivateToken token=abc")
+	if _, ok := req.Header["Authorization"]; !ok {
+		t.Fatal("expected canonical header name")
+	}
+}
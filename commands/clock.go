@@ -0,0 +1,127 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	adminClockURI    = adminURIPrefix + "clock"
+	adminClockSetURI = adminURIPrefix + "clock/set"
+)
+
+// clock tells the time to the logic that depends on it: challenge expiry,
+// epochs, and rate-limit windows. Roles read it instead of calling time.Now so
+// that time can be moved in tests and demos.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// demoClock runs at the pace of the system clock, shifted by an offset that
+// the admin API of roles in demo mode can change, e.g., to watch challenges
+// expire or epochs roll over without waiting.
+type demoClock struct {
+	lock   sync.Mutex
+	offset time.Duration
+}
+
+func (c *demoClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return time.Now().Add(c.offset)
+}
+
+// advance moves the clock forward by d, or backward if d is negative.
+func (c *demoClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.offset += d
+}
+
+// set moves the clock to now.
+func (c *demoClock) set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.offset = time.Until(now)
+}
+
+// newRoleClock returns the clock of a role, a demo clock in demo mode.
+func newRoleClock(demo bool) clock {
+	if demo {
+		return &demoClock{}
+	}
+	return systemClock{}
+}
+
+// clockSetRequest moves the clock to a time, or by a duration.
+type clockSetRequest struct {
+	Now     string `json:"now,omitempty"`     // RFC 3339 time
+	Advance string `json:"advance,omitempty"` // Go duration, e.g., "90s" or "-1h"
+}
+
+type clockState struct {
+	Now    string `json:"now"`
+	Offset string `json:"offset"`
+}
+
+func (c *demoClock) state() clockState {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return clockState{
+		Now:    time.Now().Add(c.offset).Format(time.RFC3339Nano),
+		Offset: c.offset.String(),
+	}
+}
+
+func (c *demoClock) handleClock(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, c.state())
+}
+
+func (c *demoClock) handleClockSet(w http.ResponseWriter, req *http.Request) {
+	var setReq clockSetRequest
+	if err := readAdminJSON(req, &setReq); err != nil {
+		http.Error(w, "Invalid clock request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (setReq.Now == "") == (setReq.Advance == "") {
+		http.Error(w, "Exactly one of now or advance is required", http.StatusBadRequest)
+		return
+	}
+	if setReq.Now != "" {
+		now, err := time.Parse(time.RFC3339Nano, setReq.Now)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid time %q: %v", setReq.Now, err), http.StatusBadRequest)
+			return
+		}
+		c.set(now)
+	} else {
+		d, err := time.ParseDuration(setReq.Advance)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid duration %q: %v", setReq.Advance, err), http.StatusBadRequest)
+			return
+		}
+		c.advance(d)
+	}
+	writeAdminJSON(w, c.state())
+}
+
+// handleClockAdmin serves the clock control endpoints on the admin API if the
+// clock is a demo clock.
+func handleClockAdmin(admin *adminServer, c clock) {
+	demo, ok := c.(*demoClock)
+	if !ok {
+		return
+	}
+	admin.handle(http.MethodGet, adminClockURI, "Current time of the demo clock and its offset from the system clock",
+		nil, clockState{}, demo.handleClock)
+	admin.handle(http.MethodPost, adminClockSetURI, "Move the demo clock to a time or by a duration, for demos and tests only",
+		clockSetRequest{}, clockState{}, demo.handleClockSet)
+}
@@ -0,0 +1,98 @@
+package commands
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Clock skew tolerated between peers unless configured otherwise
+	defaultClockSkew = 30 * time.Second
+
+	// Timestamps checked against the local clock
+	skewCheckEpochChallenge     = "epoch-challenge"
+	skewCheckVerificationBundle = "verification-bundle"
+	skewCheckAdminHMAC          = "admin-hmac"
+	skewCheckAttesterSignature  = "attester-signature"
+
+	// Results of clock skew checks
+	skewResultOK        = "ok"
+	skewResultTolerated = "tolerated"
+	skewResultRefused   = "refused"
+)
+
+// checkTimeWindow reports whether now falls within [notBefore, notAfter),
+// widened by skew on both ends, and counts whether it did so only thanks to
+// the skew tolerance.
+func checkTimeWindow(check string, now, notBefore, notAfter time.Time, skew time.Duration) bool {
+	switch {
+	case !now.Before(notBefore) && now.Before(notAfter):
+		clockSkewChecks.Inc(0, check, skewResultOK)
+		return true
+	case !now.Before(notBefore.Add(-skew)) && now.Before(notAfter.Add(skew)):
+		log.Debugln("Tolerated clock skew in", check, "check: now", now, "outside of", notBefore, "to", notAfter)
+		clockSkewChecks.Inc(0, check, skewResultTolerated)
+		return true
+	default:
+		log.Warnln("Refused", check, "timestamp beyond the clock skew tolerance of", skew, ": now", now, "outside of", notBefore, "to", notAfter)
+		clockSkewChecks.Inc(0, check, skewResultRefused)
+		return false
+	}
+}
+
+// clockSkewTransport measures the offset of a peer's clock from the Date
+// header of its responses, warning if it exceeds the tolerance.
+type clockSkewTransport struct {
+	base http.RoundTripper
+	peer string
+	skew time.Duration
+	now  func() time.Time
+}
+
+func newClockSkewTransport(base http.RoundTripper, peer string, skew time.Duration) *clockSkewTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &clockSkewTransport{
+		base: base,
+		peer: peer,
+		skew: skew,
+		now:  time.Now,
+	}
+}
+
+func (t *clockSkewTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sent := t.now()
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return resp, nil
+	}
+
+	// Date has a resolution of one second and is taken somewhere between
+	// sending the request and receiving the response
+	received := t.now()
+	offset := time.Duration(0)
+	if date.Before(sent.Truncate(time.Second)) {
+		offset = date.Sub(sent.Truncate(time.Second))
+	} else if latest := received.Truncate(time.Second); date.After(latest) {
+		offset = date.Sub(latest)
+	}
+	clockSkew.Set(0, offset.Seconds(), t.peer)
+	if offset > t.skew || offset < -t.skew {
+		log.Warnln("Clock of", t.peer, "is off by", offset, "beyond the clock skew tolerance of", t.skew)
+	}
+	return resp, nil
+}
+
+// withClockSkewCheck returns a client measuring the clock of the peer.
+func withClockSkewCheck(client *http.Client, peer string, skew time.Duration) *http.Client {
+	checked := *client
+	checked.Transport = newClockSkewTransport(client.Transport, peer, skew)
+	return &checked
+}
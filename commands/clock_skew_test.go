@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestCheckTimeWindow(t *testing.T) {
+	notBefore := time.Unix(1000, 0)
+	notAfter := notBefore.Add(time.Minute)
+	for _, test := range []struct {
+		now    time.Time
+		ok     bool
+		result string
+	}{
+		{notBefore, true, skewResultOK},
+		{notBefore.Add(-10 * time.Second), true, skewResultTolerated},
+		{notAfter.Add(10 * time.Second), true, skewResultTolerated},
+		{notBefore.Add(-time.Minute), false, skewResultRefused},
+		{notAfter.Add(30 * time.Second), false, skewResultRefused},
+	} {
+		count := clockSkewChecks.Value(0, skewCheckEpochChallenge, test.result)
+		if ok := checkTimeWindow(skewCheckEpochChallenge, test.now, notBefore, notAfter, 30*time.Second); ok != test.ok {
+			t.Fatalf("unexpected result %v at %v", ok, test.now)
+		}
+		if clockSkewChecks.Value(0, skewCheckEpochChallenge, test.result) != count+1 {
+			t.Fatalf("expected a %s check to be counted at %v", test.result, test.now)
+		}
+	}
+}
+
+func TestClockSkewTransport(t *testing.T) {
+	peerNow := time.Now().Add(-2 * time.Minute)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Date", peerNow.UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	client := withClockSkewCheck(server.Client(), "skewed.example", time.Minute)
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if offset := clockSkew.Value(0, "skewed.example"); offset > -119 || offset < -122 {
+		t.Fatalf("unexpected clock offset %v", offset)
+	}
+}
+
+func TestEpochChallengeSkew(t *testing.T) {
+	challenger, err := newEpochChallenger(bytes.Repeat([]byte{0x42}, 32), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenger.skew = time.Minute
+
+	// A replica whose clock is ahead hands out challenges of the next epoch
+	// shortly before it starts locally
+	now := time.Unix(0, 0).Add(10 * time.Hour).Add(-30 * time.Second)
+	ahead := now.Add(time.Minute)
+	origin := newTestOrigin()
+	tokenTypes := []uint16{pat.RateLimitedTokenType}
+	challenge := pat.TokenChallenge{
+		TokenType:       tokenTypes[0],
+		IssuerName:      "issuer.example",
+		OriginInfo:      origin.originInfo(),
+		RedemptionNonce: challenger.nonce("origin.example", challenger.epoch(ahead)),
+	}
+	challengeBlob := challenge.Marshal()
+	context := sha256.Sum256(challengeBlob)
+	contextEnc := hex.EncodeToString(context[:])
+
+	tolerated := clockSkewChecks.Value(0, skewCheckEpochChallenge, skewResultTolerated)
+	if _, ok := challenger.match(contextEnc, "issuer.example", "origin.example", origin.originInfo(), tokenTypes, now); !ok {
+		t.Fatal("expected challenges of the next epoch to match within the clock skew")
+	}
+	if clockSkewChecks.Value(0, skewCheckEpochChallenge, skewResultTolerated) != tolerated+1 {
+		t.Fatal("expected the match to be counted as tolerated")
+	}
+	challenger.skew = 0
+	if _, ok := challenger.match(contextEnc, "issuer.example", "origin.example", origin.originInfo(), tokenTypes, now); ok {
+		t.Fatal("expected challenges of the next epoch to be rejected without clock skew")
+	}
+}
+
+func TestVerificationBundleSkew(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	bundleKey, err := loadEd25519SigningKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := bundleKey.Public().(ed25519.PublicKey)
+
+	// The issuer's clock is ahead of the origin's
+	now := time.Now()
+	bundle, err := issuer.verificationBundle(now.Add(20 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signVerificationBundle(bundle, bundleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openVerificationBundle(signed, "issuer.example", publicKey, now, 0); err == nil {
+		t.Fatal("expected a bundle issued in the future to be refused without clock skew")
+	}
+	if _, err := openVerificationBundle(signed, "issuer.example", publicKey, now, defaultClockSkew); err != nil {
+		t.Fatal(err)
+	}
+}
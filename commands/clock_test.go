@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func postClockSet(admin *adminServer, setReq clockSetRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(setReq)
+	req := httptest.NewRequest(http.MethodPost, adminClockSetURI, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	return w
+}
+
+func TestDemoClockExpiresChallenges(t *testing.T) {
+	origin := newTestOrigin()
+	origin.clock = newRoleClock(true)
+	admin := origin.newAdminServer("secret")
+	contextEnc := createTestChallengeContext(t, origin, true)
+
+	w := postClockSet(admin, clockSetRequest{Advance: "1m"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var state clockState
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil || state.Offset != "1m0s" {
+		t.Fatalf("unexpected clock state %+v: %v", state, err)
+	}
+	if _, err := origin.consumeChallenge(contextEnc); err != ErrUnknownChallenge {
+		t.Fatalf("expected the challenge to expire on the demo clock, got %v", err)
+	}
+
+	// The clock can be set to a time, but not to a time and by a duration
+	target := time.Now().Add(-time.Hour)
+	if w := postClockSet(admin, clockSetRequest{Now: target.Format(time.RFC3339Nano)}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if skew := origin.now().Sub(target); skew < 0 || skew > time.Minute {
+		t.Fatalf("expected the clock to be set, got %v", origin.now())
+	}
+	if w := postClockSet(admin, clockSetRequest{Now: target.Format(time.RFC3339Nano), Advance: "1s"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an ambiguous request, got %d", w.Code)
+	}
+	if w := postClockSet(admin, clockSetRequest{Advance: "soon"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid duration, got %d", w.Code)
+	}
+}
+
+func TestSystemClockHasNoAdmin(t *testing.T) {
+	origin := newTestOrigin()
+	if w := postClockSet(origin.newAdminServer("secret"), clockSetRequest{Advance: "1m"}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the clock endpoints to be disabled outside demo mode, got %d", w.Code)
+	}
+
+	attester := newTestAttester(nil)
+	attester.policyWindow = time.Hour
+	attester.clock = newRoleClock(true)
+	epoch := attester.policyEpoch(attester.now())
+	attester.clock.(*demoClock).advance(time.Hour)
+	if attester.policyEpoch(attester.now()) != epoch+1 {
+		t.Fatal("expected the policy window to roll over on the demo clock")
+	}
+}
@@ -1,6 +1,8 @@
 package commands
 
 import (
+	"time"
+
 	"github.com/urfave/cli"
 )
 
@@ -9,21 +11,25 @@ var Commands = []cli.Command{
 		Name:   "issuer",
 		Usage:  "Start a PAT issuer",
 		Action: startIssuer,
-		Flags: []cli.Flag{
-			cli.StringFlag{
-				Name:     "cert, c",
-				Value:    "",
-				Required: true,
+		Before: recordTranscript,
+		Flags: append([]cli.Flag{
+			configFileFlag,
+			recordFlag,
+			cli.StringSliceFlag{
+				Name:  "cert, c",
+				Usage: "TLS certificate file, may be repeated for multiple hostnames",
+			},
+			cli.StringSliceFlag{
+				Name:  "key, k",
+				Usage: "TLS private key file, one per --cert in the same order",
 			},
 			cli.StringFlag{
-				Name:     "key, k",
-				Value:    "",
-				Required: true,
+				Name:  "cert-dir",
+				Usage: "Directory of <name>.pem and <name>-key.pem pairs, selected by SNI",
 			},
 			cli.StringFlag{
-				Name:     "name",
-				Value:    "",
-				Required: true,
+				Name:  "name",
+				Value: "",
 			},
 			cli.StringFlag{
 				Name:  "port",
@@ -33,98 +39,650 @@ var Commands = []cli.Command{
 				Name:  "origins",
 				Usage: "Supported origins",
 			},
+			cli.StringFlag{
+				Name:  "origin-allowlist",
+				Usage: "File of origins to issue rate-limited tokens for, one name or *.<domain> pattern per line, replacing the default origin",
+			},
+			cli.BoolFlag{
+				Name:  "self-test",
+				Usage: "Check the directory, issuance and verification of each token type, and verification bundles before serving, refusing to start if a check fails",
+			},
 			cli.StringFlag{
 				Name:  "log",
 				Value: "error",
 			},
-		},
+			cli.BoolFlag{
+				Name:  "http3",
+				Usage: "Also serve HTTP/3 over QUIC on the same port",
+			},
+			cli.BoolFlag{
+				Name:  "h2c",
+				Usage: "Serve HTTP/2 and HTTP/1.1 in cleartext (h2c) instead of TLS, e.g., behind a proxy terminating TLS",
+			},
+			cli.StringSliceFlag{
+				Name:  "trusted-proxies",
+				Usage: "CIDRs of proxies whose Forwarded and X-Forwarded-For headers give the client address, may be repeated",
+			},
+			cli.StringFlag{
+				Name:  "verification-bundle-signing-key",
+				Usage: "File with the hex-encoded Ed25519 seed signing verification bundles, generated if unset",
+			},
+			cli.StringFlag{
+				Name:  "admin-client-ca",
+				Usage: "PEM file of CAs whose client certificates may use the admin API under /admin/",
+			},
+			cli.StringSliceFlag{
+				Name:  "admin-hmac-key",
+				Usage: "<key-id>:<hex key> accepted for HMAC-signed admin requests, may be repeated",
+			},
+			cli.DurationFlag{
+				Name:  "admin-hmac-skew",
+				Value: defaultAdminHMACSkew,
+				Usage: "Largest difference between the timestamp of HMAC-signed admin requests and the local clock",
+			},
+			cli.StringFlag{
+				Name:  "admin-audit-log",
+				Usage: "File to append admin requests to as JSON lines, '-' for stdout",
+			},
+			cli.StringFlag{
+				Name:  "private-token-key",
+				Usage: "File with the hex-encoded VOPRF key of privately verifiable tokens (type 0x0001), shared with origins verifying them locally, random if unset",
+			},
+			cli.BoolFlag{
+				Name:  "experimental-ed25519",
+				Usage: "Also issue experimental, linkable Ed25519 tokens (type 0xED25) for benchmarking",
+			},
+			cli.BoolFlag{
+				Name:  "ohttp-gateway",
+				Usage: "Also serve token requests encapsulated with Oblivious HTTP and relayed by attesters, publishing the gateway key configuration in the directory",
+			},
+			cli.StringFlag{
+				Name:  "ohttp-key",
+				Usage: "File with the hex-encoded 32-byte seed of the Oblivious HTTP gateway's X25519 key, random if unset",
+			},
+			cli.StringSliceFlag{
+				Name:  "token-window",
+				Usage: "<seconds>=<limit> tokens a client may obtain per origin in each window of that many seconds, published in the directory for attesters to enforce, may be repeated, e.g., 3600=10 and 86400=50",
+			},
+			cli.StringSliceFlag{
+				Name:  "attester-key",
+				Usage: "<key-id>:<hex Ed25519 public key> of an attester signing the token requests it forwards, may be repeated. Unsigned token requests are then refused",
+			},
+			cli.DurationFlag{
+				Name:  "attester-signature-skew",
+				Value: defaultAttesterSignatureSkew,
+				Usage: "Largest difference between the creation time of attester signatures and the local clock",
+			},
+			cli.StringFlag{
+				Name:  "attester-client-ca",
+				Usage: "PEM file of CAs whose client certificates attesters must present with token requests. Token requests without one are then refused",
+			},
+			cli.IntFlag{
+				Name:  "fair-queue-slots",
+				Usage: "Token requests signed in parallel, shared among attesters with weighted fair queueing, 0 signs every request as it arrives",
+			},
+			cli.StringSliceFlag{
+				Name:  "attester-weight",
+				Usage: "<address>=<weight> share of signing capacity of the attester at that address under fair queueing, 1 if unlisted, may be repeated",
+			},
+			cli.IntFlag{
+				Name:  "fair-queue-depth",
+				Value: defaultFairQueueDepth,
+				Usage: "Token requests queued per attester under fair queueing, beyond which the issuer answers 503",
+			},
+			cli.DurationFlag{
+				Name:  "key-rotation-interval",
+				Usage: "Interval at which token keys are rotated, 0 to rotate only on SIGHUP or through the admin API",
+			},
+			cli.DurationFlag{
+				Name:  "key-overlap",
+				Value: defaultKeyOverlap,
+				Usage: "Time a rotated token key stays published and accepted for verification",
+			},
+			cli.StringSliceFlag{
+				Name:  "simulate-fault",
+				Usage: "Break token responses for attester and client testing ['truncate-signature', 'wrong-content-type', 'drop-token-limit', 'error-storm'], never in production; may be repeated",
+			},
+			cli.Float64Flag{
+				Name:  "fault-probability",
+				Value: 1,
+				Usage: "Probability of each simulated fault being injected into a token response",
+			},
+			cli.DurationFlag{
+				Name:  "fault-storm-duration",
+				Value: defaultFaultStormDuration,
+				Usage: "Time every token request fails with a 5xx status once an error storm started",
+			},
+		}, serverFlags...),
 	},
 	{
 		Name:   "attester",
 		Usage:  "Start a PAT attester",
 		Action: startAttester,
-		Flags: []cli.Flag{
-			cli.StringFlag{
-				Name:     "cert, c",
-				Value:    "",
-				Required: true,
+		Before: recordTranscript,
+		Subcommands: []cli.Command{
+			{
+				Name:   "wipe-state",
+				Usage:  "Drop all client state of a running attester through its admin API",
+				Action: runAttesterWipeState,
+				Before: applyConfigFile,
+				Flags: []cli.Flag{
+					configFileFlag,
+					cli.StringFlag{
+						Name:  "attester",
+						Usage: "Attester to wipe, e.g., attester.example:4569",
+					},
+					cli.StringFlag{
+						Name:  "admin-token",
+						Usage: "Bearer token of the attester admin API",
+					},
+					cli.BoolFlag{
+						Name:  "yes",
+						Usage: "Skip the confirmation prompt",
+					},
+				},
+			},
+		},
+		Flags: append([]cli.Flag{
+			configFileFlag,
+			recordFlag,
+			cli.StringSliceFlag{
+				Name:  "cert, c",
+				Usage: "TLS certificate file, may be repeated for multiple hostnames",
+			},
+			cli.StringSliceFlag{
+				Name:  "key, k",
+				Usage: "TLS private key file, one per --cert in the same order",
 			},
 			cli.StringFlag{
-				Name:     "key, k",
-				Value:    "",
-				Required: true,
+				Name:  "cert-dir",
+				Usage: "Directory of <name>.pem and <name>-key.pem pairs, selected by SNI",
 			},
 			cli.StringFlag{
 				Name:  "port",
 				Value: "443",
 			},
+			cli.StringFlag{
+				Name:  "policy",
+				Usage: "Attester policy file (JSON)",
+			},
+			cli.StringSliceFlag{
+				Name:  "attestation-plugin",
+				Usage: "WASM attestation verifier as format=path.wasm, may be repeated",
+			},
+			cli.StringSliceFlag{
+				Name:  "attestation",
+				Usage: "Built-in attestation method as format=file ['api-key', 'totp', 'device-statement'] with the accepted credentials, may be repeated",
+			},
+			cli.StringSliceFlag{
+				Name:  "issuer-failover",
+				Usage: "Ordered issuer endpoints as name=endpoint[,endpoint...], primary first, may be repeated. Endpoints are host[:port] or token request URLs like http://host:8080/issue",
+			},
+			cli.DurationFlag{
+				Name:  "issuer-timeout",
+				Value: 10 * time.Second,
+				Usage: "Timeout of each token request forwarded to an issuer endpoint, 0 for none",
+			},
+			cli.StringFlag{
+				Name:  "issuer-policy",
+				Value: issuerPolicyIgnore,
+				Usage: "Whether token requests are checked against the policy in the issuer directory before forwarding them ['ignore', 'enforce']",
+			},
+			cli.DurationFlag{
+				Name:  "issuer-policy-ttl",
+				Value: defaultIssuerPolicyTTL,
+				Usage: "Time an issuer directory is used before fetching it again",
+			},
+			cli.StringFlag{
+				Name:  "admin-token",
+				Usage: "Bearer token enabling the admin API under /admin/",
+			},
+			cli.StringFlag{
+				Name:  "admin-port",
+				Usage: "Port serving the admin API apart from protected resources, which then no longer serve it",
+			},
+			cli.StringFlag{
+				Name:  "admin-audit-log",
+				Usage: "File to append admin requests to as JSON lines, '-' for stdout",
+			},
+			cli.DurationFlag{
+				Name:  "privacy-epoch",
+				Value: 24 * time.Hour,
+				Usage: "Epoch over which the privacy budget report accumulates per-client information",
+			},
+			cli.StringFlag{
+				Name:  "receipt-signing-key",
+				Usage: "File with the hex-encoded Ed25519 seed signing issuance receipts, which are only issued if set",
+			},
+			cli.StringFlag{
+				Name:  "request-signing-key",
+				Usage: "File with the hex-encoded Ed25519 seed signing token requests forwarded to issuers, unsigned if unset",
+			},
+			cli.StringFlag{
+				Name:  "request-signing-key-id",
+				Usage: "Key ID of the request signing key issuers know it by, its hex-encoded public key if unset",
+			},
+			cli.StringFlag{
+				Name:  "issuer-client-cert",
+				Usage: "PEM file of the client certificate presented to issuers asking for one, with --issuer-client-key",
+			},
+			cli.StringFlag{
+				Name:  "issuer-client-key",
+				Usage: "PEM file of the private key of --issuer-client-cert",
+			},
+			cli.DurationFlag{
+				Name:  "policy-window",
+				Value: time.Duration(defaultTokenPolicyWindow) * time.Second,
+				Usage: "Window after which per-origin token counts reset and unused anonymous origin IDs expire, swept once per window, 0 keeps them forever",
+			},
+			cli.StringFlag{
+				Name:  "state-store",
+				Value: storeMemory,
+				Usage: "Where per-client state is kept across restarts ['memory', 'bolt:<file>', 'redis://<host>:<port>/<db>', 'redis+cluster://<host>:<port>', 'redis+sentinel://<host>:<port>/<db>?master=<name>']",
+			},
+			cli.StringFlag{
+				Name:  "state-encryption-key",
+				Usage: "File with the hex-encoded AES-256 key encrypting client state in the state store, created if missing and rotated by wipe-state",
+			},
+			cli.DurationFlag{
+				Name:  "origin-churn-window",
+				Value: time.Minute,
+				Usage: "Window over which new anonymous origin IDs per client are counted as a fraud signal",
+			},
+			cli.IntFlag{
+				Name:  "origin-churn-threshold",
+				Value: 10,
+				Usage: "New anonymous origin IDs per client within the churn window beyond which churn is reported, 0 disables",
+			},
+			cli.StringFlag{
+				Name:  "fraud-events",
+				Usage: "File to append fraud signals to as JSON lines, '-' for stdout",
+			},
+			cli.BoolFlag{
+				Name:  "require-client-keys",
+				Usage: "Refuse rate-limited token requests of clients that did not register a key at /register",
+			},
+			cli.StringSliceFlag{
+				Name:  "client-key-format",
+				Usage: "Client key format accepted in Sec-Token-Client and at /register ['p256-compressed', 'p256-uncompressed', 'p384-compressed', 'p384-uncompressed'], p384-compressed and p256-compressed if unset; may be repeated. Only P-384 keys can be registered, as request keys cannot be checked against P-256 keys yet",
+			},
+			cli.StringFlag{
+				Name:  "blind-reuse-action",
+				Value: blindReuseActionLog,
+				Usage: "What to do about blinded request keys seen before ['log', 'reject']",
+			},
+			cli.StringSliceFlag{
+				Name:  "simulate-fault",
+				Usage: "Misbehave on purpose for research ['drop-blind', 'tamper-request-key', 'misreport-count'], never in production; may be repeated",
+			},
+			cli.DurationFlag{
+				Name:  "dedup-window",
+				Value: 5 * time.Second,
+				Usage: "Window in which byte-identical token requests of a client are deduplicated, 0 disables deduplication",
+			},
+			cli.StringFlag{
+				Name:  "dedup-action",
+				Value: dedupActionReplay,
+				Usage: "What to do about duplicate token requests ['replay', 'reject']",
+			},
+			cli.BoolFlag{
+				Name:  "stream-responses",
+				Usage: "Stream issuer response bodies to clients as they arrive instead of reading them in full first",
+			},
+			cli.DurationFlag{
+				Name:  "stream-flush-interval",
+				Usage: "Longest time streamed response bytes are held before flushing them to the client, 0 flushes every read",
+			},
+			cli.BoolFlag{
+				Name:  "self-test",
+				Usage: "Check the issuance receipt signing key before serving, refusing to start if a check fails",
+			},
+			cli.BoolFlag{
+				Name:  "demo",
+				Usage: "Run on a demo clock that the admin API can move, for demos and integration tests only",
+			},
 			cli.StringFlag{
 				Name:  "log",
 				Value: "error",
 			},
-		},
+			cli.BoolFlag{
+				Name:  "http3",
+				Usage: "Also serve HTTP/3 over QUIC on the same port",
+			},
+			cli.BoolFlag{
+				Name:  "h2c",
+				Usage: "Serve HTTP/2 and HTTP/1.1 in cleartext (h2c) instead of TLS, e.g., behind a proxy terminating TLS",
+			},
+			cli.BoolFlag{
+				Name:  "issuer-h2c",
+				Usage: "Speak HTTP/2 in cleartext (h2c) to issuers",
+			},
+			cli.StringFlag{
+				Name:  "user-agent",
+				Usage: "User-Agent of requests to issuers, Go's default if unset",
+			},
+			cli.BoolFlag{
+				Name:  "ohttp-relay",
+				Usage: "Also relay token requests that clients encapsulated with Oblivious HTTP to the gateways of issuers",
+			},
+			cli.StringSliceFlag{
+				Name:  "issuer-header",
+				Usage: "'<name>: <value>' header sent with every request to issuers, e.g., an API key of a hosted issuer, may be repeated",
+			},
+			cli.StringSliceFlag{
+				Name:  "trusted-proxies",
+				Usage: "CIDRs of proxies whose Forwarded and X-Forwarded-For headers give the client address, may be repeated",
+			},
+		}, serverFlags...),
 	},
 	{
 		Name:   "origin",
 		Usage:  "Start a PAT origin",
 		Action: startOrigin,
-		Flags: []cli.Flag{
-			cli.StringFlag{
-				Name:     "cert, c",
-				Value:    "",
-				Required: true,
+		Before: recordTranscript,
+		Subcommands: []cli.Command{
+			{
+				Name:   "enroll",
+				Usage:  "Verify the keys of an issuer and write the configuration of an origin challenging for it",
+				Action: runOriginEnroll,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "issuer",
+						Usage: "Issuer to enroll with, e.g., issuer.example:4567 or https://issuer.example:4567",
+					},
+					cli.StringFlag{
+						Name:  "name",
+						Usage: "Name of the origin, e.g., origin.example:4568",
+					},
+					cli.StringSliceFlag{
+						Name:  "origin-info",
+						Usage: "Additional origins to include in origin_info",
+					},
+					cli.StringFlag{
+						Name:  "verification-bundle-key",
+						Usage: "Hex-encoded Ed25519 key of the issuer's signed verification bundle, verified before writing the origin",
+					},
+					cli.StringFlag{
+						Name:  "out, o",
+						Usage: "Origins configuration file to add the origin to, created if missing; the origin is printed if unset",
+					},
+					cli.StringSliceFlag{
+						Name:  "admin-hmac-key",
+						Usage: "<key-id>:<hex key> of the issuer admin API, to register the origin with the issuer",
+					},
+					cli.StringFlag{
+						Name:  "issuer-admin",
+						Usage: "Admin API of the issuer if not served by the issuer itself, e.g., https://issuer.example:4570",
+					},
+					cli.DurationFlag{
+						Name:  "timeout",
+						Value: 30 * time.Second,
+						Usage: "Timeout of each request to the issuer",
+					},
+				},
+			},
+		},
+		Flags: append([]cli.Flag{
+			recordFlag,
+			cli.StringSliceFlag{
+				Name:  "cert, c",
+				Usage: "TLS certificate file, may be repeated for multiple hostnames",
+			},
+			cli.StringSliceFlag{
+				Name:  "key, k",
+				Usage: "TLS private key file, one per --cert in the same order",
 			},
 			cli.StringFlag{
-				Name:     "key, k",
-				Value:    "",
-				Required: true,
+				Name:  "cert-dir",
+				Usage: "Directory of <name>.pem and <name>-key.pem pairs, selected by SNI",
 			},
 			cli.StringFlag{
 				Name:  "port",
 				Value: "443",
 			},
+			cli.StringSliceFlag{
+				Name:  "issuer",
+				Usage: "Issuer name, required unless every origin in --config sets one. May be repeated to challenge for several issuers in turn",
+			},
+			cli.StringSliceFlag{
+				Name:  "issuer-route",
+				Usage: "Challenge for one of several issuers under a path, as <path prefix>=<issuer>. May be repeated",
+			},
 			cli.StringFlag{
-				Name:     "issuer",
-				Value:    "",
-				Required: true,
+				Name:  "name",
+				Value: "",
+				Usage: "Origin name, required unless --config declares origins",
 			},
 			cli.StringFlag{
-				Name:     "name",
-				Value:    "",
-				Required: true,
+				Name:  "config",
+				Usage: "JSON or YAML file setting flags of this command, overridden by flags on the command line, and declaring origins served by this process, routed by Host",
+			},
+			cli.BoolFlag{
+				Name:  "self-test",
+				Usage: "Check the issuer keys and epoch challenges before serving, refusing to start if a check fails",
+			},
+			cli.BoolFlag{
+				Name:  "demo",
+				Usage: "Run on a demo clock that the admin API can move, for demos and integration tests only",
 			},
 			cli.StringFlag{
 				Name:  "log",
 				Value: "error",
 			},
+			cli.BoolFlag{
+				Name:  "http3",
+				Usage: "Also serve HTTP/3 over QUIC on the same port",
+			},
+			cli.BoolFlag{
+				Name:  "h2c",
+				Usage: "Serve HTTP/2 and HTTP/1.1 in cleartext (h2c) instead of TLS, e.g., behind a proxy terminating TLS",
+			},
+			cli.BoolFlag{
+				Name:  "issuer-h2c",
+				Usage: "Speak HTTP/2 in cleartext (h2c) to issuers",
+			},
+			cli.StringFlag{
+				Name:  "user-agent",
+				Usage: "User-Agent of requests to issuers, Go's default if unset",
+			},
+			cli.StringSliceFlag{
+				Name:  "issuer-header",
+				Usage: "'<name>: <value>' header sent with every request to issuers, e.g., an API key of a hosted issuer, may be repeated",
+			},
+			cli.StringSliceFlag{
+				Name:  "trusted-proxies",
+				Usage: "CIDRs of proxies whose Forwarded and X-Forwarded-For headers give the client address, may be repeated",
+			},
 			cli.StringSliceFlag{
 				Name:  "origin-info",
 				Usage: "Additional origins to include in origin_info",
 			},
-		},
+			cli.StringFlag{
+				Name:  "redemption-hook",
+				Usage: "WASM module invoked after token verification to allow, deny, or tag redemptions",
+			},
+			cli.StringFlag{
+				Name:  "challenge-rules",
+				Usage: "JSON file of rules deciding per path and client which requests need tokens, of which type, and with which challenge",
+			},
+			cli.StringFlag{
+				Name:  "admin-token",
+				Usage: "Bearer token enabling the admin API under /admin/",
+			},
+			cli.StringFlag{
+				Name:  "verification",
+				Value: "local",
+				Usage: "Where tokens are verified ['local', 'remote'], remote delegates to the issuer",
+			},
+			cli.DurationFlag{
+				Name:  "verification-cache-ttl",
+				Value: time.Minute,
+				Usage: "Time remote verification results are cached, 0 to disable",
+			},
+			cli.IntFlag{
+				Name:  "verification-workers",
+				Usage: "Tokens verified concurrently in batches of the admin API, GOMAXPROCS if 0",
+			},
+			cli.StringFlag{
+				Name:  "verification-bundle-key",
+				Usage: "Hex-encoded Ed25519 key of the issuer's signed verification bundle, the only source of token keys if set",
+			},
+			cli.StringFlag{
+				Name:  "verification-failure",
+				Value: "deny",
+				Usage: "Outcome when the issuer cannot verify a token ['deny', 'allow']",
+			},
+			cli.StringFlag{
+				Name:  "epoch-challenge-key",
+				Usage: "Hex-encoded key shared by replicas to derive non-interactive challenges per epoch",
+			},
+			cli.StringFlag{
+				Name:  "challenge-signing-key",
+				Usage: "Hex-encoded key shared by replicas to sign interactive challenges with their expiry instead of storing them",
+			},
+			cli.DurationFlag{
+				Name:  "epoch-length",
+				Value: time.Hour,
+				Usage: "Lifetime of epoch-derived challenges",
+			},
+			cli.DurationFlag{
+				Name:  "issuer-refresh-interval",
+				Value: 10 * time.Minute,
+				Usage: "How often to re-fetch the issuer directory and encapsulation key",
+			},
+			cli.BoolTFlag{
+				Name:  "compress",
+				Usage: "Compress resources with gzip or brotli when the client accepts it and upstream did not",
+			},
+			cli.IntFlag{
+				Name:  "max-challenges-per-context",
+				Value: defaultMaxContextChallenges,
+				Usage: "Outstanding challenges kept per challenge context, further ones are not redeemable",
+			},
+			cli.StringFlag{
+				Name:  "unknown-auth-params",
+				Value: unknownAuthParamsIgnore,
+				Usage: "What to do about unknown PrivateToken Authorization parameters ['ignore', 'reject']",
+			},
+			cli.IntFlag{
+				Name:  "nonce-length",
+				Value: challengeNonceLength,
+				Usage: "Length of challenge redemption nonces in bytes, at most 32",
+			},
+			cli.StringFlag{
+				Name:  "nonce-source",
+				Value: nonceSourceSystem,
+				Usage: "Source of challenge nonces ['system', 'file:<path>', 'seed:<hex>'], seeded nonces are predictable and only meant for test vectors",
+			},
+			cli.DurationFlag{
+				Name:  "clock-skew",
+				Value: defaultClockSkew,
+				Usage: "Clock skew tolerated against the issuer and replicas when checking epochs and verification bundles",
+			},
+			cli.StringFlag{
+				Name:  "challenge-store",
+				Value: storeMemory,
+				Usage: "Where outstanding challenges are kept ['memory', 'bolt:<file>', 'redis://<host>:<port>/<db>', 'redis+cluster://<host>:<port>', 'redis+sentinel://<host>:<port>/<db>?master=<name>']",
+			},
+			cli.DurationFlag{
+				Name:  "challenge-ttl",
+				Value: defaultChallengeTTL,
+				Usage: "Lifetime of outstanding challenges, also sent as their max-age",
+			},
+			cli.StringFlag{
+				Name:  "spent-token-store",
+				Value: storeMemory,
+				Usage: "Where admitted tokens are kept to refuse replays ['memory', 'bolt:<file>', 'redis://<host>:<port>/<db>', 'redis+cluster://<host>:<port>', 'redis+sentinel://<host>:<port>/<db>?master=<name>']",
+			},
+			cli.DurationFlag{
+				Name:  "spent-token-retention",
+				Usage: "How long admitted tokens are kept, by default as long as their challenges can be matched",
+			},
+			cli.StringFlag{
+				Name:  "private-token-key",
+				Usage: "File with the issuer's hex-encoded VOPRF key to verify private tokens (type 0x0001) locally, which are otherwise only offered with remote verification",
+			},
+			cli.BoolFlag{
+				Name:  "early-hints",
+				Usage: "Send challenges and an issuer preconnect hint in a 103 Early Hints response ahead of the 401",
+			},
+			cli.StringSliceFlag{
+				Name:  "cors-origin",
+				Usage: "Origin allowed to fetch protected resources from browsers, as scheme://host[:port] or * for any; may be repeated",
+			},
+			cli.StringFlag{
+				Name:  "serve-dir",
+				Usage: "Directory to serve protected resources from once their token verifies, instead of the test resource",
+			},
+			cli.StringFlag{
+				Name:  "proxy-upstream",
+				Usage: "URL to reverse-proxy protected requests to once their token verifies, with their method, path, and headers, instead of the test resource",
+			},
+			cli.StringFlag{
+				Name:  "redirect-attester",
+				Usage: "Attester host to issue basic tokens through for browsers without PrivateToken support, which are redirected to a challenge page",
+			},
+			cli.StringSliceFlag{
+				Name:  "simulate-fault",
+				Usage: "Send broken challenges for client testing ['malformed-challenge', 'wrong-token-key', 'bogus-max-age'], never in production; may be repeated",
+			},
+			cli.Float64Flag{
+				Name:  "fault-probability",
+				Value: 1,
+				Usage: "Probability of each simulated fault being injected into a challenge",
+			},
+			cli.StringSliceFlag{
+				Name:  "outage-fallback",
+				Usage: "What to do with redemptions under a path prefix when tokens cannot be verified, as <path prefix>=<action> ['open', 'closed'], other paths follow --verification-failure",
+			},
+			cli.DurationFlag{
+				Name:  "outage-stale-threshold",
+				Usage: "Age of the last fetched issuer directory beyond which tokens count as unverifiable, 0 to never",
+			},
+			cli.StringFlag{
+				Name:  "directory-path",
+				Usage: "Path the issuer directory is served at for clients that only reach the origin, e.g., /.well-known/private-token-issuer-directory, empty not to serve it",
+			},
+			cli.DurationFlag{
+				Name:  "directory-cache-ttl",
+				Value: defaultDirectoryCacheTTL,
+				Usage: "Time the served issuer directory is fresh, after which it is served stale while revalidated, 0 to fetch it on every request",
+			},
+			cli.DurationFlag{
+				Name:  "redemption-cache-ttl",
+				Value: defaultRedemptionCacheTTL,
+				Usage: "Time the outcome of a redemption is replayed to clients retrying with the same token, 0 to disable",
+			},
+			cli.DurationFlag{
+				Name:  "failed-token-cache-ttl",
+				Value: 10 * time.Second,
+				Usage: "Time tokens that failed verification are refused without verifying them again, 0 to disable",
+			},
+		}, serverFlags...),
 	},
 	{
 		Name:   "fetch",
 		Usage:  "Fetch a resource protected using PAT",
 		Action: runClientFetch,
+		Before: recordTranscript,
 		Flags: []cli.Flag{
+			configFileFlag,
+			recordFlag,
 			cli.StringFlag{
 				Name:  "id",
 				Value: "default",
 			},
 			cli.StringFlag{
-				Name:     "origin",
-				Value:    "",
-				Required: true,
+				Name:  "origin",
+				Value: "",
 			},
 			cli.StringFlag{
 				Name:  "secret",
 				Value: "",
 			},
 			cli.StringFlag{
-				Name:     "attester",
-				Value:    "",
-				Required: true,
+				Name:  "attester",
+				Value: "",
 			},
 			cli.StringFlag{
 				Name:  "resource",
@@ -138,6 +696,14 @@ var Commands = []cli.Command{
 				Name:  "count",
 				Value: 1,
 			},
+			cli.IntFlag{
+				Name:  "batch",
+				Usage: "Fetch private tokens in batches of this size, keeping the spare tokens in the store for later challenges with the same context",
+			},
+			cli.IntFlag{
+				Name:  "prefetch",
+				Usage: "Fetch this many tokens at once for non-interactive challenges, keeping the spare tokens in the store for later requests, 0 to disable",
+			},
 			cli.BoolFlag{
 				Name:  "non-interactive",
 				Usage: "Flag to request non-interactive tokens",
@@ -148,41 +714,487 @@ var Commands = []cli.Command{
 			},
 			cli.StringFlag{
 				Name:  "token-type",
-				Usage: "Type of token protocol requested ['basic', 'rate-limited'], defaults to 'rate-limited'",
+				Usage: "Type of token protocol requested ['basic', 'rate-limited', 'private', 'ed25519'], defaults to 'rate-limited'",
+			},
+			cli.StringFlag{
+				Name:  "emulate",
+				Usage: "Client behavior to emulate ['default', 'ios'], defaults to 'default'",
+			},
+			cli.StringFlag{
+				Name:  "log",
+				Value: "error",
+			},
+			cli.BoolFlag{
+				Name:  "http3",
+				Usage: "Speak HTTP/3 over QUIC to the origin, attester, and issuer",
+			},
+			cli.BoolFlag{
+				Name:  "h2c",
+				Usage: "Speak HTTP/2 in cleartext (h2c) to the origin, attester, and issuer",
+			},
+			cli.BoolFlag{
+				Name:  "ohttp",
+				Usage: "Tunnel basic, private, and Ed25519 token requests to the issuer over Oblivious HTTP, through the attester's relay",
+			},
+			cli.StringFlag{
+				Name:  "attestation",
+				Usage: "Attestation evidence presented to the attester as format=file ['api-key', 'totp', 'device-statement'] with the credential",
+			},
+			cli.StringFlag{
+				Name:  "receipt-log",
+				Usage: "File to append the attester's issuance receipts to as JSON lines, '-' for stdout",
+			},
+			cli.StringFlag{
+				Name:  "receipt-key",
+				Usage: "Hex-encoded Ed25519 public key of the attester verifying logged issuance receipts",
+			},
+			cli.StringFlag{
+				Name:  "client-key",
+				Usage: "Client key file from `pat-app keygen client` used for rate-limited tokens, instead of one derived from --secret",
+			},
+		},
+	},
+	{
+		Name:      "client",
+		Usage:     "Fetch a protected resource end to end: answer the origin's challenge with a token issued through the attester, redeem it, and print the resource",
+		ArgsUsage: "<url>",
+		Action:    runClient,
+		Before:    recordTranscript,
+		Flags: []cli.Flag{
+			configFileFlag,
+			recordFlag,
+			cli.StringFlag{
+				Name:  "id",
+				Value: "default",
+			},
+			cli.StringFlag{
+				Name:  "secret",
+				Usage: "Hex-encoded client secret the rate-limited client and its anonymous origin IDs derive from",
+			},
+			cli.StringFlag{
+				Name:  "attester",
+				Usage: "Attester host to request tokens through",
+			},
+			cli.StringFlag{
+				Name:  "token-type",
+				Usage: "Type of token protocol requested ['basic', 'rate-limited', 'private', 'ed25519'], defaults to the origin's first challenge",
+			},
+			cli.BoolFlag{
+				Name:  "non-interactive",
+				Usage: "Flag to request non-interactive tokens",
+			},
+			cli.BoolFlag{
+				Name:  "cross-origin",
+				Usage: "Flag to request cross-origin tokens",
+			},
+			cli.StringFlag{
+				Name:  "client-key",
+				Usage: "Client key file from `pat-app keygen client` used for rate-limited tokens, instead of one derived from --secret",
+			},
+			cli.StringFlag{
+				Name:  "store",
+				Usage: "Token store file prefetched tokens are kept in across runs",
+			},
+			cli.IntFlag{
+				Name:  "prefetch",
+				Usage: "Fetch this many tokens at once for non-interactive challenges, keeping the spare tokens in the store for later requests, 0 to disable",
+			},
+			cli.BoolFlag{
+				Name:  "include, i",
+				Usage: "Print the status line and headers of the final response before the resource",
+			},
+			cli.StringFlag{
+				Name:  "emulate",
+				Usage: "Client behavior to emulate ['default', 'ios'], defaults to 'default'",
+			},
+			cli.StringFlag{
+				Name:  "log",
+				Value: "error",
+			},
+			cli.BoolFlag{
+				Name:  "http3",
+				Usage: "Speak HTTP/3 over QUIC to the origin, attester, and issuer",
+			},
+			cli.BoolFlag{
+				Name:  "h2c",
+				Usage: "Speak HTTP/2 in cleartext (h2c) to the origin, attester, and issuer",
+			},
+			cli.BoolFlag{
+				Name:  "ohttp",
+				Usage: "Tunnel basic, private, and Ed25519 token requests to the issuer over Oblivious HTTP, through the attester's relay",
+			},
+			cli.StringFlag{
+				Name:  "attestation",
+				Usage: "Attestation evidence presented to the attester as format=file ['api-key', 'totp', 'device-statement'] with the credential",
+			},
+		},
+	},
+	{
+		Name:   "redeem",
+		Usage:  "Redeem an existing token at any origin and report its verdict",
+		Action: runClientRedeem,
+		Before: recordTranscript,
+		Flags: []cli.Flag{
+			configFileFlag,
+			recordFlag,
+			cli.StringFlag{
+				Name:  "origin",
+				Usage: "Origin host, or URL of the resource to redeem the token for",
+			},
+			cli.StringFlag{
+				Name:  "resource",
+				Usage: "Resource to request, resolved against --origin, defaults to the origin URL or '/'",
+			},
+			cli.StringFlag{
+				Name:  "token",
+				Usage: "File holding the token in base64url, hex, or binary, or a token store from `fetch --store`",
+			},
+			cli.StringFlag{
+				Name:  "extensions",
+				Usage: "Base64url-encoded extensions sent with the token",
+			},
+			cli.StringFlag{
+				Name:  "emulate",
+				Usage: "Client behavior to emulate ['default', 'ios'], defaults to 'default'",
+			},
+			cli.StringFlag{
+				Name:  "log",
+				Value: "error",
+			},
+			cli.BoolFlag{
+				Name:  "http3",
+				Usage: "Speak HTTP/3 over QUIC to the origin",
+			},
+			cli.BoolFlag{
+				Name:  "h2c",
+				Usage: "Speak HTTP/2 in cleartext (h2c) to the origin",
+			},
+		},
+	},
+	{
+		Name:   "scenario",
+		Usage:  "Run a YAML scenario of challenges, issuances, redemptions, and malformed sends against an origin",
+		Action: runClientScenario,
+		Before: recordTranscript,
+		Flags: []cli.Flag{
+			configFileFlag,
+			recordFlag,
+			cli.StringFlag{
+				Name:  "file, f",
+				Usage: "Scenario file",
+			},
+			cli.StringFlag{
+				Name:  "origin",
+				Usage: "Origin to run against, overriding the scenario's",
+			},
+			cli.StringFlag{
+				Name:  "attester",
+				Usage: "Attester to fetch tokens from, overriding the scenario's",
+			},
+			cli.StringFlag{
+				Name:  "secret",
+				Usage: "Hex-encoded client secret, defaults to a random one",
+			},
+			cli.StringFlag{
+				Name:  "id",
+				Value: "default",
 			},
 			cli.StringFlag{
 				Name:  "log",
 				Value: "error",
 			},
+			cli.BoolFlag{
+				Name:  "http3",
+				Usage: "Speak HTTP/3 over QUIC to the origin, attester, and issuer",
+			},
+			cli.BoolFlag{
+				Name:  "h2c",
+				Usage: "Speak HTTP/2 in cleartext (h2c) to the origin, attester, and issuer",
+			},
+		},
+	},
+	{
+		Name:  "keygen",
+		Usage: "Generate key material",
+		Subcommands: []cli.Command{
+			{
+				Name:   "client",
+				Usage:  "Generate (or rotate) a client key and blinds for rate-limited issuance",
+				Action: runKeygenClient,
+				Before: applyConfigFile,
+				Flags: []cli.Flag{
+					configFileFlag,
+					cli.StringFlag{
+						Name:  "out, o",
+						Value: "client.key",
+						Usage: "Client key file to write, or to rotate in place",
+					},
+					cli.StringFlag{
+						Name:  "id",
+						Value: "default",
+						Usage: "Client ID the key is registered for",
+					},
+					cli.IntFlag{
+						Name:  "blinds",
+						Value: defaultClientKeyBlinds,
+						Usage: "Number of request blinds to generate",
+					},
+					cli.StringFlag{
+						Name:  "attester",
+						Usage: "Attester to register the key with",
+					},
+					cli.BoolFlag{
+						Name:  "rotate",
+						Usage: "Replace the key in --out, registering the new key under the old one",
+					},
+				},
+			},
 		},
 	},
 	{
 		Name:   "test",
 		Usage:  "Run through test cases for all possible token challenges",
 		Action: runRunner,
+		Before: recordTranscript,
 		Flags: []cli.Flag{
+			configFileFlag,
+			recordFlag,
 			cli.StringFlag{
 				Name:  "id",
 				Value: "default",
 			},
 			cli.StringFlag{
-				Name:     "origin",
-				Value:    "",
-				Required: true,
+				Name:  "origin",
+				Value: "",
 			},
 			cli.StringFlag{
 				Name:  "secret",
 				Value: "",
 			},
 			cli.StringFlag{
-				Name:     "attester",
-				Value:    "",
-				Required: true,
+				Name:  "attester",
+				Value: "",
+			},
+			cli.StringFlag{
+				Name:  "resource",
+				Value: "/index.html",
+			},
+		},
+	},
+	{
+		Name:   "loadgen",
+		Usage:  "Run concurrent issuance and redemption flows against an origin, attester, and issuer, and report latency percentiles and errors",
+		Action: runLoadgenCommand,
+		Before: applyConfigFile,
+		Flags: []cli.Flag{
+			configFileFlag,
+			cli.StringFlag{
+				Name:  "origin",
+				Usage: "Origin to load, e.g., origin.example:4568",
+			},
+			cli.StringFlag{
+				Name:  "resource",
+				Value: "/index.html",
+			},
+			cli.StringFlag{
+				Name:  "secret",
+				Usage: "Hex-encoded client secret the rate-limited client and its anonymous origin IDs derive from",
+			},
+			cli.StringFlag{
+				Name:  "attester",
+				Usage: "Attester host to request tokens through",
+			},
+			cli.StringFlag{
+				Name:  "id",
+				Value: "default",
+			},
+			cli.DurationFlag{
+				Name:  "duration",
+				Value: time.Minute,
+			},
+			cli.IntFlag{
+				Name:  "concurrency",
+				Value: 4,
+				Usage: "Flows in flight at most",
+			},
+			cli.Int64Flag{
+				Name:  "requests",
+				Usage: "Flows to run at most within the duration, 0 for no limit",
+			},
+			cli.StringFlag{
+				Name:  "mix",
+				Value: defaultLoadgenMix,
+				Usage: "Weights of token types ['basic', 'rate-limited', 'private', 'ed25519']",
+			},
+			cli.BoolFlag{
+				Name:  "non-interactive",
+				Usage: "Flag to request non-interactive tokens",
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Value: 30 * time.Second,
+				Usage: "Timeout of each request",
+			},
+			cli.StringFlag{
+				Name:  "attestation",
+				Usage: "Attestation evidence presented to the attester as format=file ['api-key', 'totp', 'device-statement'] with the credential",
+			},
+			cli.BoolFlag{
+				Name:  "http3",
+				Usage: "Speak HTTP/3 over QUIC to the origin, attester, and issuer",
+			},
+			cli.BoolFlag{
+				Name:  "h2c",
+				Usage: "Speak HTTP/2 in cleartext (h2c) to the origin, attester, and issuer",
+			},
+			cli.StringFlag{
+				Name:  "log",
+				Value: "error",
+			},
+		},
+	},
+	{
+		Name:   "soak",
+		Usage:  "Redeem a mixture of valid and invalid tokens against an origin for hours, checking its resource usage stays bounded",
+		Action: runSoak,
+		Before: recordTranscript,
+		Flags: []cli.Flag{
+			configFileFlag,
+			recordFlag,
+			cli.StringFlag{
+				Name: "origin",
+			},
+			cli.StringFlag{
+				Name:  "resource",
+				Value: "/index.html",
+			},
+			cli.DurationFlag{
+				Name:  "duration",
+				Value: time.Hour,
+			},
+			cli.Float64Flag{
+				Name:  "rate",
+				Value: 10,
+				Usage: "Redemptions per second",
+			},
+			cli.IntFlag{
+				Name:  "concurrency",
+				Value: 4,
+				Usage: "Redemptions in flight at most",
+			},
+			cli.StringFlag{
+				Name:  "mix",
+				Value: defaultSoakMix,
+				Usage: "Weights of redemption kinds ['valid', 'expired', 'replayed', 'malformed']",
+			},
+			cli.StringFlag{
+				Name:  "metrics",
+				Usage: "URL of the origin metrics, defaults to its admin API at /admin/metrics",
+			},
+			cli.StringFlag{
+				Name:  "admin-token",
+				Usage: "Bearer token of the origin admin API",
+			},
+			cli.DurationFlag{
+				Name:  "scrape-interval",
+				Value: time.Minute,
+			},
+			cli.DurationFlag{
+				Name:  "warmup",
+				Value: 5 * time.Minute,
+				Usage: "Time after which the metrics baseline is taken",
+			},
+			cli.Float64Flag{
+				Name:  "max-growth",
+				Value: 2,
+				Usage: "Factor over the baseline that goroutines, heap, and outstanding challenges may grow by",
+			},
+			cli.StringFlag{
+				Name:  "log",
+				Value: "error",
+			},
+		},
+	},
+	{
+		Name:   "bench",
+		Usage:  "Time how long challenges take to reach clients, in 103 Early Hints and in the final response",
+		Action: runBench,
+		Before: recordTranscript,
+		Flags: []cli.Flag{
+			configFileFlag,
+			recordFlag,
+			cli.StringFlag{
+				Name: "origin",
 			},
 			cli.StringFlag{
 				Name:  "resource",
 				Value: "/index.html",
 			},
+			cli.IntFlag{
+				Name:  "requests",
+				Value: 100,
+			},
+			cli.StringFlag{
+				Name:  "log",
+				Value: "error",
+			},
+		},
+	},
+	{
+		Name:  "vectors",
+		Usage: "Check wire formats against golden vectors pinned to draft versions",
+		Subcommands: []cli.Command{
+			{
+				Name:   "verify",
+				Usage:  "Serialize and parse the TokenChallenge, TokenRequest, and Token vectors, failing on any byte that differs",
+				Action: runVectorsVerify,
+				Flags: []cli.Flag{
+					cli.StringSliceFlag{
+						Name:  "draft",
+						Usage: "Draft version whose vectors to verify, may be repeated, all by default",
+					},
+					cli.StringSliceFlag{
+						Name:  "file, f",
+						Usage: "Vector file to verify instead of the built-in ones, may be repeated",
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:      "verify-vectors",
+		Usage:     "Replay transcripts recorded with --record offline, checking the encoding of every message and the authenticators of tokens",
+		ArgsUsage: "<transcript>...",
+		Action:    runVerifyVectors,
+	},
+	{
+		Name:   "support-bundle",
+		Usage:  "Collect redacted configuration, metrics, profiles, and state summaries of a running role into an archive",
+		Action: runSupportBundle,
+		Before: applyConfigFile,
+		Flags: []cli.Flag{
+			configFileFlag,
+			cli.StringFlag{
+				Name:  "target",
+				Usage: "Admin API of the role, e.g., origin.example:4568 or https://origin.example:4568",
+			},
+			cli.StringFlag{
+				Name:  "admin-token",
+				Usage: "Bearer token of the admin API",
+			},
+			cli.StringSliceFlag{
+				Name:  "admin-hmac-key",
+				Usage: "<key-id>:<hex key> signing admin requests instead of a bearer token, e.g., for the issuer",
+			},
+			cli.StringFlag{
+				Name:  "out, o",
+				Usage: "Archive to write, pat-support-<time>.tar.gz by default",
+			},
+			cli.DurationFlag{
+				Name:  "timeout",
+				Value: 30 * time.Second,
+				Usage: "Timeout of each admin request",
+			},
 		},
 	},
 }
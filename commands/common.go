@@ -1,12 +1,17 @@
 package commands
 
 import (
-	"encoding/base64"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"strings"
+
+	"github.com/cloudflare/pat-app/structuredfield"
 )
 
 var (
@@ -36,15 +41,40 @@ func composeURL(host, uri string) (string, error) {
 }
 
 func marshalStructuredBinary(data []byte) string {
-	return ":" + base64.StdEncoding.EncodeToString(data) + ":"
+	return structuredfield.MarshalBinary(data)
 }
 
 func unmarshalStructuredBinary(data string) ([]byte, error) {
-	if strings.Index(data, ":") != 0 {
-		return nil, ErrInvalidBinaryHeader
+	value, err := structuredfield.ParseBinary(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBinaryHeader, err)
+	}
+	return value, nil
+}
+
+// parseEd25519PublicKey decodes a hex-encoded Ed25519 public key.
+func parseEd25519PublicKey(keyHex string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(keyHex)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Invalid Ed25519 public key, expected %d hex-encoded bytes", ed25519.PublicKeySize)
+	}
+	return key, nil
+}
+
+// loadEd25519SigningKey reads a hex-encoded Ed25519 seed from the file, or
+// generates a key if the file name is empty.
+func loadEd25519SigningKey(fileName string) (ed25519.PrivateKey, error) {
+	if fileName == "" {
+		_, key, err := ed25519.GenerateKey(nil)
+		return key, err
+	}
+	seedHex, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
 	}
-	if strings.LastIndex(data, ":") != (len(data) - 1) {
-		return nil, ErrInvalidBinaryHeader
+	seed, err := hex.DecodeString(string(bytes.TrimSpace(seedHex)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Invalid Ed25519 signing key, expected %d hex-encoded bytes", ed25519.SeedSize)
 	}
-	return base64.StdEncoding.DecodeString(data[1 : len(data)-1])
+	return ed25519.NewKeyFromSeed(seed), nil
 }
@@ -0,0 +1,227 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var (
+	// Roles that may run in the process of another, by the role running them
+	composableRoles = map[string][]string{
+		"origin":   {"issuer"},
+		"attester": {"issuer"},
+	}
+
+	// Address of the peer of requests dispatched in memory
+	localRemoteAddr = "127.0.0.1:0"
+
+	// localRoles holds the handlers of the roles this process runs
+	localRoles = newLocalDispatcher()
+
+	// Commands by name, to start composed roles with. Filled in once
+	// Commands is initialized, since it refers to the roles composing others.
+	composedCommands = make(map[string]cli.Command)
+)
+
+func init() {
+	for _, command := range Commands {
+		composedCommands[command.Name] = command
+	}
+}
+
+// localDispatcher holds the handlers of the roles running in this process by
+// host name, so that other roles of the process reach them in memory rather
+// than through loopback HTTP.
+type localDispatcher struct {
+	lock     sync.Mutex
+	handlers map[string]http.Handler // by host name
+	roles    map[string]bool         // that registered a handler
+	added    chan struct{}           // closed, and replaced, as handlers are added
+}
+
+func newLocalDispatcher() *localDispatcher {
+	return &localDispatcher{
+		handlers: make(map[string]http.Handler),
+		roles:    make(map[string]bool),
+		added:    make(chan struct{}),
+	}
+}
+
+// register serves requests for the host name with the handler of the role.
+func (d *localDispatcher) register(role, host string, handler http.Handler) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.handlers[host] = handler
+	d.roles[role] = true
+	close(d.added)
+	d.added = make(chan struct{})
+}
+
+func (d *localDispatcher) handler(host string) (http.Handler, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	handler, ok := d.handlers[host]
+	return handler, ok
+}
+
+// wait returns once the role registered its handler, or with an error once
+// ctx is done.
+func (d *localDispatcher) wait(ctx context.Context, role string) error {
+	for {
+		d.lock.Lock()
+		registered, added := d.roles[role], d.added
+		d.lock.Unlock()
+		if registered {
+			return nil
+		}
+		select {
+		case <-added:
+		case <-ctx.Done():
+			return fmt.Errorf("The %s did not start: %w", role, ctx.Err())
+		}
+	}
+}
+
+// localTransport dispatches requests for the roles of the process to their
+// handlers in memory, and sends others with base.
+type localTransport struct {
+	base       http.RoundTripper
+	dispatcher *localDispatcher
+}
+
+func (t *localTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	handler, ok := t.dispatcher.handler(req.URL.Hostname())
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	serverReq := req.Clone(req.Context())
+	serverReq.RequestURI = req.URL.RequestURI()
+	serverReq.RemoteAddr = localRemoteAddr
+	if serverReq.Host == "" {
+		serverReq.Host = req.URL.Host
+	}
+	if serverReq.Body == nil {
+		serverReq.Body = http.NoBody
+	}
+	w := &localResponseWriter{header: make(http.Header)}
+	handler.ServeHTTP(w, serverReq)
+	return w.response(req), nil
+}
+
+// localResponseWriter buffers the response of a handler dispatched to in
+// memory.
+type localResponseWriter struct {
+	header      http.Header
+	sent        http.Header // header as of WriteHeader
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (w *localResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *localResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	w.sent = w.header.Clone()
+}
+
+func (w *localResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
+
+// Flush does nothing, since the response is buffered anyway.
+func (w *localResponseWriter) Flush() {}
+
+func (w *localResponseWriter) response(req *http.Request) *http.Response {
+	w.WriteHeader(http.StatusOK)
+	return &http.Response{
+		Status:        strconv.Itoa(w.status) + " " + http.StatusText(w.status),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.sent,
+		Body:          ioutil.NopCloser(bytes.NewReader(w.body.Bytes())),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}
+}
+
+// withLocalRoles returns a client reaching the roles of the process in
+// memory, and other hosts like the client does.
+func withLocalRoles(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	withLocal := *client
+	withLocal.Transport = &localTransport{base: base, dispatcher: localRoles}
+	return &withLocal
+}
+
+// startComposedRoles starts the roles the configuration file of the role
+// composes with it, each with its own configuration file, and returns once
+// they are ready to be dispatched to.
+func startComposedRoles(ctx context.Context, c *cli.Context, role string) error {
+	configFile := c.String("config")
+	if configFile == "" {
+		return nil
+	}
+	config, err := readCommandConfig(configFile)
+	if err != nil {
+		return err
+	}
+	composed := make([]string, 0, len(config.Compose))
+	for composedRole, composedConfig := range config.Compose {
+		composable := false
+		for _, other := range composableRoles[role] {
+			composable = composable || other == composedRole
+		}
+		if !composable {
+			return fmt.Errorf("Invalid composed role %s, the %s runs %v", composedRole, role, composableRoles[role])
+		}
+		if composedConfig == "" {
+			return fmt.Errorf("Invalid composed role %s, missing its configuration file", composedRole)
+		}
+		composed = append(composed, composedRole)
+	}
+	sort.Strings(composed)
+
+	for _, composedRole := range composed {
+		command, ok := composedCommands[composedRole]
+		if !ok {
+			return fmt.Errorf("Unknown role %s", composedRole)
+		}
+		args := []string{"pat-app", composedRole, "--config", config.Compose[composedRole], "--log", c.String("log")}
+		log.Infoln("Starting the", composedRole, "in the", role, "process with", config.Compose[composedRole])
+		app := cli.App{Name: "pat-app", Commands: []cli.Command{command}, HideVersion: true}
+		if c.App != nil {
+			app.Version = c.App.Version
+		}
+		go func(composedRole string) {
+			if err := app.Run(args); err != nil {
+				log.Fatalf("The composed %s failed: %v", composedRole, err)
+			}
+		}(composedRole)
+		if err := localRoles.wait(ctx, composedRole); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalTransport(t *testing.T) {
+	dispatcher := newLocalDispatcher()
+	base := &recordingTransport{}
+	client := &http.Client{Transport: &localTransport{base: base, dispatcher: dispatcher}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := dispatcher.wait(ctx, "issuer"); err == nil {
+		t.Fatal("expected waiting for a role that never starts to fail")
+	}
+
+	var remoteAddr string
+	dispatcher.register("issuer", "issuer.example", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		remoteAddr = req.RemoteAddr
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", tokenResponseMediaType)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(append(body, []byte(req.URL.Path)...))
+		w.Header().Set("X-Too-Late", "true")
+	}))
+	if err := dispatcher.wait(context.Background(), "issuer"); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Post("https://issuer.example:4567"+tokenRequestURI, tokenRequestMediaType, strings.NewReader("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusCreated || string(body) != "request"+tokenRequestURI || resp.Header.Get("Content-Type") != tokenResponseMediaType {
+		t.Fatalf("unexpected response %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Too-Late") != "" || remoteAddr != localRemoteAddr || len(base.requests) != 0 {
+		t.Fatal("expected the request to be dispatched in memory")
+	}
+
+	// Other hosts are reached over the network
+	if _, err := client.Get("https://origin.example/"); err != nil || len(base.requests) != 1 {
+		t.Fatal("expected other hosts to be reached with the base transport")
+	}
+}
+
+func TestStartComposedRoles(t *testing.T) {
+	configFile := writeTestConfigFile(t, "attester.yaml", "compose:\n  origin: origin.yaml\n")
+	c := testCommandContext(t, "attester", "--config", configFile)
+	if err := startComposedRoles(context.Background(), c, "attester"); err == nil || !strings.Contains(err.Error(), "Invalid composed role origin") {
+		t.Fatalf("expected the attester to refuse running an origin, got %v", err)
+	}
+
+	configFile = writeTestConfigFile(t, "origin.yaml", "compose:\n  issuer: \"\"\n")
+	c = testCommandContext(t, "origin", "--config", configFile)
+	if err := startComposedRoles(context.Background(), c, "origin"); err == nil || !strings.Contains(err.Error(), "missing its configuration file") {
+		t.Fatalf("expected a composed role without configuration to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	adminConfigURI = adminURIPrefix + "config"
+
+	// Replaces secrets in configuration dumps
+	redactedValue = "REDACTED"
+)
+
+// secretFlags carry credentials or keys, as opposed to names of files
+// holding them, and are redacted wherever the configuration is shown.
+var secretFlags = map[string]bool{
+	"admin-token":           true,
+	"admin-hmac-key":        true,
+	"challenge-signing-key": true,
+	"epoch-challenge-key":   true,
+	"secret":                true,
+}
+
+// storeFlags name stores whose URLs may carry passwords.
+var storeFlags = map[string]bool{
+	"challenge-store":   true,
+	"spent-token-store": true,
+	"state-store":       true,
+}
+
+// effectiveConfig is what a role runs with: every flag after defaults, and
+// for origins their merged configuration, with secrets redacted.
+type effectiveConfig struct {
+	Role      string                 `json:"role"`
+	Version   string                 `json:"version,omitempty"`
+	Flags     map[string]interface{} `json:"flags"`
+	Overrides []string               `json:"overrides"` // flags set explicitly
+	Origins   []OriginConfig         `json:"origins,omitempty"`
+}
+
+// flagName returns the long name of a flag, without its aliases.
+func flagName(flag cli.Flag) string {
+	name, _, _ := strings.Cut(flag.GetName(), ",")
+	return strings.TrimSpace(name)
+}
+
+// commandFlags returns the flags of the command. Commands with subcommands
+// run as an app of their own, holding their flags.
+func commandFlags(c *cli.Context) []cli.Flag {
+	if len(c.Command.Flags) == 0 && c.App != nil {
+		return c.App.Flags
+	}
+	return c.Command.Flags
+}
+
+func effectiveConfigFromFlags(c *cli.Context, role string) effectiveConfig {
+	config := effectiveConfig{
+		Role:      role,
+		Flags:     make(map[string]interface{}),
+		Overrides: make([]string, 0),
+	}
+	if c.App != nil {
+		config.Version = c.App.Version
+	}
+	for _, flag := range commandFlags(c) {
+		name := flagName(flag)
+		if name == "print-config" || name == "help" {
+			continue
+		}
+		var value interface{}
+		switch flag.(type) {
+		case cli.StringFlag:
+			value = c.String(name)
+		case cli.StringSliceFlag:
+			value = c.StringSlice(name)
+		case cli.BoolFlag:
+			value = c.Bool(name)
+		case cli.BoolTFlag:
+			value = c.BoolT(name)
+		case cli.IntFlag:
+			value = c.Int(name)
+		case cli.Float64Flag:
+			value = c.Float64(name)
+		case cli.DurationFlag:
+			value = c.Duration(name).String()
+		default:
+			value = c.Generic(name)
+		}
+		config.Flags[name] = redactFlag(name, value)
+		if c.IsSet(name) {
+			config.Overrides = append(config.Overrides, name)
+		}
+	}
+	sort.Strings(config.Overrides)
+	return config
+}
+
+// redactFlag hides the secret in a flag value. HMAC keys keep their key ID,
+// issuer headers their name, and store URLs everything but their password.
+func redactFlag(name string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactFlagString(name, v)
+	case []string:
+		redacted := make([]string, len(v))
+		for i, s := range v {
+			redacted[i] = redactFlagString(name, s)
+		}
+		return redacted
+	}
+	return value
+}
+
+func redactFlagString(name, value string) string {
+	switch {
+	case value == "":
+		return value
+	case name == "admin-hmac-key":
+		keyID, _, _ := strings.Cut(value, ":")
+		return keyID + ":" + redactedValue
+	case name == "issuer-header":
+		return redactIssuerHeader(value)
+	case secretFlags[name]:
+		return redactedValue
+	case storeFlags[name] && redisScheme(value) != "":
+		return redactRedisURL(value)
+	}
+	return value
+}
+
+// redacted returns the configuration of an origin with its secrets hidden.
+func (cfg OriginConfig) redacted() OriginConfig {
+	cfg.AdminToken = redactFlagString("admin-token", cfg.AdminToken)
+	cfg.EpochChallengeKey = redactFlagString("epoch-challenge-key", cfg.EpochChallengeKey)
+	cfg.ChallengeSigningKey = redactFlagString("challenge-signing-key", cfg.ChallengeSigningKey)
+	cfg.ChallengeStore = redactFlagString("challenge-store", cfg.ChallengeStore)
+	cfg.SpentTokenStore = redactFlagString("spent-token-store", cfg.SpentTokenStore)
+	cfg.IssuerHeaders = redactFlag("issuer-header", cfg.IssuerHeaders).([]string)
+	return cfg
+}
+
+// withOrigins returns the configuration with the merged configuration of
+// the origins.
+func (config effectiveConfig) withOrigins(origins []OriginConfig) effectiveConfig {
+	config.Origins = make([]OriginConfig, len(origins))
+	for i, cfg := range origins {
+		config.Origins[i] = cfg.redacted()
+	}
+	return config
+}
+
+// printConfig writes the configuration for --print-config.
+func printConfig(w io.Writer, config effectiveConfig) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// logStartupBanner logs what the role starts with, so that logs of a run
+// show its configuration.
+func logStartupBanner(config effectiveConfig, port string) {
+	overrides := make([]string, len(config.Overrides))
+	for i, name := range config.Overrides {
+		overrides[i] = fmt.Sprintf("%s=%v", name, config.Flags[name])
+	}
+	log.Infof("Starting pat-app %s %s on port %s", config.Role, config.Version, port)
+	if len(overrides) > 0 {
+		log.Infoln("Configured with", strings.Join(overrides, " "))
+	}
+	for _, cfg := range config.Origins {
+		log.Infof("Origin %s: issuers %s, verification %s, challenge store %s", cfg.Name, strings.Join(cfg.issuerNames(), ", "), cfg.Verification, cfg.ChallengeStore)
+	}
+}
+
+// serveConfig adds the effective configuration to the admin API.
+func (s *adminServer) serveConfig(config effectiveConfig) {
+	s.handle(http.MethodGet, adminConfigURI, "Effective configuration, secrets redacted", nil, effectiveConfig{},
+		func(w http.ResponseWriter, req *http.Request) {
+			writeAdminJSON(w, config)
+		})
+}
@@ -0,0 +1,93 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// testCommandContext parses the arguments with the flags of a command.
+func testCommandContext(t *testing.T, name string, args ...string) *cli.Context {
+	for _, command := range Commands {
+		if command.Name != name {
+			continue
+		}
+		set := flag.NewFlagSet(name, flag.ContinueOnError)
+		for _, f := range command.Flags {
+			f.Apply(set)
+		}
+		if err := set.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		c := cli.NewContext(nil, set, nil)
+		c.Command = command
+		return c
+	}
+	t.Fatalf("no command %s", name)
+	return nil
+}
+
+func TestEffectiveConfigRedactsSecrets(t *testing.T) {
+	c := testCommandContext(t, "origin",
+		"--name", "origin.example",
+		"--admin-token", "hunter2",
+		"--epoch-challenge-key", "00112233445566778899aabbccddeeff",
+		"--challenge-store", "redis+sentinel://:hunter2@sentinel:26379/0?master=pat",
+		"--challenge-ttl", "20s")
+	config := effectiveConfigFromFlags(c, "origin")
+
+	if config.Flags["name"] != "origin.example" || config.Flags["challenge-ttl"] != "20s" || config.Flags["port"] == nil {
+		t.Fatalf("expected every flag with its effective value, got %+v", config.Flags)
+	}
+	if _, ok := config.Flags["print-config"]; ok {
+		t.Fatal("expected --print-config to be left out")
+	}
+	if strings.Join(config.Overrides, ",") != "admin-token,challenge-store,challenge-ttl,epoch-challenge-key,name" {
+		t.Fatalf("unexpected overrides %q", config.Overrides)
+	}
+
+	var out bytes.Buffer
+	if err := printConfig(&out, config.withOrigins([]OriginConfig{{Name: "origin.example", AdminToken: "hunter2", ChallengeStore: "redis://:hunter2@redis:6379/0"}})); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "hunter2") || strings.Contains(out.String(), "00112233") {
+		t.Fatalf("expected secrets to be redacted:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), `"admin-token": "REDACTED"`) || !strings.Contains(out.String(), "sentinel:26379") {
+		t.Fatalf("expected redacted values in place of secrets:\n%s", out.String())
+	}
+}
+
+func TestRedactHMACKeys(t *testing.T) {
+	c := testCommandContext(t, "issuer", "--admin-hmac-key", "ops:00112233", "--admin-hmac-key", "ci:44556677")
+	keys := effectiveConfigFromFlags(c, "issuer").Flags["admin-hmac-key"].([]string)
+	if strings.Join(keys, ",") != "ops:REDACTED,ci:REDACTED" {
+		t.Fatalf("expected key IDs without keys, got %q", keys)
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	admin := newAdminServer("origin", "secret")
+	admin.serveConfig(effectiveConfig{Role: "origin", Flags: map[string]interface{}{"port": "4568"}})
+
+	resp := httptest.NewRecorder()
+	admin.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, adminConfigURI, nil))
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the configuration to require authentication, got %d", resp.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, adminConfigURI, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp = httptest.NewRecorder()
+	admin.ServeHTTP(resp, req)
+	var config effectiveConfig
+	if err := json.Unmarshal(resp.Body.Bytes(), &config); err != nil || config.Role != "origin" || config.Flags["port"] != "4568" {
+		t.Fatalf("unexpected configuration %s: %v", resp.Body.String(), err)
+	}
+}
@@ -0,0 +1,215 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileFlag is the --config flag of every command. The origin command
+// declares it itself, since its file also declares origins.
+var configFileFlag = cli.StringFlag{
+	Name:  "config",
+	Usage: "JSON or YAML file setting flags of this command, overridden by flags on the command line",
+}
+
+// CommandConfig is the file given to any command with --config. Typed keys
+// cover what most deployments set, and flags holds any other flag of the
+// command by name. Flags on the command line take precedence over the file,
+// which takes precedence over flag defaults. Origins are only read by the
+// origin command, see OriginConfig.
+type CommandConfig struct {
+	Log      string                 `json:"log,omitempty"`
+	Port     string                 `json:"port,omitempty"`
+	TLS      *TLSFileConfig         `json:"tls,omitempty"`
+	Name     string                 `json:"name,omitempty"`
+	Issuer   string                 `json:"issuer,omitempty"`
+	Attester string                 `json:"attester,omitempty"`
+	Origin   string                 `json:"origin,omitempty"`
+	Tokens   *TokensFileConfig      `json:"tokens,omitempty"`
+	Stores   *StoresFileConfig      `json:"stores,omitempty"`
+	Outbound *OutboundFileConfig    `json:"outbound,omitempty"`
+	Flags    map[string]interface{} `json:"flags,omitempty"`
+	Origins  []OriginConfig         `json:"origins,omitempty"`
+	Compose  map[string]string      `json:"compose,omitempty"` // configuration file by role run in the same process
+}
+
+// TLSFileConfig sets the key material of servers.
+type TLSFileConfig struct {
+	Certs   []string `json:"certs,omitempty"`
+	Keys    []string `json:"keys,omitempty"`
+	CertDir string   `json:"cert-dir,omitempty"`
+}
+
+// TokensFileConfig sets the token types an issuer offers or a client
+// fetches.
+type TokensFileConfig struct {
+	Type                string `json:"type,omitempty"`
+	PrivateTokenKey     string `json:"private-token-key,omitempty"`
+	ExperimentalEd25519 *bool  `json:"experimental-ed25519,omitempty"`
+}
+
+// StoresFileConfig sets where origins and attesters keep their state.
+type StoresFileConfig struct {
+	Challenges  string `json:"challenges,omitempty"`
+	SpentTokens string `json:"spent-tokens,omitempty"`
+	State       string `json:"state,omitempty"`
+}
+
+// OutboundFileConfig sets what attesters and origins send with their
+// requests to issuers.
+type OutboundFileConfig struct {
+	UserAgent     string            `json:"user-agent,omitempty"`
+	IssuerHeaders map[string]string `json:"issuer-headers,omitempty"`
+	IssuerH2C     *bool             `json:"issuer-h2c,omitempty"`
+}
+
+// readCommandConfig reads a configuration file. YAML is a superset of JSON,
+// so both are read as YAML and then decoded as JSON, sharing the JSON keys
+// and value types of the configuration structs.
+func readCommandConfig(fileName string) (*CommandConfig, error) {
+	configEnc, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var document interface{}
+	if err := yaml.Unmarshal(configEnc, &document); err != nil {
+		return nil, err
+	}
+	if document == nil {
+		return &CommandConfig{}, nil
+	}
+	configJSON, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(configJSON))
+	decoder.DisallowUnknownFields()
+	config := &CommandConfig{}
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// flagValues returns the flags the file sets, each with its values: one for
+// most flags, and one per element for slices.
+func (cfg CommandConfig) flagValues() (map[string][]string, error) {
+	values := make(map[string][]string)
+	set := func(name string, flagValues ...string) {
+		if len(flagValues) > 0 && !(len(flagValues) == 1 && flagValues[0] == "") {
+			values[name] = flagValues
+		}
+	}
+	set("log", cfg.Log)
+	set("port", cfg.Port)
+	if cfg.TLS != nil {
+		set("cert", cfg.TLS.Certs...)
+		set("key", cfg.TLS.Keys...)
+		set("cert-dir", cfg.TLS.CertDir)
+	}
+	set("name", cfg.Name)
+	set("issuer", cfg.Issuer)
+	set("attester", cfg.Attester)
+	set("origin", cfg.Origin)
+	if cfg.Tokens != nil {
+		set("token-type", cfg.Tokens.Type)
+		set("private-token-key", cfg.Tokens.PrivateTokenKey)
+		if cfg.Tokens.ExperimentalEd25519 != nil {
+			set("experimental-ed25519", strconv.FormatBool(*cfg.Tokens.ExperimentalEd25519))
+		}
+	}
+	if cfg.Stores != nil {
+		set("challenge-store", cfg.Stores.Challenges)
+		set("spent-token-store", cfg.Stores.SpentTokens)
+		set("state-store", cfg.Stores.State)
+	}
+	if cfg.Outbound != nil {
+		set("user-agent", cfg.Outbound.UserAgent)
+		headers := make([]string, 0, len(cfg.Outbound.IssuerHeaders))
+		for name, value := range cfg.Outbound.IssuerHeaders {
+			headers = append(headers, name+": "+value)
+		}
+		sort.Strings(headers)
+		set("issuer-header", headers...)
+		if cfg.Outbound.IssuerH2C != nil {
+			set("issuer-h2c", strconv.FormatBool(*cfg.Outbound.IssuerH2C))
+		}
+	}
+
+	for name, value := range cfg.Flags {
+		if _, ok := values[name]; ok || name == "config" {
+			return nil, fmt.Errorf("Flag %s cannot be set under flags", name)
+		}
+		flagValues, err := configFlagValues(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid value of flag %s: %w", name, err)
+		}
+		values[name] = flagValues
+	}
+	return values, nil
+}
+
+// configFlagValues formats a value of the flags map as flag values.
+func configFlagValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, element := range v {
+			elementValues, err := configFlagValues(element)
+			if err != nil || len(elementValues) != 1 {
+				return nil, fmt.Errorf("expected a list of scalars")
+			}
+			values = append(values, elementValues...)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected %T", value)
+}
+
+// applyConfigFile sets the flags of the command from the file given with
+// --config, leaving those set on the command line. Commands run it before
+// their action.
+func applyConfigFile(c *cli.Context) error {
+	fileName := c.String("config")
+	if fileName == "" {
+		return nil
+	}
+	config, err := readCommandConfig(fileName)
+	if err != nil {
+		return fmt.Errorf("Invalid configuration file %s: %w", fileName, err)
+	}
+	values, err := config.flagValues()
+	if err != nil {
+		return fmt.Errorf("Invalid configuration file %s: %w", fileName, err)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if c.IsSet(name) {
+			continue
+		}
+		for _, value := range values[name] {
+			if err := c.Set(name, value); err != nil {
+				return fmt.Errorf("Invalid configuration file %s: flag %s: %w", fileName, name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfigFile(t *testing.T, name, config string) string {
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(fileName, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	fileName := writeTestConfigFile(t, "origin.yaml", `
+log: debug
+port: "4600"
+tls:
+  cert-dir: ./certs
+issuer: issuer.example:4567
+name: origin.example
+stores:
+  challenges: bolt:challenges.db
+flags:
+  challenge-ttl: 20s
+  max-challenges-per-context: 16
+  compress: false
+  outage-fallback: [/public=open, /private=closed]
+`)
+	c := testCommandContext(t, "origin", "--config", fileName, "--port", "4700")
+	if err := applyConfigFile(c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.String("port") != "4700" {
+		t.Fatalf("expected the command line to take precedence, got port %s", c.String("port"))
+	}
+	if c.String("log") != "debug" || c.String("cert-dir") != "./certs" || c.String("challenge-store") != "bolt:challenges.db" {
+		t.Fatalf("expected typed keys to set their flags, got %s %s %s", c.String("log"), c.String("cert-dir"), c.String("challenge-store"))
+	}
+	if c.Duration("challenge-ttl") != 20*time.Second || c.Int("max-challenges-per-context") != 16 || c.BoolT("compress") {
+		t.Fatal("expected other flags to be set by name")
+	}
+	if fallbacks := c.StringSlice("outage-fallback"); strings.Join(fallbacks, ",") != "/public=open,/private=closed" {
+		t.Fatalf("expected one value per list element, got %q", fallbacks)
+	}
+	if cfg := originConfigFromFlags(c); cfg.Name != "origin.example" || cfg.Issuer != "issuer.example:4567" {
+		t.Fatalf("expected the origin to take its configuration from the file, got %+v", cfg)
+	}
+}
+
+func TestApplyConfigFileJSON(t *testing.T) {
+	fileName := writeTestConfigFile(t, "issuer.json", `{"name": "issuer.example", "tokens": {"experimental-ed25519": true}, "flags": {"admin-hmac-key": ["ops:0011"]}}`)
+	c := testCommandContext(t, "issuer", "--config", fileName)
+	if err := applyConfigFile(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.String("name") != "issuer.example" || !c.Bool("experimental-ed25519") || len(c.StringSlice("admin-hmac-key")) != 1 {
+		t.Fatal("expected JSON files to set flags like YAML ones")
+	}
+}
+
+func TestApplyConfigFileInvalid(t *testing.T) {
+	for _, config := range []string{
+		`unknown: key`,
+		`attester: attester.example`,
+		`flags: {no-such-flag: 1}`,
+		`flags: {port: {nested: map}}`,
+		`{port: "4567", flags: {port: "4568"}}`,
+		`flags: {challenge-ttl: forever}`,
+		`[not, a, map]`,
+	} {
+		c := testCommandContext(t, "issuer", "--config", writeTestConfigFile(t, "issuer.yaml", config))
+		if err := applyConfigFile(c); err == nil {
+			t.Errorf("expected %q to be rejected", config)
+		}
+	}
+}
+
+func TestReadOriginsConfigYAML(t *testing.T) {
+	fileName := writeTestConfigFile(t, "origins.yaml", `
+port: "4568"
+origins:
+  - name: a.example
+    challenge-ttl: 5s
+  - name: b.example
+    issuer: other-issuer.example
+`)
+	config, err := readOriginsConfig(fileName, OriginConfig{Issuer: "issuer.example", Verification: verificationModeLocal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Origins) != 2 || time.Duration(config.Origins[0].ChallengeTTL) != 5*time.Second || config.Origins[1].Issuer != "other-issuer.example" {
+		t.Fatalf("unexpected origins %+v", config.Origins)
+	}
+}
@@ -0,0 +1,176 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDirectoryCacheTTL = 5 * time.Minute
+
+	// Results of directory requests at the origin, as metric labels
+	directoryCacheHit   = "hit"
+	directoryCacheStale = "stale"
+	directoryCacheMiss  = "miss"
+	directoryCacheError = "error"
+)
+
+// cachedDirectory is an issuer directory as served by the origin.
+type cachedDirectory struct {
+	body    []byte
+	fetched time.Time
+}
+
+// directoryCache fetches the issuer directory for an origin to serve it to
+// clients that only reach the origin. Once cached, the directory is served
+// while it is younger than the TTL, and after that while it is revalidated in
+// the background, or for as long as the issuer stays unreachable.
+type directoryCache struct {
+	client *http.Client
+	issuer string
+	ttl    time.Duration // fetched on every request if zero
+
+	lock       sync.Mutex
+	directory  *cachedDirectory
+	refreshing bool
+}
+
+func newDirectoryCache(client *http.Client, issuer string, ttl time.Duration) *directoryCache {
+	return &directoryCache{
+		client: client,
+		issuer: issuer,
+		ttl:    ttl,
+	}
+}
+
+// fetch reads the issuer directory, making its URIs absolute so that clients
+// reach the issuer for them instead of the origin.
+func (c *directoryCache) fetch(now time.Time) (*cachedDirectory, error) {
+	issuerConfig, err := fetchIssuerConfig(c.client, c.issuer)
+	if err != nil {
+		return nil, err
+	}
+	for _, uri := range []*string{&issuerConfig.RequestURI, &issuerConfig.IssuerEncapKeyURI, &issuerConfig.VerificationURI, &issuerConfig.VerificationBundleURI} {
+		if *uri == "" {
+			continue
+		}
+		if *uri, err = composeURL(c.issuer, *uri); err != nil {
+			return nil, fmt.Errorf("Invalid issuer directory URI: %w", err)
+		}
+	}
+	body, err := json.Marshal(issuerConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedDirectory{body: body, fetched: now}, nil
+}
+
+// refresh replaces the cached directory, keeping the last one if the issuer
+// fails.
+func (c *directoryCache) refresh(now time.Time) error {
+	directory, err := c.fetch(now)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.refreshing = false
+	if err != nil {
+		return err
+	}
+	c.directory = directory
+	return nil
+}
+
+// get returns the directory to serve at now and how it was obtained. A stale
+// directory is returned as is, with one revalidation started in the background.
+func (c *directoryCache) get(now time.Time) (*cachedDirectory, string, error) {
+	if c.ttl <= 0 {
+		directory, err := c.fetch(now)
+		return directory, directoryCacheMiss, err
+	}
+
+	c.lock.Lock()
+	directory := c.directory
+	if directory != nil && now.Sub(directory.fetched) < c.ttl {
+		c.lock.Unlock()
+		return directory, directoryCacheHit, nil
+	}
+	if directory != nil {
+		revalidate := !c.refreshing
+		c.refreshing = true
+		c.lock.Unlock()
+		if revalidate {
+			go func() {
+				if err := c.refresh(now); err != nil {
+					log.Warnln("Failed revalidating issuer directory of", c.issuer+", serving the stale one:", err)
+				}
+			}()
+		}
+		return directory, directoryCacheStale, nil
+	}
+	c.lock.Unlock()
+
+	if err := c.refresh(now); err != nil {
+		return nil, directoryCacheError, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.directory, directoryCacheMiss, nil
+}
+
+// run refreshes the directory once per TTL until ctx is done, so that
+// requests rarely find it stale.
+func (c *directoryCache) run(ctx context.Context, clock clock) {
+	if c.ttl <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.refresh(clock.Now()); err != nil {
+				log.Warnln("Failed refreshing issuer directory of", c.issuer+":", err)
+			}
+		}
+	}
+}
+
+// handleDirectoryRequest serves the issuer directory from the cache, with
+// caching headers matching its remaining freshness.
+func (o *Origin) handleDirectoryRequest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	now := o.now()
+	directory, result, err := o.directory.get(now)
+	originDirectoryRequests.Inc(0, result)
+	if err != nil {
+		log.Warnln("Failed fetching issuer directory of", o.issuerName+":", err)
+		http.Error(w, "Issuer directory unavailable", http.StatusBadGateway)
+		return
+	}
+
+	age := now.Sub(directory.fetched)
+	maxAge := o.directory.ttl - age
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, stale-while-revalidate=%d",
+		int(maxAge.Seconds()), int(math.Ceil(o.directory.ttl.Seconds()))))
+	w.Header().Set("Age", fmt.Sprint(int(age.Seconds())))
+	if req.Method == http.MethodHead {
+		return
+	}
+	w.Write(directory.body)
+}
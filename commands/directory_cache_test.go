@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOriginDirectory(t *testing.T) {
+	fetches := int32(0)
+	failing := int32(0)
+	var issuer *Issuer
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if atomic.LoadInt32(&failing) != 0 || req.URL.Path != issuerConfigURI {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		issuer.handleConfigRequest(w, req)
+	}))
+	defer server.Close()
+	name := strings.TrimPrefix(server.URL, "https://")
+	issuer = newTestIssuer(t, name)
+
+	origin := newTestOrigin()
+	origin.clock = newRoleClock(true)
+	origin.directoryPath = "/.well-known/private-token-issuer-directory"
+	origin.directory = newDirectoryCache(server.Client(), name, time.Minute)
+	handler := origin.handler("")
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://origin.example"+origin.directoryPath, nil))
+		return w
+	}
+
+	w := get()
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "max-age=60, stale-while-revalidate=60" {
+		t.Fatalf("unexpected directory response %d %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	var issuerConfig IssuerConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &issuerConfig); err != nil {
+		t.Fatal(err)
+	}
+	if issuerConfig.RequestURI != "https://"+name+tokenRequestURI || len(issuerConfig.TokenKeys) == 0 {
+		t.Fatalf("expected the directory to point clients at the issuer, got %+v", issuerConfig)
+	}
+	hits := originDirectoryRequests.Value(0, directoryCacheHit)
+	if get(); atomic.LoadInt32(&fetches) != 1 || originDirectoryRequests.Value(0, directoryCacheHit) != hits+1 {
+		t.Fatal("expected the fresh directory to be served from the cache")
+	}
+
+	// A stale directory is served while revalidated, even if the issuer fails
+	atomic.StoreInt32(&failing, 1)
+	origin.clock.(*demoClock).advance(2 * time.Minute)
+	if w := get(); w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Cache-Control"), "max-age=0,") {
+		t.Fatalf("expected the stale directory to be served, got %d %q", w.Code, w.Header().Get("Cache-Control"))
+	}
+	for atomic.LoadInt32(&fetches) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	atomic.StoreInt32(&failing, 0)
+	if err := origin.directory.refresh(origin.now()); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(); w.Header().Get("Age") != "0" {
+		t.Fatalf("expected the revalidated directory, got age %q", w.Header().Get("Age"))
+	}
+
+	// Without a cached directory, issuer failures are reported to clients
+	atomic.StoreInt32(&failing, 1)
+	origin.directory = newDirectoryCache(server.Client(), name, time.Minute)
+	if w := get(); w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", w.Code)
+	}
+}
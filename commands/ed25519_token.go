@@ -0,0 +1,224 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cloudflare/pat-app/metrics"
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Experimental token type whose authenticator is an Ed25519 signature over
+// the token input, made by the issuer in the clear. It is not unlinkable and
+// only meant for benchmarking against RSA blind signatures.
+const (
+	ed25519TokenType          = uint16(0xED25)
+	ed25519TokenRequestLength = tokenTypeLength + tokenKeyIDLength + 32 + 32 // nonce and context
+)
+
+var (
+	ErrInvalidEd25519TokenRequest = errors.New("Invalid Ed25519 TokenRequest")
+)
+
+func init() {
+	metrics.RegisterTokenType(ed25519TokenType, "ed25519-experimental", "experimental")
+	registerTokenVerifier(ed25519TokenType, ed25519Verifier{})
+}
+
+//	struct {
+//	    uint16_t token_type = 0xED25;
+//	    uint8_t truncated_token_key_id;
+//	    uint8_t nonce[32];
+//	    uint8_t context[32];
+//	} TokenRequest;
+type ed25519TokenRequest struct {
+	tokenKeyID uint8
+	nonce      []byte
+	context    []byte
+}
+
+func (r ed25519TokenRequest) Marshal() []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(ed25519TokenType)
+	b.AddUint8(r.tokenKeyID)
+	b.AddBytes(r.nonce)
+	b.AddBytes(r.context)
+	return b.BytesOrPanic()
+}
+
+func unmarshalEd25519TokenRequest(data []byte) (ed25519TokenRequest, error) {
+	s := cryptobyte.String(data)
+	var tokenType uint16
+	request := ed25519TokenRequest{}
+	if !s.ReadUint16(&tokenType) || tokenType != ed25519TokenType ||
+		!s.ReadUint8(&request.tokenKeyID) ||
+		!s.ReadBytes(&request.nonce, 32) ||
+		!s.ReadBytes(&request.context, 32) ||
+		!s.Empty() {
+		return ed25519TokenRequest{}, ErrInvalidEd25519TokenRequest
+	}
+	return request, nil
+}
+
+// unmarshalToken decodes a token of any supported type.
+func unmarshalToken(data []byte) (pat.Token, error) {
+	if len(data) >= tokenTypeLength && binary.BigEndian.Uint16(data) == pat.BasicPrivateTokenType {
+		if len(data) != tokenTypeLength+3*32+privateTokenAuthenticatorLength {
+			return pat.Token{}, fmt.Errorf("Invalid Token encoding")
+		}
+		return pat.UnmarshalPrivateToken(data)
+	}
+	if len(data) < tokenTypeLength || binary.BigEndian.Uint16(data) != ed25519TokenType {
+		return pat.UnmarshalToken(data)
+	}
+
+	s := cryptobyte.String(data)
+	token := pat.Token{}
+	if !s.ReadUint16(&token.TokenType) ||
+		!s.ReadBytes(&token.Nonce, 32) ||
+		!s.ReadBytes(&token.Context, 32) ||
+		!s.ReadBytes(&token.KeyID, 32) ||
+		!s.ReadBytes(&token.Authenticator, ed25519.SignatureSize) ||
+		!s.Empty() {
+		return pat.Token{}, fmt.Errorf("Invalid Token encoding")
+	}
+	return token, nil
+}
+
+func ed25519TokenKeyID(publicKey ed25519.PublicKey) []byte {
+	keyID := sha256.Sum256(publicKey)
+	return keyID[:]
+}
+
+type ed25519Issuer struct {
+	key ed25519.PrivateKey
+}
+
+func newEd25519Issuer() (*ed25519Issuer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &ed25519Issuer{
+		key: key,
+	}, nil
+}
+
+func (i *ed25519Issuer) TokenKey() ed25519.PublicKey {
+	return i.key.Public().(ed25519.PublicKey)
+}
+
+// Evaluate signs the token described by the request.
+func (i *ed25519Issuer) Evaluate(request ed25519TokenRequest) ([]byte, error) {
+	keyID := ed25519TokenKeyID(i.TokenKey())
+	if request.tokenKeyID != keyID[len(keyID)-1] {
+		return nil, fmt.Errorf("Unknown token key ID %d", request.tokenKeyID)
+	}
+	token := pat.Token{
+		TokenType: ed25519TokenType,
+		Nonce:     request.nonce,
+		Context:   request.context,
+		KeyID:     keyID,
+	}
+	return ed25519.Sign(i.key, token.AuthenticatorInput()), nil
+}
+
+func verifyEd25519Token(publicKey ed25519.PublicKey, token pat.Token) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("No key for token type %d", token.TokenType)
+	}
+	if !ed25519.Verify(publicKey, token.AuthenticatorInput(), token.Authenticator) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// ed25519Verifier checks Ed25519 authenticators with the key the issuer
+// published.
+type ed25519Verifier struct{}
+
+func (ed25519Verifier) algorithm() string {
+	return "ed25519"
+}
+
+func (ed25519Verifier) verify(keys verificationKeys, tokenType uint16, token pat.Token) error {
+	return verifyEd25519Token(keys.issuer.ed25519TokenKey, token)
+}
+
+// fetchEd25519Token runs issuance through the attester, which passes the
+// request through to the issuer.
+func fetchEd25519Token(httpClient *http.Client, attester string, challenge []byte, publicKeyEnc []byte) (pat.Token, error) {
+	if len(publicKeyEnc) != ed25519.PublicKeySize {
+		return pat.Token{}, fmt.Errorf("Invalid Ed25519 token key")
+	}
+	publicKey := ed25519.PublicKey(publicKeyEnc)
+	keyID := ed25519TokenKeyID(publicKey)
+
+	tokenChallenge, err := pat.UnmarshalTokenChallenge(challenge)
+	if err != nil {
+		return pat.Token{}, err
+	}
+	issuerConfig, err := fetchIssuerConfig(httpClient, tokenChallenge.IssuerName)
+	if err != nil {
+		return pat.Token{}, err
+	}
+	issuerRequestURI, err := composeURL(tokenChallenge.IssuerName, issuerConfig.RequestURI)
+	if err != nil {
+		return pat.Token{}, err
+	}
+
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+	context := sha256.Sum256(challenge)
+	request := ed25519TokenRequest{
+		tokenKeyID: keyID[len(keyID)-1],
+		nonce:      nonce,
+		context:    context[:],
+	}
+
+	tokenRequestURI, err := tokenRequestTarget(attester, issuerRequestURI)
+	if err != nil {
+		return pat.Token{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, tokenRequestURI, bytes.NewReader(request.Marshal()))
+	if err != nil {
+		return pat.Token{}, err
+	}
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return pat.Token{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return pat.Token{}, tokenRequestError(resp)
+	}
+	signature, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return pat.Token{}, err
+	}
+	protocolTranscript.recordIssuance(challenge, publicKeyEnc, request.Marshal(), signature)
+
+	token := pat.Token{
+		TokenType:     ed25519TokenType,
+		Nonce:         nonce,
+		Context:       context[:],
+		KeyID:         keyID,
+		Authenticator: signature,
+	}
+	if err := verifyEd25519Token(publicKey, token); err != nil {
+		log.Debugln("Issuer returned an invalid Ed25519 signature")
+		return pat.Token{}, err
+	}
+	return protocolTranscript.recordToken(token, nil)
+}
@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEd25519Token(t *testing.T) {
+	tokenIssuer := newTestIssuer(t, "issuer.example")
+	issuer, err := newEd25519Issuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenIssuer.ed25519Issuer = issuer
+	token := createTestToken(t, tokenIssuer, testTokenChallenge(ed25519TokenType))
+
+	decoded, err := unmarshalToken(token.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Marshal(), token.Marshal()) {
+		t.Fatal("token encoding mismatch")
+	}
+	if err := verifyEd25519Token(issuer.TokenKey(), decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded.Nonce[0] ^= 0xFF
+	if err := verifyEd25519Token(issuer.TokenKey(), decoded); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+
+	// Truncated tokens are rejected
+	if _, err := unmarshalToken(token.Marshal()[:100]); err == nil {
+		t.Fatal("expected truncated token to fail decoding")
+	}
+
+	// Requests for another key are refused
+	request := ed25519TokenRequest{tokenKeyID: token.KeyID[31] + 1, nonce: token.Nonce, context: token.Context}
+	if _, err := issuer.Evaluate(request); err == nil {
+		t.Fatal("expected unknown key ID to be refused")
+	}
+}
+
+func TestEd25519TokenVerificationRequest(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	ed25519Issuer, err := newEd25519Issuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.ed25519Issuer = ed25519Issuer
+	token := createTestToken(t, issuer, testTokenChallenge(ed25519TokenType))
+	issuer.ed25519Issuer = nil
+
+	verify := func() int {
+		req := httptest.NewRequest(http.MethodPost, tokenVerificationURI, bytes.NewReader(token.Marshal()))
+		req.Header.Set("Content-Type", tokenMediaType)
+		w := httptest.NewRecorder()
+		issuer.handleVerificationRequest(w, req)
+		return w.Code
+	}
+
+	// Unsupported unless enabled at the issuer
+	if code := verify(); code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", code)
+	}
+	issuer.ed25519Issuer = ed25519Issuer
+	if code := verify(); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+}
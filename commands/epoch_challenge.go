@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+const (
+	epochChallengeLabel = "PAT epoch challenge"
+)
+
+// epochChallenger derives the redemption nonce of non-interactive challenges
+// from the origin name, the current epoch, and a key shared by all replicas.
+// Challenges are then stable within an epoch and any replica can recognize
+// them without shared storage. Tokens for epoch challenges can be redeemed
+// more than once within the epoch.
+type epochChallenger struct {
+	key    []byte
+	length time.Duration
+	skew   time.Duration // clock skew tolerated between replicas
+}
+
+func newEpochChallenger(key []byte, length time.Duration) (*epochChallenger, error) {
+	if len(key) < 16 {
+		return nil, fmt.Errorf("Epoch challenge key must be at least 16 bytes")
+	}
+	if length < time.Second {
+		return nil, fmt.Errorf("Epoch length must be at least one second")
+	}
+	return &epochChallenger{
+		key:    key,
+		length: length,
+	}, nil
+}
+
+func (e *epochChallenger) epoch(now time.Time) uint64 {
+	return uint64(now.UnixNano() / int64(e.length))
+}
+
+func (e *epochChallenger) nonce(originName string, epoch uint64) []byte {
+	mac := hmac.New(sha256.New, e.key)
+	mac.Write([]byte(epochChallengeLabel))
+	mac.Write([]byte(originName))
+	epochEnc := make([]byte, 8)
+	binary.BigEndian.PutUint64(epochEnc, epoch)
+	mac.Write(epochEnc)
+	return mac.Sum(nil)[:challengeNonceLength]
+}
+
+// lifetime is how long an epoch challenge is matched after it was handed out
+// at most: for the rest of its epoch, the next one, and the skew tolerance.
+func (e *epochChallenger) lifetime() time.Duration {
+	return 2*e.length + 2*e.skew
+}
+
+// match finds the challenge of the current or previous epoch with the given
+// context, among every token type and origin_info the origin hands out. Epochs
+// within the clock skew tolerance of those are matched too, for challenges
+// handed out by replicas whose clocks are ahead or behind.
+func (e *epochChallenger) match(contextEnc, issuerName, originName string, originInfo []string, tokenTypes []uint16, now time.Time) (pat.TokenChallenge, bool) {
+	current := e.epoch(now)
+	newest, oldest := e.epoch(now.Add(e.skew)), e.epoch(now.Add(-e.skew))-1
+	for epoch := newest; epoch >= oldest && epoch <= newest; epoch-- {
+		nonce := e.nonce(originName, epoch)
+		for _, tokenType := range tokenTypes {
+			for _, info := range [][]string{originInfo, nil} {
+				challenge := pat.TokenChallenge{
+					TokenType:       tokenType,
+					IssuerName:      issuerName,
+					OriginInfo:      info,
+					RedemptionNonce: nonce,
+				}
+				context := sha256.Sum256(challenge.Marshal())
+				if hmac.Equal([]byte(hex.EncodeToString(context[:])), []byte(contextEnc)) {
+					result := skewResultOK
+					if epoch != current && epoch+1 != current {
+						result = skewResultTolerated
+					}
+					clockSkewChecks.Inc(0, skewCheckEpochChallenge, result)
+					return challenge, true
+				}
+			}
+		}
+	}
+	return pat.TokenChallenge{}, false
+}
@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestEpochChallenges(t *testing.T) {
+	challenger, err := newEpochChallenger(bytes.Repeat([]byte{0x42}, 32), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two replicas sharing the key
+	replicas := []*Origin{newTestOrigin(), newTestOrigin()}
+	for _, replica := range replicas {
+		replica.epochChallenger = challenger
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	req.Header.Set(headerTokenAttributeNoninteractive, "1")
+	challengeEnc, _, _ := replicas[0].CreateChallenge(req)
+	otherEnc, _, _ := replicas[1].CreateChallenge(req)
+	if challengeEnc != otherEnc {
+		t.Fatal("expected replicas to hand out the same challenge within an epoch")
+	}
+	if len(outstandingChallenges(replicas[0])) != 0 {
+		t.Fatal("expected epoch challenges not to be stored")
+	}
+
+	challengeBlob, _ := base64.URLEncoding.DecodeString(challengeEnc)
+	context := sha256.Sum256(challengeBlob)
+	contextEnc := hex.EncodeToString(context[:])
+
+	tokenTypes := []uint16{pat.RateLimitedTokenType, pat.BasicPublicTokenType}
+	now := time.Now()
+	challenge, ok := challenger.match(contextEnc, "issuer.example", "origin.example", replicas[1].originInfo(), tokenTypes, now)
+	if !ok || !bytes.Equal(challenge.Marshal(), challengeBlob) {
+		t.Fatal("expected the other replica to match the challenge")
+	}
+	if _, ok := challenger.match(contextEnc, "issuer.example", "origin.example", replicas[1].originInfo(), tokenTypes, now.Add(time.Hour)); !ok {
+		t.Fatal("expected challenges of the previous epoch to match")
+	}
+	if _, ok := challenger.match(contextEnc, "issuer.example", "origin.example", replicas[1].originInfo(), tokenTypes, now.Add(2*time.Hour)); ok {
+		t.Fatal("expected challenges of older epochs to be rejected")
+	}
+	if _, ok := challenger.match(contextEnc, "issuer.example", "other.example", []string{"other.example"}, tokenTypes, now); ok {
+		t.Fatal("expected challenges of other origins to be rejected")
+	}
+
+	// Interactive challenges are still random and stored
+	interactive := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	replicas[0].CreateChallenge(interactive)
+	if len(outstandingChallenges(replicas[0])) != 1 {
+		t.Fatal("expected interactive challenges to be stored")
+	}
+
+	if _, err := newEpochChallenger([]byte{0x01}, time.Hour); err == nil {
+		t.Fatal("expected short key to be rejected")
+	}
+}
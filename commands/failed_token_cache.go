@@ -0,0 +1,74 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+const (
+	// Failed tokens remembered at once. Beyond, expired entries are swept
+	// and, if none expired, further failures are not remembered, so that a
+	// flood of junk tokens cannot grow the cache without bound.
+	failedTokenCacheSize = 100000
+)
+
+// failedTokenCache remembers tokens that failed verification by digest for a
+// short time, so that clients resubmitting the same junk, e.g., misconfigured
+// ones, are refused without verifying their tokens again.
+type failedTokenCache struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	expires map[[sha256.Size]byte]time.Time
+}
+
+// newFailedTokenCache returns nil, disabling the cache, unless ttl is
+// positive.
+func newFailedTokenCache(ttl time.Duration) *failedTokenCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &failedTokenCache{
+		ttl:     ttl,
+		expires: make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// failed returns whether the token failed verification within the TTL.
+func (c *failedTokenCache) failed(tokenEnc []byte, now time.Time) bool {
+	key := sha256.Sum256(tokenEnc)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires, ok := c.expires[key]
+	if ok && !now.Before(expires) {
+		delete(c.expires, key)
+		return false
+	}
+	return ok
+}
+
+func (c *failedTokenCache) store(tokenEnc []byte, now time.Time) {
+	key := sha256.Sum256(tokenEnc)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.expires) >= failedTokenCacheSize {
+		for other, expires := range c.expires {
+			if !now.Before(expires) {
+				delete(c.expires, other)
+			}
+		}
+		if len(c.expires) >= failedTokenCacheSize {
+			return
+		}
+	}
+	c.expires[key] = now.Add(c.ttl)
+}
+
+// flush forgets every failed token, e.g., once new issuer keys may verify
+// tokens the previous ones did not.
+func (c *failedTokenCache) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.expires = make(map[[sha256.Size]byte]time.Time)
+}
@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestFailedTokenCache(t *testing.T) {
+	cache := newFailedTokenCache(10 * time.Second)
+	now := time.Unix(1700000000, 0)
+	token := []byte("token")
+
+	if cache.failed(token, now) {
+		t.Fatal("expected an empty cache")
+	}
+	cache.store(token, now)
+	if !cache.failed(token, now.Add(time.Second)) || cache.failed([]byte("other"), now) {
+		t.Fatal("expected failures to be cached per token")
+	}
+	if cache.failed(token, now.Add(10*time.Second)) {
+		t.Fatal("expected the failure to expire")
+	}
+	cache.store(token, now)
+	cache.flush()
+	if cache.failed(token, now) {
+		t.Fatal("expected flushing to forget the failure")
+	}
+
+	if newFailedTokenCache(0) != nil {
+		t.Fatal("expected a zero TTL to disable the cache")
+	}
+}
+
+func TestFailedTokenResubmission(t *testing.T) {
+	origin := newTestOrigin()
+	origin.failedTokens = newFailedTokenCache(time.Minute)
+	redeem := func(token pat.Token) int {
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+		req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+		w := httptest.NewRecorder()
+		origin.handleRequest(w, req)
+		return w.Code
+	}
+	newToken := func() pat.Token {
+		context, _ := hex.DecodeString(createTestChallengeContext(t, origin, false))
+		return pat.Token{
+			TokenType:     pat.RateLimitedTokenType,
+			Nonce:         make([]byte, 32),
+			Context:       context,
+			KeyID:         make([]byte, 32),
+			Authenticator: make([]byte, 256),
+		}
+	}
+
+	token := newToken()
+	hits := originFailedTokenCacheHits.Value(pat.RateLimitedTokenType)
+	if code := redeem(token); code != http.StatusBadRequest {
+		t.Fatalf("expected the invalid token to be refused, got %d", code)
+	}
+	if originFailedTokenCacheHits.Value(pat.RateLimitedTokenType) != hits {
+		t.Fatal("expected the first submission to be verified")
+	}
+
+	// Resubmissions are refused before their challenge is looked up
+	if code := redeem(token); code != http.StatusBadRequest {
+		t.Fatalf("expected the resubmission to be refused, got %d", code)
+	}
+	if originFailedTokenCacheHits.Value(pat.RateLimitedTokenType) != hits+1 {
+		t.Fatal("expected the resubmission to hit the cache")
+	}
+	if code := redeem(newToken()); code != http.StatusBadRequest || originFailedTokenCacheHits.Value(pat.RateLimitedTokenType) != hits+1 {
+		t.Fatalf("expected other tokens to be verified, got %d", code)
+	}
+}
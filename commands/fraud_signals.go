@@ -0,0 +1,162 @@
+package commands
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Fraud signals surfaced by the attester in rate-limited issuance
+	fraudEventIndexMismatch = "index_mismatch"
+	fraudEventLimitExceeded = "limit_exceeded"
+	fraudEventOriginChurn   = "origin_churn"
+	fraudEventBlindReuse    = "blind_reuse"
+
+	// Limits a client can hit
+	fraudLimitIssuer = "issuer" // per-origin token limit set by the issuer
+	fraudLimitBucket = "bucket" // token buckets of the attester policy
+	fraudLimitWindow = "window" // token windows published by the issuer
+)
+
+// fraudEvent is the structured form of a fraud signal, written as one JSON
+// object per line.
+type fraudEvent struct {
+	Time            time.Time `json:"time"`
+	Event           string    `json:"event"`
+	ClientID        string    `json:"client_id"`
+	AnonymousOrigin string    `json:"anonymous_origin,omitempty"`
+	Issuer          string    `json:"issuer,omitempty"`
+	Limit           string    `json:"limit,omitempty"`
+	NewOrigins      int       `json:"new_origins,omitempty"`
+	Scope           string    `json:"scope,omitempty"`
+}
+
+// fraudSignals counts the events the rate-limited architecture is meant to
+// surface: index mismatches, clients hitting limits, reused blinds, and
+// clients switching anonymous origin IDs rapidly, i.e., more than
+// churnThreshold new ones within churnWindow.
+type fraudSignals struct {
+	churnWindow    time.Duration
+	churnThreshold int
+
+	lock       sync.Mutex
+	newOrigins map[string][]time.Time // client ID -> first use of each recent new anonymous origin
+	events     *json.Encoder          // nil unless structured events are enabled
+}
+
+func newFraudSignals(churnWindow time.Duration, churnThreshold int, events io.Writer) *fraudSignals {
+	f := &fraudSignals{
+		churnWindow:    churnWindow,
+		churnThreshold: churnThreshold,
+		newOrigins:     make(map[string][]time.Time),
+	}
+	if events != nil {
+		f.events = json.NewEncoder(events)
+	}
+	return f
+}
+
+// openEventLog opens the destination of JSON line events, such as fraud
+// signals or admin audit entries, with "-" standing for stdout.
+func openEventLog(fileName string) (io.Writer, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	if fileName == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+// emit writes the event if structured events are enabled. The caller holds
+// the lock.
+func (f *fraudSignals) emit(event fraudEvent) {
+	if f.events == nil {
+		return
+	}
+	if err := f.events.Encode(event); err != nil {
+		log.Errorln("Failed writing fraud event:", err)
+	}
+}
+
+func (f *fraudSignals) indexMismatch(clientID, anonOriginEnc, issuer string, now time.Time) {
+	attesterIndexMismatches.Inc(pat.RateLimitedTokenType)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.emit(fraudEvent{
+		Time:            now,
+		Event:           fraudEventIndexMismatch,
+		ClientID:        clientID,
+		AnonymousOrigin: anonOriginEnc,
+		Issuer:          issuer,
+	})
+}
+
+func (f *fraudSignals) limitExceeded(clientID, anonOriginEnc, issuer, limit string, now time.Time) {
+	attesterLimitsExceeded.Inc(pat.RateLimitedTokenType, limit)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.emit(fraudEvent{
+		Time:            now,
+		Event:           fraudEventLimitExceeded,
+		ClientID:        clientID,
+		AnonymousOrigin: anonOriginEnc,
+		Issuer:          issuer,
+		Limit:           limit,
+	})
+}
+
+// blindReuse reports a blinded request key seen before, within the scope.
+func (f *fraudSignals) blindReuse(clientID, anonOriginEnc, issuer, scope string, now time.Time) {
+	attesterBlindReuse.Inc(pat.RateLimitedTokenType, scope)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.emit(fraudEvent{
+		Time:            now,
+		Event:           fraudEventBlindReuse,
+		ClientID:        clientID,
+		AnonymousOrigin: anonOriginEnc,
+		Issuer:          issuer,
+		Scope:           scope,
+	})
+}
+
+// newOrigin records the first use of an anonymous origin ID by the client and
+// reports whether the client now switches origins too rapidly.
+func (f *fraudSignals) newOrigin(clientID, anonOriginEnc, issuer string, now time.Time) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	recent := f.newOrigins[clientID]
+	kept := recent[:0]
+	for _, seen := range recent {
+		if now.Sub(seen) < f.churnWindow {
+			kept = append(kept, seen)
+		}
+	}
+	kept = append(kept, now)
+	f.newOrigins[clientID] = kept
+
+	if f.churnThreshold <= 0 || len(kept) <= f.churnThreshold {
+		return false
+	}
+	attesterOriginChurn.Inc(pat.RateLimitedTokenType)
+	f.emit(fraudEvent{
+		Time:            now,
+		Event:           fraudEventOriginChurn,
+		ClientID:        clientID,
+		AnonymousOrigin: anonOriginEnc,
+		Issuer:          issuer,
+		NewOrigins:      len(kept),
+	})
+	return true
+}
@@ -0,0 +1,64 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestFraudSignals(t *testing.T) {
+	var events bytes.Buffer
+	signals := newFraudSignals(time.Minute, 2, &events)
+	now := time.Unix(1700000000, 0)
+
+	churn := attesterOriginChurn.Value(pat.RateLimitedTokenType)
+	if signals.newOrigin("alice", "origin-a", "issuer.example", now) ||
+		signals.newOrigin("alice", "origin-b", "issuer.example", now.Add(time.Second)) {
+		t.Fatal("expected no churn within the threshold")
+	}
+	if !signals.newOrigin("alice", "origin-c", "issuer.example", now.Add(2*time.Second)) {
+		t.Fatal("expected churn beyond the threshold")
+	}
+	if signals.newOrigin("alice", "origin-d", "issuer.example", now.Add(2*time.Minute)) {
+		t.Fatal("expected new origins outside of the window to be forgotten")
+	}
+	if signals.newOrigin("bob", "origin-a", "issuer.example", now) {
+		t.Fatal("expected churn to be tracked per client")
+	}
+	if attesterOriginChurn.Value(pat.RateLimitedTokenType) != churn+1 {
+		t.Fatal("expected churn to be counted")
+	}
+
+	mismatches := attesterIndexMismatches.Value(pat.RateLimitedTokenType)
+	signals.indexMismatch("alice", "origin-a", "issuer.example", now)
+	if attesterIndexMismatches.Value(pat.RateLimitedTokenType) != mismatches+1 {
+		t.Fatal("expected index mismatch to be counted")
+	}
+	limits := attesterLimitsExceeded.Value(pat.RateLimitedTokenType, fraudLimitIssuer)
+	signals.limitExceeded("alice", "origin-a", "issuer.example", fraudLimitIssuer, now)
+	if attesterLimitsExceeded.Value(pat.RateLimitedTokenType, fraudLimitIssuer) != limits+1 {
+		t.Fatal("expected limit to be counted")
+	}
+
+	var emitted []fraudEvent
+	scanner := bufio.NewScanner(&events)
+	for scanner.Scan() {
+		event := fraudEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		emitted = append(emitted, event)
+	}
+	if len(emitted) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(emitted))
+	}
+	if emitted[0].Event != fraudEventOriginChurn || emitted[0].NewOrigins != 3 ||
+		emitted[1].Event != fraudEventIndexMismatch ||
+		emitted[2].Event != fraudEventLimitExceeded || emitted[2].Limit != fraudLimitIssuer {
+		t.Fatalf("unexpected events %+v", emitted)
+	}
+}
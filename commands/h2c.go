@@ -0,0 +1,42 @@
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// withH2C serves HTTP/2 in cleartext (h2c) next to HTTP/1.1, both with prior
+// knowledge and by upgrade, for roles running behind a proxy terminating TLS.
+func withH2C(handler http.Handler, options serverOptions) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{IdleTimeout: options.idleTimeout})
+}
+
+// h2cTransport speaks HTTP/2 in cleartext with prior knowledge. URLs keep
+// their https scheme throughout the commands, so requests for them are sent
+// in cleartext too, to the port of the URL or 80 if it has none.
+type h2cTransport struct {
+	base *http2.Transport
+}
+
+func newH2CTransport() h2cTransport {
+	return h2cTransport{base: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+}
+
+func (t h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "https" {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = "http"
+	}
+	return t.base.RoundTrip(req)
+}
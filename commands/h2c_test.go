@@ -0,0 +1,68 @@
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServeH2C(t *testing.T) {
+	options := serverOptions{shutdownTimeout: time.Second, h2c: true}
+	if err := options.validate(); err != nil {
+		t.Fatal(err)
+	}
+	options.http3 = true
+	if err := options.validate(); err == nil {
+		t.Fatal("expected h2c and HTTP/3 to be refused together")
+	}
+	options.http3 = false
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	})
+	server := newServer(port, nil, mux, options)
+	server.Addr = "127.0.0.1:" + port
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveTLS(ctx, server, false, time.Second)
+
+	// URLs keep the https scheme, as composed by the commands
+	clients := map[string]*http.Client{
+		"HTTP/2.0": newHTTPClient(false, true),
+		"HTTP/1.1": {},
+	}
+	uris := map[string]string{
+		"HTTP/2.0": "https://127.0.0.1:" + port + "/",
+		"HTTP/1.1": "http://127.0.0.1:" + port + "/",
+	}
+	for proto, client := range clients {
+		var resp *http.Response
+		for i := 0; i < 50; i++ {
+			resp, err = client.Get(uris[proto])
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != proto {
+			t.Fatalf("expected %s, got %s", proto, body)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	log "github.com/sirupsen/logrus"
+)
+
+// newHTTPClient returns the client used for outbound requests, speaking
+// HTTP/3 over QUIC rather than HTTP/1.1 or HTTP/2 over TCP when useHTTP3 is
+// set, or HTTP/2 in cleartext when useH2C is.
+func newHTTPClient(useHTTP3, useH2C bool) *http.Client {
+	if useHTTP3 {
+		return &http.Client{
+			Transport: &http3.Transport{},
+		}
+	}
+	if useH2C {
+		return &http.Client{
+			Transport: newH2CTransport(),
+		}
+	}
+	return &http.Client{}
+}
+
+// serveTLS runs the server over TCP and, when enableHTTP3 is set, over QUIC on
+// the same port. TCP responses then advertise the QUIC endpoint with Alt-Svc.
+// Servers without TLS configuration, serving h2c, run over TCP in cleartext.
+// Once ctx is done, the server stops accepting connections and waits up to
+// shutdownTimeout for in-flight requests.
+func serveTLS(ctx context.Context, server *http.Server, enableHTTP3 bool, shutdownTimeout time.Duration) error {
+	var quicServer *http3.Server
+	if enableHTTP3 {
+		handler := server.Handler
+		if handler == nil {
+			handler = http.DefaultServeMux
+		}
+		quicServer = &http3.Server{
+			Addr:      server.Addr,
+			TLSConfig: server.TLSConfig,
+			Handler:   handler,
+		}
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			quicServer.SetQUICHeaders(w.Header())
+			handler.ServeHTTP(w, req)
+		})
+	}
+
+	errs := make(chan error, 2)
+	if quicServer != nil {
+		go func() {
+			log.Infoln("Serving HTTP/3 on", server.Addr)
+			errs <- quicServer.ListenAndServe()
+		}()
+	}
+	go func() {
+		if server.TLSConfig == nil {
+			log.Infoln("Serving cleartext HTTP/2 (h2c) on", server.Addr)
+			errs <- server.ListenAndServe()
+			return
+		}
+		errs <- server.ListenAndServeTLS("", "")
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infoln("Shutting down, draining in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if quicServer != nil {
+		if quicErr := quicServer.Shutdown(shutdownCtx); err == nil {
+			err = quicErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestServeHTTP3(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir, "localhost", []string{"localhost"})
+	tlsConfig, err := newServerTLSConfig(nil, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Proto))
+	})
+	server := &http.Server{
+		Addr:      "127.0.0.1:" + port,
+		TLSConfig: tlsConfig,
+		Handler:   mux,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveTLS(ctx, server, true, time.Second)
+
+	clientTLSConfig := &tls.Config{InsecureSkipVerify: true}
+	clients := map[string]*http.Client{
+		"HTTP/3.0": {Transport: &http3.Transport{TLSClientConfig: clientTLSConfig}},
+		"HTTP/1.1": {Transport: &http.Transport{TLSClientConfig: clientTLSConfig}},
+	}
+	for proto, client := range clients {
+		var resp *http.Response
+		for i := 0; i < 50; i++ {
+			resp, err = client.Get("https://localhost:" + port + "/")
+			if err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != proto {
+			t.Fatalf("expected %s, got %s", proto, body)
+		}
+		if proto == "HTTP/1.1" && !strings.Contains(resp.Header.Get("Alt-Svc"), "h3=") {
+			t.Fatal("expected TCP responses to advertise HTTP/3")
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+var (
+	// Header carrying the attester's signed receipt of a rate-limited issuance
+	headerIssuanceReceipt = "sec-token-receipt"
+)
+
+// issuanceReceipt is what the attester attests to about one rate-limited
+// issuance: the token type, a digest of the anonymous origin ID, the policy
+// epoch, and how many more tokens the client may obtain for the origin.
+type issuanceReceipt struct {
+	TokenType  uint16
+	OriginHash []byte // SHA-256 of the anonymous origin ID
+	Epoch      uint64
+	Remaining  uint32
+	IssuedAt   uint64 // Unix seconds
+}
+
+func (r issuanceReceipt) marshal() []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16(r.TokenType)
+	b.AddBytes(r.OriginHash)
+	b.AddUint64(r.Epoch)
+	b.AddUint32(r.Remaining)
+	b.AddUint64(r.IssuedAt)
+	return b.BytesOrPanic()
+}
+
+// signIssuanceReceipt encodes the receipt followed by its Ed25519 signature.
+func signIssuanceReceipt(receipt issuanceReceipt, key ed25519.PrivateKey) []byte {
+	receiptEnc := receipt.marshal()
+	return append(receiptEnc, ed25519.Sign(key, receiptEnc)...)
+}
+
+// openIssuanceReceipt decodes a signed receipt. The signature is checked
+// unless key is nil.
+func openIssuanceReceipt(signed []byte, key ed25519.PublicKey) (issuanceReceipt, error) {
+	if len(signed) < ed25519.SignatureSize {
+		return issuanceReceipt{}, fmt.Errorf("Issuance receipt too short")
+	}
+	receiptEnc := signed[:len(signed)-ed25519.SignatureSize]
+	if key != nil && !ed25519.Verify(key, receiptEnc, signed[len(receiptEnc):]) {
+		return issuanceReceipt{}, fmt.Errorf("Invalid issuance receipt signature")
+	}
+
+	receipt := issuanceReceipt{}
+	s := cryptobyte.String(receiptEnc)
+	if !s.ReadUint16(&receipt.TokenType) ||
+		!s.ReadBytes(&receipt.OriginHash, sha256.Size) ||
+		!s.ReadUint64(&receipt.Epoch) ||
+		!s.ReadUint32(&receipt.Remaining) ||
+		!s.ReadUint64(&receipt.IssuedAt) ||
+		!s.Empty() {
+		return issuanceReceipt{}, fmt.Errorf("Invalid issuance receipt encoding")
+	}
+	return receipt, nil
+}
+
+// remainingBudget returns how many more tokens the client may obtain for the
+// anonymous origin in the current epoch, given the issuer's token limit and
+// the buckets of the policy. The caller holds the client lock.
+func (a TestAttester) remainingBudget(state *ClientState, clientID, anonOriginEnc string, tokenLimit int, now time.Time) uint32 {
+	count, _ := state.originCount(anonOriginEnc, a.policyEpoch(now))
+	remaining := float64(tokenLimit - 1 - count)
+	policy := a.policy.forClient(clientID)
+	if policy.Client.enabled() {
+		state.clientBucket.refill(policy.Client, now)
+		remaining = math.Min(remaining, math.Floor(state.clientBucket.tokens))
+	}
+	if originBucket, ok := state.originBuckets[anonOriginEnc]; ok && policy.Origin.enabled() {
+		originBucket.refill(policy.Origin, now)
+		remaining = math.Min(remaining, math.Floor(originBucket.tokens))
+	}
+	if remaining < 0 {
+		return 0
+	}
+	return uint32(remaining)
+}
+
+// issuanceReceipt signs the receipt of an issuance just recorded for the
+// client, or returns nil if receipts are disabled. The caller holds the client
+// lock.
+func (a TestAttester) issuanceReceipt(state *ClientState, clientID, anonOriginEnc string, tokenType uint16, tokenLimit int, now time.Time) []byte {
+	if a.receiptKey == nil {
+		return nil
+	}
+	anonOrigin, _ := hex.DecodeString(anonOriginEnc)
+	originHash := sha256.Sum256(anonOrigin)
+	return signIssuanceReceipt(issuanceReceipt{
+		TokenType:  tokenType,
+		OriginHash: originHash[:],
+		Epoch:      a.policyEpoch(now),
+		Remaining:  a.faults.remaining(a.remainingBudget(state, clientID, anonOriginEnc, tokenLimit, now), tokenLimit),
+		IssuedAt:   uint64(now.Unix()),
+	}, a.receiptKey)
+}
+
+// receiptLogEntry is a receipt as logged by clients for offline audits.
+type receiptLogEntry struct {
+	Time       time.Time `json:"time"`
+	Origin     string    `json:"origin"`
+	TokenType  uint16    `json:"token_type"`
+	OriginHash string    `json:"origin_hash"`
+	Epoch      uint64    `json:"epoch"`
+	Remaining  uint32    `json:"remaining"`
+	IssuedAt   uint64    `json:"issued_at"`
+	Verified   bool      `json:"verified"` // signature checked with the configured key
+	Receipt    string    `json:"receipt"`  // base64url of the signed receipt
+}
+
+// receiptLog appends the issuance receipts a client receives as JSON lines.
+type receiptLog struct {
+	lock   sync.Mutex
+	key    ed25519.PublicKey // receipts are not verified if nil
+	events *json.Encoder
+}
+
+func newReceiptLog(w io.Writer, key ed25519.PublicKey) *receiptLog {
+	if w == nil {
+		return nil
+	}
+	return &receiptLog{
+		key:    key,
+		events: json.NewEncoder(w),
+	}
+}
+
+// record logs the receipt sent with an issuance for the origin, if any. A nil
+// log records nothing.
+func (l *receiptLog) record(origin, receiptValue string, now time.Time) {
+	if l == nil {
+		return
+	}
+	if receiptValue == "" {
+		log.Warnln("Attester sent no issuance receipt for", origin)
+		return
+	}
+	signed, err := unmarshalStructuredBinary(receiptValue)
+	if err != nil {
+		log.Warnln("Invalid issuance receipt:", err)
+		return
+	}
+	receipt, err := openIssuanceReceipt(signed, l.key)
+	if err != nil {
+		log.Warnln("Invalid issuance receipt:", err)
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events.Encode(receiptLogEntry{
+		Time:       now,
+		Origin:     origin,
+		TokenType:  receipt.TokenType,
+		OriginHash: hex.EncodeToString(receipt.OriginHash),
+		Epoch:      receipt.Epoch,
+		Remaining:  receipt.Remaining,
+		IssuedAt:   receipt.IssuedAt,
+		Verified:   l.key != nil,
+		Receipt:    base64.URLEncoding.EncodeToString(signed),
+	})
+}
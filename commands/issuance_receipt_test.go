@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestIssuanceReceipt(t *testing.T) {
+	attester := newTestAttester(&AttesterPolicy{
+		ClientPolicy: ClientPolicy{Origin: BucketPolicy{Burst: 3}},
+	})
+	attester.policyWindow = time.Hour
+	attester.receiptKey, _ = loadEd25519SigningKey("")
+	publicKey := attester.receiptKey.Public().(ed25519.PublicKey)
+	anonOriginEnc := hex.EncodeToString([]byte("anonymous origin"))
+	now := time.Now()
+
+	issue := func(tokenLimit int) []byte {
+		var receipt []byte
+		err := attester.clients.update("alice", func(state *ClientState) error {
+			attester.recordIssuance(state, "alice", anonOriginEnc, "index", "issuer.example", now)
+			receipt = attester.issuanceReceipt(state, "alice", anonOriginEnc, pat.RateLimitedTokenType, tokenLimit, now)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return receipt
+	}
+
+	receipt, err := openIssuanceReceipt(issue(10), publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	originHash := sha256.Sum256([]byte("anonymous origin"))
+	if receipt.TokenType != pat.RateLimitedTokenType || !bytes.Equal(receipt.OriginHash, originHash[:]) ||
+		receipt.Epoch != attester.policyEpoch(now) || receipt.IssuedAt != uint64(now.Unix()) {
+		t.Fatalf("unexpected receipt %+v", receipt)
+	}
+	if receipt.Remaining != 2 {
+		t.Fatalf("expected the origin bucket to bound the budget, got %d", receipt.Remaining)
+	}
+	if receipt, _ := openIssuanceReceipt(issue(3), publicKey); receipt.Remaining != 0 {
+		t.Fatalf("expected the issuer limit to bound the budget, got %d", receipt.Remaining)
+	}
+
+	signed := issue(10)
+	signed[0] ^= 1
+	if _, err := openIssuanceReceipt(signed, publicKey); err == nil {
+		t.Fatal("expected a tampered receipt to be refused")
+	}
+	if _, err := openIssuanceReceipt(signed[:10], nil); err == nil {
+		t.Fatal("expected a truncated receipt to be refused")
+	}
+}
+
+func TestReceiptLog(t *testing.T) {
+	key, _ := loadEd25519SigningKey("")
+	signed := signIssuanceReceipt(issuanceReceipt{
+		TokenType:  pat.RateLimitedTokenType,
+		OriginHash: make([]byte, sha256.Size),
+		Epoch:      7,
+		Remaining:  5,
+	}, key)
+
+	var events bytes.Buffer
+	receipts := newReceiptLog(&events, key.Public().(ed25519.PublicKey))
+	receipts.record("origin.example", marshalStructuredBinary(signed), time.Now())
+	otherKey, _ := loadEd25519SigningKey("")
+	receipts.record("origin.example", marshalStructuredBinary(signIssuanceReceipt(issuanceReceipt{OriginHash: make([]byte, sha256.Size)}, otherKey)), time.Now())
+
+	entry := receiptLogEntry{}
+	if err := json.Unmarshal(events.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Origin != "origin.example" || entry.Epoch != 7 || entry.Remaining != 5 || !entry.Verified {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	if bytes.Count(events.Bytes(), []byte("\n")) != 1 {
+		t.Fatal("expected receipts signed by another key not to be logged")
+	}
+
+	var nilLog *receiptLog
+	nilLog.record("origin.example", "", time.Now())
+}
@@ -1,17 +1,26 @@
 package commands
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
-	"strconv"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/pat-app/structuredfield"
 	pat "github.com/cloudflare/pat-go"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -38,59 +47,99 @@ type IssuerTokenKey struct {
 }
 
 type IssuerConfig struct {
-	TokenWindow       int              `json:"issuer-token-window"`  // policy window
-	RequestURI        string           `json:"issuer-request-uri"`   // request URI
-	TokenKeys         []IssuerTokenKey `json:"token-keys"`           // per-origin token key
-	IssuerEncapKeyURI string           `json:"issuer-encap-key-uri"` // issuer encapsulation key URI
+	TokenWindow       int                 `json:"issuer-token-window"`              // policy window
+	TokenWindows      []IssuerTokenWindow `json:"issuer-token-windows,omitempty"`   // per-origin limits per window
+	RequestURI        string              `json:"issuer-request-uri"`               // request URI
+	TokenKeys         []IssuerTokenKey    `json:"token-keys"`                       // per-origin token key
+	IssuerEncapKeyURI string              `json:"issuer-encap-key-uri"`             // issuer encapsulation key URI
+	VerificationURI   string              `json:"token-verification-uri,omitempty"` // token verification URI for origins
+
+	VerificationBundleURI string `json:"token-verification-bundle-uri,omitempty"` // signed verification bundle URI for origins
+	OHTTPKeysURI          string `json:"ohttp-keys-uri,omitempty"`                // Oblivious HTTP gateway key configuration URI
 }
 
 type Issuer struct {
-	name              string
-	debug             bool
+	name          string
+	debug         bool
+	ed25519Issuer *ed25519Issuer            // experimental, nil unless enabled
+	bundleKey     ed25519.PrivateKey        // signs verification bundles
+	scheduler     *fairScheduler            // nil unless signing is fair queued
+	attesterKeys  *requestSignatureVerifier // nil unless attester signatures are required
+	attesterCAs   *x509.CertPool            // nil unless attester client certificates are required
+	ohttpKey      *ohttpGatewayKey          // nil unless the Oblivious HTTP gateway is enabled
+
+	originAllowlist *originAllowlist // patterns of origins added on first request, none if nil
+
+	// lock guards the token issuers and policy, which the admin API replaces
+	lock              sync.RWMutex
 	rateLimitedIssuer *pat.RateLimitedIssuer
 	basicIssuer       *pat.BasicPublicIssuer
+	privateIssuer     *pat.BasicPrivateIssuer
+	privateTokenKey   *oprf.PrivateKey // key of privateIssuer, evaluates batched requests
+	origins           []string
+	originTokenLimit  int // defaultOriginTokenLimit if zero
+	tokenWindow       int // defaultTokenPolicyWindow if zero
+	tokenWindows      []IssuerTokenWindow
+	keyOverlap        time.Duration
+	faults            *issuerFaults     // breaks token responses on purpose, none if nil
+	retiredKeys       []retiredTokenKey // rotated away, still published until they expire
 }
 
-func (i Issuer) dumpRequest(label string, w http.ResponseWriter, req *http.Request) error {
+// policy returns the issuance policy. The caller holds the lock.
+func (i *Issuer) policy() issuerPolicy {
+	policy := issuerPolicy{
+		OriginTokenLimit: i.originTokenLimit,
+		TokenWindow:      i.tokenWindow,
+		TokenWindows:     append([]IssuerTokenWindow{}, i.tokenWindows...),
+		Origins:          append([]string{}, i.origins...),
+		OriginPatterns:   i.originAllowlist.formattedPatterns(),
+	}
+	if policy.OriginTokenLimit == 0 {
+		policy.OriginTokenLimit = defaultOriginTokenLimit
+	}
+	if policy.TokenWindow == 0 {
+		policy.TokenWindow = defaultTokenPolicyWindow
+	}
+	return policy
+}
+
+func (i *Issuer) dumpRequest(label string, w http.ResponseWriter, req *http.Request) error {
 	if i.debug {
 		reqEnc, err := httputil.DumpRequest(req, false)
 		if err != nil {
 			return err
 		}
-		log.Debugln(label+":", string(reqEnc))
+		log.Debugln(label, "from", req.RemoteAddr+":", string(reqEnc))
 	}
 	return nil
 }
 
-func (i Issuer) handleNameKeyRequest(w http.ResponseWriter, req *http.Request) {
+func (i *Issuer) handleNameKeyRequest(w http.ResponseWriter, req *http.Request) {
 	err := i.dumpRequest("Handling HPKE config request", w, req)
 	if err != nil {
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
 		return
 	}
 
+	i.lock.RLock()
+	nameKeyEnc := i.rateLimitedIssuer.NameKey().Marshal()
+	i.lock.RUnlock()
+
 	w.Header().Set("Content-Type", "application/issuer-name-key")
 	w.Header().Set("Connection", "close")
-	w.Write(i.rateLimitedIssuer.NameKey().Marshal())
+	w.Write(nameKeyEnc)
 }
 
-func (i Issuer) handleConfigRequest(w http.ResponseWriter, req *http.Request) {
-	err := i.dumpRequest("Handling config request", w, req)
-	if err != nil {
-		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
-		return
-	}
-
+// config returns the issuer directory. The caller holds the lock.
+func (i *Issuer) config() (IssuerConfig, error) {
 	basicTokenKeyEnc, err := marshalTokenKey(i.basicIssuer.TokenKey(), false)
 	if err != nil {
-		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
-		return
+		return IssuerConfig{}, err
 	}
 
 	rateLimitedTokenKeyEnc, err := marshalTokenKey(i.rateLimitedIssuer.TokenKey(), false)
 	if err != nil {
-		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
-		return
+		return IssuerConfig{}, err
 	}
 
 	tokenKeys := make([]IssuerTokenKey, 0)
@@ -102,12 +151,66 @@ func (i Issuer) handleConfigRequest(w http.ResponseWriter, req *http.Request) {
 		TokenType: int(pat.RateLimitedTokenType),
 		TokenKey:  base64.URLEncoding.EncodeToString(rateLimitedTokenKeyEnc),
 	})
+	// Retired keys follow the current ones, which clients and origins use first
+	for _, retiredKey := range i.publishedTokenKeys(time.Now()) {
+		retiredKeyEnc, err := marshalTokenKey(retiredKey, false)
+		if err != nil {
+			return IssuerConfig{}, err
+		}
+		for _, tokenType := range []uint16{pat.BasicPublicTokenType, pat.RateLimitedTokenType} {
+			tokenKeys = append(tokenKeys, IssuerTokenKey{
+				TokenType: int(tokenType),
+				TokenKey:  base64.URLEncoding.EncodeToString(retiredKeyEnc),
+			})
+		}
+	}
+	if i.privateIssuer != nil {
+		privateTokenKeyEnc, err := i.privateIssuer.TokenKey().MarshalBinary()
+		if err != nil {
+			return IssuerConfig{}, err
+		}
+		tokenKeys = append(tokenKeys, IssuerTokenKey{
+			TokenType: int(pat.BasicPrivateTokenType),
+			TokenKey:  base64.URLEncoding.EncodeToString(privateTokenKeyEnc),
+		})
+	}
+	if i.ed25519Issuer != nil {
+		tokenKeys = append(tokenKeys, IssuerTokenKey{
+			TokenType: int(ed25519TokenType),
+			TokenKey:  base64.URLEncoding.EncodeToString(i.ed25519Issuer.TokenKey()),
+		})
+	}
 
 	config := IssuerConfig{
-		TokenWindow:       defaultTokenPolicyWindow,
+		TokenWindow:       i.policy().TokenWindow,
+		TokenWindows:      i.tokenWindows,
 		RequestURI:        "https://" + i.name + tokenRequestURI,
 		IssuerEncapKeyURI: "https://" + i.name + issuerEncapKeyURI,
 		TokenKeys:         tokenKeys,
+		VerificationURI:   "https://" + i.name + tokenVerificationURI,
+	}
+	if i.bundleKey != nil {
+		config.VerificationBundleURI = "https://" + i.name + verificationBundleURI
+	}
+	if i.ohttpKey != nil {
+		config.OHTTPKeysURI = "https://" + i.name + issuerOHTTPKeysURI
+	}
+	return config, nil
+}
+
+func (i *Issuer) handleConfigRequest(w http.ResponseWriter, req *http.Request) {
+	err := i.dumpRequest("Handling config request", w, req)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	i.lock.RLock()
+	config, err := i.config()
+	i.lock.RUnlock()
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
 	}
 
 	jsonResp, err := json.Marshal(config)
@@ -122,7 +225,7 @@ func (i Issuer) handleConfigRequest(w http.ResponseWriter, req *http.Request) {
 	w.Write(jsonResp)
 }
 
-func (i Issuer) handleIssuanceRequest(w http.ResponseWriter, req *http.Request) {
+func (i *Issuer) handleIssuanceRequest(w http.ResponseWriter, req *http.Request) {
 	err := i.dumpRequest("Handling issuance request", w, req)
 	if err != nil {
 		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
@@ -135,7 +238,8 @@ func (i Issuer) handleIssuanceRequest(w http.ResponseWriter, req *http.Request)
 		http.Error(w, "Invalid method", 400)
 		return
 	}
-	if req.Header.Get("Content-Type") != tokenRequestMediaType {
+	batched := req.Header.Get("Content-Type") == batchedTokenRequestMediaType
+	if req.Header.Get("Content-Type") != tokenRequestMediaType && !batched {
 		log.Debugln("Invalid content type, expected", tokenRequestMediaType, "got", req.Header.Get("Content-Type"))
 		w.Header().Set("Connection", "close")
 		http.Error(w, "Invalid Content-Type", 400)
@@ -150,6 +254,44 @@ func (i Issuer) handleIssuanceRequest(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	if !i.verifyAttesterCertificate(w, req) || !i.verifyAttesterSignature(w, req, body) {
+		return
+	}
+	i.serveTokenRequest(w, req, batched, body)
+}
+
+// serveTokenRequest issues tokens for the request body, scheduled for the
+// attester sending req.
+func (i *Issuer) serveTokenRequest(w http.ResponseWriter, req *http.Request, batched bool, body []byte) {
+	if status := i.faults.storm(body, time.Now()); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w = i.faults.responseWriter(w, body)
+
+	cost := 1
+	if batched {
+		if tokenRequest, err := unmarshalBatchedTokenRequest(body); err == nil {
+			cost = len(tokenRequest.blindedElements)
+		}
+	}
+	release, err := i.scheduler.acquire(req.Context(), requestAttester(req), cost)
+	if err != nil {
+		log.Debugln("Token request not scheduled:", err)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Issuer busy", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	if batched {
+		i.issueBatch(w, body)
+		return
+	}
+
 	tokenType := binary.BigEndian.Uint16(body)
 	if tokenType == pat.RateLimitedTokenType {
 		var tokenRequest pat.RateLimitedTokenRequest
@@ -160,17 +302,30 @@ func (i Issuer) handleIssuanceRequest(w http.ResponseWriter, req *http.Request)
 			return
 		}
 
-		tokenResponse, blindRequest, err := i.rateLimitedIssuer.Evaluate(&tokenRequest)
-		if err != nil {
+		tokenResponse, blindRequest, err := i.evaluateRateLimited(&tokenRequest)
+		if origin, ok := unknownOrigin(err); ok {
+			log.Debugln("Refusing token request for origin", origin, "outside the allowlist")
+			issuerOriginRefusals.Inc(pat.RateLimitedTokenType)
+			w.Header().Set("Connection", "close")
+			writeOriginNotAllowed(w)
+			return
+		} else if err != nil {
 			log.Debugln("Token evaluation failed:", err)
 			w.Header().Set("Connection", "close")
 			http.Error(w, "Token evaluation failed", 400)
 			return
 		}
 
+		tokenLimit, err := structuredfield.MarshalInteger(int64(i.policy().OriginTokenLimit))
+		if err != nil {
+			log.Println("Invalid origin token limit:", err)
+			http.Error(w, "Invalid origin token limit", http.StatusInternalServerError)
+			return
+		}
+
 		w.Header().Set("content-type", tokenResponseMediaType)
 		w.Header().Set("Connection", "close")
-		w.Header().Set(headerTokenLimit, strconv.Itoa(defaultOriginTokenLimit))
+		w.Header().Set(headerTokenLimit, tokenLimit)
 		w.Header().Set(headerTokenOrigin, marshalStructuredBinary(blindRequest))
 		w.Write(tokenResponse)
 	} else if tokenType == pat.BasicPublicTokenType {
@@ -193,20 +348,78 @@ func (i Issuer) handleIssuanceRequest(w http.ResponseWriter, req *http.Request)
 		w.Header().Set("content-type", tokenResponseMediaType)
 		w.Header().Set("Connection", "close")
 		w.Write(tokenResponse)
+	} else if tokenType == pat.BasicPrivateTokenType && i.privateIssuer != nil {
+		tokenRequest, err := unmarshalPrivateTokenRequest(body)
+		if err != nil {
+			log.Debugln("Failed decoding token request")
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Failed decoding token request", 400)
+			return
+		}
+
+		tokenResponse, err := evaluatePrivateTokenRequest(i.privateIssuer, tokenRequest)
+		if err != nil {
+			log.Debugln("Token evaluation failed:", err)
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Token evaluation failed", 400)
+			return
+		}
+
+		w.Header().Set("content-type", tokenResponseMediaType)
+		w.Header().Set("Connection", "close")
+		w.Write(tokenResponse)
+	} else if tokenType == ed25519TokenType && i.ed25519Issuer != nil {
+		tokenRequest, err := unmarshalEd25519TokenRequest(body)
+		if err != nil {
+			log.Debugln("Failed decoding token request")
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Failed decoding token request", 400)
+			return
+		}
+
+		tokenResponse, err := i.ed25519Issuer.Evaluate(tokenRequest)
+		if err != nil {
+			log.Debugln("Token evaluation failed:", err)
+			w.Header().Set("Connection", "close")
+			http.Error(w, "Token evaluation failed", 400)
+			return
+		}
+
+		w.Header().Set("content-type", tokenResponseMediaType)
+		w.Header().Set("Connection", "close")
+		w.Write(tokenResponse)
+	} else {
+		w.Header().Set("Connection", "close")
+		writeUnsupportedTokenType(w, unsupportedTokenTypeError{role: "issuer", tokenType: tokenType, supported: i.supportedTokenTypes()})
+	}
+}
+
+// supportedTokenTypes returns the token types the issuer issues, in ascending
+// order.
+func (i *Issuer) supportedTokenTypes() []uint16 {
+	tokenTypes := make([]uint16, 0, 4)
+	if i.privateIssuer != nil {
+		tokenTypes = append(tokenTypes, pat.BasicPrivateTokenType)
+	}
+	tokenTypes = append(tokenTypes, pat.BasicPublicTokenType, pat.RateLimitedTokenType)
+	if i.ed25519Issuer != nil {
+		tokenTypes = append(tokenTypes, ed25519TokenType)
 	}
+	return tokenTypes
 }
 
 func startIssuer(c *cli.Context) error {
-	cert := c.String("cert")
-	key := c.String("key")
+	certs := c.StringSlice("cert")
+	keys := c.StringSlice("key")
+	certDir := c.String("cert-dir")
 	port := c.String("port")
 	logLevel := c.String("log")
 	name := c.String("name")
 
-	if cert == "" {
+	if len(certs) == 0 && certDir == "" {
 		log.Fatal("Invalid key material (missing certificate). See README for configuration.")
 	}
-	if key == "" {
+	if len(keys) != len(certs) {
 		log.Fatal("Invalid key material (missing private key). See README for configuration.")
 	}
 	if name == "" {
@@ -221,36 +434,230 @@ func startIssuer(c *cli.Context) error {
 		log.SetLevel(log.InfoLevel)
 	}
 
+	options := serverOptionsFromFlags(c)
+	if err := options.validate(); err != nil {
+		log.Fatal(err, ". See README for configuration.")
+	}
+
+	config := effectiveConfigFromFlags(c, "issuer")
+	if c.Bool("print-config") {
+		return printConfig(os.Stdout, config)
+	}
+	logStartupBanner(config, port)
+
+	tlsConfig, err := newServerTLSConfig(certs, keys, certDir)
+	if err != nil {
+		log.Fatal("Invalid key material: ", err)
+	}
+
+	proxies, err := parseTrustedProxies(c.StringSlice("trusted-proxies"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// XXX(caw): key size is a function of the token issuace protocol
 	tokenKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return err
 	}
 
+	bundleKey, err := loadEd25519SigningKey(c.String("verification-bundle-signing-key"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infoln("Signing verification bundles with key", hex.EncodeToString(bundleKey.Public().(ed25519.PublicKey)))
+
+	privateTokenKey, err := loadPrivateTokenKey(c.String("private-token-key"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var scheduler *fairScheduler
+	if slots := c.Int("fair-queue-slots"); slots > 0 {
+		weights, err := parseAttesterWeights(c.StringSlice("attester-weight"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		depth := c.Int("fair-queue-depth")
+		if depth <= 0 {
+			log.Fatal("Invalid fair queue depth. See README for configuration.")
+		}
+		scheduler = newFairScheduler(slots, depth, weights)
+	} else if c.Int("fair-queue-slots") < 0 {
+		log.Fatal("Invalid fair queue slots. See README for configuration.")
+	}
+
+	rotationInterval := c.Duration("key-rotation-interval")
+	if rotationInterval < 0 {
+		log.Fatal("Invalid key rotation interval. See README for configuration.")
+	}
+	keyOverlap := c.Duration("key-overlap")
+	if keyOverlap < 0 {
+		log.Fatal("Invalid key overlap. See README for configuration.")
+	}
+	stormDuration := c.Duration("fault-storm-duration")
+	if stormDuration <= 0 {
+		log.Fatal("Invalid fault storm duration. See README for configuration.")
+	}
+	// Faults can be enabled through the admin API later on
+	faults, err := newIssuerFaults(issuerFaultSettings{
+		Faults:      c.StringSlice("simulate-fault"),
+		Probability: c.Float64("fault-probability"),
+	}, stormDuration)
+	if err != nil {
+		log.Fatal(err, ". See README for configuration.")
+	}
+	if len(c.StringSlice("simulate-fault")) > 0 {
+		log.Warnln("Issuer deliberately breaks token responses, simulating", faults)
+	}
+
 	basicIssuer := pat.NewBasicPublicIssuer(tokenKey)
 	rateLimitedIssuer := pat.NewRateLimitedIssuer(tokenKey)
 	origins := c.StringSlice("origins")
-	if len(origins) > 0 {
-		for _, origin := range origins {
+	var allowlist *originAllowlist
+	if allowlistFile := c.String("origin-allowlist"); allowlistFile != "" {
+		if allowlist, err = loadOriginAllowlist(allowlistFile); err != nil {
+			log.Fatal("Invalid origin allowlist: ", err, ". See README for configuration.")
+		}
+		origins = append(origins, allowlist.names...)
+	} else if len(origins) == 0 {
+		origins = []string{"origin.example"}
+	}
+	registered := make([]string, 0, len(origins))
+	for _, origin := range origins {
+		if rateLimitedIssuer.OriginIndexKey(origin) == nil {
 			rateLimitedIssuer.AddOrigin(origin)
+			registered = append(registered, origin)
 		}
-	} else {
-		rateLimitedIssuer.AddOrigin("origin.example")
 	}
+	origins = registered
 
-	issuer := Issuer{
+	issuer := &Issuer{
 		name:              name,
 		debug:             logLevel == "verbose",
 		rateLimitedIssuer: rateLimitedIssuer,
 		basicIssuer:       basicIssuer,
+		privateIssuer:     pat.NewBasicPrivateIssuer(privateTokenKey),
+		privateTokenKey:   privateTokenKey,
+		origins:           origins,
+		originAllowlist:   allowlist,
+		bundleKey:         bundleKey,
+		scheduler:         scheduler,
+		keyOverlap:        keyOverlap,
+		faults:            faults,
+	}
+	if issuer.tokenWindows, err = parseTokenWindows(c.StringSlice("token-window")); err != nil {
+		log.Fatal(err)
+	}
+	if attesterKeys := c.StringSlice("attester-key"); len(attesterKeys) > 0 {
+		keys, err := parseAttesterKeys(attesterKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		skew := c.Duration("attester-signature-skew")
+		if skew <= 0 {
+			log.Fatal("Invalid attester signature skew. See README for configuration.")
+		}
+		issuer.attesterKeys = newRequestSignatureVerifier(keys, skew)
+		log.Infoln("Requiring token requests signed by one of", len(keys), "attester keys")
+	}
+	if c.Bool("experimental-ed25519") {
+		issuer.ed25519Issuer, err = newEd25519Issuer()
+		if err != nil {
+			return err
+		}
+		log.Infoln("Issuing experimental Ed25519 tokens (type 0xED25)")
+	}
+	if c.Bool("ohttp-gateway") {
+		issuer.ohttpKey, err = loadOHTTPGatewayKey(c.String("ohttp-key"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infoln("Serving token requests over Oblivious HTTP with key configuration", hex.EncodeToString(issuer.ohttpKey.config.Marshal()))
+	} else if c.String("ohttp-key") != "" {
+		log.Fatal("Invalid Oblivious HTTP key (the gateway is disabled). See README for configuration.")
+	}
+
+	if c.Bool("self-test") {
+		if err := runSelfTest("issuer", issuer.selfTestChecks()); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	http.HandleFunc(issuerConfigURI, issuer.handleConfigRequest)
-	http.HandleFunc(tokenRequestURI, issuer.handleIssuanceRequest)
-	http.HandleFunc(issuerEncapKeyURI, issuer.handleNameKeyRequest)
-	err = http.ListenAndServeTLS(":"+port, cert, key, nil)
+	// Admins and attesters present client certificates on the same listener,
+	// each checked against its own CAs
+	clientCAFiles := make([]string, 0)
+	if attesterCAFile := c.String("attester-client-ca"); attesterCAFile != "" {
+		if options.h2c {
+			log.Fatal("Invalid attester client CA (h2c serves without TLS). See README for configuration.")
+		}
+		issuer.attesterCAs, err = loadClientCAs(attesterCAFile)
+		if err != nil {
+			log.Fatal("Invalid attester client CA: ", err)
+		}
+		clientCAFiles = append(clientCAFiles, attesterCAFile)
+		log.Infoln("Requiring token requests from attesters with client certificates issued by", attesterCAFile)
+	}
+	authenticators := make([]adminAuthenticator, 0)
+	if clientCAFile := c.String("admin-client-ca"); clientCAFile != "" {
+		roots, err := loadClientCAs(clientCAFile)
+		if err != nil {
+			log.Fatal("Invalid admin client CA: ", err)
+		}
+		clientCAFiles = append(clientCAFiles, clientCAFile)
+		authenticators = append(authenticators, clientCertAuthenticator(roots))
+	}
+	if len(clientCAFiles) > 0 {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if tlsConfig.ClientCAs, err = loadClientCAs(clientCAFiles...); err != nil {
+			log.Fatal("Invalid client CA: ", err)
+		}
+	}
+	if hmacKeys := c.StringSlice("admin-hmac-key"); len(hmacKeys) > 0 {
+		keys, err := parseAdminHMACKeys(hmacKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		skew := c.Duration("admin-hmac-skew")
+		if skew <= 0 {
+			log.Fatal("Invalid admin HMAC skew. See README for configuration.")
+		}
+		authenticators = append(authenticators, hmacAuthenticator(keys, skew))
+	}
+	auditLog, err := openEventLog(c.String("admin-audit-log"))
 	if err != nil {
-		log.Fatal("ListenAndServeTLS: ", err)
+		log.Fatal("Invalid admin audit log: ", err)
+	}
+	if auditLog != nil && len(authenticators) == 0 {
+		log.Fatal("Invalid admin audit log: the admin API requires --admin-client-ca or --admin-hmac-key")
+	}
+	mux := http.NewServeMux()
+	if len(authenticators) > 0 {
+		admin := issuer.newAdminServer(authenticators, newAdminAudit(auditLog))
+		admin.serveConfig(config)
+		mux.Handle(adminURIPrefix, admin)
+	}
+
+	mux.HandleFunc(issuerConfigURI, issuer.handleConfigRequest)
+	mux.HandleFunc(tokenRequestURI, instrumentTokenRequests("issuer", issuerRequests, issuerRequestDuration, issuer.handleIssuanceRequest))
+	mux.HandleFunc(issuerEncapKeyURI, issuer.handleNameKeyRequest)
+	mux.HandleFunc(tokenVerificationURI, issuer.handleVerificationRequest)
+	mux.HandleFunc(verificationBundleURI, issuer.handleVerificationBundleRequest)
+	if issuer.ohttpKey != nil {
+		mux.HandleFunc(issuerOHTTPKeysURI, issuer.handleOHTTPKeysRequest)
+		mux.HandleFunc(issuerOHTTPGatewayURI, issuer.handleOHTTPGatewayRequest)
+	}
+
+	life := newLifecycle("issuer", options.shutdownTimeout)
+	life.onShutdown("admin audit log", func() error { return closeEventLog(auditLog) })
+	life.goBackground(func(ctx context.Context) {
+		issuer.runKeyRotation(ctx, rotationInterval)
+	})
+	if options.metricsAddr != "" {
+		life.serveMetrics(options.metricsAddr)
 	}
-	return err
+	handler := withClientAddr(mux, proxies)
+	localRoles.register("issuer", name, handler)
+	life.serveTLS(newServer(port, tlsConfig, handler, options), options.http3)
+	return life.wait()
 }
@@ -0,0 +1,163 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	adminPolicyURI       = adminURIPrefix + "policy"
+	adminPolicyUpdateURI = adminURIPrefix + "policy/update"
+	adminRotateKeysURI   = adminURIPrefix + "keys/rotate"
+)
+
+type issuerPolicy struct {
+	OriginTokenLimit int                 `json:"origin_token_limit"`
+	TokenWindow      int                 `json:"token_window"`
+	TokenWindows     []IssuerTokenWindow `json:"token_windows"`
+	Origins          []string            `json:"origins"`
+	OriginPatterns   []string            `json:"origin_patterns,omitempty"`
+}
+
+// issuerPolicyUpdate changes the set fields of the policy. Origins can only
+// be added, and token windows are replaced, an empty list removing them.
+type issuerPolicyUpdate struct {
+	OriginTokenLimit int                  `json:"origin_token_limit,omitempty"`
+	TokenWindow      int                  `json:"token_window,omitempty"`
+	TokenWindows     *[]IssuerTokenWindow `json:"token_windows,omitempty"`
+	AddOrigins       []string             `json:"add_origins,omitempty"`
+}
+
+type keyRotationResponse struct {
+	TokenKeyID string `json:"token_key_id"`
+}
+
+// rotateKeys replaces the token key shared by both token types, the
+// encapsulation key, and the per-origin index keys, and returns the new token
+// key ID. The previous token key stays published for the key overlap, so that
+// tokens issued under it keep verifying until then.
+func (i *Issuer) rotateKeys(trigger string) ([]byte, error) {
+	tokenKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	basicIssuer := pat.NewBasicPublicIssuer(tokenKey)
+	rateLimitedIssuer := pat.NewRateLimitedIssuer(tokenKey)
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for _, origin := range i.origins {
+		if err := rateLimitedIssuer.AddOrigin(origin); err != nil {
+			return nil, err
+		}
+	}
+	i.retireTokenKey(i.rateLimitedIssuer.TokenKey(), time.Now())
+	i.basicIssuer = basicIssuer
+	i.rateLimitedIssuer = rateLimitedIssuer
+	issuerKeyRotations.Inc(0, trigger)
+	return rateLimitedIssuer.TokenKeyID(), nil
+}
+
+func (i *Issuer) updatePolicy(update issuerPolicyUpdate) (issuerPolicy, error) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	for _, origin := range update.AddOrigins {
+		if i.rateLimitedIssuer.OriginIndexKey(origin) != nil {
+			continue
+		}
+		if err := i.rateLimitedIssuer.AddOrigin(origin); err != nil {
+			return issuerPolicy{}, err
+		}
+		i.origins = append(i.origins, origin)
+	}
+	if update.OriginTokenLimit != 0 {
+		i.originTokenLimit = update.OriginTokenLimit
+	}
+	if update.TokenWindow != 0 {
+		i.tokenWindow = update.TokenWindow
+	}
+	if update.TokenWindows != nil {
+		i.tokenWindows = append([]IssuerTokenWindow{}, *update.TokenWindows...)
+	}
+	return i.policy(), nil
+}
+
+func (i *Issuer) handlePolicy(w http.ResponseWriter, req *http.Request) {
+	i.lock.RLock()
+	policy := i.policy()
+	i.lock.RUnlock()
+	writeAdminJSON(w, policy)
+}
+
+func (i *Issuer) handlePolicyUpdate(w http.ResponseWriter, req *http.Request) {
+	var update issuerPolicyUpdate
+	if err := readAdminJSON(req, &update); err != nil {
+		http.Error(w, "Invalid policy update: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.OriginTokenLimit < 0 || update.TokenWindow < 0 {
+		http.Error(w, "Invalid policy update: negative limit or window", http.StatusBadRequest)
+		return
+	}
+	if update.TokenWindows != nil {
+		if err := validateTokenWindows(*update.TokenWindows); err != nil {
+			http.Error(w, "Invalid policy update: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, origin := range update.AddOrigins {
+		if origin == "" {
+			http.Error(w, "Invalid policy update: empty origin", http.StatusBadRequest)
+			return
+		}
+	}
+
+	policy, err := i.updatePolicy(update)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, policy)
+}
+
+func (i *Issuer) handleRotateKeys(w http.ResponseWriter, req *http.Request) {
+	keyID, err := i.rotateKeys(keyRotationAdmin)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infoln("Rotated issuer keys, token key ID", hex.EncodeToString(keyID))
+	writeAdminJSON(w, keyRotationResponse{TokenKeyID: hex.EncodeToString(keyID)})
+}
+
+// newAdminServer serves the issuer admin API. Unlike other roles it does not
+// accept bearer tokens, only the given authenticators.
+func (i *Issuer) newAdminServer(authenticators []adminAuthenticator, audit *adminAudit) *adminServer {
+	admin := newAdminServer("issuer", "")
+	for _, authenticator := range authenticators {
+		admin.authenticate(authenticator)
+	}
+	admin.audit = audit
+	admin.handle(http.MethodGet, adminPolicyURI, "Current issuance policy",
+		nil, issuerPolicy{}, i.handlePolicy)
+	admin.handle(http.MethodPost, adminPolicyUpdateURI, "Change the origin token limit or token window, or add origins",
+		issuerPolicyUpdate{}, issuerPolicy{}, i.handlePolicyUpdate)
+	admin.handle(http.MethodPost, adminRotateKeysURI, "Replace the token, encapsulation, and origin index keys, keeping the previous token key published for the key overlap",
+		nil, keyRotationResponse{}, i.handleRotateKeys)
+	admin.handle(http.MethodGet, adminStateSummaryURI, "Counts of origins, token windows, and keys, without origin names or keys",
+		nil, issuerStateSummary{}, i.handleStateSummary)
+	if i.faults != nil {
+		admin.handle(http.MethodGet, adminFaultsURI, "Faults injected into token responses",
+			nil, issuerFaultSettings{}, i.handleFaults)
+		admin.handle(http.MethodPost, adminFaultsUpdateURI, "Replace the faults injected into token responses, none to stop",
+			issuerFaultSettings{}, issuerFaultSettings{}, i.handleFaultsUpdate)
+	}
+	return admin
+}
@@ -0,0 +1,228 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAdminHMACKey = bytes.Repeat([]byte{0x42}, 32)
+
+func newTestAdminRequest(method, uri string, body string) *http.Request {
+	if body == "" {
+		return httptest.NewRequest(method, uri, nil)
+	}
+	return httptest.NewRequest(method, uri, strings.NewReader(body))
+}
+
+func serveAdmin(admin *adminServer, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminBodyLimit(t *testing.T) {
+	var audit bytes.Buffer
+	issuer := newTestIssuer(t, "issuer.example")
+	authenticator := hmacAuthenticator(map[string][]byte{"ops": testAdminHMACKey}, defaultAdminHMACSkew)
+	admin := issuer.newAdminServer([]adminAuthenticator{authenticator}, newAdminAudit(&audit))
+
+	// Bodies are bounded before any authenticator reads them
+	req := newTestAdminRequest(http.MethodPost, adminPolicyUpdateURI, strings.Repeat(" ", adminMaxBody+1))
+	if w := serveAdmin(admin, req); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", w.Code)
+	}
+	if !strings.Contains(audit.String(), `"status":413`) {
+		t.Fatalf("expected the refused request to be audited, got %q", audit.String())
+	}
+	req = newTestAdminRequest(http.MethodPost, adminPolicyUpdateURI, `{"origin_token_limit": 5}`)
+	if err := signAdminRequest(req, "ops", testAdminHMACKey, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveAdmin(admin, req); w.Code != http.StatusOK {
+		t.Fatalf("expected a small signed request to succeed, got %d", w.Code)
+	}
+}
+
+func createTestClientCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	certEnc, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestIssuerAdminHMAC(t *testing.T) {
+	var audit bytes.Buffer
+	issuer := newTestIssuer(t, "issuer.example")
+	authenticator := hmacAuthenticator(map[string][]byte{"ops": testAdminHMACKey}, defaultAdminHMACSkew)
+	admin := issuer.newAdminServer([]adminAuthenticator{authenticator}, newAdminAudit(&audit))
+
+	update := func(keyID string, key []byte, signedAt time.Time) *http.Request {
+		req := newTestAdminRequest(http.MethodPost, adminPolicyUpdateURI, `{"origin_token_limit": 5}`)
+		if err := signAdminRequest(req, keyID, key, signedAt); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	now := time.Now()
+	if w := serveAdmin(admin, update("ops", testAdminHMACKey, now)); w.Code != http.StatusOK {
+		t.Fatalf("expected signed request to succeed, got %d", w.Code)
+	}
+	if issuer.policy().OriginTokenLimit != 5 {
+		t.Fatal("expected the policy to be updated")
+	}
+
+	// Replays, stale signatures, unknown keys, tampered bodies, and bearer
+	// tokens are refused
+	tampered := update("ops", testAdminHMACKey, now.Add(time.Second))
+	tampered.Body = newTestAdminRequest(http.MethodPost, adminPolicyUpdateURI, `{"origin_token_limit": 500}`).Body
+	bearer := newTestAdminRequest(http.MethodGet, adminPolicyURI, "")
+	bearer.Header.Set("Authorization", "Bearer "+hex.EncodeToString(testAdminHMACKey))
+	for _, req := range []*http.Request{
+		update("ops", testAdminHMACKey, now),
+		update("ops", testAdminHMACKey, now.Add(-2*defaultAdminHMACSkew)),
+		update("other", testAdminHMACKey, now),
+		update("ops", bytes.Repeat([]byte{0x24}, 32), now),
+		tampered,
+		bearer,
+	} {
+		w := serveAdmin(admin, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for %s, got %d", req.Header.Get("Authorization"), w.Code)
+		}
+		if w.Header().Get("WWW-Authenticate") != adminHMACScheme {
+			t.Fatal("expected the HMAC scheme to be advertised")
+		}
+	}
+	if issuer.policy().OriginTokenLimit != 5 {
+		t.Fatal("expected refused requests not to change the policy")
+	}
+
+	entries := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(entries) != 7 {
+		t.Fatalf("expected 7 audit entries, got %d", len(entries))
+	}
+	entry := adminAuditEntry{}
+	if err := json.Unmarshal([]byte(entries[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Role != "issuer" || entry.Principal != "hmac:ops" || entry.Status != http.StatusOK ||
+		entry.Path != adminPolicyUpdateURI || string(entry.Request) != `{"origin_token_limit":5}` {
+		t.Fatalf("unexpected audit entry %+v", entry)
+	}
+	refused := adminAuditEntry{}
+	if err := json.Unmarshal([]byte(entries[len(entries)-1]), &refused); err != nil {
+		t.Fatal(err)
+	}
+	if refused.Principal != "" || refused.Status != http.StatusUnauthorized {
+		t.Fatalf("expected refused request to be audited, got %+v", refused)
+	}
+}
+
+func TestIssuerAdminClientCert(t *testing.T) {
+	ca, caKey := createTestClientCert(t, "Test CA", nil, nil)
+	client, _ := createTestClientCert(t, "operator", ca, caKey)
+	otherCA, otherKey := createTestClientCert(t, "Other CA", nil, nil)
+	stranger, _ := createTestClientCert(t, "stranger", otherCA, otherKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	issuer := newTestIssuer(t, "issuer.example")
+	admin := issuer.newAdminServer([]adminAuthenticator{clientCertAuthenticator(roots)}, nil)
+
+	rotate := func(cert *x509.Certificate) int {
+		req := newTestAdminRequest(http.MethodPost, adminRotateKeysURI, "")
+		if cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+		return serveAdmin(admin, req).Code
+	}
+
+	keyID := issuer.rateLimitedIssuer.TokenKeyID()
+	if code := rotate(nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a client certificate, got %d", code)
+	}
+	if code := rotate(stranger); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an untrusted client certificate, got %d", code)
+	}
+	if !bytes.Equal(issuer.rateLimitedIssuer.TokenKeyID(), keyID) {
+		t.Fatal("expected refused rotation to keep the keys")
+	}
+	if code := rotate(client); code != http.StatusOK {
+		t.Fatalf("expected rotation to succeed, got %d", code)
+	}
+	if bytes.Equal(issuer.rateLimitedIssuer.TokenKeyID(), keyID) {
+		t.Fatal("expected rotated token key")
+	}
+}
+
+func TestIssuerPolicyUpdate(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	issuer.origins = []string{"origin.example"}
+	issuer.rateLimitedIssuer.AddOrigin("origin.example")
+
+	policy, err := issuer.updatePolicy(issuerPolicyUpdate{TokenWindow: 3600, AddOrigins: []string{"origin.example", "other.example"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.OriginTokenLimit != defaultOriginTokenLimit || policy.TokenWindow != 3600 || len(policy.Origins) != 2 {
+		t.Fatalf("unexpected policy %+v", policy)
+	}
+	if _, err := issuer.rotateKeys(keyRotationAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if issuer.rateLimitedIssuer.OriginIndexKey("other.example") == nil {
+		t.Fatal("expected rotated keys to cover added origins")
+	}
+}
+
+func TestParseAdminHMACKeys(t *testing.T) {
+	keyEnc := hex.EncodeToString(testAdminHMACKey)
+	keys, err := parseAdminHMACKeys([]string{"ops:" + keyEnc, "ci:" + keyEnc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+	for _, spec := range []string{keyEnc, ":" + keyEnc, "ops:00", "ops:zz", "ops:" + keyEnc + ",ops:" + keyEnc} {
+		if _, err := parseAdminHMACKeys(strings.Split(spec, ",")); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
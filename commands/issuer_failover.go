@@ -0,0 +1,276 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Consecutive failures after which an issuer endpoint is considered unhealthy
+	issuerUnhealthyThreshold = 3
+	// Time an unhealthy issuer endpoint is tried only after healthy ones
+	issuerHealthCooldown = 30 * time.Second
+	// Metric label of issuers reached under a name clients sent
+	issuerEndpointOther = "other"
+)
+
+// issuerEndpoint tracks the health of a single issuer host.
+type issuerEndpoint struct {
+	host           string // host[:port], as logged and labeled in metrics
+	uri            string // token request URI
+	unconfigured   bool   // reached under the issuer name the client sent
+	failures       int    // consecutive failures
+	unhealthyUntil time.Time
+}
+
+// newIssuerEndpoint parses an endpoint given either as host[:port], reached
+// at the standard token request path over HTTPS, or as an absolute URL with
+// its own scheme, port, and path. URLs without a path use the standard one.
+func newIssuerEndpoint(spec string) (*issuerEndpoint, error) {
+	if !strings.Contains(spec, "://") {
+		uri, err := composeURL(spec, tokenRequestURI)
+		if err != nil {
+			return nil, err
+		}
+		return &issuerEndpoint{host: spec, uri: uri}, nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid issuer endpoint %q, expected an http or https URL", spec)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = tokenRequestURI
+	}
+	return &issuerEndpoint{host: u.Host, uri: u.String()}, nil
+}
+
+// directoryURI returns the URI of the issuer directory at the endpoint.
+func (e *issuerEndpoint) directoryURI() string {
+	return e.resolve(issuerConfigURI)
+}
+
+// resolve returns the URI of path at the endpoint, or its token request URI
+// if path is empty.
+func (e *issuerEndpoint) resolve(path string) string {
+	if path == "" {
+		return e.uri
+	}
+	u, err := url.Parse(e.uri)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + path
+}
+
+// label names the endpoint in metrics. Issuer names come from clients, so
+// endpoints not configured share a label.
+func (e *issuerEndpoint) label() string {
+	if e.unconfigured {
+		return issuerEndpointOther
+	}
+	return e.host
+}
+
+func (e *issuerEndpoint) healthy(now time.Time) bool {
+	return !now.Before(e.unhealthyUntil)
+}
+
+// issuerPool maps logical issuer names, as they appear in token challenges,
+// to an ordered list of endpoints. Issuers without a configured list are
+// reached directly under their name.
+type issuerPool struct {
+	lock      sync.Mutex
+	endpoints map[string][]*issuerEndpoint
+	timeout   time.Duration  // per attempt, zero for none
+	signer    *requestSigner // signs forwarded requests, nil for none
+}
+
+// parseIssuerFailover parses name=endpoint[,endpoint...] specifications,
+// primary first. Endpoints are host[:port] or token request URLs.
+func parseIssuerFailover(specs []string) (map[string][]string, error) {
+	failover := make(map[string][]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid issuer failover %q, expected name=endpoint[,endpoint...]", spec)
+		}
+		for _, host := range strings.Split(parts[1], ",") {
+			host = strings.TrimSpace(host)
+			if host == "" {
+				return nil, fmt.Errorf("Invalid issuer failover %q, empty host", spec)
+			}
+			if _, err := newIssuerEndpoint(host); err != nil {
+				return nil, err
+			}
+			failover[parts[0]] = append(failover[parts[0]], host)
+		}
+	}
+	return failover, nil
+}
+
+func newIssuerPool(failover map[string][]string, timeout time.Duration) *issuerPool {
+	endpoints := make(map[string][]*issuerEndpoint)
+	for name, hosts := range failover {
+		for _, host := range hosts {
+			endpoint, err := newIssuerEndpoint(host)
+			if err != nil {
+				log.Warnln("Ignoring issuer endpoint", host, "for", name, ":", err)
+				continue
+			}
+			endpoints[name] = append(endpoints[name], endpoint)
+		}
+	}
+	return &issuerPool{
+		endpoints: endpoints,
+		timeout:   timeout,
+	}
+}
+
+// candidates returns the endpoints to try for the issuer: healthy ones in
+// configured order, then unhealthy ones as a last resort. Issuers without
+// configured endpoints are reached under their name, without tracking their
+// health, as clients can send any name.
+func (p *issuerPool) candidates(name string, now time.Time) []*issuerEndpoint {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	endpoints, ok := p.endpoints[name]
+	if !ok {
+		uri, _ := composeURL(name, tokenRequestURI)
+		return []*issuerEndpoint{{host: name, uri: uri, unconfigured: true}}
+	}
+
+	healthy := make([]*issuerEndpoint, 0, len(endpoints))
+	unhealthy := make([]*issuerEndpoint, 0)
+	for _, endpoint := range endpoints {
+		if endpoint.healthy(now) {
+			healthy = append(healthy, endpoint)
+		} else {
+			unhealthy = append(unhealthy, endpoint)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (p *issuerPool) reportSuccess(endpoint *issuerEndpoint) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	endpoint.failures = 0
+	endpoint.unhealthyUntil = time.Time{}
+}
+
+func (p *issuerPool) reportFailure(endpoint *issuerEndpoint, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	endpoint.failures++
+	if endpoint.failures >= issuerUnhealthyThreshold {
+		if endpoint.healthy(now) {
+			log.Warnln("Issuer endpoint", endpoint.host, "marked unhealthy after", endpoint.failures, "failures")
+		}
+		endpoint.unhealthyUntil = now.Add(issuerHealthCooldown)
+	}
+}
+
+// cancelOnClose releases the attempt's context once the body is consumed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// forward sends the token request to the issuer, failing over to the next
+// endpoint on transport errors, timeouts, and 5xx responses. Other responses
+// are final and returned as is.
+func (p *issuerPool) forward(ctx context.Context, client *http.Client, tokenType uint16, issuerName, contentType string, body []byte) (*http.Response, error) {
+	return p.send(ctx, client, tokenType, issuerName, "", contentType, body)
+}
+
+// relay sends an encapsulated request to the issuer's Oblivious HTTP gateway,
+// failing over like forward.
+func (p *issuerPool) relay(ctx context.Context, client *http.Client, issuerName string, body []byte) (*http.Response, error) {
+	return p.send(ctx, client, 0, issuerName, issuerOHTTPGatewayURI, ohttpRequestMediaType, body)
+}
+
+// send posts the body to path at the issuer endpoints, or to their token
+// request URIs if path is empty.
+func (p *issuerPool) send(ctx context.Context, client *http.Client, tokenType uint16, issuerName, path, contentType string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for i, endpoint := range p.candidates(issuerName, time.Now()) {
+		if i > 0 {
+			log.Println("Failing over to issuer endpoint", endpoint.host)
+			attesterIssuerFailovers.Inc(tokenType)
+		}
+
+		start := time.Now()
+		resp, err := p.attempt(ctx, client, endpoint.resolve(path), contentType, body)
+		attesterIssuerResponseDuration.Observe(tokenType, time.Since(start).Seconds(), endpoint.label())
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			p.reportSuccess(endpoint)
+			attesterIssuerAttempts.Inc(tokenType, endpoint.label(), "ok")
+			return resp, nil
+		}
+
+		result := "error"
+		if err == nil {
+			result = "status"
+			err = fmt.Errorf("Issuer %s responded with %d", endpoint.host, resp.StatusCode)
+			resp.Body.Close()
+		} else if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			result = "timeout"
+		}
+		log.Println("Issuer endpoint", endpoint.host, "failed:", err)
+		attesterIssuerAttempts.Inc(tokenType, endpoint.label(), result)
+		p.reportFailure(endpoint, time.Now())
+		lastErr = err
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+func (p *issuerPool) attempt(ctx context.Context, client *http.Client, targetURI, contentType string, body []byte) (*http.Response, error) {
+	cancel := context.CancelFunc(func() {})
+	if p.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+	}
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPost, targetURI, bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	tokenReq.Header.Set("Content-Type", contentType)
+	if err := p.signer.sign(tokenReq, body, time.Now()); err != nil {
+		cancel()
+		return nil, err
+	}
+	log.Println("Target:", targetURI)
+
+	resp, err := client.Do(tokenReq)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
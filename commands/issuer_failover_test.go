@@ -0,0 +1,156 @@
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func newTestIssuerServer(status int, delay time.Duration) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+	}))
+}
+
+func TestParseIssuerFailover(t *testing.T) {
+	failover, err := parseIssuerFailover([]string{"issuer.example=a.example:443, b.example:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failover["issuer.example"]) != 2 || failover["issuer.example"][1] != "b.example:443" {
+		t.Fatalf("unexpected failover %v", failover)
+	}
+	for _, spec := range []string{"issuer.example", "=a.example", "issuer.example=a.example,,b.example",
+		"issuer.example=ftp://a.example/issue", "issuer.example=https:///issue"} {
+		if _, err := parseIssuerFailover([]string{spec}); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestIssuerEndpoint(t *testing.T) {
+	for spec, expected := range map[string]string{
+		"issuer.example":                        "https://issuer.example" + tokenRequestURI,
+		"issuer.example:8443":                   "https://issuer.example:8443" + tokenRequestURI,
+		"http://issuer.example:8080":            "http://issuer.example:8080" + tokenRequestURI,
+		"https://issuer.example/v1/issue?x=1":   "https://issuer.example/v1/issue?x=1",
+		"http://issuer.example:8080/api/issue/": "http://issuer.example:8080/api/issue/",
+	} {
+		endpoint, err := newIssuerEndpoint(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if endpoint.uri != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, spec, endpoint.uri)
+		}
+	}
+}
+
+func TestIssuerEndpointPath(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	pool := newIssuerPool(map[string][]string{
+		"issuer.example": {server.URL + "/v1/issue"},
+	}, time.Second)
+	resp, err := pool.forward(context.Background(), server.Client(), pat.BasicPublicTokenType, "issuer.example", tokenRequestMediaType, []byte{0x00, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if path != "/v1/issue" {
+		t.Fatalf("expected the configured path, got %s", path)
+	}
+}
+
+func TestIssuerFailover(t *testing.T) {
+	primary := newTestIssuerServer(http.StatusServiceUnavailable, 0)
+	defer primary.Close()
+	secondary := newTestIssuerServer(http.StatusOK, 0)
+	defer secondary.Close()
+
+	primaryHost := strings.TrimPrefix(primary.URL, "https://")
+	secondaryHost := strings.TrimPrefix(secondary.URL, "https://")
+	pool := newIssuerPool(map[string][]string{
+		"issuer.example": {primaryHost, secondaryHost},
+	}, time.Second)
+
+	failovers := attesterIssuerFailovers.Value(pat.BasicPublicTokenType)
+	for i := 0; i < issuerUnhealthyThreshold; i++ {
+		resp, err := pool.forward(context.Background(), secondary.Client(), pat.BasicPublicTokenType, "issuer.example", tokenRequestMediaType, []byte{0x00, 0x02})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+			t.Fatalf("expected the secondary's response, got %d", resp.StatusCode)
+		}
+	}
+	if attesterIssuerFailovers.Value(pat.BasicPublicTokenType) != failovers+issuerUnhealthyThreshold {
+		t.Fatal("failovers not counted")
+	}
+
+	// The primary is now unhealthy and tried last
+	candidates := pool.candidates("issuer.example", time.Now())
+	if candidates[0].host != secondaryHost || candidates[1].host != primaryHost {
+		t.Fatal("expected the unhealthy primary to be tried last")
+	}
+	candidates = pool.candidates("issuer.example", time.Now().Add(issuerHealthCooldown))
+	if candidates[0].host != primaryHost {
+		t.Fatal("expected the primary to be retried first after the cooldown")
+	}
+}
+
+func TestIssuerFailoverTimeout(t *testing.T) {
+	slow := newTestIssuerServer(http.StatusOK, 200*time.Millisecond)
+	defer slow.Close()
+	slowHost := strings.TrimPrefix(slow.URL, "https://")
+	pool := newIssuerPool(map[string][]string{
+		"issuer.example": {slowHost},
+	}, 20*time.Millisecond)
+
+	before := attesterIssuerAttempts.Value(pat.BasicPublicTokenType, slowHost, "timeout")
+	if _, err := pool.forward(context.Background(), slow.Client(), pat.BasicPublicTokenType, "issuer.example", tokenRequestMediaType, []byte{0x00, 0x02}); err == nil {
+		t.Fatal("expected the request to time out")
+	}
+	if attesterIssuerAttempts.Value(pat.BasicPublicTokenType, slowHost, "timeout") != before+1 {
+		t.Fatal("timeout not counted")
+	}
+}
+
+func TestIssuerPoolUnconfigured(t *testing.T) {
+	server := newTestIssuerServer(http.StatusOK, 0)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	pool := newIssuerPool(nil, time.Second)
+
+	// Issuer names sent by clients are neither kept nor labeled in metrics
+	before := attesterIssuerAttempts.Value(pat.BasicPublicTokenType, issuerEndpointOther, "ok")
+	resp, err := pool.forward(context.Background(), server.Client(), pat.BasicPublicTokenType, host, tokenRequestMediaType, []byte{0x00, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if attesterIssuerAttempts.Value(pat.BasicPublicTokenType, issuerEndpointOther, "ok") != before+1 {
+		t.Fatal("expected the attempt to be counted under the shared label")
+	}
+	if attesterIssuerAttempts.Value(pat.BasicPublicTokenType, host, "ok") != 0 {
+		t.Fatal("expected no label for the issuer name")
+	}
+	if len(pool.endpoints) != 0 {
+		t.Fatalf("expected no endpoint to be kept, got %d", len(pool.endpoints))
+	}
+}
@@ -0,0 +1,256 @@
+package commands
+
+import (
+	"encoding/binary"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	adminFaultsURI       = adminURIPrefix + "faults"
+	adminFaultsUpdateURI = adminURIPrefix + "faults/update"
+
+	// Broken token responses the issuer sends for attester and client
+	// testing, as metric labels
+	issuerFaultTruncateSignature = "truncate-signature"
+	issuerFaultWrongContentType  = "wrong-content-type"
+	issuerFaultDropTokenLimit    = "drop-token-limit"
+	issuerFaultErrorStorm        = "error-storm"
+
+	// Time every token request fails once an error storm started, unless
+	// configured otherwise
+	defaultFaultStormDuration = 10 * time.Second
+
+	// Content type of token responses under the wrong-content-type fault
+	wrongTokenResponseMediaType = "text/plain; charset=utf-8"
+)
+
+var issuerFaultNames = []string{
+	issuerFaultTruncateSignature,
+	issuerFaultWrongContentType,
+	issuerFaultDropTokenLimit,
+	issuerFaultErrorStorm,
+}
+
+// Statuses answered during error storms
+var stormStatuses = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// issuerFaultSettings are the faults the issuer injects, as set by flags and
+// the admin API.
+type issuerFaultSettings struct {
+	Faults      []string `json:"faults"`
+	Probability float64  `json:"probability"`
+}
+
+func (settings issuerFaultSettings) validate() error {
+	if settings.Probability < 0 || settings.Probability > 1 {
+		return fmt.Errorf("Invalid fault probability %v, expected at most 1", settings.Probability)
+	}
+	for _, name := range settings.Faults {
+		known := false
+		for _, fault := range issuerFaultNames {
+			known = known || name == fault
+		}
+		if !known {
+			return fmt.Errorf("Unknown issuer fault %q", name)
+		}
+	}
+	return nil
+}
+
+// issuerFaults break the token responses of the issuer on purpose, turning
+// it into a chaos peer for the attester and clients:
+//
+//   - truncate-signature: the token response is cut in half.
+//   - wrong-content-type: the token response is sent as text/plain.
+//   - drop-token-limit: rate-limited token responses lack Sec-Token-Limit.
+//   - error-storm: every token request fails with a 5xx status for the storm
+//     duration.
+//
+// Each enabled fault is injected into a response with the probability, and
+// faults can be changed at runtime through the admin API.
+type issuerFaults struct {
+	stormDuration time.Duration
+
+	lock        sync.Mutex
+	faults      map[string]bool
+	probability float64
+	stormUntil  time.Time
+	random      *mathrand.Rand
+}
+
+func newIssuerFaults(settings issuerFaultSettings, stormDuration time.Duration) (*issuerFaults, error) {
+	f := &issuerFaults{
+		stormDuration: stormDuration,
+		random:        mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+	}
+	if err := f.update(settings); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// update replaces the enabled faults. No faults disables injection and ends
+// an ongoing storm.
+func (f *issuerFaults) update(settings issuerFaultSettings) error {
+	if err := settings.validate(); err != nil {
+		return err
+	}
+	faults := make(map[string]bool)
+	for _, name := range settings.Faults {
+		faults[name] = true
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.faults = faults
+	f.probability = settings.Probability
+	if len(faults) == 0 {
+		f.stormUntil = time.Time{}
+	}
+	return nil
+}
+
+// settings returns the enabled faults.
+func (f *issuerFaults) settings() issuerFaultSettings {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	settings := issuerFaultSettings{
+		Faults:      make([]string, 0, len(f.faults)),
+		Probability: f.probability,
+	}
+	for name := range f.faults {
+		settings.Faults = append(settings.Faults, name)
+	}
+	sort.Strings(settings.Faults)
+	return settings
+}
+
+// String lists the faults for logs.
+func (f *issuerFaults) String() string {
+	settings := f.settings()
+	return fmt.Sprintf("%v with probability %v", settings.Faults, settings.Probability)
+}
+
+// draw returns the faults injected into a response, counting them. Error
+// storms start before responses, see storm. The caller holds the lock.
+func (f *issuerFaults) draw(tokenType uint16) map[string]bool {
+	injected := make(map[string]bool)
+	for _, name := range issuerFaultNames {
+		if name != issuerFaultErrorStorm && f.faults[name] && f.random.Float64() < f.probability {
+			issuerFaultsInjected.Inc(tokenType, name)
+			injected[name] = true
+		}
+	}
+	return injected
+}
+
+// requestTokenType returns the token type of a token request body as a metric
+// label, zero if it is too short to tell or of an unknown type.
+func requestTokenType(body []byte) uint16 {
+	if len(body) < 2 {
+		return 0
+	}
+	return labelTokenType(binary.BigEndian.Uint16(body))
+}
+
+// storm returns the status to fail a token request with if an error storm is
+// ongoing or starts now, and zero otherwise.
+func (f *issuerFaults) storm(body []byte, now time.Time) int {
+	if f == nil {
+		return 0
+	}
+	tokenType := requestTokenType(body)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if now.Before(f.stormUntil) {
+		return stormStatuses[f.random.Intn(len(stormStatuses))]
+	}
+	if !f.faults[issuerFaultErrorStorm] || f.random.Float64() >= f.probability {
+		return 0
+	}
+	issuerFaultsInjected.Inc(tokenType, issuerFaultErrorStorm)
+	f.stormUntil = now.Add(f.stormDuration)
+	log.Warnln("Issuer simulates an error storm until", f.stormUntil.Format(time.RFC3339))
+	return stormStatuses[f.random.Intn(len(stormStatuses))]
+}
+
+// responseWriter returns the writer of the token response, breaking it with
+// the faults injected into it.
+func (f *issuerFaults) responseWriter(w http.ResponseWriter, body []byte) http.ResponseWriter {
+	if f == nil {
+		return w
+	}
+	f.lock.Lock()
+	injected := f.draw(requestTokenType(body))
+	f.lock.Unlock()
+	if len(injected) == 0 {
+		return w
+	}
+	return &faultyResponseWriter{ResponseWriter: w, faults: injected}
+}
+
+// faultyResponseWriter breaks successful token responses. Errors are passed
+// on as they are.
+type faultyResponseWriter struct {
+	http.ResponseWriter
+	faults map[string]bool
+	status int
+}
+
+func (w *faultyResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status == http.StatusOK {
+		if w.faults[issuerFaultWrongContentType] {
+			w.Header().Set("Content-Type", wrongTokenResponseMediaType)
+		}
+		if w.faults[issuerFaultDropTokenLimit] {
+			w.Header().Del(headerTokenLimit)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *faultyResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.status != http.StatusOK || !w.faults[issuerFaultTruncateSignature] {
+		return w.ResponseWriter.Write(b)
+	}
+	// Report the whole response written, as if the connection dropped after
+	_, err := w.ResponseWriter.Write(b[:len(b)/2])
+	return len(b), err
+}
+
+func (i *Issuer) handleFaults(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, i.faults.settings())
+}
+
+func (i *Issuer) handleFaultsUpdate(w http.ResponseWriter, req *http.Request) {
+	var settings issuerFaultSettings
+	if err := readAdminJSON(req, &settings); err != nil {
+		http.Error(w, "Invalid fault settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := i.faults.update(settings); err != nil {
+		http.Error(w, "Invalid fault settings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Warnln("Issuer deliberately breaks token responses, simulating", i.faults)
+	writeAdminJSON(w, i.faults.settings())
+}
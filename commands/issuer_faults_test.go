@@ -0,0 +1,155 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestIssuerFaultSettings(t *testing.T) {
+	faults, err := newIssuerFaults(issuerFaultSettings{Probability: 1}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings := faults.settings(); len(settings.Faults) != 0 {
+		t.Fatalf("expected no faults by default, got %v", settings.Faults)
+	}
+	if err := faults.update(issuerFaultSettings{Faults: []string{issuerFaultErrorStorm, issuerFaultDropTokenLimit}, Probability: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+	if faults.String() != "[drop-token-limit error-storm] with probability 0.5" {
+		t.Fatalf("unexpected faults %s", faults)
+	}
+	for _, settings := range []issuerFaultSettings{
+		{Faults: []string{"forge-tokens"}, Probability: 1},
+		{Faults: []string{issuerFaultErrorStorm}, Probability: 2},
+	} {
+		if err := faults.update(settings); err == nil {
+			t.Fatalf("expected %v to be refused", settings)
+		}
+	}
+}
+
+func basicTokenRequest(t *testing.T, issuer *Issuer) []byte {
+	challenge := pat.TokenChallenge{
+		TokenType:  pat.BasicPublicTokenType,
+		IssuerName: "issuer.example",
+		OriginInfo: []string{"origin.example"},
+	}
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	basicIssuer := issuer.basicIssuer
+	state, err := pat.NewBasicPublicClient().CreateTokenRequest(challenge.Marshal(), nonce, basicIssuer.TokenKeyID(), basicIssuer.TokenKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.Request().Marshal()
+}
+
+func issueWithFaults(issuer *Issuer, requestEnc []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, tokenRequestURI, bytes.NewReader(requestEnc))
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+	w := httptest.NewRecorder()
+	issuer.handleIssuanceRequest(w, req)
+	return w
+}
+
+func TestIssuerFaults(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	requestEnc := basicTokenRequest(t, issuer)
+	w := issueWithFaults(issuer, requestEnc)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != tokenResponseMediaType {
+		t.Fatalf("unexpected issuance response %d", w.Code)
+	}
+	responseLength := w.Body.Len()
+
+	injected := issuerFaultsInjected.Value(pat.BasicPublicTokenType, issuerFaultTruncateSignature)
+	var err error
+	issuer.faults, err = newIssuerFaults(issuerFaultSettings{
+		Faults:      []string{issuerFaultTruncateSignature, issuerFaultWrongContentType},
+		Probability: 1,
+	}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = issueWithFaults(issuer, requestEnc)
+	if w.Code != http.StatusOK || w.Body.Len() != responseLength/2 {
+		t.Fatalf("expected a truncated response, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if w.Header().Get("Content-Type") != wrongTokenResponseMediaType {
+		t.Fatalf("expected the wrong content type, got %s", w.Header().Get("Content-Type"))
+	}
+	if issuerFaultsInjected.Value(pat.BasicPublicTokenType, issuerFaultTruncateSignature) != injected+1 {
+		t.Fatal("expected the fault to be counted")
+	}
+
+	// Errors are passed on as they are
+	w = issueWithFaults(issuer, []byte{0xff, 0xff})
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != problemMediaType || !strings.Contains(w.Body.String(), unsupportedTokenTypeProblemType) {
+		t.Fatalf("expected the error unchanged, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Token limits are dropped from rate-limited responses
+	rec := httptest.NewRecorder()
+	faulty := &faultyResponseWriter{ResponseWriter: rec, faults: map[string]bool{issuerFaultDropTokenLimit: true}}
+	faulty.Header().Set(headerTokenLimit, "10")
+	faulty.Write([]byte("response"))
+	if rec.Header().Get(headerTokenLimit) != "" || rec.Body.String() != "response" {
+		t.Fatal("expected the token limit to be dropped")
+	}
+}
+
+func TestIssuerErrorStorm(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	requestEnc := basicTokenRequest(t, issuer)
+	var err error
+	issuer.faults, err = newIssuerFaults(issuerFaultSettings{Faults: []string{issuerFaultErrorStorm}, Probability: 1}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if status := issuer.faults.storm(requestEnc, now); status < http.StatusInternalServerError {
+		t.Fatalf("expected a storm to start, got %d", status)
+	}
+	// The storm goes on whatever the probability, until it is over
+	issuer.faults.update(issuerFaultSettings{Faults: []string{issuerFaultErrorStorm}, Probability: 0})
+	if w := issueWithFaults(issuer, requestEnc); w.Code < http.StatusInternalServerError {
+		t.Fatalf("expected the storm to go on, got %d", w.Code)
+	}
+	if status := issuer.faults.storm(requestEnc, now.Add(2*time.Minute)); status != 0 {
+		t.Fatalf("expected the storm to be over, got %d", status)
+	}
+
+	// Disabling faults ends storms right away
+	issuer.faults.update(issuerFaultSettings{Faults: []string{issuerFaultErrorStorm}, Probability: 1})
+	issuer.faults.storm(requestEnc, time.Now())
+	issuer.faults.update(issuerFaultSettings{})
+	if w := issueWithFaults(issuer, requestEnc); w.Code != http.StatusOK {
+		t.Fatalf("expected the storm to end with faults disabled, got %d", w.Code)
+	}
+}
+
+func TestCheckTokenResponse(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)}
+	resp.Header.Set("Content-Type", tokenResponseMediaType)
+	if err := checkTokenResponse(resp, tokenResponseMediaType); err != nil {
+		t.Fatal(err)
+	}
+	resp.Header.Set("Content-Type", wrongTokenResponseMediaType)
+	if err := checkTokenResponse(resp, tokenResponseMediaType); !errors.Is(err, ErrInvalidTokenResponse) {
+		t.Fatalf("expected the content type to be refused, got %v", err)
+	}
+	resp.Header.Set("Content-Type", tokenResponseMediaType)
+	resp.StatusCode = http.StatusBadRequest
+	if err := checkTokenResponse(resp, tokenResponseMediaType); !errors.Is(err, ErrInvalidTokenResponse) {
+		t.Fatalf("expected the status to be refused, got %v", err)
+	}
+}
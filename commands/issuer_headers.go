@@ -0,0 +1,76 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// parseIssuerHeaders parses the headers sent with every request to issuers,
+// given as "Name: value", e.g., API keys of hosted issuers, and the
+// User-Agent if set.
+func parseIssuerHeaders(userAgent string, specs []string) (http.Header, error) {
+	header := make(http.Header)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("Invalid issuer header %q, expected <name>: <value>", spec)
+		}
+		value := strings.TrimSpace(parts[1])
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return nil, fmt.Errorf("Invalid value of issuer header %s", name)
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "Host", "Content-Length", "Content-Type", "Transfer-Encoding", "Connection":
+			return nil, fmt.Errorf("Issuer header %s cannot be set", name)
+		}
+		header.Add(name, value)
+	}
+	if userAgent != "" {
+		if !httpguts.ValidHeaderFieldValue(userAgent) {
+			return nil, fmt.Errorf("Invalid user agent %q", userAgent)
+		}
+		header.Set("User-Agent", userAgent)
+	}
+	return header, nil
+}
+
+// headerTransport sets headers on every request, replacing those the request
+// has.
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Round trippers must not modify the request
+	req = req.Clone(req.Context())
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	return t.base.RoundTrip(req)
+}
+
+// withIssuerHeaders returns a client sending the headers with every request,
+// or the client itself if there are none.
+func withIssuerHeaders(client *http.Client, header http.Header) *http.Client {
+	if len(header) == 0 {
+		return client
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	withHeaders := *client
+	withHeaders.Transport = &headerTransport{base: base, header: header}
+	return &withHeaders
+}
+
+// redactIssuerHeader hides the value of an issuer header, keeping its name.
+func redactIssuerHeader(spec string) string {
+	name, _, _ := strings.Cut(spec, ":")
+	return name + ": " + redactedValue
+}
@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseIssuerHeaders(t *testing.T) {
+	header, err := parseIssuerHeaders("pat-app/test", []string{"X-Api-Key: secret", "x-tenant:demo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("User-Agent") != "pat-app/test" || header.Get("X-Api-Key") != "secret" || header.Get("X-Tenant") != "demo" {
+		t.Fatalf("unexpected headers %v", header)
+	}
+	if header, err := parseIssuerHeaders("", nil); err != nil || len(header) != 0 {
+		t.Fatalf("expected no headers, got %v: %v", header, err)
+	}
+	for _, spec := range []string{"X-Api-Key", ": secret", "X Api Key: secret", "X-Api-Key: a\nb", "Host: issuer.example", "content-type: text/plain"} {
+		if _, err := parseIssuerHeaders("", []string{spec}); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestIssuerHeadersClient(t *testing.T) {
+	received := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header
+	}))
+	defer server.Close()
+
+	header, _ := parseIssuerHeaders("pat-app/test", []string{"X-Api-Key: secret"})
+	client := withIssuerHeaders(&http.Client{}, header)
+	req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("request"))
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+	req.Header.Set("User-Agent", "Go-http-client/1.1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	sent := <-received
+	if sent.Get("User-Agent") != "pat-app/test" || sent.Get("X-Api-Key") != "secret" || sent.Get("Content-Type") != tokenRequestMediaType {
+		t.Fatalf("expected the configured headers to be sent, got %v", sent)
+	}
+	if req.Header.Get("X-Api-Key") != "" {
+		t.Fatal("expected the request not to be modified")
+	}
+	if unchanged := (&http.Client{}); withIssuerHeaders(unchanged, nil) != unchanged {
+		t.Fatal("expected the client to be kept without headers")
+	}
+}
+
+func TestIssuerHeadersConfig(t *testing.T) {
+	fileName := writeTestConfigFile(t, "origin.yaml", `
+name: origin.example
+issuer: issuer.example
+outbound:
+  user-agent: pat-app/test
+  issuer-headers:
+    X-Tenant: demo
+    X-Api-Key: secret
+`)
+	c := testCommandContext(t, "origin", "--config", fileName)
+	if err := applyConfigFile(c); err != nil {
+		t.Fatal(err)
+	}
+	cfg := originConfigFromFlags(c)
+	if cfg.UserAgent != "pat-app/test" || strings.Join(cfg.IssuerHeaders, ",") != "X-Api-Key: secret,X-Tenant: demo" {
+		t.Fatalf("expected the outbound keys to set their flags, got %+v", cfg)
+	}
+
+	// Origins inherit the headers unless they set their own, and never show
+	// their values
+	own := OriginConfig{Name: "other.example", IssuerHeaders: []string{"X-Api-Key: other"}}.withDefaults(cfg)
+	if own.UserAgent != "pat-app/test" || len(own.IssuerHeaders) != 1 || own.issuerClientID() == cfg.issuerClientID() {
+		t.Fatalf("unexpected origin configuration %+v", own)
+	}
+	if redacted := own.redacted(); redacted.IssuerHeaders[0] != "X-Api-Key: REDACTED" || own.IssuerHeaders[0] != "X-Api-Key: other" {
+		t.Fatalf("expected the header value to be redacted, got %q", redacted.IssuerHeaders)
+	}
+	if flags := effectiveConfigFromFlags(c, "origin").Flags["issuer-header"].([]string); strings.Join(flags, ",") != "X-Api-Key: REDACTED,X-Tenant: REDACTED" {
+		t.Fatalf("expected redacted header values, got %q", flags)
+	}
+}
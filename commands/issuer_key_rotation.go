@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Time the issuer keeps publishing a token key after rotating it away
+	// unless configured otherwise
+	defaultKeyOverlap = time.Hour
+
+	// What triggered a key rotation, as metric labels
+	keyRotationAdmin    = "admin"
+	keyRotationSchedule = "schedule"
+	keyRotationSignal   = "signal"
+)
+
+// retiredTokenKey is a token key the issuer rotated away but still publishes,
+// so that tokens issued under it keep verifying until the overlap ends.
+type retiredTokenKey struct {
+	key     *rsa.PublicKey
+	expires time.Time
+}
+
+// retireTokenKey keeps publishing the token key for the overlap, and drops
+// retired keys whose overlap ended. The caller holds the lock.
+func (i *Issuer) retireTokenKey(key *rsa.PublicKey, now time.Time) {
+	retired := make([]retiredTokenKey, 0, len(i.retiredKeys)+1)
+	if i.keyOverlap > 0 {
+		retired = append(retired, retiredTokenKey{key: key, expires: now.Add(i.keyOverlap)})
+	}
+	for _, retiredKey := range i.retiredKeys {
+		if now.Before(retiredKey.expires) {
+			retired = append(retired, retiredKey)
+		}
+	}
+	i.retiredKeys = retired
+}
+
+// publishedTokenKeys returns the retired token keys still published, newest
+// first. The caller holds the lock.
+func (i *Issuer) publishedTokenKeys(now time.Time) []*rsa.PublicKey {
+	keys := make([]*rsa.PublicKey, 0, len(i.retiredKeys))
+	for _, retiredKey := range i.retiredKeys {
+		if now.Before(retiredKey.expires) {
+			keys = append(keys, retiredKey.key)
+		}
+	}
+	return keys
+}
+
+// tokenKeyByID returns the published token key with the key ID, or the
+// current key if there is none. The caller holds the lock.
+func (i *Issuer) tokenKeyByID(current *rsa.PublicKey, keyID []byte, now time.Time) *rsa.PublicKey {
+	for _, key := range i.publishedTokenKeys(now) {
+		tokenKeyEnc, err := marshalTokenKey(key, false)
+		if err != nil {
+			continue
+		}
+		if publishedKeyID := sha256.Sum256(tokenKeyEnc); bytes.Equal(keyID, publishedKeyID[:]) {
+			return key
+		}
+	}
+	return current
+}
+
+// runKeyRotation rotates the keys every interval, if not zero, and on SIGHUP,
+// until the context is done.
+func (i *Issuer) runKeyRotation(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var schedule <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		schedule = ticker.C
+	}
+
+	for {
+		trigger := keyRotationSchedule
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			trigger = keyRotationSignal
+		case <-schedule:
+		}
+		keyID, err := i.rotateKeys(trigger)
+		if err != nil {
+			log.Errorln("Failed rotating issuer keys:", err)
+			continue
+		}
+		log.Infof("Rotated issuer keys on %s, token key ID %x", trigger, keyID)
+	}
+}
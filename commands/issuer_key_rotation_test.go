@@ -0,0 +1,100 @@
+package commands
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func verifyAtIssuer(issuer *Issuer, token pat.Token) int {
+	req := httptest.NewRequest(http.MethodPost, tokenVerificationURI, bytes.NewReader(token.Marshal()))
+	req.Header.Set("Content-Type", tokenMediaType)
+	rec := httptest.NewRecorder()
+	issuer.handleVerificationRequest(rec, req)
+	return rec.Code
+}
+
+func TestIssuerKeyRotationOverlap(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	issuer.keyOverlap = time.Hour
+	token := createTestToken(t, issuer, testTokenChallenge(pat.BasicPublicTokenType))
+	retiredKey := issuer.basicIssuer.TokenKey()
+
+	if _, err := issuer.rotateKeys(keyRotationAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if equalRSAKeys(issuer.basicIssuer.TokenKey(), retiredKey) {
+		t.Fatal("expected a fresh token key")
+	}
+	if code := verifyAtIssuer(issuer, token); code != http.StatusNoContent {
+		t.Fatalf("expected tokens of the retired key to verify during the overlap, got %d", code)
+	}
+
+	// The directory lists the current keys first, then the retired ones
+	config, err := issuer.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parseIssuerDirectory("issuer.example", config, issuerKeys{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalRSAKeys(keys.basicValidationKey, issuer.basicIssuer.TokenKey()) {
+		t.Fatal("expected the current token key to be challenged with")
+	}
+	if err := verifyPublicToken(keys.publicTokenKey(token.TokenType, token.KeyID), token); err != nil {
+		t.Fatal("expected the origin to verify tokens of the retired key:", err)
+	}
+
+	// So does the verification bundle
+	bundle, err := issuer.verificationBundle(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundleKeys, err := bundle.tokenKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalRSAKeys(bundleKeys.rateLimitedTokenKey, issuer.rateLimitedIssuer.TokenKey()) {
+		t.Fatal("expected the current token key first in the bundle")
+	}
+	if err := verifyPublicToken(bundleKeys.publicTokenKey(token.TokenType, token.KeyID), token); err != nil {
+		t.Fatal("expected the bundle to carry the retired key:", err)
+	}
+
+	// Once the overlap ended, the retired key is neither published nor accepted
+	later := time.Now().Add(2 * time.Hour)
+	if len(issuer.publishedTokenKeys(later)) != 0 {
+		t.Fatal("expected the retired key to be dropped after the overlap")
+	}
+	if !equalRSAKeys(issuer.tokenKeyByID(issuer.basicIssuer.TokenKey(), token.KeyID, later), issuer.basicIssuer.TokenKey()) {
+		t.Fatal("expected the current key after the overlap")
+	}
+	issuer.retireTokenKey(issuer.basicIssuer.TokenKey(), later)
+	if len(issuer.retiredKeys) != 1 {
+		t.Fatalf("expected expired keys to be pruned, got %d retired keys", len(issuer.retiredKeys))
+	}
+}
+
+func TestIssuerKeyRotationWithoutOverlap(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	token := createTestToken(t, issuer, testTokenChallenge(pat.BasicPublicTokenType))
+	rotations := issuerKeyRotations.Value(0, keyRotationSignal)
+
+	if _, err := issuer.rotateKeys(keyRotationSignal); err != nil {
+		t.Fatal(err)
+	}
+	if len(issuer.publishedTokenKeys(time.Now())) != 0 {
+		t.Fatal("expected no retired keys without an overlap")
+	}
+	if code := verifyAtIssuer(issuer, token); code != http.StatusForbidden {
+		t.Fatalf("expected tokens of the rotated key to be refused, got %d", code)
+	}
+	if issuerKeyRotations.Value(0, keyRotationSignal) != rotations+1 {
+		t.Fatal("expected the rotation to be counted")
+	}
+}
@@ -0,0 +1,305 @@
+package commands
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Bounds of the retry backoff after failed refreshes
+	issuerKeysMinBackoff = time.Second
+	issuerKeysMaxBackoff = 5 * time.Minute
+
+	// Resources refreshed from the issuer, as metric labels
+	issuerResourceDirectory = "directory"
+	issuerResourceEncapKey  = "encap-key"
+	issuerResourceBundle    = "verification-bundle"
+)
+
+// issuerTokenKeys are the keys tokens are verified with, replaced as a whole.
+type issuerTokenKeys struct {
+	rateLimitedTokenKeyEnc []byte // Encoding of validation public key
+	rateLimitedTokenKey    *rsa.PublicKey
+	basicTokenKeyEnc       []byte // Encoding of validation public key
+	basicValidationKey     *rsa.PublicKey
+	privateTokenKeyEnc     []byte            // VOPRF public key, nil unless the issuer offers private tokens
+	ed25519TokenKey        ed25519.PublicKey // experimental, nil unless the issuer offers it
+
+	// Every published RSA token key, the current ones and those the issuer
+	// rotated away but still accepts, by token type and key ID
+	publicTokenKeys map[publicTokenKeyID]*rsa.PublicKey
+}
+
+type publicTokenKeyID struct {
+	tokenType uint16
+	keyID     [sha256.Size]byte
+}
+
+// addPublicTokenKey records an RSA token key by its key ID.
+func (keys *issuerTokenKeys) addPublicTokenKey(tokenType uint16, tokenKeyEnc []byte, tokenKey *rsa.PublicKey) {
+	if keys.publicTokenKeys == nil {
+		keys.publicTokenKeys = make(map[publicTokenKeyID]*rsa.PublicKey)
+	}
+	keys.publicTokenKeys[publicTokenKeyID{tokenType, sha256.Sum256(tokenKeyEnc)}] = tokenKey
+}
+
+// publicTokenKey returns the RSA token key of the type with the key ID, or
+// the current one if the issuer published no such key.
+func (keys *issuerTokenKeys) publicTokenKey(tokenType uint16, keyID []byte) *rsa.PublicKey {
+	id := publicTokenKeyID{tokenType: tokenType}
+	if len(keyID) == len(id.keyID) {
+		copy(id.keyID[:], keyID)
+		if tokenKey, ok := keys.publicTokenKeys[id]; ok {
+			return tokenKey
+		}
+	}
+	if tokenType == pat.BasicPublicTokenType {
+		return keys.basicValidationKey
+	}
+	return keys.rateLimitedTokenKey
+}
+
+// issuerKeys is a snapshot of the issuer key material the origin uses.
+type issuerKeys struct {
+	issuerTokenKeys
+	encapKey              pat.EncapKey
+	encapKeyURI           string
+	verificationURI       string
+	verificationBundleURI string
+	bundleIssuedAt        int64     // of the verification bundle the token keys come from, if any
+	bundleExpires         int64     // of the same bundle, after which its token keys are not used
+	directoryFetched      time.Time // when the issuer directory was last fetched successfully
+}
+
+// parseTokenKey adds a token key of the directory or a verification bundle.
+// Unknown token types are ignored, and RSA token keys after the first of
+// their type are only accepted for verification.
+func (keys *issuerTokenKeys) parseTokenKey(tokenType int, tokenKeyEnc []byte) error {
+	var err error
+	switch tokenType {
+	case int(pat.BasicPublicTokenType), int(pat.RateLimitedTokenType):
+		var tokenKey *rsa.PublicKey
+		if tokenKey, err = pat.UnmarshalTokenKey(tokenKeyEnc); err != nil {
+			break
+		}
+		keys.addPublicTokenKey(uint16(tokenType), tokenKeyEnc, tokenKey)
+		if tokenType == int(pat.BasicPublicTokenType) && keys.basicValidationKey == nil {
+			keys.basicValidationKey, keys.basicTokenKeyEnc = tokenKey, tokenKeyEnc
+		} else if tokenType == int(pat.RateLimitedTokenType) && keys.rateLimitedTokenKey == nil {
+			keys.rateLimitedTokenKey, keys.rateLimitedTokenKeyEnc = tokenKey, tokenKeyEnc
+		}
+	case int(pat.BasicPrivateTokenType):
+		if _, err = unmarshalPrivateTokenKey(tokenKeyEnc); err == nil {
+			keys.privateTokenKeyEnc = tokenKeyEnc
+		}
+	case int(ed25519TokenType):
+		if len(tokenKeyEnc) != ed25519.PublicKeySize {
+			err = fmt.Errorf("Invalid Ed25519 token key")
+		}
+		keys.ed25519TokenKey = tokenKeyEnc
+	}
+	return err
+}
+
+// parseIssuerDirectory extracts the token keys from the issuer directory into
+// a copy of the snapshot, replacing its token keys.
+func parseIssuerDirectory(issuer string, issuerConfig IssuerConfig, keys issuerKeys) (issuerKeys, error) {
+	var err error
+	keys.issuerTokenKeys = issuerTokenKeys{}
+	keys.encapKeyURI, err = composeURL(issuer, issuerConfig.IssuerEncapKeyURI)
+	if err != nil {
+		return issuerKeys{}, err
+	}
+	keys.verificationURI = issuerConfig.VerificationURI
+	keys.verificationBundleURI = issuerConfig.VerificationBundleURI
+
+	for _, tokenKey := range issuerConfig.TokenKeys {
+		tokenKeyEnc, err := base64.URLEncoding.DecodeString(tokenKey.TokenKey)
+		if err != nil {
+			return issuerKeys{}, fmt.Errorf("Invalid token key for token type %d: %w", tokenKey.TokenType, err)
+		}
+		if err := keys.parseTokenKey(tokenKey.TokenType, tokenKeyEnc); err != nil {
+			return issuerKeys{}, err
+		}
+	}
+	return keys, nil
+}
+
+// issuerKeySource keeps the issuer directory and encapsulation key fresh. Both
+// are re-fetched periodically, and failed fetches are retried with exponential
+// backoff while the last known good keys stay in use.
+type issuerKeySource struct {
+	client   *http.Client
+	issuer   string
+	interval time.Duration
+
+	// Pinned key of verification bundles, which then are the only source of
+	// token keys. Nil to take token keys from the directory.
+	bundleKey ed25519.PublicKey
+
+	// Clock skew tolerated when checking the lifetime of verification bundles
+	skew time.Duration
+
+	lock sync.RWMutex
+	keys *issuerKeys
+}
+
+func newIssuerKeySource(client *http.Client, issuer string, interval time.Duration) *issuerKeySource {
+	return &issuerKeySource{
+		client:   client,
+		issuer:   issuer,
+		interval: interval,
+	}
+}
+
+// current returns the last known good keys.
+func (s *issuerKeySource) current() *issuerKeys {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.keys
+}
+
+// bundleExpired reports whether the token keys of the snapshot come from a
+// verification bundle that expired before now, beyond the tolerated skew. The
+// keys are kept while refreshes fail, but not past the bundle's lifetime.
+func (s *issuerKeySource) bundleExpired(keys *issuerKeys, now time.Time) bool {
+	return keys.bundleExpires != 0 && now.After(time.Unix(keys.bundleExpires, 0).Add(s.skew))
+}
+
+func recordIssuerRefresh(resource string, err error) {
+	if err != nil {
+		originIssuerRefreshes.Inc(0, resource, "failure")
+		originIssuerKeysStale.Set(0, 1, resource)
+		return
+	}
+	originIssuerRefreshes.Inc(0, resource, "success")
+	originIssuerKeysStale.Set(0, 0, resource)
+	originIssuerKeysRefreshed.Set(0, float64(time.Now().Unix()), resource)
+}
+
+// refresh fetches the directory and then the encapsulation key it points to,
+// and the verification bundle if one is pinned, keeping whichever part fails
+// from the previous snapshot.
+func (s *issuerKeySource) refresh() error {
+	keys := issuerKeys{}
+	if current := s.current(); current != nil {
+		keys = *current
+	}
+	tokenKeys := keys.issuerTokenKeys
+
+	issuerConfig, err := fetchIssuerConfig(s.client, s.issuer)
+	if err == nil {
+		keys, err = parseIssuerDirectory(s.issuer, issuerConfig, keys)
+	}
+	recordIssuerRefresh(issuerResourceDirectory, err)
+	if err == nil {
+		keys.directoryFetched = time.Now()
+	} else {
+		if keys.encapKeyURI == "" {
+			return err
+		}
+		log.Warnln("Failed refreshing issuer directory, keeping the last known good keys:", err)
+	}
+	directoryErr := err
+
+	encapKey, err := fetchIssuerNameKey(s.client, keys.encapKeyURI)
+	recordIssuerRefresh(issuerResourceEncapKey, err)
+	if err != nil {
+		if s.current() == nil {
+			return err
+		}
+		log.Warnln("Failed refreshing issuer encapsulation key, keeping the last known good key:", err)
+	} else {
+		keys.encapKey = encapKey
+	}
+	encapKeyErr := err
+
+	var bundleErr error
+	if s.bundleKey != nil {
+		keys.issuerTokenKeys = tokenKeys
+		bundleErr = s.refreshBundle(&keys)
+		recordIssuerRefresh(issuerResourceBundle, bundleErr)
+		if bundleErr != nil {
+			if keys.bundleIssuedAt == 0 {
+				return bundleErr
+			}
+			log.Warnln("Failed refreshing issuer verification bundle, keeping the last known good keys:", bundleErr)
+		}
+	}
+
+	if directoryErr == nil || encapKeyErr == nil || (s.bundleKey != nil && bundleErr == nil) {
+		s.lock.Lock()
+		s.keys = &keys
+		s.lock.Unlock()
+	}
+	for _, err := range []error{directoryErr, encapKeyErr, bundleErr} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nextIssuerKeysBackoff(backoff, limit time.Duration) time.Duration {
+	if backoff == 0 {
+		return issuerKeysMinBackoff
+	}
+	backoff *= 2
+	if backoff > limit {
+		backoff = limit
+	}
+	return backoff
+}
+
+// load blocks until the keys were fetched once, retrying with backoff.
+func (s *issuerKeySource) load(ctx context.Context) error {
+	backoff := time.Duration(0)
+	for {
+		err := s.refresh()
+		if err == nil {
+			return nil
+		}
+		backoff = nextIssuerKeysBackoff(backoff, issuerKeysMaxBackoff)
+		log.Warnln("Failed fetching issuer keys, retrying in", backoff, ":", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// run refreshes the keys every interval until the context is done. Failed
+// refreshes are retried sooner, with backoff up to the interval.
+func (s *issuerKeySource) run(ctx context.Context) {
+	limit := s.interval
+	if limit > issuerKeysMaxBackoff {
+		limit = issuerKeysMaxBackoff
+	}
+	backoff := time.Duration(0)
+	delay := s.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if err := s.refresh(); err != nil {
+			backoff = nextIssuerKeysBackoff(backoff, limit)
+			delay = backoff
+		} else {
+			backoff = 0
+			delay = s.interval
+		}
+	}
+}
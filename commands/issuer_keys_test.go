@@ -0,0 +1,110 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func newTestIssuer(t *testing.T, name string) *Issuer {
+	tokenKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Issuer{
+		name:              name,
+		basicIssuer:       pat.NewBasicPublicIssuer(tokenKey),
+		rateLimitedIssuer: pat.NewRateLimitedIssuer(tokenKey),
+	}
+}
+
+func TestIssuerKeySource(t *testing.T) {
+	var current atomic.Value
+	failing := int32(0)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) != 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		issuer := current.Load().(*Issuer)
+		switch req.URL.Path {
+		case issuerConfigURI:
+			issuer.handleConfigRequest(w, req)
+		case issuerEncapKeyURI:
+			issuer.handleNameKeyRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	name := strings.TrimPrefix(server.URL, "https://")
+
+	first := newTestIssuer(t, name)
+	current.Store(first)
+	source := newIssuerKeySource(server.Client(), name, time.Hour)
+	if err := source.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	keys := source.current()
+	if keys.rateLimitedTokenKey == nil || keys.basicValidationKey == nil ||
+		!bytes.Equal(keys.encapKey.Marshal(), first.rateLimitedIssuer.NameKey().Marshal()) {
+		t.Fatal("unexpected issuer keys")
+	}
+
+	// Failed refreshes keep the last known good keys and are reported as stale
+	atomic.StoreInt32(&failing, 1)
+	if err := source.refresh(); err == nil {
+		t.Fatal("expected refresh to fail")
+	}
+	if source.current() != keys {
+		t.Fatal("expected last known good keys to be kept")
+	}
+	if originIssuerKeysStale.Value(0, issuerResourceDirectory) != 1 || originIssuerKeysStale.Value(0, issuerResourceEncapKey) != 1 {
+		t.Fatal("expected keys to be reported as stale")
+	}
+
+	// Rotated keys are picked up on the next refresh
+	atomic.StoreInt32(&failing, 0)
+	second := newTestIssuer(t, name)
+	current.Store(second)
+	if err := source.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(source.current().encapKey.Marshal(), second.rateLimitedIssuer.NameKey().Marshal()) {
+		t.Fatal("expected rotated encapsulation key")
+	}
+	if originIssuerKeysStale.Value(0, issuerResourceEncapKey) != 0 {
+		t.Fatal("expected keys to be fresh")
+	}
+}
+
+func TestIssuerKeySourceUnavailable(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	source := newIssuerKeySource(server.Client(), strings.TrimPrefix(server.URL, "https://"), time.Hour)
+	if err := source.refresh(); err == nil || source.current() != nil {
+		t.Fatal("expected refresh without keys to fail")
+	}
+}
+
+func TestIssuerKeysBackoff(t *testing.T) {
+	backoff := time.Duration(0)
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for _, want := range expected {
+		backoff = nextIssuerKeysBackoff(backoff, 5*time.Second)
+		if backoff != want {
+			t.Fatalf("expected %v, got %v", want, backoff)
+		}
+	}
+}
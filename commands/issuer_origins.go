@@ -0,0 +1,165 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Problem type of rate-limited token requests for origins outside the
+	// issuer's allowlist
+	originNotAllowedProblemType = problemTypePrefix + "origin-not-allowed"
+
+	ErrOriginNotAllowed = errors.New("Origin not allowed by the issuer")
+)
+
+const (
+	// Most origins the issuer keeps index keys for. Origins matching a
+	// pattern of the allowlist are refused beyond, so that clients cannot
+	// grow the keys without bound.
+	maxIssuerOrigins = 10000
+
+	// Prefix of the errors pat-go evaluates requests for unregistered origins
+	// with, followed by the origin name
+	unknownOriginErrorPrefix = "Unknown origin: "
+)
+
+// originAllowlist holds the origins the issuer issues rate-limited tokens
+// for: names, registered at startup, and *.<domain> patterns matching every
+// subdomain of the domain, registered on their first token request.
+type originAllowlist struct {
+	names    []string
+	patterns []string // domains, without the leading *.
+}
+
+// loadOriginAllowlist reads one origin name or pattern per line, skipping
+// blank lines and comments starting with #.
+func loadOriginAllowlist(fileName string) (*originAllowlist, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	allowlist := &originAllowlist{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domain := strings.TrimPrefix(line, "*.")
+		if domain == "" || strings.Contains(domain, "*") || strings.ContainsAny(line, " \t") {
+			return nil, fmt.Errorf("Invalid origin %q in %s, expected a name or *.<domain>", line, fileName)
+		}
+		if domain != line {
+			allowlist.patterns = append(allowlist.patterns, domain)
+		} else {
+			allowlist.names = append(allowlist.names, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return allowlist, nil
+}
+
+// matches returns whether a pattern of the allowlist matches the origin. Ports
+// are ignored.
+func (a *originAllowlist) matches(origin string) bool {
+	if a == nil {
+		return false
+	}
+	if host, _, err := net.SplitHostPort(origin); err == nil {
+		origin = host
+	}
+	for _, domain := range a.patterns {
+		if strings.HasSuffix(origin, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// formattedPatterns returns the patterns as written in the allowlist.
+func (a *originAllowlist) formattedPatterns() []string {
+	if a == nil {
+		return nil
+	}
+	patterns := make([]string, len(a.patterns))
+	for i, domain := range a.patterns {
+		patterns[i] = "*." + domain
+	}
+	return patterns
+}
+
+// unknownOrigin returns the origin named by a rate-limited token request the
+// issuer has no index key for, if the evaluation failed for that reason.
+func unknownOrigin(err error) (string, bool) {
+	if err == nil || !strings.HasPrefix(err.Error(), unknownOriginErrorPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(err.Error(), unknownOriginErrorPrefix), true
+}
+
+// addMatchedOrigin adds an index key for an origin matching a pattern of the
+// allowlist, unless the issuer holds too many, and returns whether the issuer
+// has one for it now.
+func (i *Issuer) addMatchedOrigin(origin string) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.rateLimitedIssuer.OriginIndexKey(origin) != nil {
+		return true
+	}
+	if len(i.origins) >= maxIssuerOrigins {
+		log.Warnln("Not adding origin", origin, "beyond", maxIssuerOrigins, "origins")
+		return false
+	}
+	if err := i.rateLimitedIssuer.AddOrigin(origin); err != nil {
+		log.Errorln("Failed adding origin", origin+":", err)
+		return false
+	}
+	log.Infoln("Added origin", origin, "matching the allowlist")
+	i.origins = append(i.origins, origin)
+	return true
+}
+
+// evaluateRateLimited evaluates the rate-limited token request, adding index
+// keys for origins matching the allowlist as they are first requested. The
+// caller holds the read lock.
+func (i *Issuer) evaluateRateLimited(tokenRequest *pat.RateLimitedTokenRequest) ([]byte, []byte, error) {
+	tokenResponse, blindRequest, err := i.rateLimitedIssuer.Evaluate(tokenRequest)
+	if origin, ok := unknownOrigin(err); ok && i.originAllowlist.matches(origin) {
+		// Keys are only added under the write lock
+		i.lock.RUnlock()
+		added := i.addMatchedOrigin(origin)
+		i.lock.RLock()
+		if added {
+			tokenResponse, blindRequest, err = i.rateLimitedIssuer.Evaluate(tokenRequest)
+		}
+	}
+	return tokenResponse, blindRequest, err
+}
+
+// writeOriginNotAllowed refuses a rate-limited token request for an origin
+// outside the allowlist. The origin is not named, since the attester relays
+// the refusal and must not learn it.
+func writeOriginNotAllowed(w http.ResponseWriter) {
+	problemEnc, _ := json.Marshal(problemDetails{
+		Type:      originNotAllowedProblemType,
+		Title:     ErrOriginNotAllowed.Error(),
+		Status:    http.StatusForbidden,
+		Detail:    "The issuer does not issue rate-limited tokens for the origin of the token request",
+		RefusedBy: "issuer",
+	})
+	writeProblem(w, http.StatusForbidden, problemEnc)
+}
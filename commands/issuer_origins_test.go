@@ -0,0 +1,90 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+// rateLimitedTokenRequest returns a rate-limited token request of the issuer
+// for the origin.
+func rateLimitedTokenRequest(t *testing.T, issuer *Issuer, origin string) []byte {
+	tokenKey := issuer.rateLimitedIssuer.TokenKey()
+	tokenKeyEnc, _ := marshalTokenKey(tokenKey, false)
+	tokenKeyID := sha256.Sum256(tokenKeyEnc)
+	challenge := pat.TokenChallenge{
+		TokenType:  pat.RateLimitedTokenType,
+		IssuerName: issuer.name,
+		OriginInfo: []string{origin},
+	}
+	blind := make([]byte, clientBlindLength)
+	rand.Read(blind)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	state, err := pat.CreateRateLimitedClientFromSecret(secret).CreateTokenRequest(challenge.Marshal(), make([]byte, 32), blind, tokenKeyID[:], tokenKey, origin, issuer.rateLimitedIssuer.NameKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.Request().Marshal()
+}
+
+func TestOriginAllowlist(t *testing.T) {
+	allowlist, err := loadOriginAllowlist(writeTestCredentials(t, "allowlist", "# partners\norigin.example\n*.partner.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowlist.names) != 1 || allowlist.names[0] != "origin.example" {
+		t.Fatalf("unexpected names %v", allowlist.names)
+	}
+	for origin, matches := range map[string]bool{
+		"shop.partner.example":      true,
+		"a.b.partner.example:4568":  true,
+		"partner.example":           false,
+		"shop.otherpartner.example": false,
+		"origin.example":            false, // names are registered, not matched
+	} {
+		if allowlist.matches(origin) != matches {
+			t.Fatalf("expected %s to match %v", origin, matches)
+		}
+	}
+	if _, err := loadOriginAllowlist(writeTestCredentials(t, "invalid", "*\n")); err == nil {
+		t.Fatal("expected a bare wildcard to be refused")
+	}
+}
+
+func TestIssuerOriginAllowlist(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	issuer.rateLimitedIssuer.AddOrigin("origin.example")
+	issuer.origins = []string{"origin.example"}
+	issuer.originAllowlist = &originAllowlist{patterns: []string{"partner.example"}}
+
+	if w := issueWithFaults(issuer, rateLimitedTokenRequest(t, issuer, "origin.example")); w.Code != http.StatusOK {
+		t.Fatalf("expected listed origins to be issued for, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := issueWithFaults(issuer, rateLimitedTokenRequest(t, issuer, "shop.partner.example")); w.Code != http.StatusOK {
+		t.Fatalf("expected origins matching a pattern to be issued for, got %d: %s", w.Code, w.Body.String())
+	}
+	if issuer.rateLimitedIssuer.OriginIndexKey("shop.partner.example") == nil || len(issuer.policy().Origins) != 2 {
+		t.Fatal("expected an index key for the matching origin")
+	}
+
+	refusals := issuerOriginRefusals.Value(pat.RateLimitedTokenType)
+	w := issueWithFaults(issuer, rateLimitedTokenRequest(t, issuer, "elsewhere.example"))
+	if w.Code != http.StatusForbidden || issuerOriginRefusals.Value(pat.RateLimitedTokenType) != refusals+1 {
+		t.Fatalf("expected other origins to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The attester relays the refusal, which clients report as such
+	relayed := httptest.NewRecorder()
+	if !relayProblem(relayed, w.Result()) {
+		t.Fatal("expected the refusal to be relayed")
+	}
+	if err := tokenRequestError(relayed.Result()); !errors.Is(err, ErrOriginNotAllowed) {
+		t.Fatalf("expected the client to report the refusal, got %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package commands
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Tokens per attester the fair queue holds unless configured otherwise
+	defaultFairQueueDepth = 64
+
+	// Label of the attesters without a configured weight in fair queue
+	// metrics
+	fairQueueOtherAttesters = "other"
+)
+
+var (
+	ErrFairQueueFull = errors.New("Token request queue of attester full")
+)
+
+// parseAttesterWeights parses address=weight specifications of the share of
+// signing capacity each attester gets under fair queueing.
+func parseAttesterWeights(specs []string) (map[string]float64, error) {
+	weights := make(map[string]float64)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || net.ParseIP(parts[0]) == nil {
+			return nil, fmt.Errorf("Invalid attester weight %q, expected <address>=<weight>", spec)
+		}
+		weight, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("Invalid weight for attester %s", parts[0])
+		}
+		weights[net.ParseIP(parts[0]).String()] = weight
+	}
+	return weights, nil
+}
+
+// fairWaiter is a token request waiting for a signing slot.
+type fairWaiter struct {
+	attester string
+	start    float64 // virtual start tag
+	finish   float64 // virtual finish tag, the queue order
+	seq      uint64  // arrival order, breaking ties
+	ready    chan struct{}
+	index    int // in the queue, -1 once dequeued
+}
+
+type fairQueue []*fairWaiter
+
+func (q fairQueue) Len() int { return len(q) }
+
+func (q fairQueue) Less(i, j int) bool {
+	if q[i].finish != q[j].finish {
+		return q[i].finish < q[j].finish
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q fairQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *fairQueue) Push(x interface{}) {
+	waiter := x.(*fairWaiter)
+	waiter.index = len(*q)
+	*q = append(*q, waiter)
+}
+
+func (q *fairQueue) Pop() interface{} {
+	old := *q
+	waiter := old[len(old)-1]
+	old[len(old)-1] = nil
+	waiter.index = -1
+	*q = old[:len(old)-1]
+	return waiter
+}
+
+// fairScheduler shares the issuer's signing slots among attesters with
+// weighted fair queueing, so that an attester flooding the issuer only
+// delays its own requests. Each request is tagged with a virtual finish time
+// advancing by its tokens over the attester's weight from where the
+// attester's previous request finished, and free slots go to the smallest
+// tag. Attesters are told apart by their address.
+type fairScheduler struct {
+	lock        sync.Mutex
+	slots       int // free signing slots
+	maxDepth    int // queued requests per attester
+	weights     map[string]float64
+	virtualTime float64
+	finish      map[string]float64 // latest finish tag by attester
+	depth       map[string]int     // queued requests by attester
+	otherDepth  int                // queued requests of attesters without a weight
+	queue       fairQueue
+	seq         uint64
+}
+
+func newFairScheduler(slots, maxDepth int, weights map[string]float64) *fairScheduler {
+	return &fairScheduler{
+		slots:    slots,
+		maxDepth: maxDepth,
+		weights:  weights,
+		finish:   make(map[string]float64),
+		depth:    make(map[string]int),
+	}
+}
+
+// tag computes the virtual start and finish tags of a request of cost tokens.
+// The caller holds the lock.
+func (s *fairScheduler) tag(attester string, cost int) (float64, float64) {
+	weight, ok := s.weights[attester]
+	if !ok {
+		weight = 1
+	}
+	start := s.virtualTime
+	if finish := s.finish[attester]; finish > start {
+		start = finish
+	}
+	finish := start + float64(cost)/weight
+	s.finish[attester] = finish
+	return start, finish
+}
+
+// acquire waits for a signing slot for a request of cost tokens from the
+// attester, and returns the function releasing it. It fails with
+// ErrFairQueueFull if the attester has too many requests queued already, or
+// with the error of ctx if it is done first. A nil scheduler grants every
+// request at once.
+func (s *fairScheduler) acquire(ctx context.Context, attester string, cost int) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	s.lock.Lock()
+	if s.slots > 0 && len(s.queue) == 0 {
+		start, _ := s.tag(attester, cost)
+		s.virtualTime = start
+		s.slots--
+		s.lock.Unlock()
+		return s.release, nil
+	}
+	if s.depth[attester] >= s.maxDepth {
+		s.lock.Unlock()
+		issuerFairQueueRejections.Inc(0, s.label(attester))
+		return nil, ErrFairQueueFull
+	}
+	start, finish := s.tag(attester, cost)
+	s.seq++
+	waiter := &fairWaiter{
+		attester: attester,
+		start:    start,
+		finish:   finish,
+		seq:      s.seq,
+		ready:    make(chan struct{}),
+	}
+	heap.Push(&s.queue, waiter)
+	s.setDepth(attester, s.depth[attester]+1)
+	s.lock.Unlock()
+
+	queued := time.Now()
+	select {
+	case <-waiter.ready:
+		issuerFairQueueWait.Observe(0, time.Since(queued).Seconds())
+		return s.release, nil
+	case <-ctx.Done():
+	}
+	s.lock.Lock()
+	if waiter.index < 0 {
+		s.lock.Unlock()
+		// Granted while giving up, hand the slot on
+		s.release()
+		return nil, ctx.Err()
+	}
+	heap.Remove(&s.queue, waiter.index)
+	s.setDepth(attester, s.depth[attester]-1)
+	s.lock.Unlock()
+	return nil, ctx.Err()
+}
+
+// release hands the slot to the queued request with the smallest finish
+// tag, or frees it.
+func (s *fairScheduler) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.queue) == 0 {
+		s.slots++
+		// Tags of idle attesters behind the virtual time no longer matter
+		for attester, finish := range s.finish {
+			if finish <= s.virtualTime {
+				delete(s.finish, attester)
+			}
+		}
+		return
+	}
+	waiter := heap.Pop(&s.queue).(*fairWaiter)
+	s.setDepth(waiter.attester, s.depth[waiter.attester]-1)
+	s.virtualTime = waiter.start
+	close(waiter.ready)
+}
+
+// label returns the metric label of the attester: its address if it has a
+// configured weight, or fairQueueOtherAttesters, so that peers cannot create
+// label values.
+func (s *fairScheduler) label(attester string) string {
+	if _, ok := s.weights[attester]; ok {
+		return attester
+	}
+	return fairQueueOtherAttesters
+}
+
+// setDepth records the requests queued for the attester. The caller holds
+// the lock.
+func (s *fairScheduler) setDepth(attester string, depth int) {
+	delta := depth - s.depth[attester]
+	if depth == 0 {
+		delete(s.depth, attester)
+	} else {
+		s.depth[attester] = depth
+	}
+	if _, ok := s.weights[attester]; ok {
+		issuerFairQueueDepth.Set(0, float64(depth), attester)
+		return
+	}
+	s.otherDepth += delta
+	issuerFairQueueDepth.Set(0, float64(s.otherDepth), fairQueueOtherAttesters)
+}
+
+// requestAttester returns the address token requests are queued by.
+func requestAttester(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/pat-app/metrics"
+)
+
+func TestParseAttesterWeights(t *testing.T) {
+	weights, err := parseAttesterWeights([]string{"192.0.2.1=2", "2001:db8:0::1=0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights["192.0.2.1"] != 2 || weights["2001:db8::1"] != 0.5 {
+		t.Fatalf("unexpected weights %v", weights)
+	}
+	for _, spec := range []string{"192.0.2.1", "attester.example=1", "192.0.2.1=0", "192.0.2.1=-1", "192.0.2.1=x"} {
+		if _, err := parseAttesterWeights([]string{spec}); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestRequestAttester(t *testing.T) {
+	req := httptest.NewRequest("POST", tokenRequestURI, nil)
+	for remoteAddr, expected := range map[string]string{
+		"192.0.2.1:1234":     "192.0.2.1",
+		"[2001:db8::1]:1234": "2001:db8::1",
+		"192.0.2.1":          "192.0.2.1",
+	} {
+		req.RemoteAddr = remoteAddr
+		if attester := requestAttester(req); attester != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, remoteAddr, attester)
+		}
+	}
+}
+
+// queueTestRequest acquires a slot for the attester in the background, once
+// the request is queued.
+func queueTestRequest(t *testing.T, ctx context.Context, s *fairScheduler, attester string, cost int) <-chan error {
+	s.lock.Lock()
+	queued := len(s.queue)
+	s.lock.Unlock()
+	granted := make(chan error, 1)
+	go func() {
+		_, err := s.acquire(ctx, attester, cost)
+		granted <- err
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.lock.Lock()
+		length := len(s.queue)
+		s.lock.Unlock()
+		if length > queued {
+			return granted
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request not queued")
+		}
+	}
+}
+
+func TestFairSchedulerOrder(t *testing.T) {
+	s := newFairScheduler(1, defaultFairQueueDepth, map[string]float64{"heavy": 2})
+	ctx := context.Background()
+	if _, err := s.acquire(ctx, "noisy", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The noisy attester queues first, yet the others are served in between
+	// by their weight
+	names := []string{"noisy", "noisy", "noisy", "quiet", "heavy", "heavy"}
+	requests := make(map[string][]<-chan error)
+	for _, name := range names {
+		requests[name] = append(requests[name], queueTestRequest(t, ctx, s, name, 1))
+	}
+	// Attesters without a weight are counted together
+	if depth := issuerFairQueueDepth.Value(0, fairQueueOtherAttesters); depth != 4 {
+		t.Fatalf("expected 4 unweighted requests queued, got %v", depth)
+	}
+	if depth := issuerFairQueueDepth.Value(0, "heavy"); depth != 2 {
+		t.Fatalf("expected 2 heavy requests queued, got %v", depth)
+	}
+	order := make([]string, 0)
+	for range names {
+		s.release()
+		granted := ""
+		for granted == "" {
+			for name, pending := range requests {
+				if len(pending) == 0 {
+					continue
+				}
+				select {
+				case err := <-pending[0]:
+					if err != nil {
+						t.Fatal(err)
+					}
+					granted = name
+					requests[name] = pending[1:]
+				default:
+				}
+			}
+		}
+		order = append(order, granted)
+	}
+	expected := []string{"heavy", "quiet", "heavy", "noisy", "noisy", "noisy"}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected order %v, got %v", expected, order)
+		}
+	}
+	s.release()
+	if s.slots != 1 || len(s.depth) != 0 || issuerFairQueueDepth.Value(0, fairQueueOtherAttesters) != 0 {
+		t.Fatalf("expected the scheduler to be idle, got %d slots and depths %v", s.slots, s.depth)
+	}
+}
+
+func TestFairSchedulerLimits(t *testing.T) {
+	s := newFairScheduler(1, 1, nil)
+	release, err := s.acquire(context.Background(), "attester", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	granted := queueTestRequest(t, ctx, s, "attester", 1)
+	rejections := issuerFairQueueRejections.Value(0, fairQueueOtherAttesters)
+	if _, err := s.acquire(context.Background(), "attester", 1); !errors.Is(err, ErrFairQueueFull) {
+		t.Fatalf("expected a full queue, got %v", err)
+	}
+	if issuerFairQueueRejections.Value(0, fairQueueOtherAttesters) != rejections+1 {
+		t.Fatal("expected the rejection to be counted")
+	}
+	var text bytes.Buffer
+	metrics.Default.WriteText(&text)
+	if bytes.Contains(text.Bytes(), []byte(`attester="attester"`)) {
+		t.Fatal("expected no series for the address of an attester without a weight")
+	}
+
+	// Requests given up leave the queue, and the slot is free again
+	cancel()
+	if err := <-granted; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the request to be canceled, got %v", err)
+	}
+	release()
+	if s.slots != 1 || len(s.queue) != 0 {
+		t.Fatalf("expected a free slot and no queue, got %d slots and %d queued", s.slots, len(s.queue))
+	}
+
+	var none *fairScheduler
+	if release, err := none.acquire(context.Background(), "attester", 1); err != nil {
+		t.Fatal(err)
+	} else {
+		release()
+	}
+}
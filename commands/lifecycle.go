@@ -0,0 +1,148 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// lifecycle owns what a role runs: its servers, the background work keeping
+// its state fresh, and the stores and logs it flushes on the way out.
+//
+// Servers and background work start as they are added. On SIGINT, SIGTERM,
+// or the first failure, servers drain in-flight requests, then background
+// work is stopped and waited for, and closers run last, in the reverse order
+// they were added. Closers run on every shutdown, including failed startups.
+type lifecycle struct {
+	role            string
+	shutdownTimeout time.Duration
+
+	ctx         context.Context // done on shutdown
+	cancel      context.CancelFunc
+	stopSignals context.CancelFunc
+
+	backgroundCtx    context.Context // done once servers drained
+	cancelBackground context.CancelFunc
+
+	servers    sync.WaitGroup
+	background sync.WaitGroup
+
+	lock    sync.Mutex
+	err     error // the first failure
+	closers []lifecycleCloser
+}
+
+type lifecycleCloser struct {
+	name  string
+	close func() error
+}
+
+func newLifecycle(role string, shutdownTimeout time.Duration) *lifecycle {
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(signals)
+	backgroundCtx, cancelBackground := context.WithCancel(context.Background())
+	return &lifecycle{
+		role:             role,
+		shutdownTimeout:  shutdownTimeout,
+		ctx:              ctx,
+		cancel:           cancel,
+		stopSignals:      stopSignals,
+		backgroundCtx:    backgroundCtx,
+		cancelBackground: cancelBackground,
+	}
+}
+
+// context is done once the role shuts down. Startup work waiting on peers
+// gives up with it.
+func (l *lifecycle) context() context.Context {
+	return l.ctx
+}
+
+// fail shuts the role down, reporting err unless an earlier failure was.
+func (l *lifecycle) fail(err error) {
+	l.lock.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	l.lock.Unlock()
+	l.cancel()
+}
+
+// serve runs a server until shutdown. Servers return once they drained;
+// a server failing shuts the role down.
+func (l *lifecycle) serve(name string, run func(ctx context.Context) error) {
+	l.servers.Add(1)
+	go func() {
+		defer l.servers.Done()
+		if err := run(l.ctx); err != nil && err != http.ErrServerClosed {
+			l.fail(fmt.Errorf("%s: %w", name, err))
+		}
+	}()
+}
+
+// serveTLS runs the server of the role, over QUIC too if enableHTTP3 is set.
+func (l *lifecycle) serveTLS(server *http.Server, enableHTTP3 bool) {
+	l.serve("ListenAndServeTLS", func(ctx context.Context) error {
+		return serveTLS(ctx, server, enableHTTP3, l.shutdownTimeout)
+	})
+}
+
+// serveMetrics serves the metrics on their own listener. Failing to does not
+// take the role down.
+func (l *lifecycle) serveMetrics(addr string) {
+	l.serve("metrics", func(ctx context.Context) error {
+		serveMetrics(ctx, addr, l.shutdownTimeout)
+		return nil
+	})
+}
+
+// goBackground runs work until the servers drained.
+func (l *lifecycle) goBackground(run func(ctx context.Context)) {
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		run(l.backgroundCtx)
+	}()
+}
+
+// onShutdown adds a closer run once servers and background work stopped.
+func (l *lifecycle) onShutdown(name string, close func() error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.closers = append(l.closers, lifecycleCloser{name, close})
+}
+
+// wait blocks until the role shut down, returning the first failure. Closer
+// failures are logged, so that every closer runs.
+func (l *lifecycle) wait() error {
+	defer l.stopSignals()
+	l.servers.Wait()
+	l.cancel()
+	l.cancelBackground()
+	l.background.Wait()
+
+	l.lock.Lock()
+	closers := l.closers
+	l.closers = nil
+	err := l.err
+	l.lock.Unlock()
+	for i := len(closers) - 1; i >= 0; i-- {
+		if closeErr := closers[i].close(); closeErr != nil {
+			log.Errorln("Failed flushing", l.role, closers[i].name+":", closeErr)
+		}
+	}
+	return err
+}
+
+// abort shuts down a role that failed to start, returning err.
+func (l *lifecycle) abort(err error) error {
+	l.fail(err)
+	return l.wait()
+}
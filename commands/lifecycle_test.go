@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLifecycleShutdownOrder(t *testing.T) {
+	life := newLifecycle("test", time.Second)
+	var lock sync.Mutex
+	var events []string
+	record := func(event string) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, event)
+	}
+
+	life.onShutdown("first", func() error { record("close first"); return nil })
+	life.onShutdown("second", func() error { record("close second"); return errors.New("flush failed") })
+	life.goBackground(func(ctx context.Context) {
+		<-ctx.Done()
+		record("background")
+	})
+	life.serve("server", func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		record("server")
+		return nil
+	})
+
+	life.cancel()
+	if err := life.wait(); err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	expected := []string{"server", "background", "close second", "close first"}
+	if len(events) != len(expected) {
+		t.Fatalf("unexpected shutdown %v", events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("unexpected shutdown %v", events)
+		}
+	}
+}
+
+func TestLifecycleFailure(t *testing.T) {
+	life := newLifecycle("test", time.Second)
+	closed := false
+	life.onShutdown("state", func() error { closed = true; return nil })
+	stopped := make(chan struct{})
+	life.serve("healthy", func(ctx context.Context) error {
+		<-ctx.Done()
+		close(stopped)
+		return nil
+	})
+	failure := errors.New("address in use")
+	life.serve("broken", func(ctx context.Context) error { return failure })
+
+	err := life.wait()
+	if !errors.Is(err, failure) || err.Error() != "broken: address in use" {
+		t.Fatalf("expected the failure to be reported, got %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("expected the failure to shut the other servers down")
+	}
+	if !closed {
+		t.Fatal("expected closers to run on failure")
+	}
+
+	// Failed startups are shut down alike
+	life = newLifecycle("test", time.Second)
+	closed = false
+	life.onShutdown("state", func() error { closed = true; return nil })
+	if err := life.abort(failure); err != failure || !closed {
+		t.Fatalf("expected the startup failure to be returned after closing, got %v", err)
+	}
+}
@@ -0,0 +1,289 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	// Phases of a load test flow, as reported
+	loadgenChallenge  = "challenge"
+	loadgenIssuance   = "issuance"
+	loadgenRedemption = "redemption"
+	loadgenFlow       = "flow"
+
+	defaultLoadgenMix = "basic=50,rate-limited=50"
+)
+
+// loadgenFlowResult is the outcome of one flow: the latency of each phase it
+// got through, and the phase and reason it failed at, if it did.
+type loadgenFlowResult struct {
+	tokenType string
+	latencies map[string]time.Duration
+	phase     string // failed phase, empty if the flow succeeded
+	reason    string
+}
+
+// loadgenErrorReason describes an error without the addresses and ports of
+// connection errors, so that errors of a kind add up.
+func loadgenErrorReason(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return "connection failed"
+	}
+	return err.Error()
+}
+
+// runLoadgenFlow fetches the resource end to end with a token of the type,
+// timing each phase.
+func runLoadgenFlow(flow clientFlow, resourceURI string) loadgenFlowResult {
+	result := loadgenFlowResult{tokenType: flow.tokenType, latencies: make(map[string]time.Duration)}
+	fail := func(phase, reason string) loadgenFlowResult {
+		result.phase, result.reason = phase, reason
+		return result
+	}
+	start := time.Now()
+
+	challenge, resp, err := flow.challenge(resourceURI)
+	if err != nil {
+		return fail(loadgenChallenge, loadgenErrorReason(err))
+	}
+	if resp != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return fail(loadgenChallenge, fmt.Sprintf("status %d without a challenge", resp.StatusCode))
+	}
+	result.latencies[loadgenChallenge] = time.Since(start)
+
+	issuanceStart := time.Now()
+	token, err := flow.token(challenge)
+	if err != nil {
+		// The phase already tells that the token could not be fetched
+		return fail(loadgenIssuance, loadgenErrorReason(errors.Unwrap(err)))
+	}
+	result.latencies[loadgenIssuance] = time.Since(issuanceStart)
+
+	redemptionStart := time.Now()
+	resp, err = flow.redeem(resourceURI, token, challenge)
+	if err != nil {
+		return fail(loadgenRedemption, loadgenErrorReason(err))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fail(loadgenRedemption, fmt.Sprintf("status %d", resp.StatusCode))
+	}
+	result.latencies[loadgenRedemption] = time.Since(redemptionStart)
+	result.latencies[loadgenFlow] = time.Since(start)
+	return result
+}
+
+// loadgenReport tallies the flows of a load test.
+type loadgenReport struct {
+	lock      sync.Mutex
+	flows     map[string]int // by token type
+	succeeded map[string]int // by token type
+	latencies map[string][]time.Duration
+	errors    map[string]int // by phase and reason
+}
+
+func newLoadgenReport() *loadgenReport {
+	return &loadgenReport{
+		flows:     make(map[string]int),
+		succeeded: make(map[string]int),
+		latencies: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+	}
+}
+
+func (r *loadgenReport) record(result loadgenFlowResult) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.flows[result.tokenType]++
+	if result.phase == "" {
+		r.succeeded[result.tokenType]++
+	} else {
+		log.Debugln("Load test flow failed at", result.phase+":", result.reason)
+		r.errors[result.phase+": "+result.reason]++
+	}
+	for phase, latency := range result.latencies {
+		r.latencies[phase] = append(r.latencies[phase], latency)
+	}
+}
+
+// totals returns the flows run and those that succeeded.
+func (r *loadgenReport) totals() (int, int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	flows, succeeded := 0, 0
+	for tokenType, count := range r.flows {
+		flows += count
+		succeeded += r.succeeded[tokenType]
+	}
+	return flows, succeeded
+}
+
+// summary describes the throughput, the latency percentiles of each phase of
+// the flows that got through it, the flows by token type, and the errors by
+// phase and reason, most frequent first.
+func (r *loadgenReport) summary(elapsed time.Duration) string {
+	flows, succeeded := r.totals()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Flows: %d in %v (%.1f/s), %d succeeded, %d failed\n", flows, elapsed.Round(time.Millisecond), float64(flows)/elapsed.Seconds(), succeeded, flows-succeeded)
+	for _, phase := range []string{loadgenChallenge, loadgenIssuance, loadgenRedemption, loadgenFlow} {
+		latencies := append([]time.Duration{}, r.latencies[phase]...)
+		if len(latencies) == 0 {
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Fprintf(&b, "Latency of %s: p50=%v p90=%v p99=%v max=%v\n", phase,
+			percentile(latencies, 0.5), percentile(latencies, 0.9), percentile(latencies, 0.99), latencies[len(latencies)-1])
+	}
+
+	tokenTypes := make([]string, 0, len(r.flows))
+	for tokenType := range r.flows {
+		tokenTypes = append(tokenTypes, tokenType)
+	}
+	sort.Strings(tokenTypes)
+	for _, tokenType := range tokenTypes {
+		fmt.Fprintf(&b, "Token type %s: %d of %d succeeded\n", tokenType, r.succeeded[tokenType], r.flows[tokenType])
+	}
+
+	reasons := make([]string, 0, len(r.errors))
+	for reason := range r.errors {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if r.errors[reasons[i]] != r.errors[reasons[j]] {
+			return r.errors[reasons[i]] > r.errors[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "Error at %s: %d\n", reason, r.errors[reason])
+	}
+	return b.String()
+}
+
+// runLoadgen runs flows from concurrent workers until the context is done or,
+// if limit is positive, limit flows were started. Each worker has its own
+// token store, and draws the token type of each flow from the mix.
+func runLoadgen(ctx context.Context, flow clientFlow, resourceURI string, mix weightedMix, concurrency int, limit int64) *loadgenReport {
+	report := newLoadgenReport()
+	started := int64(0)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := mathrand.New(mathrand.NewSource(seed))
+			workerFlow := flow
+			workerFlow.store = EmptyStore()
+			for ctx.Err() == nil {
+				if limit > 0 && atomic.AddInt64(&started, 1) > limit {
+					return
+				}
+				workerFlow.tokenType = mix.pick(rnd)
+				report.record(runLoadgenFlow(workerFlow, resourceURI))
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	return report
+}
+
+func runLoadgenCommand(c *cli.Context) error {
+	origin := c.String("origin")
+	resource := c.String("resource")
+	secret := c.String("secret")
+	attester := c.String("attester")
+	duration := c.Duration("duration")
+	concurrency := c.Int("concurrency")
+	requests := c.Int64("requests")
+	timeout := c.Duration("timeout")
+	useHTTP3 := c.Bool("http3")
+	useH2C := c.Bool("h2c")
+	logLevel := c.String("log")
+
+	if origin == "" {
+		log.Fatal("Invalid origin. See README for running instructions.")
+	}
+	if secret == "" {
+		log.Fatal("Invalid client secret. See README for running instructions.")
+	}
+	if attester == "" {
+		log.Fatal("Invalid attester. See README for running instructions.")
+	}
+	if useHTTP3 && useH2C {
+		log.Fatal("Invalid transport, --http3 and --h2c exclude each other. See README for running instructions.")
+	}
+	if duration <= 0 || concurrency <= 0 || requests < 0 || timeout <= 0 {
+		log.Fatal("Invalid load test duration, concurrency, requests, or timeout. See README for running instructions.")
+	}
+	mix, err := parseWeightedMix(c.String("mix"), "token type", func(kind string) bool {
+		_, ok := tokenTypeNames[kind]
+		return ok
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch logLevel {
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	}
+
+	resourceURI, err := composeURL(origin, resource)
+	if err != nil {
+		return err
+	}
+	fetcher, err := newTokenFetcher(clientOptions{
+		secret:      secret,
+		attester:    attester,
+		originName:  origin,
+		id:          c.String("id"),
+		attestation: c.String("attestation"),
+		useHTTP3:    useHTTP3,
+		useH2C:      useH2C,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fetcher.httpClient.Timeout = timeout
+	profile, _ := lookupClientProfile("")
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	log.Infoln("Load testing", resourceURI, "for", duration, "with", concurrency, "workers")
+	start := time.Now()
+	report := runLoadgen(ctx, clientFlow{fetcher: fetcher, profile: profile, nonInteractive: c.Bool("non-interactive")}, resourceURI, mix, concurrency, requests)
+	fmt.Print(report.summary(time.Since(start)))
+
+	if flows, succeeded := report.totals(); flows > 0 && succeeded == 0 {
+		return fmt.Errorf("No flow of %d succeeded", flows)
+	}
+	return nil
+}
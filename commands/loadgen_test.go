@@ -0,0 +1,60 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestLoadgen(t *testing.T) {
+	server := newClientFlowServer(t)
+	flow := clientFlow{
+		fetcher: &tokenFetcher{
+			httpClient:  server.Client(),
+			basicClient: pat.NewBasicPublicClient(),
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	mix, _ := parseWeightedMix("basic=1", "token type", func(string) bool { return true })
+	report := runLoadgen(ctx, flow, server.URL+"/index.html", mix, 1, 5)
+	if flows, succeeded := report.totals(); flows != 5 || succeeded != 5 || server.issued != 5 {
+		t.Fatalf("expected 5 flows to succeed, got %d of %d with %d tokens issued", succeeded, flows, server.issued)
+	}
+	for _, phase := range []string{loadgenChallenge, loadgenIssuance, loadgenRedemption, loadgenFlow} {
+		if len(report.latencies[phase]) != 5 {
+			t.Fatalf("expected a latency of %s per flow, got %d", phase, len(report.latencies[phase]))
+		}
+	}
+
+	// Failed flows are broken down by phase and reason
+	mix, _ = parseWeightedMix("ed25519=1", "token type", func(string) bool { return true })
+	report = runLoadgen(ctx, flow, server.URL+"/index.html", mix, 1, 3)
+	summary := report.summary(time.Second)
+	if flows, succeeded := report.totals(); flows != 3 || succeeded != 0 {
+		t.Fatalf("expected 3 failed flows, got %d of %d", succeeded, flows)
+	}
+	if !strings.Contains(summary, "Token type ed25519: 0 of 3 succeeded") || !strings.Contains(summary, "Error at challenge: ") || !strings.Contains(summary, ": 3\n") {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+}
+
+func TestLoadgenErrorReason(t *testing.T) {
+	err := &url.Error{Op: "Get", URL: "https://origin.example/", Err: errors.New("dial tcp 192.0.2.1:443: connect: connection refused")}
+	if reason := loadgenErrorReason(err); reason != "connection failed" {
+		t.Fatalf("expected connection errors to add up, got %q", reason)
+	}
+	if reason := loadgenErrorReason(ErrOriginNotAllowed); reason != ErrOriginNotAllowed.Error() {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+
+	if _, err := newTokenFetcher(clientOptions{secret: "not hex"}); err == nil {
+		t.Fatal("expected an invalid secret to be refused")
+	}
+}
@@ -0,0 +1,138 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	attesterHealthURI      = "/health"
+	adminMaintenanceURI    = adminURIPrefix + "maintenance"
+	adminMaintenanceSetURI = adminURIPrefix + "maintenance/set"
+
+	// Retry-After sent in maintenance mode unless the admin request sets one
+	defaultMaintenanceRetryAfter = time.Minute
+
+	healthStatusOK       = "ok"
+	healthStatusDegraded = "degraded"
+)
+
+// maintenanceMode refuses new issuance while an operator works on the
+// attester, e.g., to migrate its state store. Client state, policy counts,
+// and registered keys are kept as is.
+type maintenanceMode struct {
+	lock       sync.Mutex
+	enabled    bool
+	reason     string
+	since      time.Time
+	retryAfter time.Duration
+}
+
+func newMaintenanceMode() *maintenanceMode {
+	return &maintenanceMode{}
+}
+
+// maintenanceSetRequest enables or disables maintenance mode.
+type maintenanceSetRequest struct {
+	Enabled    bool   `json:"enabled"`
+	Reason     string `json:"reason,omitempty"`
+	RetryAfter string `json:"retry_after,omitempty"` // Go duration, e.g., "5m"
+}
+
+type maintenanceState struct {
+	Enabled    bool   `json:"enabled"`
+	Reason     string `json:"reason,omitempty"`
+	Since      string `json:"since,omitempty"`
+	RetryAfter int    `json:"retry_after_seconds,omitempty"`
+}
+
+func (m *maintenanceMode) set(enabled bool, reason string, retryAfter time.Duration, now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if enabled && !m.enabled {
+		m.since = now
+	}
+	m.enabled = enabled
+	m.reason = reason
+	m.retryAfter = retryAfter
+	if !enabled {
+		m.reason = ""
+		m.since = time.Time{}
+		m.retryAfter = 0
+	}
+}
+
+func (m *maintenanceMode) state() maintenanceState {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.enabled {
+		return maintenanceState{}
+	}
+	return maintenanceState{
+		Enabled:    true,
+		Reason:     m.reason,
+		Since:      m.since.Format(time.RFC3339),
+		RetryAfter: int(m.retryAfter.Round(time.Second) / time.Second),
+	}
+}
+
+// wrap answers requests with 503 and Retry-After while in maintenance mode.
+func (m *maintenanceMode) wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		state := m.state()
+		if !state.Enabled {
+			next(w, req)
+			return
+		}
+		attesterMaintenanceRejections.Inc(0)
+		w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfter))
+		http.Error(w, "Attester in maintenance", http.StatusServiceUnavailable)
+	}
+}
+
+func (m *maintenanceMode) handleMaintenance(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, m.state())
+}
+
+func (m *maintenanceMode) handleMaintenanceSet(now func() time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var setReq maintenanceSetRequest
+		if err := readAdminJSON(req, &setReq); err != nil {
+			http.Error(w, "Invalid maintenance request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		retryAfter := defaultMaintenanceRetryAfter
+		if setReq.RetryAfter != "" {
+			d, err := time.ParseDuration(setReq.RetryAfter)
+			if err != nil || d < time.Second {
+				http.Error(w, fmt.Sprintf("Invalid retry_after %q, expected at least 1s", setReq.RetryAfter), http.StatusBadRequest)
+				return
+			}
+			retryAfter = d
+		}
+		m.set(setReq.Enabled, setReq.Reason, retryAfter, now())
+		writeAdminJSON(w, m.state())
+	}
+}
+
+// healthState is served without authentication for load balancers and
+// monitoring.
+type healthState struct {
+	Status      string            `json:"status"`
+	Maintenance *maintenanceState `json:"maintenance,omitempty"`
+}
+
+// handleHealth reports the attester degraded in maintenance mode. It still
+// answers 200 since the process is alive and its state intact.
+func (m *maintenanceMode) handleHealth(w http.ResponseWriter, req *http.Request) {
+	health := healthState{Status: healthStatusOK}
+	if state := m.state(); state.Enabled {
+		health.Status = healthStatusDegraded
+		health.Maintenance = &state
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeAdminJSON(w, health)
+}
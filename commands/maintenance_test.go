@@ -0,0 +1,68 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAttesterMaintenanceMode(t *testing.T) {
+	attester := newTestAttester(&AttesterPolicy{})
+	admin := attester.newAdminServer("secret")
+	issued := 0
+	handler := attester.maintenance.wrap(func(w http.ResponseWriter, req *http.Request) {
+		issued++
+	})
+
+	setMaintenance := func(setReq maintenanceSetRequest) int {
+		body, _ := json.Marshal(setReq)
+		req := httptest.NewRequest(http.MethodPost, adminMaintenanceSetURI, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w.Code
+	}
+	health := func() healthState {
+		w := httptest.NewRecorder()
+		attester.maintenance.handleHealth(w, httptest.NewRequest(http.MethodGet, attesterHealthURI, nil))
+		var state healthState
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &state) != nil {
+			t.Fatalf("unexpected health response %d: %s", w.Code, w.Body.String())
+		}
+		return state
+	}
+
+	if state := health(); state.Status != healthStatusOK || state.Maintenance != nil {
+		t.Fatalf("expected healthy attester, got %+v", state)
+	}
+	if code := setMaintenance(maintenanceSetRequest{Enabled: true, Reason: "state migration", RetryAfter: "5m"}); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	// New issuance is refused
+	rejections := attesterMaintenanceRejections.Value(0)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, attesterTokenRequestURI, nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "300" || issued != 0 {
+		t.Fatalf("expected 503 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if attesterMaintenanceRejections.Value(0) != rejections+1 {
+		t.Fatal("expected the rejection to be counted")
+	}
+	if state := health(); state.Status != healthStatusDegraded || state.Maintenance.Reason != "state migration" {
+		t.Fatalf("expected degraded attester, got %+v", state)
+	}
+
+	if code := setMaintenance(maintenanceSetRequest{Enabled: true, RetryAfter: "0s"}); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid retry_after, got %d", code)
+	}
+	if code := setMaintenance(maintenanceSetRequest{Enabled: false}); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, attesterTokenRequestURI, nil))
+	if issued != 1 || health().Status != healthStatusOK {
+		t.Fatal("expected issuance to resume after maintenance")
+	}
+}
@@ -0,0 +1,244 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/pat-app/metrics"
+)
+
+const (
+	// Messages whose wire sizes are recorded
+	messageTokenRequest  = "token-request"
+	messageTokenResponse = "token-response"
+	messageToken         = "token"
+)
+
+const (
+	// Reasons of origin validation failures, as metric labels
+	validationFailureAuthorization    = "authorization"
+	validationFailureTokenEncoding    = "token-encoding"
+	validationFailureUnknownChallenge = "unknown-challenge"
+	validationFailureRevokedChallenge = "revoked-challenge"
+	validationFailureVerification     = "verification"
+	validationFailureTokenType        = "token-type"
+)
+
+// Metrics of every role. All of them carry the token_type and draft_version
+// labels, see the metrics package.
+var (
+	issuerRequests = metrics.Default.NewCounter("pat_issuer_requests_total",
+		"Token requests handled by the issuer, by response status code.", "code")
+	issuerRequestDuration = metrics.Default.NewHistogram("pat_issuer_request_duration_seconds",
+		"Time spent handling token requests at the issuer.", metrics.DefaultBuckets)
+	issuerBatchedTokens = metrics.Default.NewCounter("pat_issuer_batched_tokens_total",
+		"Tokens evaluated by the issuer in batched token requests.")
+	issuerFairQueueDepth = metrics.Default.NewGauge("pat_issuer_fair_queue_depth",
+		"Token requests waiting for a signing slot at the issuer, by address of attesters with a configured weight, or other.", "attester")
+	issuerFairQueueWait = metrics.Default.NewHistogram("pat_issuer_fair_queue_wait_seconds",
+		"Time token requests waited for a signing slot at the issuer.", metrics.DefaultBuckets)
+	issuerFairQueueRejections = metrics.Default.NewCounter("pat_issuer_fair_queue_rejections_total",
+		"Token requests refused because the queue of their attester was full, by address of attesters with a configured weight, or other.", "attester")
+	issuerFaultsInjected = metrics.Default.NewCounter("pat_issuer_faults_injected_total",
+		"Token responses the issuer broke deliberately, by simulated fault.", "fault")
+	issuerKeyRotations = metrics.Default.NewCounter("pat_issuer_key_rotations_total",
+		"Rotations of the issuer keys, by trigger.", "trigger")
+	issuerAttesterSignatures = metrics.Default.NewCounter("pat_issuer_attester_signatures_total",
+		"Attester signatures of token requests checked by the issuer, by signing key ID and result.", "attester", "result")
+	issuerAttesterCertificates = metrics.Default.NewCounter("pat_issuer_attester_certificates_total",
+		"Attester client certificates of token requests checked by the issuer, by common name and result.", "attester", "result")
+	issuerOriginRefusals = metrics.Default.NewCounter("pat_issuer_origin_refusals_total",
+		"Rate-limited token requests the issuer refused since their origin is outside the allowlist.")
+	issuerOHTTPRequests = metrics.Default.NewCounter("pat_issuer_ohttp_requests_total",
+		"Token requests received through the Oblivious HTTP gateway, by status code of the encapsulated response, or why decapsulation failed.", "result")
+
+	attesterAttestations = metrics.Default.NewCounter("pat_attester_attestations_total",
+		"Attestation evidence checked by the attester, by format and result.", "format", "result")
+	attesterRequests = metrics.Default.NewCounter("pat_attester_requests_total",
+		"Token requests handled by the attester, by response status code.", "code")
+	attesterRequestDuration = metrics.Default.NewHistogram("pat_attester_request_duration_seconds",
+		"Time spent handling token requests at the attester, including the issuer round trip.", metrics.DefaultBuckets)
+	attesterIssuerAttempts = metrics.Default.NewCounter("pat_attester_issuer_attempts_total",
+		"Token requests forwarded by the attester, by issuer endpoint and result.", "endpoint", "result")
+	attesterIssuerResponseDuration = metrics.Default.NewHistogram("pat_attester_issuer_response_duration_seconds",
+		"Time until an issuer endpoint responded to a forwarded token request, by endpoint.", metrics.DefaultBuckets, "endpoint")
+	attesterIssuerFailovers = metrics.Default.NewCounter("pat_attester_issuer_failovers_total",
+		"Token requests retried against a secondary issuer endpoint.")
+	attesterOHTTPRelayed = metrics.Default.NewCounter("pat_attester_ohttp_relayed_total",
+		"Oblivious HTTP requests relayed by the attester to issuer gateways, by result.", "result")
+	attesterIndexMismatches = metrics.Default.NewCounter("pat_attester_index_mismatches_total",
+		"Token requests whose origin index differs from the one recorded for the client and anonymous origin.")
+	attesterLimitsExceeded = metrics.Default.NewCounter("pat_attester_limits_exceeded_total",
+		"Token requests refused because the client hit a limit, by limit.", "limit")
+	attesterBlindReuse = metrics.Default.NewCounter("pat_attester_blind_reuse_total",
+		"Blinded request keys returned by the issuer that the attester saw before, by where they were seen.", "scope")
+	attesterOriginChurn = metrics.Default.NewCounter("pat_attester_origin_churn_total",
+		"New anonymous origin IDs used by clients beyond the churn threshold.")
+	attesterOriginRotations = metrics.Default.NewCounter("pat_attester_origin_rotations_total",
+		"Anonymous origin IDs rotated by clients, recognized by their unchanged origin index.")
+	attesterDuplicateRequests = metrics.Default.NewCounter("pat_attester_duplicate_requests_total",
+		"Token requests identical to one of the same client within the deduplication window, by whether they were replayed or rejected.", "result")
+	attesterStateExpired = metrics.Default.NewCounter("pat_attester_state_expired_total",
+		"Anonymous origin mappings and clients dropped by state rotation, by kind.", "kind")
+	attesterStatePersistFailures = metrics.Default.NewCounter("pat_attester_state_persist_failures_total",
+		"Client state changes the attester failed to write to its state store.")
+	attesterClientKeyChecks = metrics.Default.NewCounter("pat_attester_client_key_checks_total",
+		"Client key checks of rate-limited token requests, by result.", "result")
+	attesterStreamAborts = metrics.Default.NewCounter("pat_attester_stream_aborts_total",
+		"Streamed responses the attester aborted since the issuer's response body failed.")
+	attesterIssuerPolicyChecks = metrics.Default.NewCounter("pat_attester_issuer_policy_checks_total",
+		"Token requests checked against the policy in the issuer directory, by result.", "result")
+	attesterFaultsInjected = metrics.Default.NewCounter("pat_attester_faults_injected_total",
+		"Token requests the attester misbehaved on deliberately, by simulated fault.", "fault")
+	attesterMaintenanceRejections = metrics.Default.NewCounter("pat_attester_maintenance_rejections_total",
+		"Token requests refused with 503 while the attester was in maintenance mode.")
+
+	originChallenges = metrics.Default.NewCounter("pat_origin_challenges_total",
+		"Token challenges issued by the origin.")
+	originPreflights = metrics.Default.NewCounter("pat_origin_options_requests_total",
+		"OPTIONS requests answered by the origin, by whether they were CORS preflights from allowed origins.", "result")
+	originRedirects = metrics.Default.NewCounter("pat_origin_challenge_page_total",
+		"Steps of the redirect flow for browsers without PrivateToken support, by step.", "step")
+	originIssuerChallenges = metrics.Default.NewCounter("pat_origin_issuer_challenges_total",
+		"Token challenges issued by the origin, by the issuer they are for.", "issuer")
+	originChallengeAttributes = metrics.Default.NewCounter("pat_origin_challenge_attributes_total",
+		"Challenge responses of the origin, by whether the client asked for non-interactive, cross-origin, and multiple challenges.", "non_interactive", "cross_origin", "multi_count")
+	originChallengeRuleMatches = metrics.Default.NewCounter("pat_origin_challenge_rule_matches_total",
+		"Requests without a token decided by a challenge rule of the origin, by the token type it demands and rule.", "rule")
+	originOutstandingChallenges = metrics.Default.NewGauge("pat_origin_outstanding_challenges",
+		"Challenges issued by the origin and not yet redeemed.")
+	originChallengeContexts = metrics.Default.NewGauge("pat_origin_challenge_contexts",
+		"Distinct challenge contexts with outstanding challenges at the origin.")
+	originChallengesDropped = metrics.Default.NewCounter("pat_origin_challenges_dropped_total",
+		"Challenges issued by the origin but not stored because their context reached the cap.")
+	originRedemptions = metrics.Default.NewCounter("pat_origin_redemptions_total",
+		"Token redemptions handled by the origin, by response status code.", "code")
+	originNameRedemptions = metrics.Default.NewCounter("pat_origin_name_redemptions_total",
+		"Token redemptions handled by the process, by origin name and whether the token was admitted.", "origin", "result")
+	originFailedTokenCacheHits = metrics.Default.NewCounter("pat_origin_failed_token_cache_hits_total",
+		"Redemptions refused because the same token failed verification recently, without verifying it again.")
+	originTokenTypeFallbacks = metrics.Default.NewCounter("pat_origin_token_type_fallbacks_total",
+		"Challenges for another token type than the client asked for, by the type asked for and why it was not offered. Token types pat-app does not implement are counted as 0.", "reason")
+	originRedemptionReplays = metrics.Default.NewCounter("pat_origin_redemption_replays_total",
+		"Redemptions answered with the cached outcome of an earlier redemption of the same token.")
+	originValidationFailures = metrics.Default.NewCounter("pat_origin_validation_failures_total",
+		"Redemptions refused before or at token verification, by reason.", "reason")
+	originDoubleSpends = metrics.Default.NewCounter("pat_origin_double_spends_total",
+		"Redemptions refused because the origin admitted the same token before.")
+	originVerificationDuration = metrics.Default.NewHistogram("pat_origin_verification_duration_seconds",
+		"Time spent verifying token authenticators at the origin.", metrics.DefaultBuckets)
+	originBatchVerifications = metrics.Default.NewCounter("pat_origin_batch_verifications_total",
+		"Tokens verified in batches through the admin API, by result.", "result")
+	originRemoteVerifications = metrics.Default.NewCounter("pat_origin_remote_verifications_total",
+		"Tokens verified at the issuer on behalf of the origin, by verdict source and result.", "source", "result")
+	originEarlyHints = metrics.Default.NewCounter("pat_origin_early_hints_total",
+		"Challenges sent ahead of the 401 in 103 Early Hints responses.")
+	originFaultsInjected = metrics.Default.NewCounter("pat_origin_faults_injected_total",
+		"Challenges the origin broke deliberately, by simulated fault.", "fault")
+	originOutageFallbacks = metrics.Default.NewCounter("pat_origin_outage_fallbacks_total",
+		"Redemptions the origin could not verify, by cause and fallback action.", "cause", "action")
+	originDirectoryRequests = metrics.Default.NewCounter("pat_origin_directory_requests_total",
+		"Requests for the issuer directory served by the origin, by result of its cache.", "result")
+	originIssuerRefreshes = metrics.Default.NewCounter("pat_origin_issuer_refreshes_total",
+		"Fetches of the issuer directory and encapsulation key by the origin, by resource and result.", "resource", "result")
+	originIssuerKeysStale = metrics.Default.NewGauge("pat_origin_issuer_keys_stale",
+		"Whether the origin serves last known good issuer keys because the latest fetch failed, by resource.", "resource")
+	originIssuerKeysRefreshed = metrics.Default.NewGauge("pat_origin_issuer_keys_refreshed_timestamp_seconds",
+		"Unix time of the latest successful fetch of issuer keys by the origin, by resource.", "resource")
+
+	clockSkew = metrics.Default.NewGauge("pat_clock_skew_seconds",
+		"Offset of a peer's clock from the local clock, measured from the Date header of its responses, by peer.", "peer")
+	clockSkewChecks = metrics.Default.NewCounter("pat_clock_skew_checks_total",
+		"Timestamps checked against the local clock, by check and result: ok, tolerated only thanks to the skew tolerance, or refused.", "check", "result")
+
+	tokenMessageSize = metrics.Default.NewHistogram("pat_token_message_size_bytes",
+		"Wire sizes of TokenRequest, TokenResponse, and Token messages, by role and message.", metrics.SizeBuckets, "role", "message")
+
+	selfTestChecks = metrics.Default.NewCounter("pat_self_test_checks_total",
+		"Startup self-test checks, by role, check, and result.", "role", "check", "result")
+)
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int           // body bytes
+	body    *bytes.Buffer // copy of the body, if set
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{
+		ResponseWriter: w,
+		status:         http.StatusOK,
+	}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(data)
+	r.written += n
+	if r.body != nil {
+		r.body.Write(data[:n])
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush the wrapped writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// peekTokenType returns the token type of a TokenRequest body as a metric
+// label, zero if the body is too short or of an unknown type, and the body,
+// leaving the body intact for the handler.
+func peekTokenType(req *http.Request) (uint16, []byte) {
+	if req.Body == nil {
+		return 0, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil || len(body) < tokenTypeLength {
+		return 0, body
+	}
+	return labelTokenType(binary.BigEndian.Uint16(body)), body
+}
+
+// instrumentTokenRequests counts and times a handler of TokenRequest bodies,
+// and records the sizes of the TokenRequest and of successful TokenResponses,
+// and both messages in the transcript if one is recorded.
+func instrumentTokenRequests(role string, requests *metrics.Counter, duration *metrics.Histogram, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		tokenType, body := peekTokenType(req)
+		recorder := newStatusRecorder(w)
+		if protocolTranscript != nil {
+			recorder.body = &bytes.Buffer{}
+		}
+		handler(recorder, req)
+		requests.Inc(tokenType, strconv.Itoa(recorder.status))
+		duration.Observe(tokenType, time.Since(start).Seconds())
+		tokenMessageSize.Observe(tokenType, float64(len(body)), role, messageTokenRequest)
+		if recorder.status == http.StatusOK {
+			tokenMessageSize.Observe(tokenType, float64(recorder.written), role, messageTokenResponse)
+		}
+		if recorder.body != nil {
+			requestMessage, responseMessage := messageTokenRequest, messageTokenResponse
+			if req.Header.Get("Content-Type") == batchedTokenRequestMediaType {
+				requestMessage, responseMessage = messageBatchedTokenRequest, messageBatchedTokenResponse
+			}
+			protocolTranscript.record(role, requestMessage, tokenType, nil, body)
+			if recorder.status == http.StatusOK {
+				protocolTranscript.record(role, responseMessage, tokenType, nil, recorder.body.Bytes())
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/pat-app/metrics"
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestInstrumentTokenRequests(t *testing.T) {
+	before := issuerRequests.Value(pat.BasicPublicTokenType, "400")
+	handler := instrumentTokenRequests("issuer", issuerRequests, issuerRequestDuration, func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if len(body) != 3 {
+			t.Fatal("handler did not receive the full body")
+		}
+		http.Error(w, "bad", http.StatusBadRequest)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, tokenRequestURI, bytes.NewReader([]byte{0x00, 0x02, 0xff}))
+	handler(httptest.NewRecorder(), req)
+
+	if issuerRequests.Value(pat.BasicPublicTokenType, "400") != before+1 {
+		t.Fatal("request not counted under its token type and status")
+	}
+}
+
+func TestTokenMessageSizes(t *testing.T) {
+	handler := instrumentTokenRequests("attester", attesterRequests, attesterRequestDuration, func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Fail") != "" {
+			http.Error(w, "bad", http.StatusBadRequest)
+			return
+		}
+		w.Write(make([]byte, 256))
+	})
+	requests := tokenMessageSize.Count(pat.RateLimitedTokenType, "attester", messageTokenRequest)
+	responses := tokenMessageSize.Count(pat.RateLimitedTokenType, "attester", messageTokenResponse)
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, attesterTokenRequestURI, bytes.NewReader([]byte{0x00, 0x03, 0xff})))
+	failed := httptest.NewRequest(http.MethodPost, attesterTokenRequestURI, bytes.NewReader([]byte{0x00, 0x03, 0xff}))
+	failed.Header.Set("X-Fail", "1")
+	handler(httptest.NewRecorder(), failed)
+
+	if tokenMessageSize.Count(pat.RateLimitedTokenType, "attester", messageTokenRequest) != requests+2 {
+		t.Fatal("expected both token requests to be recorded")
+	}
+	if tokenMessageSize.Count(pat.RateLimitedTokenType, "attester", messageTokenResponse) != responses+1 {
+		t.Fatal("expected only the successful token response to be recorded")
+	}
+
+	var text bytes.Buffer
+	metrics.Default.WriteText(&text)
+	if !bytes.Contains(text.Bytes(), []byte(`pat_token_message_size_bytes_bucket{token_type="rate-limited",draft_version="draft-privacypass-rate-limit-tokens-03",role="attester",message="token-response",le="256"}`)) {
+		t.Fatalf("expected the response in the 256 byte bucket:\n%s", text.String())
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serveMetrics(ctx, addr, time.Second)
+		close(done)
+	}()
+
+	var resp *http.Response
+	for i := 0; ; i++ {
+		if resp, err = http.Get("http://" + addr + metricsURI); err == nil {
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(body, []byte("# TYPE pat_origin_validation_failures_total counter")) {
+		t.Fatalf("expected the metrics without authentication, got %d:\n%s", resp.StatusCode, body)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("metrics server did not stop")
+	}
+}
+
+func TestOriginValidationFailures(t *testing.T) {
+	origin := newMultiIssuerOrigin(t, newTestIssuer(t, "issuer.example"))
+	authorization := originValidationFailures.Value(0, validationFailureAuthorization)
+	encoding := originValidationFailures.Value(0, validationFailureTokenEncoding)
+
+	for _, header := range []string{"Basic Zm9vOmJhcg==", "PrivateToken token=AAAA"} {
+		req := httptest.NewRequest(http.MethodGet, testResource, nil)
+		req.Header.Set("Authorization", header)
+		origin.handleRequest(httptest.NewRecorder(), req)
+	}
+
+	if originValidationFailures.Value(0, validationFailureAuthorization) != authorization+1 {
+		t.Fatal("expected the malformed Authorization header to be counted")
+	}
+	if originValidationFailures.Value(0, validationFailureTokenEncoding) != encoding+1 {
+		t.Fatal("expected the malformed token to be counted")
+	}
+}
+
+func TestUnknownTokenTypeLabels(t *testing.T) {
+	handler := instrumentTokenRequests("issuer", issuerRequests, issuerRequestDuration, func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "bad", http.StatusBadRequest)
+	})
+	before := issuerRequests.Value(0, "400")
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, tokenRequestURI, bytes.NewReader([]byte{0xBE, 0xEF, 0xff})))
+	if issuerRequests.Value(0, "400") != before+1 {
+		t.Fatal("expected the request to be counted under the unknown token type")
+	}
+
+	origin := newMultiIssuerOrigin(t, newTestIssuer(t, "issuer.example"))
+	tokenType := originValidationFailures.Value(0, validationFailureTokenType)
+	token := make([]byte, 2+32+32+32+256)
+	token[0], token[1] = 0xBE, 0xEF
+	req := httptest.NewRequest(http.MethodGet, testResource, nil)
+	req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token))
+	w := httptest.NewRecorder()
+	origin.handleRequest(w, req)
+	if w.Code != http.StatusBadRequest || originValidationFailures.Value(0, validationFailureTokenType) != tokenType+1 {
+		t.Fatalf("expected the token to be refused under the unknown token type, got %d", w.Code)
+	}
+
+	var text bytes.Buffer
+	metrics.Default.WriteText(&text)
+	if bytes.Contains(text.Bytes(), []byte(`token_type="0xbeef"`)) {
+		t.Fatalf("expected no series for the token type clients sent:\n%s", text.String())
+	}
+}
+
+func TestTokenMessageSizeAcceptedTypes(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	origin := newMultiIssuerOrigin(t, issuer)
+	origin.tokenTypes = newTokenTypeToggle()
+	if err := origin.tokenTypes.set([]string{"rate-limited"}); err != nil {
+		t.Fatal(err)
+	}
+	redeem := func() int {
+		token := createTestToken(t, issuer, testTokenChallenge(pat.BasicPublicTokenType))
+		req := httptest.NewRequest(http.MethodGet, testResource, nil)
+		req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+		w := httptest.NewRecorder()
+		origin.handleRequest(w, req)
+		return w.Code
+	}
+
+	// Tokens of types the origin does not accept are refused before their
+	// size is observed
+	observed := tokenMessageSize.Count(pat.BasicPublicTokenType, "origin", messageToken)
+	if status := redeem(); status != http.StatusBadRequest {
+		t.Fatalf("expected the token to be refused, got %d", status)
+	}
+	if tokenMessageSize.Count(pat.BasicPublicTokenType, "origin", messageToken) != observed {
+		t.Fatal("expected no size observed for a token type not accepted")
+	}
+
+	origin.tokenTypes.set([]string{"basic", "rate-limited"})
+	redeem()
+	if tokenMessageSize.Count(pat.BasicPublicTokenType, "origin", messageToken) != observed+1 {
+		t.Fatal("expected the size of an accepted token type to be observed")
+	}
+}
@@ -0,0 +1,85 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+const (
+	// Longest redemption nonce a token challenge may carry
+	maxChallengeNonceLength = 32
+
+	// Sources of challenge nonces
+	nonceSourceSystem = "system"
+	nonceSourceFile   = "file:"
+	nonceSourceSeed   = "seed:"
+)
+
+// seededReader is a deterministic CSPRNG, the ChaCha20 keystream keyed with
+// the SHA-256 digest of a seed. It is meant for reproducible test vectors
+// only, as anyone knowing the seed can predict every nonce.
+type seededReader struct {
+	lock   sync.Mutex
+	cipher *chacha20.Cipher
+}
+
+func newSeededReader(seed []byte) (*seededReader, error) {
+	key := sha256.Sum256(seed)
+	cipher, err := chacha20.NewUnauthenticatedCipher(key[:], make([]byte, chacha20.NonceSize))
+	if err != nil {
+		return nil, err
+	}
+	return &seededReader{cipher: cipher}, nil
+}
+
+func (r *seededReader) Read(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range p {
+		p[i] = 0
+	}
+	r.cipher.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+// newNonceSource returns the randomness source described by spec: "system"
+// (or empty) for the operating system CSPRNG, "file:<path>" to read from a
+// device such as /dev/hwrng, or "seed:<hex>" for a deterministic CSPRNG.
+func newNonceSource(spec string) (io.Reader, error) {
+	switch {
+	case spec == "" || spec == nonceSourceSystem:
+		return rand.Reader, nil
+	case strings.HasPrefix(spec, nonceSourceFile):
+		fileName := strings.TrimPrefix(spec, nonceSourceFile)
+		if fileName == "" {
+			return nil, fmt.Errorf("Invalid nonce source %q, missing file name", spec)
+		}
+		return os.Open(fileName)
+	case strings.HasPrefix(spec, nonceSourceSeed):
+		seed, err := hex.DecodeString(strings.TrimPrefix(spec, nonceSourceSeed))
+		if err != nil || len(seed) == 0 {
+			return nil, fmt.Errorf("Invalid nonce source %q, expected a hex-encoded seed", spec)
+		}
+		return newSeededReader(seed)
+	default:
+		return nil, fmt.Errorf("Unknown nonce source %q", spec)
+	}
+}
+
+// readNonce reads a nonce of the given length, failing if the source cannot
+// provide all of it.
+func readNonce(source io.Reader, length int) ([]byte, error) {
+	nonce := make([]byte, length)
+	if _, err := io.ReadFull(source, nonce); err != nil {
+		return nil, fmt.Errorf("Failed reading nonce: %w", err)
+	}
+	return nonce, nil
+}
@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestNonceSource(t *testing.T) {
+	read := func(spec string) []byte {
+		source, err := newNonceSource(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce, err := readNonce(source, 32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nonce
+	}
+
+	if !bytes.Equal(read("seed:0102"), read("seed:0102")) {
+		t.Fatal("expected seeded nonces to be reproducible")
+	}
+	if bytes.Equal(read("seed:0102"), read("seed:0103")) || bytes.Equal(read("system"), read("system")) {
+		t.Fatal("expected distinct nonces")
+	}
+	for _, spec := range []string{"seed:", "seed:zz", "file:", "dice"} {
+		if _, err := newNonceSource(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+	if _, err := readNonce(strings.NewReader("short"), 32); err == nil {
+		t.Fatal("expected an exhausted source to fail")
+	}
+}
+
+func TestChallengeNonce(t *testing.T) {
+	challengeNonce := func(origin *Origin) []byte {
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+		challengeEnc, _, err := origin.CreateChallenge(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		challengeBlob, _ := base64.URLEncoding.DecodeString(challengeEnc)
+		challenge, err := pat.UnmarshalTokenChallenge(challengeBlob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return challenge.RedemptionNonce
+	}
+	seeded := func() *Origin {
+		origin := newTestOrigin()
+		origin.nonceLength = 16
+		origin.nonceSource, _ = newNonceSource("seed:00")
+		return origin
+	}
+
+	nonce := challengeNonce(seeded())
+	if len(nonce) != 16 || !bytes.Equal(nonce, challengeNonce(seeded())) {
+		t.Fatal("expected reproducible nonces of the configured length")
+	}
+
+	// Origins fail closed if the nonce source fails
+	origin := newTestOrigin()
+	origin.nonceSource = strings.NewReader("")
+	w := httptest.NewRecorder()
+	origin.handleRequest(w, httptest.NewRequest(http.MethodGet, "https://origin.example/", nil))
+	if w.Code != http.StatusInternalServerError || w.Header().Get("WWW-Authenticate") != "" {
+		t.Fatalf("expected no challenge without entropy, got %d", w.Code)
+	}
+	if len(outstandingChallenges(origin)) != 0 {
+		t.Fatal("expected no outstanding challenge")
+	}
+}
@@ -0,0 +1,609 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/cisco/go-hpke"
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Oblivious HTTP (RFC 9458) tunnels token requests from clients through the
+// attester, acting as relay, to the issuer's gateway. Requests are Binary HTTP
+// messages encrypted to the gateway key, so the attester learns who asks but
+// not what, and the issuer what is asked but not by whom.
+
+var (
+	// Issuer key configuration and gateway, and attester relay URLs
+	issuerOHTTPKeysURI    = "/ohttp-keys"
+	issuerOHTTPGatewayURI = "/ohttp-gateway"
+	attesterOHTTPRelayURI = "/ohttp-relay"
+
+	// Media types of key configurations and encapsulated messages
+	ohttpKeysMediaType     = "application/ohttp-keys"
+	ohttpRequestMediaType  = "message/ohttp-req"
+	ohttpResponseMediaType = "message/ohttp-res"
+
+	ErrUnknownOHTTPKey     = errors.New("Unknown Oblivious HTTP key configuration")
+	ErrInvalidOHTTPMessage = errors.New("Invalid Oblivious HTTP message")
+)
+
+const (
+	ohttpRequestLabel  = "message/bhttp request"
+	ohttpResponseLabel = "message/bhttp response"
+
+	// The gateway publishes a single key configuration
+	ohttpKeyID = 1
+	// Length of the seeds gateway keys are derived from
+	ohttpKeySeedLength = 32
+
+	ohttpKEM  = hpke.DHKEM_X25519
+	ohttpKDF  = hpke.KDF_HKDF_SHA256
+	ohttpAEAD = hpke.AEAD_AESGCM128
+)
+
+func ohttpSuite() (hpke.CipherSuite, error) {
+	return hpke.AssembleCipherSuite(ohttpKEM, ohttpKDF, ohttpAEAD)
+}
+
+type ohttpSymmetricSuite struct {
+	kdfID  hpke.KDFID
+	aeadID hpke.AEADID
+}
+
+// ohttpKeyConfig is a gateway key configuration, as published by the issuer.
+type ohttpKeyConfig struct {
+	keyID     uint8
+	kemID     hpke.KEMID
+	publicKey []byte
+	suites    []ohttpSymmetricSuite
+}
+
+func (c ohttpKeyConfig) Marshal() []byte {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(c.keyID)
+	b.AddUint16(uint16(c.kemID))
+	b.AddBytes(c.publicKey)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, suite := range c.suites {
+			b.AddUint16(uint16(suite.kdfID))
+			b.AddUint16(uint16(suite.aeadID))
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+// supported reports whether the configuration can be used with ohttpSuite.
+func (c ohttpKeyConfig) supported() bool {
+	if c.kemID != ohttpKEM {
+		return false
+	}
+	for _, suite := range c.suites {
+		if suite.kdfID == ohttpKDF && suite.aeadID == ohttpAEAD {
+			return true
+		}
+	}
+	return false
+}
+
+// marshalOHTTPKeyConfigs encodes configurations as application/ohttp-keys.
+func marshalOHTTPKeyConfigs(configs ...ohttpKeyConfig) []byte {
+	b := cryptobyte.NewBuilder(nil)
+	for _, config := range configs {
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(config.Marshal())
+		})
+	}
+	return b.BytesOrPanic()
+}
+
+// unmarshalOHTTPKeyConfigs decodes application/ohttp-keys, skipping
+// configurations with KEMs it does not know the key size of.
+func unmarshalOHTTPKeyConfigs(data []byte) ([]ohttpKeyConfig, error) {
+	configs := make([]ohttpKeyConfig, 0)
+	s := cryptobyte.String(data)
+	for !s.Empty() {
+		var configEnc cryptobyte.String
+		var kemID uint16
+		config := ohttpKeyConfig{}
+		if !s.ReadUint16LengthPrefixed(&configEnc) || !configEnc.ReadUint8(&config.keyID) || !configEnc.ReadUint16(&kemID) {
+			return nil, fmt.Errorf("Invalid Oblivious HTTP key configuration")
+		}
+		config.kemID = hpke.KEMID(kemID)
+		if config.kemID != ohttpKEM {
+			continue
+		}
+		suite, err := ohttpSuite()
+		if err != nil {
+			return nil, err
+		}
+
+		var suites cryptobyte.String
+		if !configEnc.ReadBytes(&config.publicKey, suite.KEM.PublicKeySize()) || !configEnc.ReadUint16LengthPrefixed(&suites) || !configEnc.Empty() {
+			return nil, fmt.Errorf("Invalid Oblivious HTTP key configuration")
+		}
+		for !suites.Empty() {
+			var kdfID, aeadID uint16
+			if !suites.ReadUint16(&kdfID) || !suites.ReadUint16(&aeadID) {
+				return nil, fmt.Errorf("Invalid Oblivious HTTP key configuration")
+			}
+			config.suites = append(config.suites, ohttpSymmetricSuite{hpke.KDFID(kdfID), hpke.AEADID(aeadID)})
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// ohttpHeader returns the header binding an encapsulated request to the key
+// configuration and algorithms.
+func ohttpHeader(keyID uint8) []byte {
+	header := []byte{keyID, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(header[1:], uint16(ohttpKEM))
+	binary.BigEndian.PutUint16(header[3:], uint16(ohttpKDF))
+	binary.BigEndian.PutUint16(header[5:], uint16(ohttpAEAD))
+	return header
+}
+
+func ohttpInfo(header []byte) []byte {
+	info := append([]byte(ohttpRequestLabel), 0)
+	return append(info, header...)
+}
+
+// ohttpResponseNonceLength is max(Nn, Nk).
+func ohttpResponseNonceLength(suite hpke.CipherSuite) int {
+	if suite.AEAD.NonceSize() > suite.AEAD.KeySize() {
+		return suite.AEAD.NonceSize()
+	}
+	return suite.AEAD.KeySize()
+}
+
+// ohttpResponseAEAD derives the key and nonce protecting a response from the
+// secret exported by the request context.
+func ohttpResponseAEAD(suite hpke.CipherSuite, secret, enc, responseNonce []byte) (cipher.AEAD, []byte, error) {
+	salt := append(append([]byte{}, enc...), responseNonce...)
+	prk := suite.KDF.Extract(salt, secret)
+	key := suite.KDF.Expand(prk, []byte("key"), suite.AEAD.KeySize())
+	nonce := suite.KDF.Expand(prk, []byte("nonce"), suite.AEAD.NonceSize())
+	aead, err := suite.AEAD.New(key)
+	return aead, nonce, err
+}
+
+// ohttpClientContext decapsulates the response to a request.
+type ohttpClientContext struct {
+	suite  hpke.CipherSuite
+	enc    []byte
+	sender *hpke.SenderContext
+}
+
+// encapsulateOHTTPRequest encrypts the Binary HTTP request to the gateway key.
+func encapsulateOHTTPRequest(config ohttpKeyConfig, request []byte) ([]byte, *ohttpClientContext, error) {
+	if !config.supported() {
+		return nil, nil, fmt.Errorf("Unsupported Oblivious HTTP key configuration %d", config.keyID)
+	}
+	suite, err := ohttpSuite()
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := suite.KEM.DeserializePublicKey(config.publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := ohttpHeader(config.keyID)
+	enc, sender, err := hpke.SetupBaseS(suite, rand.Reader, publicKey, ohttpInfo(header))
+	if err != nil {
+		return nil, nil, err
+	}
+	encRequest := append(append(header, enc...), sender.Seal(nil, request)...)
+	return encRequest, &ohttpClientContext{suite: suite, enc: enc, sender: sender}, nil
+}
+
+func (c *ohttpClientContext) decapsulateResponse(encResponse []byte) ([]byte, error) {
+	nonceLength := ohttpResponseNonceLength(c.suite)
+	if len(encResponse) < nonceLength {
+		return nil, ErrInvalidOHTTPMessage
+	}
+	secret := c.sender.Export([]byte(ohttpResponseLabel), nonceLength)
+	aead, nonce, err := ohttpResponseAEAD(c.suite, secret, c.enc, encResponse[:nonceLength])
+	if err != nil {
+		return nil, err
+	}
+	response, err := aead.Open(nil, nonce, encResponse[nonceLength:], nil)
+	if err != nil {
+		return nil, ErrInvalidOHTTPMessage
+	}
+	return response, nil
+}
+
+// ohttpGatewayKey decapsulates requests encrypted to the gateway.
+type ohttpGatewayKey struct {
+	config     ohttpKeyConfig
+	suite      hpke.CipherSuite
+	privateKey hpke.KEMPrivateKey
+}
+
+func newOHTTPGatewayKey(keyID uint8, seed []byte) (*ohttpGatewayKey, error) {
+	suite, err := ohttpSuite()
+	if err != nil {
+		return nil, err
+	}
+	privateKey, publicKey, err := suite.KEM.DeriveKeyPair(seed)
+	if err != nil {
+		return nil, err
+	}
+	return &ohttpGatewayKey{
+		config: ohttpKeyConfig{
+			keyID:     keyID,
+			kemID:     ohttpKEM,
+			publicKey: suite.KEM.SerializePublicKey(publicKey),
+			suites:    []ohttpSymmetricSuite{{ohttpKDF, ohttpAEAD}},
+		},
+		suite:      suite,
+		privateKey: privateKey,
+	}, nil
+}
+
+// loadOHTTPGatewayKey derives the gateway key from the hex-encoded seed in the
+// file, or a random one if no file is given.
+func loadOHTTPGatewayKey(fileName string) (*ohttpGatewayKey, error) {
+	seed := make([]byte, ohttpKeySeedLength)
+	if fileName == "" {
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		return newOHTTPGatewayKey(ohttpKeyID, seed)
+	}
+	seedHex, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	seed, err = hex.DecodeString(string(bytes.TrimSpace(seedHex)))
+	if err != nil || len(seed) != ohttpKeySeedLength {
+		return nil, fmt.Errorf("Invalid Oblivious HTTP key, expected %d hex-encoded bytes", ohttpKeySeedLength)
+	}
+	return newOHTTPGatewayKey(ohttpKeyID, seed)
+}
+
+// ohttpGatewayContext encapsulates the response to a request.
+type ohttpGatewayContext struct {
+	suite    hpke.CipherSuite
+	enc      []byte
+	receiver *hpke.ReceiverContext
+}
+
+func (k *ohttpGatewayKey) decapsulateRequest(encRequest []byte) ([]byte, *ohttpGatewayContext, error) {
+	header := ohttpHeader(k.config.keyID)
+	if len(encRequest) < len(header) {
+		return nil, nil, ErrInvalidOHTTPMessage
+	}
+	if !bytes.Equal(encRequest[:len(header)], header) {
+		return nil, nil, ErrUnknownOHTTPKey
+	}
+	encLength := k.suite.KEM.PublicKeySize()
+	if len(encRequest) < len(header)+encLength {
+		return nil, nil, ErrInvalidOHTTPMessage
+	}
+	enc := encRequest[len(header) : len(header)+encLength]
+
+	receiver, err := hpke.SetupBaseR(k.suite, k.privateKey, enc, ohttpInfo(header))
+	if err != nil {
+		return nil, nil, ErrInvalidOHTTPMessage
+	}
+	request, err := receiver.Open(nil, encRequest[len(header)+encLength:])
+	if err != nil {
+		return nil, nil, ErrInvalidOHTTPMessage
+	}
+	return request, &ohttpGatewayContext{suite: k.suite, enc: enc, receiver: receiver}, nil
+}
+
+func (c *ohttpGatewayContext) encapsulateResponse(response []byte) ([]byte, error) {
+	responseNonce := make([]byte, ohttpResponseNonceLength(c.suite))
+	if _, err := rand.Read(responseNonce); err != nil {
+		return nil, err
+	}
+	secret := c.receiver.Export([]byte(ohttpResponseLabel), len(responseNonce))
+	aead, nonce, err := ohttpResponseAEAD(c.suite, secret, c.enc, responseNonce)
+	if err != nil {
+		return nil, err
+	}
+	return append(responseNonce, aead.Seal(nil, nonce, response, nil)...), nil
+}
+
+func (i *Issuer) handleOHTTPKeysRequest(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ohttpKeysMediaType)
+	w.Write(marshalOHTTPKeyConfigs(i.ohttpKey.config))
+}
+
+// handleOHTTPGatewayRequest serves token requests encapsulated by clients and
+// relayed by an attester. Once a request is decapsulated, the outcome of the
+// token request is returned encapsulated as well.
+func (i *Issuer) handleOHTTPGatewayRequest(w http.ResponseWriter, req *http.Request) {
+	err := i.dumpRequest("Handling Oblivious HTTP request", w, req)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		log.Debugln("Invalid method")
+		http.Error(w, "Invalid method", 400)
+		return
+	}
+	if req.Header.Get("Content-Type") != ohttpRequestMediaType {
+		log.Debugln("Invalid content type, expected", ohttpRequestMediaType, "got", req.Header.Get("Content-Type"))
+		http.Error(w, "Invalid Content-Type", 400)
+		return
+	}
+	encRequest, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Debugln("Failed reading request body")
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if !i.verifyAttesterCertificate(w, req) || !i.verifyAttesterSignature(w, req, encRequest) {
+		return
+	}
+
+	request, context, err := i.ohttpKey.decapsulateRequest(encRequest)
+	if err != nil {
+		log.Debugln("Failed decapsulating request:", err)
+		result := "invalid"
+		if errors.Is(err, ErrUnknownOHTTPKey) {
+			result = "unknown-key"
+		}
+		issuerOHTTPRequests.Inc(0, result)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	inner := newBHTTPResponseWriter()
+	tokenType := i.serveOHTTPTokenRequest(inner, req, request)
+	response, err := context.encapsulateResponse(inner.encode())
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	issuerOHTTPRequests.Inc(tokenType, strconv.Itoa(inner.status))
+	w.Header().Set("Content-Type", ohttpResponseMediaType)
+	w.Write(response)
+}
+
+// serveOHTTPTokenRequest serves the decapsulated request like one sent
+// directly, and returns its token type. Rate-limited token requests need
+// the attester to see them, so they are refused.
+func (i *Issuer) serveOHTTPTokenRequest(w http.ResponseWriter, outer *http.Request, request []byte) uint16 {
+	req, err := decodeBHTTPRequest(request)
+	if err != nil {
+		log.Debugln("Failed decoding encapsulated request:", err)
+		http.Error(w, err.Error(), 400)
+		return 0
+	}
+	if req.Method != http.MethodPost || req.URL.Path != tokenRequestURI {
+		log.Debugln("Invalid encapsulated request", req.Method, req.URL.Path)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return 0
+	}
+	batched := req.Header.Get("Content-Type") == batchedTokenRequestMediaType
+	if req.Header.Get("Content-Type") != tokenRequestMediaType && !batched {
+		log.Debugln("Invalid content type, expected", tokenRequestMediaType, "got", req.Header.Get("Content-Type"))
+		http.Error(w, "Invalid Content-Type", 400)
+		return 0
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	tokenType := requestTokenType(body)
+	if len(body) < 2 {
+		http.Error(w, "Failed decoding token request", 400)
+		return 0
+	}
+	if tokenType == pat.RateLimitedTokenType {
+		log.Debugln("Refusing rate-limited token request over Oblivious HTTP")
+		http.Error(w, "Rate-limited token requests must be sent to the attester", 400)
+		return tokenType
+	}
+
+	// The relaying attester is scheduled like one forwarding the request
+	i.serveTokenRequest(w, outer, batched, body)
+	return tokenType
+}
+
+func (a TestAttester) handleOHTTPRelayRequest(w http.ResponseWriter, req *http.Request) {
+	log.Println("Handling Oblivious HTTP request from", req.RemoteAddr)
+
+	if req.Method != http.MethodPost {
+		log.Println("Invalid method")
+		http.Error(w, "Invalid method", 400)
+		return
+	}
+	if req.Header.Get("Content-Type") != ohttpRequestMediaType {
+		log.Println("Invalid content type")
+		http.Error(w, "Invalid Content-Type", 400)
+		return
+	}
+	targetName := req.URL.Query().Get("issuer")
+	if targetName == "" {
+		log.Println("Issuer host missing")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	encRequest, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Println("Failed reading client request body:", err)
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// The token type is encrypted to the issuer, so evidence is bound to none
+	if _, err := a.attest(req, 0); err != nil {
+		log.Println("Attestation failed:", err)
+		attesterOHTTPRelayed.Inc(0, "refused")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	log.Println("Relaying Oblivious HTTP request to issuer", targetName)
+	resp, err := a.issuers.relay(req.Context(), a.client, targetName, encRequest)
+	if err != nil {
+		log.Println("Relayed request failed:", err)
+		attesterOHTTPRelayed.Inc(0, "failed")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if err := checkTokenResponse(resp, ohttpResponseMediaType); err != nil {
+		log.Println("Refusing gateway response:", err)
+		attesterOHTTPRelayed.Inc(0, "failed")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	encResponse, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		attesterOHTTPRelayed.Inc(0, "failed")
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	attesterOHTTPRelayed.Inc(0, "ok")
+	w.Header().Set("Content-Type", ohttpResponseMediaType)
+	w.Write(encResponse)
+}
+
+// ohttpTransport sends POST requests encapsulated to the gateway of the issuer
+// they are addressed to, through the attester's relay. Other requests, such
+// as for issuer directories, are sent directly.
+type ohttpTransport struct {
+	base     *http.Client
+	attester string
+
+	lock    sync.Mutex
+	configs map[string]ohttpKeyConfig // by issuer host
+}
+
+// newOHTTPClient returns a client tunneling token requests through the
+// attester's relay, reaching the attester and issuers with httpClient.
+func newOHTTPClient(httpClient *http.Client, attester string) *http.Client {
+	return &http.Client{Transport: &ohttpTransport{
+		base:     httpClient,
+		attester: attester,
+		configs:  make(map[string]ohttpKeyConfig),
+	}}
+}
+
+// keyConfig returns the gateway key configuration the issuer publishes in its
+// directory.
+func (t *ohttpTransport) keyConfig(issuer string) (ohttpKeyConfig, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if config, ok := t.configs[issuer]; ok {
+		return config, nil
+	}
+
+	issuerConfig, err := fetchIssuerConfig(t.base, issuer)
+	if err != nil {
+		return ohttpKeyConfig{}, err
+	}
+	if issuerConfig.OHTTPKeysURI == "" {
+		return ohttpKeyConfig{}, fmt.Errorf("Issuer %s has no Oblivious HTTP gateway", issuer)
+	}
+	resp, err := t.base.Get(issuerConfig.OHTTPKeysURI)
+	if err != nil {
+		return ohttpKeyConfig{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ohttpKeyConfig{}, fmt.Errorf("Oblivious HTTP key configuration request failed with error %d", resp.StatusCode)
+	}
+	configsEnc, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ohttpKeyConfig{}, err
+	}
+	configs, err := unmarshalOHTTPKeyConfigs(configsEnc)
+	if err != nil {
+		return ohttpKeyConfig{}, err
+	}
+	for _, config := range configs {
+		if config.supported() {
+			t.configs[issuer] = config
+			return config, nil
+		}
+	}
+	return ohttpKeyConfig{}, fmt.Errorf("Issuer %s has no supported Oblivious HTTP key configuration", issuer)
+}
+
+func (t *ohttpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost {
+		return t.base.Do(req)
+	}
+	var content []byte
+	if req.Body != nil {
+		var err error
+		content, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config, err := t.keyConfig(req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	relayURI, err := composeURL(t.attester, attesterOHTTPRelayURI+"?issuer="+url.QueryEscape(req.URL.Host))
+	if err != nil {
+		return nil, err
+	}
+	relayReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, relayURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	relayReq.Header.Set("Content-Type", ohttpRequestMediaType)
+
+	// Headers identifying the client are for the attester, not the issuer
+	inner := req.Clone(req.Context())
+	for _, header := range []string{headerClientID, headerAttestationFormat, headerAttestationEvidence} {
+		if value := inner.Header.Get(header); value != "" {
+			relayReq.Header.Set(header, value)
+			inner.Header.Del(header)
+		}
+	}
+	encRequest, context, err := encapsulateOHTTPRequest(config, encodeBHTTPRequest(inner, content))
+	if err != nil {
+		return nil, err
+	}
+	relayReq.Body = ioutil.NopCloser(bytes.NewReader(encRequest))
+	relayReq.ContentLength = int64(len(encRequest))
+
+	resp, err := t.base.Do(relayReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkTokenResponse(resp, ohttpResponseMediaType); err != nil {
+		return nil, fmt.Errorf("Oblivious HTTP relay refused the request: %w", err)
+	}
+	encResponse, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	response, err := context.decapsulateResponse(encResponse)
+	if err != nil {
+		return nil, err
+	}
+	innerResp, err := decodeBHTTPResponse(response)
+	if err != nil {
+		return nil, err
+	}
+	innerResp.Request = req
+	return innerResp, nil
+}
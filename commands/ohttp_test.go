@@ -0,0 +1,123 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestOHTTPEncapsulation(t *testing.T) {
+	key, err := loadOHTTPGatewayKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := unmarshalOHTTPKeyConfigs(marshalOHTTPKeyConfigs(key.config))
+	if err != nil || len(configs) != 1 || !configs[0].supported() || !bytes.Equal(configs[0].publicKey, key.config.publicKey) {
+		t.Fatalf("unexpected key configurations %+v, %v", configs, err)
+	}
+
+	encRequest, clientContext, err := encapsulateOHTTPRequest(configs[0], []byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, gatewayContext, err := key.decapsulateRequest(encRequest)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("unexpected request %q, %v", request, err)
+	}
+	encResponse, err := gatewayContext.encapsulateResponse([]byte("response"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := clientContext.decapsulateResponse(encResponse)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("unexpected response %q, %v", response, err)
+	}
+
+	// Tampered messages and other keys are refused
+	encResponse[len(encResponse)-1] ^= 1
+	if _, err := clientContext.decapsulateResponse(encResponse); !errors.Is(err, ErrInvalidOHTTPMessage) {
+		t.Fatalf("expected a tampered response to be refused, got %v", err)
+	}
+	encRequest[len(encRequest)-1] ^= 1
+	if _, _, err := key.decapsulateRequest(encRequest); !errors.Is(err, ErrInvalidOHTTPMessage) {
+		t.Fatalf("expected a tampered request to be refused, got %v", err)
+	}
+	encRequest[0]++
+	if _, _, err := key.decapsulateRequest(encRequest); !errors.Is(err, ErrUnknownOHTTPKey) {
+		t.Fatalf("expected an unknown key to be refused, got %v", err)
+	}
+	otherKey, _ := loadOHTTPGatewayKey("")
+	encRequest, _, _ = encapsulateOHTTPRequest(otherKey.config, []byte("request"))
+	if _, _, err := key.decapsulateRequest(encRequest); !errors.Is(err, ErrInvalidOHTTPMessage) {
+		t.Fatalf("expected a request to another key to be refused, got %v", err)
+	}
+}
+
+func TestOHTTPRelay(t *testing.T) {
+	issuer := newTestPrivateIssuer(t)
+	var err error
+	if issuer.ohttpKey, err = loadOHTTPGatewayKey(""); err != nil {
+		t.Fatal(err)
+	}
+	directRequests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc(issuerConfigURI, issuer.handleConfigRequest)
+	mux.HandleFunc(tokenRequestURI, func(w http.ResponseWriter, req *http.Request) {
+		directRequests++
+		issuer.handleIssuanceRequest(w, req)
+	})
+	mux.HandleFunc(issuerOHTTPKeysURI, issuer.handleOHTTPKeysRequest)
+	mux.HandleFunc(issuerOHTTPGatewayURI, issuer.handleOHTTPGatewayRequest)
+	issuerServer := httptest.NewTLSServer(mux)
+	defer issuerServer.Close()
+	issuer.name = strings.TrimPrefix(issuerServer.URL, "https://")
+
+	attester := newTestAttester(&AttesterPolicy{})
+	attester.client = issuerServer.Client()
+	attester.issuers = newIssuerPool(nil, 0)
+	attesterServer := httptest.NewTLSServer(http.HandlerFunc(attester.handleOHTTPRelayRequest))
+	defer attesterServer.Close()
+	client := newOHTTPClient(issuerServer.Client(), strings.TrimPrefix(attesterServer.URL, "https://"))
+
+	challenge := pat.TokenChallenge{
+		TokenType:  pat.BasicPrivateTokenType,
+		IssuerName: issuer.name,
+		OriginInfo: []string{"origin.example"},
+	}
+	publicKeyEnc, _ := issuer.privateIssuer.TokenKey().MarshalBinary()
+	relayed := attesterOHTTPRelayed.Value(0, "ok")
+	token, err := fetchPrivateToken(client, "", challenge.Marshal(), publicKeyEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPrivateToken(issuer.privateTokenKey, token); err != nil {
+		t.Fatal(err)
+	}
+	if directRequests != 0 || attesterOHTTPRelayed.Value(0, "ok") != relayed+1 {
+		t.Fatal("expected the token request to go through the relay")
+	}
+
+	// Rate-limited token requests need the attester to see them
+	req, _ := http.NewRequest(http.MethodPost, "https://"+issuer.name+tokenRequestURI, bytes.NewReader([]byte{0x00, 0x03, 0x01}))
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "attester") {
+		t.Fatalf("expected the rate-limited request to be refused, got %d %s", resp.StatusCode, body)
+	}
+
+	// Gateway errors before decapsulation reach the client through the relay
+	issuer.ohttpKey, _ = loadOHTTPGatewayKey("")
+	if _, err := client.Do(req); err == nil || !strings.Contains(err.Error(), "relay") {
+		t.Fatalf("expected the stale key configuration to be refused, got %v", err)
+	}
+}
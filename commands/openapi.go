@@ -0,0 +1,166 @@
+package commands
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	adminOpenAPIURI = adminURIPrefix + "openapi.json"
+	openAPIVersion  = "3.0.3"
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// jsonSchema describes how encoding/json serializes values of type t.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if idx := strings.Index(tag, ","); idx >= 0 {
+			name, options = tag[:idx], tag[idx+1:]
+		}
+
+		if field.Anonymous && name == "" {
+			// Fields of embedded structs are promoted
+			embedded := jsonSchema(field.Type)
+			if embeddedProperties, ok := embedded["properties"].(map[string]interface{}); ok {
+				for key, value := range embeddedProperties {
+					properties[key] = value
+				}
+				if embeddedRequired, ok := embedded["required"].([]string); ok {
+					required = append(required, embeddedRequired...)
+				}
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = jsonSchema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func jsonContent(value interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": jsonSchema(reflect.TypeOf(value)),
+		},
+	}
+}
+
+// openAPIDocument describes the registered admin routes.
+func (s *adminServer) openAPIDocument() map[string]interface{} {
+	paths := make(map[string]interface{})
+	for _, route := range s.routes {
+		responses := map[string]interface{}{
+			"401": map[string]interface{}{"description": "Missing or invalid bearer token"},
+		}
+		if route.response != nil {
+			responses["200"] = map[string]interface{}{
+				"description": "Success",
+				"content":     jsonContent(route.response),
+			}
+		} else {
+			responses["200"] = map[string]interface{}{"description": "Success"}
+		}
+
+		operation := map[string]interface{}{
+			"summary":   route.summary,
+			"responses": responses,
+		}
+		if route.request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(route.request),
+			}
+		}
+
+		item, ok := paths[route.path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[route.path] = item
+		}
+		item[strings.ToLower(route.method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":   "pat-app " + s.name + " admin API",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+		},
+	}
+}
+
+func (s *adminServer) handleOpenAPI(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, s.openAPIDocument())
+}
@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testEmbedded struct {
+	Count int `json:"count"`
+}
+
+type testSchemaType struct {
+	testEmbedded
+	Name     string            `json:"name"`
+	Data     []byte            `json:"data,omitempty"`
+	Tags     []string          `json:"tags"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Created  time.Time         `json:"created"`
+	Ignored  string            `json:"-"`
+	internal string
+}
+
+func TestJSONSchema(t *testing.T) {
+	schema := jsonSchema(reflect.TypeOf(testSchemaType{}))
+	properties := schema["properties"].(map[string]interface{})
+
+	expected := map[string]string{
+		"count":   "integer",
+		"name":    "string",
+		"data":    "string",
+		"tags":    "array",
+		"labels":  "object",
+		"created": "string",
+	}
+	if len(properties) != len(expected) {
+		t.Fatalf("unexpected properties %v", properties)
+	}
+	for name, kind := range expected {
+		property := properties[name].(map[string]interface{})
+		if property["type"] != kind {
+			t.Fatalf("expected %s to be %s, got %v", name, kind, property["type"])
+		}
+	}
+	if properties["data"].(map[string]interface{})["format"] != "byte" {
+		t.Fatal("expected []byte to be base64")
+	}
+
+	required := schema["required"].([]string)
+	if !reflect.DeepEqual(required, []string{"count", "name", "tags", "created"}) {
+		t.Fatalf("unexpected required properties %v", required)
+	}
+}
+
+func TestAdminOpenAPI(t *testing.T) {
+	admin := newTestOrigin().newAdminServer("secret")
+
+	req := httptest.NewRequest(http.MethodGet, adminOpenAPIURI, nil)
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", w.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var document struct {
+		OpenAPI string                                       `json:"openapi"`
+		Paths   map[string]map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+		t.Fatal(err)
+	}
+	if document.OpenAPI != openAPIVersion {
+		t.Fatal("unexpected OpenAPI version")
+	}
+	operation, ok := document.Paths[adminRevokeChallengesURI]["post"]
+	if !ok {
+		t.Fatal("revocation endpoint not described")
+	}
+	if _, ok := operation["requestBody"]; !ok {
+		t.Fatal("revocation request body not described")
+	}
+	if _, ok := document.Paths[adminOpenAPIURI]["get"]; !ok {
+		t.Fatal("OpenAPI endpoint not described")
+	}
+}
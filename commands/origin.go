@@ -1,36 +1,40 @@
 package commands
 
 import (
-	"crypto"
+	"context"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httputil"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/cloudflare/circl/oprf"
+	"github.com/cloudflare/pat-app/httpauth"
+	"github.com/cloudflare/pat-app/structuredfield"
 	pat "github.com/cloudflare/pat-go"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
 const (
+	// Redemption nonce length unless configured otherwise
 	challengeNonceLength = 32
+
+	// Outstanding challenges kept per context unless configured otherwise
+	defaultMaxContextChallenges = 1024
 )
 
 var (
-	// WWW-Authenticate authorization challenge attributes
-	authorizationAttributeChallenge = "challenge"
-	authorizationAttributeMaxAge    = "max-age"
-	authorizationAttributeTokenKey  = "token-key"
-	authorizationAttributeNameKey   = "issuer-encap-key"
-
 	// Headers clients can send to control the types of token challenges sent
 	headerTokenAttributeNoninteractive = "Sec-Token-Attribute-Non-Interactive"
 	headerTokenAttributeCrossOrigin    = "Sec-Token-Attribute-Cross-Origin"
@@ -38,226 +42,766 @@ var (
 	headerTokenType                    = "Sec-CH-Token-Type"
 
 	// Type of authorization
-	privateTokenType = "PrivateToken"
+	privateTokenType = httpauth.PrivateTokenScheme
 
 	// Test resource to load upon token success
 	testResource = "https://tfpauly.github.io/privacy-proxy/draft-privacypass-rate-limit-tokens.html"
+
+	ErrUnknownChallenge = errors.New("No outstanding challenge matching context")
+	ErrRevokedChallenge = errors.New("Challenge context revoked")
 )
 
 type Origin struct {
-	issuerName             string
-	originName             string
-	additionalOriginInfo   []string
-	rateLimitedTokenKeyEnc []byte // Encoding of validation public key
-	rateLimitedTokenKey    *rsa.PublicKey
-	basicTokenKeyEnc       []byte // Encoding of validation public key
-	basicValidationKey     *rsa.PublicKey
-	issuerEncapKey         pat.EncapKey
-
-	// Map from challenge hash to list of outstanding challenges
-	challenges    map[string][]pat.TokenChallenge
-	challengeLock sync.Mutex
+	issuerName           string // of the primary issuer
+	originName           string
+	additionalOriginInfo []string
+	issuerKeys           *issuerKeySource
+	issuers              []originIssuer // challenged for in turn, the primary issuer alone if empty
+	issuerRoutes         []issuerRoute  // longest prefix first
+	issuerTurn           uint32
+	cors                 *corsPolicy  // nil unless cross-origin requests are allowed
+	redirectAttester     string       // sends browsers to a challenge page issuing through this attester if set
+	redirectClient       *http.Client // relays the token requests of the challenge page
+	redemptionHook       *redemptionHook
+	remoteVerifier       *remoteVerifier   // verifies tokens at the issuer if set
+	epochChallenger      *epochChallenger  // derives non-interactive challenges statelessly if set
+	challengeSigner      *challengeSigner  // signs interactive challenges instead of storing them if set
+	compressResources    bool              // compress uncompressed resources for clients that accept it
+	content              http.Handler      // serves protected resources, the test resource if nil
+	redemptions          *redemptionCache  // replays outcomes to clients retrying with the same token if set
+	failedTokens         *failedTokenCache // refuses tokens that failed verification recently without verifying them if set
+	nonceLength          int               // challengeNonceLength if zero
+	nonceSource          io.Reader         // crypto/rand if nil
+	unknownAuthParams    string            // unknownAuthParamsReject, or ignored otherwise
+	clock                clock             // system clock if nil
+	directoryPath        string            // serves the issuer directory from directory at this path if set
+	directory            *directoryCache
+	outage               *outagePolicy     // refuses redemptions that cannot be verified if nil
+	earlyHints           bool              // sends challenges in 103 Early Hints ahead of the 401
+	privateTokenKey      *oprf.PrivateKey  // verifies private tokens locally if set
+	faults               *originFaults     // breaks challenges on purpose, none if nil
+	tokenTypes           *tokenTypeToggle  // accepts every token type if nil
+	challengeRules       *challengeRules   // challenges every request as the client asks if nil
+	stats                *originStats      // served by the admin API, none kept if nil
+	accounting           *originAccounting // the origins of the process, this one alone if nil
+	verificationWorkers  int               // verify token batches of the admin API, GOMAXPROCS if zero
+	config               effectiveConfig   // served by the admin API
+
+	// Outstanding challenges by challenge hash
+	challenges           challengeStore
+	challengeTTL         time.Duration // lifetime of outstanding challenges, defaultChallengeTTL if zero
+	maxContextChallenges int           // cap on outstanding challenges per context, defaultMaxContextChallenges if zero
+	// Set of challenge hashes whose tokens are refused
+	revokedContexts map[string]bool
+	challengeLock   sync.Mutex
+
+	spentTokens    spentTokenStore // refuses tokens admitted before if set
+	tokenRetention time.Duration   // how long spent tokens are kept, see spentTokenRetention
+}
+
+func (o *Origin) challengeLimit() int {
+	if o.maxContextChallenges > 0 {
+		return o.maxContextChallenges
+	}
+	return defaultMaxContextChallenges
+}
+
+func (o *Origin) now() time.Time {
+	if o.clock != nil {
+		return o.clock.Now()
+	}
+	return time.Now()
+}
+
+func (o *Origin) challengeLifetime() time.Duration {
+	if o.challengeTTL > 0 {
+		return o.challengeTTL
+	}
+	return defaultChallengeTTL
+}
+
+// offersPrivateTokens reports whether the origin challenges for private tokens:
+// if the issuer offers them and the origin can verify them.
+func (o *Origin) offersPrivateTokens(keys *issuerKeys) bool {
+	return keys.privateTokenKeyEnc != nil && (o.remoteVerifier != nil || o.privateTokenKey != nil)
+}
+
+// spentTokenRetention returns how long admitted tokens are kept: as configured,
+// or as long as a challenge they could be replayed against is matched.
+func (o *Origin) spentTokenRetention() time.Duration {
+	if o.tokenRetention > 0 {
+		return o.tokenRetention
+	}
+	retention := o.challengeLifetime()
+	if o.challengeSigner != nil {
+		retention = o.challengeSigner.lifetime(retention)
+	}
+	if o.epochChallenger != nil && o.epochChallenger.lifetime() > retention {
+		retention = o.epochChallenger.lifetime()
+	}
+	return retention
+}
+
+// trackContextChange updates the challenge gauges after a store operation.
+func trackContextChange(change contextChange) {
+	originOutstandingChallenges.Add(change.tokenType, float64(change.after-change.before))
+	switch {
+	case change.before == 0 && change.after > 0:
+		originChallengeContexts.Add(change.tokenType, 1)
+	case change.before > 0 && change.after == 0:
+		originChallengeContexts.Add(change.tokenType, -1)
+	}
+}
+
+// addChallenge records an outstanding challenge for the context, up to the
+// per-context cap.
+func (o *Origin) addChallenge(contextEnc string, challenge pat.TokenChallenge) error {
+	now := o.now()
+	added, change, err := o.challenges.add(contextEnc, challenge, o.challengeLimit(), now, now.Add(o.challengeLifetime()))
+	if err != nil {
+		return err
+	}
+	trackContextChange(change)
+	if !added {
+		log.Debugln("Challenge context", contextEnc, "reached the cap of", o.challengeLimit(), "outstanding challenges")
+		originChallengesDropped.Inc(challenge.TokenType)
+	}
+	return nil
+}
+
+// dropContext forgets all outstanding challenges of the context.
+func (o *Origin) dropContext(contextEnc string) error {
+	change, err := o.challenges.drop(contextEnc)
+	if err != nil {
+		return err
+	}
+	trackContextChange(change)
+	return nil
+}
+
+// expireChallenges removes expired challenges from the store.
+func (o *Origin) expireChallenges(now time.Time) error {
+	changes, err := o.challenges.expire(now)
+	for _, change := range changes {
+		trackContextChange(change)
+	}
+	return err
 }
 
-func (o Origin) CreateChallenge(req *http.Request) (string, string) {
-	nonce := make([]byte, challengeNonceLength)
-	rand.Reader.Read(nonce)
+// runExpiry sweeps expired challenges and spent tokens once per challenge
+// lifetime until ctx is done. Expired challenges are never redeemed, but they
+// are kept until swept.
+func (o *Origin) runExpiry(ctx context.Context) {
+	ticker := time.NewTicker(o.challengeLifetime())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := o.now()
+			if err := o.expireChallenges(now); err != nil {
+				log.Warnln("Failed expiring challenges of origin", o.originName+":", err)
+			}
+			if o.spentTokens != nil {
+				if err := o.spentTokens.expire(now); err != nil {
+					log.Warnln("Failed expiring spent tokens of origin", o.originName+":", err)
+				}
+			}
+		}
+	}
+}
+
+func (o *Origin) originInfo() []string {
 	originInfo := []string{o.originName}
 	for _, originName := range o.additionalOriginInfo {
 		originInfo = append(originInfo, originName)
 	}
+	return originInfo
+}
 
-	if req.Header.Get(headerTokenAttributeNoninteractive) != "" || req.URL.Query().Get("noninteractive") != "" {
-		// If the client requested a non-interactive token, then clear out the nonce slot
-		nonce = []byte{} // empty slice
+// nonceReader returns the configured nonce source.
+func (o *Origin) nonceReader() io.Reader {
+	if o.nonceSource == nil {
+		return rand.Reader
 	}
-	if req.Header.Get(headerTokenAttributeCrossOrigin) != "" || req.URL.Query().Get("crossorigin") != "" {
-		// If the client requested a cross-origin token, then clear out the origin slot
-		originInfo = nil
+	return o.nonceSource
+}
+
+// newNonce draws a redemption nonce from the configured source.
+func (o *Origin) newNonce() ([]byte, error) {
+	length := o.nonceLength
+	if length == 0 {
+		length = challengeNonceLength
 	}
+	return readNonce(o.nonceReader(), length)
+}
+
+// requestsNonInteractive tells whether the client asked for challenges
+// without a redemption nonce.
+func requestsNonInteractive(req *http.Request) bool {
+	return req.Header.Get(headerTokenAttributeNoninteractive) != "" || req.URL.Query().Get("noninteractive") != ""
+}
+
+// requestsCrossOrigin tells whether the client asked for challenges without
+// origin info.
+func requestsCrossOrigin(req *http.Request) bool {
+	return req.Header.Get(headerTokenAttributeCrossOrigin) != "" || req.URL.Query().Get("crossorigin") != ""
+}
 
-	tokenKey := base64.URLEncoding.EncodeToString(o.rateLimitedTokenKeyEnc)
-	tokenType := pat.RateLimitedTokenType // default
-	if req.Header.Get(headerTokenType) != "" || req.URL.Query().Get("type") != "" {
-		tokenTypeValue, err := strconv.Atoi(req.Header.Get(headerTokenType))
-		if err == nil {
-			if tokenTypeValue == int(pat.BasicPublicTokenType) {
-				tokenType = pat.BasicPublicTokenType
-				tokenKey = base64.URLEncoding.EncodeToString(o.basicTokenKeyEnc)
+// requestedChallengeCount returns how many challenges the client asked for.
+func requestedChallengeCount(req *http.Request) int {
+	count := 1
+	if countReq := req.Header.Get(headerTokenAttributeChallengeCount); countReq != "" {
+		countVal, err := structuredfield.ParseInteger(countReq)
+		if err == nil && countVal > 0 && countVal < 10 {
+			// These bounds are arbitrary
+			count = int(countVal)
+		}
+	}
+	return count
+}
+
+// requestedTokenType returns the token type the client asked to be
+// challenged for, in the Token-Type header or the type query parameter.
+func requestedTokenType(req *http.Request) (uint16, bool) {
+	if req.Header.Get(headerTokenType) == "" && req.URL.Query().Get("type") == "" {
+		return 0, false
+	}
+	tokenTypeValue, err := structuredfield.ParseInteger(req.Header.Get(headerTokenType))
+	if err != nil {
+		var queryValue uint64
+		queryValue, err = strconv.ParseUint(req.URL.Query().Get("type"), 10, 16)
+		tokenTypeValue = int64(queryValue)
+	}
+	if err != nil || tokenTypeValue < 0 || tokenTypeValue > math.MaxUint16 {
+		return 0, false
+	}
+	return uint16(tokenTypeValue), true
+}
+
+// challengeTokenType returns the token type of challenges for the request,
+// the type its rule demands or the client asked for if the origin offers and
+// accepts it, or else
+// the first type it does, rate-limited tokens first, and the token key for it.
+func (o *Origin) challengeTokenType(req *http.Request, keys *issuerKeys) (uint16, []byte) {
+	offered := o.offeredTokenKeys(keys)
+	if requested, ok := o.demandedTokenType(req); ok && o.tokenTypes.accepts(requested) {
+		for _, key := range offered {
+			if key.tokenType == requested {
+				return key.tokenType, key.tokenKey
 			}
+		}
+	}
+	for _, key := range offered {
+		if o.tokenTypes.accepts(key.tokenType) {
+			return key.tokenType, key.tokenKey
+		}
+	}
+	return offered[0].tokenType, offered[0].tokenKey
+}
+
+// countTokenTypeFallback logs and counts challenges for another token type
+// than the client asked for or its rule demands.
+func (o *Origin) countTokenTypeFallback(req *http.Request, tokenType uint16) {
+	requested, ok := o.demandedTokenType(req)
+	if !ok || requested == tokenType {
+		return
+	}
+	reason := "not_accepted"
+	if !isKnownTokenType(requested) {
+		reason = "unknown"
+	} else if o.tokenTypes.accepts(requested) {
+		reason = "not_offered"
+	}
+	log.Debugf("Challenging for %s instead of %s: %s", describeTokenType(tokenType), describeTokenType(requested), reason)
+	originTokenTypeFallbacks.Inc(labelTokenType(requested), reason)
+}
+
+// CreateChallenge returns a challenge and the token key for it. Challenges
+// are not created without a fresh nonce, so an error is returned if the nonce
+// source fails.
+func (o *Origin) CreateChallenge(req *http.Request) (string, string, error) {
+	challenge, err := o.createChallenge(req, o.selectIssuer(req))
+	if err != nil {
+		return "", "", err
+	}
+	return base64.URLEncoding.EncodeToString(challenge.TokenChallenge), base64.URLEncoding.EncodeToString(challenge.TokenKey), nil
+}
+
+// createChallenge returns a challenge for tokens of the issuer, with the token
+// key for it.
+func (o *Origin) createChallenge(req *http.Request, issuer originIssuer) (httpauth.Challenge, error) {
+	nonce, err := o.newNonce()
+	if err != nil {
+		return httpauth.Challenge{}, err
+	}
+	originInfo := o.originInfo()
+
+	stateless, signed := false, false
+	if o.nonInteractive(req) {
+		if o.epochChallenger != nil {
+			// Derive the nonce from the current epoch so that any replica can match it
+			nonce = o.epochChallenger.nonce(o.originName, o.epochChallenger.epoch(o.now()))
+			stateless = true
 		} else {
-			tokenTypeValue, err = strconv.Atoi(req.URL.Query().Get("type"))
-			if err == nil {
-				if tokenTypeValue == int(pat.BasicPublicTokenType) {
-					tokenType = pat.BasicPublicTokenType
-					tokenKey = base64.URLEncoding.EncodeToString(o.basicTokenKeyEnc)
-				}
-			}
+			// If the client requested a non-interactive token, then clear out the nonce slot
+			nonce = []byte{} // empty slice
 		}
+	} else if o.challengeSigner != nil {
+		// Sign the challenge so that any replica can match it without storing it
+		stateless, signed = true, true
 	}
+	if requestsCrossOrigin(req) {
+		// If the client requested a cross-origin token, then clear out the origin slot
+		originInfo = nil
+	}
+
+	tokenType, tokenKey := o.challengeTokenType(req, issuer.keys.current())
 
 	challenge := pat.TokenChallenge{
 		TokenType:       tokenType,
-		IssuerName:      o.issuerName,
+		IssuerName:      issuer.name,
 		OriginInfo:      originInfo,
 		RedemptionNonce: nonce,
 	}
+	if signed {
+		if challenge, err = o.signedChallenge(challenge); err != nil {
+			return httpauth.Challenge{}, err
+		}
+	}
 
 	// Add to the running list of challenges
 	challengeEnc := challenge.Marshal()
 	context := sha256.Sum256(challengeEnc)
 	contextEnc := hex.EncodeToString(context[:])
+	originChallenges.Inc(tokenType)
+	o.stats.challenge(tokenType)
+	originIssuerChallenges.Inc(tokenType, issuer.name)
+	protocolTranscript.record("origin", messageTokenChallenge, tokenType, tokenKey, challengeEnc)
+	if signed {
+		log.Debugln("Issuing signed challenge context", contextEnc)
+		return httpauth.Challenge{TokenChallenge: challengeEnc, TokenKey: tokenKey, Params: []httpauth.Param{{Name: challengeParamEcho, Value: "1"}}}, nil
+	}
+	if stateless {
+		log.Debugln("Issuing epoch challenge context", contextEnc)
+		return httpauth.Challenge{TokenChallenge: challengeEnc, TokenKey: tokenKey}, nil
+	}
 
-	// Acquire the lock and write
-	o.challengeLock.Lock()
-	defer o.challengeLock.Unlock()
-	_, ok := o.challenges[contextEnc]
-	if !ok {
-		o.challenges[contextEnc] = make([]pat.TokenChallenge, 0)
+	if err := o.addChallenge(contextEnc, challenge); err != nil {
+		return httpauth.Challenge{}, err
 	}
-	o.challenges[contextEnc] = append(o.challenges[contextEnc], challenge)
 	log.Debugln("Adding challenge context", contextEnc)
 
-	return base64.URLEncoding.EncodeToString(challengeEnc), tokenKey
+	return httpauth.Challenge{TokenChallenge: challengeEnc, TokenKey: tokenKey}, nil
+}
+
+// consumeChallenge removes and returns an unexpired outstanding challenge
+// matching the context, unless the context was revoked.
+func (o *Origin) consumeChallenge(contextEnc string) (pat.TokenChallenge, error) {
+	o.challengeLock.Lock()
+	revoked := o.revokedContexts[contextEnc]
+	o.challengeLock.Unlock()
+	if revoked {
+		return pat.TokenChallenge{}, ErrRevokedChallenge
+	}
+
+	// Consume one matching challenge
+	challenge, change, err := o.challenges.consume(contextEnc, o.now())
+	trackContextChange(change)
+	if err != nil {
+		return pat.TokenChallenge{}, err
+	}
+	log.Debugln("Consuming challenge context", contextEnc)
+	log.Debugln("Remainder matching challenge set size", change.after)
+	return challenge, nil
 }
 
-func (o Origin) handleRequest(w http.ResponseWriter, req *http.Request) {
+func (o *Origin) handleRequest(w http.ResponseWriter, req *http.Request) {
 	reqEnc, _ := httputil.DumpRequest(req, false)
-	log.Debugln("Handling request:", string(reqEnc))
-
-	// If the Authorization header is empty, challenge the client for a token
-	if req.Header.Get("Authorization") == "" {
-		log.Debugln("Missing authorization header. Replying with challenge.")
-
-		count := 1
-		if countReq := req.Header.Get(headerTokenAttributeChallengeCount); countReq != "" {
-			countVal, err := strconv.Atoi(countReq)
-			if err == nil && countVal > 0 && countVal < 10 {
-				// These bounds are arbitrary
-				count = countVal
-			}
+	log.Debugln("Handling request from", req.RemoteAddr+":", string(reqEnc))
+
+	// Preflights come without credentials, so they are answered before
+	// asking for a token
+	if req.Method == http.MethodOptions {
+		o.handleOptions(w, req)
+		return
+	}
+	o.cors.allow(w, req)
+
+	// Paths the challenge rules leave open are served without a token
+	if !o.requiresToken(req) {
+		o.countChallengeRule(req)
+		o.serveContent(w, req)
+		return
+	}
+
+	// Without PrivateToken credentials, challenge the client for a token.
+	// Malformed credentials are refused below.
+	credentials, authErr := findPrivateTokenAuthorization(req.Header, o.unknownAuthParams)
+	if errors.Is(authErr, ErrMissingCredentials) {
+		log.Debugln("Missing PrivateToken credentials. Replying with challenge.")
+		if req.Header.Get("Authorization") != "" {
+			// Credentials of other schemes are no use to the origin
+			originValidationFailures.Inc(0, validationFailureAuthorization)
+		}
+		if o.redirectsToChallengePage(req) {
+			o.redirectToChallengePage(w, req)
+			return
 		}
-		challengeList := ""
+
+		o.countChallengeRule(req)
+		count := requestedChallengeCount(req)
+		tokenType, _ := o.challengeTokenType(req, o.issuerKeys.current())
+		o.countTokenTypeFallback(req, tokenType)
+		originChallengeAttributes.Inc(tokenType, strconv.FormatBool(requestsNonInteractive(req)), strconv.FormatBool(requestsCrossOrigin(req)), strconv.FormatBool(count > 1))
+		challenges := make([]httpauth.Challenge, 0, count)
+		challengedIssuers := make([]string, 0, 1)
+		challenged := make(map[string]bool)
+		maxAge := int(math.Ceil(o.challengeLifetime().Seconds()))
 		for i := 0; i < count; i++ {
-			challengeEnc, tokenKeyEnc := o.CreateChallenge(req)
-			challengeString := authorizationAttributeChallenge + "=" + challengeEnc
-			issuerKeyString := authorizationAttributeTokenKey + "=" + tokenKeyEnc
-			maxAgeString := authorizationAttributeMaxAge + "=" + "10"
-			issuerEncapKeyString := authorizationAttributeNameKey + "=" + base64.URLEncoding.EncodeToString(o.issuerEncapKey.Marshal()) // This might be ignored by clients
-			challengeList = challengeList + privateTokenType + " " + challengeString + ", " + issuerKeyString + "," + issuerEncapKeyString + ", " + maxAgeString
+			issuer := o.selectIssuer(req)
+			challenge, err := o.createChallenge(req, issuer)
+			if err != nil {
+				log.Errorln("Failed creating challenge:", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			challenge.IssuerEncapKey = issuer.keys.current().encapKey.Marshal() // This might be ignored by clients
+			challenge.MaxAge = &maxAge
+			challenges = append(challenges, o.faults.apply(challenge, tokenType))
+			if !challenged[issuer.name] {
+				challenged[issuer.name] = true
+				challengedIssuers = append(challengedIssuers, issuer.name)
+			}
 		}
 
-		w.Header().Set("WWW-Authenticate", challengeList)
+		w.Header().Set("WWW-Authenticate", httpauth.Marshal(challenges...))
+		if o.earlyHints && req.ProtoAtLeast(1, 1) {
+			// Let clients preconnect to the issuer and start issuance before
+			// the final response. Headers sent in 1xx responses stay set.
+			for _, issuerName := range challengedIssuers {
+				w.Header().Add("Link", "<https://"+issuerName+">; rel=preconnect")
+			}
+			w.WriteHeader(http.StatusEarlyHints)
+			originEarlyHints.Inc(0)
+		}
+		if req.Method == http.MethodHead {
+			// The challenges without the body a GET would get
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
 
-	authValue := req.Header.Get("Authorization")
-	tokenPrefix := privateTokenType + " " + "token="
-	if !strings.HasPrefix(authValue, tokenPrefix) {
-		log.Debugln("Authorization header missing 'PrivateToken token=' prefix")
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	// Count the redemption under the token type once it is known
+	recorder := newStatusRecorder(w)
+	w = recorder
+	tokenType := uint16(0)
+	defer func() {
+		originRedemptions.Inc(tokenType, strconv.Itoa(recorder.status))
+		originNameRedemptions.Inc(tokenType, o.originName, redemptionResult(recorder.status))
+		o.stats.redemption(tokenType, recorder.status)
+	}()
+
+	if authErr != nil {
+		log.Debugln("Failed parsing Authorization header:", authErr)
+		originValidationFailures.Inc(0, validationFailureAuthorization)
+		http.Error(w, authErr.Error(), http.StatusBadRequest)
 		return
 	}
+	tokenValue := credentials.token
 
-	tokenValueEnc := strings.SplitAfter(authValue, tokenPrefix)[1] // XXX(caw): there's probably a better way to parse this out
-	tokenValue, err := base64.URLEncoding.DecodeString(tokenValueEnc)
+	token, err := unmarshalToken(tokenValue)
 	if err != nil {
-		log.Debugln("Failed reading Authorization header token value")
+		log.Debugln("Failed decoding Token")
+		originValidationFailures.Inc(0, validationFailureTokenEncoding)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-
-	token, err := pat.UnmarshalToken(tokenValue)
-	if err != nil {
-		log.Debugln("Failed decoding Token")
+	// Refuse unknown types before counting anything under the token type, so
+	// that clients cannot create label values
+	if !isKnownTokenType(token.TokenType) {
+		log.Debugln("Refusing token of unknown type", formatTokenType(token.TokenType))
+		originValidationFailures.Inc(0, validationFailureTokenType)
+		http.Error(w, ErrUnsupportedTokenType.Error(), http.StatusBadRequest)
+		return
+	}
+	tokenType = token.TokenType
+	protocolTranscript.record("origin", messageToken, tokenType, nil, tokenValue)
+	if !o.tokenTypes.accepts(tokenType) {
+		log.Debugln("Refusing token of a type no longer accepted")
+		originValidationFailures.Inc(tokenType, validationFailureTokenType)
+		http.Error(w, ErrTokenTypeNotAccepted.Error(), http.StatusBadRequest)
+		return
+	}
+	if !o.admitsTokenType(req, tokenType) {
+		log.Debugln("Refusing token of another type than the challenge rule demands")
+		originValidationFailures.Inc(tokenType, validationFailureTokenType)
+		http.Error(w, ErrTokenTypeNotDemanded.Error(), http.StatusBadRequest)
+		return
+	}
+	// Observed once the type is accepted, as every type gets its own buckets
+	tokenMessageSize.Observe(tokenType, float64(len(tokenValue)), "origin", messageToken)
+
+	// Refuse tokens that failed verification recently before any lookup
+	if o.failedTokens != nil && o.failedTokens.failed(tokenValue, o.now()) {
+		log.Debugln("Refusing token that failed verification recently")
+		originFailedTokenCacheHits.Inc(tokenType)
+		originValidationFailures.Inc(tokenType, validationFailureVerification)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
+	// Refuse tokens admitted before without consuming another challenge
+	var spentTokenKeyEnc string
+	if o.spentTokens != nil {
+		spentTokenKeyEnc = spentTokenKey(token)
+		spent, err := o.spentTokens.spent(spentTokenKeyEnc, o.now())
+		if err != nil {
+			log.Errorln("Failed looking up spent token:", err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if spent {
+			log.Debugln("Refusing token redeemed before")
+			originDoubleSpends.Inc(tokenType)
+			http.Error(w, ErrTokenSpent.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Replay the outcome of an earlier redemption of the same token. Tokens
+	// admitted before are refused above if spent tokens are recorded, so only
+	// refusals are replayed then.
+	if o.redemptions != nil {
+		if outcome, ok := o.redemptions.lookup(tokenValue, o.now()); ok {
+			log.Debugln("Replaying cached redemption outcome")
+			originRedemptionReplays.Inc(tokenType)
+			if outcome.status != 0 {
+				outcome.writeRefusal(w)
+				return
+			}
+			for name, value := range outcome.headers {
+				w.Header().Set(name, value)
+			}
+			o.serveContent(w, req)
+			return
+		}
+	}
+	record := func(outcome redemptionOutcome) {
+		if o.redemptions != nil {
+			o.redemptions.store(tokenValue, outcome, o.now())
+		}
+	}
+
 	tokenContextEnc := hex.EncodeToString(token.Context)
-	challengeList, ok := o.challenges[tokenContextEnc]
-	if !ok {
-		log.Debugln("No outstanding challenge matching context", tokenContextEnc)
+	challenge, err := o.consumeChallenge(tokenContextEnc)
+	if err == ErrUnknownChallenge && o.epochChallenger != nil {
+		for _, issuer := range o.challengeIssuers() {
+			var tokenTypes []uint16
+			for _, offered := range o.offeredTokenKeys(issuer.keys.current()) {
+				tokenTypes = append(tokenTypes, offered.tokenType)
+			}
+			if epochChallenge, ok := o.epochChallenger.match(tokenContextEnc, issuer.name, o.originName, o.originInfo(), tokenTypes, o.now()); ok {
+				log.Debugln("Matched epoch challenge context", tokenContextEnc)
+				challenge, err = epochChallenge, nil
+				break
+			}
+		}
+	}
+	if err == ErrUnknownChallenge && o.challengeSigner != nil && credentials.challenge != nil {
+		challenge, err = o.matchSignedChallenge(credentials.challenge, token)
+		if errors.Is(err, ErrInvalidChallengeSignature) || errors.Is(err, ErrChallengeExpired) {
+			log.Debugln("Refusing token for signed challenge:", err)
+			err = ErrUnknownChallenge
+		} else if err == nil {
+			log.Debugln("Matched signed challenge context", tokenContextEnc)
+		}
+	}
+	if err == ErrRevokedChallenge {
+		log.Debugln("Refusing token for revoked challenge context", tokenContextEnc)
+		originValidationFailures.Inc(tokenType, validationFailureRevokedChallenge)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil && err != ErrUnknownChallenge {
+		log.Errorln("Failed consuming challenge:", err)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Debugln(err.Error(), tokenContextEnc)
+		originValidationFailures.Inc(tokenType, validationFailureUnknownChallenge)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
-	// Consume the first matching challenge
-	challenge := challengeList[0]
-	o.challenges[tokenContextEnc] = o.challenges[tokenContextEnc][1:]
-	log.Debugln("Consuming challenge context", tokenContextEnc)
-	log.Debugln("Remainder matching challenge set size", len(o.challenges[tokenContextEnc]))
-	if len(o.challenges[tokenContextEnc]) == 0 {
-		delete(o.challenges, tokenContextEnc)
-	}
 
-	authInput := token.AuthenticatorInput()
-	key := o.rateLimitedTokenKey
-	if challenge.TokenType == pat.BasicPublicTokenType {
-		key = o.basicValidationKey
+	if challenge.TokenType != tokenType || !o.admitsTokenType(req, challenge.TokenType) {
+		log.Debugln("Refusing token for a challenge of another type", formatTokenType(challenge.TokenType))
+		originValidationFailures.Inc(tokenType, validationFailureTokenType)
+		http.Error(w, ErrTokenTypeNotDemanded.Error(), http.StatusBadRequest)
+		return
 	}
 
-	hash := sha512.New384()
-	hash.Write(authInput)
-	digest := hash.Sum(nil)
-	err = rsa.VerifyPSS(key, crypto.SHA384, digest, token.Authenticator, &rsa.PSSOptions{
-		Hash:       crypto.SHA384,
-		SaltLength: crypto.SHA384.Size(),
-	})
+	// Verify with the keys of the issuer the challenge was for
+	issuer, ok := o.issuerByName(challenge.IssuerName)
+	if !ok {
+		log.Debugln("Refusing token for challenge of unknown issuer", challenge.IssuerName)
+		originValidationFailures.Inc(tokenType, validationFailureUnknownChallenge)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	verifyStart := time.Now()
+	keys := issuer.keys.current()
+	outageCause := outageCauseRemoteVerification
+	if o.outage != nil && o.outage.staleKeys(keys, o.now()) {
+		err, outageCause = ErrVerificationUnavailable, outageCauseStaleDirectory
+	} else if issuer.remoteVerifier != nil {
+		err = issuer.remoteVerifier.verify(req.Context(), tokenType, tokenValue)
+	} else if issuer.keys.bundleExpired(keys, o.now()) {
+		err, outageCause = ErrVerificationUnavailable, outageCauseExpiredBundle
+	} else {
+		err = verifyToken(verificationKeys{issuer: keys, privateTokenKey: o.privateTokenKey}, challenge.TokenType, token)
+	}
+	originVerificationDuration.Observe(tokenType, time.Since(verifyStart).Seconds())
+	degraded := false
+	if errors.Is(err, ErrVerificationUnavailable) && o.outage != nil {
+		log.Warnln("Origin", o.originName, "cannot verify tokens ("+outageCause+"):", err)
+		if !o.outage.fallback(w, req, tokenType, outageCause) {
+			return
+		}
+		degraded, err = true, nil
+	}
 	if err != nil {
 		// Token validation failed
 		log.Debugln("Token validation failed", err)
+		originValidationFailures.Inc(tokenType, validationFailureVerification)
+		if o.failedTokens != nil && !errors.Is(err, ErrVerificationUnavailable) {
+			o.failedTokens.store(tokenValue, o.now())
+		}
+		record(redemptionOutcome{status: http.StatusBadRequest, body: http.StatusText(http.StatusBadRequest)})
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
 
-	// Fetch the test resource for the client
-	httpClient := &http.Client{}
-	resourceReq, err := http.NewRequest(http.MethodGet, testResource, nil)
-	if err != nil {
-		log.Debugln(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Give the redemption hook, if any, the final say on the verified token,
+	// before it is spent so that denied tokens and hook failures do not cost
+	// the client its token
+	outcome := redemptionOutcome{}
+	if o.redemptionHook != nil {
+		verdict, err := o.redemptionHook.evaluate(req.Context(), newRedemptionEvent(req, challenge, token, credentials.extraParams()))
+		if err != nil {
+			log.Errorln("Redemption hook failed:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		outcome.headers = verdict.Headers
+		if len(verdict.Tags) > 0 {
+			log.Infoln("Redemption tagged:", strings.Join(verdict.Tags, ","))
+		}
+		if verdict.Decision == redemptionDecisionDeny {
+			log.Debugln("Redemption denied by hook")
+			body := verdict.Body
+			if body == "" {
+				body = http.StatusText(verdict.Status)
+			}
+			outcome.status, outcome.body = verdict.Status, body
+			record(outcome)
+			outcome.writeRefusal(w)
+			return
+		}
 	}
-	resp, err := httpClient.Do(resourceReq)
-	if err != nil {
-		log.Debugln(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+
+	// Record the token, refusing it if a concurrent redemption recorded it first
+	if o.spentTokens != nil {
+		now := o.now()
+		fresh, err := o.spentTokens.spend(spentTokenKeyEnc, now, now.Add(o.spentTokenRetention()))
+		if err != nil {
+			log.Errorln("Failed recording spent token:", err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if !fresh {
+			log.Debugln("Refusing token redeemed concurrently")
+			originDoubleSpends.Inc(tokenType)
+			http.Error(w, ErrTokenSpent.Error(), http.StatusBadRequest)
+			return
+		}
 	}
 
-	defer resp.Body.Close()
+	for name, value := range outcome.headers {
+		w.Header().Set(name, value)
+	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Debugln(err.Error())
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Outcomes of unverified redemptions are not replayed once the outage ends,
+	// and admitted tokens recorded as spent are refused rather than replayed
+	if !degraded && o.spentTokens == nil {
+		record(outcome)
 	}
 
-	w.Write(body)
+	// Serve the protected resource to the client
+	o.serveContent(w, req)
 }
 
 func startOrigin(c *cli.Context) error {
-	cert := c.String("cert")
-	key := c.String("key")
+	certs := c.StringSlice("cert")
+	keys := c.StringSlice("key")
+	certDir := c.String("cert-dir")
 	port := c.String("port")
-	issuer := c.String("issuer")
-	name := c.String("name")
-	originInfo := c.StringSlice("origin-info")
+	adminPort := c.String("admin-port")
+	configFile := c.String("config")
 	logLevel := c.String("log")
+	issuerRefreshInterval := c.Duration("issuer-refresh-interval")
+	selfTest := c.Bool("self-test")
+	demo := c.Bool("demo")
+
+	// The configuration file may only set flags, which applyConfigFile did
+	declaresOrigins := false
+	if configFile != "" {
+		fileConfig, err := readCommandConfig(configFile)
+		if err != nil {
+			log.Fatal("Invalid origin configuration: ", err)
+		}
+		declaresOrigins = fileConfig.Origins != nil
+	}
 
-	if cert == "" {
+	defaults := originConfigFromFlags(c)
+	origins := []OriginConfig{defaults}
+	if declaresOrigins {
+		config, err := readOriginsConfig(configFile, defaults)
+		if err != nil {
+			log.Fatal("Invalid origin configuration: ", err)
+		}
+		origins = config.Origins
+	} else {
+		if defaults.Issuer == "" {
+			log.Fatal("Invalid issuer. See README for configuration.")
+		}
+		if defaults.Name == "" {
+			log.Fatal("Invalid origin name. See README for configuration.")
+		}
+		if err := defaults.validate(); err != nil {
+			log.Fatal(err, ". See README for configuration.")
+		}
+	}
+	for _, cfg := range origins {
+		if cfg.Cert != "" {
+			certs = append(certs, cfg.Cert)
+			keys = append(keys, cfg.Key)
+		}
+	}
+
+	if len(certs) == 0 && certDir == "" {
 		log.Fatal("Invalid key material (missing certificate). See README for configuration.")
 	}
-	if key == "" {
+	if len(keys) != len(certs) {
 		log.Fatal("Invalid key material (missing private key). See README for configuration.")
 	}
-	if issuer == "" {
-		log.Fatal("Invalid issuer. See README for configuration.")
+	if issuerRefreshInterval <= 0 {
+		log.Fatal("Invalid issuer refresh interval. See README for configuration.")
 	}
-	if name == "" {
-		log.Fatal("Invalid origin name. See README for configuration.")
+	if adminPort != "" && adminPort == port {
+		log.Fatal("Invalid admin port (same as the port). See README for configuration.")
 	}
 
 	switch logLevel {
@@ -267,64 +811,117 @@ func startOrigin(c *cli.Context) error {
 		log.SetLevel(log.InfoLevel)
 	}
 
-	issuerConfig, err := fetchIssuerConfig(issuer)
+	options := serverOptionsFromFlags(c)
+	if err := options.validate(); err != nil {
+		log.Fatal(err, ". See README for configuration.")
+	}
+
+	config := effectiveConfigFromFlags(c, "origin")
+	if c.Bool("print-config") {
+		return printConfig(os.Stdout, config.withOrigins(origins))
+	}
+	logStartupBanner(config.withOrigins(origins), port)
+
+	tlsConfig, err := newServerTLSConfig(certs, keys, certDir)
 	if err != nil {
-		return err
+		log.Fatal("Invalid key material: ", err)
 	}
 
-	var basicValidationKeyEnc []byte
-	var basicValidationKey *rsa.PublicKey
-	var rateLimitedTokenKeyEnc []byte
-	var rateLimitedTokenKey *rsa.PublicKey
-	for i := 0; i < len(issuerConfig.TokenKeys); i++ {
-		switch issuerConfig.TokenKeys[i].TokenType {
-		case int(pat.BasicPublicTokenType):
-			basicValidationKeyEnc, err = base64.URLEncoding.DecodeString(issuerConfig.TokenKeys[i].TokenKey)
-			if err != nil {
-				log.Fatal(err)
+	proxies, err := parseTrustedProxies(c.StringSlice("trusted-proxies"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Origins sharing an issuer, verification bundle key, and clock skew
+	// tolerance share its keys
+	life := newLifecycle("origin", options.shutdownTimeout)
+	if err := startComposedRoles(life.context(), c, "origin"); err != nil {
+		log.Fatal("Invalid composed roles: ", err, ". See README for configuration.")
+	}
+	issuerKeySources := make(map[string]*issuerKeySource)
+	directoryCaches := make(map[string]*directoryCache)
+	stores := newStateStores()
+	life.onShutdown("state", stores.close)
+	router := newOriginRouter()
+	adminRouter := newOriginRouter()
+	accounting := newOriginAccounting()
+	// Origins share the clock, so that moving it at one moves it at all
+	clock := newRoleClock(demo)
+	if demo {
+		log.Warnln("Origins run on a demo clock the admin API can move")
+	}
+	for _, cfg := range origins {
+		skew := time.Duration(cfg.ClockSkew)
+		var originKeys []*issuerKeySource
+		for _, issuerName := range cfg.issuerNames() {
+			sourceID := issuerName + " " + cfg.VerificationBundleKey + " " + skew.String() + " " + cfg.issuerClientID()
+			issuerKeys, ok := issuerKeySources[sourceID]
+			if !ok {
+				issuerKeys = newIssuerKeySource(withClockSkewCheck(cfg.issuerClient(), issuerName, skew), issuerName, issuerRefreshInterval)
+				issuerKeys.skew = skew
+				if cfg.VerificationBundleKey != "" {
+					issuerKeys.bundleKey, _ = parseEd25519PublicKey(cfg.VerificationBundleKey)
+				}
+				if err := issuerKeys.load(life.context()); err != nil {
+					return life.abort(err)
+				}
+				life.goBackground(issuerKeys.run)
+				if issuerKeys.current().ed25519TokenKey != nil {
+					log.Infoln("Issuer", issuerName, "offers experimental Ed25519 tokens (type 0xED25)")
+				}
+				issuerKeySources[sourceID] = issuerKeys
 			}
-			basicValidationKey, err = pat.UnmarshalTokenKey(basicValidationKeyEnc)
-			if err != nil {
-				log.Fatal(err)
+			originKeys = append(originKeys, issuerKeys)
+		}
+
+		origin, err := newOrigin(cfg, originKeys, stores)
+		if err != nil {
+			return life.abort(fmt.Errorf("Invalid configuration for origin %s: %w", cfg.Name, err))
+		}
+		origin.clock = clock
+		accounting.add(origin)
+		// The admin API of an origin shows only its own configuration
+		origin.config = config.withOrigins([]OriginConfig{cfg})
+		if cfg.DirectoryPath != "" {
+			cacheID := cfg.Issuer + " " + time.Duration(cfg.DirectoryCacheTTL).String() + " " + cfg.issuerClientID()
+			directory, ok := directoryCaches[cacheID]
+			if !ok {
+				directory = newDirectoryCache(cfg.issuerClient(), cfg.Issuer, time.Duration(cfg.DirectoryCacheTTL))
+				life.goBackground(func(ctx context.Context) {
+					directory.run(ctx, clock)
+				})
+				directoryCaches[cacheID] = directory
 			}
-		case int(pat.RateLimitedTokenType):
-			rateLimitedTokenKeyEnc, err = base64.URLEncoding.DecodeString(issuerConfig.TokenKeys[i].TokenKey)
-			if err != nil {
-				log.Fatal(err)
+			origin.directory = directory
+		}
+		life.goBackground(origin.runExpiry)
+		if selfTest {
+			if err := runSelfTest("origin", origin.selfTestChecks()); err != nil {
+				return life.abort(fmt.Errorf("Origin %s: %w", cfg.Name, err))
 			}
-			rateLimitedTokenKey, err = pat.UnmarshalTokenKey(rateLimitedTokenKeyEnc)
-			if err != nil {
-				log.Fatal(err)
+		}
+		if adminPort != "" {
+			router.add(cfg, origin.handler(""))
+			if cfg.AdminToken != "" {
+				adminRouter.add(cfg, origin.newAdminServer(cfg.AdminToken))
 			}
+		} else {
+			router.add(cfg, origin.handler(cfg.AdminToken))
 		}
+		log.Infoln("Serving origin", cfg.Name, "with issuers", strings.Join(cfg.issuerNames(), ", "))
 	}
-
-	nameKeyURI, err := composeURL(issuer, issuerConfig.IssuerEncapKeyURI)
-	if err != nil {
-		return err
-	}
-	originNameKey, err := fetchIssuerNameKey(nameKeyURI)
-	if err != nil {
-		return err
+	if len(origins) == 1 {
+		router.fallback = router.byHost[strings.ToLower(origins[0].Name)]
+		adminRouter.fallback = adminRouter.byHost[strings.ToLower(origins[0].Name)]
 	}
 
-	origin := Origin{
-		issuerName:             issuer,
-		originName:             name,
-		additionalOriginInfo:   originInfo,
-		issuerEncapKey:         originNameKey,
-		rateLimitedTokenKeyEnc: rateLimitedTokenKeyEnc,
-		rateLimitedTokenKey:    rateLimitedTokenKey,
-		basicTokenKeyEnc:       basicValidationKeyEnc,
-		basicValidationKey:     basicValidationKey,
-		challenges:             make(map[string][]pat.TokenChallenge),
-		challengeLock:          sync.Mutex{},
+	if options.metricsAddr != "" {
+		life.serveMetrics(options.metricsAddr)
 	}
-
-	http.HandleFunc("/", origin.handleRequest)
-	err = http.ListenAndServeTLS(":"+port, cert, key, nil)
-	if err != nil {
-		log.Fatal("ListenAndServeTLS: ", err)
+	if adminPort != "" {
+		log.Infoln("Serving the origin admin API on port", adminPort)
+		life.serveTLS(newServer(adminPort, tlsConfig, withClientAddr(adminRouter, proxies), options), false)
 	}
-	return err
+	life.serveTLS(newServer(port, tlsConfig, withClientAddr(router, proxies), options), options.http3)
+	return life.wait()
 }
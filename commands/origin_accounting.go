@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const adminOriginAccountingURI = adminURIPrefix + "stats/origins"
+
+// originAccounting tracks the origins served by one process, so that the
+// admin API of each can compare its token spend with the origins sharing an
+// issuer with it. Origins of other issuers stay hidden, as their
+// configuration does.
+type originAccounting struct {
+	lock    sync.Mutex
+	origins []*Origin
+}
+
+func newOriginAccounting() *originAccounting {
+	return &originAccounting{}
+}
+
+func (a *originAccounting) add(origin *Origin) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.origins = append(a.origins, origin)
+	origin.accounting = a
+}
+
+// issuerNames returns the names of the issuers the origin challenges for.
+func (o *Origin) issuerNames() []string {
+	var names []string
+	for _, issuer := range o.challengeIssuers() {
+		names = append(names, issuer.name)
+	}
+	return names
+}
+
+// sharesIssuer tells whether both origins challenge for a common issuer.
+func (o *Origin) sharesIssuer(other *Origin) bool {
+	for _, name := range o.issuerNames() {
+		for _, otherName := range other.issuerNames() {
+			if name == otherName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// peers returns the origin and the origins of the process sharing an issuer
+// with it, by name.
+func (a *originAccounting) peers(origin *Origin) []*Origin {
+	if a == nil {
+		return []*Origin{origin}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	peers := make([]*Origin, 0, len(a.origins))
+	for _, other := range a.origins {
+		if other == origin || origin.sharesIssuer(other) {
+			peers = append(peers, other)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].originName < peers[j].originName })
+	return peers
+}
+
+// originSpend is the token spend of one origin since it started. Admitted
+// counts tokens by token type, as 0x-prefixed hex.
+type originSpend struct {
+	Origin            string            `json:"origin"`
+	Issuers           []string          `json:"issuers"`
+	Since             string            `json:"since"`
+	Admitted          map[string]uint64 `json:"admitted"`
+	Refused           uint64            `json:"refused"`
+	AdmittedPerMinute float64           `json:"admitted_per_minute"`
+}
+
+type originAccountingResponse struct {
+	Origins []originSpend `json:"origins"`
+}
+
+// spend returns the admitted tokens by token type and the refused ones since
+// the origin started.
+func (s *originStats) spend() (time.Time, map[uint16]uint64, uint64) {
+	admitted := make(map[uint16]uint64)
+	if s == nil {
+		return time.Time{}, admitted, 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	refused := uint64(0)
+	for tokenType, byStatus := range s.redemptions {
+		for status, count := range byStatus {
+			if status < 300 {
+				admitted[tokenType] += count
+			} else {
+				refused += count
+			}
+		}
+	}
+	return s.since, admitted, refused
+}
+
+// spend sums up the token spend of the origin. The rate is only given once
+// the origin ran for a minute.
+func (o *Origin) spend(now time.Time) originSpend {
+	since, admitted, refused := o.stats.spend()
+	spend := originSpend{
+		Origin:   o.originName,
+		Issuers:  o.issuerNames(),
+		Admitted: make(map[string]uint64),
+		Refused:  refused,
+	}
+	total := uint64(0)
+	for tokenType, count := range admitted {
+		spend.Admitted[formatTokenType(tokenType)] = count
+		total += count
+	}
+	if !since.IsZero() {
+		spend.Since = since.UTC().Format(time.RFC3339)
+		if elapsed := now.Sub(since); elapsed >= time.Minute {
+			spend.AdmittedPerMinute = float64(total) / elapsed.Minutes()
+		}
+	}
+	return spend
+}
+
+func (o *Origin) handleOriginAccounting(w http.ResponseWriter, req *http.Request) {
+	response := originAccountingResponse{}
+	now := time.Now()
+	for _, peer := range o.accounting.peers(o) {
+		response.Origins = append(response.Origins, peer.spend(now))
+	}
+	writeAdminJSON(w, response)
+}
+
+// redemptionResult labels redemptions as admitted or refused in metrics.
+func redemptionResult(status int) string {
+	if status < 300 {
+		return "admitted"
+	}
+	return "refused"
+}
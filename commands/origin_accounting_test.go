@@ -0,0 +1,61 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestOriginAccounting(t *testing.T) {
+	shared := newTestIssuer(t, "issuer.example")
+	accounting := newOriginAccounting()
+	newAccountedOrigin := func(name string, issuers ...*Issuer) *Origin {
+		origin := newMultiIssuerOrigin(t, issuers...)
+		origin.originName = name
+		origin.stats = newOriginStats(time.Now().Add(-2 * time.Minute))
+		accounting.add(origin)
+		return origin
+	}
+	a := newAccountedOrigin("a.example", shared)
+	b := newAccountedOrigin("b.example", newTestIssuer(t, "other.example"), shared)
+	newAccountedOrigin("c.example", newTestIssuer(t, "third.example"))
+
+	for i := 0; i < 4; i++ {
+		a.stats.redemption(pat.RateLimitedTokenType, http.StatusOK)
+	}
+	b.stats.redemption(pat.BasicPublicTokenType, http.StatusOK)
+	b.stats.redemption(pat.BasicPublicTokenType, http.StatusBadRequest)
+
+	// Malformed tokens are counted under the origin name too
+	refused := originNameRedemptions.Value(0, "b.example", "refused")
+	req := httptest.NewRequest(http.MethodGet, "https://b.example/", nil)
+	req.Header.Set("Authorization", privateTokenType+" token=AAAA")
+	b.handleRequest(httptest.NewRecorder(), req)
+	if originNameRedemptions.Value(0, "b.example", "refused") != refused+1 {
+		t.Fatal("expected the redemption to be counted under the origin name")
+	}
+
+	var response originAccountingResponse
+	if code := adminRequest(t, a.newAdminServer("secret"), http.MethodGet, adminOriginAccountingURI, nil, &response); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(response.Origins) != 2 || response.Origins[0].Origin != "a.example" || response.Origins[1].Origin != "b.example" {
+		t.Fatalf("expected the origins sharing issuer.example, got %+v", response.Origins)
+	}
+	spendA, spendB := response.Origins[0], response.Origins[1]
+	if spendA.Admitted["0x0003"] != 4 || spendA.Refused != 0 || spendA.AdmittedPerMinute < 1.9 || spendA.AdmittedPerMinute > 2 {
+		t.Fatalf("unexpected spend %+v", spendA)
+	}
+	if spendB.Admitted["0x0002"] != 1 || spendB.Refused != 2 || len(spendB.Issuers) != 2 {
+		t.Fatalf("unexpected spend %+v", spendB)
+	}
+
+	// Origins served alone list just themselves
+	alone := newMultiIssuerOrigin(t, shared)
+	if peers := alone.accounting.peers(alone); len(peers) != 1 || peers[0] != alone {
+		t.Fatalf("expected the origin alone, got %d origins", len(peers))
+	}
+}
@@ -0,0 +1,238 @@
+package commands
+
+import (
+	"encoding/hex"
+	"net/http"
+	"sort"
+)
+
+const (
+	adminRevokeChallengesURI = adminURIPrefix + "challenges/revoke"
+	adminChallengesURI       = adminURIPrefix + "challenges"
+	adminFlushChallengesURI  = adminURIPrefix + "challenges/flush"
+	adminReloadIssuerKeysURI = adminURIPrefix + "issuer-keys/reload"
+	adminTokenTypesURI       = adminURIPrefix + "token-types"
+	adminTokenTypesSetURI    = adminURIPrefix + "token-types/set"
+	adminStatsURI            = adminURIPrefix + "stats"
+)
+
+// revokeRequest names a single challenge context, or an origin name whose
+// outstanding challenge contexts are all revoked.
+type revokeRequest struct {
+	Context    string `json:"context,omitempty"`
+	OriginName string `json:"origin_name,omitempty"`
+}
+
+type revokeResponse struct {
+	Revoked []string `json:"revoked"`
+}
+
+// revokeContext marks the context as revoked and drops its outstanding
+// challenges. Tokens for revoked contexts are refused for the lifetime of the
+// process, including those minted against later non-interactive challenges
+// sharing the context.
+func (o *Origin) revokeContext(contextEnc string) error {
+	o.challengeLock.Lock()
+	o.revokedContexts[contextEnc] = true
+	o.challengeLock.Unlock()
+	return o.dropContext(contextEnc)
+}
+
+// revokeOriginName revokes every outstanding challenge context whose
+// origin_info lists the name, and returns the revoked contexts.
+func (o *Origin) revokeOriginName(originName string) ([]string, error) {
+	outstanding, err := o.challenges.list(o.now())
+	if err != nil {
+		return nil, err
+	}
+	revoked := make([]string, 0)
+	for contextEnc, outstanding := range outstanding {
+		for _, name := range outstanding.challenge.OriginInfo {
+			if name == originName {
+				if err := o.revokeContext(contextEnc); err != nil {
+					return nil, err
+				}
+				revoked = append(revoked, contextEnc)
+				break
+			}
+		}
+	}
+	sort.Strings(revoked)
+	return revoked, nil
+}
+
+func (o *Origin) handleRevokeChallenges(w http.ResponseWriter, req *http.Request) {
+	var revokeReq revokeRequest
+	if err := readAdminJSON(req, &revokeReq); err != nil {
+		http.Error(w, "Invalid revocation request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (revokeReq.Context == "") == (revokeReq.OriginName == "") {
+		http.Error(w, "Exactly one of context or origin_name is required", http.StatusBadRequest)
+		return
+	}
+
+	response := revokeResponse{}
+	var err error
+	if revokeReq.Context != "" {
+		err = o.revokeContext(revokeReq.Context)
+		response.Revoked = []string{revokeReq.Context}
+	} else {
+		response.Revoked, err = o.revokeOriginName(revokeReq.OriginName)
+	}
+	if err != nil {
+		http.Error(w, "Failed revoking challenges: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, response)
+}
+
+type challengeInfo struct {
+	Context         string   `json:"context"`
+	TokenType       string   `json:"token_type"`
+	IssuerName      string   `json:"issuer_name"`
+	OriginInfo      []string `json:"origin_info,omitempty"`
+	RedemptionNonce string   `json:"redemption_nonce,omitempty"`
+	Count           int      `json:"count"`
+}
+
+type challengesResponse struct {
+	Challenges []challengeInfo `json:"challenges"`
+}
+
+func (o *Origin) handleListChallenges(w http.ResponseWriter, req *http.Request) {
+	outstanding, err := o.challenges.list(o.now())
+	if err != nil {
+		http.Error(w, "Failed listing challenges: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := challengesResponse{Challenges: make([]challengeInfo, 0, len(outstanding))}
+	for contextEnc, outstanding := range outstanding {
+		response.Challenges = append(response.Challenges, challengeInfo{
+			Context:         contextEnc,
+			TokenType:       formatTokenType(outstanding.challenge.TokenType),
+			IssuerName:      outstanding.challenge.IssuerName,
+			OriginInfo:      outstanding.challenge.OriginInfo,
+			RedemptionNonce: hex.EncodeToString(outstanding.challenge.RedemptionNonce),
+			Count:           outstanding.count,
+		})
+	}
+	sort.Slice(response.Challenges, func(i, j int) bool {
+		return response.Challenges[i].Context < response.Challenges[j].Context
+	})
+	writeAdminJSON(w, response)
+}
+
+type flushResponse struct {
+	Flushed int `json:"flushed"`
+}
+
+// handleFlushChallenges drops every outstanding challenge, so that tokens
+// for them are refused. Contexts are not revoked, so they can be challenged
+// for again.
+func (o *Origin) handleFlushChallenges(w http.ResponseWriter, req *http.Request) {
+	outstanding, err := o.challenges.list(o.now())
+	if err != nil {
+		http.Error(w, "Failed listing challenges: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := flushResponse{}
+	for contextEnc, outstanding := range outstanding {
+		if err := o.dropContext(contextEnc); err != nil {
+			http.Error(w, "Failed flushing challenges: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Flushed += outstanding.count
+	}
+	writeAdminJSON(w, response)
+}
+
+type issuerReload struct {
+	Issuer string `json:"issuer"`
+	Error  string `json:"error,omitempty"`
+}
+
+type reloadResponse struct {
+	Issuers []issuerReload `json:"issuers"`
+}
+
+// handleReloadIssuerKeys re-fetches the keys of every issuer of the origin
+// now rather than at the next refresh. Issuers failing keep their last known
+// good keys; the response is 502 if any failed.
+func (o *Origin) handleReloadIssuerKeys(w http.ResponseWriter, req *http.Request) {
+	response := reloadResponse{Issuers: make([]issuerReload, 0, 1)}
+	failed := false
+	for _, issuer := range o.challengeIssuers() {
+		reload := issuerReload{Issuer: issuer.name}
+		if err := issuer.keys.refresh(); err != nil {
+			reload.Error, failed = err.Error(), true
+		}
+		response.Issuers = append(response.Issuers, reload)
+	}
+	if o.failedTokens != nil {
+		o.failedTokens.flush()
+	}
+	if failed {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	writeAdminJSON(w, response)
+}
+
+// tokenTypesRequest names the token types the origin accepts, as in
+// --token-type of the client.
+type tokenTypesRequest struct {
+	Accepted []string `json:"accepted"`
+}
+
+type tokenTypesResponse struct {
+	Accepted []string `json:"accepted"`
+}
+
+func (o *Origin) handleTokenTypes(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, tokenTypesResponse{Accepted: o.tokenTypes.names()})
+}
+
+func (o *Origin) handleSetTokenTypes(w http.ResponseWriter, req *http.Request) {
+	var setReq tokenTypesRequest
+	if err := readAdminJSON(req, &setReq); err != nil {
+		http.Error(w, "Invalid token types request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := o.tokenTypes.set(setReq.Accepted); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeAdminJSON(w, tokenTypesResponse{Accepted: o.tokenTypes.names()})
+}
+
+func (o *Origin) handleStats(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, o.stats.snapshot())
+}
+
+func (o *Origin) newAdminServer(token string) *adminServer {
+	admin := newAdminServer("origin", token)
+	admin.handle(http.MethodPost, adminRevokeChallengesURI, "Revoke a challenge context or all contexts for an origin name",
+		revokeRequest{}, revokeResponse{}, o.handleRevokeChallenges)
+	admin.handle(http.MethodGet, adminChallengesURI, "Outstanding challenges by context",
+		nil, challengesResponse{}, o.handleListChallenges)
+	admin.handle(http.MethodPost, adminFlushChallengesURI, "Drop every outstanding challenge without revoking their contexts",
+		nil, flushResponse{}, o.handleFlushChallenges)
+	admin.handle(http.MethodPost, adminReloadIssuerKeysURI, "Re-fetch the directory and keys of every issuer of the origin now",
+		nil, reloadResponse{}, o.handleReloadIssuerKeys)
+	admin.handle(http.MethodGet, adminTokenTypesURI, "Token types the origin challenges for and accepts",
+		nil, tokenTypesResponse{}, o.handleTokenTypes)
+	admin.handle(http.MethodPost, adminTokenTypesSetURI, "Accept only the named token types ['basic', 'rate-limited', 'private', 'ed25519']",
+		tokenTypesRequest{}, tokenTypesResponse{}, o.handleSetTokenTypes)
+	admin.handle(http.MethodGet, adminStatsURI, "Challenges and redemptions of the origin since it started, by token type and status",
+		nil, originStatsResponse{}, o.handleStats)
+	admin.handle(http.MethodGet, adminOriginAccountingURI, "Tokens admitted and refused by the origin and the origins of the process sharing an issuer with it",
+		nil, originAccountingResponse{}, o.handleOriginAccounting)
+	admin.handle(http.MethodGet, adminStateSummaryURI, "Counts of outstanding challenges, with the issuers and accepted token types",
+		nil, originStateSummary{}, o.handleStateSummary)
+	admin.handle(http.MethodPost, adminVerifyTokensURI, "Verify a batch of tokens without redeeming them, with a verdict per token",
+		verifyTokensRequest{}, verifyTokensResponse{}, o.handleVerifyTokens)
+	handleClockAdmin(admin, o.clock)
+	admin.serveConfig(o.config)
+	return admin
+}
@@ -0,0 +1,274 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func newTestOrigin() *Origin {
+	return &Origin{
+		issuerName:      "issuer.example",
+		originName:      "origin.example",
+		issuerKeys:      &issuerKeySource{keys: &issuerKeys{}},
+		challenges:      newMemoryChallengeStore(),
+		revokedContexts: make(map[string]bool),
+	}
+}
+
+// outstandingChallenges lists the unexpired challenges of the origin.
+func outstandingChallenges(origin *Origin) map[string]outstandingChallenge {
+	outstanding, _ := origin.challenges.list(time.Now())
+	return outstanding
+}
+
+func createTestChallengeContext(t *testing.T, origin *Origin, noninteractive bool) string {
+	req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	if noninteractive {
+		req.Header.Set(headerTokenAttributeNoninteractive, "1")
+	}
+	origin.CreateChallenge(req)
+	for contextEnc := range outstandingChallenges(origin) {
+		return contextEnc
+	}
+	t.Fatal("no challenge created")
+	return ""
+}
+
+func postRevoke(admin *adminServer, token string, revokeReq revokeRequest) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(revokeReq)
+	req := httptest.NewRequest(http.MethodPost, adminRevokeChallengesURI, bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	origin := newTestOrigin()
+	admin := origin.newAdminServer("secret")
+
+	if w := postRevoke(admin, "", revokeRequest{Context: "00"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", w.Code)
+	}
+	if w := postRevoke(admin, "wrong", revokeRequest{Context: "00"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with wrong token, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, adminRevokeChallengesURI, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for GET, got %d", w.Code)
+	}
+}
+
+func TestRevokeChallengeContext(t *testing.T) {
+	origin := newTestOrigin()
+	admin := origin.newAdminServer("secret")
+	contextEnc := createTestChallengeContext(t, origin, true)
+
+	w := postRevoke(admin, "secret", revokeRequest{Context: contextEnc})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Re-issuing the same non-interactive challenge must not revive the context
+	createTestChallengeContext(t, origin, true)
+	if _, err := origin.consumeChallenge(contextEnc); err != ErrRevokedChallenge {
+		t.Fatalf("expected revoked challenge, got %v", err)
+	}
+}
+
+func TestRevokeOriginName(t *testing.T) {
+	origin := newTestOrigin()
+	admin := origin.newAdminServer("secret")
+	contextEnc := createTestChallengeContext(t, origin, false)
+
+	w := postRevoke(admin, "secret", revokeRequest{OriginName: "other.example"})
+	response := revokeResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Revoked) != 0 {
+		t.Fatal("expected no contexts revoked for an unrelated origin")
+	}
+
+	w = postRevoke(admin, "secret", revokeRequest{OriginName: "origin.example"})
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Revoked) != 1 || response.Revoked[0] != contextEnc {
+		t.Fatalf("unexpected revoked contexts %v", response.Revoked)
+	}
+	if _, err := origin.consumeChallenge(contextEnc); err != ErrRevokedChallenge {
+		t.Fatalf("expected revoked challenge, got %v", err)
+	}
+
+	if w := postRevoke(admin, "secret", revokeRequest{Context: contextEnc, OriginName: "origin.example"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for ambiguous request, got %d", w.Code)
+	}
+}
+
+// adminRequest sends an authorized request to the admin API, decoding the
+// JSON response into response if set.
+func adminRequest(t *testing.T, admin *adminServer, method, uri string, body interface{}, response interface{}) int {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, uri, bytes.NewReader(reqBody))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	if response != nil && w.Header().Get("Content-Type") == "application/json" {
+		if err := json.Unmarshal(w.Body.Bytes(), response); err != nil {
+			t.Fatalf("failed decoding %s response %q: %v", uri, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func TestAdminListAndFlushChallenges(t *testing.T) {
+	origin := newTestOrigin()
+	admin := origin.newAdminServer("secret")
+	contextEnc := createTestChallengeContext(t, origin, false)
+	createTestChallengeContext(t, origin, true)
+
+	var listed challengesResponse
+	if code := adminRequest(t, admin, http.MethodGet, adminChallengesURI, nil, &listed); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if len(listed.Challenges) != 2 {
+		t.Fatalf("expected two contexts, got %+v", listed.Challenges)
+	}
+	found := false
+	for _, challenge := range listed.Challenges {
+		if challenge.Context == contextEnc {
+			found = true
+			if challenge.TokenType != "0x0003" || challenge.IssuerName != "issuer.example" || challenge.Count != 1 || challenge.RedemptionNonce == "" {
+				t.Fatalf("unexpected challenge %+v", challenge)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("expected context %s to be listed", contextEnc)
+	}
+
+	var flushed flushResponse
+	if code := adminRequest(t, admin, http.MethodPost, adminFlushChallengesURI, nil, &flushed); code != http.StatusOK || flushed.Flushed != 2 {
+		t.Fatalf("expected two challenges flushed, got %d: %+v", code, flushed)
+	}
+	if len(outstandingChallenges(origin)) != 0 {
+		t.Fatal("expected no outstanding challenges")
+	}
+	// Flushed contexts are not revoked
+	createTestChallengeContext(t, origin, false)
+	if len(outstandingChallenges(origin)) != 1 {
+		t.Fatal("expected contexts to be challenged for again")
+	}
+}
+
+func TestAdminTokenTypes(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	origin := newMultiIssuerOrigin(t, issuer)
+	origin.tokenTypes = newTokenTypeToggle()
+	origin.stats = newOriginStats(time.Now())
+	admin := origin.newAdminServer("secret")
+
+	var types tokenTypesResponse
+	if adminRequest(t, admin, http.MethodGet, adminTokenTypesURI, nil, &types); len(types.Accepted) != len(tokenTypeNames) {
+		t.Fatalf("expected every token type accepted, got %v", types.Accepted)
+	}
+	for _, accepted := range [][]string{nil, {"unknown"}} {
+		if code := adminRequest(t, admin, http.MethodPost, adminTokenTypesSetURI, tokenTypesRequest{Accepted: accepted}, nil); code != http.StatusBadRequest {
+			t.Fatalf("expected %v to be refused, got %d", accepted, code)
+		}
+	}
+
+	// A basic token issued before basic tokens are disabled is refused
+	challengeReq := httptest.NewRequest(http.MethodGet, "https://origin.example/?type=2", nil)
+	challenge, tokenKey, err := origin.CreateChallenge(challengeReq)
+	if err != nil || tokenKey == "" {
+		t.Fatal(err)
+	}
+	challengeEnc, _ := base64.URLEncoding.DecodeString(challenge)
+	tokenChallenge, _ := pat.UnmarshalTokenChallenge(challengeEnc)
+	token := createTestToken(t, issuer, tokenChallenge.Marshal())
+
+	if code := adminRequest(t, admin, http.MethodPost, adminTokenTypesSetURI, tokenTypesRequest{Accepted: []string{"rate-limited"}}, &types); code != http.StatusOK || len(types.Accepted) != 1 {
+		t.Fatalf("unexpected response %d: %v", code, types.Accepted)
+	}
+	req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+	w := httptest.NewRecorder()
+	origin.handleRequest(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), ErrTokenTypeNotAccepted.Error()) {
+		t.Fatalf("expected the token to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Clients asking for basic tokens are challenged for rate-limited ones
+	tokenType, _ := origin.challengeTokenType(challengeReq, origin.issuers[0].keys.current())
+	if tokenType != pat.RateLimitedTokenType {
+		t.Fatalf("expected a rate-limited challenge, got 0x%04x", tokenType)
+	}
+
+	var stats originStatsResponse
+	if code := adminRequest(t, admin, http.MethodGet, adminStatsURI, nil, &stats); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if stats.Challenges["0x0002"] != 1 || stats.Redemptions["0x0002"]["400"] != 1 || stats.Refused != 1 || stats.Admitted != 0 || stats.Since == "" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestAdminReloadIssuerKeys(t *testing.T) {
+	var issuer *Issuer
+	failing := int32(0)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) != 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		switch req.URL.Path {
+		case issuerConfigURI:
+			issuer.handleConfigRequest(w, req)
+		case issuerEncapKeyURI:
+			issuer.handleNameKeyRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	name := strings.TrimPrefix(server.URL, "https://")
+	issuer = newTestIssuer(t, name)
+
+	origin := newTestOrigin()
+	origin.issuerName = name
+	origin.issuerKeys = newIssuerKeySource(server.Client(), name, time.Hour)
+	admin := origin.newAdminServer("secret")
+	var reloaded reloadResponse
+	if code := adminRequest(t, admin, http.MethodPost, adminReloadIssuerKeysURI, nil, &reloaded); code != http.StatusOK {
+		t.Fatalf("expected the reload to succeed, got %d: %+v", code, reloaded)
+	}
+	if reloaded.Issuers[0].Issuer != name || origin.issuerKeys.current().basicValidationKey == nil {
+		t.Fatalf("expected the keys of %s to be loaded, got %+v", name, reloaded)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	code := adminRequest(t, admin, http.MethodPost, adminReloadIssuerKeysURI, nil, &reloaded)
+	if code != http.StatusBadGateway || len(reloaded.Issuers) != 1 || reloaded.Issuers[0].Error == "" {
+		t.Fatalf("expected the reload to fail, got %d: %+v", code, reloaded)
+	}
+}
@@ -0,0 +1,176 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	// Challenges a rule can demand
+	challengeModeInteractive    = "interactive"
+	challengeModeNonInteractive = "non-interactive"
+)
+
+var ErrTokenTypeNotDemanded = errors.New("Token type not demanded for this resource")
+
+// challengeRule decides how the origin challenges the requests it matches.
+// A request matches if its path is under Path and, if set, its client address
+// is in one of Clients and its User-Agent matches the UserAgent regular
+// expression. Requests are challenged unless RequireToken is false, for the
+// token type in TokenType and the challenge in Challenge if set, and as the
+// client asks otherwise.
+type challengeRule struct {
+	Name         string   `json:"name,omitempty"`
+	Path         string   `json:"path,omitempty"`
+	Clients      []string `json:"clients,omitempty"`
+	UserAgent    string   `json:"user-agent,omitempty"`
+	RequireToken *bool    `json:"require-token,omitempty"`
+	TokenType    uint16   `json:"token-type,omitempty"`
+	Challenge    string   `json:"challenge,omitempty"`
+
+	networks  []*net.IPNet
+	userAgent *regexp.Regexp
+}
+
+// challengeRules is the rules file of the origin. The first rule matching a
+// request applies, and requests no rule matches are challenged as the client
+// asks. A nil set has no rules.
+type challengeRules struct {
+	Rules []challengeRule `json:"rules"`
+}
+
+func readChallengeRules(fileName string) (*challengeRules, error) {
+	rulesEnc, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	rules := &challengeRules{}
+	if err := json.Unmarshal(rulesEnc, rules); err != nil {
+		return nil, err
+	}
+	for i := range rules.Rules {
+		if err := rules.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("Invalid challenge rule %s: %w", rules.Rules[i].label(i), err)
+		}
+	}
+	return rules, nil
+}
+
+// label names the i-th rule in logs and metrics.
+func (r challengeRule) label(i int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("rule-%d", i+1)
+}
+
+func (r *challengeRule) compile() error {
+	if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("path %q does not start with /", r.Path)
+	}
+	for _, client := range r.Clients {
+		network, err := parseNetwork(strings.TrimSpace(client))
+		if err != nil {
+			return err
+		}
+		r.networks = append(r.networks, network)
+	}
+	if r.UserAgent != "" {
+		userAgent, err := regexp.Compile(r.UserAgent)
+		if err != nil {
+			return fmt.Errorf("user-agent: %w", err)
+		}
+		r.userAgent = userAgent
+	}
+	if r.TokenType != 0 && !isKnownTokenType(r.TokenType) {
+		return fmt.Errorf("%w: %s", ErrUnsupportedTokenType, formatTokenType(r.TokenType))
+	}
+	switch r.Challenge {
+	case "", challengeModeInteractive, challengeModeNonInteractive:
+	default:
+		return fmt.Errorf("unknown challenge %q, expected %q or %q", r.Challenge, challengeModeInteractive, challengeModeNonInteractive)
+	}
+	if r.RequireToken != nil && !*r.RequireToken && (r.TokenType != 0 || r.Challenge != "") {
+		return fmt.Errorf("token-type and challenge are of no use without require-token")
+	}
+	return nil
+}
+
+func (r challengeRule) matches(req *http.Request) bool {
+	if !strings.HasPrefix(req.URL.Path, r.Path) {
+		return false
+	}
+	if len(r.networks) > 0 {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		matched := false
+		for _, network := range r.networks {
+			matched = matched || (ip != nil && network.Contains(ip))
+		}
+		if !matched {
+			return false
+		}
+	}
+	return r.userAgent == nil || r.userAgent.MatchString(req.UserAgent())
+}
+
+// match returns the first rule matching the request, and its label.
+func (r *challengeRules) match(req *http.Request) (challengeRule, string, bool) {
+	if r == nil {
+		return challengeRule{}, "", false
+	}
+	for i, rule := range r.Rules {
+		if rule.matches(req) {
+			return rule, rule.label(i), true
+		}
+	}
+	return challengeRule{}, "", false
+}
+
+// requiresToken tells whether the origin challenges the request for a token.
+func (o *Origin) requiresToken(req *http.Request) bool {
+	rule, _, ok := o.challengeRules.match(req)
+	return !ok || rule.RequireToken == nil || *rule.RequireToken
+}
+
+// nonInteractive tells whether the request is challenged without a
+// redemption nonce, as its rule demands or else the client asks.
+func (o *Origin) nonInteractive(req *http.Request) bool {
+	if rule, _, ok := o.challengeRules.match(req); ok && rule.Challenge != "" {
+		return rule.Challenge == challengeModeNonInteractive
+	}
+	return requestsNonInteractive(req)
+}
+
+// demandedTokenType returns the token type the request is challenged for, as
+// its rule demands or else the client asks, if any.
+func (o *Origin) demandedTokenType(req *http.Request) (uint16, bool) {
+	if rule, _, ok := o.challengeRules.match(req); ok && rule.TokenType != 0 {
+		return rule.TokenType, true
+	}
+	return requestedTokenType(req)
+}
+
+// admitsTokenType tells whether tokens of the type, for challenges of the
+// type, may be redeemed for the request. Rules demanding a token type refuse
+// tokens of other types, e.g., obtained for another path.
+func (o *Origin) admitsTokenType(req *http.Request, tokenType uint16) bool {
+	rule, _, ok := o.challengeRules.match(req)
+	return !ok || rule.TokenType == 0 || rule.TokenType == tokenType
+}
+
+// countChallengeRule counts the rule deciding an unauthorized request, if any.
+func (o *Origin) countChallengeRule(req *http.Request) {
+	if rule, label, ok := o.challengeRules.match(req); ok {
+		originChallengeRuleMatches.Inc(rule.TokenType, label)
+	}
+}
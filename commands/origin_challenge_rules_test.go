@@ -0,0 +1,152 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudflare/pat-app/httpauth"
+	pat "github.com/cloudflare/pat-go"
+)
+
+func writeChallengeRules(t *testing.T, rules string) string {
+	fileName := filepath.Join(t.TempDir(), "rules.json")
+	if err := ioutil.WriteFile(fileName, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestReadChallengeRules(t *testing.T) {
+	rules, err := readChallengeRules(writeChallengeRules(t, `{"rules": [
+		{"name": "public", "path": "/public/", "require-token": false},
+		{"path": "/api/", "clients": ["10.0.0.0/8", "192.0.2.1"], "user-agent": "^curl/", "token-type": 2, "challenge": "non-interactive"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Rules) != 2 || len(rules.Rules[1].networks) != 2 || rules.Rules[1].userAgent == nil {
+		t.Fatalf("unexpected rules %+v", rules.Rules)
+	}
+	if label := rules.Rules[1].label(1); label != "rule-2" {
+		t.Fatalf("expected unnamed rules to be labeled by position, got %q", label)
+	}
+
+	for _, invalid := range []string{
+		`{"rules": [{"path": "api/"}]}`,
+		`{"rules": [{"clients": ["10.0.0.0/33"]}]}`,
+		`{"rules": [{"user-agent": "("}]}`,
+		`{"rules": [{"token-type": 4660}]}`,
+		`{"rules": [{"challenge": "sometimes"}]}`,
+		`{"rules": [{"require-token": false, "token-type": 2}]}`,
+		`{"rules": {}}`,
+	} {
+		if _, err := readChallengeRules(writeChallengeRules(t, invalid)); err == nil {
+			t.Fatalf("expected %s to be refused", invalid)
+		}
+	}
+}
+
+func TestChallengeRules(t *testing.T) {
+	origin := newMultiIssuerOrigin(t, newTestIssuer(t, "issuer.example"))
+	origin.content = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("content"))
+	})
+	var err error
+	origin.challengeRules, err = readChallengeRules(writeChallengeRules(t, `{"rules": [
+		{"name": "public", "path": "/public/", "require-token": false},
+		{"name": "internal", "path": "/api/", "clients": ["10.0.0.0/8"], "token-type": 2, "challenge": "non-interactive"},
+		{"name": "bots", "user-agent": "bot", "challenge": "interactive"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := func(req *http.Request) pat.TokenChallenge {
+		w := httptest.NewRecorder()
+		origin.handleRequest(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected %s to be challenged, got %d", req.URL.Path, w.Code)
+		}
+		challenges, err := httpauth.Parse(w.Header().Get("WWW-Authenticate"))
+		if err != nil || len(challenges) != 1 {
+			t.Fatalf("expected a single challenge, got %v %v", challenges, err)
+		}
+		tokenChallenge, err := pat.UnmarshalTokenChallenge(challenges[0].TokenChallenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenChallenge
+	}
+
+	// Open paths are served without a token
+	public := originChallengeRuleMatches.Value(0, "public")
+	w := httptest.NewRecorder()
+	origin.handleRequest(w, httptest.NewRequest(http.MethodGet, "https://origin.example/public/index.html", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Fatalf("expected the public path to be served, got %d", w.Code)
+	}
+	if originChallengeRuleMatches.Value(0, "public") != public+1 {
+		t.Fatal("expected the rule to be counted")
+	}
+
+	// Internal clients get non-interactive challenges for the demanded type,
+	// whatever they ask for
+	req := httptest.NewRequest(http.MethodGet, "https://origin.example/api/v1?type=3", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	if tokenChallenge := challenge(req); tokenChallenge.TokenType != pat.BasicPublicTokenType || len(tokenChallenge.RedemptionNonce) != 0 {
+		t.Fatalf("expected a non-interactive basic token challenge, got %+v", tokenChallenge)
+	}
+	req = httptest.NewRequest(http.MethodGet, "https://origin.example/api/v1?type=3", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if tokenChallenge := challenge(req); tokenChallenge.TokenType != pat.RateLimitedTokenType || len(tokenChallenge.RedemptionNonce) == 0 {
+		t.Fatalf("expected other clients to be challenged as they ask, got %+v", tokenChallenge)
+	}
+
+	// Clients matched by User-Agent get interactive challenges
+	req = httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	req.Header.Set("User-Agent", "examplebot/1.0")
+	req.Header.Set(headerTokenAttributeNoninteractive, "1")
+	if tokenChallenge := challenge(req); len(tokenChallenge.RedemptionNonce) == 0 {
+		t.Fatal("expected an interactive challenge")
+	}
+
+	// Tokens of another type than demanded are refused before their
+	// challenge is looked up, and tokens for challenges of another type
+	// than theirs after
+	challengeEnc, _, err := origin.CreateChallenge(httptest.NewRequest(http.MethodGet, "https://origin.example/?type=3", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	challengeBytes, _ := base64.URLEncoding.DecodeString(challengeEnc)
+	context := sha256.Sum256(challengeBytes)
+	contextEnc := hex.EncodeToString(context[:])
+	redeem := func(path string, tokenType uint16) *httptest.ResponseRecorder {
+		token := pat.Token{
+			TokenType:     tokenType,
+			Nonce:         make([]byte, 32),
+			Context:       context[:],
+			KeyID:         make([]byte, 32),
+			Authenticator: make([]byte, 256),
+		}
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example"+path, nil)
+		req.RemoteAddr = "10.1.2.3:1234"
+		req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+		w := httptest.NewRecorder()
+		origin.handleRequest(w, req)
+		return w
+	}
+	if w := redeem("/api/v1", pat.RateLimitedTokenType); w.Code != http.StatusBadRequest || w.Body.String() != ErrTokenTypeNotDemanded.Error()+"\n" {
+		t.Fatalf("expected a rate-limited token to be refused, got %d %q", w.Code, w.Body.String())
+	}
+	if _, ok := outstandingChallenges(origin)[contextEnc]; !ok {
+		t.Fatal("expected the challenge to be left outstanding")
+	}
+	if w := redeem("/", pat.BasicPublicTokenType); w.Code != http.StatusBadRequest || w.Body.String() != ErrTokenTypeNotDemanded.Error()+"\n" {
+		t.Fatalf("expected a basic token for a rate-limited challenge to be refused, got %d %q", w.Code, w.Body.String())
+	}
+}
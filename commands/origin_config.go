@@ -0,0 +1,688 @@
+package commands
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/circl/oprf"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// configDuration is a time.Duration written as a Go duration string, e.g., "1h".
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(duration)
+	return nil
+}
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// OriginConfig declares one origin. Keys mirror the origin command flags,
+// and unset keys take the flag values. Requests are routed to the origin by
+// Host, matching its name with or without port, or any of Hosts.
+type OriginConfig struct {
+	Name                  string         `json:"name"`
+	Hosts                 []string       `json:"hosts,omitempty"`
+	Issuer                string         `json:"issuer"`
+	Issuers               []string       `json:"issuers,omitempty"`
+	IssuerRoutes          []string       `json:"issuer-routes,omitempty"`
+	OriginInfo            []string       `json:"origin-info,omitempty"`
+	Cert                  string         `json:"cert,omitempty"`
+	Key                   string         `json:"key,omitempty"`
+	AdminToken            string         `json:"admin-token,omitempty"`
+	RedemptionHook        string         `json:"redemption-hook,omitempty"`
+	ChallengeRules        string         `json:"challenge-rules,omitempty"`
+	Verification          string         `json:"verification,omitempty"`
+	VerificationCacheTTL  configDuration `json:"verification-cache-ttl,omitempty"`
+	VerificationFailure   string         `json:"verification-failure,omitempty"`
+	VerificationBundleKey string         `json:"verification-bundle-key,omitempty"`
+	VerificationWorkers   int            `json:"verification-workers,omitempty"`
+	EpochChallengeKey     string         `json:"epoch-challenge-key,omitempty"`
+	EpochLength           configDuration `json:"epoch-length,omitempty"`
+	ChallengeSigningKey   string         `json:"challenge-signing-key,omitempty"`
+	Compress              *bool          `json:"compress,omitempty"`
+	MaxContextChallenges  int            `json:"max-challenges-per-context,omitempty"`
+	RedemptionCacheTTL    configDuration `json:"redemption-cache-ttl,omitempty"`
+	FailedTokenCacheTTL   configDuration `json:"failed-token-cache-ttl,omitempty"`
+	NonceLength           int            `json:"nonce-length,omitempty"`
+	NonceSource           string         `json:"nonce-source,omitempty"`
+	UnknownAuthParams     string         `json:"unknown-auth-params,omitempty"`
+	ClockSkew             configDuration `json:"clock-skew,omitempty"`
+	ChallengeStore        string         `json:"challenge-store,omitempty"`
+	ChallengeTTL          configDuration `json:"challenge-ttl,omitempty"`
+	SpentTokenStore       string         `json:"spent-token-store,omitempty"`
+	SpentTokenRetention   configDuration `json:"spent-token-retention,omitempty"`
+	DirectoryPath         string         `json:"directory-path,omitempty"`
+	DirectoryCacheTTL     configDuration `json:"directory-cache-ttl,omitempty"`
+	OutageFallback        []string       `json:"outage-fallback,omitempty"`
+	OutageStaleThreshold  configDuration `json:"outage-stale-threshold,omitempty"`
+	EarlyHints            *bool          `json:"early-hints,omitempty"`
+	PrivateTokenKey       string         `json:"private-token-key,omitempty"`
+	UserAgent             string         `json:"user-agent,omitempty"`
+	IssuerHeaders         []string       `json:"issuer-headers,omitempty"`
+	IssuerH2C             *bool          `json:"issuer-h2c,omitempty"`
+	CORSOrigins           []string       `json:"cors-origins,omitempty"`
+	RedirectAttester      string         `json:"redirect-attester,omitempty"`
+	ServeDir              string         `json:"serve-dir,omitempty"`
+	ProxyUpstream         string         `json:"proxy-upstream,omitempty"`
+	SimulateFault         []string       `json:"simulate-fault,omitempty"`
+	FaultProbability      float64        `json:"fault-probability,omitempty"`
+}
+
+// OriginsConfig declares the origins of the configuration file.
+type OriginsConfig struct {
+	Origins []OriginConfig `json:"origins"`
+}
+
+func originConfigFromFlags(c *cli.Context) OriginConfig {
+	compress := c.BoolT("compress")
+	earlyHints := c.Bool("early-hints")
+	issuerH2C := c.Bool("issuer-h2c")
+	// The first --issuer is the primary issuer, the others are challenged
+	// for in turn with it
+	var issuer string
+	var issuers []string
+	if names := c.StringSlice("issuer"); len(names) > 0 {
+		issuer, issuers = names[0], names[1:]
+	}
+	return OriginConfig{
+		Name:                  c.String("name"),
+		Issuer:                issuer,
+		Issuers:               issuers,
+		IssuerRoutes:          c.StringSlice("issuer-route"),
+		OriginInfo:            c.StringSlice("origin-info"),
+		AdminToken:            c.String("admin-token"),
+		RedemptionHook:        c.String("redemption-hook"),
+		ChallengeRules:        c.String("challenge-rules"),
+		Verification:          c.String("verification"),
+		VerificationCacheTTL:  configDuration(c.Duration("verification-cache-ttl")),
+		VerificationFailure:   c.String("verification-failure"),
+		VerificationBundleKey: c.String("verification-bundle-key"),
+		VerificationWorkers:   c.Int("verification-workers"),
+		EpochChallengeKey:     c.String("epoch-challenge-key"),
+		EpochLength:           configDuration(c.Duration("epoch-length")),
+		ChallengeSigningKey:   c.String("challenge-signing-key"),
+		Compress:              &compress,
+		MaxContextChallenges:  c.Int("max-challenges-per-context"),
+		RedemptionCacheTTL:    configDuration(c.Duration("redemption-cache-ttl")),
+		FailedTokenCacheTTL:   configDuration(c.Duration("failed-token-cache-ttl")),
+		NonceLength:           c.Int("nonce-length"),
+		NonceSource:           c.String("nonce-source"),
+		UnknownAuthParams:     c.String("unknown-auth-params"),
+		ClockSkew:             configDuration(c.Duration("clock-skew")),
+		ChallengeStore:        c.String("challenge-store"),
+		ChallengeTTL:          configDuration(c.Duration("challenge-ttl")),
+		SpentTokenStore:       c.String("spent-token-store"),
+		SpentTokenRetention:   configDuration(c.Duration("spent-token-retention")),
+		DirectoryPath:         c.String("directory-path"),
+		DirectoryCacheTTL:     configDuration(c.Duration("directory-cache-ttl")),
+		OutageFallback:        c.StringSlice("outage-fallback"),
+		OutageStaleThreshold:  configDuration(c.Duration("outage-stale-threshold")),
+		EarlyHints:            &earlyHints,
+		PrivateTokenKey:       c.String("private-token-key"),
+		UserAgent:             c.String("user-agent"),
+		IssuerHeaders:         c.StringSlice("issuer-header"),
+		IssuerH2C:             &issuerH2C,
+		CORSOrigins:           c.StringSlice("cors-origin"),
+		RedirectAttester:      c.String("redirect-attester"),
+		ServeDir:              c.String("serve-dir"),
+		ProxyUpstream:         c.String("proxy-upstream"),
+		SimulateFault:         c.StringSlice("simulate-fault"),
+		FaultProbability:      c.Float64("fault-probability"),
+	}
+}
+
+// withDefaults fills the unset keys of the configuration from defaults.
+// Names, hosts, and TLS key pairs are never inherited, and issuers only if
+// the origin sets none.
+func (cfg OriginConfig) withDefaults(defaults OriginConfig) OriginConfig {
+	if cfg.Issuer == "" && len(cfg.Issuers) == 0 {
+		cfg.Issuer = defaults.Issuer
+		cfg.Issuers = defaults.Issuers
+		if cfg.IssuerRoutes == nil {
+			cfg.IssuerRoutes = defaults.IssuerRoutes
+		}
+	}
+	if cfg.Issuer == "" && len(cfg.Issuers) > 0 {
+		cfg.Issuer, cfg.Issuers = cfg.Issuers[0], cfg.Issuers[1:]
+	}
+	if cfg.OriginInfo == nil {
+		cfg.OriginInfo = defaults.OriginInfo
+	}
+	if cfg.AdminToken == "" {
+		cfg.AdminToken = defaults.AdminToken
+	}
+	if cfg.RedemptionHook == "" {
+		cfg.RedemptionHook = defaults.RedemptionHook
+	}
+	if cfg.ChallengeRules == "" {
+		cfg.ChallengeRules = defaults.ChallengeRules
+	}
+	if cfg.Verification == "" {
+		cfg.Verification = defaults.Verification
+	}
+	if cfg.VerificationCacheTTL == 0 {
+		cfg.VerificationCacheTTL = defaults.VerificationCacheTTL
+	}
+	if cfg.VerificationFailure == "" {
+		cfg.VerificationFailure = defaults.VerificationFailure
+	}
+	if cfg.VerificationBundleKey == "" {
+		cfg.VerificationBundleKey = defaults.VerificationBundleKey
+	}
+	if cfg.EpochChallengeKey == "" {
+		cfg.EpochChallengeKey = defaults.EpochChallengeKey
+	}
+	if cfg.EpochLength == 0 {
+		cfg.EpochLength = defaults.EpochLength
+	}
+	if cfg.ChallengeSigningKey == "" {
+		cfg.ChallengeSigningKey = defaults.ChallengeSigningKey
+	}
+	if cfg.Compress == nil {
+		cfg.Compress = defaults.Compress
+	}
+	if cfg.MaxContextChallenges == 0 {
+		cfg.MaxContextChallenges = defaults.MaxContextChallenges
+	}
+	if cfg.VerificationWorkers == 0 {
+		cfg.VerificationWorkers = defaults.VerificationWorkers
+	}
+	if cfg.RedemptionCacheTTL == 0 {
+		cfg.RedemptionCacheTTL = defaults.RedemptionCacheTTL
+	}
+	if cfg.FailedTokenCacheTTL == 0 {
+		cfg.FailedTokenCacheTTL = defaults.FailedTokenCacheTTL
+	}
+	if cfg.NonceLength == 0 {
+		cfg.NonceLength = defaults.NonceLength
+	}
+	if cfg.NonceSource == "" {
+		cfg.NonceSource = defaults.NonceSource
+	}
+	if cfg.UnknownAuthParams == "" {
+		cfg.UnknownAuthParams = defaults.UnknownAuthParams
+	}
+	if cfg.ClockSkew == 0 {
+		cfg.ClockSkew = defaults.ClockSkew
+	}
+	if cfg.ChallengeStore == "" {
+		cfg.ChallengeStore = defaults.ChallengeStore
+	}
+	if cfg.ChallengeTTL == 0 {
+		cfg.ChallengeTTL = defaults.ChallengeTTL
+	}
+	if cfg.SpentTokenStore == "" {
+		cfg.SpentTokenStore = defaults.SpentTokenStore
+	}
+	if cfg.SpentTokenRetention == 0 {
+		cfg.SpentTokenRetention = defaults.SpentTokenRetention
+	}
+	if cfg.DirectoryPath == "" {
+		cfg.DirectoryPath = defaults.DirectoryPath
+	}
+	if cfg.DirectoryCacheTTL == 0 {
+		cfg.DirectoryCacheTTL = defaults.DirectoryCacheTTL
+	}
+	if cfg.OutageFallback == nil {
+		cfg.OutageFallback = defaults.OutageFallback
+	}
+	if cfg.OutageStaleThreshold == 0 {
+		cfg.OutageStaleThreshold = defaults.OutageStaleThreshold
+	}
+	if cfg.EarlyHints == nil {
+		cfg.EarlyHints = defaults.EarlyHints
+	}
+	if cfg.PrivateTokenKey == "" {
+		cfg.PrivateTokenKey = defaults.PrivateTokenKey
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = defaults.UserAgent
+	}
+	if cfg.IssuerHeaders == nil {
+		cfg.IssuerHeaders = defaults.IssuerHeaders
+	}
+	if cfg.IssuerH2C == nil {
+		cfg.IssuerH2C = defaults.IssuerH2C
+	}
+	if cfg.CORSOrigins == nil {
+		cfg.CORSOrigins = defaults.CORSOrigins
+	}
+	if cfg.RedirectAttester == "" {
+		cfg.RedirectAttester = defaults.RedirectAttester
+	}
+	if cfg.ServeDir == "" && cfg.ProxyUpstream == "" {
+		cfg.ServeDir, cfg.ProxyUpstream = defaults.ServeDir, defaults.ProxyUpstream
+	}
+	if cfg.SimulateFault == nil {
+		cfg.SimulateFault = defaults.SimulateFault
+	}
+	if cfg.FaultProbability == 0 {
+		cfg.FaultProbability = defaults.FaultProbability
+	}
+	return cfg
+}
+
+func (cfg OriginConfig) validate() error {
+	if cfg.Name == "" {
+		return fmt.Errorf("Invalid origin name")
+	}
+	if cfg.Issuer == "" {
+		return fmt.Errorf("Invalid issuer for origin %s", cfg.Name)
+	}
+	if _, err := parseIssuerRoutes(cfg.IssuerRoutes, cfg.issuerNames()); err != nil {
+		return fmt.Errorf("%w for origin %s", err, cfg.Name)
+	}
+	if cfg.VerificationBundleKey != "" && len(cfg.issuerNames()) > 1 {
+		return fmt.Errorf("Origin %s cannot verify bundles of several issuers", cfg.Name)
+	}
+	if cfg.Verification != verificationModeLocal && cfg.Verification != verificationModeRemote {
+		return fmt.Errorf("Invalid verification mode %q for origin %s", cfg.Verification, cfg.Name)
+	}
+	if cfg.MaxContextChallenges < 0 {
+		return fmt.Errorf("Invalid max challenges per context for origin %s", cfg.Name)
+	}
+	if cfg.VerificationWorkers < 0 {
+		return fmt.Errorf("Invalid verification workers for origin %s", cfg.Name)
+	}
+	switch cfg.UnknownAuthParams {
+	case "", unknownAuthParamsIgnore, unknownAuthParamsReject:
+	default:
+		return fmt.Errorf("Invalid unknown auth params action %q for origin %s", cfg.UnknownAuthParams, cfg.Name)
+	}
+	if cfg.NonceLength < 0 || cfg.NonceLength > maxChallengeNonceLength {
+		return fmt.Errorf("Invalid nonce length for origin %s, expected at most %d bytes", cfg.Name, maxChallengeNonceLength)
+	}
+	if cfg.ClockSkew < 0 {
+		return fmt.Errorf("Invalid clock skew for origin %s", cfg.Name)
+	}
+	if cfg.ChallengeSigningKey != "" {
+		key, err := hex.DecodeString(cfg.ChallengeSigningKey)
+		if err == nil {
+			_, err = newChallengeSigner(key)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid challenge signing key for origin %s: %w", cfg.Name, err)
+		}
+	}
+	if cfg.ChallengeTTL < 0 {
+		return fmt.Errorf("Invalid challenge TTL for origin %s", cfg.Name)
+	}
+	if _, err := storeKind(cfg.ChallengeStore); err != nil {
+		return fmt.Errorf("%w for origin %s", err, cfg.Name)
+	}
+	if cfg.SpentTokenRetention < 0 {
+		return fmt.Errorf("Invalid spent token retention for origin %s", cfg.Name)
+	}
+	if _, err := storeKind(cfg.SpentTokenStore); err != nil {
+		return fmt.Errorf("%w for origin %s", err, cfg.Name)
+	}
+	if cfg.DirectoryPath != "" && (!strings.HasPrefix(cfg.DirectoryPath, "/") || strings.HasPrefix(cfg.DirectoryPath, adminURIPrefix)) {
+		return fmt.Errorf("Invalid directory path %q for origin %s", cfg.DirectoryPath, cfg.Name)
+	}
+	if cfg.DirectoryCacheTTL < 0 {
+		return fmt.Errorf("Invalid directory cache TTL for origin %s", cfg.Name)
+	}
+	switch cfg.VerificationFailure {
+	case "", verificationFailureDeny, verificationFailureAllow:
+	default:
+		return fmt.Errorf("Invalid verification failure policy %q for origin %s", cfg.VerificationFailure, cfg.Name)
+	}
+	if _, err := parseOutagePolicy(cfg.OutageFallback, cfg.VerificationFailure, time.Duration(cfg.OutageStaleThreshold)); err != nil {
+		return fmt.Errorf("%w for origin %s", err, cfg.Name)
+	}
+	if cfg.VerificationBundleKey != "" {
+		if _, err := parseEd25519PublicKey(cfg.VerificationBundleKey); err != nil {
+			return fmt.Errorf("Invalid verification bundle key for origin %s: %w", cfg.Name, err)
+		}
+	}
+	if (cfg.Cert == "") != (cfg.Key == "") {
+		return fmt.Errorf("Origin %s needs both cert and key", cfg.Name)
+	}
+	if _, err := parseIssuerHeaders(cfg.UserAgent, cfg.IssuerHeaders); err != nil {
+		return fmt.Errorf("%w for origin %s", err, cfg.Name)
+	}
+	if _, err := parseCORSOrigins(cfg.CORSOrigins); err != nil {
+		return fmt.Errorf("%w for origin %s", err, cfg.Name)
+	}
+	if strings.ContainsAny(cfg.RedirectAttester, "/ ") {
+		return fmt.Errorf("Invalid redirect attester %q for origin %s, expected a host", cfg.RedirectAttester, cfg.Name)
+	}
+	if cfg.ServeDir != "" && cfg.ProxyUpstream != "" {
+		return fmt.Errorf("Invalid content backend for origin %s, either serve-dir or proxy-upstream may be set", cfg.Name)
+	}
+	if cfg.ProxyUpstream != "" {
+		if _, err := parseProxyUpstream(cfg.ProxyUpstream); err != nil {
+			return fmt.Errorf("%w for origin %s", err, cfg.Name)
+		}
+	}
+	if _, err := parseOriginFaults(cfg.SimulateFault, cfg.FaultProbability); err != nil {
+		return fmt.Errorf("%w for origin %s", err, cfg.Name)
+	}
+	return nil
+}
+
+// issuerNames returns the issuers of the origin, the primary one first.
+func (cfg OriginConfig) issuerNames() []string {
+	names := []string{cfg.Issuer}
+	for _, name := range cfg.Issuers {
+		known := false
+		for _, other := range names {
+			known = known || name == other
+		}
+		if !known && name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// issuerClient returns the client of requests to the issuer, sending the
+// configured User-Agent and headers, over h2c if configured. The
+// configuration is validated.
+func (cfg OriginConfig) issuerClient() *http.Client {
+	header, _ := parseIssuerHeaders(cfg.UserAgent, cfg.IssuerHeaders)
+	return withLocalRoles(withIssuerHeaders(newHTTPClient(false, cfg.issuerH2C()), header))
+}
+
+func (cfg OriginConfig) issuerH2C() bool {
+	return cfg.IssuerH2C != nil && *cfg.IssuerH2C
+}
+
+// issuerClientID tells apart origins sending different headers to issuers,
+// or speaking h2c to them, which cannot share issuer clients.
+func (cfg OriginConfig) issuerClientID() string {
+	return fmt.Sprintf("%s\n%s\n%t", cfg.UserAgent, strings.Join(cfg.IssuerHeaders, "\n"), cfg.issuerH2C())
+}
+
+// hostNames returns the Host values routed to the origin.
+func (cfg OriginConfig) hostNames() []string {
+	names := []string{cfg.Name}
+	if host, _, err := net.SplitHostPort(cfg.Name); err == nil {
+		names = append(names, host)
+	}
+	names = append(names, cfg.Hosts...)
+	for i := range names {
+		names[i] = strings.ToLower(names[i])
+	}
+	return names
+}
+
+func readOriginsConfig(fileName string, defaults OriginConfig) (*OriginsConfig, error) {
+	fileConfig, err := readCommandConfig(fileName)
+	if err != nil {
+		return nil, err
+	}
+	config := &OriginsConfig{Origins: fileConfig.Origins}
+	if len(config.Origins) == 0 {
+		return nil, fmt.Errorf("No origins configured")
+	}
+
+	hosts := make(map[string]string)
+	for i := range config.Origins {
+		config.Origins[i] = config.Origins[i].withDefaults(defaults)
+		if err := config.Origins[i].validate(); err != nil {
+			return nil, err
+		}
+		for _, host := range config.Origins[i].hostNames() {
+			if other, ok := hosts[host]; ok && other != config.Origins[i].Name {
+				return nil, fmt.Errorf("Host %s routed to both %s and %s", host, other, config.Origins[i].Name)
+			}
+			hosts[host] = config.Origins[i].Name
+		}
+	}
+	return config, nil
+}
+
+// newOrigin sets up an origin from its configuration, using the given keys of
+// each of its issuers in order and opening its challenge store from stores.
+func newOrigin(cfg OriginConfig, issuerKeys []*issuerKeySource, stores *stateStores) (*Origin, error) {
+	var hook *redemptionHook
+	var err error
+	if cfg.RedemptionHook != "" {
+		hook, err = loadRedemptionHook(cfg.RedemptionHook)
+		if err != nil {
+			return nil, fmt.Errorf("Failed loading redemption hook: %w", err)
+		}
+	}
+
+	var rules *challengeRules
+	if cfg.ChallengeRules != "" {
+		rules, err = readChallengeRules(cfg.ChallengeRules)
+		if err != nil {
+			return nil, fmt.Errorf("Failed loading challenge rules: %w", err)
+		}
+	}
+
+	names := cfg.issuerNames()
+	if len(issuerKeys) != len(names) {
+		return nil, fmt.Errorf("Expected keys of %d issuers, got %d", len(names), len(issuerKeys))
+	}
+	issuers := make([]originIssuer, len(names))
+	for i, name := range names {
+		issuers[i] = originIssuer{name: name, keys: issuerKeys[i]}
+		if cfg.Verification != verificationModeRemote {
+			continue
+		}
+		verificationURI := issuerKeys[i].current().verificationURI
+		if verificationURI == "" {
+			verificationURI = tokenVerificationURI
+		}
+		verificationURI, err = composeURL(name, verificationURI)
+		if err != nil {
+			return nil, err
+		}
+		// The outage policy applies the verification failure policy, so the
+		// verifier reports failures
+		issuers[i].remoteVerifier, err = newRemoteVerifier(cfg.issuerClient(), verificationURI, time.Duration(cfg.VerificationCacheTTL), verificationFailureDeny)
+		if err != nil {
+			return nil, err
+		}
+	}
+	routes, err := parseIssuerRoutes(cfg.IssuerRoutes, names)
+	if err != nil {
+		return nil, err
+	}
+	// A single issuer is the primary one alone
+	primary := issuers[0]
+	if len(issuers) == 1 {
+		issuers = nil
+	}
+
+	var privateTokenKey *oprf.PrivateKey
+	if cfg.PrivateTokenKey != "" {
+		privateTokenKey, err = loadPrivateTokenKey(cfg.PrivateTokenKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	outage, err := parseOutagePolicy(cfg.OutageFallback, cfg.VerificationFailure, time.Duration(cfg.OutageStaleThreshold))
+	if err != nil {
+		return nil, err
+	}
+
+	var challenger *epochChallenger
+	if cfg.EpochChallengeKey != "" {
+		key, err := hex.DecodeString(cfg.EpochChallengeKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid epoch challenge key: %w", err)
+		}
+		challenger, err = newEpochChallenger(key, time.Duration(cfg.EpochLength))
+		if err != nil {
+			return nil, err
+		}
+		challenger.skew = time.Duration(cfg.ClockSkew)
+	}
+
+	var signer *challengeSigner
+	if cfg.ChallengeSigningKey != "" {
+		key, err := hex.DecodeString(cfg.ChallengeSigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid challenge signing key: %w", err)
+		}
+		signer, err = newChallengeSigner(key)
+		if err != nil {
+			return nil, err
+		}
+		signer.skew = time.Duration(cfg.ClockSkew)
+	}
+
+	nonceSource, err := newNonceSource(cfg.NonceSource)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.NonceSource != "" && cfg.NonceSource != nonceSourceSystem {
+		log.Warnln("Origin", cfg.Name, "draws challenge nonces from", cfg.NonceSource)
+	}
+
+	cors, err := parseCORSOrigins(cfg.CORSOrigins)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := newContentBackend(cfg.ServeDir, cfg.ProxyUpstream)
+	if err != nil {
+		return nil, err
+	}
+
+	faults, err := parseOriginFaults(cfg.SimulateFault, cfg.FaultProbability)
+	if err != nil {
+		return nil, err
+	}
+	if faults != nil {
+		log.Warnln("Origin", cfg.Name, "deliberately sends broken challenges for client testing, simulating", faults)
+	}
+
+	challenges, err := stores.openChallenges(cfg.ChallengeStore, cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+	spentTokens, err := stores.openSpentTokens(cfg.SpentTokenStore, cfg.Name)
+	if err != nil {
+		return nil, err
+	}
+	if (challenger != nil || signer != nil) && isLocalStore(cfg.SpentTokenStore) {
+		log.Warnln("Origin", cfg.Name, "keeps the spent tokens of epoch or signed challenges per replica, so each replica admits a token once; share a Redis --spent-token-store across replicas")
+	}
+
+	// Account for challenges outstanding since before a restart
+	outstanding, err := challenges.list(time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading challenge store: %w", err)
+	}
+	for _, outstanding := range outstanding {
+		trackContextChange(contextChange{outstanding.challenge.TokenType, 0, outstanding.count})
+	}
+
+	return &Origin{
+		issuerName:           cfg.Issuer,
+		originName:           cfg.Name,
+		additionalOriginInfo: cfg.OriginInfo,
+		issuerKeys:           primary.keys,
+		issuers:              issuers,
+		issuerRoutes:         routes,
+		redemptionHook:       hook,
+		remoteVerifier:       primary.remoteVerifier,
+		epochChallenger:      challenger,
+		challengeSigner:      signer,
+		compressResources:    cfg.Compress == nil || *cfg.Compress,
+		content:              content,
+		redemptions:          newRedemptionCache(time.Duration(cfg.RedemptionCacheTTL)),
+		failedTokens:         newFailedTokenCache(time.Duration(cfg.FailedTokenCacheTTL)),
+		nonceLength:          cfg.NonceLength,
+		nonceSource:          nonceSource,
+		unknownAuthParams:    cfg.UnknownAuthParams,
+		challenges:           challenges,
+		challengeTTL:         time.Duration(cfg.ChallengeTTL),
+		maxContextChallenges: cfg.MaxContextChallenges,
+		revokedContexts:      make(map[string]bool),
+		challengeLock:        sync.Mutex{},
+		spentTokens:          spentTokens,
+		tokenRetention:       time.Duration(cfg.SpentTokenRetention),
+		directoryPath:        cfg.DirectoryPath,
+		outage:               outage,
+		earlyHints:           cfg.EarlyHints != nil && *cfg.EarlyHints,
+		privateTokenKey:      privateTokenKey,
+		cors:                 cors,
+		tokenTypes:           newTokenTypeToggle(),
+		challengeRules:       rules,
+		stats:                newOriginStats(time.Now()),
+		verificationWorkers:  cfg.VerificationWorkers,
+		redirectAttester:     cfg.RedirectAttester,
+		redirectClient:       http.DefaultClient,
+		faults:               faults,
+	}, nil
+}
+
+// handler serves the origin, including its admin API if a token is set.
+func (o *Origin) handler(adminToken string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", o.handleRequest)
+	if o.redirectAttester != "" {
+		mux.HandleFunc(challengePagePath, o.handleChallengePage)
+	}
+	if o.directoryPath != "" && o.directory != nil {
+		mux.HandleFunc(o.directoryPath, o.handleDirectoryRequest)
+	}
+	if adminToken != "" {
+		mux.Handle(adminURIPrefix, o.newAdminServer(adminToken))
+	}
+	return mux
+}
+
+// originRouter dispatches requests to origins by Host. The fallback, if any,
+// serves requests for unknown hosts.
+type originRouter struct {
+	byHost   map[string]http.Handler
+	fallback http.Handler
+}
+
+func newOriginRouter() *originRouter {
+	return &originRouter{
+		byHost: make(map[string]http.Handler),
+	}
+}
+
+func (r *originRouter) add(cfg OriginConfig, handler http.Handler) {
+	for _, host := range cfg.hostNames() {
+		r.byHost[host] = handler
+	}
+}
+
+func (r *originRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := strings.ToLower(req.Host)
+	handler, ok := r.byHost[host]
+	if !ok {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			handler, ok = r.byHost[hostname]
+		}
+	}
+	if !ok {
+		handler = r.fallback
+	}
+	if handler == nil {
+		log.Debugln("No origin configured for host", req.Host)
+		http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+		return
+	}
+	handler.ServeHTTP(w, req)
+}
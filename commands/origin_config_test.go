@@ -0,0 +1,115 @@
+package commands
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestOriginsConfig(t *testing.T, config string) string {
+	fileName := filepath.Join(t.TempDir(), "origins.json")
+	if err := ioutil.WriteFile(fileName, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestReadOriginsConfig(t *testing.T) {
+	compress := true
+	defaults := OriginConfig{
+		Issuer:               "issuer.example",
+		Verification:         verificationModeLocal,
+		VerificationCacheTTL: configDuration(time.Minute),
+		Compress:             &compress,
+	}
+	fileName := writeTestOriginsConfig(t, `{
+		"origins": [
+			{"name": "a.example:4567", "origin-info": ["b.example"]},
+			{"name": "c.example", "hosts": ["www.c.example"], "issuer": "other-issuer.example",
+			 "verification": "remote", "verification-cache-ttl": "5s", "compress": false}
+		]
+	}`)
+
+	config, err := readOriginsConfig(fileName, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Origins) != 2 {
+		t.Fatalf("expected 2 origins, got %d", len(config.Origins))
+	}
+	a, c := config.Origins[0], config.Origins[1]
+	if a.Issuer != "issuer.example" || a.Verification != verificationModeLocal || !*a.Compress ||
+		len(a.OriginInfo) != 1 || a.OriginInfo[0] != "b.example" {
+		t.Fatalf("unexpected defaults %+v", a)
+	}
+	if c.Issuer != "other-issuer.example" || c.Verification != verificationModeRemote ||
+		time.Duration(c.VerificationCacheTTL) != 5*time.Second || *c.Compress {
+		t.Fatalf("unexpected overrides %+v", c)
+	}
+	hosts := a.hostNames()
+	if len(hosts) != 2 || hosts[0] != "a.example:4567" || hosts[1] != "a.example" {
+		t.Fatalf("unexpected hosts %v", hosts)
+	}
+}
+
+func TestReadOriginsConfigInvalid(t *testing.T) {
+	defaults := OriginConfig{Issuer: "issuer.example", Verification: verificationModeLocal}
+	for _, config := range []string{
+		`{"origins": []}`,
+		`{"origins": [{"issuer": "issuer.example"}]}`,
+		`{"origins": [{"name": "a.example", "verification": "nowhere"}]}`,
+		`{"origins": [{"name": "a.example", "cert": "a.pem"}]}`,
+		`{"origins": [{"name": "a.example", "epoch-length": 3600}]}`,
+		`{"origins": [{"name": "a.example"}, {"name": "b.example", "hosts": ["a.example"]}]}`,
+	} {
+		if _, err := readOriginsConfig(writeTestOriginsConfig(t, config), defaults); err == nil {
+			t.Fatalf("expected %s to be rejected", config)
+		}
+	}
+}
+
+func TestOriginRouter(t *testing.T) {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(name))
+		})
+	}
+	router := newOriginRouter()
+	router.add(OriginConfig{Name: "a.example:4567"}, named("a"))
+	router.add(OriginConfig{Name: "b.example", Hosts: []string{"www.b.example"}}, named("b"))
+
+	for host, expected := range map[string]string{
+		"a.example:4567":    "a",
+		"A.example":         "a",
+		"b.example:443":     "b",
+		"www.b.example":     "b",
+		"unknown.example":   "",
+		"a.example.example": "",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if expected == "" {
+			if rec.Code != http.StatusMisdirectedRequest {
+				t.Fatalf("expected %s to be misdirected, got %d", host, rec.Code)
+			}
+			continue
+		}
+		if rec.Body.String() != expected {
+			t.Fatalf("expected %s to be routed to %s, got %q", host, expected, rec.Body.String())
+		}
+	}
+
+	router.fallback = named("a")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "unknown.example"
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Body.String() != "a" {
+		t.Fatal("expected unknown hosts to use the fallback")
+	}
+}
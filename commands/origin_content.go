@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parseProxyUpstream reads the base URL of the upstream protected resources
+// are proxied to.
+func parseProxyUpstream(upstream string) (*url.URL, error) {
+	parsed, err := url.Parse(upstream)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy upstream %q, expected http[s]://host[:port][/path]", upstream)
+	}
+	return parsed, nil
+}
+
+// newContentBackend returns what serves protected resources once their token
+// verified: the files under serveDir, or proxyUpstream, or nil for the test
+// resource if neither is set.
+func newContentBackend(serveDir, proxyUpstream string) (http.Handler, error) {
+	switch {
+	case serveDir != "" && proxyUpstream != "":
+		return nil, fmt.Errorf("Invalid content backend, either serve-dir or proxy-upstream may be set")
+	case serveDir != "":
+		info, err := os.Stat(serveDir)
+		if err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("Invalid serve-dir %q, expected a directory", serveDir)
+		}
+		return http.FileServer(http.Dir(serveDir)), nil
+	case proxyUpstream != "":
+		upstream, err := parseProxyUpstream(proxyUpstream)
+		if err != nil {
+			return nil, err
+		}
+		return newUpstreamProxy(upstream), nil
+	}
+	return nil, nil
+}
+
+// newUpstreamProxy relays requests to the upstream with their method, path
+// under the upstream path, query, headers, and body. The PrivateToken
+// credentials are the origin's, so the Authorization header is not relayed.
+func newUpstreamProxy(upstream *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstream)
+			r.SetXForwarded()
+			r.Out.Header.Del("Authorization")
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Warnln("Failed proxying", req.URL.Path, "to", upstream.Host+":", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+}
+
+// serveContent serves the protected resource of a request whose token
+// verified.
+func (o *Origin) serveContent(w http.ResponseWriter, req *http.Request) {
+	if o.content != nil {
+		o.content.ServeHTTP(w, req)
+		return
+	}
+	serveResource(w, req, http.DefaultClient, testResource, o.compressResources)
+}
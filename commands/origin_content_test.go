@@ -0,0 +1,127 @@
+package commands
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+// redeemingRequest returns a request carrying a basic token for a fresh
+// challenge of the origin.
+func redeemingRequest(t *testing.T, origin *Origin, issuer *Issuer, method, target string, body io.Reader) *http.Request {
+	challenge, _, err := origin.CreateChallenge(httptest.NewRequest(http.MethodGet, "https://origin.example/?type=2", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	challengeEnc, _ := base64.URLEncoding.DecodeString(challenge)
+	tokenChallenge, err := pat.UnmarshalTokenChallenge(challengeEnc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := createTestToken(t, issuer, tokenChallenge.Marshal())
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+	return req
+}
+
+func TestNewContentBackend(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file.txt")
+	if err := ioutil.WriteFile(file, []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if backend, err := newContentBackend("", ""); err != nil || backend != nil {
+		t.Fatalf("expected no backend, got %v, %v", backend, err)
+	}
+	for _, backend := range [][2]string{
+		{dir, "https://upstream.example"},
+		{file, ""},
+		{filepath.Join(dir, "missing"), ""},
+		{"", "upstream.example"},
+		{"", "ftp://upstream.example"},
+	} {
+		if _, err := newContentBackend(backend[0], backend[1]); err == nil {
+			t.Fatalf("expected %q to be refused", backend)
+		}
+	}
+}
+
+func TestOriginServeDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "docs"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "docs", "page.txt"), []byte("local content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	issuer := newTestIssuer(t, "issuer.example")
+	origin := newMultiIssuerOrigin(t, issuer)
+	var err error
+	if origin.content, err = newContentBackend(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	origin.handleRequest(rec, redeemingRequest(t, origin, issuer, http.MethodGet, "https://origin.example/docs/page.txt", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "local content" {
+		t.Fatalf("expected the local file, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	origin.handleRequest(rec, redeemingRequest(t, origin, issuer, http.MethodGet, "https://origin.example/docs/missing.txt", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing file, got %d", rec.Code)
+	}
+
+	// Files are still protected
+	rec = httptest.NewRecorder()
+	origin.handleRequest(rec, httptest.NewRequest(http.MethodGet, "https://origin.example/docs/page.txt", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a challenge, got %d", rec.Code)
+	}
+}
+
+func TestOriginProxyUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get("Authorization") != "" {
+			http.Error(w, "credentials relayed", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Upstream", "1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(strings.Join([]string{req.Method, req.URL.RequestURI(), req.Header.Get("X-Custom"), req.Header.Get("X-Forwarded-Host"), string(body)}, " ")))
+	}))
+	defer upstream.Close()
+
+	issuer := newTestIssuer(t, "issuer.example")
+	origin := newMultiIssuerOrigin(t, issuer)
+	var err error
+	if origin.content, err = newContentBackend("", upstream.URL+"/base"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := redeemingRequest(t, origin, issuer, http.MethodPost, "https://origin.example/api/items?page=2", strings.NewReader("payload"))
+	req.Header.Set("X-Custom", "value")
+	rec := httptest.NewRecorder()
+	origin.handleRequest(rec, req)
+	expected := "POST /base/api/items?page=2 value origin.example payload"
+	if rec.Code != http.StatusCreated || rec.Header().Get("X-Upstream") != "1" || rec.Body.String() != expected {
+		t.Fatalf("expected the upstream response, got %d: %q", rec.Code, rec.Body.String())
+	}
+
+	upstream.Close()
+	rec = httptest.NewRecorder()
+	origin.handleRequest(rec, redeemingRequest(t, origin, issuer, http.MethodGet, "https://origin.example/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 without upstream, got %d", rec.Code)
+	}
+}
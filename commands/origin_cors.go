@@ -0,0 +1,110 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// Methods of protected resources
+	originAllowedMethods = "GET, HEAD, OPTIONS"
+
+	// Any origin may make cross-origin requests
+	corsAnyOrigin = "*"
+
+	// Outcomes of OPTIONS requests, as metric labels
+	preflightAllowed = "allowed"
+	preflightRefused = "refused"
+	preflightNone    = "not-preflight"
+)
+
+// Request headers cross-origin clients may send, and response headers they
+// may read
+var (
+	corsAllowedHeaders = []string{
+		"Authorization",
+		headerTokenAttributeNoninteractive,
+		headerTokenAttributeCrossOrigin,
+		headerTokenAttributeChallengeCount,
+		headerTokenType,
+	}
+	corsExposedHeaders = []string{"WWW-Authenticate", headerTokenLimit}
+)
+
+// corsPolicy lets browsers on other sites fetch protected resources,
+// answering preflights and reading challenges. A nil policy allows none.
+type corsPolicy struct {
+	anyOrigin bool
+	origins   map[string]bool
+}
+
+// parseCORSOrigins reads the origins allowed to make cross-origin requests,
+// as scheme://host[:port] or * for any.
+func parseCORSOrigins(origins []string) (*corsPolicy, error) {
+	if len(origins) == 0 {
+		return nil, nil
+	}
+	policy := &corsPolicy{origins: make(map[string]bool)}
+	for _, origin := range origins {
+		if origin == corsAnyOrigin {
+			policy.anyOrigin = true
+			continue
+		}
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" || (parsed.Path != "" && parsed.Path != "/") {
+			return nil, fmt.Errorf("Invalid CORS origin %q, expected scheme://host[:port] or *", origin)
+		}
+		policy.origins[strings.ToLower(parsed.Scheme+"://"+parsed.Host)] = true
+	}
+	return policy, nil
+}
+
+// allow sets the CORS headers of the response if the request comes from an
+// allowed origin, reporting whether it does.
+func (p *corsPolicy) allow(w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if p == nil || origin == "" {
+		return false
+	}
+	header := w.Header()
+	if !p.anyOrigin {
+		// Responses differ by origin, so caches keep them apart
+		header.Add("Vary", "Origin")
+		if !p.origins[strings.ToLower(origin)] {
+			return false
+		}
+		header.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		header.Set("Access-Control-Allow-Origin", corsAnyOrigin)
+	}
+	header.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+	return true
+}
+
+// isPreflight tells whether the request is a CORS preflight.
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handleOptions answers OPTIONS requests without asking for a token, since
+// browsers send preflights without credentials.
+func (o *Origin) handleOptions(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Allow", originAllowedMethods)
+	if !isPreflight(req) {
+		originPreflights.Inc(0, preflightNone)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !o.cors.allow(w, req) {
+		originPreflights.Inc(0, preflightRefused)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	originPreflights.Inc(0, preflightAllowed)
+	w.Header().Set("Access-Control-Allow-Methods", originAllowedMethods)
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+}
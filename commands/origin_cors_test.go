@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestParseCORSOrigins(t *testing.T) {
+	policy, err := parseCORSOrigins(nil)
+	if err != nil || policy != nil {
+		t.Fatalf("expected no policy by default, got %v: %v", policy, err)
+	}
+	policy, err = parseCORSOrigins([]string{"https://App.example", "http://localhost:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !policy.origins["https://app.example"] || !policy.origins["http://localhost:8080"] || policy.anyOrigin {
+		t.Fatalf("unexpected policy %+v", policy)
+	}
+	for _, origin := range []string{"app.example", "https://app.example/path", "://"} {
+		if _, err := parseCORSOrigins([]string{origin}); err == nil {
+			t.Fatalf("expected %q to be refused", origin)
+		}
+	}
+}
+
+func TestOriginOptions(t *testing.T) {
+	origin := newMultiIssuerOrigin(t, newTestIssuer(t, "issuer.example"))
+	origin.cors, _ = parseCORSOrigins([]string{"https://app.example"})
+
+	options := func(from string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "https://origin.example/", nil)
+		if from != "" {
+			req.Header.Set("Origin", from)
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			req.Header.Set("Access-Control-Request-Headers", "authorization")
+		}
+		rec := httptest.NewRecorder()
+		origin.handleRequest(rec, req)
+		return rec
+	}
+
+	// Preflights are answered without a challenge
+	rec := options("https://app.example")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("WWW-Authenticate") != "" {
+		t.Fatalf("expected the preflight to be answered before auth, got %d", rec.Code)
+	}
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example" || rec.Header().Get("Access-Control-Allow-Methods") != originAllowedMethods {
+		t.Fatalf("unexpected preflight headers %v", rec.Header())
+	}
+	if len(outstandingChallenges(origin)) != 0 {
+		t.Fatal("expected no challenge for a preflight")
+	}
+
+	rec = options("https://other.example")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected the preflight of another origin to be refused, got %v", rec.Header())
+	}
+	rec = options("")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Allow") != originAllowedMethods {
+		t.Fatalf("unexpected OPTIONS response %d %v", rec.Code, rec.Header())
+	}
+
+	// Challenges can be read by allowed origins
+	req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	req.Header.Set("Origin", "https://app.example")
+	rec = httptest.NewRecorder()
+	origin.handleRequest(rec, req)
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("Access-Control-Expose-Headers") == "" {
+		t.Fatalf("expected the challenge to be exposed, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestOriginHead(t *testing.T) {
+	methods := make(chan string, 1)
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		methods <- req.Method
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("resource"))
+	}))
+	defer resource.Close()
+	defer func(original string) { testResource = original }(testResource)
+	testResource = resource.URL
+
+	issuer := newTestIssuer(t, "issuer.example")
+	origin := newMultiIssuerOrigin(t, issuer)
+
+	// Challenges come without a body
+	rec := httptest.NewRecorder()
+	origin.handleRequest(rec, httptest.NewRequest(http.MethodHead, "https://origin.example/?type=2", nil))
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" || rec.Body.Len() != 0 {
+		t.Fatalf("expected a challenge without body, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	challenges, err := parseClientChallenges(rec.Header().Get("WWW-Authenticate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := pat.UnmarshalTokenChallenge(challenges[0].blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := createTestToken(t, issuer, challenge.Marshal())
+	req := httptest.NewRequest(http.MethodHead, "https://origin.example/", nil)
+	req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+	rec = httptest.NewRecorder()
+	origin.handleRequest(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "text/plain" {
+		t.Fatalf("expected the resource headers without body, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if method := <-methods; method != http.MethodHead {
+		t.Fatalf("expected the resource to be fetched with HEAD, got %s", method)
+	}
+}
@@ -0,0 +1,228 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var ErrNoEnrollmentAPI = errors.New("Issuer does not expose an enrollment API")
+
+// originEnrollment is what enrolling an origin with an issuer found: the
+// configuration stanza of the origin, and the token types it can challenge
+// for with the keys of the issuer.
+type originEnrollment struct {
+	config     OriginConfig
+	tokenTypes []uint16
+	registered bool
+}
+
+// enrollmentIssuer accepts the issuer as host[:port] or as an https URL.
+func enrollmentIssuer(issuer string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(issuer, "https://"), "/")
+}
+
+// verifyEnrollment loads the keys of the issuer the way the origin will when
+// it starts, verifying the verification bundle if a key is pinned, and
+// returns the token types the origin can challenge for.
+func verifyEnrollment(httpClient *http.Client, cfg OriginConfig) ([]uint16, error) {
+	// Refreshed once, so without an interval
+	keySource := newIssuerKeySource(httpClient, cfg.Issuer, 0)
+	if cfg.VerificationBundleKey != "" {
+		bundleKey, err := parseEd25519PublicKey(cfg.VerificationBundleKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid verification bundle key: %w", err)
+		}
+		keySource.bundleKey = bundleKey
+	}
+	if err := keySource.refresh(); err != nil {
+		return nil, err
+	}
+	keys := keySource.current()
+
+	var tokenTypes []uint16
+	if keys.rateLimitedTokenKey != nil {
+		tokenTypes = append(tokenTypes, pat.RateLimitedTokenType)
+	}
+	if keys.basicValidationKey != nil {
+		tokenTypes = append(tokenTypes, pat.BasicPublicTokenType)
+	}
+	if len(tokenTypes) == 0 {
+		return nil, fmt.Errorf("No basic or rate-limited token key from %s", cfg.Issuer)
+	}
+	if keys.privateTokenKeyEnc != nil {
+		log.Infoln("Issuer", cfg.Issuer, "offers private tokens, which the origin needs the issuer's --private-token-key to verify")
+	}
+	if keys.ed25519TokenKey != nil {
+		tokenTypes = append(tokenTypes, ed25519TokenType)
+	}
+	return tokenTypes, nil
+}
+
+// registerOrigin adds the origin to the issuer's policy through its admin API,
+// so that the issuer issues rate-limited tokens for it.
+func registerOrigin(httpClient *http.Client, adminTarget string, origin string, authorize func(req *http.Request) error) error {
+	updateURI, err := adminURL(adminTarget, adminPolicyUpdateURI)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(issuerPolicyUpdate{AddOrigins: []string{origin}})
+	req, err := http.NewRequest(http.MethodPost, updateURI, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := authorize(req); err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNoEnrollmentAPI
+	default:
+		return fmt.Errorf("Origin registration failed with error %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	var policy issuerPolicy
+	if err := json.Unmarshal(respBody, &policy); err != nil {
+		return fmt.Errorf("Invalid issuer policy: %w", err)
+	}
+	for _, registered := range policy.Origins {
+		if registered == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("Issuer policy does not list %s after registration", origin)
+}
+
+// writeOriginStanza adds the origin to the origins of the configuration file,
+// replacing the origin of the same name if any, and creating the file if it
+// does not exist. The file is written back as JSON, which YAML readers read
+// too. It returns whether an origin was replaced.
+func writeOriginStanza(fileName string, stanza OriginConfig) (bool, error) {
+	config := &CommandConfig{}
+	if _, err := os.Stat(fileName); err == nil {
+		if config, err = readCommandConfig(fileName); err != nil {
+			return false, fmt.Errorf("Invalid configuration file %s: %w", fileName, err)
+		}
+	}
+	replaced := false
+	for i := range config.Origins {
+		if config.Origins[i].Name == stanza.Name {
+			config.Origins[i], replaced = stanza, true
+		}
+	}
+	if !replaced {
+		config.Origins = append(config.Origins, stanza)
+	}
+	configEnc, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	return replaced, ioutil.WriteFile(fileName, append(configEnc, '\n'), 0600)
+}
+
+// enrollOrigin verifies the issuer's keys, registers the origin with the
+// issuer if authorize is set, and returns the configuration of the origin.
+func enrollOrigin(httpClient *http.Client, cfg OriginConfig, adminTarget string, authorize func(req *http.Request) error) (originEnrollment, error) {
+	enrollment := originEnrollment{config: cfg}
+	var err error
+	if enrollment.tokenTypes, err = verifyEnrollment(httpClient, cfg); err != nil {
+		return enrollment, fmt.Errorf("Failed verifying issuer keys: %w", err)
+	}
+	if authorize == nil {
+		return enrollment, nil
+	}
+	if err := registerOrigin(httpClient, adminTarget, cfg.Name, authorize); err != nil {
+		return enrollment, err
+	}
+	enrollment.registered = true
+	return enrollment, nil
+}
+
+func runOriginEnroll(c *cli.Context) error {
+	cfg := OriginConfig{
+		Name:                  c.String("name"),
+		Issuer:                enrollmentIssuer(c.String("issuer")),
+		OriginInfo:            c.StringSlice("origin-info"),
+		VerificationBundleKey: c.String("verification-bundle-key"),
+	}
+	outFile := c.String("out")
+	adminTarget := c.String("issuer-admin")
+	timeout := c.Duration("timeout")
+
+	if cfg.Issuer == "" {
+		log.Fatal("Invalid issuer. See README for running instructions.")
+	}
+	if cfg.Name == "" {
+		log.Fatal("Invalid origin name. See README for running instructions.")
+	}
+	if timeout <= 0 {
+		log.Fatal("Invalid timeout. See README for running instructions.")
+	}
+	hmacKeys, err := parseAdminHMACKeys(c.StringSlice("admin-hmac-key"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(hmacKeys) > 1 {
+		log.Fatal("Invalid admin HMAC key, expected a single key. See README for running instructions.")
+	}
+	var authorize func(req *http.Request) error
+	for keyID, key := range hmacKeys {
+		keyID, key := keyID, key
+		authorize = func(req *http.Request) error {
+			return signAdminRequest(req, keyID, key, time.Now())
+		}
+	}
+	if adminTarget == "" {
+		adminTarget = cfg.Issuer
+	}
+
+	httpClient := cfg.issuerClient()
+	httpClient.Timeout = timeout
+	enrollment, err := enrollOrigin(httpClient, cfg, adminTarget, authorize)
+	if errors.Is(err, ErrNoEnrollmentAPI) {
+		log.Warnln(err.Error()+", add", cfg.Name, "to the issuer's --origins to issue rate-limited tokens for it")
+	} else if err != nil {
+		return err
+	}
+	tokenTypes := make([]string, len(enrollment.tokenTypes))
+	for i, tokenType := range enrollment.tokenTypes {
+		tokenTypes[i] = formatTokenType(tokenType)
+	}
+	log.Infoln("Verified keys of", cfg.Issuer, "for token types", strings.Join(tokenTypes, ", "))
+	if enrollment.registered {
+		log.Infoln("Registered", cfg.Name, "with", adminTarget)
+	}
+
+	if outFile == "" {
+		stanzaEnc, _ := json.MarshalIndent(enrollment.config, "", "  ")
+		fmt.Println(string(stanzaEnc))
+		return nil
+	}
+	replaced, err := writeOriginStanza(outFile, enrollment.config)
+	if err != nil {
+		return err
+	}
+	if replaced {
+		fmt.Printf("Replaced %s in %s\n", cfg.Name, outFile)
+	} else {
+		fmt.Printf("Added %s to %s\n", cfg.Name, outFile)
+	}
+	return nil
+}
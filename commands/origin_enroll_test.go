@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestOriginEnroll(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	mux := http.NewServeMux()
+	mux.HandleFunc(issuerConfigURI, issuer.handleConfigRequest)
+	mux.HandleFunc(issuerEncapKeyURI, issuer.handleNameKeyRequest)
+	authenticator := hmacAuthenticator(map[string][]byte{"ops": testAdminHMACKey}, defaultAdminHMACSkew)
+	mux.Handle(adminURIPrefix, issuer.newAdminServer([]adminAuthenticator{authenticator}, nil))
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	issuer.name = enrollmentIssuer(server.URL + "/")
+	authorize := func(req *http.Request) error {
+		return signAdminRequest(req, "ops", testAdminHMACKey, time.Now())
+	}
+
+	cfg := OriginConfig{Name: "origin.example:4568", Issuer: issuer.name}
+	enrollment, err := enrollOrigin(server.Client(), cfg, issuer.name, authorize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enrollment.tokenTypes) != 2 || enrollment.tokenTypes[0] != pat.RateLimitedTokenType || !enrollment.registered {
+		t.Fatalf("unexpected enrollment %+v", enrollment)
+	}
+	if issuer.rateLimitedIssuer.OriginIndexKey(cfg.Name) == nil {
+		t.Fatal("expected the issuer to issue for the origin")
+	}
+
+	// Wrong keys and pinned bundle keys the issuer does not sign with fail
+	// enrollment
+	other := func(req *http.Request) error {
+		return signAdminRequest(req, "ops", make([]byte, len(testAdminHMACKey)), time.Now())
+	}
+	if _, err := enrollOrigin(server.Client(), cfg, issuer.name, other); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected registration to be refused, got %v", err)
+	}
+	pinned := cfg
+	pinned.VerificationBundleKey = strings.Repeat("00", 32)
+	if _, err := enrollOrigin(server.Client(), pinned, issuer.name, nil); err == nil {
+		t.Fatal("expected the missing verification bundle to fail")
+	}
+
+	// Issuers without an admin API still get the origin written
+	bare := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, adminURIPrefix) {
+			http.NotFound(w, req)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	}))
+	defer bare.Close()
+	enrollment, err = enrollOrigin(bare.Client(), OriginConfig{Name: "origin.example:4568", Issuer: enrollmentIssuer(bare.URL)}, enrollmentIssuer(bare.URL), authorize)
+	if err != ErrNoEnrollmentAPI || len(enrollment.tokenTypes) != 2 {
+		t.Fatalf("expected keys to be verified without an enrollment API, got %v", err)
+	}
+}
+
+func TestWriteOriginStanza(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "origins.json")
+	for _, stanza := range []OriginConfig{
+		{Name: "origin-a.example:4568", Issuer: "issuer.example:4567"},
+		{Name: "origin-b.example:4568", Issuer: "issuer.example:4567"},
+	} {
+		if replaced, err := writeOriginStanza(fileName, stanza); err != nil || replaced {
+			t.Fatalf("expected %s to be added, got %v", stanza.Name, err)
+		}
+	}
+	replaced, err := writeOriginStanza(fileName, OriginConfig{Name: "origin-a.example:4568", Issuer: "other.example:4567"})
+	if err != nil || !replaced {
+		t.Fatalf("expected the origin to be replaced, got %v", err)
+	}
+
+	config, err := readCommandConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Origins) != 2 || config.Origins[0].Issuer != "other.example:4567" || config.Origins[1].Name != "origin-b.example:4568" {
+		t.Fatalf("unexpected origins %+v", config.Origins)
+	}
+}
@@ -0,0 +1,118 @@
+package commands
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/pat-app/httpauth"
+)
+
+const (
+	// Broken challenges the origin sends for client testing, as metric labels
+	originFaultMalformedChallenge = "malformed-challenge"
+	originFaultWrongTokenKey      = "wrong-token-key"
+	originFaultBogusMaxAge        = "bogus-max-age"
+)
+
+var originFaultNames = []string{
+	originFaultMalformedChallenge,
+	originFaultWrongTokenKey,
+	originFaultBogusMaxAge,
+}
+
+// Max-age values clients should not take at face value
+var bogusMaxAges = []string{"-1", "0", "99999999999999999999", "soon", "1.5", ""}
+
+// originFaults break the challenges of an origin on purpose, so that client
+// implementations can be tested against a broken origin:
+//
+//   - malformed-challenge: the challenge is truncated, so that it does not
+//     decode as a TokenChallenge.
+//   - wrong-token-key: a bit of the token key is flipped. The key still
+//     parses, but signatures of the issuer do not verify under it.
+//   - bogus-max-age: max-age is negative, zero, overflowing, or not a number.
+//
+// Each enabled fault is injected into a challenge with the probability. A nil
+// set injects none.
+type originFaults struct {
+	faults      map[string]bool
+	probability float64
+
+	lock   sync.Mutex
+	random *mathrand.Rand
+}
+
+func parseOriginFaults(names []string, probability float64) (*originFaults, error) {
+	if probability < 0 || probability > 1 {
+		return nil, fmt.Errorf("Invalid fault probability %v, expected at most 1", probability)
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	faults := make(map[string]bool)
+	for _, name := range names {
+		known := false
+		for _, fault := range originFaultNames {
+			known = known || name == fault
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown origin fault %q", name)
+		}
+		faults[name] = true
+	}
+	return &originFaults{
+		faults:      faults,
+		probability: probability,
+		random:      mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// String lists the faults for logs.
+func (f *originFaults) String() string {
+	names := make([]string, 0, len(f.faults))
+	for name := range f.faults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%v with probability %v", names, f.probability)
+}
+
+// inject tells whether the fault is injected into this challenge, and counts
+// it if so.
+func (f *originFaults) inject(fault string, tokenType uint16) bool {
+	if f == nil || !f.faults[fault] {
+		return false
+	}
+	f.lock.Lock()
+	injected := f.random.Float64() < f.probability
+	f.lock.Unlock()
+	if injected {
+		originFaultsInjected.Inc(tokenType, fault)
+	}
+	return injected
+}
+
+// apply returns the challenge sent to the client, broken by the faults
+// injected into it.
+func (f *originFaults) apply(challenge httpauth.Challenge, tokenType uint16) httpauth.Challenge {
+	if f.inject(originFaultMalformedChallenge, tokenType) {
+		challenge.TokenChallenge = challenge.TokenChallenge[:len(challenge.TokenChallenge)/2]
+	}
+	if len(challenge.TokenKey) >= 6 && f.inject(originFaultWrongTokenKey, tokenType) {
+		// The encoding ends with the modulus followed by the exponent, 65537
+		tokenKey := append([]byte{}, challenge.TokenKey...)
+		tokenKey[len(tokenKey)-6] ^= 0x02
+		challenge.TokenKey = tokenKey
+	}
+	if f.inject(originFaultBogusMaxAge, tokenType) {
+		f.lock.Lock()
+		maxAge := bogusMaxAges[f.random.Intn(len(bogusMaxAges))]
+		f.lock.Unlock()
+		challenge.MaxAge = nil
+		challenge.Params = append(challenge.Params, httpauth.Param{Name: httpauth.ParamMaxAge, Value: maxAge})
+	}
+	return challenge
+}
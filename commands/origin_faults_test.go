@@ -0,0 +1,114 @@
+package commands
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/cloudflare/pat-app/httpauth"
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestParseOriginFaults(t *testing.T) {
+	faults, err := parseOriginFaults(nil, 1)
+	if err != nil || faults != nil {
+		t.Fatalf("expected no faults by default, got %v: %v", faults, err)
+	}
+	faults, err = parseOriginFaults([]string{originFaultBogusMaxAge, originFaultMalformedChallenge}, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if faults.String() != "[bogus-max-age malformed-challenge] with probability 0.5" {
+		t.Fatalf("unexpected faults %s", faults)
+	}
+	if _, err := parseOriginFaults([]string{"drop-blind"}, 1); err == nil {
+		t.Fatal("expected unknown faults to be refused")
+	}
+	if _, err := parseOriginFaults([]string{originFaultBogusMaxAge}, 1.5); err == nil {
+		t.Fatal("expected probabilities above 1 to be refused")
+	}
+}
+
+func challengeAttribute(t *testing.T, authValue, key string) string {
+	challenges, err := httpauth.Parse(authValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == httpauth.ParamMaxAge && challenges[0].MaxAge != nil {
+		return strconv.Itoa(*challenges[0].MaxAge)
+	}
+	value, ok := challenges[0].Param(key)
+	if !ok {
+		t.Fatalf("missing %s in %s", key, authValue)
+	}
+	return value
+}
+
+func TestOriginFaults(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	keys := &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey()}
+	basicKeyEnc, _ := marshalTokenKey(issuer.basicIssuer.TokenKey(), false)
+	keys.parseTokenKey(int(pat.BasicPublicTokenType), basicKeyEnc)
+	origin := newTestOrigin()
+	origin.issuerKeys = &issuerKeySource{keys: keys}
+
+	challenge := func() string {
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/?type=2", nil)
+		rec := httptest.NewRecorder()
+		origin.handleRequest(rec, req)
+		return rec.Header().Get("WWW-Authenticate")
+	}
+
+	// Without faults, challenges are well-formed
+	challenges, err := parseClientChallenges(challenge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pat.UnmarshalTokenChallenge(challenges[0].blob); err != nil {
+		t.Fatal(err)
+	}
+
+	injected := originFaultsInjected.Value(pat.BasicPublicTokenType, originFaultWrongTokenKey)
+	origin.faults, err = parseOriginFaults(originFaultNames, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authValue := challenge()
+	challenges, err = parseClientChallenges(authValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pat.UnmarshalTokenChallenge(challenges[0].blob); err == nil {
+		t.Fatal("expected a malformed challenge")
+	}
+	tokenKey, err := pat.UnmarshalTokenKey(challenges[0].tokenKeyEnc)
+	if err != nil {
+		t.Fatal("expected the wrong token key to parse:", err)
+	}
+	if bytes.Equal(challenges[0].tokenKeyEnc, basicKeyEnc) || equalRSAKeys(tokenKey, issuer.basicIssuer.TokenKey()) {
+		t.Fatal("expected a wrong token key")
+	}
+	maxAge := challengeAttribute(t, authValue, httpauth.ParamMaxAge)
+	bogus := false
+	for _, value := range bogusMaxAges {
+		bogus = bogus || maxAge == value
+	}
+	if !bogus {
+		t.Fatalf("expected a bogus max-age, got %q", maxAge)
+	}
+	if originFaultsInjected.Value(pat.BasicPublicTokenType, originFaultWrongTokenKey) != injected+1 {
+		t.Fatal("expected the fault to be counted")
+	}
+
+	// Faults are never injected with probability 0
+	origin.faults.probability = 0
+	challenges, err = parseClientChallenges(challenge())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(challenges[0].tokenKeyEnc, basicKeyEnc) {
+		t.Fatal("expected no fault to be injected")
+	}
+}
@@ -0,0 +1,106 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// originIssuer is an issuer an origin challenges for, with the keys tokens
+// it issued are verified with.
+type originIssuer struct {
+	name           string
+	keys           *issuerKeySource
+	remoteVerifier *remoteVerifier // verifies tokens at the issuer if set
+}
+
+// issuerRoute sends the challenges for paths under a prefix to an issuer.
+type issuerRoute struct {
+	prefix string
+	issuer string
+}
+
+// parseIssuerRoutes reads routes written as <path prefix>=<issuer>, each to
+// one of the issuers of the origin.
+func parseIssuerRoutes(routes []string, issuers []string) ([]issuerRoute, error) {
+	parsed := make([]issuerRoute, 0, len(routes))
+	for _, route := range routes {
+		prefix, issuer, ok := strings.Cut(route, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("Invalid issuer route %q, expected <path prefix>=<issuer>", route)
+		}
+		known := false
+		for _, name := range issuers {
+			known = known || name == issuer
+		}
+		if !known {
+			return nil, fmt.Errorf("Invalid issuer route %q, %s is not an issuer of the origin", route, issuer)
+		}
+		parsed = append(parsed, issuerRoute{prefix, issuer})
+	}
+	sort.SliceStable(parsed, func(i, j int) bool {
+		return len(parsed[i].prefix) > len(parsed[j].prefix)
+	})
+	return parsed, nil
+}
+
+// challengeIssuers returns the issuers of the origin, the primary one first.
+func (o *Origin) challengeIssuers() []originIssuer {
+	if len(o.issuers) > 0 {
+		return o.issuers
+	}
+	return []originIssuer{{name: o.issuerName, keys: o.issuerKeys, remoteVerifier: o.remoteVerifier}}
+}
+
+// issuerByName returns the issuer of the origin with the name, which
+// challenges carry.
+func (o *Origin) issuerByName(name string) (originIssuer, bool) {
+	for _, issuer := range o.challengeIssuers() {
+		if issuer.name == name {
+			return issuer, true
+		}
+	}
+	return originIssuer{}, false
+}
+
+// offersRequestedType reports whether the issuer offers the token type the
+// client asked for or the request's rule demands, if any.
+func (o *Origin) offersRequestedType(req *http.Request, issuer originIssuer) bool {
+	requested, ok := o.demandedTokenType(req)
+	if !ok {
+		return true
+	}
+	tokenType, _ := o.challengeTokenType(req, issuer.keys.current())
+	return tokenType == requested
+}
+
+// selectIssuer returns the issuer to challenge for: the issuer the path is
+// routed to, or else the issuers offering the requested token type in turn.
+// If none offers it, all issuers take turns.
+func (o *Origin) selectIssuer(req *http.Request) originIssuer {
+	issuers := o.challengeIssuers()
+	if len(issuers) == 1 {
+		return issuers[0]
+	}
+	for _, route := range o.issuerRoutes {
+		if strings.HasPrefix(req.URL.Path, route.prefix) {
+			if issuer, ok := o.issuerByName(route.issuer); ok {
+				return issuer
+			}
+		}
+	}
+
+	candidates := make([]originIssuer, 0, len(issuers))
+	for _, issuer := range issuers {
+		if o.offersRequestedType(req, issuer) {
+			candidates = append(candidates, issuer)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = issuers
+	}
+	turn := atomic.AddUint32(&o.issuerTurn, 1) - 1
+	return candidates[turn%uint32(len(candidates))]
+}
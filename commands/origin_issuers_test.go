@@ -0,0 +1,133 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestParseIssuerRoutes(t *testing.T) {
+	issuers := []string{"issuer.example", "other.example"}
+	routes, err := parseIssuerRoutes([]string{"/api=issuer.example", "/api/private=other.example"}, issuers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[0].prefix != "/api/private" || routes[0].issuer != "other.example" {
+		t.Fatalf("expected the longest prefix first, got %v", routes)
+	}
+	for _, route := range []string{"/api", "api=issuer.example", "/api=unknown.example"} {
+		if _, err := parseIssuerRoutes([]string{route}, issuers); err == nil {
+			t.Fatalf("expected %q to be refused", route)
+		}
+	}
+}
+
+func TestOriginIssuerConfig(t *testing.T) {
+	cfg := OriginConfig{Name: "origin.example", Issuers: []string{"issuer.example", "other.example", "issuer.example"}, Verification: verificationModeLocal}
+	cfg = cfg.withDefaults(OriginConfig{Issuer: "default.example"})
+	if names := cfg.issuerNames(); len(names) != 2 || names[0] != "issuer.example" || names[1] != "other.example" {
+		t.Fatalf("unexpected issuers %v", names)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.VerificationBundleKey = "key"
+	if err := cfg.validate(); err == nil {
+		t.Fatal("expected a bundle key for several issuers to be refused")
+	}
+}
+
+// newMultiIssuerOrigin returns an origin challenging for both issuers.
+func newMultiIssuerOrigin(t *testing.T, issuers ...*Issuer) *Origin {
+	origin := newTestOrigin()
+	for _, issuer := range issuers {
+		keys := &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey()}
+		basicKeyEnc, _ := marshalTokenKey(issuer.basicIssuer.TokenKey(), false)
+		keys.parseTokenKey(int(pat.BasicPublicTokenType), basicKeyEnc)
+		origin.issuers = append(origin.issuers, originIssuer{name: issuer.name, keys: &issuerKeySource{keys: keys}})
+	}
+	origin.issuerName, origin.issuerKeys = origin.issuers[0].name, origin.issuers[0].keys
+	return origin
+}
+
+func TestOriginSelectIssuer(t *testing.T) {
+	origin := newMultiIssuerOrigin(t, newTestIssuer(t, "issuer.example"), newTestIssuer(t, "other.example"))
+
+	// Issuers take turns
+	for i := 0; i < 4; i++ {
+		origin.CreateChallenge(httptest.NewRequest(http.MethodGet, "https://origin.example/?type=2", nil))
+	}
+	challenged := make(map[string]int)
+	for _, outstanding := range outstandingChallenges(origin) {
+		challenged[outstanding.challenge.IssuerName] += outstanding.count
+	}
+	if challenged["issuer.example"] != 2 || challenged["other.example"] != 2 {
+		t.Fatalf("expected issuers to take turns, got %v", challenged)
+	}
+
+	// Routed paths are challenged for their issuer only
+	var err error
+	origin.issuerRoutes, err = parseIssuerRoutes([]string{"/private=other.example"}, []string{"issuer.example", "other.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/private/page", nil)
+		if issuer := origin.selectIssuer(req); issuer.name != "other.example" {
+			t.Fatalf("expected the routed issuer, got %s", issuer.name)
+		}
+	}
+
+	// Challenging for several issuers lets clients preconnect to each
+	origin.issuerRoutes = nil
+	origin.earlyHints = true
+	req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	req.Header.Set(headerTokenAttributeChallengeCount, "2")
+	rec := httptest.NewRecorder()
+	origin.handleRequest(rec, req)
+	if links := rec.Header().Values("Link"); len(links) != 2 {
+		t.Fatalf("expected a preconnect link per issuer, got %v", links)
+	}
+}
+
+func TestOriginVerifiesAgainstChallengedIssuer(t *testing.T) {
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("resource"))
+	}))
+	defer resource.Close()
+	defer func(original string) { testResource = original }(testResource)
+	testResource = resource.URL
+
+	issuer, other := newTestIssuer(t, "issuer.example"), newTestIssuer(t, "other.example")
+	origin := newMultiIssuerOrigin(t, issuer, other)
+
+	redeem := func(tokenIssuer *Issuer, issuerName string) int {
+		challenge := pat.TokenChallenge{
+			TokenType:  pat.BasicPublicTokenType,
+			IssuerName: issuerName,
+			OriginInfo: []string{"origin.example"},
+		}
+		context := sha256.Sum256(challenge.Marshal())
+		origin.addChallenge(hex.EncodeToString(context[:]), challenge)
+		token := createTestToken(t, tokenIssuer, challenge.Marshal())
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+		req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+		w := httptest.NewRecorder()
+		origin.handleRequest(w, req)
+		return w.Code
+	}
+	if code := redeem(other, "other.example"); code != http.StatusOK {
+		t.Fatalf("expected the token of the second issuer to be admitted, got %d", code)
+	}
+	if code := redeem(issuer, "issuer.example"); code != http.StatusOK {
+		t.Fatalf("expected the token of the primary issuer to be admitted, got %d", code)
+	}
+	if code := redeem(issuer, "other.example"); code == http.StatusOK {
+		t.Fatal("expected a token signed by another issuer than challenged for to be refused")
+	}
+}
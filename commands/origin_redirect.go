@@ -0,0 +1,320 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Where browsers without PrivateToken support are sent for a token
+	challengePagePath = "/.well-known/private-token-challenge"
+
+	// Largest token request relayed for the challenge page
+	maxRelayedTokenRequest = 64 << 10
+
+	// Steps of the redirect flow, as metric labels
+	redirectStepRedirect = "redirect"
+	redirectStepPage     = "page"
+	redirectStepIssuance = "issuance"
+)
+
+// redirectsToChallengePage tells whether an unauthorized request is sent to
+// the challenge page rather than challenged: page loads of browsers, when the
+// origin has an attester to issue through. Browsers send Sec-Fetch-Mode with
+// navigations; older ones are recognized by asking for HTML. Requests from
+// the page itself, and requests for non-interactive tokens, are challenged as
+// usual.
+func (o *Origin) redirectsToChallengePage(req *http.Request) bool {
+	if o.redirectAttester == "" || req.Method != http.MethodGet || o.nonInteractive(req) {
+		return false
+	}
+	if mode := req.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// redirectToChallengePage sends the browser to the challenge page, which
+// returns it to the requested URL with a token.
+func (o *Origin) redirectToChallengePage(w http.ResponseWriter, req *http.Request) {
+	location := challengePagePath + "?" + url.Values{"return": {req.URL.RequestURI()}}.Encode()
+	originRedirects.Inc(0, redirectStepRedirect)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, req, location, http.StatusSeeOther)
+}
+
+// returnPath returns the path of the origin the challenge page returns to.
+// Other hosts are refused, so that the page is no open redirect.
+func returnPath(value string) (string, bool) {
+	if !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") || strings.HasPrefix(value, `/\`) {
+		return "", false
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" || parsed.Path == challengePagePath {
+		return "", false
+	}
+	return value, true
+}
+
+// handleChallengePage serves the challenge page on GET, and relays the token
+// requests of the page to the attester on POST.
+func (o *Origin) handleChallengePage(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		o.serveChallengePage(w, req)
+	case http.MethodPost:
+		o.relayPageIssuance(w, req)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// challengePageData is what the script of the challenge page needs to fetch a
+// basic token (type 0x0002) and retry the original request with it.
+type challengePageData struct {
+	Challenge  string `json:"challenge"`    // base64url TokenChallenge
+	TokenKeyID string `json:"token_key_id"` // hex
+	Modulus    string `json:"modulus"`      // hex
+	Exponent   int    `json:"exponent"`
+	Issuance   string `json:"issuance"` // where the page posts its token request
+	Return     string `json:"return"`
+}
+
+// serveChallengePage challenges for a basic token of the issuer the return
+// path would be challenged for, and renders the page answering it. Basic
+// tokens are the only ones a page can compute with WebCrypto and BigInt.
+func (o *Origin) serveChallengePage(w http.ResponseWriter, req *http.Request) {
+	path, ok := returnPath(req.URL.Query().Get("return"))
+	if !ok {
+		http.Error(w, "Invalid return path", http.StatusBadRequest)
+		return
+	}
+
+	// Challenge as for the return path, asking for a basic token
+	target := req.Clone(req.Context())
+	target.URL, _ = url.Parse(path)
+	target.Header = make(http.Header)
+	target.Header.Set(headerTokenType, strconv.Itoa(int(pat.BasicPublicTokenType)))
+	issuer := o.selectIssuer(target)
+	keys := issuer.keys.current()
+	if keys.basicValidationKey == nil {
+		log.Warnln("Issuer", issuer.name, "offers no basic tokens for the challenge page")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	challenge, err := o.createChallenge(target, issuer)
+	if err != nil {
+		log.Errorln("Failed creating challenge:", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	keyID := sha256.Sum256(challenge.TokenKey)
+
+	data := challengePageData{
+		Challenge:  base64.URLEncoding.EncodeToString(challenge.TokenChallenge),
+		TokenKeyID: hex.EncodeToString(keyID[:]),
+		Modulus:    keys.basicValidationKey.N.Text(16),
+		Exponent:   keys.basicValidationKey.E,
+		Issuance:   challengePagePath + "?" + url.Values{"issuer": {issuer.name}}.Encode(),
+		Return:     path,
+	}
+	originRedirects.Inc(pat.BasicPublicTokenType, redirectStepPage)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := challengePageTemplate.Execute(w, data); err != nil {
+		log.Errorln("Failed rendering challenge page:", err)
+	}
+}
+
+// relayPageIssuance forwards the basic token request of the challenge page to
+// the attester, for the issuer the page was challenged for, and returns the
+// token response.
+func (o *Origin) relayPageIssuance(w http.ResponseWriter, req *http.Request) {
+	issuer, ok := o.issuerByName(req.URL.Query().Get("issuer"))
+	if !ok {
+		http.Error(w, "Unknown issuer", http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get("Content-Type") != tokenRequestMediaType {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	requestBody, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRelayedTokenRequest))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tokenType, err := validateTokenRequest(requestBody); err != nil || tokenType != pat.BasicPublicTokenType {
+		http.Error(w, "Invalid basic TokenRequest", http.StatusBadRequest)
+		return
+	}
+
+	tokenRequestURI, err := composeURL(o.redirectAttester, attesterTokenRequestURI+"?"+url.Values{"issuer": {issuer.name}}.Encode())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	attesterReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, tokenRequestURI, bytes.NewReader(requestBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	attesterReq.Header.Set("Content-Type", tokenRequestMediaType)
+
+	client := o.redirectClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(attesterReq)
+	if err != nil {
+		log.Errorln("Failed relaying token request to attester:", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if err := checkTokenResponse(resp, tokenResponseMediaType); err != nil {
+		log.Debugln("Refusing attester response:", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	originRedirects.Inc(pat.BasicPublicTokenType, redirectStepIssuance)
+	w.Header().Set("Content-Type", tokenResponseMediaType)
+	w.Header().Set("Cache-Control", "no-store")
+	io.Copy(w, resp.Body)
+}
+
+// The challenge page blinds the token input with RSABSSA-SHA384-PSS as the
+// issuer expects, has the origin relay the request, finalizes the token, and
+// retries the original URL with it, showing the response in place.
+var challengePageTemplate = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Checking your browser</title>
+<script type="application/json" id="challenge-data">{{.}}</script>
+</head>
+<body>
+<p id="status">Fetching a Privacy Pass token&hellip;</p>
+<script>
+"use strict";
+const challengeData = JSON.parse(document.getElementById("challenge-data").textContent);
+
+const b64u = {
+  decode: (s) => Uint8Array.from(atob(s.replace(/-/g, "+").replace(/_/g, "/")), (c) => c.charCodeAt(0)),
+  encode: (b) => btoa(String.fromCharCode(...b)).replace(/\+/g, "-").replace(/\//g, "_"),
+};
+const hexBytes = (s, length) => {
+  s = s.padStart(length * 2, "0");
+  return Uint8Array.from(s.match(/../g), (h) => parseInt(h, 16));
+};
+const toBigInt = (b) => BigInt("0x" + (Array.from(b, (x) => x.toString(16).padStart(2, "0")).join("") || "0"));
+const concat = (...parts) => {
+  const out = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+  let offset = 0;
+  for (const p of parts) {
+    out.set(p, offset);
+    offset += p.length;
+  }
+  return out;
+};
+const sha = async (algorithm, data) => new Uint8Array(await crypto.subtle.digest(algorithm, data));
+const modPow = (base, exponent, modulus) => {
+  let result = 1n;
+  base %= modulus;
+  for (; exponent > 0n; exponent >>= 1n) {
+    if (exponent & 1n) result = (result * base) % modulus;
+    base = (base * base) % modulus;
+  }
+  return result;
+};
+const modInverse = (a, m) => {
+  let [r0, r1, s0, s1] = [m, a % m, 0n, 1n];
+  while (r1 !== 0n) {
+    const q = r0 / r1;
+    [r0, r1, s0, s1] = [r1, r0 - q * r1, s1, s0 - q * s1];
+  }
+  if (r0 !== 1n) return 0n;
+  return ((s0 % m) + m) % m;
+};
+
+// EMSA-PSS encoding with SHA-384, MGF1-SHA-384, and a 48-byte salt
+async function encodePSS(message, emBits) {
+  const hashLength = 48;
+  const emLength = Math.ceil(emBits / 8);
+  const salt = crypto.getRandomValues(new Uint8Array(hashLength));
+  const h = await sha("SHA-384", concat(new Uint8Array(8), await sha("SHA-384", message), salt));
+  const db = concat(new Uint8Array(emLength - 2 * hashLength - 2), [1], salt);
+  const mask = new Uint8Array(db.length);
+  for (let counter = 0, offset = 0; offset < mask.length; counter++, offset += hashLength) {
+    const block = await sha("SHA-384", concat(h, [counter >>> 24, (counter >>> 16) & 255, (counter >>> 8) & 255, counter & 255]));
+    mask.set(block.subarray(0, Math.min(hashLength, mask.length - offset)), offset);
+  }
+  for (let i = 0; i < db.length; i++) db[i] ^= mask[i];
+  db[0] &= 0xff >> (8 * emLength - emBits);
+  return concat(db, h, [0xbc]);
+}
+
+async function fetchToken(data) {
+  const n = BigInt("0x" + data.modulus);
+  const e = BigInt(data.exponent);
+  const modulusBits = n.toString(2).length;
+  const k = Math.ceil(modulusBits / 8);
+  const keyID = hexBytes(data.token_key_id, 32);
+
+  const context = await sha("SHA-256", b64u.decode(data.challenge));
+  const nonce = crypto.getRandomValues(new Uint8Array(32));
+  const tokenInput = concat([0, 2], nonce, context, keyID);
+  const m = toBigInt(await encodePSS(tokenInput, modulusBits - 1));
+
+  let r, rInverse = 0n;
+  while (rInverse === 0n) {
+    r = toBigInt(crypto.getRandomValues(new Uint8Array(k))) % n;
+    rInverse = modInverse(r, n);
+  }
+  const blinded = (m * modPow(r, e, n)) % n;
+  const request = concat([0, 2, keyID[0]], hexBytes(blinded.toString(16), k));
+
+  const response = await fetch(data.issuance, {
+    method: "POST",
+    headers: { "Content-Type": "message/token-request" },
+    body: request,
+  });
+  if (!response.ok) throw new Error("Issuance failed with status " + response.status);
+  const blindSignature = toBigInt(new Uint8Array(await response.arrayBuffer()));
+  const signature = (blindSignature * rInverse) % n;
+  if (modPow(signature, e, n) !== m) throw new Error("Invalid token signature");
+  return concat(tokenInput, hexBytes(signature.toString(16), k));
+}
+
+async function retry(data) {
+  const token = await fetchToken(data);
+  const response = await fetch(data.return, {
+    headers: { "Authorization": "PrivateToken token=" + b64u.encode(token) },
+  });
+  const body = await response.text();
+  history.replaceState(null, "", data.return);
+  document.open();
+  document.write(body);
+  document.close();
+}
+
+retry(challengeData).catch((err) => {
+  document.getElementById("status").textContent = "Could not fetch a token: " + err.message;
+});
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,187 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestOriginRedirectsBrowsers(t *testing.T) {
+	origin := newMultiIssuerOrigin(t, newTestIssuer(t, "issuer.example"))
+	handler := origin.handler("")
+	navigate := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/page?q=1", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Without an attester to issue through, browsers are challenged
+	if rec := navigate(map[string]string{"Sec-Fetch-Mode": "navigate"}); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a challenge, got %d", rec.Code)
+	}
+
+	origin.redirectAttester = "attester.example"
+	handler = origin.handler("")
+	for _, headers := range []map[string]string{
+		{"Sec-Fetch-Mode": "navigate"},
+		{"Accept": "text/html,application/xhtml+xml,*/*;q=0.8"},
+	} {
+		rec := navigate(headers)
+		if rec.Code != http.StatusSeeOther {
+			t.Fatalf("expected a redirect for %v, got %d", headers, rec.Code)
+		}
+		if location := rec.Header().Get("Location"); location != challengePagePath+"?return=%2Fpage%3Fq%3D1" {
+			t.Fatalf("unexpected location %q", location)
+		}
+	}
+	for _, headers := range []map[string]string{
+		{},
+		{"Sec-Fetch-Mode": "cors", "Accept": "text/html"},
+		{"Sec-Fetch-Mode": "navigate", headerTokenAttributeNoninteractive: "1"},
+	} {
+		if rec := navigate(headers); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected a challenge for %v, got %d", headers, rec.Code)
+		}
+	}
+}
+
+func TestChallengePageReturnPath(t *testing.T) {
+	origin := newMultiIssuerOrigin(t, newTestIssuer(t, "issuer.example"))
+	origin.redirectAttester = "attester.example"
+	handler := origin.handler("")
+	for _, path := range []string{"", "page", "//evil.example/", `/\evil.example`, "https://evil.example/", challengePagePath} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, challengePagePath+"?"+url.Values{"return": {path}}.Encode(), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected return path %q to be refused, got %d", path, rec.Code)
+		}
+	}
+	if len(outstandingChallenges(origin)) != 0 {
+		t.Fatal("expected no challenge for refused return paths")
+	}
+}
+
+// challengePageDataOf reads the data the challenge page embeds for its script.
+func challengePageDataOf(t *testing.T, page string) challengePageData {
+	const start = `<script type="application/json" id="challenge-data">`
+	i := strings.Index(page, start)
+	if i < 0 {
+		t.Fatal("challenge page without data")
+	}
+	encoded := page[i+len(start):]
+	encoded = encoded[:strings.Index(encoded, "</script>")]
+	var data challengePageData
+	if err := json.Unmarshal([]byte(encoded), &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestChallengePageIssuance(t *testing.T) {
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("resource"))
+	}))
+	defer resource.Close()
+	defer func(original string) { testResource = original }(testResource)
+	testResource = resource.URL
+
+	issuer := newTestIssuer(t, "issuer.example")
+	attester := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != attesterTokenRequestURI || req.URL.Query().Get("issuer") != "issuer.example" {
+			http.Error(w, "unexpected request", http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		var tokenRequest pat.BasicPublicTokenRequest
+		if !tokenRequest.Unmarshal(body) {
+			http.Error(w, "invalid token request", http.StatusBadRequest)
+			return
+		}
+		blindSignature, err := issuer.basicIssuer.Evaluate(&tokenRequest)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", tokenResponseMediaType)
+		w.Write(blindSignature)
+	}))
+	defer attester.Close()
+
+	origin := newMultiIssuerOrigin(t, issuer)
+	origin.redirectAttester = strings.TrimPrefix(attester.URL, "https://")
+	origin.redirectClient = attester.Client()
+	handler := origin.handler("")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, challengePagePath+"?return=%2Fpage", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("expected the challenge page, got %d", rec.Code)
+	}
+	data := challengePageDataOf(t, rec.Body.String())
+	if data.Return != "/page" {
+		t.Fatalf("unexpected return path %q", data.Return)
+	}
+
+	// Do what the script of the page does
+	challenge, err := base64.URLEncoding.DecodeString(data.Challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenChallenge, err := pat.UnmarshalTokenChallenge(challenge)
+	if err != nil || tokenChallenge.TokenType != pat.BasicPublicTokenType {
+		t.Fatalf("expected a basic token challenge, got %+v, %v", tokenChallenge, err)
+	}
+	keyID, _ := hex.DecodeString(data.TokenKeyID)
+	if data.Modulus != issuer.basicIssuer.TokenKey().N.Text(16) || data.Exponent != issuer.basicIssuer.TokenKey().E {
+		t.Fatal("unexpected token key")
+	}
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	state, err := pat.NewBasicPublicClient().CreateTokenRequest(challenge, nonce, keyID, issuer.basicIssuer.TokenKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Malformed requests are not relayed
+	req := httptest.NewRequest(http.MethodPost, data.Issuance, bytes.NewReader([]byte{0, 2, 1}))
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a malformed token request to be refused, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, data.Issuance, bytes.NewReader(state.Request().Marshal()))
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != tokenResponseMediaType {
+		t.Fatalf("expected a token response, got %d: %s", rec.Code, rec.Body.String())
+	}
+	token, err := state.FinalizeToken(rec.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "https://origin.example"+data.Return, nil)
+	req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "resource" {
+		t.Fatalf("expected the resource, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
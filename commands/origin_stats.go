@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// originStats counts the challenges and redemptions of one origin since it
+// started, for the admin API. Unlike the metrics, which are shared by every
+// origin of the process, they tell origins apart. A nil originStats counts
+// nothing.
+type originStats struct {
+	lock        sync.Mutex
+	since       time.Time
+	challenges  map[uint16]uint64
+	redemptions map[uint16]map[int]uint64 // by response status
+}
+
+func newOriginStats(now time.Time) *originStats {
+	return &originStats{
+		since:       now,
+		challenges:  make(map[uint16]uint64),
+		redemptions: make(map[uint16]map[int]uint64),
+	}
+}
+
+func (s *originStats) challenge(tokenType uint16) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.challenges[tokenType]++
+}
+
+func (s *originStats) redemption(tokenType uint16, status int) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.redemptions[tokenType] == nil {
+		s.redemptions[tokenType] = make(map[int]uint64)
+	}
+	s.redemptions[tokenType][status]++
+}
+
+// originStatsResponse holds the counts by token type, as 0x-prefixed hex, and
+// redemptions further by response status.
+type originStatsResponse struct {
+	Since       string                       `json:"since"`
+	Challenges  map[string]uint64            `json:"challenges"`
+	Redemptions map[string]map[string]uint64 `json:"redemptions"`
+	Admitted    uint64                       `json:"admitted"`
+	Refused     uint64                       `json:"refused"`
+}
+
+func formatTokenType(tokenType uint16) string {
+	return fmt.Sprintf("0x%04x", tokenType)
+}
+
+func (s *originStats) snapshot() originStatsResponse {
+	response := originStatsResponse{
+		Challenges:  make(map[string]uint64),
+		Redemptions: make(map[string]map[string]uint64),
+	}
+	if s == nil {
+		return response
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	response.Since = s.since.UTC().Format(time.RFC3339)
+	for tokenType, count := range s.challenges {
+		response.Challenges[formatTokenType(tokenType)] = count
+	}
+	for tokenType, byStatus := range s.redemptions {
+		counts := make(map[string]uint64)
+		for status, count := range byStatus {
+			counts[strconv.Itoa(status)] = count
+			if status < 300 {
+				response.Admitted += count
+			} else {
+				response.Refused += count
+			}
+		}
+		response.Redemptions[formatTokenType(tokenType)] = counts
+	}
+	return response
+}
@@ -0,0 +1,82 @@
+package commands
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestChallengeCap(t *testing.T) {
+	origin := newTestOrigin()
+	origin.maxContextChallenges = 3
+	tokenType := pat.RateLimitedTokenType
+	outstanding := originOutstandingChallenges.Value(tokenType)
+	contexts := originChallengeContexts.Value(tokenType)
+	dropped := originChallengesDropped.Value(tokenType)
+
+	// Non-interactive challenges share one context
+	req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	req.Header.Set(headerTokenAttributeNoninteractive, "1")
+	for i := 0; i < 5; i++ {
+		origin.CreateChallenge(req)
+	}
+	challenges := outstandingChallenges(origin)
+	if len(challenges) != 1 {
+		t.Fatalf("expected a single context, got %d", len(challenges))
+	}
+	var contextEnc string
+	for contextEnc = range challenges {
+		break
+	}
+	if challenges[contextEnc].count != 3 {
+		t.Fatalf("expected the context to be capped at 3, got %d", challenges[contextEnc].count)
+	}
+	if originOutstandingChallenges.Value(tokenType) != outstanding+3 ||
+		originChallengeContexts.Value(tokenType) != contexts+1 ||
+		originChallengesDropped.Value(tokenType) != dropped+2 {
+		t.Fatal("unexpected challenge accounting")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := origin.consumeChallenge(contextEnc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := origin.consumeChallenge(contextEnc); err != ErrUnknownChallenge {
+		t.Fatal("expected challenges beyond the cap not to be redeemable")
+	}
+	if originOutstandingChallenges.Value(tokenType) != outstanding || originChallengeContexts.Value(tokenType) != contexts {
+		t.Fatal("expected consumed challenges to be released")
+	}
+
+	// Revocation releases outstanding challenges too
+	contextEnc = createTestChallengeContext(t, origin, false)
+	origin.revokeContext(contextEnc)
+	if originOutstandingChallenges.Value(tokenType) != outstanding || originChallengeContexts.Value(tokenType) != contexts {
+		t.Fatal("expected revoked challenges to be released")
+	}
+}
+
+func TestChallengeAttributeMetrics(t *testing.T) {
+	origin := newTestOrigin()
+	issuer := newTestIssuer(t, "issuer.example")
+	origin.issuerKeys = &issuerKeySource{keys: &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey()}}
+	nonInteractive := originChallengeAttributes.Value(pat.RateLimitedTokenType, "true", "false", "true")
+	crossOrigin := originChallengeAttributes.Value(pat.BasicPublicTokenType, "false", "true", "false")
+
+	req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	req.Header.Set(headerTokenAttributeNoninteractive, "1")
+	req.Header.Set(headerTokenAttributeChallengeCount, "3")
+	origin.handleRequest(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodGet, "https://origin.example/?crossorigin=1&type=2", nil)
+	origin.handleRequest(httptest.NewRecorder(), req)
+
+	if originChallengeAttributes.Value(pat.RateLimitedTokenType, "true", "false", "true") != nonInteractive+1 {
+		t.Fatal("expected a multi-count non-interactive challenge response to be counted once")
+	}
+	if originChallengeAttributes.Value(pat.BasicPublicTokenType, "false", "true", "false") != crossOrigin+1 {
+		t.Fatal("expected a cross-origin challenge response to be counted under its token type")
+	}
+}
@@ -0,0 +1,91 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+var ErrTokenTypeNotAccepted = errors.New("Token type not accepted")
+
+// tokenTypeToggle holds the token types the origin stopped accepting through
+// the admin API. Challenges are not issued for them, and their tokens are
+// refused. A nil toggle accepts every type.
+type tokenTypeToggle struct {
+	lock     sync.RWMutex
+	disabled map[uint16]bool
+}
+
+func newTokenTypeToggle() *tokenTypeToggle {
+	return &tokenTypeToggle{disabled: make(map[uint16]bool)}
+}
+
+func (t *tokenTypeToggle) accepts(tokenType uint16) bool {
+	if t == nil {
+		return true
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return !t.disabled[tokenType]
+}
+
+// set accepts the named token types only.
+func (t *tokenTypeToggle) set(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("At least one token type must be accepted")
+	}
+	accepted := make(map[uint16]bool)
+	for _, name := range names {
+		tokenType, ok := tokenTypeNames[name]
+		if !ok {
+			return fmt.Errorf("Unknown token type %q", name)
+		}
+		accepted[tokenType] = true
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.disabled = make(map[uint16]bool)
+	for _, tokenType := range tokenTypeNames {
+		if !accepted[tokenType] {
+			t.disabled[tokenType] = true
+		}
+	}
+	return nil
+}
+
+// names returns the names of the accepted token types, sorted.
+func (t *tokenTypeToggle) names() []string {
+	names := make([]string, 0, len(tokenTypeNames))
+	for name, tokenType := range tokenTypeNames {
+		if t.accepts(tokenType) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// offeredTokenKey is a token type the origin can challenge for, with its key.
+type offeredTokenKey struct {
+	tokenType uint16
+	tokenKey  []byte
+}
+
+// offeredTokenKeys returns the token types the origin can challenge for with
+// the keys of an issuer, rate-limited tokens first.
+func (o *Origin) offeredTokenKeys(keys *issuerKeys) []offeredTokenKey {
+	offered := []offeredTokenKey{
+		{pat.RateLimitedTokenType, keys.rateLimitedTokenKeyEnc},
+		{pat.BasicPublicTokenType, keys.basicTokenKeyEnc},
+	}
+	if o.offersPrivateTokens(keys) {
+		offered = append(offered, offeredTokenKey{pat.BasicPrivateTokenType, keys.privateTokenKeyEnc})
+	}
+	if keys.ed25519TokenKey != nil {
+		offered = append(offered, offeredTokenKey{ed25519TokenType, keys.ed25519TokenKey})
+	}
+	return offered
+}
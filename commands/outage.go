@@ -0,0 +1,97 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// What the origin does with a redemption it cannot verify
+	outageFallbackOpen   = "open"   // serve the resource with a warning
+	outageFallbackClosed = "closed" // answer 503
+
+	// Causes of outage fallbacks, as metric labels
+	outageCauseRemoteVerification = "remote-verification"
+	outageCauseStaleDirectory     = "stale-directory"
+	outageCauseExpiredBundle      = "expired-bundle"
+)
+
+var (
+	ErrVerificationUnavailable = errors.New("Token verification unavailable")
+)
+
+// outageRule applies an action to the paths under a prefix.
+type outageRule struct {
+	prefix string
+	action string
+}
+
+// outagePolicy decides what the origin does, per path, when it cannot verify
+// tokens: because remote verification failed, or because the issuer directory
+// was last fetched longer than staleAfter ago.
+type outagePolicy struct {
+	rules         []outageRule  // longest prefix first
+	defaultAction string        // for paths no rule matches
+	staleAfter    time.Duration // issuer keys never count as stale if zero
+}
+
+// parseOutagePolicy reads rules written as <path prefix>=<action>. The action
+// for other paths follows the verification failure policy.
+func parseOutagePolicy(rules []string, verificationFailure string, staleAfter time.Duration) (*outagePolicy, error) {
+	policy := &outagePolicy{
+		defaultAction: outageFallbackClosed,
+		staleAfter:    staleAfter,
+	}
+	if verificationFailure == verificationFailureAllow {
+		policy.defaultAction = outageFallbackOpen
+	}
+	if staleAfter < 0 {
+		return nil, fmt.Errorf("Invalid outage stale threshold")
+	}
+	for _, rule := range rules {
+		prefix, action, ok := strings.Cut(rule, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("Invalid outage fallback %q, expected <path prefix>=<action>", rule)
+		}
+		if action != outageFallbackOpen && action != outageFallbackClosed {
+			return nil, fmt.Errorf("Invalid outage fallback action %q", action)
+		}
+		policy.rules = append(policy.rules, outageRule{prefix, action})
+	}
+	sort.SliceStable(policy.rules, func(i, j int) bool {
+		return len(policy.rules[i].prefix) > len(policy.rules[j].prefix)
+	})
+	return policy, nil
+}
+
+// action returns the action for a path.
+func (p *outagePolicy) action(path string) string {
+	for _, rule := range p.rules {
+		if strings.HasPrefix(path, rule.prefix) {
+			return rule.action
+		}
+	}
+	return p.defaultAction
+}
+
+// staleKeys reports whether verifying with keys is an outage at now.
+func (p *outagePolicy) staleKeys(keys *issuerKeys, now time.Time) bool {
+	return p.staleAfter > 0 && now.Sub(keys.directoryFetched) > p.staleAfter
+}
+
+// fallback applies the action for the request to a redemption that could not
+// be verified, and reports whether the resource is served.
+func (p *outagePolicy) fallback(w http.ResponseWriter, req *http.Request, tokenType uint16, cause string) bool {
+	action := p.action(req.URL.Path)
+	originOutageFallbacks.Inc(tokenType, cause, action)
+	if action == outageFallbackClosed {
+		http.Error(w, ErrVerificationUnavailable.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+	w.Header().Set("Warning", `199 - "Token not verified: `+cause+`"`)
+	return true
+}
@@ -0,0 +1,153 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestOutagePolicy(t *testing.T) {
+	policy, err := parseOutagePolicy([]string{"/=closed", "/public/=open", "/public/private/=closed"}, verificationFailureAllow, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, action := range map[string]string{
+		"/":                     outageFallbackClosed,
+		"/public/page":          outageFallbackOpen,
+		"/public/private/page":  outageFallbackClosed,
+		"/publications/article": outageFallbackClosed,
+	} {
+		if policy.action(path) != action {
+			t.Fatalf("expected %s for %s, got %s", action, path, policy.action(path))
+		}
+	}
+
+	// Paths without rules follow the verification failure policy
+	policy, _ = parseOutagePolicy(nil, verificationFailureAllow, 0)
+	if policy.action("/") != outageFallbackOpen {
+		t.Fatal("expected unmatched paths to fail open")
+	}
+	for _, rule := range []string{"/", "public=open", "/=maybe"} {
+		if _, err := parseOutagePolicy([]string{rule}, verificationFailureDeny, 0); err == nil {
+			t.Fatalf("expected %q to be refused", rule)
+		}
+	}
+}
+
+func TestOutageFallback(t *testing.T) {
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("resource"))
+	}))
+	defer resource.Close()
+	defer func(original string) { testResource = original }(testResource)
+	testResource = resource.URL
+
+	issuer := newTestIssuer(t, "issuer.example")
+	origin := newTestOrigin()
+	keys := &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey(), directoryFetched: time.Now()}
+	basicKeyEnc, _ := marshalTokenKey(issuer.basicIssuer.TokenKey(), false)
+	keys.parseTokenKey(int(pat.BasicPublicTokenType), basicKeyEnc)
+	origin.issuerKeys = &issuerKeySource{keys: keys}
+	origin.clock = newRoleClock(true)
+	origin.outage, _ = parseOutagePolicy([]string{"/public/=open"}, verificationFailureDeny, time.Hour)
+
+	redeem := func(path string) *httptest.ResponseRecorder {
+		challenge := pat.TokenChallenge{
+			TokenType:  pat.BasicPublicTokenType,
+			IssuerName: "issuer.example",
+			OriginInfo: []string{"origin.example"},
+		}
+		context := sha256.Sum256(challenge.Marshal())
+		origin.addChallenge(hex.EncodeToString(context[:]), challenge)
+		token := createTestToken(t, issuer, testTokenChallenge(pat.BasicPublicTokenType))
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example"+path, nil)
+		req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+		w := httptest.NewRecorder()
+		origin.handleRequest(w, req)
+		return w
+	}
+	if w := redeem("/"); w.Code != http.StatusOK || w.Header().Get("Warning") != "" {
+		t.Fatalf("expected a verified redemption, got %d %q", w.Code, w.Header().Get("Warning"))
+	}
+
+	// Once the issuer directory is stale, paths fail open or closed
+	origin.clock.(*demoClock).advance(2 * time.Hour)
+	fallbacks := originOutageFallbacks.Value(pat.BasicPublicTokenType, outageCauseStaleDirectory, outageFallbackClosed)
+	if w := redeem("/"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if originOutageFallbacks.Value(pat.BasicPublicTokenType, outageCauseStaleDirectory, outageFallbackClosed) != fallbacks+1 {
+		t.Fatal("expected the fallback to be counted")
+	}
+	if w := redeem("/public/page"); w.Code != http.StatusOK || w.Header().Get("Warning") == "" {
+		t.Fatalf("expected the resource with a warning, got %d %q", w.Code, w.Header().Get("Warning"))
+	}
+}
+
+func TestOutageExpiredBundle(t *testing.T) {
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("resource"))
+	}))
+	defer resource.Close()
+	defer func(original string) { testResource = original }(testResource)
+	testResource = resource.URL
+
+	issuer := newTestIssuer(t, "issuer.example")
+	origin := newTestOrigin()
+	origin.clock = newRoleClock(true)
+	keys := &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey(), directoryFetched: origin.now()}
+	basicKeyEnc, _ := marshalTokenKey(issuer.basicIssuer.TokenKey(), false)
+	keys.parseTokenKey(int(pat.BasicPublicTokenType), basicKeyEnc)
+	keys.bundleIssuedAt = origin.now().Unix()
+	keys.bundleExpires = origin.now().Add(time.Hour).Unix()
+	origin.issuerKeys = &issuerKeySource{keys: keys, skew: time.Minute}
+
+	redeem := func(path string) *httptest.ResponseRecorder {
+		challenge := pat.TokenChallenge{
+			TokenType:  pat.BasicPublicTokenType,
+			IssuerName: "issuer.example",
+			OriginInfo: []string{"origin.example"},
+		}
+		context := sha256.Sum256(challenge.Marshal())
+		origin.addChallenge(hex.EncodeToString(context[:]), challenge)
+		token := createTestToken(t, issuer, testTokenChallenge(pat.BasicPublicTokenType))
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example"+path, nil)
+		req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+		w := httptest.NewRecorder()
+		origin.handleRequest(w, req)
+		return w
+	}
+	if w := redeem("/"); w.Code != http.StatusOK {
+		t.Fatalf("expected a verified redemption, got %d", w.Code)
+	}
+
+	// Within the skew, the bundle keys are still used
+	origin.clock.(*demoClock).advance(time.Hour + 30*time.Second)
+	if w := redeem("/"); w.Code != http.StatusOK || w.Header().Get("Warning") != "" {
+		t.Fatalf("expected a verified redemption within the skew, got %d %q", w.Code, w.Header().Get("Warning"))
+	}
+
+	// Past it, tokens are no longer verified with the keys of the expired
+	// bundle, even though the refresh never replaced them
+	origin.clock.(*demoClock).advance(time.Minute)
+	if w := redeem("/"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected keys of an expired bundle to be refused, got %d", w.Code)
+	}
+	origin.outage, _ = parseOutagePolicy([]string{"/public/=open"}, verificationFailureDeny, 0)
+	fallbacks := originOutageFallbacks.Value(pat.BasicPublicTokenType, outageCauseExpiredBundle, outageFallbackClosed)
+	if w := redeem("/"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	if originOutageFallbacks.Value(pat.BasicPublicTokenType, outageCauseExpiredBundle, outageFallbackClosed) != fallbacks+1 {
+		t.Fatal("expected the fallback to be counted as an expired bundle")
+	}
+	if w := redeem("/public/page"); w.Code != http.StatusOK || w.Header().Get("Warning") == "" {
+		t.Fatalf("expected the resource with a warning, got %d %q", w.Code, w.Header().Get("Warning"))
+	}
+}
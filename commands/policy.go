@@ -0,0 +1,129 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// BucketPolicy configures a token bucket: up to Burst issuances may happen
+// back to back, after which the bucket refills at RefillRate tokens per second.
+// A zero Burst disables the bucket.
+type BucketPolicy struct {
+	Burst      float64 `json:"burst"`
+	RefillRate float64 `json:"refill-rate"`
+}
+
+func (p BucketPolicy) enabled() bool {
+	return p.Burst > 0
+}
+
+// ClientPolicy holds the buckets applied to a single client: one across all of
+// its origins, and one for each anonymous origin it visits.
+type ClientPolicy struct {
+	Client BucketPolicy `json:"client"`
+	Origin BucketPolicy `json:"origin"`
+}
+
+// AttesterPolicy is the attester policy file. The embedded ClientPolicy is
+// the default, and Clients overrides it per client ID. Expression is an
+// optional CEL expression that every issuance must satisfy.
+type AttesterPolicy struct {
+	ClientPolicy
+	Clients    map[string]ClientPolicy `json:"clients"`
+	Expression string                  `json:"expression"`
+
+	expression *policyExpression
+}
+
+func (p *AttesterPolicy) forClient(clientID string) ClientPolicy {
+	if p == nil {
+		return ClientPolicy{}
+	}
+	if policy, ok := p.Clients[clientID]; ok {
+		return policy
+	}
+	return p.ClientPolicy
+}
+
+// allow evaluates the policy expression, if any, for a single issuance.
+func (p *AttesterPolicy) allow(input policyInput) (bool, error) {
+	if p == nil || p.expression == nil {
+		return true, nil
+	}
+	return p.expression.allow(input)
+}
+
+func (p *AttesterPolicy) validate() error {
+	policies := []ClientPolicy{p.ClientPolicy}
+	for _, policy := range p.Clients {
+		policies = append(policies, policy)
+	}
+	for _, policy := range policies {
+		for _, bucket := range []BucketPolicy{policy.Client, policy.Origin} {
+			if bucket.Burst < 0 || bucket.RefillRate < 0 {
+				return fmt.Errorf("Invalid bucket policy: burst and refill-rate must be non-negative")
+			}
+			// A bucket holding less than a whole token never admits an issuance
+			if bucket.Burst > 0 && bucket.Burst < 1 {
+				return fmt.Errorf("Invalid bucket policy: burst must be 0 or at least 1")
+			}
+		}
+	}
+	return nil
+}
+
+func readAttesterPolicy(fname string) (*AttesterPolicy, error) {
+	policyEnc, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &AttesterPolicy{}
+	err = json.Unmarshal(policyEnc, policy)
+	if err != nil {
+		return nil, err
+	}
+	if err = policy.validate(); err != nil {
+		return nil, err
+	}
+	if policy.Expression != "" {
+		policy.expression, err = compilePolicyExpression(policy.Expression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return policy, nil
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newTokenBucket(policy BucketPolicy, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		tokens:  policy.Burst,
+		updated: now,
+	}
+}
+
+func (b *tokenBucket) refill(policy BucketPolicy, now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(policy.Burst, b.tokens+elapsed*policy.RefillRate)
+		b.updated = now
+	}
+}
+
+func (b *tokenBucket) available(policy BucketPolicy, now time.Time) bool {
+	b.refill(policy, now)
+	return b.tokens >= 1
+}
+
+func (b *tokenBucket) take() {
+	b.tokens = b.tokens - 1
+}
@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+const (
+	// Client headers with this prefix are exposed to policy expressions as
+	// attestation attributes, e.g., Sec-Attestation-Platform becomes
+	// attestation.platform.
+	headerAttestationPrefix = "Sec-Attestation-"
+)
+
+// policyInput is the per-request data exposed to policy expressions.
+type policyInput struct {
+	tokenType   uint16
+	clientID    string
+	issuer      string
+	originCount int // tokens issued to this client for this origin
+	origins     int // distinct origins visited by this client
+	limit       int // issuer token limit, zero if unknown
+	attestation map[string]string
+}
+
+// policyExpression is a compiled CEL issuance policy. Expressions can refer to
+// request.token_type, request.client_id, request.issuer, state.origin_count,
+// state.origins, limit, and attestation.<attribute>, and must evaluate to a bool.
+type policyExpression struct {
+	source  string
+	program cel.Program
+}
+
+func compilePolicyExpression(source string) (*policyExpression, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("request", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("state", cel.MapType(cel.StringType, cel.IntType)),
+		cel.Variable("limit", cel.IntType),
+		cel.Variable("attestation", cel.MapType(cel.StringType, cel.StringType)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("Invalid policy expression: %w", issues.Err())
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("Invalid policy expression: expected bool result, got %v", ast.OutputType())
+	}
+
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policyExpression{
+		source:  source,
+		program: program,
+	}, nil
+}
+
+// allow evaluates the expression. Evaluation errors, such as references to
+// missing attestation attributes, deny the request.
+func (e *policyExpression) allow(input policyInput) (bool, error) {
+	attestation := input.attestation
+	if attestation == nil {
+		attestation = map[string]string{}
+	}
+
+	result, _, err := e.program.Eval(map[string]interface{}{
+		"request": map[string]interface{}{
+			"token_type": int64(input.tokenType),
+			"client_id":  input.clientID,
+			"issuer":     input.issuer,
+		},
+		"state": map[string]int64{
+			"origin_count": int64(input.originCount),
+			"origins":      int64(input.origins),
+		},
+		"limit":       int64(input.limit),
+		"attestation": attestation,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	allowed, ok := result.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("Policy expression returned %v, expected bool", result.Value())
+	}
+	return allowed, nil
+}
+
+func readAttestationAttributes(req *http.Request) map[string]string {
+	attributes := make(map[string]string)
+	for name, values := range req.Header {
+		if name == headerAttestationFormat || name == headerAttestationEvidence {
+			continue
+		}
+		if len(values) > 0 && strings.HasPrefix(name, headerAttestationPrefix) {
+			attribute := strings.ToLower(strings.TrimPrefix(name, headerAttestationPrefix))
+			attributes[strings.ReplaceAll(attribute, "-", "_")] = values[0]
+		}
+	}
+	return attributes
+}
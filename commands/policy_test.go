@@ -0,0 +1,128 @@
+package commands
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurstAndRefill(t *testing.T) {
+	policy := BucketPolicy{
+		Burst:      3,
+		RefillRate: 0.5,
+	}
+	now := time.Unix(0, 0)
+	bucket := newTokenBucket(policy, now)
+
+	for i := 0; i < 3; i++ {
+		if !bucket.available(policy, now) {
+			t.Fatal("expected burst capacity to be available")
+		}
+		bucket.take()
+	}
+	if bucket.available(policy, now) {
+		t.Fatal("expected bucket to be empty after burst")
+	}
+
+	now = now.Add(time.Second)
+	if bucket.available(policy, now) {
+		t.Fatal("expected partial refill to be insufficient")
+	}
+	now = now.Add(time.Second)
+	if !bucket.available(policy, now) {
+		t.Fatal("expected bucket to refill one token")
+	}
+
+	// Refill never exceeds the burst size
+	now = now.Add(time.Hour)
+	bucket.available(policy, now)
+	if bucket.tokens != policy.Burst {
+		t.Fatal("expected bucket to be capped at burst size")
+	}
+}
+
+func TestAttesterPolicyOverrides(t *testing.T) {
+	policyEnc := []byte(`{
+		"client": {"burst": 10, "refill-rate": 1},
+		"origin": {"burst": 2, "refill-rate": 0.1},
+		"clients": {"special": {"client": {"burst": 100, "refill-rate": 10}}}
+	}`)
+
+	policy := &AttesterPolicy{}
+	if err := json.Unmarshal(policyEnc, policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if policy.forClient("default").Origin.Burst != 2 {
+		t.Fatal("expected default origin policy")
+	}
+	special := policy.forClient("special")
+	if special.Client.Burst != 100 || special.Origin.enabled() {
+		t.Fatal("expected client override policy")
+	}
+
+	var nilPolicy *AttesterPolicy
+	if nilPolicy.forClient("default").Client.enabled() {
+		t.Fatal("expected missing policy to disable buckets")
+	}
+}
+
+func TestAttesterPolicyInvalidBurst(t *testing.T) {
+	for _, bucket := range []BucketPolicy{{Burst: -1}, {RefillRate: -1}, {Burst: 0.5, RefillRate: 1}} {
+		policy := &AttesterPolicy{Clients: map[string]ClientPolicy{"client": {Origin: bucket}}}
+		if err := policy.validate(); err == nil {
+			t.Errorf("expected %+v to be refused", bucket)
+		}
+	}
+	policy := &AttesterPolicy{ClientPolicy: ClientPolicy{Client: BucketPolicy{Burst: 1}}}
+	if err := policy.validate(); err != nil {
+		t.Fatalf("expected a burst of one to be valid, got %v", err)
+	}
+}
+
+func TestPolicyExpression(t *testing.T) {
+	expression, err := compilePolicyExpression(`request.token_type == 0x0003 && state.origin_count < limit && attestation.platform == "ios"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := policyInput{
+		tokenType:   0x0003,
+		originCount: 1,
+		limit:       10,
+		attestation: map[string]string{"platform": "ios"},
+	}
+	allowed, err := expression.allow(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed {
+		t.Fatal("expected request to be allowed")
+	}
+
+	input.originCount = 10
+	allowed, _ = expression.allow(input)
+	if allowed {
+		t.Fatal("expected request over the limit to be denied")
+	}
+
+	// Missing attestation attributes deny the request
+	input.originCount = 1
+	input.attestation = nil
+	allowed, err = expression.allow(input)
+	if allowed || err == nil {
+		t.Fatal("expected request without attestation to be denied")
+	}
+}
+
+func TestPolicyExpressionInvalid(t *testing.T) {
+	if _, err := compilePolicyExpression(`request.token_type +`); err == nil {
+		t.Fatal("expected syntax error")
+	}
+	if _, err := compilePolicyExpression(`limit + 1`); err == nil {
+		t.Fatal("expected non-bool expression to be rejected")
+	}
+}
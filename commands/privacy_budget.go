@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of epochs, including the current one, kept for reporting
+	privacyBudgetEpochs = 7
+)
+
+// privacyLedger accounts, per epoch, how much linkable information the
+// attester accumulates about each client through rate-limited issuance: the
+// anonymous origins a client requested tokens for, and how often.
+type privacyLedger struct {
+	lock   sync.Mutex
+	length time.Duration
+	epochs map[uint64]map[string]map[string]int // epoch -> client ID -> anonymous origin -> tokens
+}
+
+type clientPrivacyBudget struct {
+	ClientID        string  `json:"client_id"`
+	DistinctOrigins int     `json:"distinct_origins"`
+	Tokens          int     `json:"tokens"`
+	MaxOriginCount  int     `json:"max_origin_count"`
+	CountSkew       float64 `json:"count_skew"` // max over mean per-origin count, 1 when uniform
+}
+
+type epochPrivacyBudget struct {
+	Epoch   uint64                `json:"epoch"`
+	Start   time.Time             `json:"start"`
+	Clients []clientPrivacyBudget `json:"clients"`
+}
+
+type privacyBudgetReport struct {
+	EpochLength int64                `json:"epoch_length_seconds"`
+	Epochs      []epochPrivacyBudget `json:"epochs"`
+}
+
+func newPrivacyLedger(length time.Duration) *privacyLedger {
+	return &privacyLedger{
+		length: length,
+		epochs: make(map[uint64]map[string]map[string]int),
+	}
+}
+
+func (l *privacyLedger) epoch(now time.Time) uint64 {
+	return uint64(now.UnixNano() / int64(l.length))
+}
+
+// record accounts a token issued to the client for the anonymous origin.
+func (l *privacyLedger) record(clientID, anonOriginEnc string, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	epoch := l.epoch(now)
+	clients, ok := l.epochs[epoch]
+	if !ok {
+		clients = make(map[string]map[string]int)
+		l.epochs[epoch] = clients
+		for old := range l.epochs {
+			if old+privacyBudgetEpochs <= epoch {
+				delete(l.epochs, old)
+			}
+		}
+	}
+	origins, ok := clients[clientID]
+	if !ok {
+		origins = make(map[string]int)
+		clients[clientID] = origins
+	}
+	origins[anonOriginEnc]++
+}
+
+// rename accounts the tokens of the current epoch issued for an anonymous
+// origin the client rotated to its new ID, so that the rotation does not count
+// as another origin.
+func (l *privacyLedger) rename(clientID, oldOriginEnc, anonOriginEnc string, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	origins, ok := l.epochs[l.epoch(now)][clientID]
+	if !ok {
+		return
+	}
+	if count, ok := origins[oldOriginEnc]; ok {
+		origins[anonOriginEnc] += count
+		delete(origins, oldOriginEnc)
+	}
+}
+
+func computeClientPrivacyBudget(clientID string, origins map[string]int) clientPrivacyBudget {
+	budget := clientPrivacyBudget{
+		ClientID:        clientID,
+		DistinctOrigins: len(origins),
+	}
+	for _, count := range origins {
+		budget.Tokens += count
+		if count > budget.MaxOriginCount {
+			budget.MaxOriginCount = count
+		}
+	}
+	if budget.Tokens > 0 {
+		mean := float64(budget.Tokens) / float64(budget.DistinctOrigins)
+		budget.CountSkew = float64(budget.MaxOriginCount) / mean
+	}
+	return budget
+}
+
+// report summarizes the retained epochs, newest first, optionally restricted
+// to a single client.
+func (l *privacyLedger) report(clientID string) privacyBudgetReport {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	report := privacyBudgetReport{
+		EpochLength: int64(l.length / time.Second),
+		Epochs:      make([]epochPrivacyBudget, 0, len(l.epochs)),
+	}
+	for epoch, clients := range l.epochs {
+		summary := epochPrivacyBudget{
+			Epoch:   epoch,
+			Start:   time.Unix(0, int64(epoch)*int64(l.length)).UTC(),
+			Clients: make([]clientPrivacyBudget, 0, len(clients)),
+		}
+		for id, origins := range clients {
+			if clientID != "" && id != clientID {
+				continue
+			}
+			summary.Clients = append(summary.Clients, computeClientPrivacyBudget(id, origins))
+		}
+		sort.Slice(summary.Clients, func(i, j int) bool {
+			return summary.Clients[i].ClientID < summary.Clients[j].ClientID
+		})
+		report.Epochs = append(report.Epochs, summary)
+	}
+	sort.Slice(report.Epochs, func(i, j int) bool {
+		return report.Epochs[i].Epoch > report.Epochs[j].Epoch
+	})
+	return report
+}
@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrivacyLedger(t *testing.T) {
+	ledger := newPrivacyLedger(time.Hour)
+	now := time.Unix(1700000000, 0)
+
+	ledger.record("alice", "origin-a", now)
+	ledger.record("alice", "origin-a", now)
+	ledger.record("alice", "origin-a", now)
+	ledger.record("alice", "origin-b", now)
+	ledger.record("bob", "origin-a", now)
+	ledger.record("alice", "origin-c", now.Add(time.Hour))
+
+	report := ledger.report("")
+	if report.EpochLength != 3600 || len(report.Epochs) != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if report.Epochs[0].Epoch != ledger.epoch(now)+1 {
+		t.Fatal("expected the newest epoch first")
+	}
+
+	previous := report.Epochs[1]
+	if len(previous.Clients) != 2 || previous.Clients[0].ClientID != "alice" {
+		t.Fatalf("unexpected clients %+v", previous.Clients)
+	}
+	alice := previous.Clients[0]
+	if alice.DistinctOrigins != 2 || alice.Tokens != 4 || alice.MaxOriginCount != 3 || alice.CountSkew != 1.5 {
+		t.Fatalf("unexpected budget %+v", alice)
+	}
+
+	filtered := ledger.report("bob")
+	if len(filtered.Epochs[1].Clients) != 1 || len(filtered.Epochs[0].Clients) != 0 {
+		t.Fatal("expected the report to be filtered by client")
+	}
+
+	// Old epochs are dropped
+	ledger.record("alice", "origin-a", now.Add(privacyBudgetEpochs*time.Hour))
+	if len(ledger.report("").Epochs) != 2 {
+		t.Fatal("expected epochs beyond the retention to be dropped")
+	}
+}
+
+func TestAttesterPrivacyBudgetAdmin(t *testing.T) {
+	attester := TestAttester{ledger: newPrivacyLedger(time.Hour)}
+	attester.ledger.record("alice", "origin-a", time.Now())
+	admin := attester.newAdminServer("secret")
+
+	req := httptest.NewRequest(http.MethodGet, adminPrivacyBudgetURI+"?client=alice", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	report := privacyBudgetReport{}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Epochs) != 1 || report.Epochs[0].Clients[0].DistinctOrigins != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
@@ -0,0 +1,166 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/cloudflare/circl/oprf"
+	pat "github.com/cloudflare/pat-go"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Privately verifiable tokens (type 0x0001) carry a VOPRF(P-384, SHA-384)
+// output as authenticator. Only the issuer key computes it, so origins verify
+// them with a copy of that key or remotely at the issuer.
+const (
+	privateTokenElementLength       = 49 // compressed P-384 point
+	privateTokenScalarLength        = 48
+	privateTokenRequestLength       = tokenTypeLength + tokenKeyIDLength + privateTokenElementLength
+	privateTokenResponseLength      = privateTokenElementLength + 2*privateTokenScalarLength // element and DLEQ proof
+	privateTokenAuthenticatorLength = 48
+)
+
+var (
+	ErrInvalidPrivateTokenRequest = errors.New("Invalid private TokenRequest")
+)
+
+//	struct {
+//	    uint16_t token_type = 0x0001;
+//	    uint8_t truncated_token_key_id;
+//	    uint8_t blinded_msg[Ne];
+//	} TokenRequest;
+//
+// pat.BasicPrivateTokenRequest reads one byte short of a compressed P-384
+// point, so requests are decoded here.
+func unmarshalPrivateTokenRequest(data []byte) (*pat.BasicPrivateTokenRequest, error) {
+	s := cryptobyte.String(data)
+	var tokenType uint16
+	request := &pat.BasicPrivateTokenRequest{}
+	if !s.ReadUint16(&tokenType) || tokenType != pat.BasicPrivateTokenType ||
+		!s.ReadUint8(&request.TokenKeyID) ||
+		!s.ReadBytes(&request.BlindedReq, privateTokenElementLength) ||
+		!s.Empty() {
+		return nil, ErrInvalidPrivateTokenRequest
+	}
+	return request, nil
+}
+
+// privateTokenKeyID is the key ID of a serialized VOPRF public key, as
+// pat.BasicPrivateIssuer computes it.
+func privateTokenKeyID(publicKeyEnc []byte) []byte {
+	keyID := sha256.Sum256(append([]byte{0x00, 0x01}, publicKeyEnc...))
+	return keyID[:]
+}
+
+func unmarshalPrivateTokenKey(publicKeyEnc []byte) (*oprf.PublicKey, error) {
+	publicKey := new(oprf.PublicKey)
+	if err := publicKey.UnmarshalBinary(oprf.SuiteP384, publicKeyEnc); err != nil {
+		return nil, fmt.Errorf("Invalid private token key: %w", err)
+	}
+	return publicKey, nil
+}
+
+// loadPrivateTokenKey reads a hex-encoded VOPRF private key from a file, or
+// generates one if the file name is empty. Issuers and the origins verifying
+// their tokens locally load the same file.
+func loadPrivateTokenKey(fileName string) (*oprf.PrivateKey, error) {
+	if fileName == "" {
+		return oprf.GenerateKey(oprf.SuiteP384, rand.Reader)
+	}
+	keyHex, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	keyEnc, err := hex.DecodeString(string(bytes.TrimSpace(keyHex)))
+	key := new(oprf.PrivateKey)
+	if err != nil || len(keyEnc) != privateTokenScalarLength || key.UnmarshalBinary(oprf.SuiteP384, keyEnc) != nil {
+		return nil, fmt.Errorf("Invalid private token key, expected %d hex-encoded bytes", privateTokenScalarLength)
+	}
+	return key, nil
+}
+
+func verifyPrivateToken(key *oprf.PrivateKey, token pat.Token) error {
+	if key == nil {
+		return fmt.Errorf("No key for token type %d", token.TokenType)
+	}
+	if len(token.Authenticator) != privateTokenAuthenticatorLength {
+		return ErrInvalidToken
+	}
+	if err := pat.NewBasicPrivateIssuer(key).Verify(token); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// evaluatePrivateTokenRequest evaluates the request with the issuer key,
+// checking it names that key.
+func evaluatePrivateTokenRequest(issuer *pat.BasicPrivateIssuer, request *pat.BasicPrivateTokenRequest) ([]byte, error) {
+	if keyID := issuer.TokenKeyID(); request.TokenKeyID != keyID[0] {
+		return nil, fmt.Errorf("Unknown token key ID %d", request.TokenKeyID)
+	}
+	return issuer.Evaluate(request)
+}
+
+// fetchPrivateToken runs issuance through the attester, which passes the
+// request through to the issuer.
+func fetchPrivateToken(httpClient *http.Client, attester string, challenge []byte, publicKeyEnc []byte) (pat.Token, error) {
+	publicKey, err := unmarshalPrivateTokenKey(publicKeyEnc)
+	if err != nil {
+		return pat.Token{}, err
+	}
+
+	tokenChallenge, err := pat.UnmarshalTokenChallenge(challenge)
+	if err != nil {
+		return pat.Token{}, err
+	}
+	issuerConfig, err := fetchIssuerConfig(httpClient, tokenChallenge.IssuerName)
+	if err != nil {
+		return pat.Token{}, err
+	}
+	issuerRequestURI, err := composeURL(tokenChallenge.IssuerName, issuerConfig.RequestURI)
+	if err != nil {
+		return pat.Token{}, err
+	}
+
+	nonce := make([]byte, 32)
+	rand.Reader.Read(nonce)
+	state, err := pat.NewBasicPrivateClient().CreateTokenRequest(challenge, nonce, privateTokenKeyID(publicKeyEnc), publicKey)
+	if err != nil {
+		return pat.Token{}, err
+	}
+
+	tokenRequestURI, err := tokenRequestTarget(attester, issuerRequestURI)
+	if err != nil {
+		return pat.Token{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, tokenRequestURI, bytes.NewReader(state.Request().Marshal()))
+	if err != nil {
+		return pat.Token{}, err
+	}
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return pat.Token{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return pat.Token{}, tokenRequestError(resp)
+	}
+	tokenResponse, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return pat.Token{}, err
+	}
+	protocolTranscript.recordIssuance(challenge, publicKeyEnc, state.Request().Marshal(), tokenResponse)
+	if len(tokenResponse) != privateTokenResponseLength {
+		return pat.Token{}, fmt.Errorf("Invalid private TokenResponse length %d", len(tokenResponse))
+	}
+	// Finalizing checks the DLEQ proof that the issuer used the directory key
+	return protocolTranscript.recordToken(state.FinalizeToken(tokenResponse))
+}
@@ -0,0 +1,129 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func newTestPrivateIssuer(t *testing.T) *Issuer {
+	issuer := newTestIssuer(t, "issuer.example")
+	privateTokenKey, err := loadPrivateTokenKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.privateIssuer = pat.NewBasicPrivateIssuer(privateTokenKey)
+	issuer.privateTokenKey = privateTokenKey
+	return issuer
+}
+
+func TestPrivateToken(t *testing.T) {
+	issuer := newTestPrivateIssuer(t)
+	token := createTestToken(t, issuer, testTokenChallenge(pat.BasicPrivateTokenType))
+
+	decoded, err := unmarshalToken(token.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Marshal(), token.Marshal()) {
+		t.Fatal("token encoding mismatch")
+	}
+	if err := verifyPrivateToken(issuer.privateTokenKey, decoded); err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _ := loadPrivateTokenKey("")
+	if err := verifyPrivateToken(otherKey, decoded); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+	if err := verifyPrivateToken(nil, decoded); err == nil {
+		t.Fatal("expected verification without a key to fail")
+	}
+
+	// Requests one byte short of a compressed point are refused
+	if _, err := unmarshalToken(token.Marshal()[:100]); err == nil {
+		t.Fatal("expected truncated token to fail decoding")
+	}
+	short := make([]byte, privateTokenRequestLength-1)
+	short[1] = byte(pat.BasicPrivateTokenType)
+	if _, err := validateTokenRequest(short); err == nil {
+		t.Fatal("expected short request to be refused")
+	}
+	if _, err := unmarshalPrivateTokenRequest(short); err != ErrInvalidPrivateTokenRequest {
+		t.Fatalf("expected ErrInvalidPrivateTokenRequest, got %v", err)
+	}
+}
+
+func TestLoadPrivateTokenKey(t *testing.T) {
+	key, _ := loadPrivateTokenKey("")
+	keyEnc, err := key.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "private-token.key")
+	os.WriteFile(fileName, []byte(hex.EncodeToString(keyEnc)+"\n"), 0600)
+	loaded, err := loadPrivateTokenKey(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedEnc, _ := loaded.MarshalBinary()
+	if !bytes.Equal(loadedEnc, keyEnc) {
+		t.Fatal("key mismatch")
+	}
+
+	invalid := filepath.Join(dir, "invalid.key")
+	os.WriteFile(invalid, []byte("00ff"), 0600)
+	if _, err := loadPrivateTokenKey(invalid); err == nil {
+		t.Fatal("expected invalid key to be refused")
+	}
+}
+
+func TestOriginPrivateTokens(t *testing.T) {
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("resource"))
+	}))
+	defer resource.Close()
+	defer func(original string) { testResource = original }(testResource)
+	testResource = resource.URL
+
+	issuer := newTestPrivateIssuer(t)
+	origin := newTestOrigin()
+	keys := &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey()}
+	privateTokenKeyEnc, _ := issuer.privateIssuer.TokenKey().MarshalBinary()
+	keys.parseTokenKey(int(pat.BasicPrivateTokenType), privateTokenKeyEnc)
+	origin.issuerKeys = &issuerKeySource{keys: keys}
+
+	// Not offered unless the origin can verify them
+	if origin.offersPrivateTokens(keys) {
+		t.Fatal("expected private tokens not to be offered without a key")
+	}
+	origin.privateTokenKey = issuer.privateTokenKey
+	if !origin.offersPrivateTokens(keys) {
+		t.Fatal("expected private tokens to be offered")
+	}
+
+	challengeEnc, tokenKey, err := origin.CreateChallenge(httptest.NewRequest(http.MethodGet, "https://origin.example/?type=1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenKey != base64.URLEncoding.EncodeToString(privateTokenKeyEnc) {
+		t.Fatal("expected the private token key in the challenge")
+	}
+	challenge, _ := base64.URLEncoding.DecodeString(challengeEnc)
+	token := createTestToken(t, issuer, challenge)
+
+	req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+	w := httptest.NewRecorder()
+	origin.handleRequest(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the resource, got %d", w.Code)
+	}
+}
@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Media type of problem details (RFC 9457)
+	problemMediaType = "application/problem+json"
+
+	// Prefix of the problem types pat-app sends
+	problemTypePrefix = "https://github.com/cloudflare/pat-app#"
+)
+
+const (
+	// Largest problem details body read from a response
+	maxProblemLength = 16 * 1024
+)
+
+// problemDetails holds the members every problem details body pat-app sends
+// carries.
+type problemDetails struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	RefusedBy string `json:"refused_by"` // attester or issuer
+}
+
+// writeProblem writes the encoded problem details with the status.
+func writeProblem(w http.ResponseWriter, status int, problemEnc []byte) {
+	w.Header().Set("Content-Type", problemMediaType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(problemEnc)
+}
+
+// readProblem returns the problem details of a client error response sent by
+// pat-app, if it is one, and their type. The body is consumed.
+func readProblem(resp *http.Response) ([]byte, string, bool) {
+	if resp.StatusCode < 400 || resp.StatusCode >= 500 {
+		return nil, "", false
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != problemMediaType {
+		return nil, "", false
+	}
+	problemEnc, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxProblemLength))
+	if err != nil {
+		return nil, "", false
+	}
+	var problem problemDetails
+	if err := json.Unmarshal(problemEnc, &problem); err != nil || !strings.HasPrefix(problem.Type, problemTypePrefix) {
+		return nil, "", false
+	}
+	return problemEnc, problem.Type, true
+}
+
+// relayProblem passes problem details the issuer refused a forwarded token
+// request with on to the client as they are, so that clients learn why.
+func relayProblem(w http.ResponseWriter, resp *http.Response) bool {
+	problemEnc, problemType, ok := readProblem(resp)
+	if !ok {
+		return false
+	}
+	log.Debugln("Relaying issuer refusal", problemType)
+	writeProblem(w, resp.StatusCode, problemEnc)
+	return true
+}
@@ -0,0 +1,244 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/cloudflare/pat-app/httpauth"
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	// Response body bytes included in redemption reports
+	maxRedemptionReportBody = 1024
+)
+
+// readRedemptionToken reads a token from a file holding it base64url-encoded,
+// as sent in Authorization headers, hex-encoded, in binary, or in a token store
+// written by `fetch --store`, of which the first token is used.
+func readRedemptionToken(fileName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSpace(string(data))
+	if strings.HasPrefix(text, "{") {
+		store, err := ReadStoreFromFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid token store: %w", err)
+		}
+		contexts := make([]string, 0, len(store.store))
+		for context := range store.store {
+			contexts = append(contexts, context)
+		}
+		if len(contexts) == 0 {
+			return nil, ErrNoMatchingToken
+		}
+		sort.Strings(contexts)
+		log.Debugln("Using stored token for challenge", contexts[0])
+		return store.store[contexts[0]][0].Marshal(), nil
+	}
+	text = strings.TrimPrefix(text, privateTokenType+" token=")
+	if tokenValue, err := hex.DecodeString(text); err == nil {
+		return tokenValue, nil
+	}
+	if tokenValue, err := decodeChallengeAttribute(authParamToken, text); err == nil {
+		return tokenValue, nil
+	}
+	return data, nil
+}
+
+// redemptionURL returns the URL redeemed at: origin if it is a URL, with
+// resource resolved against it if set, or resource at the origin host.
+func redemptionURL(origin, resource string) (string, error) {
+	if !strings.Contains(origin, "://") {
+		if resource == "" {
+			resource = "/"
+		}
+		return composeURL(origin, resource)
+	}
+	base, err := url.Parse(origin)
+	if err != nil {
+		return "", err
+	}
+	if resource == "" {
+		return base.String(), nil
+	}
+	ref, err := url.Parse(resource)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// redemptionReport is the origin's verdict on a redeemed token.
+type redemptionReport struct {
+	status     int
+	accepted   bool
+	reasons    []string
+	challenges []string // challenges sent with the refusal, decoded
+	body       string
+}
+
+func (r redemptionReport) String() string {
+	var b strings.Builder
+	verdict := "refused"
+	if r.accepted {
+		verdict = "accepted"
+	}
+	fmt.Fprintf(&b, "Redemption %s: %d %s\n", verdict, r.status, http.StatusText(r.status))
+	for _, reason := range r.reasons {
+		fmt.Fprintf(&b, "Reason: %s\n", reason)
+	}
+	for _, challenge := range r.challenges {
+		fmt.Fprintf(&b, "Challenge: %s\n", challenge)
+	}
+	if r.body != "" {
+		fmt.Fprintf(&b, "Body: %s\n", r.body)
+	}
+	return b.String()
+}
+
+// redemptionStatusReasons explains refusals of the origin in this repository,
+// which other origins are likely to share.
+var redemptionStatusReasons = map[int]string{
+	http.StatusBadRequest:          "the token is malformed, was not issued for a challenge of the origin, or failed verification",
+	http.StatusUnauthorized:        "the origin wants a token for another challenge",
+	http.StatusForbidden:           "the challenge was revoked or a redemption hook denied the token",
+	http.StatusTooManyRequests:     "the origin is rate limiting redemptions",
+	http.StatusInternalServerError: "the origin failed verifying the token",
+	http.StatusServiceUnavailable:  "the origin could not reach the issuer to verify the token",
+}
+
+// describeChallenge decodes a token challenge for reports.
+func describeChallenge(blob []byte) string {
+	challenge, err := pat.UnmarshalTokenChallenge(blob)
+	if err != nil {
+		return fmt.Sprintf("undecodable (%v): %s", err, base64.URLEncoding.EncodeToString(blob))
+	}
+	context := sha256.Sum256(blob)
+	return fmt.Sprintf("token type 0x%04x, issuer %s, origin info %q, context %x", challenge.TokenType, challenge.IssuerName, challenge.OriginInfo, context)
+}
+
+// newRedemptionReport decodes the origin's response to a redemption: its
+// status, error parameters of WWW-Authenticate challenges, new challenges, and
+// the start of its body.
+func newRedemptionReport(resp *http.Response) redemptionReport {
+	report := redemptionReport{
+		status:   resp.StatusCode,
+		accepted: resp.StatusCode >= 200 && resp.StatusCode < 300,
+	}
+	if !report.accepted {
+		if reason, ok := redemptionStatusReasons[resp.StatusCode]; ok {
+			report.reasons = append(report.reasons, reason)
+		}
+	}
+
+	for _, authValue := range resp.Header.Values("WWW-Authenticate") {
+		challenges, err := httpauth.Parse(authValue)
+		if err != nil {
+			report.reasons = append(report.reasons, fmt.Sprintf("undecodable challenge %q: %v", authValue, err))
+			continue
+		}
+		for _, challenge := range challenges {
+			if !challenge.IsPrivateToken() {
+				report.reasons = append(report.reasons, "the origin asks for another authentication scheme: "+challenge.String())
+				continue
+			}
+			// Bearer-style error parameters, which some origins send
+			if reason, ok := challenge.Param("error"); ok {
+				if description, _ := challenge.Param("error_description"); description != "" {
+					reason += ": " + description
+				}
+				report.reasons = append(report.reasons, reason)
+			}
+			if len(challenge.TokenChallenge) > 0 {
+				report.challenges = append(report.challenges, describeChallenge(challenge.TokenChallenge))
+			}
+		}
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxRedemptionReportBody))
+	report.body = string(bytes.TrimSpace(body))
+	return report
+}
+
+func runClientRedeem(c *cli.Context) error {
+	origin := c.String("origin")
+	resource := c.String("resource")
+	tokenFile := c.String("token")
+	extensions := c.String("extensions")
+	emulate := c.String("emulate")
+	logLevel := c.String("log")
+	useHTTP3 := c.Bool("http3")
+	useH2C := c.Bool("h2c")
+
+	if origin == "" {
+		log.Fatal("Invalid origin. See README for running instructions.")
+	}
+	if useHTTP3 && useH2C {
+		log.Fatal("Invalid transport, --http3 and --h2c exclude each other. See README for running instructions.")
+	}
+	if tokenFile == "" {
+		log.Fatal("Invalid token file. See README for running instructions.")
+	}
+	profile, err := lookupClientProfile(emulate)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch logLevel {
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	}
+
+	tokenValue, err := readRedemptionToken(tokenFile)
+	if err != nil {
+		log.Fatal("Failed reading token from file ", tokenFile, ": ", err)
+	}
+	if token, err := unmarshalToken(tokenValue); err != nil {
+		log.Warnln("Redeeming a token that does not decode:", err)
+	} else {
+		log.Infof("Redeeming token of type 0x%04x for context %x", token.TokenType, token.Context)
+	}
+
+	resourceURI, err := redemptionURL(origin, resource)
+	if err != nil {
+		return err
+	}
+	req, err := profile.newRequest(resourceURI)
+	if err != nil {
+		return err
+	}
+	authValue := privateTokenType + " " + authParamToken + "=" + base64.URLEncoding.EncodeToString(tokenValue)
+	if extensions != "" {
+		authValue += ", " + authParamExtensions + "=" + extensions
+	}
+	profile.setHeader(req, "Authorization", authValue)
+
+	resp, err := newHTTPClient(useHTTP3, useH2C).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	report := newRedemptionReport(resp)
+	fmt.Print(report)
+	if !report.accepted {
+		return fmt.Errorf("Origin refused the token")
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestReadRedemptionToken(t *testing.T) {
+	token := pat.Token{
+		TokenType:     pat.BasicPublicTokenType,
+		Nonce:         bytes.Repeat([]byte{1}, 32),
+		Context:       bytes.Repeat([]byte{2}, 32),
+		KeyID:         bytes.Repeat([]byte{3}, 32),
+		Authenticator: bytes.Repeat([]byte{4}, 256),
+	}
+	tokenValue := token.Marshal()
+	store := EmptyStore()
+	store.AddToken(hex.EncodeToString(token.Context), token)
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"base64url": []byte(base64.URLEncoding.EncodeToString(tokenValue) + "\n"),
+		"header":    []byte("PrivateToken token=" + base64.RawURLEncoding.EncodeToString(tokenValue)),
+		"hex":       []byte(hex.EncodeToString(tokenValue)),
+		"binary":    tokenValue,
+		"store":     []byte(store.String()),
+	} {
+		fileName := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fileName, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		read, err := readRedemptionToken(fileName)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !bytes.Equal(read, tokenValue) {
+			t.Fatalf("unexpected %s token %x", name, read)
+		}
+	}
+}
+
+func TestRedemptionURL(t *testing.T) {
+	for _, test := range []struct {
+		origin, resource, url string
+	}{
+		{"origin.example", "", "https://origin.example/"},
+		{"origin.example:4568", "/index.html", "https://origin.example:4568/index.html"},
+		{"https://origin.example/a/b", "", "https://origin.example/a/b"},
+		{"http://origin.example/a/b", "c?d=1", "http://origin.example/a/c?d=1"},
+	} {
+		url, err := redemptionURL(test.origin, test.resource)
+		if err != nil || url != test.url {
+			t.Fatalf("unexpected URL %q for %q and %q: %v", url, test.origin, test.resource, err)
+		}
+	}
+}
+
+func TestRedemptionReport(t *testing.T) {
+	challenge := pat.TokenChallenge{
+		TokenType:       pat.RateLimitedTokenType,
+		IssuerName:      "issuer.example",
+		OriginInfo:      []string{"origin.example"},
+		RedemptionNonce: bytes.Repeat([]byte{5}, 32),
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "PrivateToken token=") {
+			t.Errorf("unexpected Authorization %q", req.Header.Get("Authorization"))
+		}
+		w.Header().Set("WWW-Authenticate", `PrivateToken challenge=`+base64.URLEncoding.EncodeToString(challenge.Marshal())+`, error="invalid_token", error_description="expired key"`)
+		http.Error(w, "stale token", http.StatusUnauthorized)
+	}))
+	defer origin.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+	req.Header.Set("Authorization", "PrivateToken token=AAAA")
+	resp, err := origin.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	report := newRedemptionReport(resp)
+	if report.accepted || report.status != http.StatusUnauthorized || report.body != "stale token" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(report.reasons) != 2 || report.reasons[1] != "invalid_token: expired key" {
+		t.Fatalf("unexpected reasons %q", report.reasons)
+	}
+	if len(report.challenges) != 1 || !strings.Contains(report.challenges[0], "token type 0x0003, issuer issuer.example") {
+		t.Fatalf("unexpected challenges %q", report.challenges)
+	}
+	if !strings.HasPrefix(report.String(), "Redemption refused: 401 Unauthorized\n") {
+		t.Fatalf("unexpected report text %q", report.String())
+	}
+}
@@ -0,0 +1,88 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedemptionCacheTTL = 30 * time.Second
+
+	// Cached outcomes beyond which expired entries are swept on insertion
+	redemptionCacheSweepSize = 1024
+)
+
+// redemptionOutcome is the result of redeeming a token. A zero status admits
+// the client to the resource; otherwise the redemption was refused with the
+// status and body.
+type redemptionOutcome struct {
+	status  int
+	body    string
+	headers map[string]string
+	expires time.Time
+}
+
+// redemptionCache remembers redemption outcomes by token digest so that a
+// client retrying with the same token, e.g., after a network timeout, gets
+// the same outcome instead of failing for lack of an outstanding challenge.
+type redemptionCache struct {
+	ttl time.Duration
+
+	lock     sync.Mutex
+	outcomes map[string]redemptionOutcome
+}
+
+// newRedemptionCache returns nil, disabling the cache, unless ttl is positive.
+func newRedemptionCache(ttl time.Duration) *redemptionCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &redemptionCache{
+		ttl:      ttl,
+		outcomes: make(map[string]redemptionOutcome),
+	}
+}
+
+func redemptionCacheKey(tokenEnc []byte) string {
+	digest := sha256.Sum256(tokenEnc)
+	return hex.EncodeToString(digest[:])
+}
+
+func (c *redemptionCache) lookup(tokenEnc []byte, now time.Time) (redemptionOutcome, bool) {
+	key := redemptionCacheKey(tokenEnc)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	outcome, ok := c.outcomes[key]
+	if ok && !now.Before(outcome.expires) {
+		delete(c.outcomes, key)
+		return redemptionOutcome{}, false
+	}
+	return outcome, ok
+}
+
+func (c *redemptionCache) store(tokenEnc []byte, outcome redemptionOutcome, now time.Time) {
+	key := redemptionCacheKey(tokenEnc)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.outcomes) >= redemptionCacheSweepSize {
+		for other, cached := range c.outcomes {
+			if !now.Before(cached.expires) {
+				delete(c.outcomes, other)
+			}
+		}
+	}
+	outcome.expires = now.Add(c.ttl)
+	c.outcomes[key] = outcome
+}
+
+// writeRefusal replays a refused redemption. Admitted redemptions are served
+// the resource by the caller.
+func (outcome redemptionOutcome) writeRefusal(w http.ResponseWriter) {
+	for name, value := range outcome.headers {
+		w.Header().Set(name, value)
+	}
+	http.Error(w, outcome.body, outcome.status)
+}
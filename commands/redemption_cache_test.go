@@ -0,0 +1,70 @@
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestRedemptionCache(t *testing.T) {
+	cache := newRedemptionCache(time.Minute)
+	now := time.Unix(1700000000, 0)
+	token := []byte("token")
+
+	if _, ok := cache.lookup(token, now); ok {
+		t.Fatal("expected an empty cache")
+	}
+	cache.store(token, redemptionOutcome{status: http.StatusForbidden, body: "blocked"}, now)
+	outcome, ok := cache.lookup(token, now.Add(time.Second))
+	if !ok || outcome.status != http.StatusForbidden || outcome.body != "blocked" {
+		t.Fatalf("unexpected outcome %+v", outcome)
+	}
+	if _, ok := cache.lookup([]byte("other"), now); ok {
+		t.Fatal("expected outcomes to be cached per token")
+	}
+	if _, ok := cache.lookup(token, now.Add(time.Minute)); ok {
+		t.Fatal("expected the outcome to expire")
+	}
+
+	if newRedemptionCache(0) != nil {
+		t.Fatal("expected a zero TTL to disable the cache")
+	}
+}
+
+func TestRedemptionReplay(t *testing.T) {
+	origin := newTestOrigin()
+	origin.redemptions = newRedemptionCache(time.Minute)
+	contextEnc := createTestChallengeContext(t, origin, false)
+	context, _ := hex.DecodeString(contextEnc)
+
+	token := pat.Token{
+		TokenType:     pat.RateLimitedTokenType,
+		Nonce:         make([]byte, 32),
+		Context:       context,
+		KeyID:         make([]byte, 32),
+		Authenticator: make([]byte, 256),
+	}
+	redeem := func() int {
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+		req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+		w := httptest.NewRecorder()
+		origin.handleRequest(w, req)
+		return w.Code
+	}
+
+	replays := originRedemptionReplays.Value(pat.RateLimitedTokenType)
+	if code := redeem(); code != http.StatusBadRequest {
+		t.Fatalf("expected the invalid token to be refused, got %d", code)
+	}
+	if code := redeem(); code != http.StatusBadRequest {
+		t.Fatalf("expected the retry to be refused, got %d", code)
+	}
+	if originRedemptionReplays.Value(pat.RateLimitedTokenType) != replays+1 {
+		t.Fatal("expected the retry to replay the cached outcome")
+	}
+}
@@ -0,0 +1,103 @@
+package commands
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+const (
+	redemptionHookEntryPoint = "pat_on_redemption"
+
+	// Decisions a redemption hook can return
+	redemptionDecisionAllow = "allow"
+	redemptionDecisionDeny  = "deny"
+	redemptionDecisionTag   = "tag"
+)
+
+// redemptionEvent is the metadata passed to the redemption hook after a token
+// has been cryptographically verified.
+type redemptionEvent struct {
+	TokenType       uint16   `json:"token_type"`
+	IssuerName      string   `json:"issuer_name"`
+	OriginInfo      []string `json:"origin_info"`
+	RedemptionNonce string   `json:"redemption_nonce"`
+	TokenNonce      string   `json:"token_nonce"`
+	KeyID           string   `json:"key_id"`
+	Method          string   `json:"method"`
+	Path            string   `json:"path"`
+	RemoteAddr      string   `json:"remote_addr"`
+
+	// Authorization parameters besides the token, e.g., extensions
+	AuthParams map[string]string `json:"auth_params,omitempty"`
+}
+
+// redemptionVerdict is the hook's decision. Headers are added to the response
+// regardless of the decision; Status and Body only apply to denials.
+type redemptionVerdict struct {
+	Decision string            `json:"decision"`
+	Status   int               `json:"status"`
+	Body     string            `json:"body"`
+	Tags     []string          `json:"tags"`
+	Headers  map[string]string `json:"headers"`
+}
+
+type redemptionHook struct {
+	plugin *wasmPlugin
+}
+
+func loadRedemptionHook(path string) (*redemptionHook, error) {
+	plugin, err := loadWasmPlugin(context.Background(), path, redemptionHookEntryPoint)
+	if err != nil {
+		return nil, err
+	}
+	return &redemptionHook{
+		plugin: plugin,
+	}, nil
+}
+
+func newRedemptionEvent(req *http.Request, challenge pat.TokenChallenge, token pat.Token, authParams map[string]string) redemptionEvent {
+	return redemptionEvent{
+		TokenType:       token.TokenType,
+		IssuerName:      challenge.IssuerName,
+		OriginInfo:      challenge.OriginInfo,
+		RedemptionNonce: hex.EncodeToString(challenge.RedemptionNonce),
+		TokenNonce:      hex.EncodeToString(token.Nonce),
+		KeyID:           hex.EncodeToString(token.KeyID),
+		Method:          req.Method,
+		Path:            req.URL.Path,
+		RemoteAddr:      req.RemoteAddr,
+		AuthParams:      authParams,
+	}
+}
+
+// evaluate runs the hook. A hook that returns nothing allows the redemption,
+// and one returning an unknown decision fails. Denials are answered with 403
+// unless the hook sets a status, which is clamped to an error status.
+func (h *redemptionHook) evaluate(ctx context.Context, event redemptionEvent) (redemptionVerdict, error) {
+	verdict := redemptionVerdict{
+		Decision: redemptionDecisionAllow,
+	}
+	err := h.plugin.call(ctx, redemptionHookEntryPoint, event, &verdict)
+	if err != nil {
+		return redemptionVerdict{}, err
+	}
+	switch verdict.Decision {
+	case redemptionDecisionAllow, redemptionDecisionTag:
+	case redemptionDecisionDeny:
+		switch {
+		case verdict.Status == 0:
+			verdict.Status = http.StatusForbidden
+		case verdict.Status < http.StatusBadRequest:
+			verdict.Status = http.StatusBadRequest
+		case verdict.Status > 599:
+			verdict.Status = 599
+		}
+	default:
+		return redemptionVerdict{}, fmt.Errorf("Redemption hook returned unknown decision %q", verdict.Decision)
+	}
+	return verdict, nil
+}
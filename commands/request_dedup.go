@@ -0,0 +1,230 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// What the attester does about duplicate token requests
+	dedupActionReplay = "replay"
+	dedupActionReject = "reject"
+
+	// Deduplicated requests beyond which expired entries are swept on insertion
+	requestDedupSweepSize = 1024
+)
+
+// dedupResponse is a response to a token request, kept to be replayed.
+type dedupResponse struct {
+	status  int
+	headers http.Header
+	body    []byte
+}
+
+// dedupEntry is a token request in flight or answered within the window. done
+// is closed once the first request was answered; response is nil if it was
+// not answered with 200, in which case the entry is dropped.
+type dedupEntry struct {
+	done     chan struct{}
+	response *dedupResponse
+	expires  time.Time
+}
+
+// requestDedup detects byte-identical token requests of a client within a
+// window, so that retry storms of a client reach the issuer once and are
+// counted against the client's limits once. Duplicates are either served the
+// response to the first request or refused.
+type requestDedup struct {
+	window time.Duration
+	action string // dedupActionReplay or dedupActionReject
+
+	lock    sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+// newRequestDedup returns nil, disabling deduplication, unless window is
+// positive.
+func newRequestDedup(window time.Duration, action string) *requestDedup {
+	if window <= 0 {
+		return nil
+	}
+	return &requestDedup{
+		window:  window,
+		action:  action,
+		entries: make(map[string]*dedupEntry),
+	}
+}
+
+// requestDedupKey digests everything the attester's response depends on: the
+// client, the target issuer, the rate-limited issuance headers, and the
+// TokenRequest.
+func requestDedupKey(req *http.Request, body []byte) string {
+	hash := sha256.New()
+	for _, value := range []string{
+		req.Header.Get(headerClientID),
+		req.URL.Query().Get("issuer"),
+		req.Header.Get(headerTokenOrigin),
+		req.Header.Get(headerClientKey),
+		req.Header.Get(headerRequestBlind),
+	} {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// begin returns the entry of an identical request seen within the window, or
+// records a new entry for the request and reports that the caller handles it.
+func (d *requestDedup) begin(key string, now time.Time) (*dedupEntry, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if entry, ok := d.entries[key]; ok {
+		select {
+		case <-entry.done:
+			if now.Before(entry.expires) {
+				return entry, false
+			}
+		default:
+			return entry, false
+		}
+	}
+	if len(d.entries) >= requestDedupSweepSize {
+		for other, entry := range d.entries {
+			select {
+			case <-entry.done:
+				if !now.Before(entry.expires) {
+					delete(d.entries, other)
+				}
+			default:
+			}
+		}
+	}
+	entry := &dedupEntry{done: make(chan struct{})}
+	d.entries[key] = entry
+	return entry, true
+}
+
+// finish records the response to the request of the entry. Only successful
+// responses are kept, so that requests refused or failed for transient reasons
+// can be retried.
+func (d *requestDedup) finish(key string, entry *dedupEntry, response *dedupResponse, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if response != nil && response.status == http.StatusOK {
+		entry.response = response
+		entry.expires = now.Add(d.window)
+	} else if d.entries[key] == entry {
+		delete(d.entries, key)
+	}
+	close(entry.done)
+}
+
+// dedupRecorder buffers a response to keep it for duplicates.
+type dedupRecorder struct {
+	http.ResponseWriter
+	response dedupResponse
+}
+
+func (r *dedupRecorder) WriteHeader(status int) {
+	if r.response.status == 0 {
+		r.response.status = status
+		r.response.headers = r.ResponseWriter.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *dedupRecorder) Write(data []byte) (int, error) {
+	if r.response.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.response.body = append(r.response.body, data...)
+	return r.ResponseWriter.Write(data)
+}
+
+// Unwrap lets http.ResponseController flush the wrapped writer.
+func (r *dedupRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// replay writes the response to an earlier identical request.
+func (response *dedupResponse) replay(w http.ResponseWriter) {
+	for name, values := range response.headers {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(response.status)
+	w.Write(response.body)
+}
+
+// wrap deduplicates the token requests handled by handler. Concurrent
+// duplicates wait for the first request to be answered, and are handled
+// themselves if it was not answered with 200.
+func (d *requestDedup) wrap(handler http.HandlerFunc) http.HandlerFunc {
+	if d == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			handler(w, req)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			log.Println("Failed reading client request body:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := requestDedupKey(req, body)
+		var tokenType uint16
+		if len(body) >= tokenTypeLength {
+			tokenType = labelTokenType(binary.BigEndian.Uint16(body))
+		}
+
+		for {
+			entry, first := d.begin(key, time.Now())
+			if first {
+				req.Body = ioutil.NopCloser(bytes.NewReader(body))
+				recorder := &dedupRecorder{ResponseWriter: w}
+				completed := false
+				defer func() {
+					// Aborted responses are not kept
+					if !completed {
+						d.finish(key, entry, nil, time.Now())
+					}
+				}()
+				handler(recorder, req)
+				completed = true
+				d.finish(key, entry, &recorder.response, time.Now())
+				return
+			}
+
+			if d.action == dedupActionReject {
+				log.Println("Refusing duplicate token request from", req.RemoteAddr)
+				attesterDuplicateRequests.Inc(tokenType, "rejected")
+				http.Error(w, ErrDuplicateRequest.Error(), http.StatusConflict)
+				return
+			}
+			select {
+			case <-entry.done:
+			case <-req.Context().Done():
+				return
+			}
+			if entry.response != nil {
+				log.Println("Replaying response to duplicate token request from", req.RemoteAddr)
+				attesterDuplicateRequests.Inc(tokenType, "replayed")
+				entry.response.replay(w)
+				return
+			}
+			// The first request failed and its entry is gone, try again
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package commands
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestRequestDedup(t *testing.T) {
+	calls := 0
+	status := http.StatusOK
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if status != http.StatusOK {
+			http.Error(w, "issuer unavailable", status)
+			return
+		}
+		w.Header().Set(headerIssuanceReceipt, "receipt")
+		w.Header().Set("content-type", tokenResponseMediaType)
+		w.Write([]byte{byte(calls)})
+	}
+	send := func(dedup *requestDedup, clientID string) *httptest.ResponseRecorder {
+		body := []byte{0x00, 0x03, 1, 2, 3}
+		req := httptest.NewRequest(http.MethodPost, "/token-request?issuer=issuer.example", bytes.NewReader(body))
+		req.Header.Set(headerClientID, clientID)
+		w := httptest.NewRecorder()
+		dedup.wrap(handler)(w, req)
+		return w
+	}
+
+	if newRequestDedup(0, dedupActionReplay) != nil {
+		t.Fatal("expected a zero window to disable deduplication")
+	}
+
+	dedup := newRequestDedup(time.Minute, dedupActionReplay)
+	replayed := attesterDuplicateRequests.Value(pat.RateLimitedTokenType, "replayed")
+	first := send(dedup, "alice")
+	second := send(dedup, "alice")
+	if calls != 1 {
+		t.Fatalf("expected the duplicate not to be handled, got %d calls", calls)
+	}
+	if second.Code != http.StatusOK || !bytes.Equal(second.Body.Bytes(), first.Body.Bytes()) || second.Header().Get(headerIssuanceReceipt) != "receipt" {
+		t.Fatalf("expected the response to be replayed, got %d %x %v", second.Code, second.Body.Bytes(), second.Header())
+	}
+	if attesterDuplicateRequests.Value(pat.RateLimitedTokenType, "replayed") != replayed+1 {
+		t.Fatal("expected the replay to be counted")
+	}
+
+	// Other clients are handled separately
+	send(dedup, "bob")
+	if calls != 2 {
+		t.Fatalf("expected requests of another client to be handled, got %d calls", calls)
+	}
+
+	// Failed requests are not kept, so that clients can retry
+	status = http.StatusBadGateway
+	send(dedup, "carol")
+	status = http.StatusOK
+	if w := send(dedup, "carol"); w.Code != http.StatusOK || calls != 4 {
+		t.Fatalf("expected a retry after a failure to be handled, got %d after %d calls", w.Code, calls)
+	}
+
+	// Entries expire after the window
+	for _, entry := range dedup.entries {
+		entry.expires = time.Now()
+	}
+	send(dedup, "alice")
+	if calls != 5 {
+		t.Fatalf("expected an expired entry to be handled again, got %d calls", calls)
+	}
+
+	reject := newRequestDedup(time.Minute, dedupActionReject)
+	send(reject, "alice")
+	if w := send(reject, "alice"); w.Code != http.StatusConflict || calls != 6 {
+		t.Fatalf("expected the duplicate to be refused, got %d after %d calls", w.Code, calls)
+	}
+}
+
+func TestRequestDedupConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	calls := 0
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		<-release
+		w.Write([]byte("response"))
+	}
+	dedup := newRequestDedup(time.Minute, dedupActionReplay)
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 4)
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/token-request?issuer=issuer.example", bytes.NewReader([]byte{0x00, 0x02, 1}))
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			dedup.wrap(handler)(w, req)
+		}(responses[i])
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("expected concurrent duplicates to wait for the first request, got %d calls", calls)
+	}
+	for _, w := range responses {
+		if w.Code != http.StatusOK || w.Body.String() != "response" {
+			t.Fatalf("unexpected response %d %q", w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Headers of HTTP Message Signatures (RFC 9421) and digests (RFC 9530)
+	headerSignatureInput = "Signature-Input"
+	headerSignature      = "Signature"
+	headerContentDigest  = "Content-Digest"
+
+	// Label of the attester's signature among those of the request
+	attesterSignatureLabel = "attester"
+
+	// Largest difference between the creation time of attester signatures
+	// and the local clock unless configured otherwise
+	defaultAttesterSignatureSkew = 5 * time.Minute
+)
+
+var (
+	ErrMissingAttesterSignature = errors.New("Missing attester signature")
+	ErrInvalidAttesterSignature = errors.New("Invalid attester signature")
+)
+
+// Components of forwarded token requests covered by attester signatures
+var attesterSignatureComponents = []string{"@method", "@authority", "@path", "content-type", "content-digest"}
+
+// requestSigner signs the token requests an attester forwards with an Ed25519
+// key, so that issuers can tell which attester forwarded them without mTLS.
+// A nil signer leaves requests unsigned.
+type requestSigner struct {
+	keyID string
+	key   ed25519.PrivateKey
+}
+
+// newRequestSigner returns a signer with the key in the file, or nil if
+// fileName is empty. The key ID defaults to the hex-encoded public key.
+func newRequestSigner(fileName, keyID string) (*requestSigner, error) {
+	if fileName == "" {
+		if keyID != "" {
+			return nil, fmt.Errorf("Invalid request signing key ID, no request signing key")
+		}
+		return nil, nil
+	}
+	key, err := loadEd25519SigningKey(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if keyID == "" {
+		keyID = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	}
+	if !validSignatureKeyID(keyID) {
+		return nil, fmt.Errorf("Invalid request signing key ID %q", keyID)
+	}
+	return &requestSigner{keyID: keyID, key: key}, nil
+}
+
+// validSignatureKeyID accepts key IDs that are sf-strings needing no escapes.
+func validSignatureKeyID(keyID string) bool {
+	if keyID == "" {
+		return false
+	}
+	for _, c := range keyID {
+		if c < 0x20 || c > 0x7e || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// sign adds the Content-Digest of the body and the attester's signature over
+// attesterSignatureComponents to the request.
+func (s *requestSigner) sign(req *http.Request, body []byte, now time.Time) error {
+	if s == nil {
+		return nil
+	}
+	req.Header.Set(headerContentDigest, contentDigest(body))
+	quoted := make([]string, len(attesterSignatureComponents))
+	for i, component := range attesterSignatureComponents {
+		quoted[i] = `"` + component + `"`
+	}
+	params := fmt.Sprintf(`(%s);created=%d;keyid="%s";alg="ed25519"`, strings.Join(quoted, " "), now.Unix(), s.keyID)
+	base, err := signatureBase(req, attesterSignatureComponents, params)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(headerSignatureInput, attesterSignatureLabel+"="+params)
+	req.Header.Set(headerSignature, attesterSignatureLabel+"="+marshalStructuredBinary(ed25519.Sign(s.key, base)))
+	return nil
+}
+
+// contentDigest returns the sha-256 Content-Digest of the body.
+func contentDigest(body []byte) string {
+	digest := sha256.Sum256(body)
+	return "sha-256=" + marshalStructuredBinary(digest[:])
+}
+
+// requestAuthority returns the target host of the request, lowercased and
+// without the default port of its scheme.
+func requestAuthority(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+	}
+	host = strings.ToLower(host)
+	if scheme == "https" {
+		return strings.TrimSuffix(host, ":443")
+	}
+	return strings.TrimSuffix(host, ":80")
+}
+
+// signatureBase returns what is signed for the components of the request,
+// followed by the signature parameters, as in RFC 9421, section 2.5.
+func signatureBase(req *http.Request, components []string, params string) ([]byte, error) {
+	var base strings.Builder
+	for _, component := range components {
+		var value string
+		switch component {
+		case "@method":
+			value = req.Method
+		case "@authority":
+			value = requestAuthority(req)
+		case "@path":
+			value = req.URL.EscapedPath()
+		default:
+			if strings.HasPrefix(component, "@") {
+				return nil, fmt.Errorf("Unsupported signature component %s", component)
+			}
+			values := req.Header.Values(component)
+			if len(values) == 0 {
+				return nil, fmt.Errorf("Missing signed header %s", component)
+			}
+			trimmed := make([]string, len(values))
+			for i, v := range values {
+				trimmed[i] = strings.TrimSpace(v)
+			}
+			value = strings.Join(trimmed, ", ")
+		}
+		fmt.Fprintf(&base, "\"%s\": %s\n", component, value)
+	}
+	fmt.Fprintf(&base, "\"@signature-params\": %s", params)
+	return []byte(base.String()), nil
+}
+
+// splitUnquoted splits s at each sep outside of quoted strings.
+func splitUnquoted(s string, sep byte) []string {
+	parts := make([]string, 0)
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// dictionaryMember returns the value of the member of a structured field
+// dictionary with the key.
+func dictionaryMember(values []string, key string) (string, bool) {
+	for _, member := range splitUnquoted(strings.Join(values, ","), ',') {
+		parts := strings.SplitN(strings.TrimSpace(member), "=", 2)
+		if len(parts) == 2 && parts[0] == key {
+			return parts[1], true
+		}
+	}
+	return "", false
+}
+
+// parseSignatureInput reads the covered components and parameters of a
+// Signature-Input member.
+func parseSignatureInput(input string) ([]string, map[string]string, error) {
+	end := strings.IndexByte(input, ')')
+	if !strings.HasPrefix(input, "(") || end < 0 {
+		return nil, nil, fmt.Errorf("Invalid signature input")
+	}
+	components := make([]string, 0)
+	for _, item := range strings.Fields(input[1:end]) {
+		component, err := strconv.Unquote(item)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid signature component %s", item)
+		}
+		components = append(components, component)
+	}
+	params := make(map[string]string)
+	paramList := splitUnquoted(input[end+1:], ';')
+	if paramList[0] != "" {
+		return nil, nil, fmt.Errorf("Invalid signature input")
+	}
+	for _, param := range paramList[1:] {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("Invalid signature parameter %s", param)
+		}
+		params[parts[0]] = strings.Trim(parts[1], `"`)
+	}
+	return components, params, nil
+}
+
+// parseAttesterKeys parses <key-id>:<hex Ed25519 public key> pairs.
+func parseAttesterKeys(specs []string) (map[string]ed25519.PublicKey, error) {
+	keys := make(map[string]ed25519.PublicKey)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, ":", 2)
+		if len(parts) != 2 || !validSignatureKeyID(parts[0]) {
+			return nil, fmt.Errorf("Invalid attester key %q, expected <key-id>:<hex Ed25519 public key>", spec)
+		}
+		key, err := parseEd25519PublicKey(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid attester key %s: %w", parts[0], err)
+		}
+		if _, ok := keys[parts[0]]; ok {
+			return nil, fmt.Errorf("Duplicate attester key %s", parts[0])
+		}
+		keys[parts[0]] = key
+	}
+	return keys, nil
+}
+
+// requestSignatureVerifier checks the attester signatures of token requests
+// at the issuer. A nil verifier accepts unsigned requests.
+type requestSignatureVerifier struct {
+	keys map[string]ed25519.PublicKey
+	skew time.Duration
+	now  func() time.Time
+}
+
+func newRequestSignatureVerifier(keys map[string]ed25519.PublicKey, skew time.Duration) *requestSignatureVerifier {
+	if len(keys) == 0 {
+		return nil
+	}
+	return &requestSignatureVerifier{
+		keys: keys,
+		skew: skew,
+		now:  time.Now,
+	}
+}
+
+// verify checks the attester signature of the request with the body, and
+// returns the key ID of the attester that signed it.
+func (v *requestSignatureVerifier) verify(req *http.Request, body []byte) (string, error) {
+	input, ok := dictionaryMember(req.Header.Values(headerSignatureInput), attesterSignatureLabel)
+	if !ok {
+		return "", ErrMissingAttesterSignature
+	}
+	signatureEnc, ok := dictionaryMember(req.Header.Values(headerSignature), attesterSignatureLabel)
+	if !ok {
+		return "", ErrMissingAttesterSignature
+	}
+	components, params, err := parseSignatureInput(input)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAttesterSignature, err)
+	}
+	covered := make(map[string]bool)
+	for _, component := range components {
+		covered[component] = true
+	}
+	for _, component := range attesterSignatureComponents {
+		if !covered[component] {
+			return "", fmt.Errorf("%w: %s not covered", ErrInvalidAttesterSignature, component)
+		}
+	}
+	if alg, ok := params["alg"]; ok && alg != "ed25519" {
+		return "", fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidAttesterSignature, alg)
+	}
+	keyID := params["keyid"]
+	key, ok := v.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown key %q", ErrInvalidAttesterSignature, keyID)
+	}
+
+	created, err := strconv.ParseInt(params["created"], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid creation time", ErrInvalidAttesterSignature)
+	}
+	now, signedAt := v.now(), time.Unix(created, 0)
+	if signedAt.Before(now.Add(-v.skew)) || signedAt.After(now.Add(v.skew)) {
+		clockSkewChecks.Inc(0, skewCheckAttesterSignature, skewResultRefused)
+		return "", fmt.Errorf("%w: created at %s", ErrInvalidAttesterSignature, signedAt.UTC().Format(time.RFC3339))
+	}
+	clockSkewChecks.Inc(0, skewCheckAttesterSignature, skewResultOK)
+
+	digest, ok := dictionaryMember(req.Header.Values(headerContentDigest), "sha-256")
+	if !ok || subtle.ConstantTimeCompare([]byte("sha-256="+digest), []byte(contentDigest(body))) != 1 {
+		return "", fmt.Errorf("%w: content digest mismatch", ErrInvalidAttesterSignature)
+	}
+	signature, err := unmarshalStructuredBinary(signatureEnc)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAttesterSignature, err)
+	}
+	base, err := signatureBase(req, components, input)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidAttesterSignature, err)
+	}
+	if !ed25519.Verify(key, base, signature) {
+		return "", fmt.Errorf("%w: signature mismatch with key %s", ErrInvalidAttesterSignature, keyID)
+	}
+	return keyID, nil
+}
+
+// verifyAttesterSignature refuses token requests without a valid attester
+// signature if attester keys are configured, and logs who signed the others.
+func (i *Issuer) verifyAttesterSignature(w http.ResponseWriter, req *http.Request, body []byte) bool {
+	if i.attesterKeys == nil {
+		return true
+	}
+	keyID, err := i.attesterKeys.verify(req, body)
+	if err != nil {
+		result := "invalid"
+		if errors.Is(err, ErrMissingAttesterSignature) {
+			result = "missing"
+		}
+		log.Infoln("Refusing token request from", req.RemoteAddr+":", err)
+		issuerAttesterSignatures.Inc(0, "", result)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	log.Infoln("Token request from", req.RemoteAddr, "signed by attester", keyID)
+	issuerAttesterSignatures.Inc(0, keyID, "verified")
+	return true
+}
@@ -0,0 +1,157 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func newTestRequestSigner(t *testing.T, keyID string) *requestSigner {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "signing.key")
+	if err := ioutil.WriteFile(file, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := newRequestSigner(file, keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestParseAttesterKeys(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(nil)
+	keys, err := parseAttesterKeys([]string{"attester-1:" + hex.EncodeToString(publicKey)})
+	if err != nil || !bytes.Equal(keys["attester-1"], publicKey) {
+		t.Fatalf("unexpected keys %v, %v", keys, err)
+	}
+	for _, specs := range [][]string{
+		{"attester-1"},
+		{":" + hex.EncodeToString(publicKey)},
+		{"attester-1:00"},
+		{`"quoted":` + hex.EncodeToString(publicKey)},
+		{"attester-1:" + hex.EncodeToString(publicKey), "attester-1:" + hex.EncodeToString(publicKey)},
+	} {
+		if _, err := parseAttesterKeys(specs); err == nil {
+			t.Fatalf("expected %q to be refused", specs)
+		}
+	}
+	if signer, err := newRequestSigner("", ""); signer != nil || err != nil {
+		t.Fatalf("expected no signer, got %v, %v", signer, err)
+	}
+	if _, err := newRequestSigner("", "attester-1"); err == nil {
+		t.Fatal("expected a key ID without key to be refused")
+	}
+	signer := newTestRequestSigner(t, "")
+	if signer.keyID != hex.EncodeToString(signer.key.Public().(ed25519.PublicKey)) {
+		t.Fatalf("expected the public key as key ID, got %s", signer.keyID)
+	}
+}
+
+func TestRequestSignature(t *testing.T) {
+	signer := newTestRequestSigner(t, "attester-1")
+	verifier := newRequestSignatureVerifier(map[string]ed25519.PublicKey{
+		"attester-1": signer.key.Public().(ed25519.PublicKey),
+	}, time.Minute)
+	now := time.Unix(1700000000, 0)
+	verifier.now = func() time.Time { return now }
+
+	body := []byte{0x00, 0x02, 0x01}
+	signed := func(target string, signedAt time.Time) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", tokenRequestMediaType)
+		if err := signer.sign(req, body, signedAt); err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	req := signed("https://issuer.example/token-request", now)
+	if !strings.HasPrefix(req.Header.Get(headerSignatureInput), `attester=("@method" "@authority" "@path" "content-type" "content-digest");created=1700000000;keyid="attester-1";alg="ed25519"`) {
+		t.Fatalf("unexpected signature input %s", req.Header.Get(headerSignatureInput))
+	}
+	// Signatures of other hops are ignored
+	req.Header.Add(headerSignatureInput, `proxy=("@method");created=1700000000;keyid="proxy"`)
+	req.Header.Add(headerSignature, "proxy=:AAAA:")
+	if keyID, err := verifier.verify(req, body); err != nil || keyID != "attester-1" {
+		t.Fatalf("expected a signature of attester-1, got %q, %v", keyID, err)
+	}
+	if keyID, err := verifier.verify(signed("https://issuer.example:443/token-request", now), body); err != nil || keyID != "attester-1" {
+		t.Fatalf("expected the default port to be ignored, got %q, %v", keyID, err)
+	}
+
+	if _, err := verifier.verify(signed("https://issuer.example/token-request", now), []byte{0x00, 0x02, 0x02}); !errors.Is(err, ErrInvalidAttesterSignature) {
+		t.Fatalf("expected a tampered body to be refused, got %v", err)
+	}
+	if _, err := verifier.verify(signed("https://issuer.example/token-request", now.Add(-2*time.Minute)), body); !errors.Is(err, ErrInvalidAttesterSignature) {
+		t.Fatalf("expected a stale signature to be refused, got %v", err)
+	}
+	req = signed("https://issuer.example/token-request", now)
+	req.Host = "other.example"
+	if _, err := verifier.verify(req, body); !errors.Is(err, ErrInvalidAttesterSignature) {
+		t.Fatalf("expected a signature for another authority to be refused, got %v", err)
+	}
+	req = signed("https://issuer.example/token-request", now)
+	req.Header.Set(headerSignatureInput, strings.Replace(req.Header.Get(headerSignatureInput), ` "content-digest"`, "", 1))
+	if _, err := verifier.verify(req, body); !errors.Is(err, ErrInvalidAttesterSignature) {
+		t.Fatalf("expected a signature not covering the digest to be refused, got %v", err)
+	}
+	if _, err := verifier.verify(httptest.NewRequest(http.MethodPost, "https://issuer.example/token-request", nil), body); !errors.Is(err, ErrMissingAttesterSignature) {
+		t.Fatalf("expected a missing signature, got %v", err)
+	}
+	other := newTestRequestSigner(t, "attester-1")
+	req = httptest.NewRequest(http.MethodPost, "https://issuer.example/token-request", nil)
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+	other.sign(req, body, now)
+	if _, err := verifier.verify(req, body); !errors.Is(err, ErrInvalidAttesterSignature) {
+		t.Fatalf("expected a signature with another key to be refused, got %v", err)
+	}
+}
+
+func TestIssuerAttesterSignatures(t *testing.T) {
+	signer := newTestRequestSigner(t, "attester-1")
+	issuer := newTestIssuer(t, "issuer.example")
+	issuer.attesterKeys = newRequestSignatureVerifier(map[string]ed25519.PublicKey{
+		"attester-1": signer.key.Public().(ed25519.PublicKey),
+	}, time.Minute)
+	server := httptest.NewTLSServer(http.HandlerFunc(issuer.handleIssuanceRequest))
+	defer server.Close()
+
+	forward := func(signer *requestSigner) int {
+		pool := newIssuerPool(map[string][]string{"issuer.example": {server.URL}}, time.Second)
+		pool.signer = signer
+		resp, err := pool.forward(context.Background(), server.Client(), pat.BasicPublicTokenType, "issuer.example", tokenRequestMediaType, []byte{0x00, 0x02})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := forward(nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected unsigned requests to be refused, got %d", status)
+	}
+	if status := forward(newTestRequestSigner(t, "attester-2")); status != http.StatusUnauthorized {
+		t.Fatalf("expected requests of unknown attesters to be refused, got %d", status)
+	}
+	// Signed requests reach issuance, which refuses the truncated request
+	if status := forward(signer); status != http.StatusBadRequest {
+		t.Fatalf("expected signed requests to be accepted, got %d", status)
+	}
+	if issuerAttesterSignatures.Value(0, "attester-1", "verified") == 0 || issuerAttesterSignatures.Value(0, "", "missing") == 0 {
+		t.Fatal("expected attester signatures to be counted")
+	}
+}
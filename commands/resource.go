@@ -0,0 +1,217 @@
+package commands
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	encodingGzip     = "gzip"
+	encodingBrotli   = "br"
+	encodingIdentity = "identity"
+
+	// Smaller resources are not worth compressing
+	minCompressLength = 1024
+)
+
+var (
+	// Encodings the origin can produce, in order of preference
+	supportedEncodings = []string{encodingBrotli, encodingGzip}
+
+	// Upstream response headers passed through to clients along with the
+	// resource. Content-Length and Content-Encoding are set separately since
+	// they depend on the encoding served.
+	resourceHeaders = []string{
+		"Cache-Control",
+		"Content-Disposition",
+		"Content-Language",
+		"Content-Type",
+		"ETag",
+		"Expires",
+		"Last-Modified",
+	}
+)
+
+// negotiateEncoding picks the supported content coding the client prefers
+// from its Accept-Encoding header, or "" for identity.
+func negotiateEncoding(acceptEncoding string, supported []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	weights := make(map[string]float64)
+	for _, element := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(element, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					weight = q
+				}
+			}
+		}
+		weights[coding] = weight
+	}
+
+	best, bestWeight := "", 0.0
+	for _, coding := range supported {
+		weight, ok := weights[coding]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+		if ok && weight > bestWeight {
+			best, bestWeight = coding, weight
+		}
+	}
+	return best
+}
+
+// compressibleContentType reports whether content of the given type is
+// likely to shrink when compressed.
+func compressibleContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/wasm":
+		return true
+	}
+	return false
+}
+
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	case encodingBrotli:
+		return brotli.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("Unsupported content encoding %q", encoding)
+}
+
+func newDecoder(r io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewReader(r)
+	case encodingBrotli:
+		return brotli.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("Unsupported content encoding %q", encoding)
+}
+
+// serveResource fetches the resource and relays it to the client with its
+// status and content headers. The body is passed through as is when upstream
+// already used the client's preferred encoding, compressed when upstream sent
+// it uncompressed and compress is set, and decoded otherwise.
+func serveResource(w http.ResponseWriter, req *http.Request, client *http.Client, resourceURI string, compress bool) {
+	// HEAD requests are relayed as such, so that no body is fetched
+	method := http.MethodGet
+	if req.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	resourceReq, err := http.NewRequestWithContext(req.Context(), method, resourceURI, nil)
+	if err != nil {
+		log.Debugln(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Setting Accept-Encoding explicitly also stops the transport from
+	// transparently decompressing the response
+	encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"), supportedEncodings)
+	if encoding != "" {
+		resourceReq.Header.Set("Accept-Encoding", encoding)
+	} else {
+		resourceReq.Header.Set("Accept-Encoding", encodingIdentity)
+	}
+
+	resp, err := client.Do(resourceReq)
+	if err != nil {
+		log.Debugln(err.Error())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	header := w.Header()
+	for _, name := range resourceHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+
+	body := io.Reader(resp.Body)
+	upstreamEncoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch {
+	case upstreamEncoding == "" || upstreamEncoding == encodingIdentity:
+		if compress && encoding != "" && compressibleContentType(resp.Header.Get("Content-Type")) &&
+			(resp.ContentLength < 0 || resp.ContentLength >= minCompressLength) {
+			header.Set("Content-Encoding", encoding)
+			w.WriteHeader(resp.StatusCode)
+			if method == http.MethodHead {
+				return
+			}
+			encoder, err := newEncoder(w, encoding)
+			if err != nil {
+				log.Debugln(err.Error())
+				return
+			}
+			if _, err := io.Copy(encoder, resp.Body); err != nil {
+				log.Debugln("Failed relaying resource:", err)
+			}
+			if err := encoder.Close(); err != nil {
+				log.Debugln("Failed relaying resource:", err)
+			}
+			return
+		}
+		if resp.ContentLength >= 0 {
+			header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+	case upstreamEncoding == encoding:
+		header.Set("Content-Encoding", encoding)
+		if resp.ContentLength >= 0 {
+			header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+	case method == http.MethodHead:
+		// Upstream used a coding the client did not ask for, which is
+		// removed from the body the client would get
+	default:
+		// Upstream used a coding the client did not ask for
+		body, err = newDecoder(resp.Body, upstreamEncoding)
+		if err != nil {
+			log.Debugln(err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	if method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		log.Debugln("Failed relaying resource:", err)
+	}
+}
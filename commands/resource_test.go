@@ -0,0 +1,117 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, test := range []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", encodingGzip},
+		{"gzip, deflate, br", encodingBrotli},
+		{"br;q=0.5, gzip", encodingGzip},
+		{"br;q=0, *", encodingGzip},
+		{"*;q=0", ""},
+	} {
+		if encoding := negotiateEncoding(test.acceptEncoding, supportedEncodings); encoding != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.acceptEncoding, test.expected, encoding)
+		}
+	}
+}
+
+func TestServeResource(t *testing.T) {
+	page := []byte("<html>" + strings.Repeat("private access tokens ", 200) + "</html>")
+	image := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 512)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/page.html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("ETag", `"page"`)
+			w.Write(page)
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+			w.Write(image)
+		case "/page.html.gz":
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", encodingGzip)
+			gz := gzip.NewWriter(w)
+			gz.Write(page)
+			gz.Close()
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer upstream.Close()
+
+	fetch := func(path, acceptEncoding string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		serveResource(w, req, upstream.Client(), upstream.URL+path, true)
+		return w.Result()
+	}
+	readBody := func(t *testing.T, resp *http.Response) []byte {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	// Non-HTML content keeps its type and length and is not compressed
+	resp := fetch("/image.png", "gzip, br")
+	if resp.Header.Get("Content-Type") != "image/png" || resp.Header.Get("Content-Encoding") != "" ||
+		resp.Header.Get("Content-Length") != strconv.Itoa(len(image)) || !bytes.Equal(readBody(t, resp), image) {
+		t.Fatalf("unexpected image response %v", resp.Header)
+	}
+
+	resp = fetch("/page.html", "gzip")
+	if resp.Header.Get("Content-Encoding") != encodingGzip || resp.Header.Get("ETag") != `"page"` || resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("unexpected page response %v", resp.Header)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := ioutil.ReadAll(gz); !bytes.Equal(body, page) {
+		t.Fatal("gzip body mismatch")
+	}
+
+	resp = fetch("/page.html", "br")
+	if resp.Header.Get("Content-Encoding") != encodingBrotli {
+		t.Fatalf("unexpected page response %v", resp.Header)
+	}
+	if body, _ := ioutil.ReadAll(brotli.NewReader(resp.Body)); !bytes.Equal(body, page) {
+		t.Fatal("brotli body mismatch")
+	}
+
+	// Compressed upstream content is passed through, or decoded for clients that do not accept it
+	resp = fetch("/page.html.gz", "gzip")
+	if resp.Header.Get("Content-Encoding") != encodingGzip || bytes.Equal(readBody(t, resp), page) {
+		t.Fatal("expected gzip content to be passed through")
+	}
+	resp = fetch("/page.html.gz", "")
+	if resp.Header.Get("Content-Encoding") != "" || !bytes.Equal(readBody(t, resp), page) {
+		t.Fatal("expected gzip content to be decoded")
+	}
+
+	if resp := fetch("/missing", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected upstream status to be passed through, got %d", resp.StatusCode)
+	}
+}
@@ -1,21 +1,15 @@
 package commands
 
 import (
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/hex"
-	"fmt"
-	"io"
 	"net/http"
 	"net/http/httputil"
 	"strconv"
-	"strings"
 
 	"github.com/cloudflare/pat-go"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
-	"golang.org/x/crypto/hkdf"
 )
 
 func visit(rateLimitedClient pat.RateLimitedClient, basicClient pat.BasicPublicClient, id string, clientOriginSecret []byte, origin, attester, resourceURI string, nonInteractive, crossOrigin bool, tokenType uint16, tokenCount int) error {
@@ -49,69 +43,37 @@ func visit(rateLimitedClient pat.RateLimitedClient, basicClient pat.BasicPublicC
 
 	if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "" {
 		authValue := resp.Header.Get("WWW-Authenticate")
-		if !strings.HasPrefix(authValue, privateTokenType) {
-			return fmt.Errorf("Invalid WWW-Authenticate challenge header")
-		}
-
-		var err error
-		var challengeBlob []byte
-		var tokenKeyEnc []byte
-
 		log.Debugln("Challenged:", authValue)
-		challenges := strings.Split(authValue, privateTokenType)
+		challenges, err := parseClientChallenges(authValue)
+		if err != nil {
+			return err
+		}
 		tokenChallenges := make([]string, 0)
 		for _, challenge := range challenges {
-			if len(challenge) > 0 {
-				log.Debugln("Processing PrivateToken challenge:", challenge)
-				attributes := strings.Split(challenge, ",")
-				for _, attribute := range attributes {
-					kv := strings.SplitN(attribute, "=", 2)
-					key := strings.TrimSpace(kv[0])
-					value := kv[1]
-
-					if key == authorizationAttributeChallenge {
-						challengeBlob, err = base64.URLEncoding.DecodeString(value)
-						if err != nil {
-							return err
-						}
-					} else if key == authorizationAttributeTokenKey {
-						tokenKeyEnc, err = base64.URLEncoding.DecodeString(value)
-						if err != nil {
-							return err
-						}
-					} else if key == authorizationAttributeMaxAge {
-						// Ignore this attribute for now
-					} else {
-						log.Debugln("Unknown key:", key)
-					}
+			challengeEnc := challenge.context
+			tokenChallenges = append(tokenChallenges, challengeEnc)
+
+			tokenType := challenge.tokenType()
+			if tokenType == pat.RateLimitedTokenType {
+				log.Debugln("Fetching rate-limited token...")
+				token, err := fetchRateLimitedToken(httpClient, rateLimitedClient, nil, clientOriginSecret, id, attester, origin, challenge.blob, challenge.tokenKeyEnc, nil)
+				if err != nil {
+					return err
 				}
 
-				challenge := sha256.Sum256(challengeBlob)
-				challengeEnc := hex.EncodeToString(challenge[:])
-				tokenChallenges = append(tokenChallenges, challengeEnc)
-
-				tokenType := binary.BigEndian.Uint16(challengeBlob)
-				if tokenType == pat.RateLimitedTokenType {
-					log.Debugln("Fetching rate-limited token...")
-					token, err := fetchRateLimitedToken(rateLimitedClient, clientOriginSecret, id, attester, origin, challengeBlob, tokenKeyEnc)
-					if err != nil {
-						return err
-					}
-
-					log.Debugf("Adding token for challenge %s to the store\n", challengeEnc)
-					tokenStore.AddToken(challengeEnc, token)
-					log.Debugln("TokenStore contents:", tokenStore.String())
-				} else {
-					// log.Println("Fetching basic token...")
-					token, err := fetchBasicToken(basicClient, attester, challengeBlob, tokenKeyEnc)
-					if err != nil {
-						return err
-					}
-
-					log.Debugf("Adding token for challenge %s to the store\n", challengeEnc)
-					tokenStore.AddToken(challengeEnc, token)
-					log.Debugln("TokenStore contents:", tokenStore.String())
+				log.Debugf("Adding token for challenge %s to the store\n", challengeEnc)
+				tokenStore.AddToken(challengeEnc, token)
+				log.Debugln("TokenStore contents:", tokenStore.String())
+			} else {
+				// log.Println("Fetching basic token...")
+				token, err := fetchBasicToken(httpClient, basicClient, attester, challenge.blob, challenge.tokenKeyEnc)
+				if err != nil {
+					return err
 				}
+
+				log.Debugf("Adding token for challenge %s to the store\n", challengeEnc)
+				tokenStore.AddToken(challengeEnc, token)
+				log.Debugln("TokenStore contents:", tokenStore.String())
 			}
 		}
 
@@ -158,15 +120,7 @@ func runRunner(c *cli.Context) error {
 		return err
 	}
 
-	clientRequestSecret := make([]byte, 32)
-	clientOriginSecret := make([]byte, 32)
-	hkdf := hkdf.New(sha256.New, clientSecret, nil, []byte("PAT demo"))
-	if _, err := io.ReadFull(hkdf, clientRequestSecret); err != nil {
-		panic(err)
-	}
-	if _, err := io.ReadFull(hkdf, clientOriginSecret); err != nil {
-		panic(err)
-	}
+	clientRequestSecret, clientOriginSecret := deriveClientSecrets(clientSecret)
 
 	rateLimitedClient := pat.CreateRateLimitedClientFromSecret(clientRequestSecret)
 	basicClient := pat.NewBasicPublicClient()
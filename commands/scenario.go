@@ -0,0 +1,478 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Actions of scenario steps
+	scenarioChallenge = "challenge"
+	scenarioIssue     = "issue"
+	scenarioRedeem    = "redeem"
+	scenarioMalformed = "malformed"
+
+	// Kinds of malformed redemptions
+	malformedRandom      = "random"
+	malformedUnknownType = "unknown-type"
+	malformedForged      = "forged"
+	malformedTruncated   = "truncated"
+	malformedEncoding    = "bad-encoding"
+	malformedScheme      = "bad-scheme"
+)
+
+var (
+	// Token types scenarios and the client refer to by name
+	tokenTypeNames = map[string]uint16{
+		"private":      pat.BasicPrivateTokenType,
+		"basic":        pat.BasicPublicTokenType,
+		"rate-limited": pat.RateLimitedTokenType,
+		"ed25519":      ed25519TokenType,
+	}
+)
+
+// scenario is a replayable sequence of client interactions with an origin and
+// attester, read from YAML.
+type scenario struct {
+	Name     string         `yaml:"name"`
+	Origin   string         `yaml:"origin"`
+	Attester string         `yaml:"attester"`
+	Resource string         `yaml:"resource"`
+	Seed     int64          `yaml:"seed"` // of the randomness in malformed tokens
+	Steps    []scenarioStep `yaml:"steps"`
+}
+
+// scenarioStep is one action of a scenario. Challenges and tokens are labeled
+// with name, and later steps refer to them by label, defaulting to the latest.
+type scenarioStep struct {
+	Action         string            `yaml:"action"`
+	Name           string            `yaml:"name"`
+	Challenge      string            `yaml:"challenge"`
+	Token          string            `yaml:"token"`
+	TokenType      string            `yaml:"token-type"`
+	NonInteractive bool              `yaml:"non-interactive"`
+	CrossOrigin    bool              `yaml:"cross-origin"`
+	Count          int               `yaml:"count"`
+	Kind           string            `yaml:"kind"`
+	Resource       string            `yaml:"resource"`
+	Headers        map[string]string `yaml:"headers"`
+	Expect         scenarioExpect    `yaml:"expect"`
+}
+
+// scenarioExpect is the outcome a step must have. Unset fields are not
+// checked.
+type scenarioExpect struct {
+	Status     int   `yaml:"status"`
+	Challenged *bool `yaml:"challenged"` // whether the response carries a PrivateToken challenge
+	Fail       bool  `yaml:"fail"`       // whether issuance is refused
+}
+
+// readScenario reads a scenario, refusing unknown keys so that typos do not
+// silently skip checks.
+func readScenario(r io.Reader) (scenario, error) {
+	s := scenario{}
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&s); err != nil {
+		return scenario{}, fmt.Errorf("Invalid scenario: %w", err)
+	}
+	if len(s.Steps) == 0 {
+		return scenario{}, fmt.Errorf("Invalid scenario: no steps")
+	}
+	for i, step := range s.Steps {
+		if err := step.validate(); err != nil {
+			return scenario{}, fmt.Errorf("Invalid scenario step %d: %w", i+1, err)
+		}
+	}
+	return s, nil
+}
+
+func (step scenarioStep) validate() error {
+	switch step.Action {
+	case scenarioChallenge, scenarioIssue, scenarioRedeem:
+	case scenarioMalformed:
+		switch step.Kind {
+		case malformedRandom, malformedUnknownType, malformedForged, malformedTruncated, malformedEncoding, malformedScheme:
+		default:
+			return fmt.Errorf("unknown malformed kind %q", step.Kind)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", step.Action)
+	}
+	if _, ok := tokenTypeNames[step.TokenType]; step.TokenType != "" && !ok {
+		return fmt.Errorf("unknown token type %q", step.TokenType)
+	}
+	if step.Count < 0 || step.Count > 10 {
+		return fmt.Errorf("invalid challenge count %d", step.Count)
+	}
+	return nil
+}
+
+// scenarioRunner executes scenario steps, keeping the challenges and tokens
+// they produce.
+type scenarioRunner struct {
+	httpClient         *http.Client
+	rateLimitedClient  pat.RateLimitedClient
+	basicClient        pat.BasicPublicClient
+	clientOriginSecret []byte
+	clientID           string
+	origin             string
+	attester           string
+	resource           string
+	rnd                *mathrand.Rand
+
+	challenges    map[string][]clientChallenge
+	tokens        map[string][]byte
+	lastChallenge string
+	lastToken     string
+}
+
+func newScenarioRunner(httpClient *http.Client, s scenario, clientSecret []byte, clientID string) *scenarioRunner {
+	clientRequestSecret, clientOriginSecret := deriveClientSecrets(clientSecret)
+	resource := s.Resource
+	if resource == "" {
+		resource = "/index.html"
+	}
+	return &scenarioRunner{
+		httpClient:         httpClient,
+		rateLimitedClient:  pat.CreateRateLimitedClientFromSecret(clientRequestSecret),
+		basicClient:        pat.NewBasicPublicClient(),
+		clientOriginSecret: clientOriginSecret,
+		clientID:           clientID,
+		origin:             s.Origin,
+		attester:           s.Attester,
+		resource:           resource,
+		rnd:                mathrand.New(mathrand.NewSource(s.Seed)),
+		challenges:         make(map[string][]clientChallenge),
+		tokens:             make(map[string][]byte),
+	}
+}
+
+// scenarioOutcome is what a step observed.
+type scenarioOutcome struct {
+	status     int
+	challenged bool
+	err        error
+}
+
+func (o scenarioOutcome) String() string {
+	if o.err != nil {
+		return "failed: " + o.err.Error()
+	}
+	if o.status == 0 {
+		return "done"
+	}
+	if o.challenged {
+		return fmt.Sprintf("status %d, challenged", o.status)
+	}
+	return fmt.Sprintf("status %d", o.status)
+}
+
+// check returns an error if the outcome does not meet the expectation.
+func (e scenarioExpect) check(outcome scenarioOutcome) error {
+	if outcome.err != nil && !e.Fail {
+		return outcome.err
+	}
+	if outcome.err == nil && e.Fail {
+		return fmt.Errorf("expected the step to fail")
+	}
+	if e.Status != 0 && outcome.status != e.Status {
+		return fmt.Errorf("expected status %d, got %d", e.Status, outcome.status)
+	}
+	if e.Challenged != nil && outcome.challenged != *e.Challenged {
+		return fmt.Errorf("expected challenged to be %v", *e.Challenged)
+	}
+	return nil
+}
+
+// label returns the label of the step's output, defaulting to its index.
+func (step scenarioStep) label(index int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return "#" + strconv.Itoa(index+1)
+}
+
+func (r *scenarioRunner) request(step scenarioStep, authValue string) (scenarioOutcome, []clientChallenge) {
+	resource := step.Resource
+	if resource == "" {
+		resource = r.resource
+	}
+	resourceURI, err := redemptionURL(r.origin, resource)
+	if err != nil {
+		return scenarioOutcome{err: err}, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, resourceURI, nil)
+	if err != nil {
+		return scenarioOutcome{err: err}, nil
+	}
+	if step.NonInteractive {
+		req.Header.Set(headerTokenAttributeNoninteractive, "true")
+	}
+	if step.CrossOrigin {
+		req.Header.Set(headerTokenAttributeCrossOrigin, "true")
+	}
+	if step.TokenType != "" {
+		req.Header.Set(headerTokenType, strconv.Itoa(int(tokenTypeNames[step.TokenType])))
+	}
+	if step.Count > 0 {
+		req.Header.Set(headerTokenAttributeChallengeCount, strconv.Itoa(step.Count))
+	}
+	for name, value := range step.Headers {
+		req.Header.Set(name, value)
+	}
+	if authValue != "" {
+		req.Header.Set("Authorization", authValue)
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return scenarioOutcome{err: err}, nil
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	outcome := scenarioOutcome{status: resp.StatusCode}
+	authValue = resp.Header.Get("WWW-Authenticate")
+	if authValue == "" {
+		return outcome, nil
+	}
+	challenges, err := parseClientChallenges(authValue)
+	if err != nil {
+		outcome.err = err
+		return outcome, nil
+	}
+	outcome.challenged = true
+	return outcome, challenges
+}
+
+// issue fetches a token for the first challenge of the step's token type, if
+// set, among the labeled challenges.
+func (r *scenarioRunner) issue(step scenarioStep) ([]byte, error) {
+	label := step.Challenge
+	if label == "" {
+		label = r.lastChallenge
+	}
+	challenges, ok := r.challenges[label]
+	if !ok {
+		return nil, fmt.Errorf("No challenge %q", label)
+	}
+	var challenge *clientChallenge
+	for i := range challenges {
+		if step.TokenType == "" || challenges[i].tokenType() == tokenTypeNames[step.TokenType] {
+			challenge = &challenges[i]
+			break
+		}
+	}
+	if challenge == nil {
+		return nil, fmt.Errorf("No %s challenge %q", step.TokenType, label)
+	}
+
+	var token pat.Token
+	var err error
+	switch challenge.tokenType() {
+	case pat.RateLimitedTokenType:
+		token, err = fetchRateLimitedToken(r.httpClient, r.rateLimitedClient, nil, r.clientOriginSecret, r.clientID, r.attester, r.origin, challenge.blob, challenge.tokenKeyEnc, nil)
+	case pat.BasicPrivateTokenType:
+		token, err = fetchPrivateToken(r.httpClient, r.attester, challenge.blob, challenge.tokenKeyEnc)
+	case ed25519TokenType:
+		token, err = fetchEd25519Token(r.httpClient, r.attester, challenge.blob, challenge.tokenKeyEnc)
+	case pat.BasicPublicTokenType:
+		token, err = fetchBasicToken(r.httpClient, r.basicClient, r.attester, challenge.blob, challenge.tokenKeyEnc)
+	default:
+		err = unsupportedTokenTypeError{role: "client", tokenType: challenge.tokenType(), supported: knownTokenTypes()}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token.Marshal(), nil
+}
+
+func (r *scenarioRunner) token(step scenarioStep) ([]byte, error) {
+	label := step.Token
+	if label == "" {
+		label = r.lastToken
+	}
+	tokenValue, ok := r.tokens[label]
+	if !ok {
+		return nil, fmt.Errorf("No token %q", label)
+	}
+	return tokenValue, nil
+}
+
+// malformed returns the Authorization header of a malformed redemption.
+func (r *scenarioRunner) malformed(step scenarioStep) (string, error) {
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		r.rnd.Read(data)
+		return data
+	}
+	switch step.Kind {
+	case malformedRandom:
+		return tokenAuthorization(random(1 + r.rnd.Intn(512))), nil
+	case malformedEncoding:
+		return privateTokenType + " token=!" + string(bytes.Repeat([]byte("A"), 64)), nil
+	case malformedScheme:
+		return "Bearer " + string(bytes.Repeat([]byte("A"), 64)), nil
+	case malformedUnknownType, malformedForged:
+		token := pat.Token{
+			TokenType:     pat.BasicPublicTokenType,
+			Nonce:         random(32),
+			Context:       random(32),
+			KeyID:         random(32),
+			Authenticator: random(256),
+		}
+		if step.Kind == malformedUnknownType {
+			token.TokenType = 0xFFFF
+		}
+		return tokenAuthorization(token.Marshal()), nil
+	}
+
+	tokenValue, err := r.token(step)
+	if err != nil {
+		return "", err
+	}
+	return tokenAuthorization(tokenValue[:len(tokenValue)/2]), nil
+}
+
+// run executes a step and records the challenges and tokens it produces.
+func (r *scenarioRunner) run(index int, step scenarioStep) scenarioOutcome {
+	switch step.Action {
+	case scenarioChallenge:
+		outcome, challenges := r.request(step, "")
+		if outcome.err == nil && len(challenges) == 0 {
+			outcome.err = fmt.Errorf("Expected a challenge, got status %d", outcome.status)
+		}
+		if len(challenges) > 0 {
+			r.lastChallenge = step.label(index)
+			r.challenges[r.lastChallenge] = challenges
+		}
+		return outcome
+
+	case scenarioIssue:
+		tokenValue, err := r.issue(step)
+		if err != nil {
+			return scenarioOutcome{err: err}
+		}
+		r.lastToken = step.label(index)
+		r.tokens[r.lastToken] = tokenValue
+		return scenarioOutcome{}
+
+	case scenarioRedeem:
+		tokenValue, err := r.token(step)
+		if err != nil {
+			return scenarioOutcome{err: err}
+		}
+		outcome, _ := r.request(step, tokenAuthorization(tokenValue))
+		return outcome
+	}
+
+	authValue, err := r.malformed(step)
+	if err != nil {
+		return scenarioOutcome{err: err}
+	}
+	outcome, _ := r.request(step, authValue)
+	return outcome
+}
+
+// describe names the step in reports by its action and the challenge or token
+// it produces or redeems.
+func (step scenarioStep) describe(index int) string {
+	subject := step.Token
+	if step.Action == scenarioChallenge || step.Action == scenarioIssue {
+		subject = step.label(index)
+	}
+	if subject == "" {
+		return step.Action
+	}
+	return step.Action + " " + subject
+}
+
+// runScenario executes the steps in order, stopping at the first whose
+// outcome is not the expected one.
+func runScenario(r *scenarioRunner, s scenario, w io.Writer) error {
+	for i, step := range s.Steps {
+		outcome := r.run(i, step)
+		fmt.Fprintf(w, "Step %d (%s): %s\n", i+1, step.describe(i), outcome)
+		if err := step.Expect.check(outcome); err != nil {
+			return fmt.Errorf("Step %d (%s): %w", i+1, step.describe(i), err)
+		}
+	}
+	return nil
+}
+
+func runClientScenario(c *cli.Context) error {
+	scenarioFile := c.String("file")
+	secret := c.String("secret")
+	id := c.String("id")
+	logLevel := c.String("log")
+	useHTTP3 := c.Bool("http3")
+	useH2C := c.Bool("h2c")
+
+	if scenarioFile == "" {
+		log.Fatal("Invalid scenario file. See README for running instructions.")
+	}
+	if useHTTP3 && useH2C {
+		log.Fatal("Invalid transport, --http3 and --h2c exclude each other. See README for running instructions.")
+	}
+
+	switch logLevel {
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	}
+
+	file, err := os.Open(scenarioFile)
+	if err != nil {
+		log.Fatal("Failed opening scenario ", scenarioFile, ": ", err)
+	}
+	s, err := readScenario(file)
+	file.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if origin := c.String("origin"); origin != "" {
+		s.Origin = origin
+	}
+	if attester := c.String("attester"); attester != "" {
+		s.Attester = attester
+	}
+	if s.Origin == "" {
+		log.Fatal("Invalid origin. See README for running instructions.")
+	}
+
+	// Scenarios run as a fresh client unless given a secret
+	clientSecret := make([]byte, 32)
+	if secret != "" {
+		clientSecret, err = hex.DecodeString(secret)
+		if err != nil {
+			log.Fatal("Invalid client secret: ", err)
+		}
+	} else if _, err := rand.Read(clientSecret); err != nil {
+		return err
+	}
+
+	if s.Name != "" {
+		fmt.Println("Scenario:", s.Name)
+	}
+	runner := newScenarioRunner(newHTTPClient(useHTTP3, useH2C), s, clientSecret, id)
+	if err := runScenario(runner, s, os.Stdout); err != nil {
+		return err
+	}
+	fmt.Println("Scenario passed")
+	return nil
+}
@@ -0,0 +1,130 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+const testScenario = `
+name: replay and malformed tokens
+resource: /index.html
+seed: 7
+steps:
+  - action: challenge
+    name: first
+    token-type: basic
+    non-interactive: true
+    expect:
+      status: 401
+      challenged: true
+  - action: redeem
+    token: valid
+    expect: {status: 200}
+  - action: redeem
+    token: valid
+    expect: {status: 400}
+  - action: malformed
+    kind: truncated
+    token: valid
+    expect: {status: 400}
+  - action: malformed
+    kind: bad-scheme
+    expect: {status: 400, challenged: false}
+  - action: issue
+    challenge: missing
+    expect: {fail: true}
+`
+
+func TestReadScenario(t *testing.T) {
+	s, err := readScenario(strings.NewReader(testScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "replay and malformed tokens" || s.Seed != 7 || len(s.Steps) != 6 {
+		t.Fatalf("unexpected scenario %+v", s)
+	}
+	if step := s.Steps[0]; step.Action != scenarioChallenge || step.TokenType != "basic" || !step.NonInteractive || *step.Expect.Challenged != true {
+		t.Fatalf("unexpected step %+v", step)
+	}
+
+	for _, invalid := range []string{
+		"steps: []",
+		"steps:\n  - action: fly",
+		"steps:\n  - action: malformed\n    kind: odd",
+		"steps:\n  - action: challenge\n    token-type: premium",
+		"steps:\n  - action: challenge\n    expect: {stauts: 401}",
+	} {
+		if _, err := readScenario(strings.NewReader(invalid)); err == nil {
+			t.Fatalf("expected %q to be refused", invalid)
+		}
+	}
+}
+
+func TestRunScenario(t *testing.T) {
+	validToken := pat.Token{
+		TokenType:     pat.BasicPublicTokenType,
+		Nonce:         bytes.Repeat([]byte{1}, 32),
+		Context:       bytes.Repeat([]byte{2}, 32),
+		KeyID:         bytes.Repeat([]byte{3}, 32),
+		Authenticator: bytes.Repeat([]byte{4}, 256),
+	}
+	challenge := pat.TokenChallenge{
+		TokenType:       pat.BasicPublicTokenType,
+		IssuerName:      "issuer.example",
+		RedemptionNonce: make([]byte, 32),
+	}
+	redeemed := false
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		authValue := req.Header.Get("Authorization")
+		if authValue == "" {
+			if req.Header.Get(headerTokenType) != "2" || req.Header.Get(headerTokenAttributeNoninteractive) == "" {
+				t.Errorf("unexpected challenge request headers %v", req.Header)
+			}
+			w.Header().Set("WWW-Authenticate", privateTokenType+" challenge="+base64.URLEncoding.EncodeToString(challenge.Marshal()))
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if authValue != tokenAuthorization(validToken.Marshal()) || redeemed {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		redeemed = true
+	}))
+	defer origin.Close()
+
+	s, err := readScenario(strings.NewReader(testScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Origin = origin.URL
+	runner := newScenarioRunner(origin.Client(), s, make([]byte, 32), "default")
+	runner.tokens["valid"] = validToken.Marshal()
+
+	var out bytes.Buffer
+	if err := runScenario(runner, s, &out); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if len(runner.challenges["first"]) != 1 || runner.lastChallenge != "first" {
+		t.Fatal("expected the challenge to be kept")
+	}
+	if !strings.Contains(out.String(), "Step 3 (redeem valid): status 400\n") {
+		t.Fatalf("unexpected output %q", out.String())
+	}
+
+	// The first unexpected outcome stops the scenario
+	s.Steps[1].Expect.Status = 204
+	redeemed = false
+	out.Reset()
+	if err := runScenario(runner, s, &out); err == nil || !strings.Contains(err.Error(), "Step 2 (redeem valid): expected status 204, got 200") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if strings.Contains(out.String(), "Step 3") {
+		t.Fatal("expected later steps not to run")
+	}
+}
@@ -0,0 +1,398 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// selfTestCheck is one check of a startup self-test, exercising key material
+// the way traffic would.
+type selfTestCheck struct {
+	name string
+	run  func() error
+}
+
+// runSelfTest runs the checks in order and returns the first failure, so that
+// the role refuses to serve with corrupted or mismatched keys.
+func runSelfTest(role string, checks []selfTestCheck) error {
+	for _, check := range checks {
+		start := time.Now()
+		err := check.run()
+		result := "passed"
+		if err != nil {
+			result = "failed"
+		}
+		selfTestChecks.Inc(0, role, check.name, result)
+		if err != nil {
+			return fmt.Errorf("Self-test check %s of the %s failed: %w", check.name, role, err)
+		}
+		log.Infoln("Self-test check", check.name, "of the", role, "passed in", time.Since(start).Round(time.Microsecond))
+	}
+	return nil
+}
+
+func equalRSAKeys(a, b *rsa.PublicKey) bool {
+	return a != nil && b != nil && a.E == b.E && a.N.Cmp(b.N) == 0
+}
+
+func selfTestNonce() []byte {
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	return nonce
+}
+
+// selfTestChecks covers the directory, issuance and verification of every
+// token type, and verification bundles.
+func (i *Issuer) selfTestChecks() []selfTestCheck {
+	checks := []selfTestCheck{
+		{"directory", i.selfTestDirectory},
+		{"basic-token", i.selfTestBasicToken},
+		{"rate-limited-token", i.selfTestRateLimitedToken},
+	}
+	if i.privateIssuer != nil {
+		checks = append(checks, selfTestCheck{"private-token", i.selfTestPrivateToken})
+	}
+	if i.ed25519Issuer != nil {
+		checks = append(checks, selfTestCheck{"ed25519-token", i.selfTestEd25519Token})
+	}
+	if i.bundleKey != nil {
+		checks = append(checks, selfTestCheck{"verification-bundle", i.selfTestVerificationBundle})
+	}
+	return checks
+}
+
+// selfTestDirectory parses the directory and encapsulation key as origins do
+// and compares them with the keys in use.
+func (i *Issuer) selfTestDirectory() error {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	config, err := i.config()
+	if err != nil {
+		return err
+	}
+	configEnc, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	parsed := IssuerConfig{}
+	if err := json.Unmarshal(configEnc, &parsed); err != nil {
+		return err
+	}
+	keys := issuerTokenKeys{}
+	for _, tokenKey := range parsed.TokenKeys {
+		tokenKeyEnc, err := base64.URLEncoding.DecodeString(tokenKey.TokenKey)
+		if err != nil {
+			return err
+		}
+		if err := keys.parseTokenKey(tokenKey.TokenType, tokenKeyEnc); err != nil {
+			return err
+		}
+	}
+	if !equalRSAKeys(keys.basicValidationKey, i.basicIssuer.TokenKey()) {
+		return fmt.Errorf("Directory basic token key does not match the issuer's")
+	}
+	if !equalRSAKeys(keys.rateLimitedTokenKey, i.rateLimitedIssuer.TokenKey()) {
+		return fmt.Errorf("Directory rate-limited token key does not match the issuer's")
+	}
+	if i.privateIssuer != nil {
+		privateTokenKeyEnc, err := i.privateIssuer.TokenKey().MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(keys.privateTokenKeyEnc, privateTokenKeyEnc) {
+			return fmt.Errorf("Directory private token key does not match the issuer's")
+		}
+	}
+	if i.ed25519Issuer != nil && !bytes.Equal(keys.ed25519TokenKey, i.ed25519Issuer.TokenKey()) {
+		return fmt.Errorf("Directory Ed25519 token key does not match the issuer's")
+	}
+
+	nameKeyEnc := i.rateLimitedIssuer.NameKey().Marshal()
+	nameKey, err := pat.UnmarshalEncapKey(nameKeyEnc)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(nameKey.Marshal(), nameKeyEnc) {
+		return fmt.Errorf("Encapsulation key does not round-trip")
+	}
+	return nil
+}
+
+// selfTestBasicToken issues a basic token and verifies it.
+func (i *Issuer) selfTestBasicToken() error {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	tokenKey := i.basicIssuer.TokenKey()
+	tokenKeyEnc, err := marshalTokenKey(tokenKey, false)
+	if err != nil {
+		return err
+	}
+	tokenKeyID := sha256.Sum256(tokenKeyEnc)
+	challenge := pat.TokenChallenge{
+		TokenType:       pat.BasicPublicTokenType,
+		IssuerName:      i.name,
+		RedemptionNonce: selfTestNonce(),
+	}
+	state, err := pat.NewBasicPublicClient().CreateTokenRequest(challenge.Marshal(), selfTestNonce(), tokenKeyID[:], tokenKey)
+	if err != nil {
+		return err
+	}
+	tokenResponse, err := i.basicIssuer.Evaluate(state.Request())
+	if err != nil {
+		return err
+	}
+	token, err := state.FinalizeToken(tokenResponse)
+	if err != nil {
+		return err
+	}
+	return verifyPublicToken(tokenKey, token)
+}
+
+// selfTestRateLimitedToken issues a rate-limited token for the first origin,
+// encrypting the origin name to the encapsulation key, and verifies it.
+func (i *Issuer) selfTestRateLimitedToken() error {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	if len(i.origins) == 0 {
+		return fmt.Errorf("No origins to issue rate-limited tokens for")
+	}
+	tokenKey := i.rateLimitedIssuer.TokenKey()
+	tokenKeyEnc, err := marshalTokenKey(tokenKey, false)
+	if err != nil {
+		return err
+	}
+	tokenKeyID := sha256.Sum256(tokenKeyEnc)
+	challenge := pat.TokenChallenge{
+		TokenType:       pat.RateLimitedTokenType,
+		IssuerName:      i.name,
+		OriginInfo:      []string{i.origins[0]},
+		RedemptionNonce: selfTestNonce(),
+	}
+	client := pat.CreateRateLimitedClientFromSecret(selfTestNonce())
+	blind := make([]byte, clientBlindLength)
+	rand.Read(blind)
+	state, err := client.CreateTokenRequest(challenge.Marshal(), selfTestNonce(), blind, tokenKeyID[:], tokenKey, i.origins[0], i.rateLimitedIssuer.NameKey())
+	if err != nil {
+		return err
+	}
+	tokenResponse, _, err := i.rateLimitedIssuer.Evaluate(state.Request())
+	if err != nil {
+		return err
+	}
+	token, err := state.FinalizeToken(tokenResponse)
+	if err != nil {
+		return err
+	}
+	return verifyPublicToken(tokenKey, token)
+}
+
+// selfTestPrivateToken issues a private token through the wire encoding of its
+// request, and verifies it.
+func (i *Issuer) selfTestPrivateToken() error {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	tokenKeyEnc, err := i.privateIssuer.TokenKey().MarshalBinary()
+	if err != nil {
+		return err
+	}
+	challenge := pat.TokenChallenge{
+		TokenType:       pat.BasicPrivateTokenType,
+		IssuerName:      i.name,
+		RedemptionNonce: selfTestNonce(),
+	}
+	state, err := pat.NewBasicPrivateClient().CreateTokenRequest(challenge.Marshal(), selfTestNonce(), privateTokenKeyID(tokenKeyEnc), i.privateIssuer.TokenKey())
+	if err != nil {
+		return err
+	}
+	request, err := unmarshalPrivateTokenRequest(state.Request().Marshal())
+	if err != nil {
+		return err
+	}
+	tokenResponse, err := evaluatePrivateTokenRequest(i.privateIssuer, request)
+	if err != nil {
+		return err
+	}
+	token, err := state.FinalizeToken(tokenResponse)
+	if err != nil {
+		return err
+	}
+	return i.privateIssuer.Verify(token)
+}
+
+// selfTestEd25519Token signs an experimental Ed25519 token and verifies it.
+func (i *Issuer) selfTestEd25519Token() error {
+	tokenKey := i.ed25519Issuer.TokenKey()
+	keyID := ed25519TokenKeyID(tokenKey)
+	context := sha256.Sum256(selfTestNonce())
+	request := ed25519TokenRequest{
+		tokenKeyID: keyID[len(keyID)-1],
+		nonce:      selfTestNonce(),
+		context:    context[:],
+	}
+	signature, err := i.ed25519Issuer.Evaluate(request)
+	if err != nil {
+		return err
+	}
+	return verifyEd25519Token(tokenKey, pat.Token{
+		TokenType:     ed25519TokenType,
+		Nonce:         request.nonce,
+		Context:       request.context,
+		KeyID:         keyID,
+		Authenticator: signature,
+	})
+}
+
+// selfTestVerificationBundle signs a verification bundle and opens it as
+// origins do.
+func (i *Issuer) selfTestVerificationBundle() error {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	now := time.Now()
+	bundle, err := i.verificationBundle(now)
+	if err != nil {
+		return err
+	}
+	signed, err := signVerificationBundle(bundle, i.bundleKey)
+	if err != nil {
+		return err
+	}
+	opened, err := openVerificationBundle(signed, i.name, i.bundleKey.Public().(ed25519.PublicKey), now, 0)
+	if err != nil {
+		return err
+	}
+	keys, err := opened.tokenKeys()
+	if err != nil {
+		return err
+	}
+	if !equalRSAKeys(keys.rateLimitedTokenKey, i.rateLimitedIssuer.TokenKey()) {
+		return fmt.Errorf("Verification bundle token key does not match the issuer's")
+	}
+	return nil
+}
+
+// selfTestChecks covers the issuance receipt signing key.
+func (a TestAttester) selfTestChecks() []selfTestCheck {
+	checks := make([]selfTestCheck, 0)
+	if a.receiptKey != nil {
+		checks = append(checks, selfTestCheck{"issuance-receipt", a.selfTestIssuanceReceipt})
+	}
+	return checks
+}
+
+// selfTestIssuanceReceipt signs a receipt and opens it as clients do.
+func (a TestAttester) selfTestIssuanceReceipt() error {
+	receipt := issuanceReceipt{
+		TokenType:  pat.RateLimitedTokenType,
+		OriginHash: make([]byte, sha256.Size),
+		IssuedAt:   uint64(time.Now().Unix()),
+	}
+	opened, err := openIssuanceReceipt(signIssuanceReceipt(receipt, a.receiptKey), a.receiptKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return err
+	}
+	if opened.IssuedAt != receipt.IssuedAt {
+		return fmt.Errorf("Issuance receipt does not round-trip")
+	}
+	return nil
+}
+
+// selfTestChecks covers the issuer keys the origin loaded and its epoch and
+// signed challenges.
+func (o *Origin) selfTestChecks() []selfTestCheck {
+	checks := []selfTestCheck{
+		{"issuer-keys", o.selfTestIssuerKeys},
+	}
+	if o.epochChallenger != nil {
+		checks = append(checks, selfTestCheck{"epoch-challenge", o.selfTestEpochChallenge})
+	}
+	if o.challengeSigner != nil {
+		checks = append(checks, selfTestCheck{"signed-challenge", o.selfTestSignedChallenge})
+	}
+	return checks
+}
+
+// selfTestIssuerKeys checks that the directory, or verification bundle, held
+// keys for the token types challenged for, and that they re-parse.
+func (o *Origin) selfTestIssuerKeys() error {
+	keys := o.issuerKeys.current()
+	for _, tokenKey := range []struct {
+		name string
+		enc  []byte
+		key  *rsa.PublicKey
+	}{
+		{"basic", keys.basicTokenKeyEnc, keys.basicValidationKey},
+		{"rate-limited", keys.rateLimitedTokenKeyEnc, keys.rateLimitedTokenKey},
+	} {
+		if tokenKey.key == nil {
+			return fmt.Errorf("No %s token key from issuer %s", tokenKey.name, o.issuerName)
+		}
+		parsed, err := pat.UnmarshalTokenKey(tokenKey.enc)
+		if err != nil {
+			return err
+		}
+		if !equalRSAKeys(parsed, tokenKey.key) {
+			return fmt.Errorf("The %s token key does not round-trip", tokenKey.name)
+		}
+	}
+	encapKeyEnc := keys.encapKey.Marshal()
+	encapKey, err := pat.UnmarshalEncapKey(encapKeyEnc)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(encapKey.Marshal(), encapKeyEnc) {
+		return fmt.Errorf("Encapsulation key does not round-trip")
+	}
+	if o.issuerKeys.bundleKey != nil && keys.bundleIssuedAt == 0 {
+		return fmt.Errorf("No verification bundle from issuer %s", o.issuerName)
+	}
+	return nil
+}
+
+// selfTestEpochChallenge matches a challenge of the current epoch.
+func (o *Origin) selfTestEpochChallenge() error {
+	now := time.Now()
+	challenge := pat.TokenChallenge{
+		TokenType:       pat.BasicPublicTokenType,
+		IssuerName:      o.issuerName,
+		OriginInfo:      o.originInfo(),
+		RedemptionNonce: o.epochChallenger.nonce(o.originName, o.epochChallenger.epoch(now)),
+	}
+	context := sha256.Sum256(challenge.Marshal())
+	if _, ok := o.epochChallenger.match(fmt.Sprintf("%x", context), o.issuerName, o.originName, o.originInfo(), []uint16{challenge.TokenType}, now); !ok {
+		return fmt.Errorf("Epoch challenge does not match")
+	}
+	return nil
+}
+
+// selfTestSignedChallenge matches a token for a freshly signed challenge.
+func (o *Origin) selfTestSignedChallenge() error {
+	challenge, err := o.signedChallenge(pat.TokenChallenge{
+		TokenType:  pat.BasicPublicTokenType,
+		IssuerName: o.issuerName,
+		OriginInfo: o.originInfo(),
+	})
+	if err != nil {
+		return err
+	}
+	challengeEnc := challenge.Marshal()
+	context := sha256.Sum256(challengeEnc)
+	if _, err := o.matchSignedChallenge(challengeEnc, pat.Token{TokenType: challenge.TokenType, Context: context[:]}); err != nil {
+		return fmt.Errorf("Signed challenge does not match: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestIssuerSelfTest(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	issuer.origins = []string{"origin.example"}
+	issuer.rateLimitedIssuer.AddOrigin("origin.example")
+	issuer.bundleKey, _ = loadEd25519SigningKey("")
+	issuer.ed25519Issuer, _ = newEd25519Issuer()
+
+	checks := issuer.selfTestChecks()
+	if len(checks) != 5 {
+		t.Fatalf("expected every check to run, got %d", len(checks))
+	}
+	passed := selfTestChecks.Value(0, "issuer", "rate-limited-token", "passed")
+	if err := runSelfTest("issuer", checks); err != nil {
+		t.Fatal(err)
+	}
+	if selfTestChecks.Value(0, "issuer", "rate-limited-token", "passed") != passed+1 {
+		t.Fatal("expected the check to be counted")
+	}
+
+	// A private key whose public half was corrupted signs unverifiable tokens
+	corrupted := append(ed25519.PrivateKey{}, issuer.ed25519Issuer.key...)
+	corrupted[len(corrupted)-1] ^= 1
+	issuer.ed25519Issuer.key = corrupted
+	if err := runSelfTest("issuer", issuer.selfTestChecks()); err == nil || !strings.Contains(err.Error(), "ed25519-token") {
+		t.Fatalf("expected the Ed25519 check to fail, got %v", err)
+	}
+
+	issuer.origins = nil
+	if err := runSelfTest("issuer", issuer.selfTestChecks()); err == nil || !strings.Contains(err.Error(), "rate-limited-token") {
+		t.Fatalf("expected the rate-limited check to fail, got %v", err)
+	}
+}
+
+func TestAttesterSelfTest(t *testing.T) {
+	attester := newTestAttester(&AttesterPolicy{})
+	if len(attester.selfTestChecks()) != 0 {
+		t.Fatal("expected no checks without a receipt key")
+	}
+	attester.receiptKey, _ = loadEd25519SigningKey("")
+	if err := runSelfTest("attester", attester.selfTestChecks()); err != nil {
+		t.Fatal(err)
+	}
+
+	seed := attester.receiptKey.Seed()
+	other, _ := loadEd25519SigningKey("")
+	attester.receiptKey = append(append(ed25519.PrivateKey{}, seed...), other.Public().(ed25519.PublicKey)...)
+	if err := runSelfTest("attester", attester.selfTestChecks()); err == nil {
+		t.Fatal("expected a mismatched receipt key to fail")
+	}
+}
+
+func TestOriginSelfTest(t *testing.T) {
+	origin := newTestOrigin()
+	if err := runSelfTest("origin", origin.selfTestChecks()); err == nil || !strings.Contains(err.Error(), "No basic token key") {
+		t.Fatalf("expected missing issuer keys to fail, got %v", err)
+	}
+
+	issuer := newTestIssuer(t, "issuer.example")
+	keys := &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey()}
+	basicKeyEnc, _ := marshalTokenKey(issuer.basicIssuer.TokenKey(), false)
+	rateLimitedKeyEnc, _ := marshalTokenKey(issuer.rateLimitedIssuer.TokenKey(), false)
+	keys.parseTokenKey(int(pat.BasicPublicTokenType), basicKeyEnc)
+	keys.parseTokenKey(int(pat.RateLimitedTokenType), rateLimitedKeyEnc)
+	origin.issuerKeys = &issuerKeySource{keys: keys}
+	origin.epochChallenger, _ = newEpochChallenger(bytes.Repeat([]byte{0x42}, 32), time.Hour)
+	origin.challengeSigner, _ = newChallengeSigner(bytes.Repeat([]byte{0x43}, 32))
+	if err := runSelfTest("origin", origin.selfTestChecks()); err != nil {
+		t.Fatal(err)
+	}
+
+	origin.issuerKeys.bundleKey = issuer.rateLimitedIssuer.NameKey().Marshal()[:ed25519.PublicKeySize]
+	if err := runSelfTest("origin", origin.selfTestChecks()); err == nil {
+		t.Fatal("expected keys without a verification bundle to fail")
+	}
+}
@@ -0,0 +1,140 @@
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultReadTimeout     = 30 * time.Second
+	defaultWriteTimeout    = time.Minute
+	defaultIdleTimeout     = 2 * time.Minute
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// serverFlags configure the HTTP server of every role.
+var serverFlags = []cli.Flag{
+	cli.DurationFlag{
+		Name:  "read-timeout",
+		Value: defaultReadTimeout,
+		Usage: "Time to read a request, including its body, no limit if zero",
+	},
+	cli.DurationFlag{
+		Name:  "write-timeout",
+		Value: defaultWriteTimeout,
+		Usage: "Time to write a response once its request was read, no limit if zero",
+	},
+	cli.DurationFlag{
+		Name:  "idle-timeout",
+		Value: defaultIdleTimeout,
+		Usage: "Time to keep idle keep-alive connections open",
+	},
+	cli.BoolFlag{
+		Name:  "print-config",
+		Usage: "Print the effective configuration, secrets redacted, and exit",
+	},
+	cli.StringFlag{
+		Name:  "metrics-addr",
+		Usage: "Address to serve Prometheus metrics at /metrics on over plain HTTP, e.g., :9090, disabled if unset",
+	},
+	cli.DurationFlag{
+		Name:  "shutdown-timeout",
+		Value: defaultShutdownTimeout,
+		Usage: "Time to drain in-flight requests on SIGINT or SIGTERM before closing connections",
+	},
+}
+
+type serverOptions struct {
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	shutdownTimeout time.Duration
+	http3           bool
+	h2c             bool   // serves HTTP/2 in cleartext instead of TLS
+	metricsAddr     string // serves /metrics if set
+}
+
+func serverOptionsFromFlags(c *cli.Context) serverOptions {
+	return serverOptions{
+		readTimeout:     c.Duration("read-timeout"),
+		writeTimeout:    c.Duration("write-timeout"),
+		idleTimeout:     c.Duration("idle-timeout"),
+		shutdownTimeout: c.Duration("shutdown-timeout"),
+		http3:           c.Bool("http3"),
+		h2c:             c.Bool("h2c"),
+		metricsAddr:     c.String("metrics-addr"),
+	}
+}
+
+func (o serverOptions) validate() error {
+	if o.readTimeout < 0 || o.writeTimeout < 0 || o.idleTimeout < 0 {
+		return fmt.Errorf("Invalid server timeout")
+	}
+	if o.shutdownTimeout <= 0 {
+		return fmt.Errorf("Invalid shutdown timeout")
+	}
+	if o.http3 && o.h2c {
+		return fmt.Errorf("Invalid transport, HTTP/3 requires TLS and cannot be combined with h2c")
+	}
+	return nil
+}
+
+// newServer creates the HTTP server of a role, serving its own mux, in
+// cleartext without tlsConfig if h2c is set.
+func newServer(port string, tlsConfig *tls.Config, handler http.Handler, options serverOptions) *http.Server {
+	if options.h2c {
+		tlsConfig, handler = nil, withH2C(handler, options)
+	}
+	return &http.Server{
+		Addr:         ":" + port,
+		TLSConfig:    tlsConfig,
+		Handler:      handler,
+		ReadTimeout:  options.readTimeout,
+		WriteTimeout: options.writeTimeout,
+		IdleTimeout:  options.idleTimeout,
+	}
+}
+
+// serveMetrics serves the metrics without authentication on their own
+// listener, so that scrapers need neither TLS nor admin credentials, until
+// ctx is done.
+func serveMetrics(ctx context.Context, addr string, shutdownTimeout time.Duration) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsURI, handleMetrics)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: defaultReadTimeout,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	log.Infoln("Serving metrics on", addr+metricsURI)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorln("Failed serving metrics:", err)
+	}
+}
+
+// closeEventLog flushes and closes a file opened with openEventLog.
+func closeEventLog(w io.Writer) error {
+	file, ok := w.(*os.File)
+	if !ok || file == os.Stdout {
+		return nil
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServeTLSDrainsOnShutdown(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir, "localhost", []string{"localhost"})
+	tlsConfig, err := newServerTLSConfig(nil, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {})
+	options := serverOptions{readTimeout: time.Second, writeTimeout: 5 * time.Second, idleTimeout: time.Second, shutdownTimeout: 5 * time.Second}
+	server := newServer(port, tlsConfig, mux, options)
+	server.Addr = "127.0.0.1:" + port
+	if server.ReadTimeout != time.Second || server.WriteTimeout != 5*time.Second {
+		t.Fatalf("expected the configured timeouts, got %v and %v", server.ReadTimeout, server.WriteTimeout)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- serveTLS(ctx, server, false, options.shutdownTimeout) }()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for i := 0; ; i++ {
+		resp, err := client.Get("https://localhost:" + port + "/")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// A request in flight at shutdown completes before serveTLS returns
+	slow := make(chan int, 1)
+	go func() {
+		resp, err := client.Get("https://localhost:" + port + "/slow")
+		if err != nil {
+			slow <- 0
+			return
+		}
+		resp.Body.Close()
+		slow <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("expected shutdown to wait for the request in flight, returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if code := <-slow; code != http.StatusOK {
+		t.Fatalf("expected the request in flight to complete, got %d", code)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("expected a clean shutdown, got %v", err)
+	}
+	if _, err := client.Get("https://localhost:" + port + "/"); err == nil {
+		t.Fatal("expected new requests to be refused after shutdown")
+	}
+}
+
+func TestServerOptionsValidate(t *testing.T) {
+	valid := serverOptions{shutdownTimeout: time.Second}
+	if err := valid.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, options := range []serverOptions{{readTimeout: -time.Second, shutdownTimeout: time.Second}, {}} {
+		if err := options.validate(); err == nil {
+			t.Fatalf("expected %+v to be refused", options)
+		}
+	}
+}
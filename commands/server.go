@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Suffix used by mkcert for private key files, e.g., origin.example+3-key.pem
+	certDirKeySuffix = "-key.pem"
+	certDirSuffix    = ".pem"
+)
+
+// certificateStore holds every certificate a server can present, indexed by
+// the DNS names and IP addresses in each leaf, so that a single process can
+// serve several hostnames.
+type certificateStore struct {
+	certificates []*tls.Certificate
+	byName       map[string]*tls.Certificate
+}
+
+func newCertificateStore() *certificateStore {
+	return &certificateStore{
+		certificates: make([]*tls.Certificate, 0),
+		byName:       make(map[string]*tls.Certificate),
+	}
+}
+
+func (s *certificateStore) addKeyPair(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed loading key pair (%s, %s): %w", certFile, keyFile, err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	s.certificates = append(s.certificates, &cert)
+	names := cert.Leaf.DNSNames
+	for _, ip := range cert.Leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if _, ok := s.byName[name]; !ok {
+			log.Debugln("Serving certificate", certFile, "for", name)
+			s.byName[name] = &cert
+		}
+	}
+
+	return nil
+}
+
+// addDirectory loads every <name>.pem and <name>-key.pem pair in dir.
+func (s *certificateStore) addDirectory(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, certDirSuffix) || strings.HasSuffix(name, certDirKeySuffix) {
+			continue
+		}
+		keyName := strings.TrimSuffix(name, certDirSuffix) + certDirKeySuffix
+		if err := s.addKeyPair(filepath.Join(dir, name), filepath.Join(dir, keyName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCertificate selects a certificate by SNI, falling back to wildcard
+// matches and then to the first configured certificate.
+func (s *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(s.certificates) == 0 {
+		return nil, fmt.Errorf("No certificates configured")
+	}
+
+	serverName := strings.ToLower(hello.ServerName)
+	if cert, ok := s.byName[serverName]; ok {
+		return cert, nil
+	}
+	if i := strings.Index(serverName, "."); i > 0 {
+		if cert, ok := s.byName["*"+serverName[i:]]; ok {
+			return cert, nil
+		}
+	}
+
+	return s.certificates[0], nil
+}
+
+func loadCertificateStore(certFiles, keyFiles []string, certDir string) (*certificateStore, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("Mismatched certificate and key lists (%d certificates, %d keys)", len(certFiles), len(keyFiles))
+	}
+
+	store := newCertificateStore()
+	for i := range certFiles {
+		if err := store.addKeyPair(certFiles[i], keyFiles[i]); err != nil {
+			return nil, err
+		}
+	}
+	if certDir != "" {
+		if err := store.addDirectory(certDir); err != nil {
+			return nil, err
+		}
+	}
+	if len(store.certificates) == 0 {
+		return nil, fmt.Errorf("No certificates configured")
+	}
+
+	return store, nil
+}
+
+func newServerTLSConfig(certFiles, keyFiles []string, certDir string) (*tls.Config, error) {
+	store, err := loadCertificateStore(certFiles, keyFiles, certDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		GetCertificate: store.GetCertificate,
+	}, nil
+}
@@ -0,0 +1,90 @@
+package commands
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestKeyPair(t *testing.T, dir, name string, dnsNames []string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+certDirSuffix), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+certDirKeySuffix), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateSelectionBySNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pat-app-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestKeyPair(t, dir, "a.example", []string{"a.example"})
+	writeTestKeyPair(t, dir, "b.example", []string{"b.example", "*.b.example"})
+
+	store, err := loadCertificateStore(nil, nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		serverName string
+		expected   string
+	}{
+		{"a.example", "a.example"},
+		{"B.EXAMPLE", "b.example"},
+		{"www.b.example", "b.example"},
+		{"unknown.example", "a.example"}, // default to the first certificate
+	}
+	for _, test := range tests {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Leaf.Subject.CommonName != test.expected {
+			t.Fatalf("Expected %s for %s, got %s", test.expected, test.serverName, cert.Leaf.Subject.CommonName)
+		}
+	}
+}
+
+func TestCertificateStoreMismatchedKeys(t *testing.T) {
+	_, err := loadCertificateStore([]string{"a.pem", "b.pem"}, []string{"a-key.pem"}, "")
+	if err == nil {
+		t.Fatal("expected mismatched certificate and key lists to fail")
+	}
+}
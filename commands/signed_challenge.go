@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+const (
+	signedChallengeLabel = "PAT signed challenge"
+
+	// Signed redemption nonces are expiry || random || MAC, as long as the
+	// nonces of other interactive challenges. The MAC covers the whole
+	// challenge.
+	signedChallengeExpiryLength = 8
+	signedChallengeRandomLength = 8
+	signedChallengeMACLength    = challengeNonceLength - signedChallengeExpiryLength - signedChallengeRandomLength
+
+	// Attribute of signed challenges asking clients to send the challenge
+	// back with the token, in the challenge Authorization parameter
+	challengeParamEcho = "echo-challenge"
+)
+
+var (
+	ErrInvalidChallengeSignature = errors.New("Invalid challenge signature")
+	ErrChallengeExpired          = errors.New("Challenge expired")
+)
+
+// challengeSigner signs the redemption nonce of interactive challenges with a
+// key shared by all replicas, embedding when the challenge expires. Signed
+// challenges are not stored: clients send them back with their token, and any
+// replica accepts the token if the challenge hashes to the token's context,
+// its signature verifies, and it has not expired. Unless spent tokens are
+// recorded, tokens for signed challenges can be redeemed more than once until
+// the challenge expires.
+type challengeSigner struct {
+	key  []byte
+	skew time.Duration // clock skew tolerated between replicas
+}
+
+func newChallengeSigner(key []byte) (*challengeSigner, error) {
+	if len(key) < 16 {
+		return nil, fmt.Errorf("Challenge signing key must be at least 16 bytes")
+	}
+	return &challengeSigner{key: key}, nil
+}
+
+// mac authenticates the challenge, whose redemption nonce has its MAC field
+// zeroed, so that the nonce of one challenge cannot be moved into another of
+// a different token type, issuer, or origin_info.
+func (s *challengeSigner) mac(originName string, challenge pat.TokenChallenge) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(signedChallengeLabel))
+	mac.Write([]byte(originName))
+	mac.Write(challenge.Marshal())
+	return mac.Sum(nil)[:signedChallengeMACLength]
+}
+
+// lifetime is how long a signed challenge is accepted after it was handed out
+// at most: until it expires, and the skew tolerance of the replica that signed
+// it and of the one verifying it.
+func (s *challengeSigner) lifetime(challengeLifetime time.Duration) time.Duration {
+	return challengeLifetime + 2*s.skew
+}
+
+// sign returns the challenge of the origin with a signed redemption nonce
+// expiring at expiry, with random drawn by the origin.
+func (s *challengeSigner) sign(originName string, challenge pat.TokenChallenge, expiry time.Time, random []byte) pat.TokenChallenge {
+	nonce := make([]byte, signedChallengeExpiryLength, challengeNonceLength)
+	binary.BigEndian.PutUint64(nonce, uint64(expiry.Unix()))
+	nonce = append(nonce, random...)
+	challenge.RedemptionNonce = append(nonce, make([]byte, signedChallengeMACLength)...)
+	copy(challenge.RedemptionNonce[signedChallengeExpiryLength+signedChallengeRandomLength:], s.mac(originName, challenge))
+	return challenge
+}
+
+// verify checks the signature of a challenge of the origin, and that it had
+// not expired by now, give or take the skew tolerance.
+func (s *challengeSigner) verify(originName string, challenge pat.TokenChallenge, now time.Time) error {
+	nonce := challenge.RedemptionNonce
+	if len(nonce) != challengeNonceLength {
+		return ErrInvalidChallengeSignature
+	}
+	macOffset := signedChallengeExpiryLength + signedChallengeRandomLength
+	challenge.RedemptionNonce = append(append([]byte{}, nonce[:macOffset]...), make([]byte, signedChallengeMACLength)...)
+	if !hmac.Equal(s.mac(originName, challenge), nonce[macOffset:]) {
+		return ErrInvalidChallengeSignature
+	}
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(nonce[:signedChallengeExpiryLength])), 0)
+	if now.After(expiry.Add(s.skew)) {
+		return fmt.Errorf("%w at %s", ErrChallengeExpired, expiry.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// signedChallenge returns a challenge with a signed redemption nonce expiring
+// with the challenge lifetime.
+func (o *Origin) signedChallenge(challenge pat.TokenChallenge) (pat.TokenChallenge, error) {
+	random, err := readNonce(o.nonceReader(), signedChallengeRandomLength)
+	if err != nil {
+		return pat.TokenChallenge{}, err
+	}
+	return o.challengeSigner.sign(o.originName, challenge, o.now().Add(o.challengeLifetime()), random), nil
+}
+
+// matchSignedChallenge returns the signed challenge a client sent back with
+// its token, if the token answers it and it was handed out by a replica of
+// the origin and has not expired.
+func (o *Origin) matchSignedChallenge(challengeEnc []byte, token pat.Token) (pat.TokenChallenge, error) {
+	context := sha256.Sum256(challengeEnc)
+	if !bytes.Equal(context[:], token.Context) {
+		return pat.TokenChallenge{}, ErrUnknownChallenge
+	}
+	challenge, err := pat.UnmarshalTokenChallenge(challengeEnc)
+	if err != nil || challenge.TokenType != token.TokenType {
+		return pat.TokenChallenge{}, ErrUnknownChallenge
+	}
+	if len(challenge.OriginInfo) > 0 && !equalStrings(challenge.OriginInfo, o.originInfo()) {
+		return pat.TokenChallenge{}, ErrUnknownChallenge
+	}
+	if err := o.challengeSigner.verify(o.originName, challenge, o.now()); err != nil {
+		return pat.TokenChallenge{}, err
+	}
+	return challenge, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
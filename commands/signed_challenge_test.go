@@ -0,0 +1,134 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestChallengeSigner(t *testing.T) {
+	signer, err := newChallengeSigner(bytes.Repeat([]byte{0x42}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.skew = time.Minute
+	now := time.Now()
+	challenge := signer.sign("origin.example", pat.TokenChallenge{
+		TokenType:  pat.BasicPrivateTokenType,
+		IssuerName: "issuer.example",
+		OriginInfo: []string{"origin.example"},
+	}, now.Add(time.Hour), bytes.Repeat([]byte{0x01}, signedChallengeRandomLength))
+	if len(challenge.RedemptionNonce) != challengeNonceLength {
+		t.Fatalf("expected a %d byte nonce, got %d", challengeNonceLength, len(challenge.RedemptionNonce))
+	}
+	if err := signer.verify("origin.example", challenge, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.verify("origin.example", challenge, now.Add(time.Hour+30*time.Second)); err != nil {
+		t.Fatalf("expected the skew to be tolerated, got %v", err)
+	}
+	if err := signer.verify("origin.example", challenge, now.Add(2*time.Hour)); !errors.Is(err, ErrChallengeExpired) {
+		t.Fatalf("expected the challenge to expire, got %v", err)
+	}
+	if err := signer.verify("other.example", challenge, now); err != ErrInvalidChallengeSignature {
+		t.Fatalf("expected nonces of other origins to be refused, got %v", err)
+	}
+	tampered := challenge
+	tampered.RedemptionNonce = append([]byte{}, challenge.RedemptionNonce...)
+	tampered.RedemptionNonce[0] ^= 0x01
+	if err := signer.verify("origin.example", tampered, now); err != ErrInvalidChallengeSignature {
+		t.Fatalf("expected a tampered expiry to be refused, got %v", err)
+	}
+
+	// The nonce is bound to the rest of the challenge
+	for _, moved := range []pat.TokenChallenge{
+		{TokenType: pat.BasicPublicTokenType, IssuerName: challenge.IssuerName, OriginInfo: challenge.OriginInfo, RedemptionNonce: challenge.RedemptionNonce},
+		{TokenType: challenge.TokenType, IssuerName: "other.example", OriginInfo: challenge.OriginInfo, RedemptionNonce: challenge.RedemptionNonce},
+		{TokenType: challenge.TokenType, IssuerName: challenge.IssuerName, RedemptionNonce: challenge.RedemptionNonce},
+	} {
+		if err := signer.verify("origin.example", moved, now); err != ErrInvalidChallengeSignature {
+			t.Fatalf("expected the nonce in another challenge to be refused, got %v", err)
+		}
+	}
+
+	// Tokens are kept as spent for as long as their signed challenges verify
+	origin := newTestOrigin()
+	origin.challengeSigner = signer
+	if retention := origin.spentTokenRetention(); retention != origin.challengeLifetime()+2*time.Minute {
+		t.Fatalf("unexpected retention %v", retention)
+	}
+
+	if _, err := newChallengeSigner([]byte{0x01}); err == nil {
+		t.Fatal("expected short key to be rejected")
+	}
+}
+
+func TestSignedChallenges(t *testing.T) {
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("resource"))
+	}))
+	defer resource.Close()
+	defer func(original string) { testResource = original }(testResource)
+	testResource = resource.URL
+
+	// Two replicas sharing the key and nothing else
+	issuer := newTestPrivateIssuer(t)
+	signer, _ := newChallengeSigner(bytes.Repeat([]byte{0x42}, 32))
+	keys := &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey()}
+	privateTokenKeyEnc, _ := issuer.privateIssuer.TokenKey().MarshalBinary()
+	keys.parseTokenKey(int(pat.BasicPrivateTokenType), privateTokenKeyEnc)
+	replicas := []*Origin{newTestOrigin(), newTestOrigin()}
+	for _, replica := range replicas {
+		replica.issuerKeys = &issuerKeySource{keys: keys}
+		replica.privateTokenKey = issuer.privateTokenKey
+		replica.challengeSigner = signer
+	}
+
+	w := httptest.NewRecorder()
+	replicas[0].handleRequest(w, httptest.NewRequest(http.MethodGet, "https://origin.example/?type=1", nil))
+	challenges, err := parseClientChallenges(w.Header().Get("WWW-Authenticate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(challenges) != 1 || !challenges[0].echo {
+		t.Fatalf("expected a challenge asking to be sent back, got %+v", challenges)
+	}
+	if len(outstandingChallenges(replicas[0])) != 0 {
+		t.Fatal("expected signed challenges not to be stored")
+	}
+	token := createTestToken(t, issuer, challenges[0].blob)
+
+	redeem := func(authValue string) int {
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+		req.Header.Set("Authorization", authValue)
+		w := httptest.NewRecorder()
+		replicas[1].handleRequest(w, req)
+		return w.Code
+	}
+	echoless := challenges[0]
+	echoless.echo = false
+	if code := redeem(privateTokenAuthorization(token, echoless)); code != http.StatusBadRequest {
+		t.Fatalf("expected the token to be refused without its challenge, got %d", code)
+	}
+	if code := redeem(privateTokenAuthorization(token, challenges[0])); code != http.StatusOK {
+		t.Fatalf("expected the other replica to admit the token, got %d", code)
+	}
+
+	// Challenges expire, and are only matched for the tokens answering them
+	clock := &demoClock{}
+	clock.advance(replicas[1].challengeLifetime() + time.Minute)
+	replicas[1].clock = clock
+	if _, err := replicas[1].matchSignedChallenge(challenges[0].blob, token); !errors.Is(err, ErrChallengeExpired) {
+		t.Fatalf("expected the challenge to expire, got %v", err)
+	}
+	other := createTestToken(t, issuer, challenges[0].blob)
+	other.Context = bytes.Repeat([]byte{0x00}, len(other.Context))
+	if _, err := replicas[0].matchSignedChallenge(challenges[0].blob, other); err != ErrUnknownChallenge {
+		t.Fatalf("expected a token for another challenge to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,493 @@
+package commands
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	// Kinds of synthetic redemptions
+	soakValid     = "valid"
+	soakExpired   = "expired"
+	soakReplayed  = "replayed"
+	soakMalformed = "malformed"
+
+	defaultSoakMix = "valid=70,expired=10,replayed=10,malformed=10"
+)
+
+// Series scraped from the origin that must stay bounded during a soak
+var soakBoundedSeries = []string{
+	"go_goroutines",
+	"go_memstats_heap_inuse_bytes",
+	"pat_origin_outstanding_challenges",
+	"pat_origin_challenge_contexts",
+}
+
+type mixWeight struct {
+	kind   string
+	weight int
+}
+
+// weightedMix is a weighted mixture of kinds, of redemptions for soak tests
+// or of token types for load tests.
+type weightedMix []mixWeight
+
+// parseWeightedMix parses comma-separated kind=weight pairs of the kinds
+// known returns true for.
+func parseWeightedMix(spec, what string, known func(kind string) bool) (weightedMix, error) {
+	mix := make(weightedMix, 0)
+	total := 0
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid %s mix entry %q, expected <%s>=<weight>", what, pair, what)
+		}
+		if !known(parts[0]) {
+			return nil, fmt.Errorf("Unknown %s %q", what, parts[0])
+		}
+		weight, err := strconv.Atoi(parts[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("Invalid weight for %s %s", what, parts[0])
+		}
+		mix = append(mix, mixWeight{parts[0], weight})
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("Mix of %ss has no positive weight", what)
+	}
+	return mix, nil
+}
+
+// parseSoakMix parses the mixture of redemption kinds of a soak test.
+func parseSoakMix(spec string) (weightedMix, error) {
+	return parseWeightedMix(spec, "soak kind", func(kind string) bool {
+		switch kind {
+		case soakValid, soakExpired, soakReplayed, soakMalformed:
+			return true
+		}
+		return false
+	})
+}
+
+// pick draws a kind with probability proportional to its weight.
+func (m weightedMix) pick(r *mathrand.Rand) string {
+	total := 0
+	for _, entry := range m {
+		total += entry.weight
+	}
+	n := r.Intn(total)
+	for _, entry := range m {
+		if n < entry.weight {
+			return entry.kind
+		}
+		n -= entry.weight
+	}
+	return m[len(m)-1].kind
+}
+
+// parseMetricsText sums the samples of every metric in a Prometheus text
+// exposition over all label sets.
+func parseMetricsText(r io.Reader) (map[string]float64, error) {
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.LastIndex(line, " ")
+		if separator < 0 {
+			return nil, fmt.Errorf("Invalid metrics line %q", line)
+		}
+		value, err := strconv.ParseFloat(line[separator+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid metrics line %q", line)
+		}
+		name := line[:separator]
+		if labels := strings.Index(name, "{"); labels >= 0 {
+			name = name[:labels]
+		}
+		values[name] += value
+	}
+	return values, scanner.Err()
+}
+
+// checkSoakBounds returns an error for the first bounded series that grew
+// beyond maxGrowth times its baseline. Baselines below one count as one, so
+// that series starting at zero may still grow a little.
+func checkSoakBounds(baseline, current map[string]float64, maxGrowth float64) error {
+	for _, name := range soakBoundedSeries {
+		start, ok := baseline[name]
+		if !ok {
+			continue
+		}
+		if start < 1 {
+			start = 1
+		}
+		if value := current[name]; value > start*maxGrowth {
+			return fmt.Errorf("%s grew from %s to %s, beyond %gx", name, formatSoakValue(baseline[name]), formatSoakValue(value), maxGrowth)
+		}
+	}
+	return nil
+}
+
+func formatSoakValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// soakRunner redeems synthetic basic tokens, which the issuer mints directly,
+// against one origin resource and tallies the response status per kind.
+type soakRunner struct {
+	httpClient  *http.Client
+	basicClient pat.BasicPublicClient
+	resourceURI string
+
+	lock     sync.Mutex
+	last     *clientChallenge // latest challenge seen, reused for expired tokens
+	outcomes map[string]map[int]int
+	errors   map[string]int
+}
+
+func newSoakRunner(httpClient *http.Client, resourceURI string) *soakRunner {
+	return &soakRunner{
+		httpClient:  httpClient,
+		basicClient: pat.NewBasicPublicClient(),
+		resourceURI: resourceURI,
+		outcomes:    make(map[string]map[int]int),
+		errors:      make(map[string]int),
+	}
+}
+
+// challenge requests the resource without a token and returns the origin's
+// challenge for basic tokens.
+func (r *soakRunner) challenge() (clientChallenge, error) {
+	req, err := http.NewRequest(http.MethodGet, r.resourceURI, nil)
+	if err != nil {
+		return clientChallenge{}, err
+	}
+	req.Header.Set(headerTokenType, strconv.Itoa(int(pat.BasicPublicTokenType)))
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return clientChallenge{}, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		return clientChallenge{}, fmt.Errorf("Expected a challenge, got status %d", resp.StatusCode)
+	}
+	challenges, err := parseClientChallenges(resp.Header.Get("WWW-Authenticate"))
+	if err != nil {
+		return clientChallenge{}, err
+	}
+
+	r.lock.Lock()
+	r.last = &challenges[0]
+	r.lock.Unlock()
+	return challenges[0], nil
+}
+
+// staleChallenge returns a challenge the origin does not hold, like one that
+// expired or was evicted: the latest challenge with a fresh redemption nonce.
+func (r *soakRunner) staleChallenge() (clientChallenge, error) {
+	r.lock.Lock()
+	last := r.last
+	r.lock.Unlock()
+	if last == nil {
+		challenge, err := r.challenge()
+		if err != nil {
+			return clientChallenge{}, err
+		}
+		last = &challenge
+	}
+
+	tokenChallenge, err := pat.UnmarshalTokenChallenge(last.blob)
+	if err != nil {
+		return clientChallenge{}, err
+	}
+	tokenChallenge.RedemptionNonce, err = readNonce(rand.Reader, len(tokenChallenge.RedemptionNonce))
+	if err != nil {
+		return clientChallenge{}, err
+	}
+	return clientChallenge{
+		blob:        tokenChallenge.Marshal(),
+		tokenKeyEnc: last.tokenKeyEnc,
+	}, nil
+}
+
+func (r *soakRunner) mint(challenge clientChallenge) (pat.Token, error) {
+	return fetchBasicToken(r.httpClient, r.basicClient, "", challenge.blob, challenge.tokenKeyEnc)
+}
+
+func (r *soakRunner) redeem(authValue string) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, r.resourceURI, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", authValue)
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func tokenAuthorization(tokenEnc []byte) string {
+	return "PrivateToken token=" + base64.URLEncoding.EncodeToString(tokenEnc)
+}
+
+// malformedToken returns random bytes, a token of an unknown type, or a
+// well-formed token with a random authenticator.
+func malformedToken(r *mathrand.Rand) []byte {
+	random := func(n int) []byte {
+		data := make([]byte, n)
+		r.Read(data)
+		return data
+	}
+	token := pat.Token{
+		TokenType:     pat.BasicPublicTokenType,
+		Nonce:         random(32),
+		Context:       random(32),
+		KeyID:         random(32),
+		Authenticator: random(256),
+	}
+	switch r.Intn(3) {
+	case 0:
+		return random(1 + r.Intn(512))
+	case 1:
+		token.TokenType = 0xFFFF
+	}
+	return token.Marshal()
+}
+
+// run performs one redemption of the kind and returns the status of the
+// redemption that kind is about.
+func (r *soakRunner) run(kind string, rnd *mathrand.Rand) (int, error) {
+	switch kind {
+	case soakMalformed:
+		return r.redeem(tokenAuthorization(malformedToken(rnd)))
+	case soakExpired:
+		challenge, err := r.staleChallenge()
+		if err != nil {
+			return 0, err
+		}
+		token, err := r.mint(challenge)
+		if err != nil {
+			return 0, err
+		}
+		return r.redeem(tokenAuthorization(token.Marshal()))
+	}
+
+	challenge, err := r.challenge()
+	if err != nil {
+		return 0, err
+	}
+	token, err := r.mint(challenge)
+	if err != nil {
+		return 0, err
+	}
+	status, err := r.redeem(tokenAuthorization(token.Marshal()))
+	if err != nil || kind == soakValid {
+		return status, err
+	}
+	return r.redeem(tokenAuthorization(token.Marshal()))
+}
+
+func (r *soakRunner) record(kind string, status int, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err != nil {
+		log.Debugln("Soak", kind, "redemption failed:", err)
+		r.errors[kind]++
+		return
+	}
+	if r.outcomes[kind] == nil {
+		r.outcomes[kind] = make(map[int]int)
+	}
+	r.outcomes[kind][status]++
+}
+
+// summary lists the statuses and errors per kind, e.g.,
+// "valid: 200=10 errors=1".
+func (r *soakRunner) summary() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	kinds := make([]string, 0)
+	for _, kind := range []string{soakValid, soakExpired, soakReplayed, soakMalformed} {
+		if r.outcomes[kind] == nil && r.errors[kind] == 0 {
+			continue
+		}
+		statuses := make([]int, 0)
+		for status := range r.outcomes[kind] {
+			statuses = append(statuses, status)
+		}
+		sort.Ints(statuses)
+		parts := make([]string, 0)
+		for _, status := range statuses {
+			parts = append(parts, fmt.Sprintf("%d=%d", status, r.outcomes[kind][status]))
+		}
+		if r.errors[kind] > 0 {
+			parts = append(parts, fmt.Sprintf("errors=%d", r.errors[kind]))
+		}
+		kinds = append(kinds, kind+": "+strings.Join(parts, " "))
+	}
+	return strings.Join(kinds, ", ")
+}
+
+func scrapeMetrics(httpClient *http.Client, metricsURI, adminToken string) (map[string]float64, error) {
+	req, err := http.NewRequest(http.MethodGet, metricsURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Metrics request failed with error %d", resp.StatusCode)
+	}
+	return parseMetricsText(resp.Body)
+}
+
+func runSoak(c *cli.Context) error {
+	origin := c.String("origin")
+	resource := c.String("resource")
+	duration := c.Duration("duration")
+	rate := c.Float64("rate")
+	concurrency := c.Int("concurrency")
+	metricsURI := c.String("metrics")
+	adminToken := c.String("admin-token")
+	scrapeInterval := c.Duration("scrape-interval")
+	warmup := c.Duration("warmup")
+	maxGrowth := c.Float64("max-growth")
+	logLevel := c.String("log")
+
+	if origin == "" {
+		log.Fatal("Invalid origin. See README for running instructions.")
+	}
+	mix, err := parseSoakMix(c.String("mix"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if duration <= 0 || rate <= 0 || concurrency <= 0 || scrapeInterval <= 0 || warmup < 0 {
+		log.Fatal("Invalid soak duration, rate, concurrency, scrape interval, or warmup. See README for running instructions.")
+	}
+	if maxGrowth < 1 {
+		log.Fatal("Invalid max growth, expected at least 1. See README for running instructions.")
+	}
+
+	switch logLevel {
+	case "debug":
+		log.SetLevel(log.DebugLevel)
+	case "info":
+		log.SetLevel(log.InfoLevel)
+	}
+
+	resourceURI, err := composeURL(origin, resource)
+	if err != nil {
+		return err
+	}
+	if metricsURI == "" {
+		metricsURI, err = composeURL(origin, adminMetricsURI)
+		if err != nil {
+			return err
+		}
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	runner := newSoakRunner(httpClient, resourceURI)
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	ticks := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticks.Stop()
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := mathrand.New(mathrand.NewSource(seed))
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticks.C:
+				}
+				kind := mix.pick(rnd)
+				status, err := runner.run(kind, rnd)
+				runner.record(kind, status, err)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+
+	log.Infoln("Soaking", resourceURI, "for", duration, "at", rate, "redemptions/s, scraping", metricsURI)
+	var baseline map[string]float64
+	var soakErr error
+	start := time.Now()
+	scrapes := time.NewTicker(scrapeInterval)
+	defer scrapes.Stop()
+	for soakErr == nil {
+		select {
+		case <-ctx.Done():
+		case <-scrapes.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		values, err := scrapeMetrics(httpClient, metricsURI, adminToken)
+		if err != nil {
+			soakErr = fmt.Errorf("Failed scraping origin metrics: %w", err)
+			break
+		}
+		series := make([]string, 0)
+		for _, name := range soakBoundedSeries {
+			if value, ok := values[name]; ok {
+				series = append(series, name+"="+formatSoakValue(value))
+			}
+		}
+		log.Infoln("Soak", time.Since(start).Round(time.Second), strings.Join(series, " "), "|", runner.summary())
+
+		if baseline == nil {
+			if time.Since(start) >= warmup {
+				baseline = values
+				log.Infoln("Soak baseline taken after", time.Since(start).Round(time.Second))
+			}
+			continue
+		}
+		soakErr = checkSoakBounds(baseline, values, maxGrowth)
+	}
+	cancel()
+	wg.Wait()
+
+	fmt.Println("Soak outcomes:", runner.summary())
+	if soakErr != nil {
+		return soakErr
+	}
+	if baseline == nil {
+		return fmt.Errorf("Soak ended before the warmup, no bounds were checked")
+	}
+	fmt.Println("Soak passed: goroutines, heap, and outstanding challenges stayed within", formatSoakValue(maxGrowth), "times their baseline")
+	return nil
+}
@@ -0,0 +1,102 @@
+package commands
+
+import (
+	mathrand "math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSoakMix(t *testing.T) {
+	mix, err := parseSoakMix("valid=3, malformed=1,expired=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	rnd := mathrand.New(mathrand.NewSource(1))
+	for i := 0; i < 4000; i++ {
+		counts[mix.pick(rnd)]++
+	}
+	if counts[soakExpired] != 0 || counts[soakValid] < 2800 || counts[soakValid] > 3200 || counts[soakValid]+counts[soakMalformed] != 4000 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+
+	for _, spec := range []string{"", "valid", "valid=-1", "forged=1", "valid=0,replayed=0"} {
+		if _, err := parseSoakMix(spec); err == nil {
+			t.Fatalf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestParseMetricsText(t *testing.T) {
+	values, err := parseMetricsText(strings.NewReader(`# HELP pat_origin_outstanding_challenges Outstanding challenges.
+# TYPE pat_origin_outstanding_challenges gauge
+pat_origin_outstanding_challenges{token_type="basic",draft_version="draft"} 3
+pat_origin_outstanding_challenges{token_type="rate-limited",draft_version="draft"} 4
+go_goroutines 12
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["pat_origin_outstanding_challenges"] != 7 || values["go_goroutines"] != 12 {
+		t.Fatalf("unexpected values %v", values)
+	}
+	if _, err := parseMetricsText(strings.NewReader("go_goroutines many\n")); err == nil {
+		t.Fatal("expected invalid value to be rejected")
+	}
+}
+
+func TestCheckSoakBounds(t *testing.T) {
+	baseline := map[string]float64{"go_goroutines": 10, "pat_origin_outstanding_challenges": 0}
+	if err := checkSoakBounds(baseline, map[string]float64{"go_goroutines": 20, "pat_origin_outstanding_challenges": 2}, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSoakBounds(baseline, map[string]float64{"go_goroutines": 21}, 2); err == nil {
+		t.Fatal("expected goroutine growth to be reported")
+	}
+	if err := checkSoakBounds(baseline, map[string]float64{"go_goroutines": 10, "pat_origin_outstanding_challenges": 3}, 2); err == nil {
+		t.Fatal("expected challenge growth from zero to be reported")
+	}
+}
+
+func TestSoakMalformed(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "PrivateToken token=") {
+			t.Errorf("unexpected Authorization %q", req.Header.Get("Authorization"))
+		}
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	}))
+	defer origin.Close()
+
+	runner := newSoakRunner(origin.Client(), origin.URL+"/index.html")
+	rnd := mathrand.New(mathrand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		status, err := runner.run(soakMalformed, rnd)
+		runner.record(soakMalformed, status, err)
+	}
+	if summary := runner.summary(); summary != "malformed: 400=10" {
+		t.Fatalf("unexpected summary %q", summary)
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	admin := newAdminServer("origin", "secret")
+	req := httptest.NewRequest(http.MethodGet, adminMetricsURI, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := serveAdmin(admin, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	values, err := parseMetricsText(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["go_goroutines"] < 1 {
+		t.Fatal("expected runtime statistics")
+	}
+	if !strings.Contains(body, "# TYPE pat_origin_outstanding_challenges gauge\n") {
+		t.Fatal("expected registered metrics")
+	}
+}
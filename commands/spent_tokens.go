@@ -0,0 +1,184 @@
+package commands
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrTokenSpent = errors.New("Token already redeemed")
+)
+
+// spentTokenStore remembers the tokens an origin admitted until their
+// retention ends, so that each is redeemed once.
+type spentTokenStore interface {
+	// spent reports whether the token is recorded.
+	spent(tokenKey string, now time.Time) (bool, error)
+	// spend records the token until expires and reports whether it is fresh,
+	// i.e., not recorded already.
+	spend(tokenKey string, now, expires time.Time) (bool, error)
+	// expire forgets tokens whose retention ended.
+	expire(now time.Time) error
+}
+
+// spentTokenKey identifies a token by the digest of its nonce and
+// authenticator. Tokens with the same nonce are distinct issuances, while the
+// same token sent again is a replay.
+func spentTokenKey(token pat.Token) string {
+	hash := sha256.New()
+	hash.Write(token.Nonce)
+	hash.Write(token.Authenticator)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// memorySpentTokenStore keeps spent tokens in process memory.
+type memorySpentTokenStore struct {
+	lock   sync.Mutex
+	tokens map[string]time.Time
+}
+
+func newMemorySpentTokenStore() *memorySpentTokenStore {
+	return &memorySpentTokenStore{
+		tokens: make(map[string]time.Time),
+	}
+}
+
+func (s *memorySpentTokenStore) spent(tokenKey string, now time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	retained, ok := s.tokens[tokenKey]
+	return ok && now.Before(retained), nil
+}
+
+func (s *memorySpentTokenStore) spend(tokenKey string, now, expires time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if retained, ok := s.tokens[tokenKey]; ok && now.Before(retained) {
+		return false, nil
+	}
+	s.tokens[tokenKey] = expires
+	return true, nil
+}
+
+func (s *memorySpentTokenStore) expire(now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for tokenKey, retained := range s.tokens {
+		if !now.Before(retained) {
+			delete(s.tokens, tokenKey)
+		}
+	}
+	return nil
+}
+
+// boltSpentTokenStore keeps spent tokens in a bucket of a Bolt database named
+// after the origin, with their retention end in Unix nanoseconds.
+type boltSpentTokenStore struct {
+	db     *bolt.DB
+	bucket []byte
+}
+
+func newBoltSpentTokenStore(db *bolt.DB, originName string) (*boltSpentTokenStore, error) {
+	s := &boltSpentTokenStore{
+		db:     db,
+		bucket: []byte("spent-tokens/" + originName),
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// spentTokenRetained reports whether the retention end of a token is after now.
+func spentTokenRetained(value []byte, now time.Time) bool {
+	return len(value) == 8 && now.UnixNano() < int64(binary.BigEndian.Uint64(value))
+}
+
+func (s *boltSpentTokenStore) spent(tokenKey string, now time.Time) (bool, error) {
+	spent := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		spent = spentTokenRetained(tx.Bucket(s.bucket).Get([]byte(tokenKey)), now)
+		return nil
+	})
+	return spent, err
+}
+
+func (s *boltSpentTokenStore) spend(tokenKey string, now, expires time.Time) (bool, error) {
+	fresh := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		if spentTokenRetained(bucket.Get([]byte(tokenKey)), now) {
+			return nil
+		}
+		fresh = true
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(expires.UnixNano()))
+		return bucket.Put([]byte(tokenKey), value)
+	})
+	return fresh, err
+}
+
+func (s *boltSpentTokenStore) expire(now time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(s.bucket)
+		// Cursors are invalidated by writes, so collect the keys first
+		var expired [][]byte
+		err := bucket.ForEach(func(key, value []byte) error {
+			if !spentTokenRetained(value, now) {
+				expired = append(expired, append([]byte{}, key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// redisSpentTokenStore keeps spent tokens in Redis, one key per token prefixed
+// with the origin name and expiring with its retention, so that replicas
+// refuse tokens admitted by each other.
+type redisSpentTokenStore struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func newRedisSpentTokenStore(client redis.UniversalClient, originName string) *redisSpentTokenStore {
+	return &redisSpentTokenStore{
+		client: client,
+		prefix: "pat:spent-tokens:" + originName + ":",
+	}
+}
+
+func (s *redisSpentTokenStore) spent(tokenKey string, now time.Time) (bool, error) {
+	count, err := s.client.Exists(context.Background(), s.prefix+tokenKey).Result()
+	return count > 0, err
+}
+
+func (s *redisSpentTokenStore) spend(tokenKey string, now, expires time.Time) (bool, error) {
+	return s.client.SetNX(context.Background(), s.prefix+tokenKey, 1, expires.Sub(now)).Result()
+}
+
+func (s *redisSpentTokenStore) expire(now time.Time) error {
+	// Redis expires keys on its own
+	return nil
+}
@@ -0,0 +1,137 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	pat "github.com/cloudflare/pat-go"
+)
+
+func testSpentTokenStore(t *testing.T, store spentTokenStore) {
+	now := time.Now()
+	if spent, err := store.spent("token", now); err != nil || spent {
+		t.Fatalf("expected a fresh token, got %v: %v", spent, err)
+	}
+	if fresh, err := store.spend("token", now, now.Add(time.Minute)); err != nil || !fresh {
+		t.Fatalf("expected the token to be recorded, got %v: %v", fresh, err)
+	}
+	if spent, _ := store.spent("token", now); !spent {
+		t.Fatal("expected the token to be spent")
+	}
+	if fresh, _ := store.spend("token", now, now.Add(time.Minute)); fresh {
+		t.Fatal("expected the token to be refused")
+	}
+	if err := store.expire(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if spent, _ := store.spent("token", now.Add(time.Hour)); spent {
+		t.Fatal("expected the token to be forgotten after its retention")
+	}
+}
+
+func TestMemorySpentTokenStore(t *testing.T) {
+	store := newMemorySpentTokenStore()
+	testSpentTokenStore(t, store)
+	if len(store.tokens) != 0 {
+		t.Fatal("expected expired tokens to be swept")
+	}
+}
+
+func TestBoltSpentTokenStore(t *testing.T) {
+	store, err := newStateStores().openSpentTokens("bolt:"+filepath.Join(t.TempDir(), "tokens.db"), "origin.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSpentTokenStore(t, store)
+}
+
+func TestRedisSpentTokenStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	store, err := newStateStores().openSpentTokens("redis://"+server.Addr()+"/0", "origin.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if fresh, _ := store.spend("token", now, now.Add(time.Minute)); !fresh {
+		t.Fatal("expected the token to be recorded")
+	}
+	if fresh, _ := store.spend("token", now, now.Add(time.Minute)); fresh {
+		t.Fatal("expected the token to be refused")
+	}
+	server.FastForward(time.Minute)
+	if spent, _ := store.spent("token", now); spent {
+		t.Fatal("expected Redis to expire the token")
+	}
+}
+
+func TestDoubleSpend(t *testing.T) {
+	resource := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("resource"))
+	}))
+	defer resource.Close()
+	defer func(original string) { testResource = original }(testResource)
+	testResource = resource.URL
+
+	issuer := newTestIssuer(t, "issuer.example")
+	origin := newTestOrigin()
+	keys := &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey()}
+	basicKeyEnc, _ := marshalTokenKey(issuer.basicIssuer.TokenKey(), false)
+	keys.parseTokenKey(int(pat.BasicPublicTokenType), basicKeyEnc)
+	origin.issuerKeys = &issuerKeySource{keys: keys}
+	origin.spentTokens = newMemorySpentTokenStore()
+	origin.redemptions = newRedemptionCache(defaultRedemptionCacheTTL)
+
+	// Two identical outstanding challenges the token could be replayed against
+	token := createTestToken(t, issuer, testTokenChallenge(pat.BasicPublicTokenType))
+	challenge := pat.TokenChallenge{
+		TokenType:  pat.BasicPublicTokenType,
+		IssuerName: "issuer.example",
+		OriginInfo: []string{"origin.example"},
+	}
+	context := sha256.Sum256(challenge.Marshal())
+	contextEnc := hex.EncodeToString(context[:])
+	origin.addChallenge(contextEnc, challenge)
+	origin.addChallenge(contextEnc, challenge)
+
+	redeem := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+		req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+		w := httptest.NewRecorder()
+		origin.handleRequest(w, req)
+		return w
+	}
+	if w := redeem(); w.Code != http.StatusOK {
+		t.Fatalf("expected the token to be admitted, got %d %q", w.Code, w.Body.String())
+	}
+
+	// The redemption cache does not serve the resource again to replays
+	doubleSpends := originDoubleSpends.Value(pat.BasicPublicTokenType)
+	replays := originRedemptionReplays.Value(pat.BasicPublicTokenType)
+	w := redeem()
+	if w.Code != http.StatusBadRequest || w.Body.String() != ErrTokenSpent.Error()+"\n" {
+		t.Fatalf("expected the replay to be refused, got %d %q", w.Code, w.Body.String())
+	}
+	if originDoubleSpends.Value(pat.BasicPublicTokenType) != doubleSpends+1 || originRedemptionReplays.Value(pat.BasicPublicTokenType) != replays {
+		t.Fatal("expected the replay to be counted as a double spend")
+	}
+	if outstandingChallenges(origin)[contextEnc].count != 1 {
+		t.Fatal("expected the replay not to consume the other challenge")
+	}
+
+	// Admitted tokens are kept for as long as their challenges are matched
+	origin.epochChallenger, _ = newEpochChallenger(make([]byte, 32), time.Hour)
+	if origin.spentTokenRetention() != 2*time.Hour {
+		t.Fatalf("unexpected retention %v", origin.spentTokenRetention())
+	}
+	origin.tokenRetention = time.Minute
+	if origin.spentTokenRetention() != time.Minute {
+		t.Fatalf("unexpected configured retention %v", origin.spentTokenRetention())
+	}
+}
@@ -0,0 +1,127 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Size of the AES-256 key sealing persisted client state
+const stateKeySize = 32
+
+var (
+	ErrStateUnsealed = errors.New("Failed decrypting client state")
+)
+
+// stateSealer encrypts client states with AES-256-GCM before they are
+// persisted, bound to their client ID. The key is kept in a file apart from
+// the state store, so that rotating it makes whatever the store still holds
+// of earlier states unreadable, including what a Bolt database leaves in its
+// free pages.
+type stateSealer struct {
+	lock     sync.RWMutex
+	fileName string
+	aead     cipher.AEAD
+}
+
+// openStateSealer reads the hex-encoded key of the file, or creates the file
+// with a new key if it does not exist.
+func openStateSealer(fileName string) (*stateSealer, error) {
+	s := &stateSealer{fileName: fileName}
+	keyHex, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return s, s.rotate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(keyHex)))
+	if err != nil || len(key) != stateKeySize {
+		return nil, fmt.Errorf("Invalid state encryption key, expected %d hex-encoded bytes", stateKeySize)
+	}
+	if s.aead, err = newStateAEAD(key); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newStateAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// rotate replaces the key with a new one, written to the key file before it
+// is used.
+func (s *stateSealer) rotate() error {
+	key := make([]byte, stateKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	aead, err := newStateAEAD(key)
+	if err != nil {
+		return err
+	}
+	// Written aside and renamed, so that a failed write keeps the old key
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.fileName), filepath.Base(s.fileName)+".*")
+	if err != nil {
+		return fmt.Errorf("Failed writing state encryption key: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.WriteString(hex.EncodeToString(key) + "\n")
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), s.fileName)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed writing state encryption key: %w", err)
+	}
+	for i := range key {
+		key[i] = 0
+	}
+
+	s.lock.Lock()
+	s.aead = aead
+	s.lock.Unlock()
+	return nil
+}
+
+// seal encrypts the state of the client under a random nonce, which prefixes
+// the result.
+func (s *stateSealer) seal(clientID string, data []byte) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(data)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, data, []byte(clientID)), nil
+}
+
+// open decrypts the state of the client, failing with ErrStateUnsealed for
+// states sealed under another key or for another client.
+func (s *stateSealer) open(clientID string, sealed []byte) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, ErrStateUnsealed
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	data, err := s.aead.Open(nil, nonce, ciphertext, []byte(clientID))
+	if err != nil {
+		return nil, ErrStateUnsealed
+	}
+	return data, nil
+}
@@ -0,0 +1,59 @@
+package commands
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateSealer(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "state.key")
+	sealer, err := openStateSealer(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the key file to be created readable by its owner only, got %v", err)
+	}
+	sealed, err := sealer.seal("client", []byte("state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := sealer.open("client", sealed); err != nil || string(data) != "state" {
+		t.Fatalf("expected the state back, got %q: %v", data, err)
+	}
+	// States are bound to their client
+	if _, err := sealer.open("other", sealed); !errors.Is(err, ErrStateUnsealed) {
+		t.Fatalf("expected the state of another client to be refused, got %v", err)
+	}
+
+	// Reopening the file keeps the key
+	reopened, err := openStateSealer(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.open("client", sealed); err != nil {
+		t.Fatalf("expected the key to be read back, got %v", err)
+	}
+
+	// Rotating the key replaces it in the file
+	if err := sealer.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sealer.open("client", sealed); !errors.Is(err, ErrStateUnsealed) {
+		t.Fatalf("expected the state to be unreadable after a rotation, got %v", err)
+	}
+	if reopened, err = openStateSealer(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.open("client", sealed); !errors.Is(err, ErrStateUnsealed) {
+		t.Fatalf("expected the old key to be gone from the file, got %v", err)
+	}
+
+	ioutil.WriteFile(keyFile, []byte("00"), 0600)
+	if _, err := openStateSealer(keyFile); err == nil {
+		t.Fatal("expected a short key to be refused")
+	}
+}
@@ -0,0 +1,352 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// Stores of origin state
+	storeMemory = "memory"
+	storeBolt   = "bolt"
+	storeRedis  = "redis"
+)
+
+// URL schemes of Redis topologies besides a single server, each with a TLS
+// variant prefixed "rediss"
+const (
+	redisClusterScheme  = "redis+cluster"
+	redisSentinelScheme = "redis+sentinel"
+)
+
+// storeBackend opens the stores of an optional kind, "<kind>:<location>".
+// The memory, Bolt, and Redis stores are pure Go and always built in, so that
+// the binaries cross-compile with CGO_ENABLED=0, e.g., for ARM devices.
+// Heavier backends, such as those requiring cgo, live in files behind a build
+// tag of their kind and register themselves in init.
+type storeBackend interface {
+	openChallenges(store, originName string) (challengeStore, error)
+	openSpentTokens(store, originName string) (spentTokenStore, error)
+	openClientStates(store string) (clientStateBackend, error)
+	close() error
+}
+
+// storeBackends create the optional backends built in, by kind. A backend
+// is created once per process, on the first store of its kind.
+var storeBackends = make(map[string]func() storeBackend)
+
+// registerStoreBackend adds an optional kind of stores.
+func registerStoreBackend(kind string, newBackend func() storeBackend) {
+	storeBackends[kind] = newBackend
+}
+
+// stateStores opens the stores of the roles served by a process: the
+// challenges and spent tokens of origins, and the client state of the
+// attester. A store is "memory", "bolt:<file>", the URL of a Redis server,
+// cluster, or Sentinel-monitored master, or "<kind>:<location>" of an
+// optional backend. Origins sharing a Bolt database or Redis deployment are
+// kept apart by name.
+type stateStores struct {
+	boltDBs  map[string]*bolt.DB
+	redis    map[string]redis.UniversalClient
+	backends map[string]storeBackend
+}
+
+func newStateStores() *stateStores {
+	return &stateStores{
+		boltDBs:  make(map[string]*bolt.DB),
+		redis:    make(map[string]redis.UniversalClient),
+		backends: make(map[string]storeBackend),
+	}
+}
+
+// storeKind returns the kind of the store, or an error if it is not
+// recognized.
+func storeKind(store string) (string, error) {
+	switch {
+	case store == "" || store == storeMemory:
+		return storeMemory, nil
+	case strings.HasPrefix(store, storeBolt+":") && len(store) > len(storeBolt)+1:
+		return storeBolt, nil
+	case redisScheme(store) != "":
+		return storeRedis, nil
+	}
+	kind, location, ok := strings.Cut(store, ":")
+	if !ok || location == "" || strings.HasPrefix(location, "//") {
+		return "", fmt.Errorf("Invalid store %q", store)
+	}
+	if _, ok := storeBackends[kind]; !ok {
+		return "", fmt.Errorf("Invalid store %q, %s stores are not built into this binary", store, kind)
+	}
+	return kind, nil
+}
+
+// isLocalStore tells whether the store is kept by one process, or one host,
+// so that replicas of an origin do not share it.
+func isLocalStore(store string) bool {
+	kind, err := storeKind(store)
+	return err == nil && (kind == storeMemory || kind == storeBolt)
+}
+
+// backend creates the optional backend of the kind once per process.
+func (s *stateStores) backend(kind string) storeBackend {
+	backend, ok := s.backends[kind]
+	if !ok {
+		backend = storeBackends[kind]()
+		s.backends[kind] = backend
+	}
+	return backend
+}
+
+// boltDB opens the Bolt database of the store once per process, since Bolt
+// locks its file.
+func (s *stateStores) boltDB(store string) (*bolt.DB, error) {
+	fileName := strings.TrimPrefix(store, storeBolt+":")
+	if db, ok := s.boltDBs[fileName]; ok {
+		return db, nil
+	}
+	db, err := bolt.Open(fileName, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening store %s: %w", fileName, err)
+	}
+	s.boltDBs[fileName] = db
+	return db, nil
+}
+
+// redisScheme returns the scheme of a Redis store URL, without its TLS
+// variant, or "" if the store is not one.
+func redisScheme(store string) string {
+	for _, scheme := range []string{"redis", redisClusterScheme, redisSentinelScheme} {
+		if strings.HasPrefix(store, scheme+"://") || strings.HasPrefix(store, "rediss"+strings.TrimPrefix(scheme, "redis")+"://") {
+			return scheme
+		}
+	}
+	return ""
+}
+
+// redisClient connects to the Redis deployment of the store once per
+// process. Clients pool their connections, sized with the pool_size,
+// min_idle_conns, and pool_timeout URL parameters, and follow cluster
+// redirections and Sentinel failovers on their own.
+func (s *stateStores) redisClient(store string) (redis.UniversalClient, error) {
+	if client, ok := s.redis[store]; ok {
+		return client, nil
+	}
+	client, err := newRedisClient(store)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid store: %w", err)
+	}
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("Failed reaching store %s: %w", redactRedisURL(store), err)
+	}
+	s.redis[store] = client
+	return client, nil
+}
+
+// newRedisClient creates the client of a Redis store URL:
+//
+//	redis://[user:password@]host:port/db
+//	redis+cluster://[user:password@]host:port?addr=host:port&addr=...
+//	redis+sentinel://[user:password@]host:port/db?master=name&addr=host:port&...
+//
+// Cluster and Sentinel URLs name one node or sentinel in the host, and any
+// others in addr parameters.
+func newRedisClient(store string) (redis.UniversalClient, error) {
+	switch redisScheme(store) {
+	case redisClusterScheme:
+		options, err := redis.ParseClusterURL(plainRedisURL(store))
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClusterClient(options), nil
+	case redisSentinelScheme:
+		options, err := parseRedisSentinelURL(store)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(options), nil
+	}
+	options, err := redis.ParseURL(store)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(options), nil
+}
+
+// plainRedisURL drops the topology from the scheme of a Redis store URL,
+// keeping TLS.
+func plainRedisURL(store string) string {
+	scheme, rest, _ := strings.Cut(store, "://")
+	scheme, _, _ = strings.Cut(scheme, "+")
+	return scheme + "://" + rest
+}
+
+// parseRedisSentinelURL reads the failover options of a redis+sentinel URL.
+// Besides the parameters of a redis URL, it takes the master name, more
+// sentinels in addr, and the sentinel_password if the sentinels require one.
+func parseRedisSentinelURL(store string) (*redis.FailoverOptions, error) {
+	u, err := url.Parse(plainRedisURL(store))
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	masterName := q.Get("master")
+	if masterName == "" {
+		return nil, fmt.Errorf("Missing Sentinel master name")
+	}
+	sentinelAddrs := append([]string{u.Host}, q["addr"]...)
+	for _, addr := range sentinelAddrs {
+		if host, port, err := net.SplitHostPort(addr); err != nil || host == "" || port == "" {
+			return nil, fmt.Errorf("Invalid sentinel address %q", addr)
+		}
+	}
+	sentinelPassword := q.Get("sentinel_password")
+	for _, name := range []string{"master", "addr", "sentinel_password"} {
+		q.Del(name)
+	}
+	u.RawQuery = q.Encode()
+
+	options, err := redis.ParseURL(u.String())
+	if err != nil {
+		return nil, err
+	}
+	return &redis.FailoverOptions{
+		MasterName:       masterName,
+		SentinelAddrs:    sentinelAddrs,
+		SentinelPassword: sentinelPassword,
+		ClientName:       options.ClientName,
+		Protocol:         options.Protocol,
+		Username:         options.Username,
+		Password:         options.Password,
+		DB:               options.DB,
+		MaxRetries:       options.MaxRetries,
+		MinRetryBackoff:  options.MinRetryBackoff,
+		MaxRetryBackoff:  options.MaxRetryBackoff,
+		DialTimeout:      options.DialTimeout,
+		ReadTimeout:      options.ReadTimeout,
+		WriteTimeout:     options.WriteTimeout,
+		PoolFIFO:         options.PoolFIFO,
+		PoolSize:         options.PoolSize,
+		PoolTimeout:      options.PoolTimeout,
+		MinIdleConns:     options.MinIdleConns,
+		MaxIdleConns:     options.MaxIdleConns,
+		MaxActiveConns:   options.MaxActiveConns,
+		ConnMaxIdleTime:  options.ConnMaxIdleTime,
+		ConnMaxLifetime:  options.ConnMaxLifetime,
+		TLSConfig:        options.TLSConfig,
+	}, nil
+}
+
+// redactRedisURL hides the password of a Redis store URL in messages.
+func redactRedisURL(store string) string {
+	u, err := url.Parse(store)
+	if err != nil {
+		return redisScheme(store)
+	}
+	return u.Redacted()
+}
+
+// close flushes and closes the stores, once the roles stopped using them.
+func (s *stateStores) close() error {
+	var err error
+	for fileName, db := range s.boltDBs {
+		if closeErr := db.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("Failed closing store %s: %w", fileName, closeErr)
+		}
+	}
+	for _, client := range s.redis {
+		if closeErr := client.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	for kind, backend := range s.backends {
+		if closeErr := backend.close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("Failed closing %s stores: %w", kind, closeErr)
+		}
+	}
+	return err
+}
+
+// openChallenges opens the store of the origin's outstanding challenges.
+func (s *stateStores) openChallenges(store, originName string) (challengeStore, error) {
+	kind, err := storeKind(store)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case storeBolt:
+		db, err := s.boltDB(store)
+		if err != nil {
+			return nil, err
+		}
+		return newBoltChallengeStore(db, originName)
+	case storeRedis:
+		client, err := s.redisClient(store)
+		if err != nil {
+			return nil, err
+		}
+		return newRedisChallengeStore(client, originName), nil
+	case storeMemory:
+		return newMemoryChallengeStore(), nil
+	}
+	return s.backend(kind).openChallenges(store, originName)
+}
+
+// openSpentTokens opens the store of the tokens the origin admitted.
+func (s *stateStores) openSpentTokens(store, originName string) (spentTokenStore, error) {
+	kind, err := storeKind(store)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case storeBolt:
+		db, err := s.boltDB(store)
+		if err != nil {
+			return nil, err
+		}
+		return newBoltSpentTokenStore(db, originName)
+	case storeRedis:
+		client, err := s.redisClient(store)
+		if err != nil {
+			return nil, err
+		}
+		return newRedisSpentTokenStore(client, originName), nil
+	case storeMemory:
+		return newMemorySpentTokenStore(), nil
+	}
+	return s.backend(kind).openSpentTokens(store, originName)
+}
+
+// openClientStates opens the store of the attester's client state, nil if
+// the state is kept in memory only.
+func (s *stateStores) openClientStates(store string) (clientStateBackend, error) {
+	kind, err := storeKind(store)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case storeBolt:
+		db, err := s.boltDB(store)
+		if err != nil {
+			return nil, err
+		}
+		return newBoltClientStateBackend(db)
+	case storeRedis:
+		client, err := s.redisClient(store)
+		if err != nil {
+			return nil, err
+		}
+		return newRedisClientStateBackend(client), nil
+	case storeMemory:
+		return nil, nil
+	}
+	return s.backend(kind).openClientStates(store)
+}
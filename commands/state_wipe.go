@@ -0,0 +1,225 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	adminStateWipeURI = adminURIPrefix + "state/wipe"
+
+	// Value of the confirm field that a wipe request must carry
+	stateWipeConfirmation = "wipe-state"
+)
+
+// stateWipeRequest must confirm the wipe, so that a stray request cannot
+// drop the attester state.
+type stateWipeRequest struct {
+	Confirm string `json:"confirm"`
+}
+
+// stateWipeReport counts what a wipe dropped.
+type stateWipeReport struct {
+	Clients         int    `json:"clients"`
+	StoredClients   int    `json:"stored_clients"`
+	ClientKeys      int    `json:"client_keys"`
+	BlindedKeys     int    `json:"blinded_keys"`
+	PrivacyClients  int    `json:"privacy_clients"`
+	FraudClients    int    `json:"fraud_clients"`
+	DedupedRequests int    `json:"deduped_requests"`
+	StateKeyRotated bool   `json:"state_key_rotated"`
+	Time            string `json:"time"`
+}
+
+// wipe drops every client's state, in memory and in the state store.
+// Entries being updated are marked removed so that the update starts over,
+// like when a client's state is dropped. The state encryption key is rotated
+// first, so that states the store fails to delete, or keeps in free space,
+// cannot be read back. It returns the clients dropped from memory and from
+// the store. Updates wait for the wipe to complete, so that none is sealed
+// under the old key or written before the store is wiped.
+func (s *clientStateStore) wipe() (int, int, error) {
+	s.wipeLock.Lock()
+	defer s.wipeLock.Unlock()
+
+	s.lock.Lock()
+	clients := s.clients
+	s.clients = make(map[string]*clientEntry)
+	s.lock.Unlock()
+
+	for _, entry := range clients {
+		entry.lock.Lock()
+		entry.state = ClientState{}
+		entry.removed = true
+		entry.lock.Unlock()
+	}
+	if s.backend == nil {
+		return len(clients), 0, nil
+	}
+	if err := s.sealer.rotate(); err != nil {
+		return len(clients), 0, err
+	}
+	stored, err := s.backend.wipe()
+	return len(clients), stored, err
+}
+
+func (r *clientKeyRegistry) wipe() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	count := len(r.keys)
+	for _, clientKey := range r.keys {
+		for i := range clientKey {
+			clientKey[i] = 0
+		}
+	}
+	r.keys = make(map[string][]byte)
+	return count
+}
+
+func (i *blindedKeyIndex) wipe() int {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	count := len(i.owners)
+	i.owners = make(map[string]blindedKeyOwner)
+	return count
+}
+
+// wipe drops the ledger of every epoch, and returns the clients it had in
+// any of them.
+func (l *privacyLedger) wipe() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	clients := make(map[string]bool)
+	for _, epoch := range l.epochs {
+		for clientID := range epoch {
+			clients[clientID] = true
+		}
+	}
+	l.epochs = make(map[uint64]map[string]map[string]int)
+	return len(clients)
+}
+
+func (f *fraudSignals) wipe() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	count := len(f.newOrigins)
+	f.newOrigins = make(map[string][]time.Time)
+	return count
+}
+
+// wipe drops the responses kept for duplicate requests, which carry client
+// data.
+func (d *requestDedup) wipe() int {
+	if d == nil {
+		return 0
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	count := len(d.entries)
+	d.entries = make(map[string]*dedupEntry)
+	return count
+}
+
+// wipeState clears all client state of the attester, keeping its
+// configuration, keys, and what it learned about issuers.
+func (a TestAttester) wipeState() (stateWipeReport, error) {
+	clients, storedClients, err := a.clients.wipe()
+	report := stateWipeReport{
+		Clients:         clients,
+		StoredClients:   storedClients,
+		ClientKeys:      a.clientKeys.wipe(),
+		BlindedKeys:     a.blindedKeys.wipe(),
+		PrivacyClients:  a.ledger.wipe(),
+		FraudClients:    a.fraud.wipe(),
+		DedupedRequests: a.dedup.wipe(),
+		StateKeyRotated: err == nil && a.clients.sealer != nil,
+		Time:            a.now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		return report, fmt.Errorf("Failed wiping state store: %w", err)
+	}
+	log.Warnf("Wiped attester state: %d clients, %d client keys, %d blinded keys", report.Clients, report.ClientKeys, report.BlindedKeys)
+	if report.StateKeyRotated {
+		log.Warnln("Rotated the state encryption key")
+	}
+	return report, nil
+}
+
+func (a TestAttester) handleStateWipe(w http.ResponseWriter, req *http.Request) {
+	var wipeReq stateWipeRequest
+	if err := readAdminJSON(req, &wipeReq); err != nil {
+		http.Error(w, "Invalid wipe request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wipeReq.Confirm != stateWipeConfirmation {
+		http.Error(w, fmt.Sprintf("Wiping state requires {\"confirm\": %q}", stateWipeConfirmation), http.StatusBadRequest)
+		return
+	}
+	report, err := a.wipeState()
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, report)
+}
+
+// confirmStateWipe asks the operator to type the attester name back.
+func confirmStateWipe(in io.Reader, out io.Writer, attester string) bool {
+	fmt.Fprintf(out, "This drops all client state at %s and cannot be undone.\nType the attester name to confirm: ", attester)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	return strings.TrimSpace(answer) == attester
+}
+
+func runAttesterWipeState(c *cli.Context) error {
+	attester := c.String("attester")
+	adminToken := c.String("admin-token")
+
+	if attester == "" {
+		log.Fatal("Invalid attester. See README for running instructions.")
+	}
+	if adminToken == "" {
+		log.Fatal("Invalid admin token. See README for running instructions.")
+	}
+	if !c.Bool("yes") && !confirmStateWipe(os.Stdin, os.Stdout, attester) {
+		return fmt.Errorf("State wipe not confirmed")
+	}
+
+	wipeURI, err := composeURL(attester, adminStateWipeURI)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(stateWipeRequest{Confirm: stateWipeConfirmation})
+	req, err := http.NewRequest(http.MethodPost, wipeURI, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Wipe failed with error %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	fmt.Println(string(respBody))
+	return nil
+}
@@ -0,0 +1,142 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAttesterStateWipe(t *testing.T) {
+	attester := newTestAttester(&AttesterPolicy{})
+	attester.clientKeys = newClientKeyRegistry()
+	attester.dedup = newRequestDedup(time.Minute, dedupActionReplay)
+	now := time.Now()
+	if err := attester.issue("client", "origin", 10, now); err != nil {
+		t.Fatal(err)
+	}
+	attester.blindedKeys.claim("blinded", "client", "origin", now)
+	attester.ledger.record("client", "origin", now)
+	clientKey := []byte{0x02, 0x01}
+	attester.clientKeys.keys["client"] = clientKey
+
+	var audit bytes.Buffer
+	admin := attester.newAdminServer("secret")
+	admin.audit = newAdminAudit(&audit)
+	wipe := func(wipeReq stateWipeRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(wipeReq)
+		req := httptest.NewRequest(http.MethodPost, adminStateWipeURI, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w
+	}
+
+	// Unconfirmed wipes are refused
+	if w := wipe(stateWipeRequest{}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if _, ok := attester.clientKeys.lookup("client"); !ok {
+		t.Fatal("expected the state to be kept")
+	}
+
+	w := wipe(stateWipeRequest{Confirm: stateWipeConfirmation})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var report stateWipeReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Clients != 1 || report.ClientKeys != 1 || report.BlindedKeys != 1 || report.PrivacyClients != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if _, ok := attester.clientKeys.lookup("client"); ok || !bytes.Equal(clientKey, []byte{0, 0}) {
+		t.Fatal("expected the client key to be zeroed and dropped")
+	}
+	if attester.blindedKeys.claim("blinded", "other", "origin", now) != "" {
+		t.Fatal("expected the blinded keys to be dropped")
+	}
+	if len(attester.ledger.report("").Epochs) != 0 {
+		t.Fatal("expected the privacy ledger to be dropped")
+	}
+
+	// Clients start over after the wipe
+	if err := attester.issue("client", "origin", 1, now); err != nil {
+		t.Fatal(err)
+	}
+	if entries := strings.Split(strings.TrimSpace(audit.String()), "\n"); len(entries) != 2 || !strings.Contains(entries[1], adminStateWipeURI) {
+		t.Fatalf("expected both wipe requests to be audited, got %q", audit.String())
+	}
+}
+
+// TestStateWipeConcurrentUpdates wipes while clients are issued tokens, and
+// checks that memory and the store agree afterwards: no state is dropped
+// from the store while kept in memory, or stored under the rotated key.
+func TestStateWipeConcurrentUpdates(t *testing.T) {
+	stores := newStateStores()
+	defer stores.close()
+	backend, err := stores.openClientStates("bolt:" + filepath.Join(t.TempDir(), "attester.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer, err := openStateSealer(filepath.Join(t.TempDir(), "state.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attester := newTestAttester(nil)
+	if _, err := attester.clients.restore(backend, sealer); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := attester.issue(fmt.Sprintf("client-%d-%d", worker, i), "origin", 10, now); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(worker)
+	}
+	for i := 0; i < 10; i++ {
+		if _, _, err := attester.clients.wipe(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	sealedStates, err := backend.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientIDs := attester.clients.clientIDs()
+	if len(sealedStates) != len(clientIDs) {
+		t.Fatalf("expected the %d clients in memory to be stored, got %d", len(clientIDs), len(sealedStates))
+	}
+	for _, clientID := range clientIDs {
+		if _, err := sealer.open(clientID, sealedStates[clientID]); err != nil {
+			t.Fatalf("expected the state of %s to be stored under the current key: %v", clientID, err)
+		}
+	}
+}
+
+func TestConfirmStateWipe(t *testing.T) {
+	var out bytes.Buffer
+	if !confirmStateWipe(strings.NewReader("attester.example:4569\n"), &out, "attester.example:4569") {
+		t.Fatal("expected the typed name to confirm")
+	}
+	if confirmStateWipe(strings.NewReader("yes\n"), &out, "attester.example:4569") {
+		t.Fatal("expected another answer to be refused")
+	}
+}
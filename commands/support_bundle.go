@@ -0,0 +1,390 @@
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	adminGoroutinesURI   = adminURIPrefix + "debug/goroutines"
+	adminHeapURI         = adminURIPrefix + "debug/heap"
+	adminStateSummaryURI = adminURIPrefix + "state/summary"
+
+	// Largest response kept per support bundle entry
+	maxSupportBundleEntrySize = 64 << 20
+)
+
+// supportBundleFiles are the admin endpoints collected into a support
+// bundle, by name of the file they are written to.
+var supportBundleFiles = []struct {
+	name string
+	path string
+}{
+	{"openapi.json", adminOpenAPIURI},
+	{"config.json", adminConfigURI},
+	{"metrics.txt", adminMetricsURI},
+	{"goroutines.txt", adminGoroutinesURI},
+	{"heap.pprof", adminHeapURI},
+	{"state-summary.json", adminStateSummaryURI},
+}
+
+func handleGoroutineProfile(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	pprof.Lookup("goroutine").WriteTo(w, 1)
+}
+
+func handleHeapProfile(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	pprof.Lookup("heap").WriteTo(w, 0)
+}
+
+// attesterStateSummary describes the attester state by counts only, without
+// client IDs or anonymous origins, so that it can be attached to bug reports.
+type attesterStateSummary struct {
+	Clients              int  `json:"clients"`
+	AnonymousOrigins     int  `json:"anonymous_origins"`
+	MaxOriginsPerClient  int  `json:"max_origins_per_client"`
+	ClientKeys           int  `json:"client_keys"`
+	BlindedKeys          int  `json:"blinded_keys"`
+	DedupedRequests      int  `json:"deduped_requests"`
+	IssuerPolicies       int  `json:"issuer_policies"`
+	PersistedState       bool `json:"persisted_state"`
+	Maintenance          bool `json:"maintenance"`
+	PolicyWindowSeconds  int  `json:"policy_window_seconds"`
+	AttestationVerifiers int  `json:"attestation_verifiers"`
+}
+
+// summary counts the clients with state and their anonymous origins, and
+// returns the largest number of origins of a single client.
+func (s *clientStateStore) summary() (int, int, int) {
+	s.lock.Lock()
+	entries := make([]*clientEntry, 0, len(s.clients))
+	for _, entry := range s.clients {
+		entries = append(entries, entry)
+	}
+	s.lock.Unlock()
+
+	clients, origins, maxOrigins := 0, 0, 0
+	for _, entry := range entries {
+		entry.lock.Lock()
+		if !entry.removed && entry.state.known() {
+			clients++
+			origins += len(entry.state.originIndices)
+			if len(entry.state.originIndices) > maxOrigins {
+				maxOrigins = len(entry.state.originIndices)
+			}
+		}
+		entry.lock.Unlock()
+	}
+	return clients, origins, maxOrigins
+}
+
+func (r *clientKeyRegistry) count() int {
+	if r == nil {
+		return 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.keys)
+}
+
+func (i *blindedKeyIndex) count() int {
+	if i == nil {
+		return 0
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return len(i.owners)
+}
+
+func (d *requestDedup) count() int {
+	if d == nil {
+		return 0
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.entries)
+}
+
+func (c *issuerPolicyCache) count() int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.policies)
+}
+
+func (a TestAttester) stateSummary() attesterStateSummary {
+	clients, origins, maxOrigins := a.clients.summary()
+	a.clients.lock.Lock()
+	persisted := a.clients.backend != nil
+	a.clients.lock.Unlock()
+	return attesterStateSummary{
+		Clients:              clients,
+		AnonymousOrigins:     origins,
+		MaxOriginsPerClient:  maxOrigins,
+		ClientKeys:           a.clientKeys.count(),
+		BlindedKeys:          a.blindedKeys.count(),
+		DedupedRequests:      a.dedup.count(),
+		IssuerPolicies:       a.issuerPolicies.count(),
+		PersistedState:       persisted,
+		Maintenance:          a.maintenance.state().Enabled,
+		PolicyWindowSeconds:  int(a.policyWindow / time.Second),
+		AttestationVerifiers: len(a.verifiers),
+	}
+}
+
+func (a TestAttester) handleStateSummary(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, a.stateSummary())
+}
+
+// originStateSummary describes the origin state by counts only, without
+// challenge contexts or nonces.
+type originStateSummary struct {
+	ChallengeContexts     int      `json:"challenge_contexts"`
+	OutstandingChallenges int      `json:"outstanding_challenges"`
+	Issuers               []string `json:"issuers"`
+	AcceptedTokenTypes    []string `json:"accepted_token_types"`
+	Error                 string   `json:"error,omitempty"`
+}
+
+func (o *Origin) stateSummary() originStateSummary {
+	summary := originStateSummary{
+		Issuers:            make([]string, 0, 1),
+		AcceptedTokenTypes: o.tokenTypes.names(),
+	}
+	for _, issuer := range o.challengeIssuers() {
+		summary.Issuers = append(summary.Issuers, issuer.name)
+	}
+	outstanding, err := o.challenges.list(o.now())
+	if err != nil {
+		summary.Error = err.Error()
+		return summary
+	}
+	summary.ChallengeContexts = len(outstanding)
+	for _, challenge := range outstanding {
+		summary.OutstandingChallenges += challenge.count
+	}
+	return summary
+}
+
+func (o *Origin) handleStateSummary(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, o.stateSummary())
+}
+
+// issuerStateSummary describes the issuer state by counts only, without
+// origin names or keys.
+type issuerStateSummary struct {
+	Origins          int  `json:"origins"`
+	OriginTokenLimit int  `json:"origin_token_limit"`
+	TokenWindows     int  `json:"token_windows"`
+	RetiredKeys      int  `json:"retired_keys"`
+	PrivateTokens    bool `json:"private_tokens"`
+	Ed25519Tokens    bool `json:"ed25519_tokens"`
+	FairScheduling   bool `json:"fair_scheduling"`
+	AttesterKeys     int  `json:"attester_keys"`
+	FaultsInjected   bool `json:"faults_injected"`
+}
+
+func (i *Issuer) stateSummary() issuerStateSummary {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	policy := i.policy()
+	summary := issuerStateSummary{
+		Origins:          len(policy.Origins),
+		OriginTokenLimit: policy.OriginTokenLimit,
+		TokenWindows:     len(policy.TokenWindows),
+		RetiredKeys:      len(i.retiredKeys),
+		PrivateTokens:    i.privateIssuer != nil,
+		Ed25519Tokens:    i.ed25519Issuer != nil,
+		FairScheduling:   i.scheduler != nil,
+		FaultsInjected:   i.faults != nil,
+	}
+	if i.attesterKeys != nil {
+		summary.AttesterKeys = len(i.attesterKeys.keys)
+	}
+	return summary
+}
+
+func (i *Issuer) handleStateSummary(w http.ResponseWriter, req *http.Request) {
+	writeAdminJSON(w, i.stateSummary())
+}
+
+// supportBundleEntry records how one file of a support bundle was collected.
+type supportBundleEntry struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Status int    `json:"status,omitempty"`
+	Size   int    `json:"size"`
+	Error  string `json:"error,omitempty"`
+}
+
+// supportBundleManifest is written to manifest.json in every bundle.
+type supportBundleManifest struct {
+	Target    string               `json:"target"`
+	Collected string               `json:"collected"`
+	Entries   []supportBundleEntry `json:"entries"`
+}
+
+// adminURL resolves an admin path against the target, either host[:port] or
+// a URL.
+func adminURL(target, path string) (string, error) {
+	if strings.Contains(target, "://") {
+		return strings.TrimSuffix(target, "/") + path, nil
+	}
+	return composeURL(target, path)
+}
+
+// fetchAdminFile gets an admin endpoint, returning its body even if the
+// status is not 200, which the manifest records.
+func fetchAdminFile(httpClient *http.Client, uri string, authorize func(req *http.Request) error) (int, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := authorize(req); err != nil {
+		return 0, nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSupportBundleEntrySize))
+	return resp.StatusCode, body, err
+}
+
+// collectSupportBundle writes a gzipped tar archive of every support bundle
+// file of the target into out. Files that cannot be collected, e.g., because
+// the role does not serve them, are recorded in the manifest rather than
+// failing the bundle.
+func collectSupportBundle(httpClient *http.Client, target string, authorize func(req *http.Request) error, out io.Writer, now time.Time) (supportBundleManifest, error) {
+	manifest := supportBundleManifest{
+		Target:    target,
+		Collected: now.UTC().Format(time.RFC3339),
+		Entries:   make([]supportBundleEntry, 0, len(supportBundleFiles)),
+	}
+	dir := "pat-support-" + now.UTC().Format("20060102T150405Z") + "/"
+	gz := gzip.NewWriter(out)
+	archive := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		header := &tar.Header{
+			Name:    dir + name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := archive.Write(data)
+		return err
+	}
+
+	for _, file := range supportBundleFiles {
+		entry := supportBundleEntry{Name: file.name, Path: file.path}
+		uri, err := adminURL(target, file.path)
+		if err != nil {
+			return manifest, err
+		}
+		status, body, err := fetchAdminFile(httpClient, uri, authorize)
+		entry.Status, entry.Size = status, len(body)
+		switch {
+		case err != nil:
+			entry.Error = err.Error()
+		case status != http.StatusOK:
+			entry.Error = strings.TrimSpace(string(body))
+		default:
+			if err := add(file.name, body); err != nil {
+				return manifest, err
+			}
+		}
+		if entry.Error != "" {
+			log.Warnln("Failed collecting", file.path+":", entry.Error)
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	manifestEnc, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := add("manifest.json", manifestEnc); err != nil {
+		return manifest, err
+	}
+	if err := archive.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, gz.Close()
+}
+
+func runSupportBundle(c *cli.Context) error {
+	target := c.String("target")
+	adminToken := c.String("admin-token")
+	outFile := c.String("out")
+	timeout := c.Duration("timeout")
+
+	if target == "" {
+		log.Fatal("Invalid target. See README for running instructions.")
+	}
+	hmacKeys, err := parseAdminHMACKeys(c.StringSlice("admin-hmac-key"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if adminToken == "" && len(hmacKeys) == 0 {
+		log.Fatal("Invalid admin credentials, expected --admin-token or --admin-hmac-key. See README for running instructions.")
+	}
+	if len(hmacKeys) > 1 {
+		log.Fatal("Invalid admin HMAC key, expected a single key. See README for running instructions.")
+	}
+	if timeout <= 0 {
+		log.Fatal("Invalid timeout. See README for running instructions.")
+	}
+
+	authorize := func(req *http.Request) error {
+		for keyID, key := range hmacKeys {
+			return signAdminRequest(req, keyID, key, time.Now())
+		}
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		return nil
+	}
+
+	now := time.Now()
+	if outFile == "" {
+		outFile = "pat-support-" + now.UTC().Format("20060102T150405Z") + ".tar.gz"
+	}
+	out, err := os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	manifest, err := collectSupportBundle(&http.Client{Timeout: timeout}, target, authorize, out, now)
+	if err != nil {
+		return err
+	}
+	collected := 0
+	for _, entry := range manifest.Entries {
+		if entry.Error == "" {
+			collected++
+		}
+	}
+	if collected == 0 {
+		return fmt.Errorf("Nothing collected from %s, see %s", target, outFile)
+	}
+	fmt.Printf("Wrote %s with %d of %d files\n", outFile, collected, len(manifest.Entries))
+	return out.Close()
+}
@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readSupportBundle(t *testing.T, archive []byte) map[string][]byte {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name[strings.Index(header.Name, "/")+1:]] = data
+	}
+}
+
+func TestAttesterStateSummary(t *testing.T) {
+	attester := newTestAttester(&AttesterPolicy{})
+	attester.clientKeys = newClientKeyRegistry()
+	now := time.Now()
+	for _, origin := range []string{"origin-a", "origin-b"} {
+		if err := attester.issue("alice", origin, 10, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := attester.issue("bob", "origin-a", 10, now); err != nil {
+		t.Fatal(err)
+	}
+	attester.blindedKeys.claim("blinded", "alice", "origin-a", time.Now())
+
+	var summary attesterStateSummary
+	if code := adminRequest(t, attester.newAdminServer("secret"), http.MethodGet, adminStateSummaryURI, nil, &summary); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if summary.Clients != 2 || summary.AnonymousOrigins != 3 || summary.MaxOriginsPerClient != 2 || summary.BlindedKeys != 1 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+}
+
+func TestSupportBundle(t *testing.T) {
+	attester := newTestAttester(&AttesterPolicy{})
+	admin := attester.newAdminServer("secret")
+	admin.serveConfig(effectiveConfig{Role: "attester", Flags: map[string]interface{}{"admin-token": redactedValue}})
+	server := httptest.NewTLSServer(admin)
+	defer server.Close()
+
+	authorize := func(req *http.Request) error {
+		req.Header.Set("Authorization", "Bearer secret")
+		return nil
+	}
+	var out bytes.Buffer
+	now := time.Unix(1700000000, 0)
+	manifest, err := collectSupportBundle(server.Client(), server.URL+"/", authorize, &out, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range manifest.Entries {
+		if entry.Error != "" || entry.Status != http.StatusOK {
+			t.Fatalf("expected %s to be collected, got %+v", entry.Name, entry)
+		}
+	}
+	files := readSupportBundle(t, out.Bytes())
+	for _, name := range []string{"openapi.json", "config.json", "metrics.txt", "goroutines.txt", "heap.pprof", "state-summary.json", "manifest.json"} {
+		if len(files[name]) == 0 {
+			t.Fatalf("expected %s in the bundle", name)
+		}
+	}
+	if !strings.Contains(string(files["goroutines.txt"]), "goroutine profile") {
+		t.Fatalf("unexpected goroutines %s", files["goroutines.txt"])
+	}
+	var written supportBundleManifest
+	if err := json.Unmarshal(files["manifest.json"], &written); err != nil || written.Collected != "2023-11-14T22:13:20Z" {
+		t.Fatalf("unexpected manifest %s, %v", files["manifest.json"], err)
+	}
+
+	// Failures are recorded, not fatal
+	out.Reset()
+	unauthorized := func(req *http.Request) error { return nil }
+	manifest, err = collectSupportBundle(server.Client(), server.URL, unauthorized, &out, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Entries[0].Status != http.StatusUnauthorized || manifest.Entries[0].Error == "" {
+		t.Fatalf("expected failures in the manifest, got %+v", manifest.Entries[0])
+	}
+	if files := readSupportBundle(t, out.Bytes()); len(files) != 1 || files["manifest.json"] == nil {
+		t.Fatalf("expected only the manifest, got %d files", len(files))
+	}
+}
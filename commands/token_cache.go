@@ -0,0 +1,57 @@
+package commands
+
+import (
+	"bytes"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// EvictTokens drops the tokens stored for the challenge under another key
+// than keyID, which the issuer rotated away, and returns how many it dropped.
+func (s *TokenStore) EvictTokens(challenge string, keyID []byte) int {
+	kept := make([]pat.Token, 0, len(s.store[challenge]))
+	for _, token := range s.store[challenge] {
+		if bytes.Equal(token.KeyID, keyID) {
+			kept = append(kept, token)
+		}
+	}
+	evicted := len(s.store[challenge]) - len(kept)
+	if len(kept) == 0 {
+		delete(s.store, challenge)
+	} else {
+		s.store[challenge] = kept
+	}
+	return evicted
+}
+
+// cachedToken returns a token for the challenge from the store. Tokens for
+// non-interactive challenges are served from the store, which is refilled
+// with prefetch tokens when empty, so that later requests skip issuance.
+// Tokens of other challenges are fetched one at a time. A prefetch of zero
+// disables caching.
+func cachedToken(store *TokenStore, fetcher *tokenFetcher, challenge clientChallenge, prefetch int) (pat.Token, error) {
+	if prefetch <= 0 || !challenge.nonInteractive() {
+		return fetcher.fetch(challenge)
+	}
+	if evicted := store.EvictTokens(challenge.context, challenge.tokenKeyID()); evicted > 0 {
+		log.Infof("Evicted %d cached tokens for challenge %s issued under a rotated key", evicted, challenge.context)
+	}
+	if _, err := store.Token(challenge.context); err != nil {
+		log.Debugf("Prefetching %d tokens for challenge %s\n", prefetch, challenge.context)
+		for i := 0; i < prefetch; i++ {
+			token, err := fetcher.fetch(challenge)
+			if err != nil && i == 0 {
+				return pat.Token{}, err
+			}
+			if err != nil {
+				log.Warnf("Prefetched %d of %d tokens: %v", i, prefetch, err)
+				break
+			}
+			store.AddToken(challenge.context, token)
+		}
+	} else {
+		log.Debugf("Using cached token for challenge %s\n", challenge.context)
+	}
+	return store.ConsumeToken(challenge.context)
+}
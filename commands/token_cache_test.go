@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestTokenStoreEviction(t *testing.T) {
+	store := EmptyStore()
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	store.AddToken("context", pat.Token{KeyID: oldKey})
+	store.AddToken("context", pat.Token{KeyID: newKey})
+	store.AddToken("context", pat.Token{KeyID: oldKey})
+	if evicted := store.EvictTokens("context", newKey); evicted != 2 {
+		t.Fatalf("expected 2 tokens under the old key to be evicted, got %d", evicted)
+	}
+	if token, err := store.Token("context"); err != nil || !bytes.Equal(token.KeyID, newKey) {
+		t.Fatal("expected the token under the current key to be kept")
+	}
+	store.EvictTokens("context", oldKey)
+	if _, err := store.Token("context"); err != ErrNoMatchingToken {
+		t.Fatal("expected the context to be dropped once empty")
+	}
+}
+
+func TestTokenPrefetch(t *testing.T) {
+	server := newClientFlowServer(t)
+	flow := clientFlow{
+		fetcher: &tokenFetcher{
+			httpClient:  server.Client(),
+			basicClient: pat.NewBasicPublicClient(),
+		},
+		store:          EmptyStore(),
+		prefetch:       3,
+		tokenType:      "basic",
+		nonInteractive: true,
+	}
+	fetch := func() {
+		resp, err := flow.run(server.URL + "/index.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the token to be accepted, got %d", resp.StatusCode)
+		}
+	}
+
+	fetch()
+	if server.issued != 3 {
+		t.Fatalf("expected 3 tokens to be prefetched, got %d", server.issued)
+	}
+	fetch()
+	fetch()
+	if server.issued != 3 {
+		t.Fatalf("expected cached tokens to be used, got %d issuances", server.issued)
+	}
+	fetch()
+	if server.issued != 6 {
+		t.Fatalf("expected the cache to be refilled once empty, got %d issuances", server.issued)
+	}
+
+	// Tokens under the previous key are evicted, since the context is the same
+	server.rotateKeys(t)
+	fetch()
+	if server.issued != 9 {
+		t.Fatalf("expected tokens to be fetched again after key rotation, got %d issuances", server.issued)
+	}
+
+	// Interactive challenges are never cached
+	flow.nonInteractive = false
+	fetch()
+	if server.issued != 10 {
+		t.Fatalf("expected a single token for an interactive challenge, got %d issuances", server.issued)
+	}
+}
@@ -0,0 +1,67 @@
+package commands
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+const (
+	// Fixed field sizes of the token request encodings
+	tokenTypeLength             = 2
+	tokenKeyIDLength            = 1
+	minBlindedMessageLength     = 256 // RSA-2048 blind RSA messages
+	rateLimitedRequestKeyLength = 49  // compressed P-384 point
+	rateLimitedNameKeyIDLength  = 32
+	rateLimitedSignatureLength  = 96 // P-384 (r, s) pair
+)
+
+var (
+	ErrTokenRequestTooShort    = errors.New("TokenRequest too short")
+	ErrUnsupportedTokenRequest = errors.New("Unsupported TokenRequest token type")
+)
+
+// validateTokenRequest checks that the encoded TokenRequest is structurally
+// valid for the token type it claims, without performing any cryptographic
+// operations. It returns the claimed token type on success.
+func validateTokenRequest(data []byte) (uint16, error) {
+	if len(data) < tokenTypeLength {
+		return 0, ErrTokenRequestTooShort
+	}
+
+	tokenType := binary.BigEndian.Uint16(data)
+	switch tokenType {
+	case pat.BasicPublicTokenType:
+		minLength := tokenTypeLength + tokenKeyIDLength + minBlindedMessageLength
+		if len(data) < minLength {
+			return tokenType, fmt.Errorf("%w: basic TokenRequest is %d bytes, expected at least %d", ErrTokenRequestTooShort, len(data), minLength)
+		}
+	case pat.RateLimitedTokenType:
+		prefixLength := tokenTypeLength + rateLimitedRequestKeyLength + rateLimitedNameKeyIDLength + 2
+		if len(data) < prefixLength {
+			return tokenType, fmt.Errorf("%w: rate-limited TokenRequest is %d bytes, expected at least %d", ErrTokenRequestTooShort, len(data), prefixLength)
+		}
+		encryptedLength := int(binary.BigEndian.Uint16(data[prefixLength-2:]))
+		if encryptedLength == 0 {
+			return tokenType, fmt.Errorf("Invalid rate-limited TokenRequest: empty encrypted_token_request")
+		}
+		expectedLength := prefixLength + encryptedLength + rateLimitedSignatureLength
+		if len(data) != expectedLength {
+			return tokenType, fmt.Errorf("Invalid rate-limited TokenRequest: got %d bytes, expected %d", len(data), expectedLength)
+		}
+	case pat.BasicPrivateTokenType:
+		if len(data) != privateTokenRequestLength {
+			return tokenType, fmt.Errorf("Invalid private TokenRequest: got %d bytes, expected %d", len(data), privateTokenRequestLength)
+		}
+	case ed25519TokenType:
+		if len(data) != ed25519TokenRequestLength {
+			return tokenType, fmt.Errorf("Invalid Ed25519 TokenRequest: got %d bytes, expected %d", len(data), ed25519TokenRequestLength)
+		}
+	default:
+		return tokenType, fmt.Errorf("%w: 0x%04x", ErrUnsupportedTokenRequest, tokenType)
+	}
+
+	return tokenType, nil
+}
@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"errors"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func createRateLimitedTokenRequest(encryptedLength int) []byte {
+	req := pat.RateLimitedTokenRequest{
+		RequestKey:            make([]byte, rateLimitedRequestKeyLength),
+		NameKeyID:             make([]byte, rateLimitedNameKeyIDLength),
+		EncryptedTokenRequest: make([]byte, encryptedLength),
+		Signature:             make([]byte, rateLimitedSignatureLength),
+	}
+	return req.Marshal()
+}
+
+func TestValidateTokenRequest(t *testing.T) {
+	basicRequest := pat.BasicPublicTokenRequest{
+		TokenKeyID: 0x01,
+		BlindedReq: make([]byte, minBlindedMessageLength),
+	}
+	tokenType, err := validateTokenRequest(basicRequest.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenType != pat.BasicPublicTokenType {
+		t.Fatal("token type mismatch")
+	}
+
+	tokenType, err = validateTokenRequest(createRateLimitedTokenRequest(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenType != pat.RateLimitedTokenType {
+		t.Fatal("token type mismatch")
+	}
+}
+
+func TestValidateTokenRequestMalformed(t *testing.T) {
+	if _, err := validateTokenRequest([]byte{0x00}); !errors.Is(err, ErrTokenRequestTooShort) {
+		t.Fatal("expected short request to be rejected")
+	}
+	if _, err := validateTokenRequest([]byte{0x00, 0x02, 0x01, 0x02}); !errors.Is(err, ErrTokenRequestTooShort) {
+		t.Fatal("expected truncated basic request to be rejected")
+	}
+	if _, err := validateTokenRequest([]byte{0xFF, 0xFF, 0x00}); !errors.Is(err, ErrUnsupportedTokenRequest) {
+		t.Fatal("expected unknown token type to be rejected")
+	}
+
+	rateLimitedRequest := createRateLimitedTokenRequest(64)
+	if _, err := validateTokenRequest(rateLimitedRequest[:len(rateLimitedRequest)-1]); err == nil {
+		t.Fatal("expected truncated rate-limited request to be rejected")
+	}
+	if _, err := validateTokenRequest(append(rateLimitedRequest, 0x00)); err == nil {
+		t.Fatal("expected trailing data to be rejected")
+	}
+	if _, err := validateTokenRequest(createRateLimitedTokenRequest(0)); err == nil {
+		t.Fatal("expected empty encrypted request to be rejected")
+	}
+}
@@ -150,7 +150,7 @@ func ReadStoreFromFile(fname string) (*TokenStore, error) {
 				return nil, err
 			}
 
-			token, err := pat.UnmarshalToken(tokenEnc)
+			token, err := unmarshalToken(tokenEnc)
 			if err != nil {
 				return nil, err
 			}
@@ -13,7 +13,7 @@ func createEmptyToken() pat.Token {
 		Nonce:         make([]byte, 32),
 		Context:       make([]byte, 32),
 		KeyID:         make([]byte, 32),
-		Authenticator: make([]byte, 512),
+		Authenticator: make([]byte, 256),
 	}
 }
 
@@ -0,0 +1,176 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Problem type of token requests and challenges of token types the
+	// receiver does not support
+	unsupportedTokenTypeProblemType = problemTypePrefix + "unsupported-token-type"
+
+	ErrUnsupportedTokenType = errors.New("Unsupported token type")
+)
+
+// knownTokenTypes returns the token types pat-app implements, in ascending
+// order.
+func knownTokenTypes() []uint16 {
+	tokenTypes := make([]uint16, 0, len(tokenTypeNames))
+	for _, tokenType := range tokenTypeNames {
+		tokenTypes = append(tokenTypes, tokenType)
+	}
+	sort.Slice(tokenTypes, func(i, j int) bool { return tokenTypes[i] < tokenTypes[j] })
+	return tokenTypes
+}
+
+// isKnownTokenType returns whether pat-app implements the token type.
+func isKnownTokenType(tokenType uint16) bool {
+	for _, known := range tokenTypeNames {
+		if known == tokenType {
+			return true
+		}
+	}
+	return false
+}
+
+// labelTokenType returns the token type as a metric label. Types pat-app
+// does not implement are all labeled 0, so that clients sending them cannot
+// create label values.
+func labelTokenType(tokenType uint16) uint16 {
+	if !isKnownTokenType(tokenType) {
+		return 0
+	}
+	return tokenType
+}
+
+// offeredTokenTypes returns the token types of the challenges, in the order
+// offered.
+func offeredTokenTypes(challenges []clientChallenge) []uint16 {
+	offered := make([]uint16, 0, len(challenges))
+	for _, challenge := range challenges {
+		offered = append(offered, challenge.tokenType())
+	}
+	return offered
+}
+
+// describeTokenType names the token type for people, e.g., "basic (0x0002)".
+func describeTokenType(tokenType uint16) string {
+	for name, known := range tokenTypeNames {
+		if known == tokenType {
+			return name + " (" + formatTokenType(tokenType) + ")"
+		}
+	}
+	return formatTokenType(tokenType)
+}
+
+func describeTokenTypes(tokenTypes []uint16) string {
+	if len(tokenTypes) == 0 {
+		return "none"
+	}
+	described := make([]string, len(tokenTypes))
+	for i, tokenType := range tokenTypes {
+		described[i] = describeTokenType(tokenType)
+	}
+	return strings.Join(described, ", ")
+}
+
+// unsupportedTokenTypeProblem is the problem details body refusing a token
+// type, listing the token types that are supported instead.
+type unsupportedTokenTypeProblem struct {
+	problemDetails
+	TokenType           string   `json:"token_type"`
+	SupportedTokenTypes []string `json:"supported_token_types"`
+}
+
+// unsupportedTokenTypeError refuses a token type the role does not support.
+type unsupportedTokenTypeError struct {
+	role      string
+	tokenType uint16
+	supported []uint16
+}
+
+func (e unsupportedTokenTypeError) Error() string {
+	return fmt.Sprintf("%s: the %s does not support %s, only %s", ErrUnsupportedTokenType, e.role, describeTokenType(e.tokenType), describeTokenTypes(e.supported))
+}
+
+func (e unsupportedTokenTypeError) Unwrap() error {
+	return ErrUnsupportedTokenType
+}
+
+// writeUnsupportedTokenType refuses the token type with a 400 problem details
+// response listing the supported token types.
+func writeUnsupportedTokenType(w http.ResponseWriter, err unsupportedTokenTypeError) {
+	log.Debugln(err)
+	problem := unsupportedTokenTypeProblem{
+		problemDetails: problemDetails{
+			Type:      unsupportedTokenTypeProblemType,
+			Title:     ErrUnsupportedTokenType.Error(),
+			Status:    http.StatusBadRequest,
+			Detail:    err.Error(),
+			RefusedBy: err.role,
+		},
+		TokenType:           formatTokenType(err.tokenType),
+		SupportedTokenTypes: make([]string, len(err.supported)),
+	}
+	for i, supportedType := range err.supported {
+		problem.SupportedTokenTypes[i] = formatTokenType(supportedType)
+	}
+	problemEnc, _ := json.Marshal(problem)
+	writeProblem(w, http.StatusBadRequest, problemEnc)
+}
+
+// parseUnsupportedTokenType returns the refusal of a token type in the
+// problem details.
+func parseUnsupportedTokenType(problemEnc []byte) (unsupportedTokenTypeError, bool) {
+	var problem unsupportedTokenTypeProblem
+	if err := json.Unmarshal(problemEnc, &problem); err != nil || problem.Type != unsupportedTokenTypeProblemType {
+		return unsupportedTokenTypeError{}, false
+	}
+	var err error
+	refused := unsupportedTokenTypeError{role: problem.RefusedBy}
+	refused.tokenType, err = parseFormattedTokenType(problem.TokenType)
+	if err != nil {
+		return unsupportedTokenTypeError{}, false
+	}
+	for _, supportedEnc := range problem.SupportedTokenTypes {
+		if supported, err := parseFormattedTokenType(supportedEnc); err == nil {
+			refused.supported = append(refused.supported, supported)
+		}
+	}
+	return refused, true
+}
+
+// parseFormattedTokenType parses a token type formatted by formatTokenType.
+func parseFormattedTokenType(tokenTypeEnc string) (uint16, error) {
+	tokenType, err := strconv.ParseUint(strings.TrimPrefix(tokenTypeEnc, "0x"), 16, 16)
+	if err != nil || !strings.HasPrefix(tokenTypeEnc, "0x") {
+		return 0, fmt.Errorf("Invalid token type %q", tokenTypeEnc)
+	}
+	return uint16(tokenType), nil
+}
+
+// tokenRequestError returns the error of a failed token request, naming the
+// token types the attester or issuer supports if it refused the token type,
+// or the reason the issuer refused the origin.
+func tokenRequestError(resp *http.Response) error {
+	problemEnc, problemType, ok := readProblem(resp)
+	if ok {
+		switch problemType {
+		case unsupportedTokenTypeProblemType:
+			if refused, ok := parseUnsupportedTokenType(problemEnc); ok {
+				return refused
+			}
+		case originNotAllowedProblemType:
+			return ErrOriginNotAllowed
+		}
+	}
+	return fmt.Errorf("Request failed with error %d", resp.StatusCode)
+}
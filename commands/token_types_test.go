@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func requestTokenFromAttester(attester TestAttester, requestEnc []byte) *http.Response {
+	req := httptest.NewRequest(http.MethodPost, attesterTokenRequestURI+"?issuer=issuer.example", bytes.NewReader(requestEnc))
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+	w := httptest.NewRecorder()
+	attester.handleAttestationRequest(w, req)
+	return w.Result()
+}
+
+func TestUnsupportedTokenTypeRefusals(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	server := httptest.NewTLSServer(http.HandlerFunc(issuer.handleIssuanceRequest))
+	defer server.Close()
+	attester := newTestAttester(&AttesterPolicy{})
+	attester.client = server.Client()
+	attester.issuers = newIssuerPool(map[string][]string{"issuer.example": {server.URL + tokenRequestURI}}, time.Second)
+
+	// The attester refuses token types pat-app does not implement
+	err := tokenRequestError(requestTokenFromAttester(attester, []byte{0x12, 0x34, 0x00}))
+	refused, ok := err.(unsupportedTokenTypeError)
+	if !ok || refused.role != "attester" || refused.tokenType != 0x1234 || !reflect.DeepEqual(refused.supported, knownTokenTypes()) {
+		t.Fatalf("expected the attester to refuse the token type, got %v", err)
+	}
+
+	// and relays the refusal of types the issuer has no key for
+	requestEnc := make([]byte, privateTokenRequestLength)
+	requestEnc[1] = byte(pat.BasicPrivateTokenType)
+	err = tokenRequestError(requestTokenFromAttester(attester, requestEnc))
+	if !errors.Is(err, ErrUnsupportedTokenType) || !strings.Contains(err.Error(), "the issuer does not support private (0x0001), only basic (0x0002), rate-limited (0x0003)") {
+		t.Fatalf("expected the issuer's refusal to be relayed, got %v", err)
+	}
+
+	resp := &http.Response{StatusCode: http.StatusBadRequest, Header: http.Header{}, Body: http.NoBody}
+	if err := tokenRequestError(resp); errors.Is(err, ErrUnsupportedTokenType) || err.Error() != "Request failed with error 400" {
+		t.Fatalf("expected other errors unchanged, got %v", err)
+	}
+}
+
+func TestClientUnsupportedTokenTypes(t *testing.T) {
+	unknown := clientChallenge{blob: []byte{0x12, 0x34}}
+	basic := clientChallenge{blob: []byte{0x00, 0x02}}
+
+	if _, err := (clientProfile{name: "default"}).selectChallenges([]clientChallenge{unknown}); !errors.Is(err, ErrUnsupportedTokenType) || !strings.Contains(err.Error(), "origin offered 0x1234") {
+		t.Fatalf("expected unknown challenges to be skipped, got %v", err)
+	}
+	if selected, err := (clientProfile{name: "default"}).selectChallenges([]clientChallenge{unknown, basic}); err != nil || selected[0].tokenType() != pat.BasicPublicTokenType {
+		t.Fatalf("expected the basic challenge to be selected, got %v", err)
+	}
+	if _, err := (&tokenFetcher{}).fetch(unknown); !errors.Is(err, ErrUnsupportedTokenType) {
+		t.Fatalf("expected the fetch to be refused, got %v", err)
+	}
+}
+
+func TestOriginTokenTypeFallback(t *testing.T) {
+	origin := newTestOrigin()
+	origin.tokenTypes = newTokenTypeToggle()
+	keys := origin.issuerKeys.current()
+	challengeFor := func(tokenType string) uint16 {
+		req := httptest.NewRequest(http.MethodGet, "https://origin.example/?type="+tokenType, nil)
+		challengeType, _ := origin.challengeTokenType(req, keys)
+		origin.countTokenTypeFallback(req, challengeType)
+		return challengeType
+	}
+
+	if challengeFor("2") != pat.BasicPublicTokenType {
+		t.Fatal("expected the requested type to be challenged for")
+	}
+	unknown := originTokenTypeFallbacks.Value(0, "unknown")
+	if challengeFor("4660") != pat.RateLimitedTokenType || originTokenTypeFallbacks.Value(0, "unknown") != unknown+1 {
+		t.Fatal("expected unknown types to fall back to rate-limited tokens")
+	}
+	notOffered := originTokenTypeFallbacks.Value(pat.BasicPrivateTokenType, "not_offered")
+	if challengeFor("1") != pat.RateLimitedTokenType || originTokenTypeFallbacks.Value(pat.BasicPrivateTokenType, "not_offered") != notOffered+1 {
+		t.Fatal("expected types without keys to fall back to rate-limited tokens")
+	}
+	origin.tokenTypes.set([]string{"basic"})
+	notAccepted := originTokenTypeFallbacks.Value(pat.RateLimitedTokenType, "not_accepted")
+	if challengeFor("3") != pat.BasicPublicTokenType || originTokenTypeFallbacks.Value(pat.RateLimitedTokenType, "not_accepted") != notAccepted+1 {
+		t.Fatal("expected types no longer accepted to fall back to accepted ones")
+	}
+}
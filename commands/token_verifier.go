@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha512" // SHA-384 for RSA blind signatures
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cloudflare/circl/oprf"
+	pat "github.com/cloudflare/pat-go"
+)
+
+var ErrNoTokenVerifier = errors.New("No verifier for token type")
+
+// tokenVerifier checks the authenticators of tokens at the origin. Each token
+// type has one, registered with registerTokenVerifier, so that experimental
+// types and algorithms are added without touching the redemption path.
+type tokenVerifier interface {
+	// algorithm names the authenticator scheme, e.g., rsa-pss-sha-384.
+	algorithm() string
+	// verify checks the authenticator of a token of the type with the keys.
+	verify(keys verificationKeys, tokenType uint16, token pat.Token) error
+}
+
+// verificationKeys are the keys verifiers may use: those the issuer published
+// and those the origin was configured with.
+type verificationKeys struct {
+	issuer          *issuerKeys
+	privateTokenKey *oprf.PrivateKey // nil unless configured
+}
+
+// Verifiers by token type
+var tokenVerifiers = make(map[uint16]tokenVerifier)
+
+// registerTokenVerifier sets the verifier of a token type, replacing any.
+func registerTokenVerifier(tokenType uint16, verifier tokenVerifier) {
+	tokenVerifiers[tokenType] = verifier
+}
+
+func init() {
+	registerTokenVerifier(pat.BasicPublicTokenType, rsaPSSVerifier{crypto.SHA384})
+	registerTokenVerifier(pat.RateLimitedTokenType, rsaPSSVerifier{crypto.SHA384})
+	registerTokenVerifier(pat.BasicPrivateTokenType, privateTokenVerifier{})
+}
+
+// verifyToken checks a token of the type with its registered verifier.
+func verifyToken(keys verificationKeys, tokenType uint16, token pat.Token) error {
+	verifier, ok := tokenVerifiers[tokenType]
+	if !ok {
+		return fmt.Errorf("%w %s", ErrNoTokenVerifier, formatTokenType(tokenType))
+	}
+	if err := verifier.verify(keys, tokenType, token); err != nil {
+		return fmt.Errorf("%s: %w", verifier.algorithm(), err)
+	}
+	return nil
+}
+
+// rsaPSSVerifier checks RSA blind signature authenticators, RSASSA-PSS with
+// the hash for both the message and MGF1 and a salt as long as the hash, with
+// the RSA key the issuer published for the type and key ID.
+type rsaPSSVerifier struct {
+	hash crypto.Hash
+}
+
+func (v rsaPSSVerifier) algorithm() string {
+	return "rsa-pss-" + strings.ToLower(v.hash.String())
+}
+
+func (v rsaPSSVerifier) verify(keys verificationKeys, tokenType uint16, token pat.Token) error {
+	return verifyRSAPSS(keys.issuer.publicTokenKey(tokenType, token.KeyID), v.hash, token)
+}
+
+// verifyRSAPSS checks an RSASSA-PSS authenticator over the token input.
+func verifyRSAPSS(key *rsa.PublicKey, hash crypto.Hash, token pat.Token) error {
+	if key == nil {
+		return fmt.Errorf("No key for token type %d", token.TokenType)
+	}
+	if !hash.Available() {
+		return fmt.Errorf("Unavailable hash %s", hash)
+	}
+	h := hash.New()
+	h.Write(token.AuthenticatorInput())
+	return rsa.VerifyPSS(key, hash, h.Sum(nil), token.Authenticator, &rsa.PSSOptions{
+		Hash:       hash,
+		SaltLength: hash.Size(),
+	})
+}
+
+// privateTokenVerifier checks VOPRF authenticators with the issuer key the
+// origin was configured with.
+type privateTokenVerifier struct{}
+
+func (privateTokenVerifier) algorithm() string {
+	return "voprf-p384-sha384"
+}
+
+func (privateTokenVerifier) verify(keys verificationKeys, tokenType uint16, token pat.Token) error {
+	return verifyPrivateToken(keys.privateTokenKey, token)
+}
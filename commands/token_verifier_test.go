@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+func TestVerifyTokenByType(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	tokenKey := issuer.basicIssuer.TokenKey()
+	keys := verificationKeys{issuer: &issuerKeys{}}
+	keys.issuer.basicValidationKey = tokenKey
+
+	token := createTestToken(t, issuer, testTokenChallenge(pat.BasicPublicTokenType))
+	if err := verifyToken(keys, pat.BasicPublicTokenType, token); err != nil {
+		t.Fatal(err)
+	}
+	token.Authenticator[0] ^= 0xff
+	if err := verifyToken(keys, pat.BasicPublicTokenType, token); err == nil {
+		t.Fatal("expected a tampered token to be refused")
+	}
+
+	const experimentalTokenType = 0xf0f0
+	if err := verifyToken(keys, experimentalTokenType, token); !errors.Is(err, ErrNoTokenVerifier) {
+		t.Fatalf("expected no verifier, got %v", err)
+	}
+
+	// Experimental types plug in their own algorithm
+	registerTokenVerifier(experimentalTokenType, rsaPSSVerifier{crypto.SHA256})
+	defer delete(tokenVerifiers, experimentalTokenType)
+	if name := tokenVerifiers[experimentalTokenType].algorithm(); name != "rsa-pss-sha-256" {
+		t.Fatalf("unexpected algorithm %q", name)
+	}
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenKeyEnc, err := marshalTokenKey(&signingKey.PublicKey, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := sha256.Sum256(tokenKeyEnc)
+	keys.issuer.addPublicTokenKey(experimentalTokenType, tokenKeyEnc, &signingKey.PublicKey)
+	experimental := pat.Token{
+		TokenType: experimentalTokenType,
+		Nonce:     make([]byte, 32),
+		Context:   make([]byte, 32),
+		KeyID:     keyID[:],
+	}
+	digest := sha256.Sum256(experimental.AuthenticatorInput())
+	experimental.Authenticator, err = rsa.SignPSS(rand.Reader, signingKey, crypto.SHA256, digest[:], &rsa.PSSOptions{
+		SaltLength: crypto.SHA256.Size(),
+		Hash:       crypto.SHA256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyToken(keys, experimentalTokenType, experimental); err != nil {
+		t.Fatal(err)
+	}
+	registerTokenVerifier(experimentalTokenType, rsaPSSVerifier{crypto.SHA384})
+	if err := verifyToken(keys, experimentalTokenType, experimental); err == nil {
+		t.Fatal("expected a SHA-256 authenticator to be refused by a SHA-384 verifier")
+	}
+}
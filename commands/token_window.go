@@ -0,0 +1,201 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrWindowLimitExceeded = errors.New("Token window limit exceeded")
+
+// IssuerTokenWindow limits the tokens a client obtains per origin within
+// consecutive windows of Window seconds, aligned to the Unix epoch, e.g., 10
+// per hour and 50 per day. Issuers publish them in their directory, and
+// attesters enforcing issuer policies count tokens against each.
+type IssuerTokenWindow struct {
+	Window int `json:"window"`
+	Limit  int `json:"limit"`
+}
+
+// parseTokenWindows parses <seconds>=<limit> specifications.
+func parseTokenWindows(specs []string) ([]IssuerTokenWindow, error) {
+	windows := make([]IssuerTokenWindow, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid token window %q, expected <seconds>=<limit>", spec)
+		}
+		window, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid token window %q, expected <seconds>=<limit>", spec)
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid token window %q, expected <seconds>=<limit>", spec)
+		}
+		windows = append(windows, IssuerTokenWindow{Window: window, Limit: limit})
+	}
+	return windows, validateTokenWindows(windows)
+}
+
+// validateTokenWindows checks that windows and limits are positive, and that
+// no window is given twice.
+func validateTokenWindows(windows []IssuerTokenWindow) error {
+	seen := make(map[int]bool)
+	for _, window := range windows {
+		if window.Window <= 0 || window.Limit <= 0 {
+			return fmt.Errorf("Invalid token window of %d seconds with limit %d, both must be positive", window.Window, window.Limit)
+		}
+		if seen[window.Window] {
+			return fmt.Errorf("Duplicate token window of %d seconds", window.Window)
+		}
+		seen[window.Window] = true
+	}
+	return nil
+}
+
+// tokenWindow is an issuer token window as the attester enforces it.
+type tokenWindow struct {
+	length time.Duration
+	limit  int
+}
+
+// tokenWindowsOf returns the valid windows of a directory, shortest first.
+func tokenWindowsOf(published []IssuerTokenWindow) []tokenWindow {
+	windows := make([]tokenWindow, 0, len(published))
+	for _, window := range published {
+		if window.Window > 0 && window.Limit > 0 {
+			windows = append(windows, tokenWindow{time.Duration(window.Window) * time.Second, window.Limit})
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].length < windows[j].length })
+	return windows
+}
+
+// epoch returns the window now falls in.
+func (w tokenWindow) epoch(now time.Time) uint64 {
+	return uint64(now.UnixNano() / int64(w.length))
+}
+
+// end returns when the window now falls in rolls over.
+func (w tokenWindow) end(now time.Time) time.Time {
+	return time.Unix(0, int64(w.epoch(now)+1)*int64(w.length))
+}
+
+// windowCount is the tokens issued for an origin in one epoch of a window.
+type windowCount struct {
+	epoch uint64
+	count int
+}
+
+// windowLimitError refuses an issuance until its window rolls over.
+type windowLimitError struct {
+	window tokenWindow
+	reset  time.Time
+}
+
+func (e windowLimitError) Error() string {
+	return fmt.Sprintf("%s: %d tokens per %s", ErrWindowLimitExceeded, e.window.limit, e.window.length)
+}
+
+func (e windowLimitError) Unwrap() error {
+	return ErrWindowLimitExceeded
+}
+
+// windowCount returns the tokens issued for the anonymous origin in the
+// current epoch of the window.
+func (state *ClientState) windowCount(anonOriginEnc string, window tokenWindow, now time.Time) int {
+	counted, ok := state.windowCounts[anonOriginEnc][window.length]
+	if !ok || counted.epoch != window.epoch(now) {
+		return 0
+	}
+	return counted.count
+}
+
+// windowsCurrent reports whether tokens issued for the anonymous origin still
+// count against a window, so its state must be kept.
+func (state *ClientState) windowsCurrent(anonOriginEnc string, now time.Time) bool {
+	for length, counted := range state.windowCounts[anonOriginEnc] {
+		if counted.epoch == (tokenWindow{length: length}).epoch(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// setWindowCount sets the count of the anonymous origin in a window.
+func (state *ClientState) setWindowCount(anonOriginEnc string, length time.Duration, counted windowCount) {
+	if state.windowCounts == nil {
+		state.windowCounts = make(map[string]map[time.Duration]windowCount)
+	}
+	if state.windowCounts[anonOriginEnc] == nil {
+		state.windowCounts[anonOriginEnc] = make(map[time.Duration]windowCount)
+	}
+	state.windowCounts[anonOriginEnc][length] = counted
+}
+
+// countInWindows counts an issuance for the anonymous origin in each window,
+// starting over in windows that rolled over.
+func (state *ClientState) countInWindows(anonOriginEnc string, windows []tokenWindow, now time.Time) {
+	for _, window := range windows {
+		state.setWindowCount(anonOriginEnc, window.length, windowCount{
+			epoch: window.epoch(now),
+			count: state.windowCount(anonOriginEnc, window, now) + 1,
+		})
+	}
+}
+
+// checkWindows refuses an issuance for the anonymous origin if a window of
+// the issuer is exhausted, reporting when the longest of those rolls over.
+func (a TestAttester) checkWindows(state *ClientState, anonOriginEnc, issuer string, now time.Time) error {
+	var refused *windowLimitError
+	for _, window := range a.issuerPolicies.windows(issuer) {
+		if state.windowCount(anonOriginEnc, window, now) < window.limit {
+			continue
+		}
+		if reset := window.end(now); refused == nil || reset.After(refused.reset) {
+			refused = &windowLimitError{window: window, reset: reset}
+		}
+	}
+	if refused != nil {
+		return *refused
+	}
+	return nil
+}
+
+// retryAfter returns how long a client refused with the error should wait
+// before asking again, zero if unknown.
+func (a TestAttester) retryAfter(err error, clientID string, now time.Time) time.Duration {
+	var windowErr windowLimitError
+	switch {
+	case errors.As(err, &windowErr):
+		return windowErr.reset.Sub(now)
+	case errors.Is(err, ErrIssuerLimitExceeded) && a.policyWindow > 0:
+		next := time.Unix(0, int64(a.policyEpoch(now)+1)*int64(a.policyWindow))
+		return next.Sub(now)
+	case errors.Is(err, ErrBucketLimitExceeded):
+		// Time to refill one token of an empty bucket, an upper bound
+		policy := a.policy.forClient(clientID)
+		wait := 0.0
+		for _, bucket := range []BucketPolicy{policy.Client, policy.Origin} {
+			if bucket.enabled() && bucket.RefillRate > 0 {
+				wait = math.Max(wait, 1/bucket.RefillRate)
+			}
+		}
+		return time.Duration(wait * float64(time.Second))
+	}
+	return 0
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounded up.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	if wait <= 0 {
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,150 @@
+package commands
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTokenWindows(t *testing.T) {
+	windows, err := parseTokenWindows([]string{"3600=10", "86400=50"})
+	if err != nil || len(windows) != 2 || windows[1] != (IssuerTokenWindow{Window: 86400, Limit: 50}) {
+		t.Fatalf("unexpected windows %v, %v", windows, err)
+	}
+	for _, specs := range [][]string{{"3600"}, {"hour=10"}, {"3600=ten"}, {"0=10"}, {"3600=0"}, {"3600=10", "3600=20"}} {
+		if _, err := parseTokenWindows(specs); err == nil {
+			t.Fatalf("expected %q to be refused", specs)
+		}
+	}
+}
+
+func TestIssuerTokenWindows(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	windows := []IssuerTokenWindow{{Window: 3600, Limit: 10}}
+	policy, err := issuer.updatePolicy(issuerPolicyUpdate{TokenWindows: &windows})
+	if err != nil || len(policy.TokenWindows) != 1 {
+		t.Fatalf("unexpected policy %+v, %v", policy, err)
+	}
+	config, err := issuer.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.TokenWindows) != 1 || config.TokenWindows[0] != windows[0] {
+		t.Fatalf("expected the windows in the directory, got %v", config.TokenWindows)
+	}
+
+	// Windows are replaced, and an empty list removes them
+	if policy, _ = issuer.updatePolicy(issuerPolicyUpdate{TokenWindow: 60}); len(policy.TokenWindows) != 1 {
+		t.Fatal("expected windows to be kept unless set")
+	}
+	windows = []IssuerTokenWindow{}
+	if policy, _ = issuer.updatePolicy(issuerPolicyUpdate{TokenWindows: &windows}); len(policy.TokenWindows) != 0 {
+		t.Fatal("expected windows to be removed")
+	}
+	w := httptest.NewRecorder()
+	issuer.handlePolicyUpdate(w, httptest.NewRequest(http.MethodPost, "/admin/policy/update", strings.NewReader(`{"token_windows": [{"window": 3600, "limit": 0}]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid windows to be refused, got %d", w.Code)
+	}
+}
+
+func newTestWindowedAttester(windows ...IssuerTokenWindow) TestAttester {
+	attester := newTestAttester(nil)
+	attester.issuerPolicies = newIssuerPolicyCache(nil, nil, time.Hour, 0)
+	attester.issuerPolicies.policies["issuer.example"] = newIssuerDirectoryPolicy(IssuerConfig{TokenWindows: windows}, time.Now())
+	return attester
+}
+
+func TestAttesterTokenWindows(t *testing.T) {
+	attester := newTestWindowedAttester(IssuerTokenWindow{Window: 86400, Limit: 3}, IssuerTokenWindow{Window: 3600, Limit: 2})
+	day := time.Unix(1000*86400, 0)
+
+	for i := 0; i < 2; i++ {
+		if err := attester.issue("alice", "origin-a", 0, day); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var windowErr windowLimitError
+	err := attester.issue("alice", "origin-a", 0, day.Add(time.Minute))
+	if !errors.As(err, &windowErr) || windowErr.window.length != time.Hour || !windowErr.reset.Equal(day.Add(time.Hour)) {
+		t.Fatalf("expected the hourly window to be exhausted, got %v", err)
+	}
+	if wait := attester.retryAfter(err, "alice", day.Add(time.Minute)); wait != 59*time.Minute {
+		t.Fatalf("expected to retry at the next hour, got %s", wait)
+	}
+	if err := attester.issue("alice", "origin-b", 0, day.Add(time.Minute)); err != nil {
+		t.Fatalf("expected windows to count per origin, got %v", err)
+	}
+
+	// The hourly window rolls over, the daily one does not
+	if err := attester.issue("alice", "origin-a", 0, day.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	err = attester.issue("alice", "origin-a", 0, day.Add(time.Hour))
+	if !errors.As(err, &windowErr) || windowErr.window.length != 24*time.Hour || !windowErr.reset.Equal(day.Add(24*time.Hour)) {
+		t.Fatalf("expected the daily window to be exhausted, got %v", err)
+	}
+	if err := attester.issue("alice", "origin-a", 0, day.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Counts survive a restart
+	attester.clients.update("alice", func(state *ClientState) error {
+		stateEnc, err := marshalClientState(*state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := unmarshalClientState(stateEnc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		window := tokenWindow{24 * time.Hour, 3}
+		if restored.windowCount("origin-a", window, day.Add(24*time.Hour)) != 1 || restored.windowCount("origin-b", window, day.Add(time.Hour)) != 1 {
+			t.Fatalf("unexpected restored window counts %v", restored.windowCounts)
+		}
+		return nil
+	})
+}
+
+func TestAttesterTokenWindowExpiry(t *testing.T) {
+	attester := newTestWindowedAttester(IssuerTokenWindow{Window: 86400, Limit: 3})
+	attester.policyWindow = time.Hour
+	day := time.Unix(1000*86400, 0)
+	if err := attester.issue("alice", "origin-a", 0, day); err != nil {
+		t.Fatal(err)
+	}
+
+	// Origins with tokens counting against a window outlive the policy window
+	if origins, _ := attester.rotateStates(day.Add(3 * time.Hour)); origins != 0 {
+		t.Fatalf("expected origins counting against a window to be kept, dropped %d", origins)
+	}
+	if origins, _ := attester.rotateStates(day.Add(25 * time.Hour)); origins != 1 {
+		t.Fatalf("expected the origin to expire after its window, dropped %d", origins)
+	}
+}
+
+func TestAttesterRetryAfter(t *testing.T) {
+	attester := newTestAttester(&AttesterPolicy{ClientPolicy: ClientPolicy{Origin: BucketPolicy{Burst: 1, RefillRate: 0.1}}})
+	attester.policyWindow = time.Hour
+	now := time.Unix(1000*86400, 0).Add(20 * time.Minute)
+	if wait := attester.retryAfter(ErrIssuerLimitExceeded, "alice", now); wait != 40*time.Minute {
+		t.Fatalf("expected to retry in the next policy window, got %s", wait)
+	}
+	if wait := attester.retryAfter(ErrBucketLimitExceeded, "alice", now); wait != 10*time.Second {
+		t.Fatalf("expected to retry once a token is refilled, got %s", wait)
+	}
+
+	w := httptest.NewRecorder()
+	attester.refuseIssuance(w, "alice", "origin-a", "issuer.example", windowLimitError{tokenWindow{time.Hour, 1}, time.Now().Add(90 * time.Second)})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "90" {
+		t.Fatalf("expected 429 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	w = httptest.NewRecorder()
+	attester.refuseIssuance(w, "alice", "origin-a", "issuer.example", ErrBucketLimitExceeded)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+		t.Fatalf("expected 429 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
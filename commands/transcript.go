@@ -0,0 +1,321 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	// Messages of transcripts besides challenges, token requests, and tokens
+	messageBatchedTokenRequest  = "batched-token-request"
+	messageBatchedTokenResponse = "batched-token-response"
+
+	// Rate-limited TokenResponses are blind signatures encrypted with
+	// AES-128-GCM, after a response nonce of max(Nk, Nn) bytes
+	rateLimitedTokenResponseLength = 16 + minBlindedMessageLength + 16
+)
+
+// recordFlag is the --record flag of every command that speaks the protocol.
+var recordFlag = cli.StringFlag{
+	Name:  "record",
+	Usage: "File to append every TokenChallenge, TokenRequest, TokenResponse, and Token sent or received to, as JSON lines of hex-encoded messages",
+}
+
+// transcriptEntry is one protocol message of a transcript. Challenges carry
+// the token key they were sent or received with.
+type transcriptEntry struct {
+	Time      time.Time   `json:"time"`
+	Role      string      `json:"role"`
+	Message   string      `json:"message"`
+	TokenType uint16      `json:"token_type"`
+	TokenKey  vectorBytes `json:"token_key,omitempty"`
+	Data      vectorBytes `json:"data"`
+}
+
+// transcriptRecorder appends the protocol messages of every role in the
+// process to a file, for replay with the verify-vectors command. A nil
+// recorder records nothing.
+type transcriptRecorder struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// The recorder of the process, nil unless --record is set
+var protocolTranscript *transcriptRecorder
+
+func openTranscript(fileName string) (*transcriptRecorder, error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &transcriptRecorder{file: file}, nil
+}
+
+// record appends a message. Failures are logged rather than failing traffic.
+func (r *transcriptRecorder) record(role, message string, tokenType uint16, tokenKey, data []byte) {
+	if r == nil {
+		return
+	}
+	entry := transcriptEntry{
+		Time:      time.Now().UTC(),
+		Role:      role,
+		Message:   message,
+		TokenType: tokenType,
+		TokenKey:  tokenKey,
+		Data:      data,
+	}
+	entryEnc, err := json.Marshal(entry)
+	if err != nil {
+		log.Warnln("Failed encoding transcript entry:", err)
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, err := r.file.Write(append(entryEnc, '\n')); err != nil {
+		log.Warnln("Failed recording transcript entry:", err)
+	}
+}
+
+// recordIssuance appends the challenge, with its token key, and the token
+// request and response of an issuance run by the client.
+func (r *transcriptRecorder) recordIssuance(challenge, tokenKey, request, response []byte) {
+	if r == nil || len(challenge) < tokenTypeLength {
+		return
+	}
+	tokenType := binary.BigEndian.Uint16(challenge)
+	r.record("client", messageTokenChallenge, tokenType, tokenKey, challenge)
+	r.record("client", messageTokenRequest, tokenType, nil, request)
+	r.record("client", messageTokenResponse, tokenType, nil, response)
+}
+
+// recordToken appends the token a client finalized, if it did, and passes the
+// result through.
+func (r *transcriptRecorder) recordToken(token pat.Token, err error) (pat.Token, error) {
+	if err == nil {
+		r.record("client", messageToken, token.TokenType, nil, token.Marshal())
+	}
+	return token, err
+}
+
+// recordTranscript applies the configuration file, which may set --record
+// too, and starts recording the transcript of the command if set.
+func recordTranscript(c *cli.Context) error {
+	if err := applyConfigFile(c); err != nil {
+		return err
+	}
+	fileName := c.String("record")
+	if fileName == "" {
+		return nil
+	}
+	recorder, err := openTranscript(fileName)
+	if err != nil {
+		return fmt.Errorf("Failed opening transcript %s: %w", fileName, err)
+	}
+	protocolTranscript = recorder
+	log.Infoln("Recording protocol messages to", fileName)
+	return nil
+}
+
+// readTranscript reads the entries of a recorded transcript.
+func readTranscript(r io.Reader) ([]transcriptEntry, error) {
+	var entries []transcriptEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entry := transcriptEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// checkTokenResponseEncoding checks the length of a TokenResponse of the
+// token type.
+func checkTokenResponseEncoding(tokenType uint16, data []byte) error {
+	expected := 0
+	switch tokenType {
+	case pat.BasicPublicTokenType:
+		expected = minBlindedMessageLength
+	case pat.RateLimitedTokenType:
+		expected = rateLimitedTokenResponseLength
+	case pat.BasicPrivateTokenType:
+		expected = privateTokenResponseLength
+	case ed25519TokenType:
+		expected = ed25519.SignatureSize
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedTokenType, formatTokenType(tokenType))
+	}
+	if len(data) != expected {
+		return fmt.Errorf("Invalid %s TokenResponse: got %d bytes, expected %d", describeTokenType(tokenType), len(data), expected)
+	}
+	return nil
+}
+
+// checkEntryEncoding parses the message of the entry as the roles do. Messages
+// that are serialized again must reproduce the recorded bytes.
+func checkEntryEncoding(entry transcriptEntry) error {
+	if len(entry.Data) >= tokenTypeLength && entry.Message != messageTokenResponse && entry.Message != messageBatchedTokenResponse {
+		if tokenType := binary.BigEndian.Uint16(entry.Data); tokenType != entry.TokenType {
+			return fmt.Errorf("Message of token type %s recorded as %s", formatTokenType(tokenType), formatTokenType(entry.TokenType))
+		}
+	}
+	switch entry.Message {
+	case messageTokenChallenge, messageTokenRequest, messageToken:
+		vector := serializationVector{Message: entry.Message, TokenType: entry.TokenType}
+		reencoded, err := vector.reencode(entry.Data)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(reencoded, entry.Data) {
+			return fmt.Errorf("%w: parsed and serialized again to %d bytes, recorded %d, first difference at offset %d",
+				ErrSerializationMismatch, len(reencoded), len(entry.Data), firstDifference(reencoded, entry.Data))
+		}
+	case messageTokenResponse:
+		return checkTokenResponseEncoding(entry.TokenType, entry.Data)
+	case messageBatchedTokenRequest:
+		_, err := unmarshalBatchedTokenRequest(entry.Data)
+		return err
+	case messageBatchedTokenResponse:
+		if len(entry.Data) < 2 {
+			return ErrInvalidBatchedTokenResponse
+		}
+		_, err := unmarshalBatchedTokenResponse(entry.Data, int(binary.BigEndian.Uint16(entry.Data))/privateTokenElementLength)
+		return err
+	default:
+		return fmt.Errorf("Unknown message %q", entry.Message)
+	}
+	return nil
+}
+
+// transcriptKeys are the token keys recorded with challenges, by token type
+// and key ID, the SHA-256 digest of the key for all but private tokens.
+type transcriptKeys map[publicTokenKeyID][]byte
+
+func (k transcriptKeys) add(tokenType uint16, tokenKeyEnc []byte) {
+	k[publicTokenKeyID{tokenType, sha256.Sum256(tokenKeyEnc)}] = tokenKeyEnc
+}
+
+// verifyTokenOffline checks the authenticator of a token with the recorded
+// token key it names. Private tokens only verify with the issuer's private
+// key, so they are reported as unverifiable.
+func (k transcriptKeys) verifyTokenOffline(token pat.Token) (bool, error) {
+	if token.TokenType == pat.BasicPrivateTokenType {
+		return false, nil
+	}
+	id := publicTokenKeyID{tokenType: token.TokenType}
+	if len(token.KeyID) != len(id.keyID) {
+		return false, fmt.Errorf("Invalid key ID length %d", len(token.KeyID))
+	}
+	copy(id.keyID[:], token.KeyID)
+	tokenKeyEnc, ok := k[id]
+	if !ok {
+		return false, nil
+	}
+	keys := &issuerKeys{}
+	if err := keys.parseTokenKey(int(token.TokenType), tokenKeyEnc); err != nil {
+		return false, err
+	}
+	return true, verifyToken(verificationKeys{issuer: keys}, token.TokenType, token)
+}
+
+// transcriptReport sums up the replay of transcripts.
+type transcriptReport struct {
+	messages   int
+	failures   []string
+	verified   int // tokens whose authenticator was checked
+	unverified int // tokens without a recorded key, or privately verifiable
+}
+
+// replayTranscript checks the encoding of every message, that tokens answer
+// a recorded challenge of their type if one matches their context, and the
+// authenticators of tokens with the recorded token keys.
+func replayTranscript(entries []transcriptEntry) transcriptReport {
+	report := transcriptReport{messages: len(entries)}
+	fail := func(i int, entry transcriptEntry, err error) {
+		report.failures = append(report.failures, fmt.Sprintf("entry %d, %s %s of %s: %v", i+1, entry.Role, entry.Message, formatTokenType(entry.TokenType), err))
+	}
+
+	keys := transcriptKeys{}
+	challengeTypes := map[[sha256.Size]byte]uint16{}
+	for _, entry := range entries {
+		if entry.Message == messageTokenChallenge {
+			challengeTypes[sha256.Sum256(entry.Data)] = entry.TokenType
+			if len(entry.TokenKey) > 0 {
+				keys.add(entry.TokenType, entry.TokenKey)
+			}
+		}
+	}
+
+	for i, entry := range entries {
+		if err := checkEntryEncoding(entry); err != nil {
+			fail(i, entry, err)
+			continue
+		}
+		if entry.Message != messageToken {
+			continue
+		}
+		token, _ := unmarshalToken(entry.Data)
+		var context [sha256.Size]byte
+		copy(context[:], token.Context)
+		if challengeType, ok := challengeTypes[context]; ok && challengeType != token.TokenType {
+			fail(i, entry, fmt.Errorf("Token of type %s answers a challenge of type %s", formatTokenType(token.TokenType), formatTokenType(challengeType)))
+			continue
+		}
+		verified, err := keys.verifyTokenOffline(token)
+		if err != nil {
+			fail(i, entry, err)
+		} else if verified {
+			report.verified++
+		} else {
+			report.unverified++
+		}
+	}
+	return report
+}
+
+func runVerifyVectors(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("Missing transcript files, recorded with --record")
+	}
+	failed := 0
+	for _, fileName := range c.Args() {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		entries, err := readTranscript(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("Invalid transcript %s: %w", fileName, err)
+		}
+		report := replayTranscript(entries)
+		for _, failure := range report.failures {
+			fmt.Printf("FAIL %s %s\n", fileName, failure)
+		}
+		fmt.Printf("%s: %d of %d messages passed, %d tokens verified, %d tokens without a verifiable key\n",
+			fileName, report.messages-len(report.failures), report.messages, report.verified, report.unverified)
+		failed += len(report.failures)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d recorded messages failed", failed)
+	}
+	return nil
+}
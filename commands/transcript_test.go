@@ -0,0 +1,105 @@
+package commands
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+// recordTestEd25519Issuance records the client's side of an Ed25519 issuance
+// and redemption, and returns the token.
+func recordTestEd25519Issuance(t *testing.T, recorder *transcriptRecorder, issuer *ed25519Issuer) pat.Token {
+	challenge := pat.TokenChallenge{
+		TokenType:       ed25519TokenType,
+		IssuerName:      "issuer.example",
+		RedemptionNonce: make([]byte, 32),
+		OriginInfo:      []string{"origin.example"},
+	}
+	rand.Read(challenge.RedemptionNonce)
+	challengeEnc := challenge.Marshal()
+	recorder.record("origin", messageTokenChallenge, ed25519TokenType, issuer.TokenKey(), challengeEnc)
+
+	keyID := ed25519TokenKeyID(issuer.TokenKey())
+	context := sha256.Sum256(challengeEnc)
+	request := ed25519TokenRequest{tokenKeyID: keyID[len(keyID)-1], nonce: make([]byte, 32), context: context[:]}
+	rand.Read(request.nonce)
+	signature, err := issuer.Evaluate(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.recordIssuance(challengeEnc, issuer.TokenKey(), request.Marshal(), signature)
+
+	token := pat.Token{
+		TokenType:     ed25519TokenType,
+		Nonce:         request.nonce,
+		Context:       context[:],
+		KeyID:         keyID,
+		Authenticator: signature,
+	}
+	recorder.recordToken(token, nil)
+	recorder.record("origin", messageToken, ed25519TokenType, nil, token.Marshal())
+	return token
+}
+
+func TestTranscriptReplay(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "transcript.jsonl")
+	recorder, err := openTranscript(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := newEd25519Issuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := recordTestEd25519Issuance(t, recorder, issuer)
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	entries, err := readTranscript(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("Expected 6 recorded messages, got %d", len(entries))
+	}
+	report := replayTranscript(entries)
+	if len(report.failures) != 0 || report.verified != 2 || report.unverified != 0 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	// A token signed by another key fails, one whose key was not recorded
+	// is not verified
+	token.Authenticator = append([]byte{}, token.Authenticator...)
+	token.Authenticator[0] ^= 0xff
+	entries = append(entries, transcriptEntry{Role: "origin", Message: messageToken, TokenType: ed25519TokenType, Data: token.Marshal()})
+	token.KeyID = make([]byte, 32)
+	entries = append(entries, transcriptEntry{Role: "origin", Message: messageToken, TokenType: ed25519TokenType, Data: token.Marshal()})
+	report = replayTranscript(entries)
+	if len(report.failures) != 1 || report.verified != 2 || report.unverified != 1 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+}
+
+func TestTranscriptEncodings(t *testing.T) {
+	for _, entry := range []transcriptEntry{
+		{Message: messageTokenResponse, TokenType: pat.BasicPublicTokenType, Data: make([]byte, 255)},
+		{Message: messageTokenResponse, TokenType: pat.RateLimitedTokenType, Data: make([]byte, 256)},
+		{Message: messageTokenRequest, TokenType: pat.BasicPublicTokenType, Data: []byte{0x00, 0x02, 0x01}},
+		{Message: messageToken, TokenType: pat.BasicPublicTokenType, Data: append([]byte{0x00, 0x03}, make([]byte, 352)...)},
+		{Message: "token-receipt", TokenType: pat.BasicPublicTokenType},
+	} {
+		if err := checkEntryEncoding(entry); err == nil {
+			t.Fatalf("Expected %s of %d bytes to be refused", entry.Message, len(entry.Data))
+		}
+	}
+	if err := checkEntryEncoding(transcriptEntry{Message: messageTokenResponse, TokenType: pat.RateLimitedTokenType, Data: make([]byte, rateLimitedTokenResponseLength)}); err != nil {
+		t.Fatal(err)
+	}
+}
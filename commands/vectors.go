@@ -0,0 +1,324 @@
+package commands
+
+import (
+	"bytes"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/cloudflare/pat-app/metrics"
+	pat "github.com/cloudflare/pat-go"
+	"github.com/urfave/cli"
+)
+
+// Message of serialization vectors besides the token requests and tokens
+// whose sizes are recorded
+const messageTokenChallenge = "token-challenge"
+
+var (
+	// Golden vectors, one file per draft version
+	//go:embed vectors/*.json
+	builtinVectorFiles embed.FS
+
+	ErrSerializationMismatch = errors.New("Serialization does not match the golden vector")
+)
+
+// vectorBytes is a byte string written in hex.
+type vectorBytes []byte
+
+func (b *vectorBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+func (b vectorBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+// serializationVector is the golden encoding of one message and the fields
+// it is built from. Fields that the message does not have are omitted.
+type serializationVector struct {
+	Name      string `json:"name"`
+	Message   string `json:"message"`
+	TokenType uint16 `json:"token_type"`
+
+	// TokenChallenge
+	IssuerName        string      `json:"issuer_name,omitempty"`
+	RedemptionContext vectorBytes `json:"redemption_context,omitempty"`
+	OriginInfo        []string    `json:"origin_info,omitempty"`
+
+	// TokenRequest of types 0x0001, 0x0002, and 0xED25
+	TokenKeyID uint8       `json:"token_key_id,omitempty"`
+	BlindedMsg vectorBytes `json:"blinded_msg,omitempty"`
+
+	// TokenRequest of type 0x0003
+	RequestKey            vectorBytes `json:"request_key,omitempty"`
+	NameKeyID             vectorBytes `json:"name_key_id,omitempty"`
+	EncryptedTokenRequest vectorBytes `json:"encrypted_token_request,omitempty"`
+	Signature             vectorBytes `json:"signature,omitempty"`
+
+	// Token, and TokenRequest of type 0xED25
+	Nonce         vectorBytes `json:"nonce,omitempty"`
+	Context       vectorBytes `json:"context,omitempty"`
+	KeyID         vectorBytes `json:"key_id,omitempty"`
+	Authenticator vectorBytes `json:"authenticator,omitempty"`
+
+	Encoded vectorBytes `json:"encoded"`
+}
+
+// serializationVectorFile pins the wire format of messages to the draft
+// version that pat-app implements their token type after.
+type serializationVectorFile struct {
+	Draft   string                `json:"draft"`
+	Vectors []serializationVector `json:"vectors"`
+}
+
+// marshal serializes the message from its fields.
+func (v serializationVector) marshal() ([]byte, error) {
+	switch v.Message {
+	case messageTokenChallenge:
+		challenge := pat.TokenChallenge{
+			TokenType:       v.TokenType,
+			IssuerName:      v.IssuerName,
+			RedemptionNonce: v.RedemptionContext,
+			OriginInfo:      v.OriginInfo,
+		}
+		return challenge.Marshal(), nil
+	case messageTokenRequest:
+		switch v.TokenType {
+		case pat.BasicPrivateTokenType:
+			request := pat.BasicPrivateTokenRequest{TokenKeyID: v.TokenKeyID, BlindedReq: v.BlindedMsg}
+			return request.Marshal(), nil
+		case pat.BasicPublicTokenType:
+			request := pat.BasicPublicTokenRequest{TokenKeyID: v.TokenKeyID, BlindedReq: v.BlindedMsg}
+			return request.Marshal(), nil
+		case pat.RateLimitedTokenType:
+			request := pat.RateLimitedTokenRequest{
+				RequestKey:            v.RequestKey,
+				NameKeyID:             v.NameKeyID,
+				EncryptedTokenRequest: v.EncryptedTokenRequest,
+				Signature:             v.Signature,
+			}
+			return request.Marshal(), nil
+		case ed25519TokenType:
+			request := ed25519TokenRequest{tokenKeyID: v.TokenKeyID, nonce: v.Nonce, context: v.Context}
+			return request.Marshal(), nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedTokenType, formatTokenType(v.TokenType))
+	case messageToken:
+		token := pat.Token{
+			TokenType:     v.TokenType,
+			Nonce:         v.Nonce,
+			Context:       v.Context,
+			KeyID:         v.KeyID,
+			Authenticator: v.Authenticator,
+		}
+		return token.Marshal(), nil
+	}
+	return nil, fmt.Errorf("Unknown message %q", v.Message)
+}
+
+// reencode parses the encoded message as the roles do, and serializes what
+// was parsed again.
+func (v serializationVector) reencode(data []byte) ([]byte, error) {
+	switch v.Message {
+	case messageTokenChallenge:
+		challenge, err := pat.UnmarshalTokenChallenge(data)
+		if err != nil {
+			return nil, err
+		}
+		return challenge.Marshal(), nil
+	case messageTokenRequest:
+		tokenType, err := validateTokenRequest(data)
+		if err != nil {
+			return nil, err
+		}
+		var request pat.TokenRequest
+		switch tokenType {
+		case pat.BasicPrivateTokenType:
+			request, err = unmarshalPrivateTokenRequest(data)
+		case pat.BasicPublicTokenType:
+			request = &pat.BasicPublicTokenRequest{}
+		case pat.RateLimitedTokenType:
+			request = &pat.RateLimitedTokenRequest{}
+		case ed25519TokenType:
+			var ed25519Request ed25519TokenRequest
+			if ed25519Request, err = unmarshalEd25519TokenRequest(data); err != nil {
+				return nil, err
+			}
+			return ed25519Request.Marshal(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tokenType != pat.BasicPrivateTokenType && !request.Unmarshal(data) {
+			return nil, fmt.Errorf("Invalid %s TokenRequest encoding", describeTokenType(tokenType))
+		}
+		return request.Marshal(), nil
+	case messageToken:
+		token, err := unmarshalToken(data)
+		if err != nil {
+			return nil, err
+		}
+		return token.Marshal(), nil
+	}
+	return nil, fmt.Errorf("Unknown message %q", v.Message)
+}
+
+// firstDifference returns the offset of the first byte where a and b differ.
+func firstDifference(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) < len(b) {
+		return len(a)
+	}
+	return len(b)
+}
+
+// verify serializes the message from its fields and parses the golden
+// encoding, and fails if either does not reproduce the golden bytes.
+func (v serializationVector) verify() error {
+	marshaled, err := v.marshal()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(marshaled, v.Encoded) {
+		return fmt.Errorf("%w: serialized %d bytes, expected %d, first difference at offset %d",
+			ErrSerializationMismatch, len(marshaled), len(v.Encoded), firstDifference(marshaled, v.Encoded))
+	}
+	reencoded, err := v.reencode(v.Encoded)
+	if err != nil {
+		return fmt.Errorf("%w: parsing failed: %v", ErrSerializationMismatch, err)
+	}
+	if !bytes.Equal(reencoded, v.Encoded) {
+		return fmt.Errorf("%w: parsed and serialized again to %d bytes, expected %d, first difference at offset %d",
+			ErrSerializationMismatch, len(reencoded), len(v.Encoded), firstDifference(reencoded, v.Encoded))
+	}
+	return nil
+}
+
+// vectorFailure is a vector that failed verification.
+type vectorFailure struct {
+	draft string
+	name  string
+	err   error
+}
+
+// verifyVectorFile verifies every vector of the file, and that the token type
+// of each is still implemented after the draft the file is pinned to.
+func verifyVectorFile(file serializationVectorFile) []vectorFailure {
+	var failures []vectorFailure
+	for _, vector := range file.Vectors {
+		err := vector.verify()
+		if draft := metrics.DraftVersion(vector.TokenType); err == nil && draft != file.Draft {
+			err = fmt.Errorf("Vector is pinned to %s, but %s is implemented after %s", file.Draft, describeTokenType(vector.TokenType), draft)
+		}
+		if err != nil {
+			failures = append(failures, vectorFailure{file.Draft, vector.Name, err})
+		}
+	}
+	return failures
+}
+
+func parseVectorFile(data []byte) (serializationVectorFile, error) {
+	file := serializationVectorFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return file, err
+	}
+	if file.Draft == "" {
+		return file, fmt.Errorf("Vector file names no draft")
+	}
+	return file, nil
+}
+
+// builtinVectors returns the golden vector files, sorted by draft version.
+func builtinVectors() ([]serializationVectorFile, error) {
+	entries, err := builtinVectorFiles.ReadDir("vectors")
+	if err != nil {
+		return nil, err
+	}
+	var files []serializationVectorFile
+	for _, entry := range entries {
+		data, err := builtinVectorFiles.ReadFile(path.Join("vectors", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		file, err := parseVectorFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid vector file %s: %w", entry.Name(), err)
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Draft < files[j].Draft })
+	return files, nil
+}
+
+// verifyVectors verifies the vector files pinned to any of the drafts, or all
+// of them if no draft is given, and reports the results to w.
+func verifyVectors(w io.Writer, files []serializationVectorFile, drafts []string) error {
+	selected := map[string]bool{}
+	for _, draft := range drafts {
+		selected[draft] = true
+	}
+	verified, failed := 0, 0
+	for _, file := range files {
+		if len(drafts) > 0 && !selected[file.Draft] {
+			continue
+		}
+		delete(selected, file.Draft)
+		failures := verifyVectorFile(file)
+		for _, failure := range failures {
+			fmt.Fprintf(w, "FAIL %s %s: %v\n", failure.draft, failure.name, failure.err)
+		}
+		fmt.Fprintf(w, "%s: %d of %d vectors passed\n", file.Draft, len(file.Vectors)-len(failures), len(file.Vectors))
+		verified += len(file.Vectors)
+		failed += len(failures)
+	}
+	for draft := range selected {
+		return fmt.Errorf("No vectors pinned to %s", draft)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d serialization vectors failed", failed, verified)
+	}
+	return nil
+}
+
+func runVectorsVerify(c *cli.Context) error {
+	files, err := builtinVectors()
+	if err != nil {
+		return err
+	}
+	if fileNames := c.StringSlice("file"); len(fileNames) > 0 {
+		files = nil
+		for _, fileName := range fileNames {
+			data, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				return err
+			}
+			file, err := parseVectorFile(data)
+			if err != nil {
+				return fmt.Errorf("Invalid vector file %s: %w", fileName, err)
+			}
+			files = append(files, file)
+		}
+	}
+	return verifyVectors(os.Stdout, files, c.StringSlice("draft"))
+}
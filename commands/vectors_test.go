@@ -0,0 +1,72 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinVectors(t *testing.T) {
+	files, err := builtinVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := map[string]int{}
+	for _, file := range files {
+		if failures := verifyVectorFile(file); len(failures) > 0 {
+			t.Fatalf("%s %s: %v", failures[0].draft, failures[0].name, failures[0].err)
+		}
+		for _, vector := range file.Vectors {
+			messages[vector.Message]++
+		}
+	}
+	for _, message := range []string{messageTokenChallenge, messageTokenRequest, messageToken} {
+		if messages[message] == 0 {
+			t.Fatalf("No golden vectors of %s", message)
+		}
+	}
+}
+
+func TestVectorMismatch(t *testing.T) {
+	files, err := builtinVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := files[0]
+	file.Vectors = append([]serializationVector{}, file.Vectors...)
+	encoded := append(vectorBytes{}, file.Vectors[0].Encoded...)
+	encoded[len(encoded)-1] ^= 0xff
+	file.Vectors[0].Encoded = encoded
+
+	failures := verifyVectorFile(file)
+	if len(failures) != 1 || !errors.Is(failures[0].err, ErrSerializationMismatch) {
+		t.Fatalf("Expected the altered vector to fail, got %v", failures)
+	}
+	if !strings.Contains(failures[0].err.Error(), "first difference at offset") {
+		t.Fatalf("Expected the offset of the difference, got %v", failures[0].err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := verifyVectors(out, []serializationVectorFile{file}, nil); err == nil {
+		t.Fatal("Expected verification to fail")
+	}
+	if !strings.Contains(out.String(), "FAIL "+file.Draft+" "+file.Vectors[0].Name) {
+		t.Fatalf("Unexpected report %q", out.String())
+	}
+}
+
+func TestVectorDraftPinning(t *testing.T) {
+	files, err := builtinVectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := files[0]
+	file.Draft = "draft-ietf-privacypass-protocol-00"
+	if failures := verifyVectorFile(file); len(failures) != len(file.Vectors) {
+		t.Fatalf("Expected vectors pinned to another draft to fail, got %d failures", len(failures))
+	}
+	if err := verifyVectors(&bytes.Buffer{}, files, []string{"draft-unknown"}); err == nil {
+		t.Fatal("Expected an unknown draft to be refused")
+	}
+}
@@ -0,0 +1,214 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	verificationModeLocal  = "local"
+	verificationModeRemote = "remote"
+
+	// What the origin does when the issuer cannot give a verdict
+	verificationFailureDeny  = "deny"
+	verificationFailureAllow = "allow"
+)
+
+var (
+	// Issuer endpoint verifying tokens on behalf of origins
+	tokenVerificationURI = "/token-verify"
+
+	// Media type of a token submitted for verification
+	tokenMediaType = "message/token"
+
+	ErrInvalidToken = errors.New("Token verification failed")
+)
+
+// verifyPublicToken checks the RSA blind signature authenticator of a
+// publicly verifiable token.
+func verifyPublicToken(key *rsa.PublicKey, token pat.Token) error {
+	return verifyRSAPSS(key, crypto.SHA384, token)
+}
+
+func (i *Issuer) handleVerificationRequest(w http.ResponseWriter, req *http.Request) {
+	err := i.dumpRequest("Handling verification request", w, req)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Header.Get("Content-Type") != tokenMediaType {
+		http.Error(w, "Invalid Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := unmarshalToken(body)
+	if err != nil {
+		http.Error(w, "Failed decoding token", http.StatusBadRequest)
+		return
+	}
+
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+
+	switch token.TokenType {
+	case pat.BasicPublicTokenType:
+		err = verifyPublicToken(i.tokenKeyByID(i.basicIssuer.TokenKey(), token.KeyID, time.Now()), token)
+	case pat.RateLimitedTokenType:
+		err = verifyPublicToken(i.tokenKeyByID(i.rateLimitedIssuer.TokenKey(), token.KeyID, time.Now()), token)
+	case pat.BasicPrivateTokenType:
+		if i.privateIssuer == nil {
+			http.Error(w, "Unsupported token type", http.StatusBadRequest)
+			return
+		}
+		err = i.privateIssuer.Verify(token)
+	case ed25519TokenType:
+		if i.ed25519Issuer == nil {
+			http.Error(w, "Unsupported token type", http.StatusBadRequest)
+			return
+		}
+		err = verifyEd25519Token(i.ed25519Issuer.TokenKey(), token)
+	default:
+		http.Error(w, "Unsupported token type", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		log.Debugln("Token verification failed:", err)
+		http.Error(w, ErrInvalidToken.Error(), http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type verificationResult struct {
+	valid   bool
+	expires time.Time
+}
+
+// remoteVerifier delegates token verification to the issuer, caching verdicts
+// by token digest.
+type remoteVerifier struct {
+	client        *http.Client
+	uri           string
+	cacheTTL      time.Duration // zero disables caching
+	failurePolicy string
+
+	lock  sync.Mutex
+	cache map[string]verificationResult
+}
+
+func newRemoteVerifier(client *http.Client, uri string, cacheTTL time.Duration, failurePolicy string) (*remoteVerifier, error) {
+	if failurePolicy != verificationFailureDeny && failurePolicy != verificationFailureAllow {
+		return nil, fmt.Errorf("Invalid verification failure policy %q", failurePolicy)
+	}
+	return &remoteVerifier{
+		client:        client,
+		uri:           uri,
+		cacheTTL:      cacheTTL,
+		failurePolicy: failurePolicy,
+		cache:         make(map[string]verificationResult),
+	}, nil
+}
+
+func (v *remoteVerifier) cached(key string, now time.Time) (verificationResult, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	result, ok := v.cache[key]
+	if ok && !now.Before(result.expires) {
+		delete(v.cache, key)
+		return verificationResult{}, false
+	}
+	return result, ok
+}
+
+func (v *remoteVerifier) store(key string, valid bool, now time.Time) {
+	if v.cacheTTL <= 0 {
+		return
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.cache[key] = verificationResult{valid: valid, expires: now.Add(v.cacheTTL)}
+}
+
+// verify returns nil if the issuer accepts the token. When the issuer gives no
+// verdict, the failure policy decides.
+func (v *remoteVerifier) verify(ctx context.Context, tokenType uint16, tokenEnc []byte) error {
+	digest := sha256.Sum256(tokenEnc)
+	key := hex.EncodeToString(digest[:])
+	if result, ok := v.cached(key, time.Now()); ok {
+		originRemoteVerifications.Inc(tokenType, "cache", validityLabel(result.valid))
+		if !result.valid {
+			return ErrInvalidToken
+		}
+		return nil
+	}
+
+	valid, err := v.query(ctx, tokenEnc)
+	if err != nil {
+		originRemoteVerifications.Inc(tokenType, "issuer", "error")
+		log.Errorln("Remote token verification failed:", err)
+		if v.failurePolicy == verificationFailureAllow {
+			return nil
+		}
+		return fmt.Errorf("%w: %v", ErrVerificationUnavailable, err)
+	}
+	originRemoteVerifications.Inc(tokenType, "issuer", validityLabel(valid))
+	v.store(key, valid, time.Now())
+	if !valid {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func (v *remoteVerifier) query(ctx context.Context, tokenEnc []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.uri, bytes.NewReader(tokenEnc))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", tokenMediaType)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent:
+		return true, nil
+	case resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("Verification endpoint responded with %d", resp.StatusCode)
+	}
+}
+
+func validityLabel(valid bool) string {
+	if valid {
+		return "valid"
+	}
+	return "invalid"
+}
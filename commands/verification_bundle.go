@@ -0,0 +1,266 @@
+package commands
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+const (
+	verificationBundleURI = "/.well-known/token-verification-bundle"
+
+	// Time origins may use a verification bundle after it was issued
+	verificationBundleLifetime = 24 * time.Hour
+
+	// Verification algorithms of bundle verifiers
+	bundleAlgorithmRSABSSA = "rsabssa-sha384-pss"
+	bundleAlgorithmEd25519 = "ed25519"
+)
+
+// bundleVerifier is the public key and parameters tokens of one type and key
+// ID are verified with.
+type bundleVerifier struct {
+	TokenType  int    `json:"token-type"`
+	KeyID      string `json:"key-id"`    // base64url of the token key ID
+	TokenKey   string `json:"token-key"` // base64url, as in the directory
+	Algorithm  string `json:"algorithm"`
+	SaltLength int    `json:"salt-length,omitempty"`
+}
+
+// verificationBundle lists everything an origin needs to verify the tokens of
+// an issuer.
+type verificationBundle struct {
+	Issuer    string           `json:"issuer"`
+	IssuedAt  int64            `json:"issued-at"`
+	Expires   int64            `json:"expires"`
+	Verifiers []bundleVerifier `json:"verifiers"`
+}
+
+// signedVerificationBundle carries the encoded bundle with an Ed25519
+// signature over exactly those bytes.
+type signedVerificationBundle struct {
+	Bundle    string `json:"bundle"`    // base64url
+	Signature string `json:"signature"` // base64url
+}
+
+// verificationBundle describes the current token keys, followed by retired
+// keys still published. The caller holds the lock.
+func (i *Issuer) verificationBundle(now time.Time) (verificationBundle, error) {
+	bundle := verificationBundle{
+		Issuer:    i.name,
+		IssuedAt:  now.Unix(),
+		Expires:   now.Add(verificationBundleLifetime).Unix(),
+		Verifiers: make([]bundleVerifier, 0),
+	}
+	type rsaTokenKey struct {
+		tokenType uint16
+		tokenKey  *rsa.PublicKey
+	}
+	issuers := []rsaTokenKey{
+		{pat.BasicPublicTokenType, i.basicIssuer.TokenKey()},
+		{pat.RateLimitedTokenType, i.rateLimitedIssuer.TokenKey()},
+	}
+	for _, retiredKey := range i.publishedTokenKeys(now) {
+		issuers = append(issuers, rsaTokenKey{pat.BasicPublicTokenType, retiredKey}, rsaTokenKey{pat.RateLimitedTokenType, retiredKey})
+	}
+	for _, issuer := range issuers {
+		tokenKeyEnc, err := marshalTokenKey(issuer.tokenKey, false)
+		if err != nil {
+			return verificationBundle{}, err
+		}
+		keyID := sha256.Sum256(tokenKeyEnc)
+		bundle.Verifiers = append(bundle.Verifiers, bundleVerifier{
+			TokenType:  int(issuer.tokenType),
+			KeyID:      base64.URLEncoding.EncodeToString(keyID[:]),
+			TokenKey:   base64.URLEncoding.EncodeToString(tokenKeyEnc),
+			Algorithm:  bundleAlgorithmRSABSSA,
+			SaltLength: crypto.SHA384.Size(),
+		})
+	}
+	if i.ed25519Issuer != nil {
+		tokenKey := i.ed25519Issuer.TokenKey()
+		bundle.Verifiers = append(bundle.Verifiers, bundleVerifier{
+			TokenType: int(ed25519TokenType),
+			KeyID:     base64.URLEncoding.EncodeToString(ed25519TokenKeyID(tokenKey)),
+			TokenKey:  base64.URLEncoding.EncodeToString(tokenKey),
+			Algorithm: bundleAlgorithmEd25519,
+		})
+	}
+	return bundle, nil
+}
+
+func signVerificationBundle(bundle verificationBundle, key ed25519.PrivateKey) (signedVerificationBundle, error) {
+	bundleEnc, err := json.Marshal(bundle)
+	if err != nil {
+		return signedVerificationBundle{}, err
+	}
+	return signedVerificationBundle{
+		Bundle:    base64.URLEncoding.EncodeToString(bundleEnc),
+		Signature: base64.URLEncoding.EncodeToString(ed25519.Sign(key, bundleEnc)),
+	}, nil
+}
+
+func (i *Issuer) handleVerificationBundleRequest(w http.ResponseWriter, req *http.Request) {
+	err := i.dumpRequest("Handling verification bundle request", w, req)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	i.lock.RLock()
+	bundle, err := i.verificationBundle(time.Now())
+	i.lock.RUnlock()
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	signed, err := signVerificationBundle(bundle, i.bundleKey)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+	jsonResp, err := json.Marshal(signed)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonResp)
+}
+
+// openVerificationBundle checks the signature, issuer, and lifetime of a
+// bundle, tolerating the given clock skew. Issuers may share a bundle key, so
+// a bundle of another issuer is refused even if its signature verifies.
+func openVerificationBundle(signed signedVerificationBundle, issuer string, key ed25519.PublicKey, now time.Time, skew time.Duration) (verificationBundle, error) {
+	bundleEnc, err := base64.URLEncoding.DecodeString(signed.Bundle)
+	if err != nil {
+		return verificationBundle{}, fmt.Errorf("Invalid verification bundle encoding: %w", err)
+	}
+	signature, err := base64.URLEncoding.DecodeString(signed.Signature)
+	if err != nil {
+		return verificationBundle{}, fmt.Errorf("Invalid verification bundle signature encoding: %w", err)
+	}
+	if !ed25519.Verify(key, bundleEnc, signature) {
+		return verificationBundle{}, fmt.Errorf("Invalid verification bundle signature")
+	}
+
+	bundle := verificationBundle{}
+	if err := json.Unmarshal(bundleEnc, &bundle); err != nil {
+		return verificationBundle{}, err
+	}
+	if bundle.Issuer != issuer {
+		return verificationBundle{}, fmt.Errorf("Verification bundle is for issuer %s, not %s", bundle.Issuer, issuer)
+	}
+	issuedAt, expires := time.Unix(bundle.IssuedAt, 0), time.Unix(bundle.Expires, 0)
+	if !checkTimeWindow(skewCheckVerificationBundle, now, issuedAt, expires, skew) {
+		return verificationBundle{}, fmt.Errorf("Verification bundle only valid from %s to %s", issuedAt, expires)
+	}
+	return bundle, nil
+}
+
+// tokenKeys checks every verifier of the bundle against its key ID and
+// returns the token keys. Key IDs may only appear once per token type.
+func (bundle verificationBundle) tokenKeys() (issuerTokenKeys, error) {
+	keys := issuerTokenKeys{}
+	seen := make(map[string]bool)
+	for _, verifier := range bundle.Verifiers {
+		verifierID := fmt.Sprintf("%d:%s", verifier.TokenType, verifier.KeyID)
+		if seen[verifierID] {
+			return issuerTokenKeys{}, fmt.Errorf("Duplicate verifier for token type %d", verifier.TokenType)
+		}
+		seen[verifierID] = true
+
+		tokenKeyEnc, err := base64.URLEncoding.DecodeString(verifier.TokenKey)
+		if err != nil {
+			return issuerTokenKeys{}, fmt.Errorf("Invalid token key for token type %d: %w", verifier.TokenType, err)
+		}
+		keyID, err := base64.URLEncoding.DecodeString(verifier.KeyID)
+		if err != nil {
+			return issuerTokenKeys{}, fmt.Errorf("Invalid key ID for token type %d: %w", verifier.TokenType, err)
+		}
+
+		var expectedAlgorithm string
+		var expectedKeyID []byte
+		switch verifier.TokenType {
+		case int(pat.BasicPublicTokenType), int(pat.RateLimitedTokenType):
+			expectedAlgorithm = bundleAlgorithmRSABSSA
+			digest := sha256.Sum256(tokenKeyEnc)
+			expectedKeyID = digest[:]
+		case int(ed25519TokenType):
+			expectedAlgorithm = bundleAlgorithmEd25519
+			expectedKeyID = ed25519TokenKeyID(tokenKeyEnc)
+		default:
+			continue
+		}
+		if verifier.Algorithm != expectedAlgorithm {
+			return issuerTokenKeys{}, fmt.Errorf("Unsupported algorithm %s for token type %d", verifier.Algorithm, verifier.TokenType)
+		}
+		if !bytes.Equal(keyID, expectedKeyID) {
+			return issuerTokenKeys{}, fmt.Errorf("Key ID mismatch for token type %d", verifier.TokenType)
+		}
+		if err := keys.parseTokenKey(verifier.TokenType, tokenKeyEnc); err != nil {
+			return issuerTokenKeys{}, err
+		}
+	}
+	return keys, nil
+}
+
+func fetchVerificationBundle(httpClient *http.Client, bundleURI string) (signedVerificationBundle, error) {
+	resp, err := httpClient.Get(bundleURI)
+	if err != nil {
+		return signedVerificationBundle{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return signedVerificationBundle{}, fmt.Errorf("Verification bundle request failed with error %d", resp.StatusCode)
+	}
+
+	signedEnc, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return signedVerificationBundle{}, err
+	}
+	signed := signedVerificationBundle{}
+	if err := json.Unmarshal(signedEnc, &signed); err != nil {
+		return signedVerificationBundle{}, err
+	}
+	return signed, nil
+}
+
+// refreshBundle replaces the token keys of the snapshot with those of a newer
+// verification bundle. Bundles issued before the current one are refused, so
+// a stale copy cannot roll keys back.
+func (s *issuerKeySource) refreshBundle(keys *issuerKeys) error {
+	if keys.verificationBundleURI == "" {
+		return fmt.Errorf("Issuer %s does not publish a verification bundle", s.issuer)
+	}
+	signed, err := fetchVerificationBundle(s.client, keys.verificationBundleURI)
+	if err != nil {
+		return err
+	}
+	bundle, err := openVerificationBundle(signed, s.issuer, s.bundleKey, time.Now(), s.skew)
+	if err != nil {
+		return err
+	}
+	if bundle.IssuedAt < keys.bundleIssuedAt {
+		return fmt.Errorf("Verification bundle issued at %s precedes the current one", time.Unix(bundle.IssuedAt, 0))
+	}
+	tokenKeys, err := bundle.tokenKeys()
+	if err != nil {
+		return err
+	}
+	keys.issuerTokenKeys = tokenKeys
+	keys.bundleIssuedAt = bundle.IssuedAt
+	keys.bundleExpires = bundle.Expires
+	return nil
+}
@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBundleIssuerServer(current *atomic.Value) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		issuer := current.Load().(*Issuer)
+		switch req.URL.Path {
+		case issuerConfigURI:
+			issuer.handleConfigRequest(w, req)
+		case issuerEncapKeyURI:
+			issuer.handleNameKeyRequest(w, req)
+		case verificationBundleURI:
+			issuer.handleVerificationBundleRequest(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+}
+
+func TestVerificationBundleKeySource(t *testing.T) {
+	var current atomic.Value
+	server := newTestBundleIssuerServer(&current)
+	defer server.Close()
+	name := strings.TrimPrefix(server.URL, "https://")
+
+	bundleKey, err := loadEd25519SigningKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := newTestIssuer(t, name)
+	issuer.bundleKey = bundleKey
+	current.Store(issuer)
+
+	source := newIssuerKeySource(server.Client(), name, time.Hour)
+	source.bundleKey = bundleKey.Public().(ed25519.PublicKey)
+	if err := source.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	keys := source.current()
+	if keys.bundleIssuedAt == 0 || keys.bundleExpires <= keys.bundleIssuedAt || keys.rateLimitedTokenKey == nil ||
+		keys.rateLimitedTokenKey.N.Cmp(issuer.rateLimitedIssuer.TokenKey().N) != 0 ||
+		keys.basicValidationKey.N.Cmp(issuer.basicIssuer.TokenKey().N) != 0 {
+		t.Fatal("expected token keys from the verification bundle")
+	}
+
+	// Rotated keys are picked up with the next bundle
+	if _, err := issuer.rotateKeys(keyRotationAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if source.current().rateLimitedTokenKey.N.Cmp(issuer.rateLimitedIssuer.TokenKey().N) != 0 {
+		t.Fatal("expected rotated token key")
+	}
+
+	// Bundles signed with another key keep the last known good keys, even if
+	// the directory lists other keys
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	impostor := newTestIssuer(t, name)
+	impostor.bundleKey = otherKey
+	current.Store(impostor)
+	keys = source.current()
+	if err := source.refresh(); err == nil {
+		t.Fatal("expected a bundle signed with another key to be refused")
+	}
+	if source.current().rateLimitedTokenKey != keys.rateLimitedTokenKey {
+		t.Fatal("expected last known good token keys to be kept")
+	}
+	if !bytes.Equal(source.current().encapKey.Marshal(), impostor.rateLimitedIssuer.NameKey().Marshal()) {
+		t.Fatal("expected the encapsulation key to be refreshed from the directory")
+	}
+}
+
+func TestOpenVerificationBundle(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	bundleKey, err := loadEd25519SigningKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := bundleKey.Public().(ed25519.PublicKey)
+	now := time.Now()
+	bundle, err := issuer.verificationBundle(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signVerificationBundle(bundle, bundleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := openVerificationBundle(signed, "issuer.example", publicKey, now, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := opened.tokenKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openVerificationBundle(signed, "issuer.example", publicKey, now.Add(verificationBundleLifetime), 0); err == nil {
+		t.Fatal("expected expired bundle to be refused")
+	}
+
+	if _, err := openVerificationBundle(signed, "other.example", publicKey, now, 0); err == nil {
+		t.Fatal("expected a bundle of another issuer signed with the same key to be refused")
+	}
+
+	tampered := signed
+	tampered.Bundle = base64.URLEncoding.EncodeToString(append([]byte(" "), mustDecodeBase64(t, signed.Bundle)...))
+	if _, err := openVerificationBundle(tampered, "issuer.example", publicKey, now, 0); err == nil {
+		t.Fatal("expected tampered bundle to be refused")
+	}
+
+	mismatched := bundle
+	mismatched.Verifiers = append([]bundleVerifier{}, bundle.Verifiers...)
+	mismatched.Verifiers[0].KeyID = base64.URLEncoding.EncodeToString(make([]byte, 32))
+	if _, err := mismatched.tokenKeys(); err == nil {
+		t.Fatal("expected key ID mismatch to be refused")
+	}
+	duplicate := bundle
+	duplicate.Verifiers = append(append([]bundleVerifier{}, bundle.Verifiers...), bundle.Verifiers[0])
+	if _, err := duplicate.tokenKeys(); err == nil {
+		t.Fatal("expected duplicate token type to be refused")
+	}
+}
+
+func mustDecodeBase64(t *testing.T, value string) []byte {
+	decoded, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
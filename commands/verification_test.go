@@ -0,0 +1,166 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+// testTokenChallenge returns a challenge of the token type by
+// issuer.example for origin.example.
+func testTokenChallenge(tokenType uint16) []byte {
+	challenge := pat.TokenChallenge{
+		TokenType:  tokenType,
+		IssuerName: "issuer.example",
+		OriginInfo: []string{"origin.example"},
+	}
+	return challenge.Marshal()
+}
+
+// createTestToken runs issuance for a challenge through the issuer handler,
+// as the attester passes it through, for the token type of the challenge.
+func createTestToken(t *testing.T, issuer *Issuer, challenge []byte) pat.Token {
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+
+	var requestEnc []byte
+	var finalize func(response []byte) (pat.Token, error)
+	switch tokenType := binary.BigEndian.Uint16(challenge); tokenType {
+	case pat.BasicPublicTokenType:
+		// Key IDs as clients compute them from the issuer directory
+		tokenKeyEnc, err := marshalTokenKey(issuer.basicIssuer.TokenKey(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokenKeyID := sha256.Sum256(tokenKeyEnc)
+		state, err := pat.NewBasicPublicClient().CreateTokenRequest(challenge, nonce, tokenKeyID[:], issuer.basicIssuer.TokenKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		requestEnc, finalize = state.Request().Marshal(), state.FinalizeToken
+	case pat.BasicPrivateTokenType:
+		publicKeyEnc, err := issuer.privateIssuer.TokenKey().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKey, err := unmarshalPrivateTokenKey(publicKeyEnc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := pat.NewBasicPrivateClient().CreateTokenRequest(challenge, nonce, privateTokenKeyID(publicKeyEnc), publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requestEnc, finalize = state.Request().Marshal(), state.FinalizeToken
+	case ed25519TokenType:
+		keyID := ed25519TokenKeyID(issuer.ed25519Issuer.TokenKey())
+		tokenContext := sha256.Sum256(challenge)
+		request := ed25519TokenRequest{
+			tokenKeyID: keyID[len(keyID)-1],
+			nonce:      nonce,
+			context:    tokenContext[:],
+		}
+		requestEnc = request.Marshal()
+		finalize = func(signature []byte) (pat.Token, error) {
+			return pat.Token{
+				TokenType:     ed25519TokenType,
+				Nonce:         nonce,
+				Context:       tokenContext[:],
+				KeyID:         keyID,
+				Authenticator: signature,
+			}, nil
+		}
+	default:
+		t.Fatalf("unsupported token type %d", tokenType)
+	}
+
+	if tokenType, err := validateTokenRequest(requestEnc); err != nil || tokenType != binary.BigEndian.Uint16(challenge) {
+		t.Fatalf("unexpected validation result %d, %v", tokenType, err)
+	}
+	req := httptest.NewRequest(http.MethodPost, tokenRequestURI, bytes.NewReader(requestEnc))
+	req.Header.Set("Content-Type", tokenRequestMediaType)
+	w := httptest.NewRecorder()
+	issuer.handleIssuanceRequest(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected issuance response %d: %s", w.Code, w.Body.String())
+	}
+	token, err := finalize(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRemoteVerification(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	requests := int32(0)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		issuer.handleVerificationRequest(w, req)
+	}))
+	defer server.Close()
+
+	verifier, err := newRemoteVerifier(server.Client(), server.URL+tokenVerificationURI, time.Minute, verificationFailureDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := createTestToken(t, issuer, testTokenChallenge(pat.BasicPublicTokenType))
+	if err := verifyPublicToken(issuer.basicIssuer.TokenKey(), token); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.verify(context.Background(), token.TokenType, token.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The verdict is cached
+	if err := verifier.verify(context.Background(), token.TokenType, token.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("expected one request to the issuer, got %d", requests)
+	}
+
+	token.Authenticator[0] ^= 0xff
+	if err := verifier.verify(context.Background(), token.TokenType, token.Marshal()); err != ErrInvalidToken {
+		t.Fatalf("expected invalid token, got %v", err)
+	}
+}
+
+func TestRemoteVerificationFailurePolicy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	for policy, expectValid := range map[string]bool{
+		verificationFailureDeny:  false,
+		verificationFailureAllow: true,
+	} {
+		verifier, err := newRemoteVerifier(server.Client(), server.URL+tokenVerificationURI, time.Minute, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = verifier.verify(context.Background(), pat.BasicPublicTokenType, []byte{0x00, 0x02})
+		if (err == nil) != expectValid {
+			t.Fatalf("unexpected result %v for failure policy %s", err, policy)
+		}
+		if !expectValid && !errors.Is(err, ErrVerificationUnavailable) {
+			t.Fatalf("expected the issuer failure to be reported, got %v", err)
+		}
+	}
+
+	if _, err := newRemoteVerifier(server.Client(), server.URL, 0, "maybe"); err == nil {
+		t.Fatal("expected invalid failure policy to be rejected")
+	}
+}
@@ -0,0 +1,130 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+const (
+	// Guest allocator every plugin must export
+	wasmAllocExport = "pat_alloc"
+
+	// Time a plugin call may run before it is aborted
+	defaultWasmCallTimeout = time.Second
+)
+
+// wasmPlugin is a compiled WASM module implementing the pat-app plugin ABI.
+// A plugin exports its linear memory as "memory", an allocator
+// pat_alloc(size i32) -> i32, and entry points of the form
+// f(ptr i32, len i32) -> i64. Entry points receive a JSON document in guest
+// memory and return (ptr << 32 | len) of a JSON result, or zero for no result.
+type wasmPlugin struct {
+	path    string
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+	timeout time.Duration
+}
+
+func loadWasmPlugin(ctx context.Context, path string, entryPoints ...string) (*wasmPlugin, error) {
+	binary, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newWasmPlugin(ctx, path, binary, entryPoints...)
+}
+
+func newWasmPlugin(ctx context.Context, path string, binary []byte, entryPoints ...string) (*wasmPlugin, error) {
+	// Abort calls once their context is done, so that a looping plugin does
+	// not hold the request forever
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	module, err := runtime.CompileModule(ctx, binary)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("Failed compiling WASM plugin %s: %w", path, err)
+	}
+
+	exports := module.ExportedFunctions()
+	for _, name := range append([]string{wasmAllocExport}, entryPoints...) {
+		if _, ok := exports[name]; !ok {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("WASM plugin %s does not export %s", path, name)
+		}
+	}
+	if _, ok := module.ExportedMemories()["memory"]; !ok {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("WASM plugin %s does not export memory", path)
+	}
+
+	return &wasmPlugin{
+		path:    path,
+		runtime: runtime,
+		module:  module,
+		timeout: defaultWasmCallTimeout,
+	}, nil
+}
+
+// call runs entryPoint in a fresh module instance, so plugins never share
+// state across requests, within the plugin's timeout. The JSON result, if any,
+// is decoded into output.
+func (p *wasmPlugin) call(ctx context.Context, entryPoint string, input interface{}, output interface{}) error {
+	inputEnc, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	instance, err := p.runtime.InstantiateModule(ctx, p.module, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return err
+	}
+	defer instance.Close(ctx)
+
+	ptr, err := p.writeInput(ctx, instance, inputEnc)
+	if err != nil {
+		return err
+	}
+
+	results, err := instance.ExportedFunction(entryPoint).Call(ctx, uint64(ptr), uint64(len(inputEnc)))
+	if err != nil {
+		return fmt.Errorf("WASM plugin %s failed in %s: %w", p.path, entryPoint, err)
+	}
+	if len(results) != 1 || results[0] == 0 {
+		return nil
+	}
+
+	resultPtr := uint32(results[0] >> 32)
+	resultLen := uint32(results[0])
+	resultEnc, ok := instance.Memory().Read(resultPtr, resultLen)
+	if !ok {
+		return fmt.Errorf("WASM plugin %s returned out of bounds result", p.path)
+	}
+
+	return json.Unmarshal(resultEnc, output)
+}
+
+func (p *wasmPlugin) writeInput(ctx context.Context, instance api.Module, input []byte) (uint32, error) {
+	results, err := instance.ExportedFunction(wasmAllocExport).Call(ctx, uint64(len(input)))
+	if err != nil {
+		return 0, err
+	}
+	if len(results) != 1 {
+		return 0, fmt.Errorf("WASM plugin %s returned invalid allocation", p.path)
+	}
+
+	ptr := uint32(results[0])
+	if !instance.Memory().Write(ptr, input) {
+		return 0, fmt.Errorf("WASM plugin %s allocated out of bounds memory", p.path)
+	}
+	return ptr, nil
+}
+
+func (p *wasmPlugin) Close(ctx context.Context) error {
+	return p.runtime.Close(ctx)
+}
@@ -0,0 +1,254 @@
+package commands
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pat "github.com/cloudflare/pat-go"
+)
+
+const (
+	testPluginInputOffset  = 1024
+	testPluginResultOffset = 2048
+)
+
+func appendULEB128(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if v == 0 {
+			return b
+		}
+	}
+}
+
+func appendSLEB128(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func appendWasmName(b []byte, name string) []byte {
+	b = appendULEB128(b, uint64(len(name)))
+	return append(b, name...)
+}
+
+func appendWasmSection(b []byte, id byte, contents []byte) []byte {
+	b = append(b, id)
+	b = appendULEB128(b, uint64(len(contents)))
+	return append(b, contents...)
+}
+
+// buildTestPlugin assembles a minimal plugin whose entry point ignores its
+// input and returns result, or nothing if result is nil.
+func buildTestPlugin(entryPoint string, result []byte) []byte {
+	packed := int64(0)
+	if result != nil {
+		packed = int64(testPluginResultOffset)<<32 | int64(len(result))
+	}
+	entryBody := appendSLEB128([]byte{0x00, 0x42}, packed)
+	return buildTestPluginWithEntry(entryPoint, append(entryBody, 0x0b), result)
+}
+
+// buildLoopingTestPlugin assembles a plugin whose entry point never returns.
+func buildLoopingTestPlugin(entryPoint string) []byte {
+	// loop br 0 end unreachable end
+	return buildTestPluginWithEntry(entryPoint, []byte{0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x00, 0x0b}, nil)
+}
+
+// buildTestPluginWithEntry assembles a plugin with the given entry point
+// body, and result in its memory if not nil.
+func buildTestPluginWithEntry(entryPoint string, entryBody []byte, result []byte) []byte {
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+	// (i32) -> i32 and (i32, i32) -> i64
+	module = appendWasmSection(module, 1, []byte{0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e})
+	module = appendWasmSection(module, 3, []byte{0x02, 0x00, 0x01})
+	module = appendWasmSection(module, 5, []byte{0x01, 0x00, 0x01})
+
+	exports := []byte{0x03}
+	exports = append(appendWasmName(exports, "memory"), 0x02, 0x00)
+	exports = append(appendWasmName(exports, wasmAllocExport), 0x00, 0x00)
+	exports = append(appendWasmName(exports, entryPoint), 0x00, 0x01)
+	module = appendWasmSection(module, 7, exports)
+
+	allocBody := appendSLEB128([]byte{0x00, 0x41}, testPluginInputOffset)
+	allocBody = append(allocBody, 0x0b)
+	code := []byte{0x02}
+	code = append(appendULEB128(code, uint64(len(allocBody))), allocBody...)
+	code = append(appendULEB128(code, uint64(len(entryBody))), entryBody...)
+	module = appendWasmSection(module, 10, code)
+
+	if result != nil {
+		data := appendSLEB128([]byte{0x01, 0x00, 0x41}, testPluginResultOffset)
+		data = append(data, 0x0b)
+		data = append(appendULEB128(data, uint64(len(result))), result...)
+		module = appendWasmSection(module, 11, data)
+	}
+
+	return module
+}
+
+func TestWasmPluginMissingExport(t *testing.T) {
+	ctx := context.Background()
+	_, err := newWasmPlugin(ctx, "test.wasm", buildTestPlugin("other", nil), redemptionHookEntryPoint)
+	if err == nil {
+		t.Fatal("expected plugin without entry point to be rejected")
+	}
+}
+
+func TestRedemptionHookVerdicts(t *testing.T) {
+	ctx := context.Background()
+	event := newRedemptionEvent(httptest.NewRequest(http.MethodGet, "/index.html", nil), pat.TokenChallenge{IssuerName: "issuer.example"}, createEmptyToken(), nil)
+
+	var tests = []struct {
+		result   []byte
+		decision string
+		status   int
+	}{
+		{nil, redemptionDecisionAllow, 0},
+		{[]byte(`{"decision":"deny"}`), redemptionDecisionDeny, 403},
+		{[]byte(`{"decision":"deny","status":429}`), redemptionDecisionDeny, 429},
+		{[]byte(`{"decision":"tag","tags":["suspicious"]}`), redemptionDecisionTag, 0},
+		{[]byte(`{"decision":"deny","status":200}`), redemptionDecisionDeny, 400},
+		{[]byte(`{"decision":"deny","status":1000}`), redemptionDecisionDeny, 599},
+	}
+	for _, test := range tests {
+		plugin, err := newWasmPlugin(ctx, "test.wasm", buildTestPlugin(redemptionHookEntryPoint, test.result), redemptionHookEntryPoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hook := &redemptionHook{plugin: plugin}
+
+		verdict, err := hook.evaluate(ctx, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verdict.Decision != test.decision || verdict.Status != test.status {
+			t.Fatalf("Expected %s/%d, got %s/%d", test.decision, test.status, verdict.Decision, verdict.Status)
+		}
+		plugin.Close(ctx)
+	}
+
+	// Unknown decisions fail rather than allow
+	plugin, err := newWasmPlugin(ctx, "test.wasm", buildTestPlugin(redemptionHookEntryPoint, []byte(`{"decision":"block"}`)), redemptionHookEntryPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close(ctx)
+	if _, err := (&redemptionHook{plugin: plugin}).evaluate(ctx, event); err == nil {
+		t.Fatal("expected an unknown decision to fail")
+	}
+}
+
+func TestWasmPluginTimeout(t *testing.T) {
+	ctx := context.Background()
+	plugin, err := newWasmPlugin(ctx, "test.wasm", buildLoopingTestPlugin(redemptionHookEntryPoint), redemptionHookEntryPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close(ctx)
+	plugin.timeout = 50 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() {
+		var verdict redemptionVerdict
+		done <- plugin.call(ctx, redemptionHookEntryPoint, struct{}{}, &verdict)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the looping plugin to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the looping plugin to be aborted")
+	}
+}
+
+func TestRedemptionHookBeforeSpend(t *testing.T) {
+	issuer := newTestIssuer(t, "issuer.example")
+	origin := newTestOrigin()
+	keys := &issuerKeys{encapKey: issuer.rateLimitedIssuer.NameKey()}
+	basicKeyEnc, _ := marshalTokenKey(issuer.basicIssuer.TokenKey(), false)
+	keys.parseTokenKey(int(pat.BasicPublicTokenType), basicKeyEnc)
+	origin.issuerKeys = &issuerKeySource{keys: keys}
+	origin.spentTokens = newMemorySpentTokenStore()
+
+	ctx := context.Background()
+	plugin, err := newWasmPlugin(ctx, "test.wasm", buildTestPlugin(redemptionHookEntryPoint, []byte(`{"decision":"deny","status":429}`)), redemptionHookEntryPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close(ctx)
+	origin.redemptionHook = &redemptionHook{plugin: plugin}
+
+	// Denied tokens are not spent
+	token := createTestToken(t, issuer, testTokenChallenge(pat.BasicPublicTokenType))
+	challenge := pat.TokenChallenge{
+		TokenType:  pat.BasicPublicTokenType,
+		IssuerName: "issuer.example",
+		OriginInfo: []string{"origin.example"},
+	}
+	context := sha256.Sum256(challenge.Marshal())
+	origin.addChallenge(hex.EncodeToString(context[:]), challenge)
+	req := httptest.NewRequest(http.MethodGet, "https://origin.example/", nil)
+	req.Header.Set("Authorization", privateTokenType+" token="+base64.URLEncoding.EncodeToString(token.Marshal()))
+	w := httptest.NewRecorder()
+	origin.handleRequest(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected the hook to deny the token, got %d", w.Code)
+	}
+	if spent, _ := origin.spentTokens.spent(spentTokenKey(token), time.Now()); spent {
+		t.Fatal("expected the denied token not to be spent")
+	}
+}
+
+func TestWasmAttestationVerifier(t *testing.T) {
+	ctx := context.Background()
+	plugin, err := newWasmPlugin(ctx, "test.wasm", buildTestPlugin(attestationVerifyEntryPoint, []byte(`{"valid":true,"attributes":{"platform":"ios"}}`)), attestationVerifyEntryPoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plugin.Close(ctx)
+
+	attester := TestAttester{
+		verifiers: map[string]attestationVerifier{
+			"test": &wasmAttestationVerifier{plugin: plugin},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, attesterTokenRequestURI, nil)
+	if _, err := attester.attest(req, pat.BasicPublicTokenType); err != ErrMissingAttestation {
+		t.Fatal("expected request without evidence to be rejected")
+	}
+
+	req.Header.Set(headerAttestationFormat, "unknown")
+	req.Header.Set(headerAttestationEvidence, marshalStructuredBinary([]byte{0x01}))
+	if _, err := attester.attest(req, pat.BasicPublicTokenType); err == nil {
+		t.Fatal("expected unknown attestation format to be rejected")
+	}
+
+	req.Header.Set(headerAttestationFormat, "test")
+	attributes, err := attester.attest(req, pat.BasicPublicTokenType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attributes["platform"] != "ios" {
+		t.Fatal("expected verified attributes")
+	}
+}
@@ -0,0 +1,331 @@
+// Package httpauth parses and serializes the challenges of WWW-Authenticate
+// headers, as in RFC 9110, with the attributes of PrivateToken challenges
+// decoded, so that origins and clients agree on one encoding.
+package httpauth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PrivateTokenScheme is the authentication scheme of Privacy Pass.
+	PrivateTokenScheme = "PrivateToken"
+
+	// Attributes of PrivateToken challenges
+	ParamChallenge      = "challenge"
+	ParamTokenKey       = "token-key"
+	ParamIssuerEncapKey = "issuer-encap-key"
+	ParamMaxAge         = "max-age"
+)
+
+var ErrInvalidHeader = errors.New("Invalid WWW-Authenticate header")
+
+// Param is an auth-param of a challenge.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Challenge is a challenge of a WWW-Authenticate header. The attributes of
+// PrivateToken challenges are decoded into their fields. Params holds the
+// other parameters in order, including unknown ones and attributes whose
+// values could not be interpreted, such as a max-age that is not a number.
+type Challenge struct {
+	Scheme string // PrivateToken if empty
+
+	TokenChallenge []byte // encoded TokenChallenge
+	TokenKey       []byte
+	IssuerEncapKey []byte // nil unless sent
+	MaxAge         *int   // in seconds, nil unless sent
+
+	Params  []Param
+	Token68 string // the credentials of token68 schemes, which have no params
+}
+
+// IsPrivateToken tells whether the challenge is of the PrivateToken scheme.
+func (c Challenge) IsPrivateToken() bool {
+	return c.Scheme == "" || strings.EqualFold(c.Scheme, PrivateTokenScheme)
+}
+
+// Param returns the value of a parameter kept in Params, matching its name
+// case-insensitively.
+func (c Challenge) Param(name string) (string, bool) {
+	for _, param := range c.Params {
+		if strings.EqualFold(param.Name, name) {
+			return param.Value, true
+		}
+	}
+	return "", false
+}
+
+// String serializes the challenge, quoting values that are not tokens.
+func (c Challenge) String() string {
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = PrivateTokenScheme
+	}
+	if c.Token68 != "" {
+		return scheme + " " + c.Token68
+	}
+
+	params := make([]Param, 0, 4+len(c.Params))
+	if c.IsPrivateToken() {
+		if c.TokenChallenge != nil {
+			params = append(params, Param{ParamChallenge, base64.URLEncoding.EncodeToString(c.TokenChallenge)})
+		}
+		if c.TokenKey != nil {
+			params = append(params, Param{ParamTokenKey, base64.URLEncoding.EncodeToString(c.TokenKey)})
+		}
+		if c.IssuerEncapKey != nil {
+			params = append(params, Param{ParamIssuerEncapKey, base64.URLEncoding.EncodeToString(c.IssuerEncapKey)})
+		}
+		if c.MaxAge != nil {
+			params = append(params, Param{ParamMaxAge, strconv.Itoa(*c.MaxAge)})
+		}
+	}
+	params = append(params, c.Params...)
+	if len(params) == 0 {
+		return scheme
+	}
+
+	var builder strings.Builder
+	builder.WriteString(scheme)
+	for i, param := range params {
+		if i == 0 {
+			builder.WriteByte(' ')
+		} else {
+			builder.WriteString(", ")
+		}
+		builder.WriteString(param.Name)
+		builder.WriteByte('=')
+		builder.WriteString(quote(param.Value))
+	}
+	return builder.String()
+}
+
+// Marshal serializes challenges into the value of one WWW-Authenticate header,
+// separated by commas.
+func Marshal(challenges ...Challenge) string {
+	values := make([]string, len(challenges))
+	for i, challenge := range challenges {
+		values[i] = challenge.String()
+	}
+	return strings.Join(values, ", ")
+}
+
+// Parse parses the challenges of a WWW-Authenticate header value, of any
+// scheme. It is tolerant of what origins send in practice: unquoted values
+// that are not tokens, such as padded base64, empty list elements, and
+// missing commas between challenges. Attributes of PrivateToken challenges
+// that do not decode are refused.
+func Parse(value string) ([]Challenge, error) {
+	challenges := make([]Challenge, 0, 1)
+	p := &parser{rest: value}
+	for {
+		p.skip(" \t,")
+		if p.rest == "" {
+			break
+		}
+		scheme := p.token()
+		if scheme == "" {
+			return nil, fmt.Errorf("%w: expected a scheme at %q", ErrInvalidHeader, p.rest)
+		}
+		challenge := Challenge{Scheme: scheme}
+		p.skip(" \t")
+		if token68, ok := p.token68(); ok {
+			challenge.Token68 = token68
+		} else {
+			params, err := p.params()
+			if err != nil {
+				return nil, err
+			}
+			challenge.Params = params
+		}
+		if challenge.IsPrivateToken() {
+			if err := challenge.decode(); err != nil {
+				return nil, err
+			}
+		}
+		challenges = append(challenges, challenge)
+	}
+	return challenges, nil
+}
+
+// ParseValues parses the challenges of every WWW-Authenticate header value.
+func ParseValues(values []string) ([]Challenge, error) {
+	challenges := make([]Challenge, 0, len(values))
+	for _, value := range values {
+		parsed, err := Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		challenges = append(challenges, parsed...)
+	}
+	return challenges, nil
+}
+
+// decode moves the attributes of a PrivateToken challenge from Params into
+// their fields. Repeated attributes are kept in Params, the first one wins.
+func (c *Challenge) decode() error {
+	params := c.Params[:0]
+	seen := make(map[string]bool)
+	for _, param := range c.Params {
+		name := strings.ToLower(param.Name)
+		if seen[name] {
+			params = append(params, param)
+			continue
+		}
+		var err error
+		switch name {
+		case ParamChallenge:
+			c.TokenChallenge, err = decodeBase64(param)
+		case ParamTokenKey:
+			c.TokenKey, err = decodeBase64(param)
+		case ParamIssuerEncapKey:
+			c.IssuerEncapKey, err = decodeBase64(param)
+		case ParamMaxAge:
+			maxAge, err := strconv.Atoi(param.Value)
+			if err != nil || maxAge < 0 {
+				params = append(params, param)
+				continue
+			}
+			c.MaxAge = &maxAge
+		default:
+			params = append(params, param)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		seen[name] = true
+	}
+	c.Params = params
+	if len(c.Params) == 0 {
+		c.Params = nil
+	}
+	return nil
+}
+
+func decodeBase64(param Param) ([]byte, error) {
+	data, err := base64.URLEncoding.DecodeString(param.Value)
+	if err != nil {
+		data, err = base64.RawURLEncoding.DecodeString(param.Value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed decoding %s: %v", ErrInvalidHeader, param.Name, err)
+	}
+	return data, nil
+}
+
+// quote returns the value as a token if it is one, and as a quoted string
+// otherwise.
+func quote(value string) string {
+	if value != "" && strings.IndexFunc(value, func(r rune) bool { return !isTokenChar(r) }) < 0 {
+		return value
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// isTokenChar tells whether r is a tchar of RFC 9110.
+func isTokenChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// isToken68Char tells whether r is a token68 character other than the
+// trailing '='.
+func isToken68Char(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("-._~+/", r)
+}
+
+type parser struct {
+	rest string
+}
+
+func (p *parser) skip(chars string) {
+	p.rest = strings.TrimLeft(p.rest, chars)
+}
+
+// token consumes a token, returning "" if there is none.
+func (p *parser) token() string {
+	end := strings.IndexFunc(p.rest, func(r rune) bool { return !isTokenChar(r) })
+	if end < 0 {
+		end = len(p.rest)
+	}
+	token := p.rest[:end]
+	p.rest = p.rest[end:]
+	return token
+}
+
+// token68 consumes the credentials of a token68 scheme, if the challenge has
+// them rather than params.
+func (p *parser) token68() (string, bool) {
+	end := strings.IndexFunc(p.rest, func(r rune) bool { return !isToken68Char(r) })
+	if end < 0 {
+		end = len(p.rest)
+	}
+	for end < len(p.rest) && p.rest[end] == '=' {
+		end++
+	}
+	after := strings.TrimLeft(p.rest[end:], " \t")
+	if end == 0 || (after != "" && after[0] != ',') {
+		return "", false
+	}
+	token68 := p.rest[:end]
+	p.rest = after
+	return token68, true
+}
+
+// params consumes the params of a challenge, up to the scheme of the next
+// one or the end of the header.
+func (p *parser) params() ([]Param, error) {
+	var params []Param
+	for {
+		start := p.rest
+		p.skip(" \t,")
+		name := p.token()
+		p.skip(" \t")
+		if name == "" || !strings.HasPrefix(p.rest, "=") {
+			// The next challenge, or the end of the header
+			p.rest = start
+			return params, nil
+		}
+		p.rest = strings.TrimLeft(p.rest[1:], " \t")
+
+		var value string
+		if strings.HasPrefix(p.rest, `"`) {
+			var builder strings.Builder
+			i := 1
+			for ; i < len(p.rest) && p.rest[i] != '"'; i++ {
+				if p.rest[i] == '\\' && i+1 < len(p.rest) {
+					i++
+				}
+				builder.WriteByte(p.rest[i])
+			}
+			if i == len(p.rest) {
+				return nil, fmt.Errorf("%w: unterminated value of %s", ErrInvalidHeader, name)
+			}
+			value, p.rest = builder.String(), p.rest[i+1:]
+		} else {
+			// Tolerate values that are not tokens, such as padded base64
+			end := strings.IndexAny(p.rest, " \t,")
+			if end < 0 {
+				end = len(p.rest)
+			}
+			value, p.rest = p.rest[:end], p.rest[end:]
+		}
+		params = append(params, Param{name, value})
+	}
+}
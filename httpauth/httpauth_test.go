@@ -0,0 +1,101 @@
+package httpauth
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	maxAge := 300
+	challenges := []Challenge{
+		{
+			TokenChallenge: []byte{0x00, 0x02, 0xff},
+			TokenKey:       []byte{0x01},
+			IssuerEncapKey: []byte{0x02, 0x03},
+			MaxAge:         &maxAge,
+			Params:         []Param{{"realm", `a "quoted" realm`}},
+		},
+		{TokenChallenge: []byte{0x00, 0x03}, TokenKey: []byte{0x04, 0x05, 0x06}},
+	}
+	header := Marshal(challenges...)
+	expected := `PrivateToken challenge=AAL_, token-key="AQ==", issuer-encap-key="AgM=", max-age=300, realm="a \"quoted\" realm", PrivateToken challenge="AAM=", token-key=BAUG`
+	if header != expected {
+		t.Fatalf("unexpected header\n%s\nexpected\n%s", header, expected)
+	}
+
+	parsed, err := Parse(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 {
+		t.Fatalf("expected two challenges, got %d", len(parsed))
+	}
+	first := parsed[0]
+	if !bytes.Equal(first.TokenChallenge, challenges[0].TokenChallenge) || !bytes.Equal(first.TokenKey, challenges[0].TokenKey) ||
+		!bytes.Equal(first.IssuerEncapKey, challenges[0].IssuerEncapKey) || first.MaxAge == nil || *first.MaxAge != maxAge {
+		t.Fatalf("unexpected first challenge %+v", first)
+	}
+	if realm, _ := first.Param("Realm"); realm != `a "quoted" realm` {
+		t.Fatalf("unexpected realm %q", realm)
+	}
+	if parsed[1].MaxAge != nil || parsed[1].IssuerEncapKey != nil || !bytes.Equal(parsed[1].TokenKey, challenges[1].TokenKey) {
+		t.Fatalf("unexpected second challenge %+v", parsed[1])
+	}
+}
+
+func TestParseTolerant(t *testing.T) {
+	// Unquoted padded base64, a lower-case scheme, missing commas between
+	// challenges, and challenges of other schemes
+	header := `Basic realm="admin", privatetoken challenge=AAM=,token-key=AQ== , max-age=soon PrivateToken challenge=AAI, Negotiate YII+/w==, , Bearer`
+	parsed, err := Parse(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 5 {
+		t.Fatalf("expected five challenges, got %+v", parsed)
+	}
+	if parsed[0].IsPrivateToken() || parsed[0].Scheme != "Basic" {
+		t.Fatalf("unexpected first challenge %+v", parsed[0])
+	}
+	tokenChallenge := parsed[1]
+	if !tokenChallenge.IsPrivateToken() || !bytes.Equal(tokenChallenge.TokenChallenge, []byte{0x00, 0x03}) || !bytes.Equal(tokenChallenge.TokenKey, []byte{0x01}) {
+		t.Fatalf("unexpected PrivateToken challenge %+v", tokenChallenge)
+	}
+	if maxAge, ok := tokenChallenge.Param(ParamMaxAge); tokenChallenge.MaxAge != nil || !ok || maxAge != "soon" {
+		t.Fatalf("expected the bogus max-age to be kept as a param, got %+v", tokenChallenge)
+	}
+	if !bytes.Equal(parsed[2].TokenChallenge, []byte{0x00, 0x02}) {
+		t.Fatalf("expected unpadded base64 to decode, got %+v", parsed[2])
+	}
+	if parsed[3].Scheme != "Negotiate" || parsed[3].Token68 != "YII+/w==" {
+		t.Fatalf("unexpected token68 challenge %+v", parsed[3])
+	}
+	if parsed[4].Scheme != "Bearer" || parsed[4].Params != nil {
+		t.Fatalf("unexpected bare challenge %+v", parsed[4])
+	}
+	if parsed[3].String() != "Negotiate YII+/w==" || parsed[4].String() != "Bearer" {
+		t.Fatalf("unexpected serialization %q, %q", parsed[3], parsed[4])
+	}
+}
+
+func TestParseRefused(t *testing.T) {
+	for _, header := range []string{
+		`PrivateToken challenge="not base64!"`,
+		`PrivateToken challenge="AAM=`,
+		`"PrivateToken" challenge=AAM=`,
+	} {
+		if _, err := Parse(header); !errors.Is(err, ErrInvalidHeader) {
+			t.Fatalf("expected %q to be refused, got %v", header, err)
+		}
+	}
+
+	// Repeated attributes are kept as params, the first one is used
+	parsed, err := Parse(`PrivateToken challenge=AAM=, challenge=AAI=`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed[0].TokenChallenge, []byte{0x00, 0x03}) || len(parsed[0].Params) != 1 {
+		t.Fatalf("unexpected challenge %+v", parsed[0])
+	}
+}
@@ -0,0 +1,382 @@
+// Package metrics implements the counters, gauges, and histograms shared by
+// the PAT roles. Every metric is labeled with token_type and draft_version, derived
+// from the token type of the request, so that dashboards can break down the
+// whole pipeline by protocol variant.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	LabelTokenType    = "token_type"
+	LabelDraftVersion = "draft_version"
+)
+
+type tokenTypeInfo struct {
+	name         string
+	draftVersion string
+}
+
+var (
+	tokenTypesLock sync.RWMutex
+	tokenTypes     = map[uint16]tokenTypeInfo{
+		0x0001: {"private", "draft-ietf-privacypass-protocol-07"},
+		0x0002: {"basic", "draft-ietf-privacypass-protocol-07"},
+		0x0003: {"rate-limited", "draft-privacypass-rate-limit-tokens-03"},
+	}
+
+	// Default is the registry used by all roles
+	Default = NewRegistry()
+
+	// DefaultBuckets are latency buckets, in seconds
+	DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+	// SizeBuckets are message size buckets, in bytes
+	SizeBuckets = []float64{32, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384}
+)
+
+// RegisterTokenType names a token type and the draft that specifies it.
+func RegisterTokenType(tokenType uint16, name, draftVersion string) {
+	tokenTypesLock.Lock()
+	defer tokenTypesLock.Unlock()
+	tokenTypes[tokenType] = tokenTypeInfo{name, draftVersion}
+}
+
+// TokenTypeName returns the token_type label value for the token type. Zero
+// stands for requests whose token type could not be determined, and for
+// metrics that are not specific to one token type.
+func TokenTypeName(tokenType uint16) string {
+	if tokenType == 0 {
+		return "unknown"
+	}
+	tokenTypesLock.RLock()
+	defer tokenTypesLock.RUnlock()
+	if info, ok := tokenTypes[tokenType]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("0x%04x", tokenType)
+}
+
+// DraftVersion returns the draft_version label value for the token type.
+func DraftVersion(tokenType uint16) string {
+	tokenTypesLock.RLock()
+	defer tokenTypesLock.RUnlock()
+	if info, ok := tokenTypes[tokenType]; ok {
+		return info.draftVersion
+	}
+	return "unknown"
+}
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+// Registry holds metrics in registration order.
+type Registry struct {
+	lock    sync.Mutex
+	names   map[string]bool
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names:   make(map[string]bool),
+		metrics: make([]metric, 0),
+	}
+}
+
+func (r *Registry) register(name string, m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes every metric in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.lock.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// series is the common part of labeled metrics.
+type series struct {
+	name   string
+	help   string
+	labels []string // extra labels, after token_type and draft_version
+}
+
+func (s series) key(tokenType uint16, labelValues []string) string {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", s.name, len(s.labels), len(labelValues)))
+	}
+	values := append([]string{TokenTypeName(tokenType), DraftVersion(tokenType)}, labelValues...)
+	return strings.Join(values, "\xff")
+}
+
+func (s series) format(key string, extra ...string) string {
+	names := append([]string{LabelTokenType, LabelDraftVersion}, s.labels...)
+	values := strings.Split(key, "\xff")
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+"="+strconv.Quote(values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (s series) writeHeader(w io.Writer, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, kind)
+	return err
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a monotonically increasing value per label set.
+type Counter struct {
+	series
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter registers a counter. The token_type and draft_version labels are
+// always present and must not be listed in labels.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		series: series{name, help, labels},
+		values: make(map[string]float64),
+	}
+	r.register(name, c)
+	return c
+}
+
+func (c *Counter) Inc(tokenType uint16, labelValues ...string) {
+	c.Add(tokenType, 1, labelValues...)
+}
+
+func (c *Counter) Add(tokenType uint16, delta float64, labelValues ...string) {
+	key := c.key(tokenType, labelValues)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] += delta
+}
+
+// Value returns the current value for the label set.
+func (c *Counter) Value(tokenType uint16, labelValues ...string) float64 {
+	key := c.key(tokenType, labelValues)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(w io.Writer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.writeHeader(w, "counter"); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(c.values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.name, c.format(key), formatFloat(c.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gauge is a value per label set that can go up and down.
+type Gauge struct {
+	series
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge registers a gauge. The token_type and draft_version labels are
+// always present and must not be listed in labels.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		series: series{name, help, labels},
+		values: make(map[string]float64),
+	}
+	r.register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(tokenType uint16, value float64, labelValues ...string) {
+	key := g.key(tokenType, labelValues)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[key] = value
+}
+
+func (g *Gauge) Add(tokenType uint16, delta float64, labelValues ...string) {
+	key := g.key(tokenType, labelValues)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[key] += delta
+}
+
+// Value returns the current value for the label set.
+func (g *Gauge) Value(tokenType uint16, labelValues ...string) float64 {
+	key := g.key(tokenType, labelValues)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.values[key]
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if err := g.writeHeader(w, "gauge"); err != nil {
+		return err
+	}
+	for _, key := range sortedKeys(g.values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", g.name, g.format(key), formatFloat(g.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type histogramValue struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Histogram tracks the distribution of observations per label set.
+type Histogram struct {
+	series
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds. The
+// token_type and draft_version labels are always present.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		series:  series{name, help, labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	r.register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(tokenType uint16, value float64, labelValues ...string) {
+	key := h.key(tokenType, labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+			break
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+// Count returns the number of observations for the label set.
+func (h *Histogram) Count(tokenType uint16, labelValues ...string) uint64 {
+	key := h.key(tokenType, labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if v, ok := h.values[key]; ok {
+		return v.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.writeHeader(w, "histogram"); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := h.values[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += v.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(key, "le", formatFloat(bound)), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(key, "le", "+Inf"), v.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", h.name, h.format(key), formatFloat(v.sum), h.name, h.format(key), v.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteRuntimeText writes goroutine and heap statistics of the process in the
+// Prometheus text exposition format, without token type labels.
+func WriteRuntimeText(w io.Writer) error {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	for _, gauge := range []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"go_goroutines", "Number of goroutines.", float64(runtime.NumGoroutine())},
+		{"go_memstats_heap_inuse_bytes", "Heap bytes in use.", float64(stats.HeapInuse)},
+		{"go_memstats_heap_objects", "Allocated heap objects.", float64(stats.HeapObjects)},
+		{"go_memstats_sys_bytes", "Bytes obtained from the system.", float64(stats.Sys)},
+	} {
+		s := series{name: gauge.name, help: gauge.help}
+		if err := s.writeHeader(w, "gauge"); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", gauge.name, formatFloat(gauge.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
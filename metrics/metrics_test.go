@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTokenTypeLabels(t *testing.T) {
+	if TokenTypeName(0x0003) != "rate-limited" || TokenTypeName(0x0002) != "basic" {
+		t.Fatal("unexpected token type names")
+	}
+	if TokenTypeName(0) != "unknown" || TokenTypeName(0xbeef) != "0xbeef" {
+		t.Fatal("unexpected names for unknown token types")
+	}
+	if DraftVersion(0xbeef) != "unknown" {
+		t.Fatal("unexpected draft version for unknown token type")
+	}
+
+	RegisterTokenType(0xbeef, "experimental", "draft-experimental-00")
+	if TokenTypeName(0xbeef) != "experimental" || DraftVersion(0xbeef) != "draft-experimental-00" {
+		t.Fatal("registered token type not used")
+	}
+}
+
+func TestCounter(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("requests_total", "Requests.", "code")
+	counter.Inc(0x0002, "200")
+	counter.Add(0x0002, 2, "200")
+	counter.Inc(0x0003, "429")
+
+	if counter.Value(0x0002, "200") != 3 {
+		t.Fatal("unexpected counter value")
+	}
+
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{token_type="basic",draft_version="draft-ietf-privacypass-protocol-07",code="200"} 3
+requests_total{token_type="rate-limited",draft_version="draft-privacypass-rate-limit-tokens-03",code="429"} 1
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected exposition:\n%s", buf.String())
+	}
+}
+
+func TestGauge(t *testing.T) {
+	registry := NewRegistry()
+	gauge := registry.NewGauge("stale", "Staleness.", "resource")
+	gauge.Set(0, 1, "directory")
+	gauge.Set(0, 0, "directory")
+	gauge.Add(0, 2, "directory")
+	gauge.Add(0, -2, "directory")
+
+	if gauge.Value(0, "directory") != 0 {
+		t.Fatal("unexpected gauge value")
+	}
+
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP stale Staleness.
+# TYPE stale gauge
+stale{token_type="unknown",draft_version="unknown",resource="directory"} 0
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected exposition:\n%s", buf.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	registry := NewRegistry()
+	histogram := registry.NewHistogram("duration_seconds", "Duration.", []float64{1, 0.1})
+	histogram.Observe(0x0002, 0.05)
+	histogram.Observe(0x0002, 0.5)
+	histogram.Observe(0x0002, 5)
+
+	if histogram.Count(0x0002) != 3 {
+		t.Fatal("unexpected histogram count")
+	}
+
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	labels := `token_type="basic",draft_version="draft-ietf-privacypass-protocol-07"`
+	for _, line := range []string{
+		`duration_seconds_bucket{` + labels + `,le="0.1"} 1`,
+		`duration_seconds_bucket{` + labels + `,le="1"} 2`,
+		`duration_seconds_bucket{` + labels + `,le="+Inf"} 3`,
+		`duration_seconds_sum{` + labels + `} 5.55`,
+		`duration_seconds_count{` + labels + `} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("requests_total", "Requests.", "code")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on missing label value")
+		}
+	}()
+	counter.Inc(0x0002)
+}
+
+func TestDuplicateMetric(t *testing.T) {
+	registry := NewRegistry()
+	registry.NewCounter("requests_total", "Requests.")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on duplicate metric")
+		}
+	}()
+	registry.NewCounter("requests_total", "Requests.")
+}
+
+func TestRuntimeText(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteRuntimeText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{"# TYPE go_goroutines gauge\n", "\ngo_goroutines ", "\ngo_memstats_heap_inuse_bytes "} {
+		if !strings.Contains(buf.String(), prefix) {
+			t.Fatalf("missing %q in:\n%s", prefix, buf.String())
+		}
+	}
+}
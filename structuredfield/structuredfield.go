@@ -0,0 +1,685 @@
+// Package structuredfield parses and serializes Structured Field Values for
+// HTTP (RFC 8941): items, lists, and dictionaries with parameters. Parsing is
+// strict, so that malformed headers are refused the same way everywhere,
+// with the offset and reason of the first error.
+package structuredfield
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Largest magnitude of integers
+	maxInteger = 999999999999999
+
+	// Largest magnitude of the integer part of decimals
+	maxDecimalIntegerPart = 999999999999
+)
+
+var ErrInvalid = errors.New("Invalid structured field")
+
+// Token is a token bare item, e.g., the true in Sec-Token-Attribute-*: true.
+type Token string
+
+// Param is a parameter of an item or inner list. Its value is a bare item.
+type Param struct {
+	Name  string
+	Value interface{}
+}
+
+// Params are the parameters of an item or inner list, in order.
+type Params []Param
+
+// Get returns the value of the named parameter.
+func (p Params) Get(name string) (interface{}, bool) {
+	for _, param := range p {
+		if param.Name == name {
+			return param.Value, true
+		}
+	}
+	return nil, false
+}
+
+// set adds the parameter, or overwrites its value in place if present.
+func (p Params) set(name string, value interface{}) Params {
+	for i := range p {
+		if p[i].Name == name {
+			p[i].Value = value
+			return p
+		}
+	}
+	return append(p, Param{name, value})
+}
+
+// Member is a member of a list or dictionary, an Item or an InnerList.
+type Member interface {
+	member()
+}
+
+// Item is a bare item with parameters. Values are int64 (Integer), float64
+// (Decimal), string (String), Token, []byte (Byte Sequence), or bool
+// (Boolean).
+type Item struct {
+	Value  interface{}
+	Params Params
+}
+
+// InnerList is a parenthesized list of items with parameters.
+type InnerList struct {
+	Items  []Item
+	Params Params
+}
+
+func (Item) member()      {}
+func (InnerList) member() {}
+
+// List is a list field value.
+type List []Member
+
+// DictMember is a named member of a dictionary.
+type DictMember struct {
+	Name   string
+	Member Member
+}
+
+// Dictionary is a dictionary field value, its members in order.
+type Dictionary []DictMember
+
+// Get returns the named member.
+func (d Dictionary) Get(name string) (Member, bool) {
+	for _, member := range d {
+		if member.Name == name {
+			return member.Member, true
+		}
+	}
+	return nil, false
+}
+
+// parser parses a field value, section 4.2.
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at offset %d", ErrInvalid, fmt.Sprintf(format, args...), p.pos)
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *parser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *parser) skipSP() {
+	for !p.done() && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *parser) skipOWS() {
+	for !p.done() && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// parse runs parse on the whole value, refusing characters left over.
+func parse(value string, parse func(p *parser) error) error {
+	p := &parser{input: value}
+	p.skipSP()
+	if err := parse(p); err != nil {
+		return err
+	}
+	p.skipSP()
+	if !p.done() {
+		return p.errorf("unexpected %q", p.peek())
+	}
+	return nil
+}
+
+// ParseItem parses an item field value.
+func ParseItem(value string) (Item, error) {
+	var item Item
+	err := parse(value, func(p *parser) (err error) {
+		item, err = p.parseItem()
+		return err
+	})
+	return item, err
+}
+
+// ParseList parses a list field value. Lists spread over several field
+// lines are parsed once joined with ", ".
+func ParseList(value string) (List, error) {
+	list := List{}
+	err := parse(value, func(p *parser) error {
+		for !p.done() {
+			member, err := p.parseMember()
+			if err != nil {
+				return err
+			}
+			list = append(list, member)
+			p.skipOWS()
+			if p.done() {
+				return nil
+			}
+			if p.peek() != ',' {
+				return p.errorf("expected ',' between list members, got %q", p.peek())
+			}
+			p.pos++
+			p.skipOWS()
+			if p.done() {
+				return p.errorf("trailing ','")
+			}
+		}
+		return nil
+	})
+	return list, err
+}
+
+// ParseDictionary parses a dictionary field value. Members named more than
+// once keep their first position and their last value.
+func ParseDictionary(value string) (Dictionary, error) {
+	dictionary := Dictionary{}
+	err := parse(value, func(p *parser) error {
+		for !p.done() {
+			name, err := p.parseKey()
+			if err != nil {
+				return err
+			}
+			var member Member
+			if p.peek() == '=' {
+				p.pos++
+				if member, err = p.parseMember(); err != nil {
+					return err
+				}
+			} else {
+				params, err := p.parseParams()
+				if err != nil {
+					return err
+				}
+				member = Item{Value: true, Params: params}
+			}
+			dictionary = dictionary.set(name, member)
+			p.skipOWS()
+			if p.done() {
+				return nil
+			}
+			if p.peek() != ',' {
+				return p.errorf("expected ',' between dictionary members, got %q", p.peek())
+			}
+			p.pos++
+			p.skipOWS()
+			if p.done() {
+				return p.errorf("trailing ','")
+			}
+		}
+		return nil
+	})
+	return dictionary, err
+}
+
+func (d Dictionary) set(name string, member Member) Dictionary {
+	for i := range d {
+		if d[i].Name == name {
+			d[i].Member = member
+			return d
+		}
+	}
+	return append(d, DictMember{name, member})
+}
+
+func (p *parser) parseMember() (Member, error) {
+	if p.peek() == '(' {
+		return p.parseInnerList()
+	}
+	return p.parseItem()
+}
+
+func (p *parser) parseInnerList() (InnerList, error) {
+	p.pos++ // (
+	items := []Item{}
+	for !p.done() {
+		p.skipSP()
+		if p.peek() == ')' {
+			p.pos++
+			params, err := p.parseParams()
+			if err != nil {
+				return InnerList{}, err
+			}
+			return InnerList{Items: items, Params: params}, nil
+		}
+		item, err := p.parseItem()
+		if err != nil {
+			return InnerList{}, err
+		}
+		items = append(items, item)
+		if c := p.peek(); c != ' ' && c != ')' {
+			return InnerList{}, p.errorf("expected ' ' or ')' after inner list item")
+		}
+	}
+	return InnerList{}, p.errorf("unterminated inner list")
+}
+
+func (p *parser) parseItem() (Item, error) {
+	value, err := p.parseBareItem()
+	if err != nil {
+		return Item{}, err
+	}
+	params, err := p.parseParams()
+	if err != nil {
+		return Item{}, err
+	}
+	return Item{Value: value, Params: params}, nil
+}
+
+func (p *parser) parseParams() (Params, error) {
+	var params Params
+	for p.peek() == ';' {
+		p.pos++
+		p.skipSP()
+		name, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		var value interface{} = true
+		if p.peek() == '=' {
+			p.pos++
+			if value, err = p.parseBareItem(); err != nil {
+				return nil, err
+			}
+		}
+		params = params.set(name, value)
+	}
+	return params, nil
+}
+
+func isLCAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'A' && c <= 'Z' || isLCAlpha(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isTChar tells whether c is a tchar of RFC 9110.
+func isTChar(c byte) bool {
+	return isAlpha(c) || isDigit(c) || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func (p *parser) parseKey() (string, error) {
+	if c := p.peek(); !isLCAlpha(c) && c != '*' {
+		return "", p.errorf("expected a key starting with a lowercase letter or '*'")
+	}
+	start := p.pos
+	for !p.done() {
+		c := p.peek()
+		if !isLCAlpha(c) && !isDigit(c) && c != '_' && c != '-' && c != '.' && c != '*' {
+			break
+		}
+		p.pos++
+	}
+	return p.input[start:p.pos], nil
+}
+
+func (p *parser) parseBareItem() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '-' || isDigit(c):
+		return p.parseNumber()
+	case c == '"':
+		return p.parseString()
+	case c == '*' || isAlpha(c):
+		return p.parseToken(), nil
+	case c == ':':
+		return p.parseByteSequence()
+	case c == '?':
+		return p.parseBoolean()
+	case p.done():
+		return nil, p.errorf("expected an item, got the end of the value")
+	default:
+		return nil, p.errorf("expected an item, got %q", c)
+	}
+}
+
+// parseNumber parses an integer or decimal, section 4.2.4.
+func (p *parser) parseNumber() (interface{}, error) {
+	start := p.pos
+	negative := p.peek() == '-'
+	if negative {
+		p.pos++
+	}
+	if !isDigit(p.peek()) {
+		return nil, p.errorf("expected a digit")
+	}
+	digitsStart, point := p.pos, -1
+	for !p.done() {
+		c := p.peek()
+		if c == '.' && point < 0 {
+			if p.pos-digitsStart > 12 {
+				return nil, p.errorf("decimal with more than 12 integer digits")
+			}
+			point = p.pos
+		} else if !isDigit(c) {
+			break
+		}
+		p.pos++
+		if point < 0 && p.pos-digitsStart > 15 {
+			return nil, p.errorf("integer with more than 15 digits")
+		}
+		if point >= 0 && p.pos-digitsStart > 16 {
+			return nil, p.errorf("decimal with more than 16 characters")
+		}
+	}
+	number := p.input[start:p.pos]
+	if point < 0 {
+		return strconv.ParseInt(number, 10, 64)
+	}
+	if fraction := p.pos - point - 1; fraction < 1 || fraction > 3 {
+		return nil, p.errorf("decimal with %d fractional digits, expected 1 to 3", fraction)
+	}
+	return strconv.ParseFloat(number, 64)
+}
+
+func (p *parser) parseString() (string, error) {
+	p.pos++ // "
+	var value strings.Builder
+	for !p.done() {
+		c := p.peek()
+		p.pos++
+		switch {
+		case c == '\\':
+			if next := p.peek(); next != '"' && next != '\\' {
+				return "", p.errorf("invalid escape in string")
+			}
+			value.WriteByte(p.peek())
+			p.pos++
+		case c == '"':
+			return value.String(), nil
+		case c < 0x20 || c > 0x7e:
+			p.pos--
+			return "", p.errorf("invalid character %q in string", c)
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *parser) parseToken() Token {
+	start := p.pos
+	p.pos++
+	for !p.done() {
+		if c := p.peek(); !isTChar(c) && c != ':' && c != '/' {
+			break
+		}
+		p.pos++
+	}
+	return Token(p.input[start:p.pos])
+}
+
+func (p *parser) parseByteSequence() ([]byte, error) {
+	p.pos++ // :
+	end := strings.IndexByte(p.input[p.pos:], ':')
+	if end < 0 {
+		return nil, p.errorf("expected ':' closing the byte sequence")
+	}
+	encoded := p.input[p.pos : p.pos+end]
+	for i := 0; i < len(encoded); i++ {
+		if c := encoded[i]; !isAlpha(c) && !isDigit(c) && c != '+' && c != '/' && c != '=' {
+			p.pos += i
+			return nil, p.errorf("invalid character %q in byte sequence", c)
+		}
+	}
+	// Padding is optional when parsing, section 4.2.7
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, p.errorf("invalid base64 in byte sequence")
+	}
+	p.pos += end + 1
+	return data, nil
+}
+
+func (p *parser) parseBoolean() (bool, error) {
+	p.pos++ // ?
+	switch p.peek() {
+	case '1':
+		p.pos++
+		return true, nil
+	case '0':
+		p.pos++
+		return false, nil
+	}
+	return false, p.errorf("expected ?0 or ?1")
+}
+
+// MarshalItem serializes an item field value, section 4.1.
+func MarshalItem(item Item) (string, error) {
+	var b strings.Builder
+	err := marshalItem(&b, item)
+	return b.String(), err
+}
+
+// MarshalList serializes a list field value.
+func MarshalList(list List) (string, error) {
+	var b strings.Builder
+	for i, member := range list {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if err := marshalMember(&b, member); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// MarshalDictionary serializes a dictionary field value. Members whose value
+// is true are serialized by name, with their parameters.
+func MarshalDictionary(dictionary Dictionary) (string, error) {
+	var b strings.Builder
+	for i, member := range dictionary {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		if err := marshalKey(&b, member.Name); err != nil {
+			return "", err
+		}
+		if item, ok := member.Member.(Item); ok && item.Value == true {
+			if err := marshalParams(&b, item.Params); err != nil {
+				return "", err
+			}
+			continue
+		}
+		b.WriteByte('=')
+		if err := marshalMember(&b, member.Member); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+func marshalMember(b *strings.Builder, member Member) error {
+	switch m := member.(type) {
+	case Item:
+		return marshalItem(b, m)
+	case InnerList:
+		b.WriteByte('(')
+		for i, item := range m.Items {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			if err := marshalItem(b, item); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(')')
+		return marshalParams(b, m.Params)
+	}
+	return fmt.Errorf("%w: unexpected member %T", ErrInvalid, member)
+}
+
+func marshalItem(b *strings.Builder, item Item) error {
+	if err := marshalBareItem(b, item.Value); err != nil {
+		return err
+	}
+	return marshalParams(b, item.Params)
+}
+
+func marshalParams(b *strings.Builder, params Params) error {
+	for _, param := range params {
+		b.WriteByte(';')
+		if err := marshalKey(b, param.Name); err != nil {
+			return err
+		}
+		if param.Value == true {
+			continue
+		}
+		b.WriteByte('=')
+		if err := marshalBareItem(b, param.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func marshalKey(b *strings.Builder, key string) error {
+	if key == "" || !isLCAlpha(key[0]) && key[0] != '*' {
+		return fmt.Errorf("%w: invalid key %q", ErrInvalid, key)
+	}
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; !isLCAlpha(c) && !isDigit(c) && c != '_' && c != '-' && c != '.' && c != '*' {
+			return fmt.Errorf("%w: invalid key %q", ErrInvalid, key)
+		}
+	}
+	b.WriteString(key)
+	return nil
+}
+
+func marshalBareItem(b *strings.Builder, value interface{}) error {
+	switch v := value.(type) {
+	case int64:
+		if v > maxInteger || v < -maxInteger {
+			return fmt.Errorf("%w: integer %d out of range", ErrInvalid, v)
+		}
+		b.WriteString(strconv.FormatInt(v, 10))
+	case int:
+		return marshalBareItem(b, int64(v))
+	case float64:
+		rounded := math.RoundToEven(v*1000) / 1000
+		if math.IsNaN(v) || math.Abs(rounded) >= maxDecimalIntegerPart+1 {
+			return fmt.Errorf("%w: decimal %v out of range", ErrInvalid, v)
+		}
+		decimal := strconv.FormatFloat(rounded, 'f', -1, 64)
+		if !strings.Contains(decimal, ".") {
+			decimal += ".0"
+		}
+		b.WriteString(decimal)
+	case string:
+		b.WriteByte('"')
+		for i := 0; i < len(v); i++ {
+			c := v[i]
+			if c < 0x20 || c > 0x7e {
+				return fmt.Errorf("%w: invalid character %q in string", ErrInvalid, c)
+			}
+			if c == '"' || c == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(c)
+		}
+		b.WriteByte('"')
+	case Token:
+		if v == "" || !isAlpha(v[0]) && v[0] != '*' {
+			return fmt.Errorf("%w: invalid token %q", ErrInvalid, v)
+		}
+		for i := 1; i < len(v); i++ {
+			if c := v[i]; !isTChar(c) && c != ':' && c != '/' {
+				return fmt.Errorf("%w: invalid token %q", ErrInvalid, v)
+			}
+		}
+		b.WriteString(string(v))
+	case []byte:
+		b.WriteByte(':')
+		b.WriteString(base64.StdEncoding.EncodeToString(v))
+		b.WriteByte(':')
+	case bool:
+		if v {
+			b.WriteString("?1")
+		} else {
+			b.WriteString("?0")
+		}
+	default:
+		return fmt.Errorf("%w: unexpected item %T", ErrInvalid, value)
+	}
+	return nil
+}
+
+// MarshalBinary serializes a byte sequence item without parameters, which
+// cannot fail.
+func MarshalBinary(data []byte) string {
+	return ":" + base64.StdEncoding.EncodeToString(data) + ":"
+}
+
+// MarshalInteger serializes an integer item without parameters.
+func MarshalInteger(integer int64) (string, error) {
+	return MarshalItem(Item{Value: integer})
+}
+
+// ParseBinary parses an item field value that must be a byte sequence.
+// Parameters are ignored.
+func ParseBinary(value string) ([]byte, error) {
+	item, err := ParseItem(value)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := item.Value.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected a byte sequence, got %s", ErrInvalid, describe(item.Value))
+	}
+	return data, nil
+}
+
+// ParseInteger parses an item field value that must be an integer.
+// Parameters are ignored.
+func ParseInteger(value string) (int64, error) {
+	item, err := ParseItem(value)
+	if err != nil {
+		return 0, err
+	}
+	integer, ok := item.Value.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%w: expected an integer, got %s", ErrInvalid, describe(item.Value))
+	}
+	return integer, nil
+}
+
+// describe names the type of a bare item for error messages.
+func describe(value interface{}) string {
+	switch value.(type) {
+	case int64:
+		return "an integer"
+	case float64:
+		return "a decimal"
+	case string:
+		return "a string"
+	case Token:
+		return "a token"
+	case []byte:
+		return "a byte sequence"
+	case bool:
+		return "a boolean"
+	}
+	return fmt.Sprintf("%T", value)
+}
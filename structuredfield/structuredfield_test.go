@@ -0,0 +1,138 @@
+package structuredfield
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseItem(t *testing.T) {
+	// Examples of RFC 8941, section 3.3
+	for value, expected := range map[string]interface{}{
+		"42":                       int64(42),
+		"-17":                      int64(-17),
+		"4.5":                      4.5,
+		`"hello world"`:            "hello world",
+		`"a \"quoted\" \\ string"`: `a "quoted" \ string`,
+		"foo123/456":               Token("foo123/456"),
+		":cHJldGVuZCB0aGlzIGlzIGJpbmFyeSBjb250ZW50Lg==:": []byte("pretend this is binary content."),
+		"?1": true,
+		"?0": false,
+	} {
+		item, err := ParseItem(value)
+		if err != nil {
+			t.Fatalf("%s: %v", value, err)
+		}
+		if !reflect.DeepEqual(item.Value, expected) {
+			t.Fatalf("%s: expected %#v, got %#v", value, expected, item.Value)
+		}
+		marshaled, err := MarshalItem(item)
+		if err != nil || marshaled != value {
+			t.Fatalf("expected %s to round trip, got %s, %v", value, marshaled, err)
+		}
+	}
+
+	item, err := ParseItem(`  5; foo=bar;baz  `)
+	if err != nil || item.Value != int64(5) || len(item.Params) != 2 {
+		t.Fatalf("unexpected item %+v, %v", item, err)
+	}
+	if value, _ := item.Params.Get("foo"); value != Token("bar") {
+		t.Fatalf("unexpected parameter %v", value)
+	}
+	if value, _ := item.Params.Get("baz"); value != true {
+		t.Fatalf("unexpected parameter %v", value)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"1234567890123456", // 16 digits
+		"1.2345",           // 4 fractional digits
+		"1.",               // no fractional digit
+		`"unterminated`,    // string
+		`"bad \n escape"`,  // only \" and \\ escape
+		":cHJldGVuZA",      // unterminated byte sequence
+		":cHJl*GVuZA==:",   // not base64
+		"?2",               // boolean
+		"5;Foo=1",          // keys are lowercase
+		"5, 6",             // items are not lists
+		"\tfoo",            // leading whitespace is SP only
+		"foo bar",          // trailing characters
+	} {
+		if _, err := ParseItem(value); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("expected %q to be refused, got %v", value, err)
+		}
+	}
+	if _, err := ParseList("sugar, tea,"); !errors.Is(err, ErrInvalid) {
+		t.Fatal("expected a trailing comma to be refused")
+	}
+	if _, err := ParseList(`("foo" "bar"`); !errors.Is(err, ErrInvalid) {
+		t.Fatal("expected an unterminated inner list to be refused")
+	}
+}
+
+func TestParseList(t *testing.T) {
+	// Examples of RFC 8941, sections 3.1 and 3.1.1
+	list, err := ParseList(`("foo" "bar"), ("baz"), ("bat" "one"), ()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 || len(list[0].(InnerList).Items) != 2 || len(list[3].(InnerList).Items) != 0 {
+		t.Fatalf("unexpected list %+v", list)
+	}
+	list, err = ParseList(`abc;a=1;b=2; cde_456, (ghi;jk=4 l);q="9";r=w`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := list[1].(InnerList)
+	if q, _ := inner.Params.Get("q"); q != "9" || inner.Items[1].Value != Token("l") {
+		t.Fatalf("unexpected inner list %+v", inner)
+	}
+	marshaled, err := MarshalList(list)
+	if err != nil || marshaled != `abc;a=1;b=2;cde_456, (ghi;jk=4 l);q="9";r=w` {
+		t.Fatalf("unexpected serialization %s, %v", marshaled, err)
+	}
+}
+
+func TestParseDictionary(t *testing.T) {
+	// Examples of RFC 8941, section 3.2
+	dictionary, err := ParseDictionary(`en="Applepie", da=:w4ZibGV0w6ZydGU=:`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if en, _ := dictionary.Get("en"); en.(Item).Value != "Applepie" {
+		t.Fatalf("unexpected member %+v", en)
+	}
+	if da, _ := dictionary.Get("da"); !bytes.Equal(da.(Item).Value.([]byte), []byte("\xc3\x86blet\xc3\xa6rte")) {
+		t.Fatalf("unexpected member %+v", da)
+	}
+
+	dictionary, err = ParseDictionary(`a=?0, b, c; foo=bar, a=1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	marshaled, err := MarshalDictionary(dictionary)
+	if err != nil || marshaled != "a=1, b, c;foo=bar" {
+		t.Fatalf("unexpected serialization %s, %v", marshaled, err)
+	}
+}
+
+func TestTypedItems(t *testing.T) {
+	if data, err := ParseBinary(MarshalBinary([]byte{0xff, 0x00})); err != nil || !bytes.Equal(data, []byte{0xff, 0x00}) {
+		t.Fatalf("unexpected byte sequence %x, %v", data, err)
+	}
+	if _, err := ParseBinary("42"); err == nil || err.Error() != "Invalid structured field: expected a byte sequence, got an integer" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if integer, err := ParseInteger("100;unit=tokens"); err != nil || integer != 100 {
+		t.Fatalf("unexpected integer %d, %v", integer, err)
+	}
+	if _, err := MarshalItem(Item{Value: int64(1e15)}); !errors.Is(err, ErrInvalid) {
+		t.Fatal("expected an integer out of range to be refused")
+	}
+	if marshaled, _ := MarshalItem(Item{Value: 1.0005}); marshaled != "1.0" {
+		t.Fatalf("expected decimals rounded to 3 digits, got %s", marshaled)
+	}
+}